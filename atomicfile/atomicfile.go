@@ -19,10 +19,10 @@ import (
 func WriteFile(filename string, data []byte, perm os.FileMode) error {
 	tmpname := filename + ".new.tmp"
 	if err := ioutil.WriteFile(tmpname, data, perm); err != nil {
-		return fmt.Errorf("%#v: %v", tmpname, err)
+		return fmt.Errorf("%#v: %w", tmpname, err)
 	}
 	if err := os.Rename(tmpname, filename); err != nil {
-		return fmt.Errorf("%#v->%#v: %v", tmpname, filename, err)
+		return fmt.Errorf("%#v->%#v: %w", tmpname, filename, err)
 	}
 	return nil
 }
@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bootstrapDNSRefresh is how often the bootstrap DNS names are
+// looked up again.
+const bootstrapDNSRefresh = 10 * time.Minute
+
+// bootstrapDNS serves /bootstrap-dns: the addresses of a fixed set of
+// names (such as the control server's), looked up periodically by the
+// DERP server. Clients whose own DNS is broken fetch it from a DERP
+// server's hardcoded IP; see package tailscale.com/net/dnsfallback.
+type bootstrapDNS struct {
+	names []string
+
+	mu  sync.Mutex
+	ips map[string][]net.IP // last successful lookup of each name
+}
+
+func newBootstrapDNS(names string) *bootstrapDNS {
+	b := &bootstrapDNS{ips: map[string][]net.IP{}}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			b.names = append(b.names, name)
+		}
+	}
+	return b
+}
+
+// refresh looks up all names, keeping the previous answer for any
+// that fail.
+func (b *bootstrapDNS) refresh() {
+	for _, name := range b.names {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		cancel()
+		if err != nil {
+			log.Printf("bootstrap DNS lookup %q: %v", name, err)
+			continue
+		}
+		ips := make([]net.IP, len(addrs))
+		for i, a := range addrs {
+			ips[i] = a.IP
+		}
+		b.mu.Lock()
+		b.ips[name] = ips
+		b.mu.Unlock()
+	}
+}
+
+func (b *bootstrapDNS) refreshLoop() {
+	for {
+		b.refresh()
+		time.Sleep(bootstrapDNSRefresh)
+	}
+}
+
+// ServeHTTP serves the addresses of all names as a JSON object, or
+// just of the name in the "q" parameter, if present.
+func (b *bootstrapDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.FormValue("q")
+	ret := map[string][]net.IP{}
+	b.mu.Lock()
+	for name, ips := range b.ips {
+		if q == "" || q == name {
+			ret[name] = ips
+		}
+	}
+	b.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
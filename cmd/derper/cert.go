@@ -0,0 +1,286 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"tailscale.com/metrics"
+)
+
+// certExpiryWarning is how close to expiry a cert can get before
+// /debug/check reports it. LetsEncrypt certs are renewed 30 days
+// before they expire, so getting this close means renewal is failing.
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// manualReloadInterval is how often manual mode checks whether the
+// cert files changed.
+const manualReloadInterval = 10 * time.Second
+
+// certProvider provides the TLS cert for the DERP server.
+type certProvider interface {
+	// TLSConfig returns the TLS config for the HTTPS listener.
+	TLSConfig() *tls.Config
+	// HTTPHandler handles the plain HTTP requests on port 80,
+	// passing those it doesn't handle to fallback.
+	HTTPHandler(fallback http.Handler) http.Handler
+}
+
+func certProviderByCertMode(mode, dir, hostname string) (certProvider, error) {
+	if dir == "" {
+		return nil, errors.New("missing required --certdir flag")
+	}
+	switch mode {
+	case "letsencrypt":
+		certManager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hostname),
+			Cache:      autocert.DirCache(dir),
+		}
+		if hostname == "derp.tailscale.com" {
+			certManager.HostPolicy = prodAutocertHostPolicy
+			certManager.Email = "security@tailscale.com"
+		}
+		return &letsEncryptManager{m: certManager, http01: *acmeHTTP01}, nil
+	case "manual":
+		return newManualCertManager(dir, hostname)
+	default:
+		return nil, fmt.Errorf("unsupported cert mode: %q", mode)
+	}
+}
+
+// letsEncryptManager gets certs from LetsEncrypt. It always answers
+// TLS-ALPN-01 challenges, and HTTP-01 challenges if http01 is set.
+type letsEncryptManager struct {
+	m      *autocert.Manager
+	http01 bool
+}
+
+func (lm *letsEncryptManager) TLSConfig() *tls.Config {
+	cfg := lm.m.TLSConfig()
+	getCert := cfg.GetCertificate
+	cfg.GetCertificate = func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := getCert(hi)
+		for _, proto := range hi.SupportedProtos {
+			if proto == acme.ALPNProto {
+				// A TLS-ALPN-01 challenge, not our real cert.
+				return cert, err
+			}
+		}
+		if err != nil {
+			// Only count failures for names we'd get a cert for,
+			// not every client asking for some other name.
+			if lm.m.HostPolicy(context.Background(), hi.ServerName) == nil {
+				certStatus.noteError(err)
+			}
+			return nil, err
+		}
+		certStatus.noteCert(cert)
+		return cert, nil
+	}
+	return cfg
+}
+
+func (lm *letsEncryptManager) HTTPHandler(fallback http.Handler) http.Handler {
+	if !lm.http01 {
+		return fallback
+	}
+	return lm.m.HTTPHandler(fallback)
+}
+
+// manualCertManager serves a cert provisioned by the operator as
+// <dir>/<hostname>.crt and <dir>/<hostname>.key, reloading it when
+// the files change so renewing it doesn't need a restart.
+type manualCertManager struct {
+	certFile, keyFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time // newest modification time of the files cert came from
+	lastCheck time.Time
+}
+
+func newManualCertManager(dir, hostname string) (*manualCertManager, error) {
+	m := &manualCertManager{
+		certFile: filepath.Join(dir, hostname+".crt"),
+		keyFile:  filepath.Join(dir, hostname+".key"),
+	}
+	modTime, err := m.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.load(modTime); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// filesModTime returns the newest modification time of the cert files.
+func (m *manualCertManager) filesModTime() (time.Time, error) {
+	var newest time.Time
+	for _, f := range []string{m.certFile, m.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// load loads the cert files, which were last modified at modTime.
+func (m *manualCertManager) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(m.certFile, m.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading cert: %v", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("parsing cert: %v", err)
+	}
+	m.mu.Lock()
+	m.cert = &cert
+	m.modTime = modTime
+	m.mu.Unlock()
+	certStatus.noteCert(&cert)
+	return nil
+}
+
+// reloadIfChanged reloads the cert if its files changed. On failure,
+// the previous cert stays in use.
+func (m *manualCertManager) reloadIfChanged() {
+	m.mu.Lock()
+	if time.Since(m.lastCheck) < manualReloadInterval {
+		m.mu.Unlock()
+		return
+	}
+	m.lastCheck = time.Now()
+	prev := m.modTime
+	m.mu.Unlock()
+
+	modTime, err := m.filesModTime()
+	if err != nil {
+		certStatus.noteError(err)
+		return
+	}
+	if modTime.Equal(prev) {
+		return
+	}
+	if err := m.load(modTime); err != nil {
+		certStatus.noteError(err)
+	}
+}
+
+func (m *manualCertManager) getCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.reloadIfChanged()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cert, nil
+}
+
+func (m *manualCertManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.getCertificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+}
+
+func (m *manualCertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return fallback
+}
+
+// certStatus tracks the health of the cert being served.
+var certStatus = newCertHealth()
+
+type certHealth struct {
+	errors expvar.Int
+
+	mu        sync.Mutex
+	notAfter  time.Time // expiry of the cert last served; zero if none yet
+	lastErr   error
+	lastErrAt time.Time
+}
+
+func newCertHealth() *certHealth {
+	h := new(certHealth)
+	stats := new(metrics.Set)
+	stats.Set("counter_errors", &h.errors)
+	stats.Set("gauge_expiry_seconds", expvar.Func(func() interface{} {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.notAfter.IsZero() {
+			return 0
+		}
+		return int64(time.Until(h.notAfter).Seconds())
+	}))
+	expvar.Publish("derper_cert", stats)
+	return h
+}
+
+func (h *certHealth) noteCert(cert *tls.Certificate) {
+	leaf := cert.Leaf
+	if leaf == nil && len(cert.Certificate) > 0 {
+		leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if leaf == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.notAfter = leaf.NotAfter
+}
+
+func (h *certHealth) noteError(err error) {
+	h.errors.Add(1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastErr = err
+	h.lastErrAt = time.Now()
+}
+
+// String describes the cert's expiry and the last error getting it,
+// for the debug page.
+func (h *certHealth) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := "none served yet"
+	if !h.notAfter.IsZero() {
+		s = fmt.Sprintf("expires %v (in %v)", h.notAfter.Format(time.RFC3339), time.Until(h.notAfter).Round(time.Hour))
+	}
+	if h.lastErr != nil {
+		s += fmt.Sprintf("; last error %v ago: %v", time.Since(h.lastErrAt).Round(time.Second), h.lastErr)
+	}
+	return s
+}
+
+// check returns an error if the cert served expires soon, meaning
+// it's not being renewed.
+func (h *certHealth) check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.notAfter.IsZero() {
+		return nil
+	}
+	if left := time.Until(h.notAfter); left < certExpiryWarning {
+		if h.lastErr != nil {
+			return fmt.Errorf("cert expires in %v; last renewal error: %v", left.Round(time.Hour), h.lastErr)
+		}
+		return fmt.Errorf("cert expires in %v", left.Round(time.Hour))
+	}
+	return nil
+}
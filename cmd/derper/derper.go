@@ -7,11 +7,13 @@ package main // import "tailscale.com/cmd/derper"
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
 	"log"
@@ -20,31 +22,37 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
-	"golang.org/x/crypto/acme/autocert"
 	"tailscale.com/atomicfile"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/logpolicy"
-	"tailscale.com/metrics"
-	"tailscale.com/net/stun"
+	"tailscale.com/net/stun/stunserver"
 	"tailscale.com/tsweb"
 	"tailscale.com/types/key"
 )
 
 var (
-	dev           = flag.Bool("dev", false, "run in localhost development mode")
-	addr          = flag.String("a", ":443", "server address")
-	configPath    = flag.String("c", "", "config file path")
-	certDir       = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
-	hostname      = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443")
-	logCollection = flag.String("logcollection", "", "If non-empty, logtail collection to log to")
-	runSTUN       = flag.Bool("stun", false, "also run a STUN server")
-	meshPSKFile   = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
-	meshWith      = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
+	dev               = flag.Bool("dev", false, "run in localhost development mode")
+	addr              = flag.String("a", ":443", "server address")
+	configPath        = flag.String("c", "", "config file path")
+	certDir           = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
+	hostname          = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443")
+	logCollection     = flag.String("logcollection", "", "If non-empty, logtail collection to log to")
+	certMode          = flag.String("certmode", "letsencrypt", "mode for getting a cert, if addr's port is :443: letsencrypt, or manual to serve <certdir>/<hostname>.{crt,key}, reloaded when they change")
+	acmeHTTP01        = flag.Bool("acme-http-01", true, "with --certmode=letsencrypt, also answer ACME HTTP-01 challenges on port 80; TLS-ALPN-01 challenges on the TLS port are always answered")
+	runSTUN           = flag.Bool("stun", false, "also run a STUN server")
+	stunPort          = flag.Int("stun-port", 3478, "UDP port for the STUN server to listen on, with --stun")
+	meshPSKFile       = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
+	clientBPS         = flag.Int("client-bytes-per-sec", 0, "if non-zero, the most bytes per second each client may send; packets over the limit are dropped")
+	clientPPS         = flag.Int("client-packets-per-sec", 0, "if non-zero, the most packets per second each client may send; packets over the limit are dropped")
+	meshWith          = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
+	bootstrapDNSNames = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to resolve for clients whose own DNS is broken, served at /bootstrap-dns")
 )
 
 type config struct {
@@ -118,9 +126,11 @@ func main() {
 
 	cfg := loadConfig()
 
-	letsEncrypt := tsweb.IsProd443(*addr)
+	serveTLS := tsweb.IsProd443(*addr)
 
 	s := derp.NewServer(key.Private(cfg.PrivateKey), log.Printf)
+	s.BytesPerSecond = *clientBPS
+	s.PacketsPerSecond = *clientPPS
 
 	if *meshPSKFile != "" {
 		b, err := ioutil.ReadFile(*meshPSKFile)
@@ -142,6 +152,11 @@ func main() {
 	// Create our own mux so we don't expose /debug/ stuff to the world.
 	mux := tsweb.NewMux(debugHandler(s))
 	mux.Handle("/derp", derphttp.Handler(s))
+	if *bootstrapDNSNames != "" {
+		bs := newBootstrapDNS(*bootstrapDNSNames)
+		go bs.refreshLoop()
+		mux.Handle("/bootstrap-dns", bs)
+	}
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(200)
@@ -169,20 +184,13 @@ func main() {
 	}
 
 	var err error
-	if letsEncrypt {
-		if *certDir == "" {
-			log.Fatalf("missing required --certdir flag")
-		}
-		log.Printf("derper: serving on %s with TLS", *addr)
-		certManager := &autocert.Manager{
-			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(*hostname),
-			Cache:      autocert.DirCache(*certDir),
-		}
-		if *hostname == "derp.tailscale.com" {
-			certManager.HostPolicy = prodAutocertHostPolicy
-			certManager.Email = "security@tailscale.com"
+	if serveTLS {
+		var certManager certProvider
+		certManager, err = certProviderByCertMode(*certMode, *certDir, *hostname)
+		if err != nil {
+			log.Fatalf("derper: can not start cert provider: %v", err)
 		}
+		log.Printf("derper: serving on %s with TLS (certmode=%s)", *addr, *certMode)
 		httpsrv.TLSConfig = certManager.TLSConfig()
 		go func() {
 			err := http.ListenAndServe(":80", certManager.HTTPHandler(tsweb.Port80Handler{mux}))
@@ -206,6 +214,9 @@ func debugHandler(s *derp.Server) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.RequestURI == "/debug/check" {
 			err := s.ConsistencyCheck()
+			if err == nil {
+				err = certStatus.check()
+			}
 			if err != nil {
 				http.Error(w, err.Error(), 500)
 			} else {
@@ -213,6 +224,14 @@ func debugHandler(s *derp.Server) http.Handler {
 			}
 			return
 		}
+		if r.URL.Path == "/debug/clients" {
+			serveClients(w, r, s)
+			return
+		}
+		if r.URL.Path == "/debug/disconnect" {
+			serveDisconnect(w, r, s)
+			return
+		}
 		f := func(format string, args ...interface{}) { fmt.Fprintf(w, format, args...) }
 		f(`<html><body>
 <h1>DERP debug</h1>
@@ -221,6 +240,7 @@ func debugHandler(s *derp.Server) http.Handler {
 		f("<li><b>Hostname:</b> %v</li>\n", *hostname)
 		f("<li><b>Uptime:</b> %v</li>\n", tsweb.Uptime())
 		f("<li><b>Mesh Key:</b> %v</li>\n", s.HasMeshKey())
+		f("<li><b>Cert:</b> %s</li>\n", html.EscapeString(certStatus.String()))
 
 		f(`<li><a href="/debug/vars">/debug/vars</a> (Go)</li>
    <li><a href="/debug/varz">/debug/varz</a> (Prometheus)</li>
@@ -228,74 +248,107 @@ func debugHandler(s *derp.Server) http.Handler {
    <li><a href="/debug/pprof/goroutine?debug=1">/debug/pprof/goroutine</a> (collapsed)</li>
    <li><a href="/debug/pprof/goroutine?debug=2">/debug/pprof/goroutine</a> (full)</li>
    <li><a href="/debug/check">/debug/check</a> internal consistency check</li>
+   <li><a href="/debug/clients">/debug/clients</a> connected clients (<a href="/debug/clients?json=1">JSON</a>)</li>
 <ul>
 </html>
 `)
 	})
 }
 
-func serveSTUN() {
-	pc, err := net.ListenPacket("udp", ":3478")
-	if err != nil {
-		log.Fatalf("failed to open STUN listener: %v", err)
+// serveClients serves /debug/clients, the traffic of each connected
+// client and why packets were dropped. Clients are only identified by
+// a prefix of their key.
+func serveClients(w http.ResponseWriter, r *http.Request, s *derp.Server) {
+	clients := s.ClientStats()
+	drops := s.PacketsDroppedByReason()
+	if r.FormValue("json") != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Clients       []derp.ClientStats
+			DroppedReason map[string]int64
+		}{clients, drops})
+		return
 	}
-	log.Printf("running STUN server on %v", pc.LocalAddr())
-
-	var (
-		stats           = new(metrics.Set)
-		stunDisposition = &metrics.LabelMap{Label: "disposition"}
-		stunAddrFamily  = &metrics.LabelMap{Label: "family"}
 
-		stunReadError  = stunDisposition.Get("read_error")
-		stunNotSTUN    = stunDisposition.Get("not_stun")
-		stunWriteError = stunDisposition.Get("write_error")
-		stunSuccess    = stunDisposition.Get("success")
+	f := func(format string, args ...interface{}) { fmt.Fprintf(w, format, args...) }
+	f("<html><body>\n<h1>DERP clients</h1>\n")
+	f("<h2>Packets dropped</h2>\n<ul>\n")
+	reasons := make([]string, 0, len(drops))
+	for reason := range drops {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		f("<li><b>%s:</b> %d</li>\n", html.EscapeString(reason), drops[reason])
+	}
+	f("</ul>\n")
 
-		stunIPv4 = stunAddrFamily.Get("ipv4")
-		stunIPv6 = stunAddrFamily.Get("ipv6")
-	)
-	stats.Set("counter_requests", stunDisposition)
-	stats.Set("counter_addrfamily", stunAddrFamily)
-	expvar.Publish("stun", stats)
+	now := time.Now()
+	f("<h2>%d connected</h2>\n", len(clients))
+	f("<table border=1 cellpadding=3>\n")
+	f("<tr><th>Key</th><th>Connected</th><th>Mesh</th><th>Pkts in</th><th>Bytes in</th><th>Pkts out</th><th>Bytes out</th><th>Dropped</th><th>Rate limited</th></tr>\n")
+	for _, c := range clients {
+		f("<tr><td>%s</td><td>%v</td><td>%v</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td></tr>\n",
+			html.EscapeString(c.Key), now.Sub(c.ConnectedAt).Round(time.Second), c.Mesh,
+			c.PacketsRecv, c.BytesRecv, c.PacketsSent, c.BytesSent, c.PacketsDropped, c.PacketsRateLimited)
+	}
+	f("</table>\n")
+	f("<p>To disconnect a client, POST to /debug/disconnect?key=<i>key</i> with the mesh key as a bearer token, optionally with &amp;ban=<i>duration</i> to keep it from reconnecting.</p>\n")
+	f("</body></html>\n")
+}
 
-	var buf [64 << 10]byte
-	for {
-		n, addr, err := pc.ReadFrom(buf[:])
-		if err != nil {
-			log.Printf("STUN ReadFrom: %v", err)
-			time.Sleep(time.Second)
-			stunReadError.Add(1)
-			continue
-		}
-		ua, ok := addr.(*net.UDPAddr)
-		if !ok {
-			log.Printf("STUN unexpected address %T %v", addr, addr)
-			stunReadError.Add(1)
-			continue
-		}
-		pkt := buf[:n]
-		if !stun.Is(pkt) {
-			stunNotSTUN.Add(1)
-			continue
-		}
-		txid, err := stun.ParseBindingRequest(pkt)
-		if err != nil {
-			stunNotSTUN.Add(1)
-			continue
-		}
-		if ua.IP.To4() != nil {
-			stunIPv4.Add(1)
-		} else {
-			stunIPv6.Add(1)
-		}
-		res := stun.Response(txid, ua.IP, uint16(ua.Port))
-		_, err = pc.WriteTo(res, addr)
-		if err != nil {
-			stunWriteError.Add(1)
-		} else {
-			stunSuccess.Add(1)
+// serveDisconnect serves /debug/disconnect, which disconnects the
+// client given by the key parameter (as shown on /debug/clients, or
+// in full as hex) and optionally bans it for the ban duration.
+//
+// The debug pages are open to the whole tailnet, so disconnecting
+// also needs the mesh key, which only the server's operators have,
+// as a bearer token. Without a mesh key, it's disabled.
+func serveDisconnect(w http.ResponseWriter, r *http.Request, s *derp.Server) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.HasMeshKey() {
+		http.Error(w, "disconnecting clients requires --mesh-psk-file", http.StatusForbidden)
+		return
+	}
+	if !hasBearerToken(r, s.MeshKey()) {
+		http.Error(w, "mesh key required", http.StatusUnauthorized)
+		return
+	}
+	var ban time.Duration
+	if v := r.FormValue("ban"); v != "" {
+		var err error
+		if ban, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "bad ban duration: "+err.Error(), http.StatusBadRequest)
+			return
 		}
 	}
+	if err := s.DisconnectClient(r.FormValue("key"), ban); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	io.WriteString(w, "disconnected\n")
+}
+
+// hasBearerToken reports whether r's Authorization header carries
+// token as a bearer token.
+func hasBearerToken(r *http.Request, token string) bool {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return false
+	}
+	got := strings.TrimPrefix(h, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func serveSTUN() {
+	s := stunserver.New(log.Printf)
+	expvar.Publish("stun", s.ExpVar())
+	if err := s.ListenAndServe(net.JoinHostPort("", strconv.Itoa(*stunPort))); err != nil {
+		log.Fatalf("STUN server: %v", err)
+	}
 }
 
 var validProdHostname = regexp.MustCompile(`^derp([^.]*)\.tailscale\.com\.?$`)
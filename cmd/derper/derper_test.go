@@ -6,7 +6,19 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestProdAutocertHostPolicy(t *testing.T) {
@@ -31,5 +43,120 @@ func TestProdAutocertHostPolicy(t *testing.T) {
 			t.Errorf("f(%q) = %v; want %v", tt.in, got, tt.wantOK)
 		}
 	}
+}
+
+// writeTestCert writes a self-signed cert for host, valid until
+// notAfter, to dir in the layout manual cert mode expects.
+func writeTestCert(t *testing.T, dir, host string, notAfter time.Time) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, host+".crt"), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, host+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManualCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "derper-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const host = "derp.example.com"
+	first := time.Now().Add(5 * 24 * time.Hour).Truncate(time.Second)
+	writeTestCert(t, dir, host, first)
+
+	m, err := newManualCertManager(dir, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() time.Time {
+		t.Helper()
+		m.mu.Lock()
+		m.lastCheck = time.Time{} // don't wait for manualReloadInterval
+		m.mu.Unlock()
+		cert, err := m.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Leaf.NotAfter
+	}
+	if got := get(); !got.Equal(first) {
+		t.Errorf("NotAfter = %v; want %v", got, first)
+	}
+	if err := certStatus.check(); err == nil {
+		t.Error("check passed for a cert expiring in 5 days")
+	}
 
+	second := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	writeTestCert(t, dir, host, second)
+	// Make sure the change is visible even with coarse mtimes.
+	later := time.Now().Add(time.Minute)
+	for _, ext := range []string{".crt", ".key"} {
+		if err := os.Chtimes(filepath.Join(dir, host+ext), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := get(); !got.Equal(second) {
+		t.Errorf("after reload, NotAfter = %v; want %v", got, second)
+	}
+	if err := certStatus.check(); err != nil {
+		t.Errorf("check: %v", err)
+	}
+
+	// A broken replacement keeps the previous cert.
+	if err := ioutil.WriteFile(filepath.Join(dir, host+".crt"), []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, host+".crt"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(); !got.Equal(second) {
+		t.Errorf("after bad reload, NotAfter = %v; want %v", got, second)
+	}
+}
+
+func TestHasBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"Bearer s3cret", true},
+		{"Bearer wrong", false},
+		{"s3cret", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/debug/disconnect", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if got := hasBearerToken(r, "s3cret"); got != tt.want {
+			t.Errorf("hasBearerToken with %q = %v; want %v", tt.header, got, tt.want)
+		}
+	}
 }
@@ -0,0 +1,187 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/atomicfile"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+var configureCmd = &ffcli.Command{
+	Name:       "configure",
+	ShortUsage: "configure <subcommand>",
+	ShortHelp:  "Configure other software to work with Tailscale",
+	Subcommands: []*ffcli.Command{
+		configureDNSCmd,
+	},
+	Exec: func(context.Context, []string) error { return flag.ErrHelp },
+}
+
+var configureDNSCmd = &ffcli.Command{
+	Name:       "dns",
+	ShortUsage: "configure dns --downstream=dnsmasq|coredns [--write=file [--reload=command] [--watch]]",
+	ShortHelp:  "Print config for a local DNS server to forward Tailscale names to MagicDNS",
+	LongHelp: strings.TrimSpace(`
+"tailscale configure dns" prints the config that makes a caching DNS server
+already running on this machine (one that owns port 53, so the OS can't be
+pointed at MagicDNS directly) forward the tailnet's DNS zones to MagicDNS.
+
+With --write, the config is written to a file instead, and --reload is run
+if it changed. With --watch as well, the file is kept up to date as the
+zones change. For example:
+
+	tailscale configure dns --downstream=dnsmasq --watch \
+		--write=/etc/dnsmasq.d/tailscale-zones.conf \
+		--reload="systemctl restart dnsmasq"
+
+For CoreDNS, add "import /etc/coredns/tailscale.conf" to the Corefile and
+write that file; with CoreDNS's reload plugin, no --reload is needed.
+`),
+	Exec: runConfigureDNS,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("dns", flag.ExitOnError)
+		fs.StringVar(&configureDNSArgs.downstream, "downstream", "", "the local DNS server: dnsmasq or coredns")
+		fs.StringVar(&configureDNSArgs.write, "write", "", "file to write the config to, rather than printing it")
+		fs.StringVar(&configureDNSArgs.reload, "reload", "", "with --write, command to run after the file changes")
+		fs.BoolVar(&configureDNSArgs.watch, "watch", false, "with --write, keep running and update the file when the zones change")
+		return fs
+	})(),
+}
+
+var configureDNSArgs struct {
+	downstream string
+	write      string
+	reload     string
+	watch      bool
+}
+
+func runConfigureDNS(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	switch configureDNSArgs.downstream {
+	case "dnsmasq", "coredns":
+	case "":
+		return errors.New("--downstream is required")
+	default:
+		return fmt.Errorf("unknown --downstream %q; want dnsmasq or coredns", configureDNSArgs.downstream)
+	}
+	if configureDNSArgs.write == "" && (configureDNSArgs.reload != "" || configureDNSArgs.watch) {
+		return errors.New("--reload and --watch need --write")
+	}
+
+	c, bc, ctx, cancel := connect(ctx)
+	defer cancel()
+
+	bc.AllowVersionSkew = true
+
+	ch := make(chan *ipnstate.Status, 1)
+	changed := make(chan struct{}, 1)
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		if n.ErrMessage != nil {
+			log.Fatal(*n.ErrMessage)
+		}
+		if n.Status != nil {
+			ch <- n.Status
+		}
+		if n.NetMap != nil || n.Prefs != nil {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	})
+	go pump(ctx, bc, c)
+
+	for {
+		bc.RequestStatus()
+		var st *ipnstate.Status
+		select {
+		case st = <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if st.MagicDNS == nil {
+			if !configureDNSArgs.watch {
+				return errors.New("this node isn't using Tailscale's DNS settings")
+			}
+		} else {
+			conf := downstreamDNSConfig(configureDNSArgs.downstream, st.MagicDNS)
+			if configureDNSArgs.write == "" {
+				fmt.Print(conf)
+				return nil
+			}
+			if err := writeDownstreamDNSConfig(configureDNSArgs.write, conf, configureDNSArgs.reload); err != nil {
+				return err
+			}
+		}
+		if !configureDNSArgs.watch {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// downstreamDNSConfig returns the config for a DNS server of the given
+// kind ("dnsmasq" or "coredns") to forward the zones in ms to MagicDNS.
+func downstreamDNSConfig(kind string, ms *ipnstate.MagicDNSStatus) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Generated by \"tailscale configure dns --downstream=%s\"; don't edit.\n", kind)
+	fmt.Fprintf(&buf, "# Forwards the tailnet's DNS zones to MagicDNS at %s.\n", ms.Addr)
+	switch kind {
+	case "dnsmasq":
+		for _, z := range ms.Zones {
+			fmt.Fprintf(&buf, "server=/%s/%s\n", z, ms.Addr)
+		}
+		// Tailscale IPs are in 100.64.0.0/10, which dnsmasq's
+		// --stop-dns-rebind (on by default on OpenWrt) may reject.
+		for _, z := range ms.Zones {
+			fmt.Fprintf(&buf, "rebind-domain-ok=/%s/\n", z)
+		}
+	case "coredns":
+		fmt.Fprintf(&buf, "%s {\n", strings.Join(ms.Zones, " "))
+		fmt.Fprintf(&buf, "\tforward . %s\n", ms.Addr)
+		fmt.Fprintf(&buf, "}\n")
+	}
+	return buf.String()
+}
+
+// writeDownstreamDNSConfig writes conf to path and runs reloadCmd, a
+// space-separated command line, unless path already holds conf.
+func writeDownstreamDNSConfig(path, conf, reloadCmd string) error {
+	if old, err := ioutil.ReadFile(path); err == nil && string(old) == conf {
+		return nil
+	}
+	if err := atomicfile.WriteFile(path, []byte(conf), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote %s\n", path)
+	args := strings.Fields(reloadCmd)
+	if len(args) == 0 {
+		return nil
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", reloadCmd, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
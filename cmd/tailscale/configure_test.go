@@ -0,0 +1,41 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+func TestDownstreamDNSConfig(t *testing.T) {
+	ms := &ipnstate.MagicDNSStatus{
+		Addr:  "100.100.100.100",
+		Zones: []string{"corp.example.com", "tailscale.us"},
+	}
+	tests := []struct {
+		kind string
+		want string
+	}{
+		{"dnsmasq", `# Generated by "tailscale configure dns --downstream=dnsmasq"; don't edit.
+# Forwards the tailnet's DNS zones to MagicDNS at 100.100.100.100.
+server=/corp.example.com/100.100.100.100
+server=/tailscale.us/100.100.100.100
+rebind-domain-ok=/corp.example.com/
+rebind-domain-ok=/tailscale.us/
+`},
+		{"coredns", `# Generated by "tailscale configure dns --downstream=coredns"; don't edit.
+# Forwards the tailnet's DNS zones to MagicDNS at 100.100.100.100.
+corp.example.com tailscale.us {
+	forward . 100.100.100.100
+}
+`},
+	}
+	for _, tt := range tests {
+		if got := downstreamDNSConfig(tt.kind, ms); got != tt.want {
+			t.Errorf("%s config:\n%s\nwant:\n%s", tt.kind, got, tt.want)
+		}
+	}
+}
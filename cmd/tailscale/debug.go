@@ -0,0 +1,393 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/lsm"
+)
+
+var debugCmd = &ffcli.Command{
+	Name:       "debug",
+	ShortUsage: "debug <subcommand> [flags]",
+	ShortHelp:  "Debugging tools",
+	LongHelp:   "The output of these commands is meant for humans and subject to change.",
+	Subcommands: []*ffcli.Command{
+		debugDaemonGoroutinesCmd,
+		debugDERPMapCmd,
+		debugDNSCmd,
+		debugNetMapCmd,
+		debugPolicyCmd,
+		debugPrefsCmd,
+		debugSelftestCmd,
+	},
+	Exec: func(context.Context, []string) error { return flag.ErrHelp },
+}
+
+var debugPrefsCmd = &ffcli.Command{
+	Name:       "prefs",
+	ShortUsage: "debug prefs [-json]",
+	ShortHelp:  "Print the current prefs and where each value came from",
+	Exec:       runDebugPrefs,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("prefs", flag.ExitOnError)
+		fs.BoolVar(&debugPrefsArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var debugPrefsArgs struct {
+	json bool
+}
+
+func runDebugPrefs(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		log.Fatalf("too many non-flag arguments: %q", args)
+	}
+	c, bc, ctx, cancel := connect(ctx)
+	defer cancel()
+
+	bc.AllowVersionSkew = true
+
+	ch := make(chan ipn.Notify, 1)
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		if n.ErrMessage != nil {
+			log.Fatal(*n.ErrMessage)
+		}
+		if n.Prefs != nil && n.PrefSources != nil {
+			ch <- n
+		}
+	})
+	go pump(ctx, bc, c)
+
+	bc.RequestPrefs()
+	var n ipn.Notify
+	select {
+	case n = <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	type pref struct {
+		Name   string
+		Value  interface{}
+		Source ipn.PrefSource
+	}
+	var prefs []pref
+	v := reflect.ValueOf(n.Prefs).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		src, ok := n.PrefSources[name]
+		if !ok {
+			continue // not a pref (Persist)
+		}
+		prefs = append(prefs, pref{name, v.Field(i).Interface(), src})
+	}
+
+	if debugPrefsArgs.json {
+		j, err := json.MarshalIndent(prefs, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", j)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "PREF\tVALUE\tSOURCE\n")
+	for _, p := range prefs {
+		fmt.Fprintf(w, "%s\t%v\t%s\n", p.Name, p.Value, p.Source)
+	}
+	return w.Flush()
+}
+
+var debugDaemonGoroutinesCmd = &ffcli.Command{
+	Name:       "daemon-goroutines",
+	ShortUsage: "debug daemon-goroutines",
+	ShortHelp:  "Print the stacks of all of tailscaled's goroutines",
+	LongHelp: strings.TrimSpace(`
+Prints the stack of each of tailscaled's goroutines, with its state and
+how long it's been blocked, to debug a tailscaled that's stopped
+responding. tailscaled answers this itself, without involving its
+engine or backend, so it works while they're wedged.
+`),
+	Exec: runDebugDaemonGoroutines,
+}
+
+func runDebugDaemonGoroutines(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		log.Fatalf("too many non-flag arguments: %q", args)
+	}
+	c, bc, ctx, cancel := connect(ctx)
+	defer cancel()
+
+	bc.AllowVersionSkew = true
+
+	ch := make(chan string, 1)
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		if n.ErrMessage != nil {
+			log.Fatal(*n.ErrMessage)
+		}
+		if n.Goroutines != nil {
+			ch <- *n.Goroutines
+		}
+	})
+	go pump(ctx, bc, c)
+
+	bc.RequestGoroutines()
+	select {
+	case stacks := <-ch:
+		fmt.Print(stacks)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var debugDNSCmd = &ffcli.Command{
+	Name:       "dns",
+	ShortUsage: "debug dns [-json] [-dry-run] [-metrics]",
+	ShortHelp:  "Print how Tailscale has configured the system's DNS",
+	LongHelp: strings.TrimSpace(`
+Prints which mechanism Tailscale uses to configure the system resolver,
+such as systemd-resolved, resolvconf or NRPT, and the nameservers and
+domains it has set there.
+
+With -dry-run, it also prints the configuration the current network
+map and prefs call for, and what "tailscale up" would change to apply
+it.
+
+With -metrics, it prints counts of the queries Tailscale's resolver
+has answered, and each upstream nameserver's failures and latency.
+To log each query's name and type as well, run tailscaled with
+TS_DEBUG_DNS_QUERY_LOG set to a file to log them to.
+`),
+	Exec: runDebugDNS,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("dns", flag.ExitOnError)
+		fs.BoolVar(&debugDNSArgs.json, "json", false, "output in JSON format")
+		fs.BoolVar(&debugDNSArgs.dryRun, "dry-run", false, "also show what \"tailscale up\" would change")
+		fs.BoolVar(&debugDNSArgs.metrics, "metrics", false, "also show query counts and upstream latency")
+		return fs
+	})(),
+}
+
+var debugDNSArgs struct {
+	json    bool
+	dryRun  bool
+	metrics bool
+}
+
+func runDebugDNS(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		log.Fatalf("too many non-flag arguments: %q", args)
+	}
+	c, bc, ctx, cancel := connect(ctx)
+	defer cancel()
+
+	bc.AllowVersionSkew = true
+
+	ch := make(chan *ipnstate.Status, 1)
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		if n.ErrMessage != nil {
+			log.Fatal(*n.ErrMessage)
+		}
+		if n.Status != nil {
+			ch <- n.Status
+		}
+	})
+	go pump(ctx, bc, c)
+
+	bc.RequestStatus()
+	var st *ipnstate.Status
+	select {
+	case st = <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var applied ipnstate.DNSConfig
+	if st.DNS != nil {
+		applied = st.DNS.Applied
+	}
+	if debugDNSArgs.json {
+		out := struct {
+			DNS     *ipnstate.DNSStatus
+			Plan    *ipnstate.DNSConfig  `json:",omitempty"`
+			Changes []string             `json:",omitempty"`
+			Metrics *ipnstate.DNSMetrics `json:",omitempty"`
+		}{DNS: st.DNS}
+		if debugDNSArgs.dryRun && st.DNSPlan != nil {
+			out.Plan = st.DNSPlan
+			out.Changes = dnsChanges(applied, *st.DNSPlan)
+		}
+		if debugDNSArgs.metrics {
+			out.Metrics = st.DNSMetrics
+		}
+		j, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", j)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if st.DNS == nil {
+		fmt.Fprintf(w, "Tailscale doesn't manage DNS on this system.\n")
+	} else {
+		fmt.Fprintf(w, "Manager:\t%s\n", st.DNS.Manager)
+		printDNSConfig(w, applied)
+	}
+	if debugDNSArgs.dryRun {
+		fmt.Fprintf(w, "\n")
+		if st.DNSPlan == nil {
+			fmt.Fprintf(w, "No network map yet, so there's nothing to plan.\n")
+		} else {
+			fmt.Fprintf(w, "Planned:\n")
+			printDNSConfig(w, *st.DNSPlan)
+			fmt.Fprintf(w, "\n")
+			changes := dnsChanges(applied, *st.DNSPlan)
+			if len(changes) == 0 {
+				fmt.Fprintf(w, "\"tailscale up\" would change nothing.\n")
+			} else {
+				fmt.Fprintf(w, "\"tailscale up\" would change:\n")
+				for _, ch := range changes {
+					fmt.Fprintf(w, "  %s\n", ch)
+				}
+			}
+		}
+	}
+	if debugDNSArgs.metrics && st.DNSMetrics != nil {
+		m := st.DNSMetrics
+		fmt.Fprintf(w, "\n")
+		fmt.Fprintf(w, "Queries:\t%d (%d local, %d cached, %d forwarded, %d failed upstream)\n", m.Queries, m.Local, m.CacheHits, m.Forwarded, m.UpstreamFailures)
+		if len(m.Upstreams) > 0 {
+			fmt.Fprintf(w, "\nUPSTREAM\tQUERIES\tFAILURES\tMEAN\tMAX\n")
+			for _, u := range m.Upstreams {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%v\t%v\n", u.Addr, u.Queries, u.Failures, u.MeanLatency.Round(time.Microsecond), u.MaxLatency.Round(time.Microsecond))
+			}
+		}
+	}
+	return w.Flush()
+}
+
+func printDNSConfig(w io.Writer, dc ipnstate.DNSConfig) {
+	fmt.Fprintf(w, "Nameservers:\t%s\n", strings.Join(dc.Nameservers, " "))
+	fmt.Fprintf(w, "Domains:\t%s\n", strings.Join(dc.Domains, " "))
+	fmt.Fprintf(w, "Routes:\t%s\n", strings.Join(dc.Routes, " "))
+	fmt.Fprintf(w, "Default route:\t%v\n", dc.DefaultRoute)
+}
+
+// dnsChanges describes the changes from DNS configuration old to new,
+// one line per setting that differs.
+func dnsChanges(old, new ipnstate.DNSConfig) []string {
+	var ret []string
+	diff := func(name string, old, new []string) {
+		added, removed := diffStrings(old, new)
+		for _, s := range removed {
+			ret = append(ret, fmt.Sprintf("-%s %s", name, s))
+		}
+		for _, s := range added {
+			ret = append(ret, fmt.Sprintf("+%s %s", name, s))
+		}
+	}
+	diff("nameserver", old.Nameservers, new.Nameservers)
+	diff("domain", old.Domains, new.Domains)
+	diff("route", old.Routes, new.Routes)
+	if old.DefaultRoute != new.DefaultRoute {
+		ret = append(ret, fmt.Sprintf("default route %v -> %v", old.DefaultRoute, new.DefaultRoute))
+	}
+	return ret
+}
+
+// diffStrings returns the strings in new but not old, and those in
+// old but not new, in the order given.
+func diffStrings(old, new []string) (added, removed []string) {
+	had := make(map[string]bool, len(old))
+	for _, s := range old {
+		had[s] = true
+	}
+	have := make(map[string]bool, len(new))
+	for _, s := range new {
+		have[s] = true
+		if !had[s] {
+			added = append(added, s)
+		}
+	}
+	for _, s := range old {
+		if !have[s] {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
+
+var debugPolicyCmd = &ffcli.Command{
+	Name:       "policy",
+	ShortUsage: "debug policy [-module=selinux|apparmor]",
+	ShortHelp:  "Print reference SELinux and AppArmor policies for tailscaled",
+	LongHelp: strings.TrimSpace(`
+Prints a reference SELinux policy module, as the tailscaled.te and
+tailscaled.fc files to build it from, and a reference AppArmor
+profile, each allowing tailscaled what it needs when installed in the
+standard paths. Start from them where a security module denies
+tailscaled, which "tailscale status" reports as a warning.
+`),
+	Exec: runDebugPolicy,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("policy", flag.ExitOnError)
+		fs.StringVar(&debugPolicyArgs.module, "module", "", `print only this module's policy: "selinux" or "apparmor"`)
+		return fs
+	})(),
+}
+
+var debugPolicyArgs struct {
+	module string
+}
+
+func runDebugPolicy(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		log.Fatalf("too many non-flag arguments: %q", args)
+	}
+	var selinux, apparmor bool
+	switch debugPolicyArgs.module {
+	case "":
+		selinux, apparmor = true, true
+	case "selinux":
+		selinux = true
+	case "apparmor":
+		apparmor = true
+	default:
+		log.Fatalf("unknown -module %q; want selinux or apparmor", debugPolicyArgs.module)
+	}
+	if m, ok := lsm.Active(); ok {
+		fmt.Printf("# This process is confined by %s (%s).\n\n", m.Name, m.Label)
+	}
+	if selinux {
+		te, fc := lsm.SELinuxPolicy()
+		fmt.Printf("# ==> tailscaled.te <==\n%s\n# ==> tailscaled.fc <==\n%s", te, fc)
+	}
+	if selinux && apparmor {
+		fmt.Println()
+	}
+	if apparmor {
+		fmt.Printf("# ==> usr.sbin.tailscaled <==\n%s", lsm.AppArmorProfile())
+	}
+	return nil
+}
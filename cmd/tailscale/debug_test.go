@@ -0,0 +1,93 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+func TestDNSChanges(t *testing.T) {
+	applied := ipnstate.DNSConfig{
+		Nameservers: []string{"100.100.100.100"},
+		Domains:     []string{"corp.example.com"},
+	}
+	if got := dnsChanges(applied, applied); len(got) != 0 {
+		t.Errorf("no change: got %q; want none", got)
+	}
+
+	plan := ipnstate.DNSConfig{
+		Nameservers:  []string{"100.100.100.100"},
+		Domains:      []string{"example.com"},
+		Routes:       []string{"ts.net"},
+		DefaultRoute: true,
+	}
+	want := []string{
+		"-domain corp.example.com",
+		"+domain example.com",
+		"+route ts.net",
+		"default route false -> true",
+	}
+	if got := dnsChanges(applied, plan); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	// Coming up from nothing applied.
+	want = []string{"+nameserver 100.100.100.100", "+domain corp.example.com"}
+	if got := dnsChanges(ipnstate.DNSConfig{}, applied); !reflect.DeepEqual(got, want) {
+		t.Errorf("from nothing: got %q; want %q", got, want)
+	}
+}
+
+func TestDERPRegions(t *testing.T) {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		2: {RegionID: 2, RegionCode: "sfo"},
+		1: {RegionID: 1, RegionCode: "nyc"},
+		3: {RegionID: 3, RegionCode: "sin"},
+	}}
+	ni := &tailcfg.NetInfo{
+		PreferredDERP: 2,
+		DERPLatency: map[string]float64{
+			"1-v4": 0.050,
+			"2-v4": 0.010,
+			"2-v6": 0.012,
+		},
+	}
+	got := derpRegions(dm, ni)
+	want := []derpRegion{
+		{DERPRegion: dm.Regions[1], LatencyV4: 50 * time.Millisecond},
+		{DERPRegion: dm.Regions[2], LatencyV4: 10 * time.Millisecond, LatencyV6: 12 * time.Millisecond, Preferred: true},
+		{DERPRegion: dm.Regions[3]},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestPeerRoutes(t *testing.T) {
+	cidrs := func(ss ...string) (ret []wgcfg.CIDR) {
+		for _, s := range ss {
+			cidr, err := wgcfg.ParseCIDR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, cidr)
+		}
+		return ret
+	}
+	p := &tailcfg.Node{
+		Addresses:  cidrs("100.101.102.103/32"),
+		AllowedIPs: cidrs("100.101.102.103/32", "192.168.1.0/24", "0.0.0.0/0"),
+	}
+	got := peerRoutes(p)
+	if want := cidrs("192.168.1.0/24", "0.0.0.0/0"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
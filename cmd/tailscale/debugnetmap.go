@@ -0,0 +1,252 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+)
+
+var debugNetMapCmd = &ffcli.Command{
+	Name:       "netmap",
+	ShortUsage: "debug netmap [-json]",
+	ShortHelp:  "Print the network map control last sent, without private keys",
+	Exec:       runDebugNetMap,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("netmap", flag.ExitOnError)
+		fs.BoolVar(&debugNetMapArgs.json, "json", false, "output the whole network map in JSON format")
+		return fs
+	})(),
+}
+
+var debugNetMapArgs struct {
+	json bool
+}
+
+var debugDERPMapCmd = &ffcli.Command{
+	Name:       "derp-map",
+	ShortUsage: "debug derp-map [-json]",
+	ShortHelp:  "Print the DERP relay servers control configured, with their measured latency",
+	Exec:       runDebugDERPMap,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("derp-map", flag.ExitOnError)
+		fs.BoolVar(&debugDERPMapArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var debugDERPMapArgs struct {
+	json bool
+}
+
+// requestNetMap returns the backend's network map, which is nil if
+// there isn't one yet, and its latest network conditions.
+func requestNetMap(ctx context.Context) (*controlclient.NetworkMap, *tailcfg.NetInfo, error) {
+	c, bc, ctx, cancel := connect(ctx)
+	defer cancel()
+
+	bc.AllowVersionSkew = true
+
+	ch := make(chan ipn.Notify, 1)
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		if n.ErrMessage != nil {
+			log.Fatal(*n.ErrMessage)
+		}
+		if n.NetInfo != nil {
+			ch <- n
+		}
+	})
+	go pump(ctx, bc, c)
+
+	bc.RequestNetMap()
+	select {
+	case n := <-ch:
+		return n.NetMap, n.NetInfo, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+func runDebugNetMap(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		log.Fatalf("too many non-flag arguments: %q", args)
+	}
+	nm, _, err := requestNetMap(ctx)
+	if err != nil {
+		return err
+	}
+	if nm == nil {
+		return fmt.Errorf("no network map yet; is Tailscale up?")
+	}
+	if debugNetMapArgs.json {
+		j, err := json.MarshalIndent(nm, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", j)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Node key:\t%v\n", nm.NodeKey)
+	fmt.Fprintf(w, "Addresses:\t%v\n", nm.Addresses)
+	if nm.Expiry.IsZero() {
+		fmt.Fprintf(w, "Key expiry:\tnever\n")
+	} else {
+		fmt.Fprintf(w, "Key expiry:\t%v\n", nm.Expiry.Local().Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Machine:\t%v\n", nm.MachineStatus)
+	fmt.Fprintf(w, "Domain:\t%s\n", nm.Domain)
+	if len(nm.Tags) > 0 {
+		fmt.Fprintf(w, "Tags:\t%s\n", strings.Join(nm.Tags, " "))
+	}
+	if nm.DERPMap != nil {
+		fmt.Fprintf(w, "DERP regions:\t%d\n", len(nm.DERPMap.Regions))
+	}
+
+	dc := nm.DNS
+	fmt.Fprintf(w, "\nDNS resolvers:\t%s\n", strings.Join(resolverAddrs(dc.Resolvers), " "))
+	if len(dc.FallbackResolvers) > 0 {
+		fmt.Fprintf(w, "DNS fallback:\t%s\n", strings.Join(resolverAddrs(dc.FallbackResolvers), " "))
+	}
+	fmt.Fprintf(w, "DNS domains:\t%s\n", strings.Join(dc.Domains, " "))
+	var domains []string
+	for d := range dc.Routes {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	for _, d := range domains {
+		fmt.Fprintf(w, "DNS route:\t%s -> %s\n", d, strings.Join(resolverAddrs(dc.Routes[d]), " "))
+	}
+	fmt.Fprintf(w, "DNS proxied:\t%v\n", dc.Proxied)
+	if len(dc.ExtraRecords) > 0 {
+		fmt.Fprintf(w, "DNS records:\t%d\n", len(dc.ExtraRecords))
+	}
+
+	fmt.Fprintf(w, "\nPEER\tADDRESSES\tROUTES\tDERP\tENDPOINTS\n")
+	for _, p := range nm.Peers {
+		name := p.Name
+		if name == "" {
+			name = p.Hostinfo.Hostname
+		}
+		var routes []string
+		for _, r := range peerRoutes(p) {
+			routes = append(routes, r.String())
+		}
+		fmt.Fprintf(w, "%s\t%v\t%s\t%s\t%d\n", name, p.Addresses, strings.Join(routes, ","), strings.TrimPrefix(p.DERP, "127.3.3.40:"), len(p.Endpoints))
+	}
+	return w.Flush()
+}
+
+// peerRoutes returns the routes in p's AllowedIPs other than its own
+// addresses, such as subnets it routes to.
+func peerRoutes(p *tailcfg.Node) []wgcfg.CIDR {
+	own := make(map[string]bool, len(p.Addresses))
+	for _, a := range p.Addresses {
+		own[a.String()] = true
+	}
+	var ret []wgcfg.CIDR
+	for _, r := range p.AllowedIPs {
+		if !own[r.String()] {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+func resolverAddrs(resolvers []tailcfg.DNSResolver) []string {
+	var ret []string
+	for _, r := range resolvers {
+		ret = append(ret, r.Addr)
+	}
+	return ret
+}
+
+// derpRegion is a DERP region with this node's latency to it.
+type derpRegion struct {
+	*tailcfg.DERPRegion
+	LatencyV4 time.Duration `json:",omitempty"` // zero if not measured
+	LatencyV6 time.Duration `json:",omitempty"` // zero if not measured
+	Preferred bool          `json:",omitempty"` // whether it's the node's home region
+}
+
+// derpRegions returns the regions of dm, sorted by ID, with the
+// latencies measured in ni.
+func derpRegions(dm *tailcfg.DERPMap, ni *tailcfg.NetInfo) []derpRegion {
+	latency := func(rid int, family string) time.Duration {
+		if ni == nil {
+			return 0
+		}
+		secs := ni.DERPLatency[fmt.Sprintf("%d-%s", rid, family)]
+		return time.Duration(secs * float64(time.Second))
+	}
+	var ret []derpRegion
+	for _, rid := range dm.RegionIDs() {
+		ret = append(ret, derpRegion{
+			DERPRegion: dm.Regions[rid],
+			LatencyV4:  latency(rid, "v4"),
+			LatencyV6:  latency(rid, "v6"),
+			Preferred:  ni != nil && ni.PreferredDERP == rid,
+		})
+	}
+	return ret
+}
+
+func runDebugDERPMap(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		log.Fatalf("too many non-flag arguments: %q", args)
+	}
+	nm, ni, err := requestNetMap(ctx)
+	if err != nil {
+		return err
+	}
+	if nm == nil || nm.DERPMap == nil {
+		return fmt.Errorf("no DERP map yet; is Tailscale up?")
+	}
+	regions := derpRegions(nm.DERPMap, ni)
+	if debugDERPMapArgs.json {
+		j, err := json.MarshalIndent(regions, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", j)
+		return nil
+	}
+
+	ms := func(d time.Duration) string {
+		if d == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1fms", d.Seconds()*1000)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "REGION\tCODE\tV4\tV6\tNODES\n")
+	for _, r := range regions {
+		var nodes []string
+		for _, n := range r.Nodes {
+			nodes = append(nodes, n.HostName)
+		}
+		home := ""
+		if r.Preferred {
+			home = " (home)"
+		}
+		fmt.Fprintf(w, "%d\t%s%s\t%s\t%s\t%s\n", r.RegionID, r.RegionCode, home, ms(r.LatencyV4), ms(r.LatencyV6), strings.Join(nodes, " "))
+	}
+	return w.Flush()
+}
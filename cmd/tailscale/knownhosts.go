@@ -0,0 +1,91 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+var knownHostsCmd = &ffcli.Command{
+	Name:       "ssh-known-hosts",
+	ShortUsage: "ssh-known-hosts [host...]",
+	ShortHelp:  "Print SSH known_hosts lines for Tailscale nodes",
+	LongHelp: strings.TrimSpace(`
+"tailscale ssh-known-hosts" prints the SSH host keys that Tailscale nodes
+reported to the control server, in known_hosts format, so ssh can verify
+them without asking you to trust a key on first use.
+
+With arguments, only nodes whose hostname or Tailscale IP is listed are
+printed. To use it from ssh (OpenSSH 8.5 or later), add to ~/.ssh/config:
+
+	Host 100.*
+		KnownHostsCommand /usr/bin/tailscale ssh-known-hosts %H
+
+or write the output to a file and point UserKnownHostsFile at it.
+`),
+	Exec: runKnownHosts,
+}
+
+func runKnownHosts(ctx context.Context, args []string) error {
+	c, bc, ctx, cancel := connect(ctx)
+	defer cancel()
+
+	bc.AllowVersionSkew = true
+
+	ch := make(chan *ipnstate.Status, 1)
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		if n.ErrMessage != nil {
+			log.Fatal(*n.ErrMessage)
+		}
+		if n.Status != nil {
+			ch <- n.Status
+		}
+	})
+	go pump(ctx, bc, c)
+
+	bc.RequestStatus()
+	var st *ipnstate.Status
+	select {
+	case st = <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	want := map[string]bool{}
+	for _, a := range args {
+		want[strings.ToLower(a)] = true
+	}
+	var lines []string
+	for _, ps := range st.Peer {
+		if len(ps.SSHHostKeys) == 0 {
+			continue
+		}
+		var names []string
+		for _, n := range []string{strings.ToLower(ps.HostName), ps.TailAddr} {
+			if n != "" {
+				names = append(names, n)
+			}
+		}
+		if len(want) > 0 && !(want[strings.ToLower(ps.HostName)] || want[ps.TailAddr]) {
+			continue
+		}
+		for _, k := range ps.SSHHostKeys {
+			lines = append(lines, strings.Join(names, ",")+" "+k)
+		}
+	}
+	sort.Strings(lines)
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+	return nil
+}
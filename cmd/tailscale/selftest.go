@@ -0,0 +1,324 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"github.com/tailscale/wireguard-go/tun"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/derp/derpmap"
+	"tailscale.com/net/dnscache"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/tlsdial"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/packet"
+	"tailscale.com/wgengine/router"
+)
+
+var debugSelftestCmd = &ffcli.Command{
+	Name:       "selftest",
+	ShortUsage: "debug selftest [-json] [-login-server=url]",
+	ShortHelp:  "Check that each component Tailscale needs works on this machine",
+	LongHelp: `Runs a one-shot check of each thing Tailscale needs from the
+machine and network: TUN devices, UDP sockets, STUN, DERP, the control
+server, DNS and packet filtering. It prints whether each one passed.
+It doesn't need tailscaled to be running. Checking TUN devices usually
+requires root.`,
+	Exec: runDebugSelftest,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+		fs.BoolVar(&selftestArgs.json, "json", false, "output in JSON format")
+		fs.StringVar(&selftestArgs.server, "login-server", "https://login.tailscale.com", "base URL of control server to check")
+		return fs
+	})(),
+}
+
+var selftestArgs struct {
+	json   bool
+	server string
+}
+
+// selftestTimeout bounds each individual check.
+const selftestTimeout = 15 * time.Second
+
+// errSkipped is wrapped by checks that don't apply to this machine.
+var errSkipped = errors.New("skipped")
+
+type selftestCheck struct {
+	name string
+	run  func(ctx context.Context) (detail string, err error)
+}
+
+// selftestResult is the outcome of one selftestCheck.
+type selftestResult struct {
+	Component string
+	Result    string // "pass", "fail" or "skip"
+	Detail    string `json:",omitempty"`
+	Duration  time.Duration
+}
+
+var selftestChecks = []selftestCheck{
+	{"tun", selftestTUN},
+	{"udp", selftestUDP},
+	{"stun", selftestSTUN},
+	{"derp", selftestDERP},
+	{"control", selftestControl},
+	{"dns", selftestDNS},
+	{"dns-config", selftestDNSConfig},
+	{"filter", selftestFilter},
+}
+
+func runDebugSelftest(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	var results []selftestResult
+	failed := 0
+	for _, c := range selftestChecks {
+		res := runSelftestCheck(ctx, c)
+		if res.Result == "fail" {
+			failed++
+		}
+		results = append(results, res)
+	}
+
+	if selftestArgs.json {
+		j, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", j)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "COMPONENT\tRESULT\tTIME\tDETAIL\n")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%v\t%s\n", r.Component, r.Result, r.Duration.Round(time.Millisecond), r.Detail)
+		}
+		w.Flush()
+		fmt.Printf("\n%s/%s %s\n", runtime.GOOS, runtime.GOARCH, runtime.Version())
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	return nil
+}
+
+func runSelftestCheck(ctx context.Context, c selftestCheck) selftestResult {
+	ctx, cancel := context.WithTimeout(ctx, selftestTimeout)
+	defer cancel()
+	t0 := time.Now()
+	detail, err := c.run(ctx)
+	res := selftestResult{
+		Component: c.name,
+		Result:    "pass",
+		Detail:    detail,
+		Duration:  time.Since(t0),
+	}
+	switch {
+	case errors.Is(err, errSkipped):
+		res.Result = "skip"
+		res.Detail = err.Error()
+	case err != nil:
+		res.Result = "fail"
+		res.Detail = err.Error()
+	}
+	return res
+}
+
+func selftestTUN(ctx context.Context) (string, error) {
+	name := "tailscale-test"
+	if runtime.GOOS == "darwin" {
+		name = "utun"
+	}
+	dev, err := tun.CreateTUN(name, 1280)
+	if err != nil {
+		return "", fmt.Errorf("creating TUN device: %v (this usually requires root)", err)
+	}
+	if got, err := dev.Name(); err == nil {
+		name = got
+	}
+	if err := dev.Close(); err != nil {
+		return "", fmt.Errorf("closing TUN device %s: %v", name, err)
+	}
+	return fmt.Sprintf("created and removed %s", name), nil
+}
+
+func selftestUDP(ctx context.Context) (string, error) {
+	pc, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", fmt.Errorf("IPv4: %v", err)
+	}
+	pc.Close()
+	pc, err = net.ListenPacket("udp6", "[::]:0")
+	if err != nil {
+		// Plenty of machines have no IPv6; that's not a failure.
+		return fmt.Sprintf("IPv4 ok; no IPv6: %v", err), nil
+	}
+	pc.Close()
+	return "IPv4 and IPv6 ok", nil
+}
+
+func selftestSTUN(ctx context.Context) (string, error) {
+	c := &netcheck.Client{
+		DNSCache: dnscache.Get(),
+		Logf:     logger.Discard,
+	}
+	report, err := c.GetReport(ctx, derpmap.Prod())
+	if err != nil {
+		return "", err
+	}
+	if !report.UDP {
+		return "", errors.New("no STUN replies; UDP seems to be blocked, so all traffic will be relayed over DERP")
+	}
+	detail := "global endpoint " + report.GlobalV4
+	if report.MappingVariesByDestIP.EqualBool(true) {
+		detail += "; hard NAT (mapping varies by destination)"
+	}
+	return detail, nil
+}
+
+func selftestDERP(ctx context.Context) (string, error) {
+	dm := derpmap.Prod()
+	var firstErr error
+	for _, id := range dm.RegionIDs() {
+		region := dm.Regions[id]
+		c := derphttp.NewRegionClient(key.NewPrivate(), logger.Discard, func() *tailcfg.DERPRegion { return region })
+		err := c.Connect(ctx)
+		c.Close()
+		if err == nil {
+			return fmt.Sprintf("connected to region %d (%s)", id, region.RegionCode), nil
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("region %d (%s): %v", id, region.RegionCode, err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no DERP regions")
+	}
+	return "", firstErr
+}
+
+func selftestControl(ctx context.Context) (string, error) {
+	u, err := url.Parse(selftestArgs.server)
+	if err != nil {
+		return "", err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsdial.Config(u.Hostname(), tr.TLSClientConfig)
+	defer tr.CloseIdleConnections()
+	req, err := http.NewRequest("GET", selftestArgs.server+"/key", nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := (&http.Client{Transport: tr}).Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != 200 || len(body) == 0 {
+		return "", fmt.Errorf("fetching server key: %s", res.Status)
+	}
+	return fmt.Sprintf("fetched server key from %s", u.Host), nil
+}
+
+func selftestDNS(ctx context.Context) (string, error) {
+	u, err := url.Parse(selftestArgs.server)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s is %v", u.Hostname(), addrs), nil
+}
+
+// selftestDNSConfig applies a DNS config with the system's DNS
+// backend and rolls it back. On Linux the config goes on a TUN
+// device of its own, as tailscaled's would.
+func selftestDNSConfig(ctx context.Context) (string, error) {
+	tunname := ""
+	if runtime.GOOS == "linux" {
+		dev, err := tun.CreateTUN("tailscale-test", 1280)
+		if err != nil {
+			return "", fmt.Errorf("%w: creating TUN device: %v", errSkipped, err)
+		}
+		defer dev.Close()
+		if tunname, err = dev.Name(); err != nil {
+			return "", err
+		}
+	}
+	backend, err := router.CheckDNS(logger.Discard, tunname)
+	if errors.Is(err, router.ErrDNSCheckSkipped) {
+		return "", fmt.Errorf("%w: %v", errSkipped, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", backend, err)
+	}
+	return fmt.Sprintf("applied and rolled back with %s", backend), nil
+}
+
+// selftestFilter compiles a packet filter like the ones control sends
+// and checks that it accepts and drops the packets it should.
+func selftestFilter(ctx context.Context) (string, error) {
+	self := packet.NewIP(net.ParseIP("100.101.102.103"))
+	peer := packet.NewIP(net.ParseIP("100.99.98.97"))
+	matches := filter.Matches{{
+		Srcs: []filter.Net{{IP: peer, Mask: filter.Netmask(32)}},
+		Dsts: []filter.NetPortRange{{
+			Net:   filter.Net{IP: self, Mask: filter.Netmask(32)},
+			Ports: filter.PortRange{First: 22, Last: 22},
+		}},
+	}}
+	local := []filter.Net{{IP: self, Mask: filter.Netmask(32)}}
+	f := filter.New(matches, local, nil, logger.Discard)
+
+	tests := []struct {
+		src   packet.IP
+		dport uint16
+		want  filter.Response
+	}{
+		{peer, 22, filter.Accept},
+		{peer, 23, filter.Drop},
+		{packet.NewIP(net.ParseIP("100.1.2.3")), 22, filter.Drop},
+	}
+	for _, tt := range tests {
+		b := packet.Generate(&packet.UDPHeader{
+			IPHeader: packet.IPHeader{SrcIP: tt.src, DstIP: self},
+			SrcPort:  12345,
+			DstPort:  tt.dport,
+		}, []byte("selftest"))
+		var q packet.ParsedPacket
+		q.Decode(b)
+		if got := f.RunIn(&q, 0); got != tt.want {
+			return "", fmt.Errorf("%v: got %v, want %v", q.String(), got, tt.want)
+		}
+	}
+	return fmt.Sprintf("%d rules, %d packets ok", len(matches), len(tests)), nil
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/ipn"
+)
+
+// setPrefNames maps the flags of up that set also takes to the names
+// of the prefs they change. Flags that need a new login, like
+// --login-server and --authkey, aren't among them.
+var setPrefNames = map[string]string{
+	"accept-routes":              "RouteAll",
+	"host-routes":                "AllowSingleHosts",
+	"exit-node-dns":              "NoExitNodeDNS",
+	"shields-up":                 "ShieldsUp",
+	"advertise-routes":           "AdvertiseRoutes",
+	"advertise-tags":             "AdvertiseTags",
+	"enable-derp":                "DisableDERP",
+	"cloud-info":                 "CloudInfo",
+	"port-mapping":               "NoPortMapping",
+	"lan-discovery":              "NoLANDiscovery",
+	"metered":                    "Metered",
+	"schedule":                   "Schedule",
+	"snat-subnet-routes":         "NoSNAT",
+	"proxy-neighbors":            "ProxyNeighbors",
+	"netfilter-mode":             "NetfilterMode",
+	"kill-switch":                "KillSwitch",
+	"lockdown":                   "Lockdown",
+	"exit-node-lockdown":         "ExitNodeLockdown",
+	"exclusive-dns":              "NoExclusiveDNS",
+	"exit-node-allow-lan-access": "ExitNodeAllowLANAccess",
+	"strict-control-key":         "StrictControlKey",
+}
+
+// newSetCmd returns the set command. It shares the flags of upf that
+// are in setPrefNames, so they parse into upArgs as they do for up.
+func newSetCmd(upf *flag.FlagSet) *ffcli.Command {
+	setf := flag.NewFlagSet("set", flag.ExitOnError)
+	upf.VisitAll(func(f *flag.Flag) {
+		if _, ok := setPrefNames[f.Name]; ok {
+			setf.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	return &ffcli.Command{
+		Name:       "set",
+		ShortUsage: "set [flags]",
+		ShortHelp:  "Change specific settings",
+		LongHelp: strings.TrimSpace(`
+"tailscale set" changes only the settings whose flags are given, and
+leaves the rest as they are. Unlike "tailscale up", it doesn't reset
+settings that aren't mentioned, and doesn't bring Tailscale up.
+`),
+		FlagSet: setf,
+		Exec: func(ctx context.Context, args []string) error {
+			return runSet(ctx, setf, args)
+		},
+	}
+}
+
+func runSet(ctx context.Context, setf *flag.FlagSet, args []string) error {
+	if len(args) > 0 {
+		log.Fatalf("too many non-flag arguments: %q", args)
+	}
+	mp := &ipn.MaskedPrefs{}
+	setf.Visit(func(f *flag.Flag) {
+		mp.Set = append(mp.Set, setPrefNames[f.Name])
+	})
+	if len(mp.Set) == 0 {
+		log.Fatalf("no settings to change; see \"tailscale set --help\"")
+	}
+	sort.Strings(mp.Set)
+
+	if upArgs.advertiseRoutes != "" || upArgs.proxyNeighbors != "" {
+		checkIPForwarding()
+	}
+	mp.Prefs = *prefsFromUpArgs()
+
+	c, bc, ctx, cancel := connect(ctx)
+	defer cancel()
+
+	ch := make(chan *ipn.Prefs, 1)
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		if n.ErrMessage != nil {
+			log.Fatal(*n.ErrMessage)
+		}
+		if n.Prefs != nil {
+			ch <- n.Prefs
+		}
+	})
+	go pump(ctx, bc, c)
+
+	// Get the prefs as they are, to tell which ones the edit
+	// changes; some, like those set by system policy, may not.
+	bc.RequestPrefs()
+	var old *ipn.Prefs
+	select {
+	case old = <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	bc.EditPrefs(mp)
+	select {
+	case p := <-ch:
+		if changed := changedPrefs(old, p, mp.Set); len(changed) > 0 {
+			fmt.Printf("Changed %s.\n", strings.Join(changed, ", "))
+		} else {
+			fmt.Printf("No settings changed.\n")
+		}
+		if p.KillSwitch && !p.RouteAll {
+			warning("--kill-switch has no effect without --accept-routes.")
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// changedPrefs returns those of the prefs named in names whose values
+// differ between old and new.
+func changedPrefs(old, new *ipn.Prefs, names []string) []string {
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	var ret []string
+	for _, name := range names {
+		if !reflect.DeepEqual(ov.FieldByName(name).Interface(), nv.FieldByName(name).Interface()) {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
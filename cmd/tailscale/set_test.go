@@ -0,0 +1,39 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/ipn"
+)
+
+func TestChangedPrefs(t *testing.T) {
+	cidr := func(s string) []wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []wgcfg.CIDR{c}
+	}
+	old := ipn.NewPrefs()
+	old.Lockdown = true
+	old.AdvertiseRoutes = cidr("10.0.0.0/8")
+
+	new := old.Clone()
+	new.ShieldsUp = true
+	new.AdvertiseRoutes = cidr("10.0.0.0/16")
+
+	names := []string{"AdvertiseRoutes", "Lockdown", "RouteAll", "ShieldsUp"}
+	want := []string{"AdvertiseRoutes", "ShieldsUp"}
+	if got := changedPrefs(old, new, names); !reflect.DeepEqual(got, want) {
+		t.Errorf("changedPrefs = %q; want %q", got, want)
+	}
+	if got := changedPrefs(old, old.Clone(), names); got != nil {
+		t.Errorf("changedPrefs of unchanged prefs = %q; want none", got)
+	}
+}
@@ -14,6 +14,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
@@ -25,7 +27,7 @@ import (
 
 var statusCmd = &ffcli.Command{
 	Name:       "status",
-	ShortUsage: "status [-web] [-json]",
+	ShortUsage: "status [-web] [-json] [-watch] [-peers=...] [-columns=...]",
 	ShortHelp:  "Show state of tailscaled and its connections",
 	Exec:       runStatus,
 	FlagSet: (func() *flag.FlagSet {
@@ -34,6 +36,9 @@ var statusCmd = &ffcli.Command{
 		fs.BoolVar(&statusArgs.web, "web", false, "run webserver with HTML showing status")
 		fs.StringVar(&statusArgs.listen, "listen", "127.0.0.1:8384", "listen address; use port 0 for automatic")
 		fs.BoolVar(&statusArgs.browser, "browser", true, "Open a browser in web mode")
+		fs.BoolVar(&statusArgs.watch, "watch", false, "keep running, printing the status again whenever it changes")
+		fs.StringVar(&statusArgs.peers, "peers", "", "only show peers matching any of these comma-separated selectors: tag:NAME, os:NAME, user:LOGIN, active, or a hostname (glob) or Tailscale IP")
+		fs.StringVar(&statusArgs.columns, "columns", defaultStatusColumns, "comma-separated columns to show, out of "+strings.Join(statusColumnNames(), ","))
 		return fs
 	})(),
 }
@@ -43,15 +48,31 @@ var statusArgs struct {
 	web     bool   // run webserver
 	listen  string // in web mode, webserver address to listen on, empty means auto
 	browser bool   // in web mode, whether to open browser
+	watch   bool   // keep printing status as it changes
+	peers   string // peer selectors; empty means all
+	columns string // columns of the peer table
 }
 
 func runStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		log.Fatalf("too many non-flag arguments: %q", args)
+	}
+	cols, err := parseStatusColumns(statusArgs.columns)
+	if err != nil {
+		return err
+	}
+	match, err := parsePeerSelectors(statusArgs.peers)
+	if err != nil {
+		return err
+	}
+
 	c, bc, ctx, cancel := connect(ctx)
 	defer cancel()
 
 	bc.AllowVersionSkew = true
 
 	ch := make(chan *ipnstate.Status, 1)
+	changed := make(chan struct{}, 1)
 	bc.SetNotifyCallback(func(n ipn.Notify) {
 		if n.ErrMessage != nil {
 			log.Fatal(*n.ErrMessage)
@@ -59,6 +80,12 @@ func runStatus(ctx context.Context, args []string) error {
 		if n.Status != nil {
 			ch <- n.Status
 		}
+		if n.NetMap != nil || n.Engine != nil || n.State != nil {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
 	})
 	go pump(ctx, bc, c)
 
@@ -71,17 +98,15 @@ func runStatus(ctx context.Context, args []string) error {
 			return nil, ctx.Err()
 		}
 	}
+	if statusArgs.watch && !statusArgs.web {
+		return watchStatus(ctx, getStatus, changed, cols, match)
+	}
 	st, err := getStatus()
 	if err != nil {
 		return err
 	}
 	if statusArgs.json {
-		j, err := json.MarshalIndent(st, "", "  ")
-		if err != nil {
-			return err
-		}
-		fmt.Printf("%s", j)
-		return nil
+		return printStatusJSON(st, match)
 	}
 	if statusArgs.web {
 		ln, err := net.Listen("tcp", statusArgs.listen)
@@ -107,6 +132,7 @@ func runStatus(ctx context.Context, args []string) error {
 				http.Error(w, err.Error(), 500)
 				return
 			}
+			filterPeers(st, match)
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
 			st.WriteHTML(w)
 		}))
@@ -117,38 +143,269 @@ func runStatus(ctx context.Context, args []string) error {
 	}
 
 	var buf bytes.Buffer
-	f := func(format string, a ...interface{}) { fmt.Fprintf(&buf, format, a...) }
+	printStatus(&buf, st, cols, match)
+	os.Stdout.Write(buf.Bytes())
+	return nil
+}
+
+// watchStatus prints the status whenever the backend reports a
+// change, at most once a second.
+func watchStatus(ctx context.Context, getStatus func() (*ipnstate.Status, error), changed <-chan struct{}, cols []statusColumn, match peerMatcher) error {
+	// Also refresh periodically, for traffic counters.
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	for {
+		st, err := getStatus()
+		if err != nil {
+			return err
+		}
+		if statusArgs.json {
+			if err := printStatusJSON(st, match); err != nil {
+				return err
+			}
+		} else {
+			var buf bytes.Buffer
+			buf.WriteString("\x1b[H\x1b[2J") // clear the terminal
+			fmt.Fprintf(&buf, "# %s, %s\n", st.BackendState, time.Now().Format("15:04:05"))
+			printStatus(&buf, st, cols, match)
+			os.Stdout.Write(buf.Bytes())
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		case <-t.C:
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// filterPeers removes the peers for which match (if non-nil) returns
+// false from st.
+func filterPeers(st *ipnstate.Status, match peerMatcher) {
+	if match == nil {
+		return
+	}
+	for k, ps := range st.Peer {
+		if !match(st, ps) {
+			delete(st.Peer, k)
+		}
+	}
+}
+
+func printStatusJSON(st *ipnstate.Status, match peerMatcher) error {
+	filterPeers(st, match)
+	j, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", j)
+	return nil
+}
+
+// printStatus writes the human-readable status to buf: a few header
+// lines, then a table of the peers for which match (if non-nil)
+// returns true.
+func printStatus(buf *bytes.Buffer, st *ipnstate.Status, cols []statusColumn, match peerMatcher) {
+	f := func(format string, a ...interface{}) { fmt.Fprintf(buf, format, a...) }
+	if cs := st.Control; cs != nil && (!cs.Connected || cs.LastErr != "") {
+		f("# control: %s\n", cs)
+	}
+	for _, w := range st.Warnings {
+		f("# warning: %s\n", w)
+	}
+	if len(st.ManagedPrefs) > 0 {
+		f("# managed by your organization: %s\n", strings.Join(st.ManagedPrefs, ", "))
+	}
+	if st.NoLogs {
+		f("# no-logs-no-support: log uploads are disabled; Tailscale support can't debug this node\n")
+	}
+	if !st.KeyExpiry.IsZero() {
+		if left := time.Until(st.KeyExpiry); left < ipn.DefaultKeyExpiryWarnings[0] {
+			f("# node key expires in %v (%v); log in again to renew it\n", left.Round(time.Minute), st.KeyExpiry.Format(time.RFC3339))
+		}
+	}
+	if st.Metered {
+		f("# metered network: background traffic reduced\n")
+	}
+	if st.OnBattery {
+		bg := st.Background
+		f("# on battery: background pings reduced (so far: %d heartbeats, %d disco pings, %d STUN rounds)\n",
+			bg.Heartbeats, bg.DiscoPings, bg.STUNRounds)
+	}
+	switch st.PortMapping {
+	case "", "none":
+	case "off":
+		f("# port mapping: gateway probes disabled\n")
+	default:
+		f("# port mapping: gateway offers %s\n", st.PortMapping)
+	}
+	if st.NoLANDiscovery {
+		f("# LAN discovery disabled: peers on this network are reached via public addresses or DERP\n")
+	}
+	if len(st.Tags) > 0 {
+		f("# tags: %s\n", strings.Join(st.Tags, ", "))
+	}
+	if len(st.DeniedTags) > 0 {
+		f("# tags not granted by control (check the ACL's TagOwners): %s\n", strings.Join(st.DeniedTags, ", "))
+	}
 	for _, peer := range st.Peers() {
 		ps := st.Peer[peer]
-		f("%s %-7s %-15s %-18s tx=%8d rx=%8d ",
-			peer.ShortString(),
-			ps.OS,
-			ps.TailAddr,
-			ps.SimpleHostName(),
-			ps.TxBytes,
-			ps.RxBytes,
-		)
-		// TODO: let server report this active bool instead
-		active := !ps.LastWrite.IsZero() && time.Since(ps.LastWrite) < 2*time.Minute
+		if match != nil && !match(st, ps) {
+			continue
+		}
+		for i, c := range cols {
+			if i > 0 {
+				f(" ")
+			}
+			f("%s", c.cell(st, ps))
+		}
+		f("\n")
+	}
+}
+
+// statusColumn is a column of the peer table.
+type statusColumn struct {
+	name string
+	cell func(*ipnstate.Status, *ipnstate.PeerStatus) string
+}
+
+const defaultStatusColumns = "id,os,ip,host,tx,rx,relay,addrs"
+
+var statusColumns = []statusColumn{
+	{"id", func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) string { return ps.PublicKey.ShortString() }},
+	{"os", func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) string { return fmt.Sprintf("%-7s", ps.OS) }},
+	{"ip", func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) string { return fmt.Sprintf("%-15s", ps.TailAddr) }},
+	{"host", func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) string {
+		return fmt.Sprintf("%-18s", ps.SimpleHostName())
+	}},
+	{"user", func(st *ipnstate.Status, ps *ipnstate.PeerStatus) string {
+		return fmt.Sprintf("%-20s", st.User[ps.UserID].LoginName)
+	}},
+	{"tags", func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) string {
+		return fmt.Sprintf("%-15s", strings.Join(ps.Tags, ","))
+	}},
+	{"tx", func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) string { return fmt.Sprintf("tx=%8d", ps.TxBytes) }},
+	{"rx", func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) string { return fmt.Sprintf("rx=%8d", ps.RxBytes) }},
+	{"relay", func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) string {
 		relay := ps.Relay
-		if active && relay != "" && ps.CurAddr == "" {
+		if peerActive(ps) && relay != "" && ps.CurAddr == "" {
 			relay = "*" + relay + "*"
 		} else {
 			relay = " " + relay
 		}
-		f("%-6s", relay)
+		// Five wide, plus the separator, keeps the table as it was
+		// before columns were selectable.
+		return fmt.Sprintf("%-5s", relay)
+	}},
+	{"addrs", func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) string {
+		var b strings.Builder
 		for i, addr := range ps.Addrs {
 			if i != 0 {
-				f(", ")
+				b.WriteString(", ")
 			}
 			if addr == ps.CurAddr {
-				f("*%s*", addr)
+				fmt.Fprintf(&b, "*%s*", addr)
 			} else {
-				f("%s", addr)
+				b.WriteString(addr)
 			}
 		}
-		f("\n")
+		return b.String()
+	}},
+}
+
+func statusColumnNames() []string {
+	var names []string
+	for _, c := range statusColumns {
+		names = append(names, c.name)
 	}
-	os.Stdout.Write(buf.Bytes())
-	return nil
+	return names
+}
+
+func parseStatusColumns(s string) ([]statusColumn, error) {
+	var cols []statusColumn
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, c := range statusColumns {
+			if c.name == name {
+				cols = append(cols, c)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown status column %q; want some of %s", name, strings.Join(statusColumnNames(), ","))
+		}
+	}
+	return cols, nil
+}
+
+// peerActive reports whether we've recently sent ps traffic.
+func peerActive(ps *ipnstate.PeerStatus) bool {
+	// TODO: let server report this active bool instead
+	return !ps.LastWrite.IsZero() && time.Since(ps.LastWrite) < 2*time.Minute
+}
+
+// peerMatcher reports whether a peer is of interest.
+type peerMatcher func(*ipnstate.Status, *ipnstate.PeerStatus) bool
+
+// parsePeerSelectors parses the --peers flag into a func reporting
+// whether a peer matches any of the selectors. It returns a nil func
+// if s is empty, meaning all peers match.
+func parsePeerSelectors(s string) (peerMatcher, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var sels []peerMatcher
+	for _, sel := range strings.Split(s, ",") {
+		sel := strings.TrimSpace(sel)
+		switch {
+		case sel == "":
+			continue
+		case strings.HasPrefix(sel, "tag:"):
+			sels = append(sels, func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) bool {
+				for _, t := range ps.Tags {
+					if t == sel {
+						return true
+					}
+				}
+				return false
+			})
+		case strings.HasPrefix(sel, "os:"):
+			osName := strings.TrimPrefix(sel, "os:")
+			sels = append(sels, func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) bool { return strings.EqualFold(ps.OS, osName) })
+		case strings.HasPrefix(sel, "user:"):
+			login := strings.TrimPrefix(sel, "user:")
+			sels = append(sels, func(st *ipnstate.Status, ps *ipnstate.PeerStatus) bool {
+				return strings.EqualFold(st.User[ps.UserID].LoginName, login)
+			})
+		case sel == "active":
+			sels = append(sels, func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) bool { return peerActive(ps) })
+		default:
+			if _, err := path.Match(sel, ""); err != nil {
+				return nil, fmt.Errorf("bad peer selector %q: %v", sel, err)
+			}
+			pat := strings.ToLower(sel)
+			sels = append(sels, func(_ *ipnstate.Status, ps *ipnstate.PeerStatus) bool {
+				if ps.TailAddr == sel {
+					return true
+				}
+				ok, _ := path.Match(pat, strings.ToLower(ps.SimpleHostName()))
+				return ok
+			})
+		}
+	}
+	return func(st *ipnstate.Status, ps *ipnstate.PeerStatus) bool {
+		for _, sel := range sels {
+			if sel(st, ps) {
+				return true
+			}
+		}
+		return false
+	}, nil
 }
@@ -0,0 +1,126 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func testStatus() *ipnstate.Status {
+	return &ipnstate.Status{
+		Peer: map[key.Public]*ipnstate.PeerStatus{
+			{1}: {
+				PublicKey: key.Public{1},
+				HostName:  "web-1.local",
+				OS:        "linux",
+				UserID:    1,
+				Tags:      []string{"tag:web"},
+				TailAddr:  "100.101.102.1",
+				Addrs:     []string{"1.2.3.4:41641", "10.0.0.1:41641"},
+				CurAddr:   "10.0.0.1:41641",
+				Relay:     "nyc",
+				TxBytes:   10,
+				RxBytes:   20,
+				LastWrite: time.Now(),
+			},
+			{2}: {
+				PublicKey: key.Public{2},
+				HostName:  "laptop",
+				OS:        "macOS",
+				UserID:    2,
+				TailAddr:  "100.101.102.2",
+				Relay:     "sfo",
+			},
+		},
+		User: map[tailcfg.UserID]tailcfg.UserProfile{
+			1: {LoginName: "ops@example.com"},
+			2: {LoginName: "alice@example.com"},
+		},
+	}
+}
+
+func TestParsePeerSelectors(t *testing.T) {
+	st := testStatus()
+	tests := []struct {
+		sel     string
+		want    string // space-separated hostnames
+		wantErr bool
+	}{
+		{sel: "", want: "web-1 laptop"},
+		{sel: "tag:web", want: "web-1"},
+		{sel: "os:MACOS", want: "laptop"},
+		{sel: "user:Alice@example.com", want: "laptop"},
+		{sel: "active", want: "web-1"},
+		{sel: "web-*", want: "web-1"},
+		{sel: "100.101.102.2", want: "laptop"},
+		{sel: "tag:web, laptop", want: "web-1 laptop"},
+		{sel: "nomatch", want: ""},
+		{sel: "[", wantErr: true},
+	}
+	for _, tt := range tests {
+		match, err := parsePeerSelectors(tt.sel)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePeerSelectors(%q): err = %v; want error: %v", tt.sel, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var got []string
+		for _, k := range st.Peers() {
+			ps := st.Peer[k]
+			if match == nil || match(st, ps) {
+				got = append(got, ps.SimpleHostName())
+			}
+		}
+		if g := strings.Join(got, " "); g != tt.want {
+			t.Errorf("parsePeerSelectors(%q) matches %q; want %q", tt.sel, g, tt.want)
+		}
+	}
+}
+
+func TestParseStatusColumns(t *testing.T) {
+	cols, err := parseStatusColumns("ip, user,tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range cols {
+		names = append(names, c.name)
+	}
+	if got := strings.Join(names, ","); got != "ip,user,tags" {
+		t.Errorf("columns = %s; want ip,user,tags", got)
+	}
+	if _, err := parseStatusColumns("ip,bogus"); err == nil {
+		t.Errorf("unknown column accepted")
+	}
+	if _, err := parseStatusColumns(defaultStatusColumns); err != nil {
+		t.Errorf("default columns: %v", err)
+	}
+}
+
+func TestPrintStatusDefaultColumns(t *testing.T) {
+	st := testStatus()
+	delete(st.Peer, key.Public{2})
+	cols, err := parseStatusColumns(defaultStatusColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	printStatus(&buf, st, cols, nil)
+	// The layout of the table before its columns were selectable.
+	want := st.Peer[key.Public{1}].PublicKey.ShortString() +
+		" linux   100.101.102.1   web-1              tx=      10 rx=      20  nyc  1.2.3.4:41641, *10.0.0.1:41641*\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
@@ -25,9 +25,11 @@ import (
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"tailscale.com/ipn"
+	"tailscale.com/net/interfaces"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
 	"tailscale.com/wgengine/router"
 )
 
@@ -54,17 +56,33 @@ func main() {
 	upf.StringVar(&upArgs.server, "login-server", "https://login.tailscale.com", "base URL of control server")
 	upf.BoolVar(&upArgs.acceptRoutes, "accept-routes", false, "accept routes advertised by other Tailscale nodes")
 	upf.BoolVar(&upArgs.singleRoutes, "host-routes", true, "install host routes to other Tailscale nodes")
+	upf.BoolVar(&upArgs.exitNodeDNS, "exit-node-dns", true, "while using an exit node, send all DNS queries through it, so that none go to the local network's resolvers")
 	upf.BoolVar(&upArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
-	upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "ACL tags to request (comma-separated, e.g. eng,montreal,ssh)")
+	upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "ACL tags to request (comma-separated, e.g. tag:eng,tag:montreal); changing them doesn't require logging in again, and \"tailscale status\" shows any the control server didn't grant")
 	upf.StringVar(&upArgs.authKey, "authkey", "", "node authorization key")
 	upf.BoolVar(&upArgs.enableDERP, "enable-derp", true, "enable the use of DERP servers")
+	upf.BoolVar(&upArgs.cloudInfo, "cloud-info", false, "look up the cloud instance's identity (provider, region, instance type and IDs) and send it to the control server")
+	upf.BoolVar(&upArgs.portMapping, "port-mapping", true, "probe the LAN's gateway for UPnP, NAT-PMP and PCP port mapping")
+	upf.BoolVar(&upArgs.lanDiscovery, "lan-discovery", true, "use LAN addresses to find direct paths to peers on the same network")
+	upf.StringVar(&upArgs.metered, "metered", "auto", "whether to treat the network as metered and reduce background traffic (one of auto, true, false)")
+	upf.StringVar(&upArgs.schedule, "schedule", "", "times of the week to change state at, in local time (semicolon-separated \"DAYS HH:MM ACTION\" entries, e.g. \"mon-fri 09:00 down; mon-fri 17:30 up\"; actions are up, down, accept-routes and no-accept-routes)")
 	if runtime.GOOS == "linux" || isBSD(runtime.GOOS) {
 		upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. 10.0.0.0/8,192.168.0.0/24)")
 	}
 	if runtime.GOOS == "linux" {
 		upf.BoolVar(&upArgs.snat, "snat-subnet-routes", true, "source NAT traffic to local routes advertised with -advertise-routes")
+		upf.BoolVar(&upArgs.siteToSite, "site-to-site", false, "link this subnet router's LAN with those of other --site-to-site routers, without source NAT between them; advertises this machine's LAN unless -advertise-routes is given")
+		upf.StringVar(&upArgs.proxyNeighbors, "proxy-neighbors", "", "addresses reached over Tailscale to answer ARP/NDP for on the LAN, so LAN hosts see them as on-link (comma-separated, at most 256 addresses per prefix, e.g. 192.168.1.240/28)")
 		upf.StringVar(&upArgs.netfilterMode, "netfilter-mode", "on", "netfilter mode (one of on, nodivert, off)")
+		upf.BoolVar(&upArgs.killSwitch, "kill-switch", false, "while an exit node is in use (with --accept-routes), block all traffic that doesn't go over Tailscale, so nothing leaks if it becomes unreachable")
+		upf.BoolVar(&upArgs.lockdown, "lockdown", false, "block all traffic that doesn't go over Tailscale, even while stopped; only an administrator can turn this off again")
+		upf.BoolVar(&upArgs.exclusiveDNS, "exclusive-dns", true, "with openresolv, make Tailscale's nameservers the only ones used while they resolve all names; if false, only add them and the search domains to the system's")
 	}
+	if runtime.GOOS == "windows" {
+		upf.BoolVar(&upArgs.exitNodeLockdown, "exit-node-lockdown", false, "while using an exit node, block all traffic that doesn't go over Tailscale, other than tailscaled's own, so nothing leaks to the local network if the tunnel drops")
+	}
+	upf.BoolVar(&upArgs.exitNodeAllowLAN, "exit-node-allow-lan-access", false, "while using an exit node, keep reaching the local networks directly instead of through it")
+	upf.BoolVar(&upArgs.strictControlKey, "strict-control-key", false, "refuse to connect if the control server's key changes from the one first seen, as if the server were replaced")
 	upCmd := &ffcli.Command{
 		Name:       "up",
 		ShortUsage: "up [flags]",
@@ -75,7 +93,8 @@ func main() {
 triggering authentication if necessary.
 
 The flags passed to this command are specific to this machine. If you don't
-specify any flags, options are reset to their default.
+specify any flags, options are reset to their default. To change some
+settings without resetting the others, use "tailscale set".
 `),
 		FlagSet: upf,
 		Exec:    runUp,
@@ -94,8 +113,12 @@ change in the future.
 `),
 		Subcommands: []*ffcli.Command{
 			upCmd,
+			newSetCmd(upf),
 			netcheckCmd,
 			statusCmd,
+			debugCmd,
+			knownHostsCmd,
+			configureCmd,
 		},
 		FlagSet: rootfs,
 		Exec:    func(context.Context, []string) error { return flag.ErrHelp },
@@ -107,16 +130,30 @@ change in the future.
 }
 
 var upArgs struct {
-	server          string
-	acceptRoutes    bool
-	singleRoutes    bool
-	shieldsUp       bool
-	advertiseRoutes string
-	advertiseTags   string
-	enableDERP      bool
-	snat            bool
-	netfilterMode   string
-	authKey         string
+	server           string
+	acceptRoutes     bool
+	singleRoutes     bool
+	exitNodeDNS      bool
+	shieldsUp        bool
+	advertiseRoutes  string
+	advertiseTags    string
+	enableDERP       bool
+	cloudInfo        bool
+	portMapping      bool
+	lanDiscovery     bool
+	metered          string
+	schedule         string
+	snat             bool
+	siteToSite       bool
+	proxyNeighbors   string
+	netfilterMode    string
+	killSwitch       bool
+	lockdown         bool
+	exitNodeLockdown bool
+	exitNodeAllowLAN bool
+	strictControlKey bool
+	exclusiveDNS     bool
+	authKey          string
 }
 
 // parseIPOrCIDR parses an IP address or a CIDR prefix. If the input
@@ -153,29 +190,78 @@ func warning(format string, args ...interface{}) {
 // checkIPForwarding prints warnings on linux if IP forwarding is not
 // enabled, or if we were unable to verify the state of IP forwarding.
 func checkIPForwarding() {
-	var key string
+	var keys []string
 
 	if runtime.GOOS == "linux" {
-		key = "net.ipv4.ip_forward"
+		keys = append(keys, "net.ipv4.ip_forward")
+		if strings.Contains(upArgs.advertiseRoutes, ":") {
+			keys = append(keys, "net.ipv6.conf.all.forwarding")
+		}
 	} else if isBSD(runtime.GOOS) {
-		key = "net.inet.ip.forwarding"
-	} else {
-		return
+		keys = append(keys, "net.inet.ip.forwarding")
+	}
+
+	for _, key := range keys {
+		bs, err := exec.Command("sysctl", "-n", key).Output()
+		if err != nil {
+			warning("couldn't check %s (%v).\nSubnet routes won't work without IP forwarding.", key, err)
+			continue
+		}
+		on, err := strconv.ParseBool(string(bytes.TrimSpace(bs)))
+		if err != nil {
+			warning("couldn't parse %s (%v).\nSubnet routes won't work without IP forwarding.", key, err)
+			continue
+		}
+		if !on {
+			warning("%s is disabled. Subnet routes won't work.", key)
+		}
+	}
+}
+
+// privateNets are the RFC 1918 ranges.
+var privateNets = func() []*net.IPNet {
+	var ret []*net.IPNet
+	for _, s := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"} {
+		_, ipn, _ := net.ParseCIDR(s)
+		ret = append(ret, ipn)
 	}
+	return ret
+}()
 
-	bs, err := exec.Command("sysctl", "-n", key).Output()
+// siteSubnets returns the private IPv4 subnets of the interface with
+// the default route, which is taken to be this site's LAN.
+func siteSubnets() ([]wgcfg.CIDR, error) {
+	name, err := interfaces.DefaultRouteInterface()
 	if err != nil {
-		warning("couldn't check %s (%v).\nSubnet routes won't work without IP forwarding.", key, err)
-		return
+		return nil, err
 	}
-	on, err := strconv.ParseBool(string(bytes.TrimSpace(bs)))
+	ifi, err := net.InterfaceByName(name)
 	if err != nil {
-		warning("couldn't parse %s (%v).\nSubnet routes won't work without IP forwarding.", key, err)
-		return
+		return nil, err
 	}
-	if !on {
-		warning("%s is disabled. Subnet routes won't work.", key)
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
 	}
+	var ret []wgcfg.CIDR
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || ipn.IP.To4() == nil {
+			continue
+		}
+		for _, priv := range privateNets {
+			if !priv.Contains(ipn.IP) {
+				continue
+			}
+			subnet := &net.IPNet{IP: ipn.IP.Mask(ipn.Mask), Mask: ipn.Mask}
+			cidr, err := wgcfg.ParseCIDR(subnet.String())
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, cidr)
+		}
+	}
+	return ret, nil
 }
 
 func runUp(ctx context.Context, args []string) error {
@@ -183,55 +269,20 @@ func runUp(ctx context.Context, args []string) error {
 		log.Fatalf("too many non-flag arguments: %q", args)
 	}
 
-	var routes []wgcfg.CIDR
-	if upArgs.advertiseRoutes != "" {
+	if upArgs.advertiseRoutes != "" || upArgs.proxyNeighbors != "" || upArgs.siteToSite {
 		checkIPForwarding()
-		advroutes := strings.Split(upArgs.advertiseRoutes, ",")
-		for _, s := range advroutes {
-			cidr, ok := parseIPOrCIDR(s)
-			if !ok {
-				log.Fatalf("%q is not a valid IP address or CIDR prefix", s)
-			}
-			routes = append(routes, cidr)
-		}
-	}
-
-	var tags []string
-	if upArgs.advertiseTags != "" {
-		tags = strings.Split(upArgs.advertiseTags, ",")
-		for _, tag := range tags {
-			err := tailcfg.CheckTag(tag)
-			if err != nil {
-				log.Fatalf("tag: %q: %s", tag, err)
-			}
-		}
 	}
 
-	// TODO(apenwarr): fix different semantics between prefs and uflags
-	// TODO(apenwarr): allow setting/using CorpDNS
-	prefs := ipn.NewPrefs()
-	prefs.ControlURL = upArgs.server
+	prefs := prefsFromUpArgs()
 	prefs.WantRunning = true
-	prefs.RouteAll = upArgs.acceptRoutes
-	prefs.AllowSingleHosts = upArgs.singleRoutes
-	prefs.ShieldsUp = upArgs.shieldsUp
-	prefs.AdvertiseRoutes = routes
-	prefs.AdvertiseTags = tags
-	prefs.NoSNAT = !upArgs.snat
-	prefs.DisableDERP = !upArgs.enableDERP
-	if runtime.GOOS == "linux" {
-		switch upArgs.netfilterMode {
-		case "on":
-			prefs.NetfilterMode = router.NetfilterOn
-		case "nodivert":
-			prefs.NetfilterMode = router.NetfilterNoDivert
-			warning("netfilter=nodivert; add iptables calls to ts-* chains manually.")
-		case "off":
-			prefs.NetfilterMode = router.NetfilterOff
-			warning("netfilter=off; configure iptables yourself.")
-		default:
-			log.Fatalf("invalid value --netfilter-mode: %q", upArgs.netfilterMode)
-		}
+	if runtime.GOOS == "linux" && prefs.KillSwitch && !prefs.RouteAll {
+		warning("--kill-switch has no effect without --accept-routes.")
+	}
+	if runtime.GOOS == "windows" && prefs.ExitNodeLockdown && !prefs.RouteAll {
+		warning("--exit-node-lockdown has no effect without --accept-routes.")
+	}
+	if prefs.ExitNodeAllowLANAccess && !prefs.RouteAll {
+		warning("--exit-node-allow-lan-access has no effect without --accept-routes.")
 	}
 
 	c, bc, ctx, cancel := connect(ctx)
@@ -282,6 +333,118 @@ func runUp(ctx context.Context, args []string) error {
 	return nil
 }
 
+// prefsFromUpArgs returns the prefs the flags of up describe, other
+// than WantRunning. It exits if a flag is invalid.
+func prefsFromUpArgs() *ipn.Prefs {
+	var routes []wgcfg.CIDR
+	if upArgs.advertiseRoutes != "" {
+		advroutes := strings.Split(upArgs.advertiseRoutes, ",")
+		for _, s := range advroutes {
+			cidr, ok := parseIPOrCIDR(s)
+			if !ok {
+				log.Fatalf("%q is not a valid IP address or CIDR prefix", s)
+			}
+			routes = append(routes, cidr)
+		}
+	}
+	if upArgs.siteToSite {
+		if len(routes) == 0 {
+			var err error
+			routes, err = siteSubnets()
+			if err != nil || len(routes) == 0 {
+				log.Fatalf("--site-to-site: couldn't find this machine's LAN (%v); name it with --advertise-routes", err)
+			}
+			fmt.Printf("Advertising this site's LAN: %v\n", routes)
+		}
+		fmt.Printf("For hosts on this LAN to reach the other sites, route their subnets to this machine, as with a static route on the LAN's gateway.\n")
+	}
+
+	var proxyNeighbors []wgcfg.CIDR
+	if upArgs.proxyNeighbors != "" {
+		for _, s := range strings.Split(upArgs.proxyNeighbors, ",") {
+			cidr, ok := parseIPOrCIDR(s)
+			if !ok {
+				log.Fatalf("%q is not a valid IP address or CIDR prefix", s)
+			}
+			proxyNeighbors = append(proxyNeighbors, cidr)
+		}
+	}
+
+	var tags []string
+	if upArgs.advertiseTags != "" {
+		var bad []string
+		seen := map[string]bool{}
+		for _, tag := range strings.Split(upArgs.advertiseTags, ",") {
+			tag = strings.TrimSpace(tag)
+			if seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			if err := tailcfg.CheckTag(tag); err != nil {
+				bad = append(bad, fmt.Sprintf("%q: %s", tag, err))
+				continue
+			}
+			tags = append(tags, tag)
+		}
+		if len(bad) > 0 {
+			log.Fatalf("invalid --advertise-tags:\n\t%s", strings.Join(bad, "\n\t"))
+		}
+	}
+
+	// TODO(apenwarr): fix different semantics between prefs and uflags
+	// TODO(apenwarr): allow setting/using CorpDNS
+	prefs := ipn.NewPrefs()
+	prefs.ControlURL = upArgs.server
+	prefs.RouteAll = upArgs.acceptRoutes
+	prefs.AllowSingleHosts = upArgs.singleRoutes
+	prefs.NoExitNodeDNS = !upArgs.exitNodeDNS
+	prefs.ShieldsUp = upArgs.shieldsUp
+	prefs.AdvertiseRoutes = routes
+	prefs.AdvertiseTags = tags
+	prefs.NoSNAT = !upArgs.snat
+	prefs.SiteToSite = upArgs.siteToSite
+	prefs.ProxyNeighbors = proxyNeighbors
+	prefs.DisableDERP = !upArgs.enableDERP
+	prefs.CloudInfo = upArgs.cloudInfo
+	prefs.NoPortMapping = !upArgs.portMapping
+	prefs.NoLANDiscovery = !upArgs.lanDiscovery
+	switch upArgs.metered {
+	case "auto":
+	case "true", "false":
+		prefs.Metered = opt.Bool(upArgs.metered)
+	default:
+		log.Fatalf("invalid value --metered: %q", upArgs.metered)
+	}
+	schedule, err := ipn.ParseSchedule(upArgs.schedule)
+	if err != nil {
+		log.Fatalf("invalid --schedule: %v", err)
+	}
+	prefs.Schedule = schedule
+	if runtime.GOOS == "linux" {
+		switch upArgs.netfilterMode {
+		case "on":
+			prefs.NetfilterMode = router.NetfilterOn
+		case "nodivert":
+			prefs.NetfilterMode = router.NetfilterNoDivert
+			warning("netfilter=nodivert; add iptables calls to ts-* chains manually.")
+		case "off":
+			prefs.NetfilterMode = router.NetfilterOff
+			warning("netfilter=off; configure iptables yourself.")
+		default:
+			log.Fatalf("invalid value --netfilter-mode: %q", upArgs.netfilterMode)
+		}
+		prefs.KillSwitch = upArgs.killSwitch
+		prefs.Lockdown = upArgs.lockdown
+		prefs.NoExclusiveDNS = !upArgs.exclusiveDNS
+	}
+	if runtime.GOOS == "windows" {
+		prefs.ExitNodeLockdown = upArgs.exitNodeLockdown
+	}
+	prefs.ExitNodeAllowLANAccess = upArgs.exitNodeAllowLAN
+	prefs.StrictControlKey = upArgs.strictControlKey
+	return prefs
+}
+
 func connect(ctx context.Context) (net.Conn, *ipn.BackendClient, context.Context, context.CancelFunc) {
 	c, err := safesocket.Connect(rootArgs.socket, 41112)
 	if err != nil {
@@ -0,0 +1,584 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/ipn"
+	"tailscale.com/paths"
+	"tailscale.com/safesocket"
+	"tailscale.com/tailcfg"
+)
+
+// Paths used by install-system-daemon. They match the paths in
+// tailscaled.service and the Linux packages.
+const (
+	installBinPath      = "/usr/sbin/tailscaled"
+	installUnitPath     = "/etc/systemd/system/tailscaled.service"
+	installDefaultsPath = "/etc/default/tailscaled"
+	installTmpfilesPath = "/etc/tmpfiles.d/tailscale.conf"
+)
+
+// SMF service used by install-system-daemon on illumos and Solaris.
+const (
+	installManifestPath = "/var/svc/manifest/site/tailscale.xml"
+	smfService          = "network/tailscale"
+)
+
+// systemdUnit is the contents of tailscaled.service, which must be
+// kept in sync with it; TestSystemdUnit checks that it is.
+const systemdUnit = `[Unit]
+Description=Tailscale node agent
+Documentation=https://tailscale.com/kb/
+Wants=network-pre.target
+After=network-pre.target
+StartLimitIntervalSec=0
+StartLimitBurst=0
+
+[Service]
+EnvironmentFile=/etc/default/tailscaled
+ExecStart=/usr/sbin/tailscaled --state=/var/lib/tailscale/tailscaled.state --socket=/run/tailscale/tailscaled.sock --port $PORT $FLAGS
+
+Restart=on-failure
+
+RuntimeDirectory=tailscale
+RuntimeDirectoryMode=0755
+StateDirectory=tailscale
+StateDirectoryMode=0750
+CacheDirectory=tailscale
+CacheDirectoryMode=0750
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// tmpfilesConf is the tmpfiles.d(5) configuration creating the
+// directories in the unit, with the same modes, for running tailscaled
+// or the CLI outside the service before it has ever started.
+// tailscaled runs as root, so there's no sysusers.d(5) configuration
+// to go with it.
+const tmpfilesConf = `# Written by tailscaled install-system-daemon.
+d /var/lib/tailscale 0750 root root -
+d /var/cache/tailscale 0750 root root -
+d /run/tailscale 0755 root root -
+`
+
+// installResult is the machine-readable outcome of
+// install-system-daemon or uninstall-system-daemon, printed to stdout
+// as a single JSON line.
+type installResult struct {
+	Success bool
+	State   string `json:",omitempty"` // final backend state, if it was reached
+	Error   string `json:",omitempty"`
+}
+
+var installArgs struct {
+	authKey         string
+	server          string
+	advertiseRoutes string
+	advertiseTags   string
+	acceptRoutes    bool
+	port            int
+	flags           string
+	timeout         time.Duration
+	root            string
+
+	// setDefaults is whether --port or --flags was given, which
+	// replaces an existing installDefaultsPath.
+	setDefaults bool
+}
+
+// runInstallSystemDaemon implements "tailscaled install-system-daemon",
+// a one-shot setup for provisioning scripts such as cloud-init, and
+// for packages' postinstall scripts and installs from tarballs: it
+// installs tailscaled as a systemd service, or an SMF service on
+// illumos and Solaris, starts it, and, given an auth key, brings the
+// node up. It reports the outcome on stdout and via the process exit
+// code.
+//
+// With --root, it only writes the files under that directory, for
+// building packages.
+func runInstallSystemDaemon(args []string) {
+	fs := flag.NewFlagSet("install-system-daemon", flag.ExitOnError)
+	fs.StringVar(&installArgs.authKey, "authkey", "", "node authorization key; without one, the service is started but the node isn't brought up")
+	fs.StringVar(&installArgs.server, "login-server", "https://login.tailscale.com", "base URL of control server")
+	fs.StringVar(&installArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. 10.0.0.0/8,192.168.0.0/24)")
+	fs.StringVar(&installArgs.advertiseTags, "advertise-tags", "", "ACL tags to request (comma-separated, e.g. eng,montreal,ssh)")
+	fs.BoolVar(&installArgs.acceptRoutes, "accept-routes", false, "accept routes advertised by other Tailscale nodes")
+	fs.IntVar(&installArgs.port, "port", 41641, "UDP port for tailscaled to listen on")
+	fs.StringVar(&installArgs.flags, "flags", "", "extra flags for tailscaled, written to "+installDefaultsPath+" or, on illumos, the SMF manifest")
+	fs.DurationVar(&installArgs.timeout, "timeout", 2*time.Minute, "how long to wait for the node to come up")
+	fs.StringVar(&installArgs.root, "root", "", "if non-empty, only write the files under this directory, without starting anything, for building packages")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		log.Fatalf("too many non-flag arguments: %q", fs.Args())
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "port" || f.Name == "flags" {
+			installArgs.setDefaults = true
+		}
+	})
+
+	res := installResult{Success: true}
+	state, err := installSystemDaemon()
+	if state != nil {
+		res.State = state.String()
+	}
+	if err != nil {
+		res.Success = false
+		res.Error = err.Error()
+	}
+	json.NewEncoder(os.Stdout).Encode(res)
+	if err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func installSystemDaemon() (*ipn.State, error) {
+	var installService func() error
+	switch runtime.GOOS {
+	case "linux":
+		if _, err := exec.LookPath("systemctl"); err != nil && installArgs.root == "" {
+			return nil, errors.New("install-system-daemon requires systemd")
+		}
+		installService = installSystemdService
+	case "illumos", "solaris":
+		installService = installSMFService
+	default:
+		return nil, fmt.Errorf("install-system-daemon is only supported on Linux and illumos, not %s", runtime.GOOS)
+	}
+	if installArgs.authKey != "" && installArgs.root != "" {
+		return nil, errors.New("--authkey can't be used with --root")
+	}
+	prefs, err := installPrefs()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := installBinary(); err != nil {
+		return nil, fmt.Errorf("installing binary: %v", err)
+	}
+	if err := installService(); err != nil {
+		return nil, err
+	}
+	if installArgs.authKey == "" {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), installArgs.timeout)
+	defer cancel()
+	return installUp(ctx, prefs)
+}
+
+// installSystemdService installs, enables and (re)starts the
+// tailscaled systemd service.
+func installSystemdService() error {
+	if err := writeInstallFile(installUnitPath, systemdUnit, 0644); err != nil {
+		return err
+	}
+	if err := writeInstallFile(installTmpfilesPath, tmpfilesConf, 0644); err != nil {
+		return err
+	}
+	if err := installDefaults(); err != nil {
+		return err
+	}
+	if installArgs.root != "" {
+		return nil
+	}
+	if _, err := exec.LookPath("systemd-tmpfiles"); err == nil {
+		if err := runAll("systemd-tmpfiles", []string{"--create", installTmpfilesPath}); err != nil {
+			return err
+		}
+	}
+	return runAll("systemctl",
+		[]string{"daemon-reload"},
+		[]string{"enable", "tailscaled"},
+		[]string{"restart", "tailscaled"},
+	)
+}
+
+// installSMFService imports the tailscale SMF service and (re)starts
+// it. SMF has no environment files, so the port and extra flags go
+// into the manifest's start method.
+func installSMFService() error {
+	manifest := smfManifest(installArgs.port, installArgs.flags)
+	if err := writeInstallFile(installManifestPath, manifest, 0444); err != nil {
+		return err
+	}
+	if installArgs.root != "" {
+		return nil
+	}
+	if err := runAll("svccfg", []string{"import", installManifestPath}); err != nil {
+		return err
+	}
+	// Disabling and re-enabling, waiting for each, restarts the
+	// service whether or not it was running, with the new manifest.
+	return runAll("svcadm",
+		[]string{"disable", "-s", smfService},
+		[]string{"enable", "-s", smfService},
+	)
+}
+
+// runUninstallSystemDaemon implements "tailscaled
+// uninstall-system-daemon", which undoes install-system-daemon for
+// packages' removal scripts and installs from tarballs: it stops and
+// disables the service and removes the files installing it wrote. The
+// binary is left to whoever installed it, and tailscaled's state and
+// settings are kept, so that reinstalling brings back the same node.
+func runUninstallSystemDaemon(args []string) {
+	fs := flag.NewFlagSet("uninstall-system-daemon", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		log.Fatalf("too many non-flag arguments: %q", fs.Args())
+	}
+
+	res := installResult{Success: true}
+	err := uninstallSystemDaemon()
+	if err != nil {
+		res.Success = false
+		res.Error = err.Error()
+	}
+	json.NewEncoder(os.Stdout).Encode(res)
+	if err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func uninstallSystemDaemon() error {
+	switch runtime.GOOS {
+	case "linux":
+		return uninstallSystemdService()
+	case "illumos", "solaris":
+		return uninstallSMFService()
+	}
+	return fmt.Errorf("uninstall-system-daemon is only supported on Linux and illumos, not %s", runtime.GOOS)
+}
+
+// uninstallSystemdService stops and disables the tailscaled systemd
+// service and removes the unit and tmpfiles.d files that
+// install-system-daemon wrote. The defaults file is kept, like a
+// package keeps its configuration files, so that reinstalling keeps
+// the admin's settings.
+func uninstallSystemdService() error {
+	_, err := exec.LookPath("systemctl")
+	haveSystemctl := err == nil
+	if haveSystemctl {
+		// This fails if the service was already removed; carry on
+		// removing whatever else is left.
+		if err := runAll("systemctl", []string{"disable", "--now", "tailscaled"}); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	if err := removeSystemdFiles(); err != nil {
+		return err
+	}
+	if !haveSystemctl {
+		return nil
+	}
+	return runAll("systemctl", []string{"daemon-reload"})
+}
+
+// uninstallSMFService stops the tailscale SMF service, deletes it,
+// and removes its manifest.
+func uninstallSMFService() error {
+	if err := runAll("svcadm", []string{"disable", "-s", smfService}); err != nil {
+		log.Printf("%v", err)
+	}
+	if err := runAll("svccfg", []string{"delete", smfService}); err != nil {
+		log.Printf("%v", err)
+	}
+	return removeFiles(installManifestPath)
+}
+
+// removeFiles removes paths, any of which may not exist.
+func removeFiles(paths ...string) error {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSystemdFiles removes the systemd unit and tmpfiles.d files
+// under --root, but only those still holding what
+// install-system-daemon wrote. Anything else there belongs to a
+// package or an admin, and is left alone.
+func removeSystemdFiles() error {
+	for _, f := range []struct {
+		path, contents string
+	}{
+		{installUnitPath, systemdUnit},
+		{installTmpfilesPath, tmpfilesConf},
+	} {
+		path := installPath(f.path)
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if string(b) != f.contents {
+			log.Printf("not removing %s: it wasn't written by install-system-daemon", path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installDefaults writes installDefaultsPath with the port and extra
+// flags. An existing one is kept unless --port or --flags was given,
+// so that reinstalling, as a package does on upgrade, keeps an
+// admin's settings.
+func installDefaults() error {
+	if !installArgs.setDefaults {
+		if _, err := os.Stat(installPath(installDefaultsPath)); err == nil {
+			return nil
+		}
+	}
+	defaults := fmt.Sprintf("# Written by tailscaled install-system-daemon.\nPORT=%q\nFLAGS=%q\n", fmt.Sprint(installArgs.port), installArgs.flags)
+	return writeInstallFile(installDefaultsPath, defaults, 0644)
+}
+
+// installPath returns path under --root.
+func installPath(path string) string {
+	return filepath.Join("/", installArgs.root, path)
+}
+
+// writeInstallFile writes contents to path under --root, creating
+// its directory if needed.
+func writeInstallFile(path, contents string, perm os.FileMode) error {
+	path = installPath(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(contents), perm)
+}
+
+// runAll runs cmd with each of argLists in turn, stopping at the
+// first failure.
+func runAll(cmd string, argLists ...[]string) error {
+	for _, args := range argLists {
+		if out, err := exec.Command(cmd, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s %s: %v: %s", cmd, strings.Join(args, " "), err, bytes.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// smfManifest returns the SMF manifest of the tailscale service,
+// which runs tailscaled on port with the extra flags. The start
+// method is run by the shell, like ExecStart in the systemd unit.
+func smfManifest(port int, flags string) string {
+	start := fmt.Sprintf("%s --state=/var/lib/tailscale/tailscaled.state --socket=/var/run/tailscale/tailscaled.sock --port %d", installBinPath, port)
+	if flags != "" {
+		start += " " + flags
+	}
+	var esc bytes.Buffer
+	xml.EscapeText(&esc, []byte(start))
+	return fmt.Sprintf(smfManifestTemplate, smfService, esc.String())
+}
+
+// smfManifestTemplate is the SMF manifest, given the service name and
+// the XML-escaped start command. The startd duration "child" makes
+// SMF supervise tailscaled in the foreground and restart it if it
+// exits.
+const smfManifestTemplate = `<?xml version="1.0"?>
+<!DOCTYPE service_bundle SYSTEM "/usr/share/lib/xml/dtd/service_bundle.dtd.1">
+<service_bundle type="manifest" name="tailscale">
+  <service name="%s" type="service" version="1">
+    <create_default_instance enabled="false"/>
+    <single_instance/>
+    <dependency name="network" grouping="require_all" restart_on="error" type="service">
+      <service_fmri value="svc:/milestone/network:default"/>
+    </dependency>
+    <dependency name="filesystem" grouping="require_all" restart_on="error" type="service">
+      <service_fmri value="svc:/system/filesystem/local:default"/>
+    </dependency>
+    <exec_method type="method" name="start" exec="%s" timeout_seconds="60"/>
+    <exec_method type="method" name="stop" exec=":kill" timeout_seconds="60"/>
+    <property_group name="startd" type="framework">
+      <propval name="duration" type="astring" value="child"/>
+    </property_group>
+    <stability value="Unstable"/>
+    <template>
+      <common_name>
+        <loctext xml:lang="C">Tailscale node agent</loctext>
+      </common_name>
+      <documentation>
+        <doc_link name="tailscale" uri="https://tailscale.com/kb/"/>
+      </documentation>
+    </template>
+  </service>
+</service_bundle>
+`
+
+// installPrefs returns the prefs requested by installArgs.
+func installPrefs() (*ipn.Prefs, error) {
+	prefs := ipn.NewPrefs()
+	prefs.ControlURL = installArgs.server
+	prefs.WantRunning = true
+	prefs.RouteAll = installArgs.acceptRoutes
+	if installArgs.advertiseRoutes != "" {
+		for _, s := range strings.Split(installArgs.advertiseRoutes, ",") {
+			cidr, err := wgcfg.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("--advertise-routes: %q is not a valid CIDR prefix", s)
+			}
+			prefs.AdvertiseRoutes = append(prefs.AdvertiseRoutes, cidr)
+		}
+	}
+	if installArgs.advertiseTags != "" {
+		for _, tag := range strings.Split(installArgs.advertiseTags, ",") {
+			if err := tailcfg.CheckTag(tag); err != nil {
+				return nil, fmt.Errorf("--advertise-tags: %q: %v", tag, err)
+			}
+			prefs.AdvertiseTags = append(prefs.AdvertiseTags, tag)
+		}
+	}
+	return prefs, nil
+}
+
+// installBinary copies the running executable to installBinPath
+// under --root, unless that's where it's running from.
+func installBinary() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	binPath := installPath(installBinPath)
+	if exe == binPath {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(binPath), 0755); err != nil {
+		return err
+	}
+	src, err := os.Open(exe)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := binPath + ".new"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, binPath)
+}
+
+// installUp connects to the freshly started tailscaled and brings the
+// node up with prefs and the auth key, waiting until it's running.
+// It never asks for interactive login; needing one is an error.
+func installUp(ctx context.Context, prefs *ipn.Prefs) (*ipn.State, error) {
+	// Wait for tailscaled to create its socket.
+	var c io.ReadWriteCloser
+	for {
+		var err error
+		c, err = safesocket.Connect(paths.DefaultTailscaledSocket(), 41112)
+		if err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("connecting to tailscaled: %v", err)
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+	defer c.Close()
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+
+	type outcome struct {
+		state ipn.State
+		err   error
+	}
+	done := make(chan outcome, 1)
+	finish := func(o outcome) {
+		select {
+		case done <- o:
+		default:
+		}
+	}
+
+	bc := ipn.NewBackendClient(log.Printf, func(b []byte) { ipn.WriteMsg(c, b) })
+	bc.SetPrefs(prefs)
+	bc.Start(ipn.Options{
+		StateKey: globalStateKey,
+		AuthKey:  installArgs.authKey,
+		Notify: func(n ipn.Notify) {
+			if n.ErrMessage != nil {
+				finish(outcome{err: fmt.Errorf("backend error: %v", *n.ErrMessage)})
+			}
+			if s := n.State; s != nil {
+				switch *s {
+				case ipn.NeedsLogin:
+					finish(outcome{state: *s, err: errors.New("auth key was not accepted")})
+				case ipn.NeedsMachineAuth:
+					finish(outcome{state: *s, err: errors.New("machine needs to be authorized by an admin")})
+				case ipn.Starting, ipn.Running:
+					finish(outcome{state: *s})
+				}
+			}
+		},
+	})
+
+	go func() {
+		for {
+			msg, err := ipn.ReadMsg(c)
+			if err != nil {
+				finish(outcome{err: fmt.Errorf("reading from tailscaled: %v", err)})
+				return
+			}
+			bc.GotNotifyMsg(msg)
+		}
+	}()
+
+	select {
+	case o := <-done:
+		if o.state == ipn.NoState {
+			return nil, o.err
+		}
+		return &o.state, o.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timed out waiting for node to come up: %v", ctx.Err())
+	}
+}
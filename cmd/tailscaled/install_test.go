@@ -0,0 +1,144 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSMFManifest(t *testing.T) {
+	var m struct {
+		Service struct {
+			Name        string `xml:"name,attr"`
+			ExecMethods []struct {
+				Name string `xml:"name,attr"`
+				Exec string `xml:"exec,attr"`
+			} `xml:"exec_method"`
+		} `xml:"service"`
+	}
+	manifest := smfManifest(41641, `--tun=tun1 --debug="localhost:8080" && true`)
+	if err := xml.Unmarshal([]byte(manifest), &m); err != nil {
+		t.Fatalf("manifest isn't valid XML: %v\n%s", err, manifest)
+	}
+	if m.Service.Name != smfService {
+		t.Errorf("service name = %q; want %q", m.Service.Name, smfService)
+	}
+	var start string
+	for _, em := range m.Service.ExecMethods {
+		if em.Name == "start" {
+			start = em.Exec
+		}
+	}
+	wantPrefix := installBinPath + " --state="
+	wantSuffix := ` --port 41641 --tun=tun1 --debug="localhost:8080" && true`
+	if !strings.HasPrefix(start, wantPrefix) || !strings.HasSuffix(start, wantSuffix) {
+		t.Errorf("start method = %q; want %q...%q", start, wantPrefix, wantSuffix)
+	}
+}
+
+// TestSystemdUnit checks that the unit install-system-daemon writes is
+// the one packaged next to it.
+func TestSystemdUnit(t *testing.T) {
+	b, err := ioutil.ReadFile("tailscaled.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != systemdUnit {
+		t.Errorf("systemdUnit differs from tailscaled.service; update it to match:\n%s", b)
+	}
+}
+
+func TestInstallSystemdServiceRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "install-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	oldArgs := installArgs
+	defer func() { installArgs = oldArgs }()
+
+	read := func(path string) string {
+		t.Helper()
+		b, err := ioutil.ReadFile(filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	installArgs.root = root
+	installArgs.port = 12345
+	installArgs.setDefaults = true
+	if err := installSystemdService(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(installUnitPath); got != systemdUnit {
+		t.Errorf("unit = %q; want systemdUnit", got)
+	}
+	if got := read(installTmpfilesPath); got != tmpfilesConf {
+		t.Errorf("tmpfiles.d = %q; want tmpfilesConf", got)
+	}
+	if got := read(installDefaultsPath); !strings.Contains(got, `PORT="12345"`) {
+		t.Errorf("defaults = %q; want PORT 12345", got)
+	}
+
+	// Reinstalling without --port or --flags, as on upgrade, keeps
+	// the defaults.
+	installArgs.port = 41641
+	installArgs.setDefaults = false
+	if err := installSystemdService(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(installDefaultsPath); !strings.Contains(got, `PORT="12345"`) {
+		t.Errorf("defaults after reinstall = %q; want PORT 12345 kept", got)
+	}
+}
+
+func TestRemoveSystemdFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "install-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	oldArgs := installArgs
+	defer func() { installArgs = oldArgs }()
+
+	exists := func(path string) bool {
+		_, err := os.Stat(filepath.Join(root, path))
+		return err == nil
+	}
+
+	installArgs.root = root
+	installArgs.port = 41641
+	if err := installSystemdService(); err != nil {
+		t.Fatal(err)
+	}
+	// An admin's edit makes the unit theirs.
+	if err := writeInstallFile(installUnitPath, systemdUnit+"# local change\n", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeSystemdFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(installUnitPath) {
+		t.Errorf("edited unit was removed")
+	}
+	if exists(installTmpfilesPath) {
+		t.Errorf("tmpfiles.d file wasn't removed")
+	}
+	if !exists(installDefaultsPath) {
+		t.Errorf("defaults file was removed")
+	}
+
+	// Removing again, with the tmpfiles.d file gone, is fine.
+	if err := removeSystemdFiles(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -11,22 +11,40 @@ package main // import "tailscale.com/cmd/tailscaled"
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/apenwarr/fixconsole"
 	"github.com/pborman/getopt/v2"
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnserver"
+	"tailscale.com/log/logsink"
 	"tailscale.com/logpolicy"
+	"tailscale.com/net/dnsmasq"
+	"tailscale.com/net/mcastrelay"
+	"tailscale.com/net/socks5"
+	"tailscale.com/net/tlsdial"
 	"tailscale.com/paths"
+	"tailscale.com/tsweb"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/magicsock"
+	"tailscale.com/wgengine/router"
 )
 
 // globalStateKey is the ipn.StateKey that tailscaled loads on
@@ -38,6 +56,10 @@ import (
 // later, the global state key doesn't look like a username.
 const globalStateKey = "_daemon"
 
+// logFlushTimeout bounds how long tailscaled waits for pending logs
+// to upload once it has shut down.
+const logFlushTimeout = 2 * time.Second
+
 func main() {
 	// We aren't very performance sensitive, and the parts that are
 	// performance sensitive (wireguard) try hard not to do any memory
@@ -47,32 +69,130 @@ func main() {
 		debug.SetGCPercent(10)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "install-system-daemon" {
+		runInstallSystemDaemon(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "uninstall-system-daemon" {
+		runUninstallSystemDaemon(os.Args[2:])
+		return
+	}
+
 	defaultTunName := "tailscale0"
-	if runtime.GOOS == "openbsd" {
+	switch runtime.GOOS {
+	case "openbsd":
 		defaultTunName = "tun"
+	case "illumos", "solaris":
+		defaultTunName = "tun0"
+	case "darwin":
+		// Let the kernel pick a free utun.
+		defaultTunName = "utun"
+	}
+
+	// In Chrome OS's Linux container, Chrome OS's own apps can't
+	// use the container's tun device, so they get a proxy instead.
+	defaultSOCKS5 := ""
+	if router.InCrostini() {
+		defaultSOCKS5 = socks5.DefaultAddr
 	}
 
 	fake := getopt.BoolLong("fake", 0, "fake tunnel+routing instead of tuntap")
 	debug := getopt.StringLong("debug", 0, "", "Address of debug server")
-	tunname := getopt.StringLong("tun", 0, defaultTunName, "tunnel interface name")
+	tunname := getopt.StringLong("tun", 0, defaultTunName, "tunnel interface name; with a name other than the default, the default --state and --socket paths and the log state are suffixed with it, so several instances can run at once")
 	listenport := getopt.Uint16Long("port", 'p', magicsock.DefaultPort, "WireGuard port (0=autoselect)")
 	statepath := getopt.StringLong("state", 0, paths.DefaultTailscaledStateFile(), "Path of state file")
 	socketpath := getopt.StringLong("socket", 's', paths.DefaultTailscaledSocket(), "Path of the service unix socket")
+	logoutOnExit := getopt.BoolLong("logout-on-exit", 0, "log out of the control server when exiting, for ephemeral nodes")
+	idleTimeout := getopt.DurationLong("idle-timeout", 0, 0, "if non-zero, exit after this long without traffic to or from peers")
+	configFile := getopt.StringLong("config", 0, "", "file of prefs, as JSON like \"tailscale debug prefs\" prints, to run with declaratively: the CLI can't change them, and the state file only holds the node key")
+	authKeyFile := getopt.StringLong("auth-key-file", 0, "", "file containing a node auth key to log in with when there's no node key yet, for unattended setups like --config")
+	lockdownUnlock := getopt.StringLong("lockdown-unlock-file", 0, "", "file whose existence allows turning off lockdown (default: lockdown-unlock next to the state file)")
+	logSink := getopt.StringLong("log-sink", 0, "", "where to write local logs: "+logsink.Specs)
+	noLogs := getopt.BoolLong("no-logs-no-support", 0, "disable log uploads entirely, including for debugging; also set by TS_NO_LOGS_NO_SUPPORT=true. Tailscale can't help debug nodes without logs")
+	dnsmasqDNS := getopt.BoolLong("dnsmasq-dns", 0, "while MagicDNS is on, have the local dnsmasq hand out Tailscale's DNS server to DHCP clients, for subnet routers that are the LAN's DHCP server")
+	dnsmasqConf := getopt.StringLong("dnsmasq-conf", 0, dnsmasq.DefaultConfPath(), "with --dnsmasq-dns, the dnsmasq config file to write")
+	dnsRecords := getopt.StringLong("dns-records-file", 0, "", `file of extra records for MagicDNS to serve, as a JSON array like [{"Name": "git.internal", "Value": "100.101.102.103"}]; Type may be A, AAAA or CNAME`)
+	dnsmasqReload := getopt.StringLong("dnsmasq-reload", 0, dnsmasq.DefaultReloadCommand(), "with --dnsmasq-dns, the command that restarts dnsmasq")
+	keyExpiryWarnings := getopt.StringLong("key-expiry-warnings", 0, "7d,1d,1h", "comma-separated times before the node key expires to warn about it")
+	keyExpiryCommand := getopt.StringLong("key-expiry-command", 0, "", "command to run, with a message as its last argument, for each key expiry warning (e.g. a desktop notifier)")
+	eventURL := getopt.StringLong("event-url", 0, "", "URL to POST a JSON description of each event (state change, peer added, key expiry warning) to")
+	eventCommand := getopt.StringLong("event-command", 0, "", "command to run for each event, with its JSON description on stdin and its type in $TS_EVENT")
+	routerName := getopt.StringLong("router", 0, "", "router backend that configures routes and DNS (default: this platform's); one of: "+strings.Join(router.Backends(), ", "))
+	upCommand := getopt.StringLong("up-command", 0, "", "command to run when the interface comes up; see the TS_* variables in its environment")
+	downCommand := getopt.StringLong("down-command", 0, "", "command to run when the interface goes down")
+	routesCommand := getopt.StringLong("routes-command", 0, "", "command to run when the routes into the interface change, including exit node changes")
+	mcastRelay := getopt.StringLong("mcast-relay", 0, "", "experimental: comma-separated IPv4 multicast groups or broadcast addresses, with ports, to relay between this node's LAN and the nodes in --mcast-relay-peers (e.g. 224.0.0.251:5353,239.255.255.250:1900 for mDNS and SSDP)")
+	mcastRelayPeers := getopt.StringLong("mcast-relay-peers", 0, "", "comma-separated Tailscale IPs of the other nodes relaying --mcast-relay traffic, which must allow UDP port "+strconv.Itoa(mcastrelay.DefaultPort)+" from this one")
+	mcastRelayIface := getopt.StringLong("mcast-relay-interface", 0, "", "the LAN interface to relay --mcast-relay traffic on")
+	hookTimeout := getopt.DurationLong("hook-timeout", 0, router.DefaultHookTimeout, "how long --up-command, --down-command and --routes-command may run")
+	ipfixCollector := getopt.StringLong("ipfix-collector", 0, "", "host:port of an IPFIX (NetFlow v10) collector to send the flows of Tailscale traffic to, over UDP, once a minute")
+	filterAudit := getopt.BoolLong("filter-audit", 0, "log each packet the packet filter drops (rate-limited), with the ACL rules involved, to debug ACL changes")
+	firewallExport := getopt.StringLong("firewall-export", 0, "", "write host firewall rules mirroring the tailnet's ACLs to FORMAT:FILE whenever they change; FORMAT is nftables or pf")
+	firewallReload := getopt.StringLong("firewall-export-reload", 0, "", "command to run after --firewall-export rewrites its file (e.g. \"nft -f /etc/nftables.d/tailscale.nft\")")
+	slaProbeTargets := getopt.StringLong("sla-probe-targets", 0, "", "comma-separated Tailscale IPs and ACL tags (tag:name) of peers to measure latency and loss to, exported as metrics at /debug/varz on the --debug server")
+	slaProbeIfTag := getopt.StringLong("sla-probe-if-tag", 0, "", "only send SLA probes while this node has this ACL tag")
+	slaProbeInterval := getopt.StringLong("sla-probe-interval", 0, "", "how often to probe each SLA probe target (default 1m)")
+	socks5Addr := getopt.StringLong("socks5-server", 0, defaultSOCKS5, "address of a SOCKS5 proxy server to run, through which programs that can't use the tun device reach the tailnet, such as localhost:1055 (the default in Chrome OS's Linux container); empty for none")
+	fwmark := getopt.StringLong("fwmark", 0, fmt.Sprintf("%#x", router.DefaultPolicyRouting.BypassMark), "Linux: the firewall mark on tailscaled's own packets, which are routed around the tailnet; change it if it collides with another VPN's or firewall's")
+	subnetRouteMark := getopt.StringLong("subnet-route-fwmark", 0, fmt.Sprintf("%#x", router.DefaultPolicyRouting.SubnetRouteMark), "Linux: the firewall mark on packets forwarded from the tailnet, for masquerading")
+	routingTable := getopt.Uint32Long("routing-table", 0, router.DefaultPolicyRouting.Table, "Linux: the number of the routing table for Tailscale's routes")
+	allowISPCGNAT := getopt.BoolLong("allow-isp-cgnat", 0, "Linux: let in traffic from subnets in Tailscale's 100.64.0.0/10 range on other interfaces, as from an ISP's carrier-grade NAT, from those interfaces; hosts there can then pose as Tailscale peers with addresses in those subnets")
+	watchdog := getopt.StringLong("watchdog", 0, "restart", "what to do when the engine or backend stops making progress, after logging all goroutines' stacks: \"restart\" exits, for the service manager to restart tailscaled, and \"log\" waits for it to recover")
+	extraCACerts := getopt.ListLong("extra-ca-certs", 0, "Comma-separated PEM files of CA certificates to trust for control and DERP, in addition to the system roots. Only files are supported; to trust a CA from a certificate store, add it to the system's store instead")
 
 	logf := wgengine.RusagePrefixLog(log.Printf)
 	logf = logger.RateLimitedFn(logf, 5*time.Second, 5, 100)
+	// Deduplicated passes lines on with their own format, so the rate
+	// limiter still limits (and exempts) each format separately.
+	logf = logger.Deduplicated(logf, time.Minute, time.Now)
 
 	err := fixconsole.FixConsoleIfNeeded()
 	if err != nil {
 		logf("fixConsoleOutput: %v", err)
 	}
-	pol := logpolicy.New("tailnode.log.tailscale.io")
 
 	getopt.Parse()
 	if len(getopt.Args()) > 0 {
 		log.Fatalf("too many non-flag arguments: %#v", getopt.Args()[0])
 	}
 
+	if *tunname != defaultTunName {
+		// Another instance, maybe alongside the default one, so
+		// keep its files apart from that one's.
+		if !getopt.IsSet("state") {
+			*statepath = paths.InstancePath(*statepath, *tunname)
+		}
+		if !getopt.IsSet("socket") {
+			*socketpath = paths.InstancePath(*socketpath, *tunname)
+		}
+		logpolicy.SetInstance(*tunname)
+	}
+
+	// Before anything dials out, since the bypass mark keeps
+	// tailscaled's own connections off the tailnet.
+	if err := setPolicyRouting(*fwmark, *subnetRouteMark, *routingTable); err != nil {
+		log.Fatalf("policy routing: %v", err)
+	}
+	router.SetAllowISPCGNAT(*allowISPCGNAT)
+
+	// Before logpolicy.New, which connects to the log server over TLS.
+	if err := tlsdial.SetExtraRootCAs(*extraCACerts); err != nil {
+		log.Fatalf("--extra-ca-certs: %v", err)
+	}
+
+	if err := logpolicy.SetLocalSink(*logSink); err != nil {
+		log.Fatalf("--log-sink: %v", err)
+	}
+	if v, _ := strconv.ParseBool(os.Getenv("TS_NO_LOGS_NO_SUPPORT")); v {
+		*noLogs = true
+	}
+	var pol *logpolicy.Policy
+	if *noLogs {
+		pol = logpolicy.NewNoLogs()
+	} else {
+		pol = logpolicy.New("tailnode.log.tailscale.io")
+	}
+
 	if *statepath == "" {
 		log.Fatalf("--state is required")
 	}
@@ -81,6 +201,10 @@ func main() {
 		log.Fatalf("--socket is required")
 	}
 
+	if *lockdownUnlock == "" {
+		*lockdownUnlock = filepath.Join(filepath.Dir(*statepath), "lockdown-unlock")
+	}
+
 	var debugMux *http.ServeMux
 	if *debug != "" {
 		debugMux = newDebugMux()
@@ -88,15 +212,79 @@ func main() {
 	}
 
 	var e wgengine.Engine
+	noTUN := *fake
 	if *fake {
 		e, err = wgengine.NewFakeUserspaceEngine(logf, 0)
 	} else {
-		e, err = wgengine.NewUserspaceEngine(logf, *tunname, *listenport)
+		var rb router.Backend
+		if rb, err = router.Lookup(*routerName); err != nil {
+			log.Fatalf("--router: %v", err)
+		}
+		rb = router.WithHooks(rb, router.Hooks{
+			Up:      *upCommand,
+			Down:    *downCommand,
+			Routes:  *routesCommand,
+			Timeout: *hookTimeout,
+		})
+		e, err = wgengine.NewUserspaceEngineWithRouter(logf, *tunname, *listenport, wgengine.RouterGen(rb))
+		if err != nil && canRunWithoutTUN(err) {
+			// Rather than not starting, come up without a tun
+			// device: the node stays logged in and visible to
+			// its peers, and starts carrying traffic once
+			// restarted with a device.
+			logf("wgengine.New: %v", err)
+			logf("no tun device; falling back to a userspace engine that carries no traffic")
+			e, err = wgengine.NewFakeUserspaceEngine(logf, *listenport)
+			noTUN = true
+		}
 	}
 	if err != nil {
 		log.Fatalf("wgengine.New: %v", err)
 	}
-	e = wgengine.NewWatchdog(e)
+	var watchdogRestart bool
+	switch *watchdog {
+	case "restart":
+		watchdogRestart = true
+		e = wgengine.NewWatchdog(e)
+	case "log":
+		e = wgengine.NewLoggingWatchdog(e)
+	default:
+		log.Fatalf("--watchdog: unknown action %q; want restart or log", *watchdog)
+	}
+	if pol.Logtail != nil {
+		e.SetMeteredCallback(pol.Logtail.SetMetered)
+	}
+	if *ipfixCollector != "" {
+		if err := e.SetFlowCollector(*ipfixCollector); err != nil {
+			log.Fatalf("--ipfix-collector: %v", err)
+		}
+	}
+	if *filterAudit {
+		e.SetFilterAudit(true)
+	}
+	if *slaProbeTargets != "" {
+		cfg := wgengine.SLAProbeConfig{
+			Targets: strings.Split(*slaProbeTargets, ","),
+			IfTag:   *slaProbeIfTag,
+		}
+		if *slaProbeInterval != "" {
+			d, err := time.ParseDuration(*slaProbeInterval)
+			if err != nil {
+				log.Fatalf("--sla-probe-interval: %v", err)
+			}
+			cfg.Interval = d
+		}
+		e.SetSLAProbes(cfg)
+	}
+	if *firewallExport != "" {
+		i := strings.Index(*firewallExport, ":")
+		if i < 0 {
+			log.Fatalf("--firewall-export: want FORMAT:FILE, got %q", *firewallExport)
+		}
+		if err := e.SetFirewallExport((*firewallExport)[:i], (*firewallExport)[i+1:], *firewallReload); err != nil {
+			log.Fatalf("--firewall-export: %v", err)
+		}
+	}
 
 	opts := ipnserver.Options{
 		SocketPath:         *socketpath,
@@ -105,21 +293,163 @@ func main() {
 		AutostartStateKey:  globalStateKey,
 		LegacyConfigPath:   paths.LegacyConfigPath,
 		SurviveDisconnects: true,
+		LogoutOnExit:       *logoutOnExit,
+		IdleTimeout:        *idleTimeout,
+		LockdownUnlockPath: *lockdownUnlock,
+		NoLogs:             *noLogs,
+		Warnings:           crostiniWarnings(noTUN, *socks5Addr),
+		DNSRecordsPath:     *dnsRecords,
+		WatchdogRestart:    watchdogRestart,
 		DebugMux:           debugMux,
 	}
-	err = ipnserver.Run(context.Background(), logf, pol.PublicID.String(), opts, e)
-	if err != nil {
+	if opts.KeyExpiryWarnings, err = ipn.ParseKeyExpiryWarnings(*keyExpiryWarnings); err != nil {
+		log.Fatalf("--key-expiry-warnings: %v", err)
+	}
+	if opts.KeyExpiryWarnings == nil {
+		opts.KeyExpiryWarnings = []time.Duration{} // none, rather than the defaults
+	}
+	opts.KeyExpiryCommand = *keyExpiryCommand
+	if *configFile != "" {
+		if opts.DeclarativePrefs, err = ipn.LoadPrefs(*configFile, false); err != nil {
+			log.Fatalf("--config: %v", err)
+		}
+	}
+	if *authKeyFile != "" {
+		b, err := ioutil.ReadFile(*authKeyFile)
+		if err != nil {
+			log.Fatalf("--auth-key-file: %v", err)
+		}
+		opts.AutostartAuthKey = strings.TrimSpace(string(b))
+	}
+	opts.EventURL = *eventURL
+	opts.EventCommand = *eventCommand
+	if *dnsmasqDNS {
+		opts.DHCPDNS = dnsmasq.New(logf, *dnsmasqConf, *dnsmasqReload)
+	}
+
+	// Stop gracefully on the first SIGINT or SIGTERM, so that the
+	// engine cleans up and LogoutOnExit gets a chance to run. A
+	// second signal kills the process as usual.
+	runCtx, runCancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-interrupt
+		logf("tailscaled got signal %v; shutting down", sig)
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+		runCancel()
+	}()
+
+	if *mcastRelay != "" {
+		relay, err := newMcastRelay(logf, *mcastRelay, *mcastRelayPeers, *mcastRelayIface)
+		if err != nil {
+			log.Fatalf("--mcast-relay: %v", err)
+		}
+		go relay.Run(runCtx)
+	}
+
+	if *socks5Addr != "" && noTUN {
+		logf("not starting the SOCKS5 proxy: without a tun device, it can't reach the tailnet")
+	} else if *socks5Addr != "" {
+		ln, err := net.Listen("tcp", *socks5Addr)
+		if err != nil {
+			log.Fatalf("--socks5-server: %v", err)
+		}
+		logf("SOCKS5 proxy listening on %v", ln.Addr())
+		go func() {
+			<-runCtx.Done()
+			ln.Close()
+		}()
+		go (&socks5.Server{Logf: logf}).Serve(ln)
+	}
+
+	err = ipnserver.Run(runCtx, logf, pol.PublicID.String(), opts, e)
+	if err != nil && err != context.Canceled {
 		log.Fatalf("tailscaled: %v", err)
 	}
 
-	// TODO(crawshaw): It would be nice to start a timeout context the moment a signal
-	// is received and use that timeout to give us a moment to finish uploading logs
-	// here. But the signal is handled inside ipnserver.Run, so some plumbing is needed.
-	ctx, cancel := context.WithCancel(context.Background())
-	cancel()
+	// Give the log uploader a moment to flush what's left, now
+	// that Run has finished shutting down.
+	ctx, cancel := context.WithTimeout(context.Background(), logFlushTimeout)
+	defer cancel()
 	pol.Shutdown(ctx)
 }
 
+// newMcastRelay returns the multicast relay configured by the
+// --mcast-relay flags.
+func newMcastRelay(logf logger.Logf, groups, peers, iface string) (*mcastrelay.Relay, error) {
+	cfg := mcastrelay.Config{Interface: iface}
+	var err error
+	if cfg.Groups, err = mcastrelay.ParseGroups(groups); err != nil {
+		return nil, err
+	}
+	for _, s := range strings.Split(peers, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		ip, err := netaddr.ParseIP(s)
+		if err != nil {
+			return nil, fmt.Errorf("--mcast-relay-peers: %v", err)
+		}
+		cfg.Peers = append(cfg.Peers, ip)
+	}
+	return mcastrelay.New(logf, cfg)
+}
+
+// setPolicyRouting configures the fwmarks and routing table the Linux
+// router uses from the --fwmark, --subnet-route-fwmark and
+// --routing-table flags.
+func setPolicyRouting(bypassMark, subnetRouteMark string, table uint32) error {
+	pr := router.PolicyRouting{Table: table}
+	for _, m := range []struct {
+		flag string
+		s    string
+		v    *uint32
+	}{
+		{"--fwmark", bypassMark, &pr.BypassMark},
+		{"--subnet-route-fwmark", subnetRouteMark, &pr.SubnetRouteMark},
+	} {
+		v, err := strconv.ParseUint(m.s, 0, 32)
+		if err != nil {
+			return fmt.Errorf("%s: %v", m.flag, err)
+		}
+		*m.v = uint32(v)
+	}
+	return router.SetPolicyRouting(pr)
+}
+
+// crostiniWarnings returns the status warnings that explain how
+// Tailscale works in Chrome OS's Linux container, if running in one:
+// Chrome OS's apps only reach the tailnet through the SOCKS5 proxy at
+// socks5Addr, and with noTUN, there's no tun device at all.
+func crostiniWarnings(noTUN bool, socks5Addr string) []string {
+	if !router.InCrostini() {
+		return nil
+	}
+	const prefix = "running in Chrome OS's Linux container (Crostini): "
+	switch {
+	case noTUN:
+		return []string{prefix + "there's no tun device, so no traffic is carried; Chrome OS 80 and later provide one"}
+	case socks5Addr == "":
+		return []string{prefix + "only Linux apps use Tailscale; run tailscaled with --socks5-server=" + socks5.DefaultAddr + " to reach the tailnet from Chrome OS"}
+	default:
+		host, port, _ := net.SplitHostPort(socks5Addr)
+		return []string{prefix + "only Linux apps use Tailscale directly; to reach the tailnet from Chrome OS, set its network's proxy to SOCKS host " + host + ", port " + port + ", which also resolves MagicDNS names"}
+	}
+}
+
+// canRunWithoutTUN reports whether tailscaled should fall back to the
+// fake engine after err creating the real one. That's on platforms
+// with no tun support at all, and in FreeBSD jails, which often get no
+// tun device.
+func canRunWithoutTUN(err error) bool {
+	if errors.Is(err, wgengine.ErrTUNUnsupported) {
+		return true
+	}
+	jailed, _ := router.JailStatus()
+	return jailed || router.InCrostini()
+}
+
 func newDebugMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -127,6 +457,7 @@ func newDebugMux() *http.ServeMux {
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/varz", tsweb.VarzHandler)
 	return mux
 }
 
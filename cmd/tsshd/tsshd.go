@@ -12,6 +12,9 @@
 // Any user name is accepted; users are logged in as whoever is
 // running this daemon.
 //
+// With --web-port, it also serves a terminal in the browser to the
+// peers, users and tags listed in --web-allow.
+//
 // Warning: use at your own risk. This code has had very few eyeballs
 // on it.
 package main
@@ -25,6 +28,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/user"
 	"syscall"
 	"time"
 	"unsafe"
@@ -54,6 +58,12 @@ func main() {
 		log.Printf("failed to parse SSH host key: %v", err)
 		return
 	}
+	var wt *webTerminal
+	if *webPort != 0 {
+		if wt, err = newWebTerminal(*webAllow, *webAssets); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	warned := false
 	for {
@@ -81,6 +91,11 @@ func main() {
 		}
 		s.AddHostKey(signer)
 
+		if wt != nil {
+			wt.addHost(addr)
+			go serveWeb(net.JoinHostPort(addr.String(), fmt.Sprint(*webPort)), wt)
+		}
+
 		err = s.ListenAndServe()
 		log.Fatalf("tailscale sshd failed: %v", err)
 	}
@@ -121,7 +136,7 @@ func handleSSH(s ssh.Session) {
 			return
 		}
 		cmd := exec.Command(shell)
-		cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
+		cmd.Env = shellEnv(shell, ptyReq.Term)
 		f, err := pty.Start(cmd)
 		if err != nil {
 			log.Printf("running shell: %v", err)
@@ -155,6 +170,27 @@ func shellOfUser(user string) (string, error) {
 	return "/bin/bash", nil
 }
 
+// shellPath is the PATH of shells, like sshd's default.
+const shellPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// shellEnv returns the environment of a login shell, run as the user
+// tsshd runs as, on a terminal of type term.
+func shellEnv(shell, term string) []string {
+	env := []string{
+		"SHELL=" + shell,
+		"PATH=" + shellPath,
+		"TERM=" + term,
+	}
+	if u, err := user.Current(); err == nil {
+		env = append(env,
+			"USER="+u.Username,
+			"LOGNAME="+u.Username,
+			"HOME="+u.HomeDir,
+		)
+	}
+	return env
+}
+
 func setWinsize(f *os.File, w, h int) {
 	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCSWINSZ),
 		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
@@ -0,0 +1,372 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kr/pty"
+	"golang.org/x/net/websocket"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/paths"
+	"tailscale.com/safesocket"
+)
+
+var (
+	webPort   = flag.Int("web-port", 0, "if non-zero, port to serve a browser terminal on (requires --web-allow and --web-assets)")
+	webAllow  = flag.String("web-allow", "", "comma-separated Tailscale IPs, login names (user@example.com) and ACL tags (tag:name) of the peers allowed to use the browser terminal")
+	webAssets = flag.String("web-assets", "", "directory holding xterm.js, xterm.css and xterm-addon-fit.js (from the xterm and xterm-addon-fit npm packages) for the browser terminal")
+	socket    = flag.String("socket", paths.DefaultTailscaledSocket(), "path to tailscaled's unix socket, to look up which user and tags a peer has")
+)
+
+// webAssetFiles are the files of xterm.js served from --web-assets.
+var webAssetFiles = map[string]string{
+	"/xterm.js":           "application/javascript",
+	"/xterm.css":          "text/css",
+	"/xterm-addon-fit.js": "application/javascript",
+}
+
+// whoisCacheTime is how long a peer's identity, looked up from
+// tailscaled, is trusted before looking it up again.
+const whoisCacheTime = 10 * time.Second
+
+// webTerminal serves a shell in the browser: a page with a terminal
+// emulator, connected over a websocket to a pty. It's subject to the
+// same rules as SSH sessions (Tailscale peers only, running as the
+// user tsshd runs as), plus an explicit policy of which peers, users
+// and tags may connect, since a browser is easier to trick into
+// connecting than an SSH client.
+type webTerminal struct {
+	allowIPs    map[string]bool // Tailscale IPs allowed to connect
+	allowLogins map[string]bool // login names whose nodes may connect
+	allowTags   map[string]bool // ACL tags whose nodes may connect
+	assets      string          // directory of webAssetFiles
+	hosts       map[string]bool // names and IPs the browser may call us by
+	status      func() (*ipnstate.Status, error)
+
+	mu       sync.Mutex
+	st       *ipnstate.Status // last from status, or nil
+	stExpiry time.Time        // when st should be fetched again
+}
+
+func newWebTerminal(allow, assets string) (*webTerminal, error) {
+	wt := &webTerminal{
+		allowIPs:    map[string]bool{},
+		allowLogins: map[string]bool{},
+		allowTags:   map[string]bool{},
+		assets:      assets,
+		hosts:       map[string]bool{},
+		status:      func() (*ipnstate.Status, error) { return tailscaleStatus(*socket) },
+	}
+	for _, s := range strings.Split(allow, ",") {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == "":
+			continue
+		case strings.HasPrefix(s, "tag:"):
+			wt.allowTags[s] = true
+		case strings.Contains(s, "@"):
+			wt.allowLogins[strings.ToLower(s)] = true
+		default:
+			ip := net.ParseIP(s)
+			if ip == nil || !interfaces.IsTailscaleIP(ip) {
+				return nil, fmt.Errorf("--web-allow: %q is not a Tailscale IP, login name or tag", s)
+			}
+			wt.allowIPs[ip.String()] = true
+		}
+	}
+	if len(wt.allowIPs)+len(wt.allowLogins)+len(wt.allowTags) == 0 {
+		return nil, errors.New("--web-port requires --web-allow")
+	}
+	if assets == "" {
+		return nil, errors.New("--web-port requires --web-assets")
+	}
+	for name := range webAssetFiles {
+		if _, err := os.Stat(filepath.Join(assets, name)); err != nil {
+			return nil, fmt.Errorf("--web-assets: %v", err)
+		}
+	}
+	if h, err := os.Hostname(); err == nil {
+		// The node's MagicDNS name.
+		wt.hosts[strings.ToLower(strings.SplitN(h, ".", 2)[0])] = true
+	}
+	return wt, nil
+}
+
+// addHost adds ip to the hosts the browser may call us by.
+func (wt *webTerminal) addHost(ip net.IP) {
+	wt.hosts[ip.String()] = true
+}
+
+// validHost reports whether host, a request's Host header, names this
+// node. Any other name means the browser was pointed at us by someone
+// else's DNS, as in a DNS rebinding attack.
+func (wt *webTerminal) validHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return wt.hosts[strings.ToLower(strings.TrimSuffix(host, "."))]
+}
+
+// allowed reports whether the peer at remoteAddr may use the terminal.
+func (wt *webTerminal) allowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !interfaces.IsTailscaleIP(ip) {
+		return false
+	}
+	if wt.allowIPs[ip.String()] {
+		return true
+	}
+	if len(wt.allowLogins) == 0 && len(wt.allowTags) == 0 {
+		return false
+	}
+	st, err := wt.cachedStatus()
+	if err != nil {
+		log.Printf("web: looking up %v: %v", ip, err)
+		return false
+	}
+	for _, ps := range st.Peer {
+		if ps.TailAddr != ip.String() {
+			continue
+		}
+		for _, tag := range ps.Tags {
+			if wt.allowTags[tag] {
+				return true
+			}
+		}
+		// Tagged nodes act for their tags, not the user who
+		// added them.
+		if len(ps.Tags) == 0 {
+			if up, ok := st.User[ps.UserID]; ok && wt.allowLogins[strings.ToLower(up.LoginName)] {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// cachedStatus returns tailscaled's status, at most whoisCacheTime
+// old.
+func (wt *webTerminal) cachedStatus() (*ipnstate.Status, error) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	if wt.st != nil && time.Now().Before(wt.stExpiry) {
+		return wt.st, nil
+	}
+	st, err := wt.status()
+	if err != nil {
+		return nil, err
+	}
+	wt.st, wt.stExpiry = st, time.Now().Add(whoisCacheTime)
+	return st, nil
+}
+
+// tailscaleStatus asks the tailscaled at socket for its status.
+func tailscaleStatus(socket string) (*ipnstate.Status, error) {
+	c, err := safesocket.Connect(socket, 41112)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	bc := ipn.NewBackendClient(log.Printf, func(b []byte) { ipn.WriteMsg(c, b) })
+	bc.AllowVersionSkew = true
+	var st *ipnstate.Status
+	var errMsg string
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		if n.ErrMessage != nil {
+			errMsg = *n.ErrMessage
+		}
+		if n.Status != nil {
+			st = n.Status
+		}
+	})
+	bc.RequestStatus()
+	for st == nil {
+		msg, err := ipn.ReadMsg(c)
+		if err != nil {
+			return nil, err
+		}
+		bc.GotNotifyMsg(msg)
+		if errMsg != "" {
+			return nil, errors.New(errMsg)
+		}
+	}
+	return st, nil
+}
+
+func (wt *webTerminal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !wt.validHost(r.Host) {
+		log.Printf("web: rejecting %v for host %q", r.RemoteAddr, r.Host)
+		http.Error(w, "unknown host", http.StatusMisdirectedRequest)
+		return
+	}
+	if !wt.allowed(r.RemoteAddr) {
+		log.Printf("web: rejecting %v", r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if ctype, ok := webAssetFiles[r.URL.Path]; ok {
+		w.Header().Set("Content-Type", ctype)
+		http.ServeFile(w, r, filepath.Join(wt.assets, r.URL.Path))
+		return
+	}
+	switch r.URL.Path {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, webTerminalHTML)
+	case "/ws":
+		ws := websocket.Server{
+			Handshake: checkSameOrigin,
+			Handler:   wt.serveShell,
+		}
+		ws.ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// checkSameOrigin rejects websocket connections started by pages
+// other than our own, so a site visited by an allowed user can't open
+// a shell on their behalf. ServeHTTP has already checked that r.Host
+// is this node.
+func checkSameOrigin(cfg *websocket.Config, r *http.Request) error {
+	o, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || o.Host != r.Host {
+		return fmt.Errorf("cross-origin websocket from %q", r.Header.Get("Origin"))
+	}
+	cfg.Origin = o
+	return nil
+}
+
+// serveShell runs a shell for one websocket connection.
+//
+// Client messages are text frames: "i" followed by terminal input, or
+// "r<cols>x<rows>" on resize. Terminal output is sent in binary frames.
+func (wt *webTerminal) serveShell(ws *websocket.Conn) {
+	defer ws.Close()
+	remote := ws.Request().RemoteAddr
+	log.Printf("web: new session from %v", remote)
+	defer log.Printf("web: closing session from %v", remote)
+
+	shell, err := shellOfUser("")
+	if err != nil {
+		websocket.Message.Send(ws, []byte(fmt.Sprintf("failed to find shell: %v\r\n", err)))
+		return
+	}
+	cmd := exec.Command(shell)
+	cmd.Env = shellEnv(shell, "xterm-256color")
+	f, err := pty.Start(cmd)
+	if err != nil {
+		log.Printf("web: running shell: %v", err)
+		return
+	}
+	defer f.Close()
+
+	go func() {
+		defer cmd.Process.Kill()
+		for {
+			var msg string
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				return
+			}
+			if msg == "" {
+				continue
+			}
+			switch msg[0] {
+			case 'i':
+				if _, err := io.WriteString(f, msg[1:]); err != nil {
+					return
+				}
+			case 'r':
+				var cols, rows int
+				if _, err := fmt.Sscanf(msg[1:], "%dx%d", &cols, &rows); err == nil && cols > 0 && rows > 0 {
+					setWinsize(f, cols, rows)
+				}
+			}
+		}
+	}()
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := websocket.Message.Send(ws, buf[:n]); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+}
+
+// serveWeb serves the browser terminal on addr until it fails.
+func serveWeb(addr string, wt *webTerminal) {
+	log.Printf("tailscale web terminal listening on http://%v/", addr)
+	err := http.ListenAndServe(addr, wt)
+	log.Fatalf("web terminal failed: %v", err)
+}
+
+// webTerminalHTML is the terminal page. The terminal emulator itself
+// is xterm.js, served from --web-assets rather than a CDN, so that the
+// page runs no code from outside the tailnet.
+const webTerminalHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tsshd</title>
+<link rel="stylesheet" href="/xterm.css">
+<script src="/xterm.js"></script>
+<script src="/xterm-addon-fit.js"></script>
+<style>html, body, #term { height: 100%; margin: 0; background: #000; }</style>
+</head>
+<body>
+<div id="term"></div>
+<script>
+const term = new Terminal();
+const fit = new FitAddon.FitAddon();
+term.loadAddon(fit);
+term.open(document.getElementById("term"));
+fit.fit();
+
+const ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/ws");
+ws.binaryType = "arraybuffer";
+const resize = () => ws.send("r" + term.cols + "x" + term.rows);
+ws.onopen = () => { resize(); term.focus(); };
+ws.onmessage = (ev) => term.write(new Uint8Array(ev.data));
+ws.onclose = () => term.write("\r\n[connection closed]\r\n");
+term.onData((d) => ws.send("i" + d));
+term.onResize(resize);
+window.addEventListener("resize", () => fit.fit());
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,167 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestValidHost(t *testing.T) {
+	wt := &webTerminal{hosts: map[string]bool{
+		"mynode":        true,
+		"100.101.102.1": true,
+	}}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"mynode", true},
+		{"MyNode:8080", true},
+		{"mynode.", true},
+		{"100.101.102.1:8080", true},
+		{"100.101.102.1", true},
+		// DNS rebinding: a name that resolves to us, but isn't ours.
+		{"evil.example.com", false},
+		{"evil.example.com:8080", false},
+		{"mynode.evil.example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := wt.validHost(tt.host); got != tt.want {
+			t.Errorf("validHost(%q) = %v; want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSameOrigin(t *testing.T) {
+	tests := []struct {
+		origin  string
+		wantErr bool
+	}{
+		{"http://100.101.102.1:8080", false},
+		{"http://evil.example.com", true},
+		{"http://100.101.102.1:9090", true},
+		{"", true},
+		{"::not a url", true},
+	}
+	for _, tt := range tests {
+		r, err := http.NewRequest("GET", "http://100.101.102.1:8080/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		cfg := new(websocket.Config)
+		err = checkSameOrigin(cfg, r)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("origin %q: err = %v; want error %v", tt.origin, err, tt.wantErr)
+		}
+		if err == nil && cfg.Origin.String() != tt.origin {
+			t.Errorf("origin %q: cfg.Origin = %v", tt.origin, cfg.Origin)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	st := &ipnstate.Status{
+		Peer: map[key.Public]*ipnstate.PeerStatus{
+			{1}: {TailAddr: "100.101.102.1", UserID: 1},
+			{2}: {TailAddr: "100.101.102.2", UserID: 2},
+			{3}: {TailAddr: "100.101.102.3", UserID: 1, Tags: []string{"tag:ops"}},
+			{4}: {TailAddr: "100.101.102.4", UserID: 1, Tags: []string{"tag:other"}},
+		},
+		User: map[tailcfg.UserID]tailcfg.UserProfile{
+			1: {ID: 1, LoginName: "Alice@example.com"},
+			2: {ID: 2, LoginName: "bob@example.com"},
+		},
+	}
+	wt := newTestWebTerminal(t, "100.101.102.9, alice@example.com, tag:ops")
+	wt.status = func() (*ipnstate.Status, error) { return st, nil }
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       bool
+	}{
+		{"by IP", "100.101.102.9:1234", true},
+		{"by login", "100.101.102.1:1234", true},
+		{"other login", "100.101.102.2:1234", false},
+		{"by tag", "100.101.102.3:1234", true},
+		// Owned by alice, but acting for its tag.
+		{"tagged node of allowed login", "100.101.102.4:1234", false},
+		{"unknown peer", "100.101.102.5:1234", false},
+		{"not a Tailscale IP", "192.168.1.1:1234", false},
+		{"bad address", "100.101.102.1", false},
+	}
+	for _, tt := range tests {
+		if got := wt.allowed(tt.remoteAddr); got != tt.want {
+			t.Errorf("%s: allowed(%q) = %v; want %v", tt.name, tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+func TestAllowedStatusError(t *testing.T) {
+	wt := newTestWebTerminal(t, "100.101.102.9,alice@example.com,tag:ops")
+	wt.status = func() (*ipnstate.Status, error) { return nil, errors.New("tailscaled is down") }
+
+	if wt.allowed("100.101.102.1:1234") {
+		t.Errorf("peer allowed without a status lookup")
+	}
+	// Allowed IPs don't need one.
+	if !wt.allowed("100.101.102.9:1234") {
+		t.Errorf("allowed IP denied")
+	}
+}
+
+func TestShellEnv(t *testing.T) {
+	env := map[string]string{}
+	for _, kv := range shellEnv("/bin/bash", "xterm-256color") {
+		i := strings.Index(kv, "=")
+		env[kv[:i]] = kv[i+1:]
+	}
+	for _, k := range []string{"HOME", "PATH", "USER", "SHELL"} {
+		if env[k] == "" {
+			t.Errorf("shell environment has no %s", k)
+		}
+	}
+	if env["TERM"] != "xterm-256color" {
+		t.Errorf("TERM = %q; want xterm-256color", env["TERM"])
+	}
+}
+
+// newTestWebTerminal returns a webTerminal allowing allow, with empty
+// web assets.
+func newTestWebTerminal(t *testing.T, allow string) *webTerminal {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tsshd-web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name := range webAssetFiles {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wt, err := newWebTerminal(allow, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wt
+}
@@ -12,6 +12,7 @@ package controlclient
 import (
 	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"reflect"
 	"sync"
@@ -19,7 +20,9 @@ import (
 
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"golang.org/x/oauth2"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/logtail/backoff"
+	"tailscale.com/metrics"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/empty"
 	"tailscale.com/types/logger"
@@ -72,6 +75,9 @@ type Status struct {
 	NetMap        *NetworkMap       // server-pushed configuration
 	Hostinfo      *tailcfg.Hostinfo // current Hostinfo data
 	State         State
+	// ServerKeyChange describes how the control server's key
+	// changed from the pinned one, if it did; see checkServerKey.
+	ServerKeyChange string
 }
 
 // Equal reports whether s and s2 are equal.
@@ -86,7 +92,8 @@ func (s *Status) Equal(s2 *Status) bool {
 		reflect.DeepEqual(s.Persist, s2.Persist) &&
 		reflect.DeepEqual(s.NetMap, s2.NetMap) &&
 		reflect.DeepEqual(s.Hostinfo, s2.Hostinfo) &&
-		s.State == s2.State
+		s.State == s2.State &&
+		s.ServerKeyChange == s2.ServerKeyChange
 }
 
 func (s Status) String() string {
@@ -125,6 +132,11 @@ type Client struct {
 	inSendStatus int  // number of sendStatus calls currently in progress
 	state        State
 
+	lastSync    time.Time // when the last netmap was received
+	lastErr     error     // last control request error since a success, or nil
+	lastErrTime time.Time // when lastErr happened
+	failures    int       // consecutive failed control requests
+
 	authCtx    context.Context // context used for auth requests
 	mapCtx     context.Context // context used for netmap requests
 	authCancel func()          // cancel the auth context
@@ -241,7 +253,7 @@ func (c *Client) cancelMapSafely() {
 
 func (c *Client) authRoutine() {
 	defer close(c.authDone)
-	bo := backoff.NewBackoff("authRoutine", c.logf)
+	bo := newBackoff("authRoutine", c.logf)
 
 	for {
 		c.mu.Lock()
@@ -265,6 +277,7 @@ func (c *Client) authRoutine() {
 			// don't send status updates for context errors,
 			// since context cancelation is always on purpose.
 			if ctx.Err() == nil {
+				c.noteFailure(err)
 				c.sendStatus("authRoutine1", err, "", nil)
 			}
 		}
@@ -375,6 +388,7 @@ func (c *Client) authRoutine() {
 			c.loggedIn = true
 			c.loginGoal = nil
 			c.state = StateAuthenticated
+			c.noteSuccessLocked()
 			c.mu.Unlock()
 
 			c.sendStatus("authRoutine4", nil, "", nil)
@@ -400,7 +414,7 @@ func (c *Client) Direct() *Direct {
 
 func (c *Client) mapRoutine() {
 	defer close(c.mapDone)
-	bo := backoff.NewBackoff("mapRoutine", c.logf)
+	bo := newBackoff("mapRoutine", c.logf)
 
 	for {
 		c.mu.Lock()
@@ -422,6 +436,7 @@ func (c *Client) mapRoutine() {
 			// don't send status updates for context errors,
 			// since context cancelation is always on purpose.
 			if ctx.Err() == nil {
+				c.noteFailure(err)
 				c.sendStatus("mapRoutine1", err, "", nil)
 			}
 		}
@@ -464,6 +479,9 @@ func (c *Client) mapRoutine() {
 
 				c.synced = true
 				c.inPollNetMap = true
+				c.lastSync = c.timeNow()
+				metricLastSync.Set(c.lastSync.Unix())
+				c.noteSuccessLocked()
 				if c.loggedIn {
 					c.state = StateSynchronized
 				}
@@ -498,6 +516,64 @@ func (c *Client) mapRoutine() {
 	}
 }
 
+// The health of the connection to the control server, exported to
+// Prometheus by tsweb's /debug/varz handler. They're for the process's
+// current Client, as there's only the one.
+var (
+	metricLastSync = new(expvar.Int)                     // Unix time of the last netmap received
+	metricFailures = new(expvar.Int)                     // consecutive failed control requests
+	metricBackoff  = &metrics.LabelMap{Label: "routine"} // current retry delay, in milliseconds
+)
+
+func init() {
+	expvar.Publish("gauge_control_last_sync_unix", metricLastSync)
+	expvar.Publish("gauge_control_consecutive_failures", metricFailures)
+	expvar.Publish("gauge_control_backoff_ms", metricBackoff)
+}
+
+// newBackoff returns a backoff.Backoff for the named routine that
+// reports its delays in metricBackoff.
+func newBackoff(name string, logf logger.Logf) backoff.Backoff {
+	bo := backoff.NewBackoff(name, logf)
+	bo.OnDelay = func(d time.Duration) {
+		metricBackoff.Get(name).Set(d.Milliseconds())
+	}
+	return bo
+}
+
+// noteFailure records err as the most recent control request failure.
+func (c *Client) noteFailure(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastErr = err
+	c.lastErrTime = c.timeNow()
+	c.failures++
+	metricFailures.Set(int64(c.failures))
+}
+
+func (c *Client) noteSuccessLocked() {
+	c.lastErr = nil
+	c.failures = 0
+	metricFailures.Set(0)
+}
+
+// ControlStatus returns the state of the client's connection to the
+// control server.
+func (c *Client) ControlStatus() ipnstate.ControlStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cs := ipnstate.ControlStatus{
+		Connected:   c.inPollNetMap,
+		LastSync:    c.lastSync,
+		LastErrTime: c.lastErrTime,
+		Failures:    c.failures,
+	}
+	if c.lastErr != nil {
+		cs.LastErr = c.lastErr.Error()
+	}
+	return cs
+}
+
 func (c *Client) AuthCantContinue() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -525,6 +601,13 @@ func (c *Client) SetHostinfo(hi *tailcfg.Hostinfo) {
 	c.cancelMapSafely()
 }
 
+// SetStrictServerKey sets whether to refuse to log in to a control
+// server whose key isn't the pinned one. It takes effect at the next
+// login.
+func (c *Client) SetStrictServerKey(strict bool) {
+	c.direct.SetStrictServerKey(strict)
+}
+
 func (c *Client) SetNetInfo(ni *tailcfg.NetInfo) {
 	if ni == nil {
 		panic("nil NetInfo")
@@ -565,12 +648,13 @@ func (c *Client) sendStatus(who string, err error, url string, nm *NetworkMap) {
 		nm = nil
 	}
 	new := Status{
-		LoginFinished: fin,
-		URL:           url,
-		Persist:       p,
-		NetMap:        nm,
-		Hostinfo:      hi,
-		State:         state,
+		LoginFinished:   fin,
+		URL:             url,
+		Persist:         p,
+		NetMap:          nm,
+		Hostinfo:        hi,
+		State:           state,
+		ServerKeyChange: c.direct.ServerKeyChange(),
 	}
 	if err != nil {
 		new.Err = err.Error()
@@ -610,6 +694,15 @@ func (c *Client) Logout() {
 	c.cancelAuth()
 }
 
+// LogoutSync shuts down the client and then synchronously tells
+// the control server to expire the node key, waiting at most until
+// ctx is done. It's meant for use as a goodbye when exiting.
+func (c *Client) LogoutSync(ctx context.Context) error {
+	c.logf("client.LogoutSync()")
+	c.Shutdown()
+	return c.direct.TryLogout(ctx)
+}
+
 func (c *Client) UpdateEndpoints(localPort uint16, endpoints []string) {
 	changed := c.direct.SetEndpoints(localPort, endpoints)
 	if changed {
@@ -0,0 +1,44 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"net/http"
+	"time"
+)
+
+// maxSkewCorrection bounds how far key expiry times are adjusted for
+// the local clock's skew from the control server's. Beyond it, the
+// local clock is too far off to do anything but warn about.
+const maxSkewCorrection = 24 * time.Hour
+
+// clockSkew returns how far ahead of the control server's clock the
+// local clock, reading now, is, going by the Date header of the
+// server's response res. It's rounded to the minute: finer differences
+// are lost in the header's one-second precision and the round trip,
+// and don't matter for key expiry anyway. It returns false if res has
+// no valid Date header.
+func clockSkew(res *http.Response, now time.Time) (time.Duration, bool) {
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+	return now.Sub(date).Round(time.Minute), true
+}
+
+// localExpiry converts expiry, a time by the control server's clock,
+// into one by the local clock, given the local clock's skew. The
+// correction is bounded by maxSkewCorrection.
+func localExpiry(expiry time.Time, skew time.Duration) time.Time {
+	if expiry.IsZero() {
+		return expiry
+	}
+	if skew > maxSkewCorrection {
+		skew = maxSkewCorrection
+	} else if skew < -maxSkewCorrection {
+		skew = -maxSkewCorrection
+	}
+	return expiry.Add(skew)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClockSkew(t *testing.T) {
+	server := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		date   string
+		now    time.Time
+		want   time.Duration
+		wantOK bool
+	}{
+		{"in_sync", server.Format(http.TimeFormat), server.Add(700 * time.Millisecond), 0, true},
+		{"round_trip_noise", server.Format(http.TimeFormat), server.Add(20 * time.Second), 0, true},
+		{"ahead", server.Format(http.TimeFormat), server.Add(2*time.Hour + 10*time.Second), 2 * time.Hour, true},
+		{"behind", server.Format(http.TimeFormat), server.Add(-3 * time.Minute), -3 * time.Minute, true},
+		{"no_date", "", server, 0, false},
+		{"bad_date", "yesterday", server, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &http.Response{Header: http.Header{}}
+			if tt.date != "" {
+				res.Header.Set("Date", tt.date)
+			}
+			got, ok := clockSkew(res, tt.now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("clockSkew = %v, %v; want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestLocalExpiry(t *testing.T) {
+	expiry := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		skew time.Duration
+		want time.Time
+	}{
+		{0, expiry},
+		{time.Hour, expiry.Add(time.Hour)},
+		{-time.Hour, expiry.Add(-time.Hour)},
+		{30 * 24 * time.Hour, expiry.Add(maxSkewCorrection)},
+		{-30 * 24 * time.Hour, expiry.Add(-maxSkewCorrection)},
+	}
+	for _, tt := range tests {
+		if got := localExpiry(expiry, tt.skew); !got.Equal(tt.want) {
+			t.Errorf("localExpiry(%v) = %v; want %v", tt.skew, got, tt.want)
+		}
+	}
+	if got := localExpiry(time.Time{}, time.Hour); !got.IsZero() {
+		t.Errorf("localExpiry of zero time = %v; want zero", got)
+	}
+}
@@ -5,9 +5,12 @@
 package controlclient
 
 import (
+	"errors"
 	"reflect"
 	"testing"
+	"time"
 
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/types/empty"
 )
 
@@ -22,7 +25,7 @@ func fieldsOf(t reflect.Type) (fields []string) {
 
 func TestStatusEqual(t *testing.T) {
 	// Verify that the Equal method stays in sync with reality
-	equalHandles := []string{"LoginFinished", "Err", "URL", "Persist", "NetMap", "Hostinfo", "State"}
+	equalHandles := []string{"LoginFinished", "Err", "URL", "Persist", "NetMap", "Hostinfo", "State", "ServerKeyChange"}
 	if have := fieldsOf(reflect.TypeOf(Status{})); !reflect.DeepEqual(have, equalHandles) {
 		t.Errorf("Status.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
 			have, equalHandles)
@@ -70,3 +73,38 @@ func TestStatusEqual(t *testing.T) {
 		}
 	}
 }
+
+func TestControlStatus(t *testing.T) {
+	now := time.Unix(1594000000, 0)
+	c, err := NewNoStart(Options{
+		ServerURL: "https://controlplane.example",
+		TimeNow:   func() time.Time { return now },
+		Logf:      t.Logf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := c.ControlStatus(), (ipnstate.ControlStatus{}); got != want {
+		t.Errorf("initial status = %+v; want %+v", got, want)
+	}
+
+	c.noteFailure(errors.New("fetch control key: connection refused"))
+	c.noteFailure(errors.New("fetch control key: connection refused"))
+	want := ipnstate.ControlStatus{
+		LastErr:     "fetch control key: connection refused",
+		LastErrTime: now,
+		Failures:    2,
+	}
+	if got := c.ControlStatus(); got != want {
+		t.Errorf("after failures = %+v; want %+v", got, want)
+	}
+
+	c.mu.Lock()
+	c.noteSuccessLocked()
+	c.mu.Unlock()
+	want = ipnstate.ControlStatus{LastErrTime: now}
+	if got := c.ControlStatus(); got != want {
+		t.Errorf("after success = %+v; want %+v", got, want)
+	}
+}
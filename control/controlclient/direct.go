@@ -27,7 +27,9 @@ import (
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
 	"tailscale.com/log/logheap"
+	"tailscale.com/net/dnsfallback"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/tlsdial"
 	"tailscale.com/tailcfg"
@@ -43,6 +45,11 @@ type Persist struct {
 	OldPrivateNodeKey wgcfg.PrivateKey // needed to request key rotation
 	Provider          string
 	LoginName         string
+	// ServerURL and ServerKey are the control server this node
+	// last logged in to and the key it presented, pinned on first
+	// use; see checkServerKey.
+	ServerURL string
+	ServerKey wgcfg.Key
 }
 
 func (p *Persist) Equals(p2 *Persist) bool {
@@ -57,7 +64,9 @@ func (p *Persist) Equals(p2 *Persist) bool {
 		p.PrivateNodeKey.Equal(p2.PrivateNodeKey) &&
 		p.OldPrivateNodeKey.Equal(p2.OldPrivateNodeKey) &&
 		p.Provider == p2.Provider &&
-		p.LoginName == p2.LoginName
+		p.LoginName == p2.LoginName &&
+		p.ServerURL == p2.ServerURL &&
+		p.ServerKey == p2.ServerKey
 }
 
 func (p *Persist) Pretty() string {
@@ -82,8 +91,10 @@ type Direct struct {
 	serverURL       string       // URL of the tailcontrol server
 	timeNow         func() time.Time
 	lastPrintMap    time.Time
+	clockSkew       time.Duration // last measured by PollNetMap; see clockSkew
 	newDecompressor func() (Decompressor, error)
 	keepAlive       bool
+	noLogs          bool
 	logf            logger.Logf
 	discoPubKey     tailcfg.DiscoKey
 
@@ -97,6 +108,43 @@ type Direct struct {
 	hostinfo  *tailcfg.Hostinfo // always non-nil
 	endpoints []string
 	localPort uint16 // or zero to mean auto
+	// strictServerKey is whether to refuse to log in to a server
+	// whose key isn't the pinned one.
+	strictServerKey bool
+	// serverKeyChange describes the last change of the server's key
+	// from the pinned one, or is empty if there was none.
+	serverKeyChange string
+}
+
+var (
+	controlTransportsMu sync.Mutex
+	controlTransports   = map[string]*http.Transport{} // by host
+)
+
+// controlTransport returns the HTTP transport for talking to the
+// control server at host. Transports are shared by all Direct
+// clients in the process, so that restarting a client (as happens
+// on every login) reuses the pooled HTTP/2 connection instead of
+// doing a new TLS handshake.
+func controlTransport(host string) *http.Transport {
+	controlTransportsMu.Lock()
+	defer controlTransportsMu.Unlock()
+	if tr, ok := controlTransports[host]; ok {
+		return tr
+	}
+	dialer := netns.NewDialer()
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	// Resolve the control server's name ourselves, falling back
+	// to bootstrap DNS if the system's resolver is broken.
+	tr.DialContext = dnsfallback.DialContext(dialer)
+	tr.ForceAttemptHTTP2 = true
+	tr.TLSClientConfig = tlsdial.Config(host, tr.TLSClientConfig)
+	// Map polls are long-lived, so a connection can sit idle for a
+	// while between a poll ending and the next one starting, or
+	// while backing off. Keep it around longer than the default.
+	tr.IdleConnTimeout = 5 * time.Minute
+	controlTransports[host] = tr
+	return tr
 }
 
 type Options struct {
@@ -110,6 +158,8 @@ type Options struct {
 	KeepAlive       bool
 	Logf            logger.Logf
 	HTTPTestClient  *http.Client // optional HTTP client to use (for tests only)
+	NoLogs          bool         // never upload debug data, even if the server asks
+	StrictServerKey bool         // refuse to log in if the server's key isn't the one pinned in Persist
 }
 
 type Decompressor interface {
@@ -138,12 +188,7 @@ func NewDirect(opts Options) (*Direct, error) {
 
 	httpc := opts.HTTPTestClient
 	if httpc == nil {
-		dialer := netns.NewDialer()
-		tr := http.DefaultTransport.(*http.Transport).Clone()
-		tr.DialContext = dialer.DialContext
-		tr.ForceAttemptHTTP2 = true
-		tr.TLSClientConfig = tlsdial.Config(serverURL.Host, tr.TLSClientConfig)
-		httpc = &http.Client{Transport: tr}
+		httpc = &http.Client{Transport: controlTransport(serverURL.Host)}
 	}
 
 	c := &Direct{
@@ -153,9 +198,11 @@ func NewDirect(opts Options) (*Direct, error) {
 		logf:            opts.Logf,
 		newDecompressor: opts.NewDecompressor,
 		keepAlive:       opts.KeepAlive,
+		noLogs:          opts.NoLogs,
 		persist:         opts.Persist,
 		authKey:         opts.AuthKey,
 		discoPubKey:     opts.DiscoPublicKey,
+		strictServerKey: opts.StrictServerKey,
 	}
 	if opts.Hostinfo == nil {
 		c.SetHostinfo(NewHostinfo())
@@ -168,9 +215,10 @@ func NewDirect(opts Options) (*Direct, error) {
 func NewHostinfo() *tailcfg.Hostinfo {
 	hostname, _ := os.Hostname()
 	return &tailcfg.Hostinfo{
-		IPNVersion: version.LONG,
-		Hostname:   hostname,
-		OS:         version.OS(),
+		IPNVersion:  version.LONG,
+		Hostname:    hostname,
+		OS:          version.OS(),
+		SSHHostKeys: sshHostKeys(),
 	}
 }
 
@@ -210,6 +258,24 @@ func (c *Direct) SetNetInfo(ni *tailcfg.NetInfo) bool {
 	return true
 }
 
+// SetStrictServerKey sets whether to refuse to log in to a control
+// server whose key isn't the one pinned in the persisted state. It
+// takes effect at the next login.
+func (c *Direct) SetStrictServerKey(strict bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.strictServerKey = strict
+}
+
+// ServerKeyChange describes the last change of the control server's
+// key from the pinned one, or returns the empty string if there was
+// none.
+func (c *Direct) ServerKeyChange() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serverKeyChange
+}
+
 func (c *Direct) GetPersist() Persist {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -223,19 +289,67 @@ const (
 	LoginInteractive = LoginFlags(1 << iota) // force user login and key refresh
 )
 
+// TryLogout forgets the node key and asks the control server to
+// expire it immediately, which also removes ephemeral nodes. The
+// local state is cleared even if the server can't be reached, in
+// which case the key stays valid on the server until it expires.
 func (c *Direct) TryLogout(ctx context.Context) error {
 	c.logf("direct.TryLogout()")
 
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	// TODO(crawshaw): Tell the server. This node key should be
-	// immediately invalidated.
-	//if c.persist.PrivateNodeKey != (wgcfg.PrivateKey{}) {
-	//}
+	persist := c.persist
+	serverKey := c.serverKey
+	hostinfo := c.hostinfo.Clone()
+	// The server's pinned key outlives the login, so that logging
+	// back in doesn't trust a replaced server.
 	c.persist = Persist{
 		PrivateMachineKey: c.persist.PrivateMachineKey,
+		ServerURL:         c.persist.ServerURL,
+		ServerKey:         c.persist.ServerKey,
+	}
+	c.mu.Unlock()
+
+	if persist.PrivateNodeKey == (wgcfg.PrivateKey{}) || serverKey == (wgcfg.Key{}) {
+		// Never registered, so there's nothing to tell the server.
+		return nil
+	}
+	if err := c.expireNodeKey(ctx, persist, serverKey, hostinfo); err != nil {
+		return fmt.Errorf("expiring node key: %v", err)
+	}
+	return nil
+}
+
+// expireNodeKey asks the server to expire persist's node key now.
+func (c *Direct) expireNodeKey(ctx context.Context, persist Persist, serverKey wgcfg.Key, hostinfo *tailcfg.Hostinfo) error {
+	request := tailcfg.RegisterRequest{
+		Version:  1,
+		NodeKey:  tailcfg.NodeKey(persist.PrivateNodeKey.Public()),
+		Hostinfo: hostinfo,
+		// An expiry in the past asks the server to expire the key.
+		Expiry: time.Unix(123, 0),
+	}
+	request.Auth.Provider = persist.Provider
+	request.Auth.LoginName = persist.LoginName
+	bodyData, err := encode(request, &serverKey, &persist.PrivateMachineKey)
+	if err != nil {
+		return err
+	}
+
+	u := fmt.Sprintf("%s/machine/%s", c.serverURL, persist.PrivateMachineKey.Public().HexString())
+	req, err := http.NewRequest("POST", u, bytes.NewReader(bodyData))
+	if err != nil {
+		return err
 	}
+	req = req.WithContext(ctx)
+	res, err := c.httpc.Do(req)
+	if err != nil {
+		return tlsdial.DescribeError(err)
+	}
+	var resp tailcfg.RegisterResponse
+	if err := decode(res, &resp, &serverKey, &persist.PrivateMachineKey); err != nil {
+		return err
+	}
+	c.logf("node key %v expired on server", request.NodeKey.ShortString())
 	return nil
 }
 
@@ -265,6 +379,7 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 	persist := c.persist
 	tryingNewKey := c.tryingNewKey
 	serverKey := c.serverKey
+	strictServerKey := c.strictServerKey
 	authKey := c.authKey
 	hostinfo := c.hostinfo
 	backendLogID := hostinfo.BackendLogID
@@ -301,6 +416,16 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 		c.serverKey = serverKey
 		c.mu.Unlock()
 	}
+	change, err := checkServerKey(&persist, c.serverURL, serverKey, strictServerKey)
+	if change != "" {
+		c.logf("warning: %s", change)
+		c.mu.Lock()
+		c.serverKeyChange = change
+		c.mu.Unlock()
+	}
+	if err != nil {
+		return regen, url, err
+	}
 
 	var oldNodeKey wgcfg.Key
 	if url != "" {
@@ -357,7 +482,7 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 
 	res, err := c.httpc.Do(req)
 	if err != nil {
-		return regen, url, fmt.Errorf("register request: %v", err)
+		return regen, url, fmt.Errorf("register request: %v", tlsdial.DescribeError(err))
 	}
 	c.logf("RegisterReq: returned.")
 	resp := tailcfg.RegisterResponse{}
@@ -507,6 +632,7 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 
 	res, err := c.httpc.Do(req)
 	if err != nil {
+		err = tlsdial.DescribeError(err)
 		vlogf("netmap: Do: %v", err)
 		return err
 	}
@@ -519,6 +645,12 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 	}
 	defer res.Body.Close()
 
+	skew, ok := clockSkew(res, c.timeNow())
+	if ok && skew != c.clockSkew {
+		c.logf("netmap: clock skew (local minus control): %v", skew)
+		c.clockSkew = skew
+	}
+
 	// If we go more than pollTimeout without hearing from the server,
 	// end the long poll. We should be receiving a keep alive ping
 	// every minute.
@@ -600,7 +732,11 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 			lastDERPMap = resp.DERPMap
 		}
 		if resp.Debug != nil && resp.Debug.LogHeapPprof {
-			go logheap.LogHeap(resp.Debug.LogHeapURL)
+			if c.noLogs {
+				c.logf("netmap: ignoring heap profile request; no-logs-no-support")
+			} else {
+				go logheap.LogHeap(resp.Debug.LogHeapURL)
+			}
 		}
 		// Temporarily (2020-06-29) support removing all but
 		// discovery-supporting nodes during development, for
@@ -618,7 +754,8 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 		nm := &NetworkMap{
 			NodeKey:      tailcfg.NodeKey(persist.PrivateNodeKey.Public()),
 			PrivateKey:   persist.PrivateNodeKey,
-			Expiry:       resp.Node.KeyExpiry,
+			Expiry:       localExpiry(resp.Node.KeyExpiry, c.clockSkew),
+			ClockSkew:    c.clockSkew,
 			Addresses:    resp.Node.Addresses,
 			Peers:        resp.Peers,
 			LocalPort:    localPort,
@@ -626,10 +763,10 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 			UserProfiles: make(map[tailcfg.UserID]tailcfg.UserProfile),
 			Domain:       resp.Domain,
 			Roles:        resp.Roles,
-			DNS:          resp.DNS,
-			DNSDomains:   resp.SearchPaths,
+			DNS:          dnsConfigFromMapResponse(&resp),
 			Hostinfo:     resp.Node.Hostinfo,
 			PacketFilter: c.parsePacketFilter(resp.PacketFilter),
+			Tags:         resp.Node.Tags,
 			DERPMap:      lastDERPMap,
 			Debug:        resp.Debug,
 		}
@@ -753,7 +890,53 @@ func encode(v interface{}, serverKey *wgcfg.Key, mkey *wgcfg.PrivateKey) ([]byte
 	return msg, nil
 }
 
+// dnsConfigFromMapResponse returns the DNS configuration in resp,
+// translating the flat DNS and SearchPaths fields sent by older
+// control servers if resp has no DNSConfig.
+func dnsConfigFromMapResponse(resp *tailcfg.MapResponse) tailcfg.DNSConfig {
+	if resp.DNSConfig != nil {
+		return *resp.DNSConfig
+	}
+	dc := tailcfg.DNSConfig{Domains: resp.SearchPaths}
+	for _, ip := range resp.DNS {
+		dc.Resolvers = append(dc.Resolvers, tailcfg.DNSResolver{Addr: ip.String()})
+	}
+	return dc
+}
+
+// serverKeyGroup coalesces concurrent fetches of a control server's key.
+var serverKeyGroup singleflight.Group
+
+// serverKeyTimeout bounds a coalesced fetch of a control server's
+// key, which runs on behalf of all its callers, not just the first.
+const serverKeyTimeout = 30 * time.Second
+
+// serverKeyWaiting, if non-nil, is called by loadServerKey once it's
+// waiting on a fetch. It's for tests.
+var serverKeyWaiting func()
+
 func loadServerKey(ctx context.Context, httpc *http.Client, serverURL string) (wgcfg.Key, error) {
+	ch := serverKeyGroup.DoChan(serverURL, func() (interface{}, error) {
+		// Not ctx: one caller giving up mustn't fail the others.
+		ctx, cancel := context.WithTimeout(context.Background(), serverKeyTimeout)
+		defer cancel()
+		return fetchServerKey(ctx, httpc, serverURL)
+	})
+	if serverKeyWaiting != nil {
+		serverKeyWaiting()
+	}
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return wgcfg.Key{}, res.Err
+		}
+		return res.Val.(wgcfg.Key), nil
+	case <-ctx.Done():
+		return wgcfg.Key{}, ctx.Err()
+	}
+}
+
+func fetchServerKey(ctx context.Context, httpc *http.Client, serverURL string) (wgcfg.Key, error) {
 	req, err := http.NewRequest("GET", serverURL+"/key", nil)
 	if err != nil {
 		return wgcfg.Key{}, fmt.Errorf("create control key request: %v", err)
@@ -761,7 +944,7 @@ func loadServerKey(ctx context.Context, httpc *http.Client, serverURL string) (w
 	req = req.WithContext(ctx)
 	res, err := httpc.Do(req)
 	if err != nil {
-		return wgcfg.Key{}, fmt.Errorf("fetch control key: %v", err)
+		return wgcfg.Key{}, fmt.Errorf("fetch control key: %v", tlsdial.DescribeError(err))
 	}
 	defer res.Body.Close()
 	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
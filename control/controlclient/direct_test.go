@@ -0,0 +1,169 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+)
+
+func TestControlTransport(t *testing.T) {
+	a := controlTransport("a.example.com")
+	if controlTransport("a.example.com") != a {
+		t.Errorf("transport for the same host not shared")
+	}
+	if controlTransport("b.example.com") == a {
+		t.Errorf("transport shared between hosts")
+	}
+}
+
+func TestLoadServerKey(t *testing.T) {
+	k, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := k.Public()
+
+	var hits int32
+	fetching := make(chan struct{}, 1)
+	release := make(chan struct{})
+	// The server answers only once every caller is waiting on its
+	// fetch, so none of them can start another.
+	const callers = 4
+	var waiting sync.WaitGroup
+	waiting.Add(callers)
+	serverKeyWaiting = waiting.Done
+	defer func() { serverKeyWaiting = nil }()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		select {
+		case fetching <- struct{}{}:
+		default:
+		}
+		<-release
+		w.Write([]byte(want.HexString()))
+	}))
+	defer srv.Close()
+
+	// The first caller gives up while the fetch is in flight.
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := loadServerKey(ctx, srv.Client(), srv.URL)
+		firstErr <- err
+	}()
+	<-fetching
+
+	var wg sync.WaitGroup
+	for i := 0; i < callers-1; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := loadServerKey(context.Background(), srv.Client(), srv.URL)
+			if err != nil {
+				t.Errorf("coalesced caller: %v", err)
+			} else if got != want {
+				t.Errorf("coalesced caller got %v; want %v", got, want)
+			}
+		}()
+	}
+	waiting.Wait()
+	cancel()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("canceled caller: err = %v; want %v", err, context.Canceled)
+	}
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("server got %d key requests; want 1", n)
+	}
+}
+
+func TestTryLogout(t *testing.T) {
+	newKey := func() wgcfg.PrivateKey {
+		k, err := wgcfg.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	serverPriv, machinePriv, nodePriv := newKey(), newKey(), newKey()
+	machinePub := machinePriv.Public()
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if want := "/machine/" + machinePub.HexString(); r.URL.Path != want {
+			t.Errorf("request path = %q; want %q", r.URL.Path, want)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var req tailcfg.RegisterRequest
+		if err := decodeMsg(body, &req, &machinePub, &serverPriv); err != nil {
+			t.Errorf("decoding request: %v", err)
+			return
+		}
+		if req.NodeKey != tailcfg.NodeKey(nodePriv.Public()) {
+			t.Errorf("request for node key %v; want %v", req.NodeKey.ShortString(), nodePriv.Public().ShortString())
+		}
+		if !req.Expiry.Before(time.Now()) {
+			t.Errorf("request expiry %v isn't in the past", req.Expiry)
+		}
+		b, err := encode(tailcfg.RegisterResponse{}, &machinePub, &serverPriv)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	c := &Direct{
+		httpc:     srv.Client(),
+		serverURL: srv.URL,
+		logf:      t.Logf,
+		serverKey: serverPriv.Public(),
+		persist: Persist{
+			PrivateMachineKey: machinePriv,
+			PrivateNodeKey:    nodePriv,
+			ServerURL:         srv.URL,
+			ServerKey:         serverPriv.Public(),
+		},
+		hostinfo: &tailcfg.Hostinfo{},
+	}
+	if err := c.TryLogout(context.Background()); err != nil {
+		t.Fatalf("TryLogout: %v", err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("server got %d requests; want 1", n)
+	}
+	p := c.GetPersist()
+	if p.PrivateNodeKey != (wgcfg.PrivateKey{}) {
+		t.Errorf("node key kept after logout")
+	}
+	if p.PrivateMachineKey != machinePriv || p.ServerKey != serverPriv.Public() {
+		t.Errorf("machine or pinned server key lost on logout")
+	}
+
+	// Logged out, there's nothing left to expire.
+	if err := c.TryLogout(context.Background()); err != nil {
+		t.Fatalf("second TryLogout: %v", err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("second TryLogout sent a request to the server")
+	}
+}
@@ -23,17 +23,25 @@ import (
 type NetworkMap struct {
 	// Core networking
 
-	NodeKey       tailcfg.NodeKey
-	PrivateKey    wgcfg.PrivateKey
-	Expiry        time.Time
+	NodeKey    tailcfg.NodeKey
+	PrivateKey wgcfg.PrivateKey
+	// Expiry is when the node key expires, by the local clock: the
+	// control server's expiry time, adjusted by ClockSkew (by at most
+	// a day).
+	Expiry time.Time
+	// ClockSkew is how far the local clock is ahead of the control
+	// server's, to the minute; negative if it's behind.
+	ClockSkew     time.Duration
 	Addresses     []wgcfg.CIDR
 	LocalPort     uint16 // used for debugging
 	MachineStatus tailcfg.MachineStatus
 	Peers         []*tailcfg.Node
-	DNS           []wgcfg.IP
-	DNSDomains    []string
+	DNS           tailcfg.DNSConfig
 	Hostinfo      tailcfg.Hostinfo
 	PacketFilter  filter.Matches
+	// Tags are the ACL tags granted to this node; nil if the
+	// control server doesn't report them.
+	Tags []string
 
 	// DERPMap is the last DERP server map received. It's reused
 	// between updates and should not be modified.
@@ -12,7 +12,7 @@ import (
 )
 
 func TestPersistEqual(t *testing.T) {
-	persistHandles := []string{"PrivateMachineKey", "PrivateNodeKey", "OldPrivateNodeKey", "Provider", "LoginName"}
+	persistHandles := []string{"PrivateMachineKey", "PrivateNodeKey", "OldPrivateNodeKey", "Provider", "LoginName", "ServerURL", "ServerKey"}
 	if have := fieldsOf(reflect.TypeOf(Persist{})); !reflect.DeepEqual(have, persistHandles) {
 		t.Errorf("Persist.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
 			have, persistHandles)
@@ -89,6 +89,22 @@ func TestPersistEqual(t *testing.T) {
 			&Persist{LoginName: "foo@tailscale.com"},
 			true,
 		},
+
+		{
+			&Persist{ServerURL: "https://login.tailscale.com"},
+			&Persist{ServerURL: "https://control.example.com"},
+			false,
+		},
+		{
+			&Persist{ServerKey: k1.Public()},
+			&Persist{ServerKey: newPrivate().Public()},
+			false,
+		},
+		{
+			&Persist{ServerKey: k1.Public()},
+			&Persist{ServerKey: k1.Public()},
+			true,
+		},
 	}
 	for i, test := range tests {
 		if got := test.a.Equals(test.b); got != test.want {
@@ -0,0 +1,38 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"fmt"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// checkServerKey checks key, the key the control server at serverURL
+// presented, against the one pinned in persist. The first key seen
+// from a server is pinned, on trust. A different one later means the
+// server was rekeyed, or replaced by someone else's, which TLS alone
+// doesn't rule out for self-hosted servers; checkServerKey then
+// returns a description of the change. Unless strict, the new key is
+// pinned in place of the old. If strict, the old pin is kept and an
+// error is returned, so that the caller doesn't connect.
+func checkServerKey(persist *Persist, serverURL string, key wgcfg.Key, strict bool) (change string, err error) {
+	if persist.ServerURL != serverURL || persist.ServerKey == (wgcfg.Key{}) {
+		persist.ServerURL = serverURL
+		persist.ServerKey = key
+		return "", nil
+	}
+	if persist.ServerKey == key {
+		return "", nil
+	}
+	change = fmt.Sprintf("control server %s's key changed from %s to %s; if it wasn't rekeyed on purpose, it may have been replaced",
+		serverURL, persist.ServerKey.ShortString(), key.ShortString())
+	if strict {
+		return change, fmt.Errorf("control server %s's key changed from %s to %s; refusing to connect",
+			serverURL, persist.ServerKey.ShortString(), key.ShortString())
+	}
+	persist.ServerKey = key
+	return change, nil
+}
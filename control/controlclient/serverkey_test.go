@@ -0,0 +1,60 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestCheckServerKey(t *testing.T) {
+	newKey := func() wgcfg.Key {
+		k, err := wgcfg.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k.Public()
+	}
+	k1, k2 := newKey(), newKey()
+	const url = "https://control.example.com"
+
+	var p Persist
+	if change, err := checkServerKey(&p, url, k1, true); change != "" || err != nil {
+		t.Fatalf("first key: %q, %v", change, err)
+	}
+	if p.ServerURL != url || p.ServerKey != k1 {
+		t.Fatalf("first key not pinned: %+v", p)
+	}
+	if change, err := checkServerKey(&p, url, k1, true); change != "" || err != nil {
+		t.Fatalf("same key: %q, %v", change, err)
+	}
+
+	// Strictly, a new key is refused and the pin kept.
+	change, err := checkServerKey(&p, url, k2, true)
+	if change == "" || err == nil {
+		t.Fatalf("strict, new key: %q, %v; want a change and an error", change, err)
+	}
+	if p.ServerKey != k1 {
+		t.Errorf("strict: pin replaced")
+	}
+
+	// Otherwise it's reported and pinned.
+	change, err = checkServerKey(&p, url, k2, false)
+	if change == "" || err != nil {
+		t.Fatalf("new key: %q, %v; want a change and no error", change, err)
+	}
+	if p.ServerKey != k2 {
+		t.Errorf("new key not pinned")
+	}
+
+	// Another server's key is pinned anew.
+	if change, err := checkServerKey(&p, "https://other.example.com", k1, true); change != "" || err != nil {
+		t.Fatalf("other server: %q, %v", change, err)
+	}
+	if p.ServerURL != "https://other.example.com" || p.ServerKey != k1 {
+		t.Errorf("other server's key not pinned: %+v", p)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// sshHostKeyDir is where sshd keeps its host keys.
+const sshHostKeyDir = "/etc/ssh"
+
+// sshHostKeys returns the public SSH host keys of this machine, in
+// authorized_keys format ("ssh-ed25519 AAAA..."), so peers can verify
+// them without trust-on-first-use. It returns nil if there are none
+// or they can't be read.
+func sshHostKeys() []string {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	return sshHostKeysInDir(sshHostKeyDir)
+}
+
+func sshHostKeysInDir(dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "ssh_host_*_key.pub"))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(files)
+	var keys []string
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		// Keep the key type and data, but not the trailing comment,
+		// which is usually root@<hostname> and not worth leaking.
+		fields := strings.Fields(string(bytes.TrimSpace(b)))
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "ssh-") && !strings.HasPrefix(fields[0], "ecdsa-") {
+			continue
+		}
+		keys = append(keys, fields[0]+" "+fields[1])
+	}
+	return keys
+}
@@ -19,6 +19,7 @@ import (
 	"math/big"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +27,7 @@ import (
 
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 	"tailscale.com/metrics"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
@@ -47,6 +49,13 @@ type Server struct {
 	// before failing when writing to a client.
 	WriteTimeout time.Duration
 
+	// BytesPerSecond and PacketsPerSecond, if non-zero, limit how
+	// fast each client may send packets through the server. Packets
+	// over the limit are dropped. Mesh peers aren't limited.
+	// They must be set before serving begins.
+	BytesPerSecond   int
+	PacketsPerSecond int
+
 	privateKey key.Private
 	publicKey  key.Public
 	logf       logger.Logf
@@ -65,6 +74,7 @@ type Server struct {
 	packetsDroppedQueueHead  *expvar.Int // queue full, drop head packet
 	packetsDroppedQueueTail  *expvar.Int // queue full, drop tail packet
 	packetsDroppedWrite      *expvar.Int // error writing to dst conn
+	packetsDroppedRateLimit  *expvar.Int // src over its rate limit
 	_                        [pad32bit]byte
 	packetsForwardedOut      expvar.Int
 	packetsForwardedIn       expvar.Int
@@ -97,6 +107,9 @@ type Server struct {
 	// because it includes intra-region forwarded packets as the
 	// src.
 	sentTo map[key.Public]map[key.Public]int64 // src => dst => dst's latest sclient.connNum
+	// banned holds the clients disconnected by DisconnectClient
+	// that can't reconnect until the given time.
+	banned map[key.Public]time.Time
 }
 
 // PacketForwarder is something that can forward packets.
@@ -139,6 +152,7 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 		memSys0:              ms.Sys,
 		watchers:             map[*sclient]bool{},
 		sentTo:               map[key.Public]map[key.Public]int64{},
+		banned:               map[key.Public]time.Time{},
 	}
 	s.packetsDroppedUnknown = s.packetsDroppedReason.Get("unknown_dest")
 	s.packetsDroppedFwdUnknown = s.packetsDroppedReason.Get("unknown_dest_on_fwd")
@@ -146,6 +160,7 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 	s.packetsDroppedQueueHead = s.packetsDroppedReason.Get("queue_head")
 	s.packetsDroppedQueueTail = s.packetsDroppedReason.Get("queue_tail")
 	s.packetsDroppedWrite = s.packetsDroppedReason.Get("write_error")
+	s.packetsDroppedRateLimit = s.packetsDroppedReason.Get("rate_limit")
 	return s
 }
 
@@ -373,6 +388,19 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 	}
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{})
+	} else {
+		if s.PacketsPerSecond > 0 {
+			c.pktLimit = rate.NewLimiter(rate.Limit(s.PacketsPerSecond), s.PacketsPerSecond)
+		}
+		if s.BytesPerSecond > 0 {
+			// Allow bursts of at least one full packet, so
+			// low limits don't block large packets entirely.
+			burst := s.BytesPerSecond
+			if burst < MaxPacketSize {
+				burst = MaxPacketSize
+			}
+			c.byteLimit = rate.NewLimiter(rate.Limit(s.BytesPerSecond), burst)
+		}
 	}
 	if clientInfo != nil {
 		c.info = *clientInfo
@@ -503,6 +531,8 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 		return fmt.Errorf("client %x: recvForwardPacket: %v", c.key, err)
 	}
 	s.packetsForwardedIn.Add(1)
+	c.packetsRecv.Add(1)
+	c.bytesRecv.Add(int64(len(contents)))
 
 	s.mu.Lock()
 	dst := s.clients[dstKey]
@@ -546,6 +576,18 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	c.packetsRecv.Add(1)
+	c.bytesRecv.Add(int64(len(contents)))
+
+	if !c.allowPacket(len(contents)) {
+		s.packetsDropped.Add(1)
+		s.packetsDroppedRateLimit.Add(1)
+		c.packetsRateLimited.Add(1)
+		if debug {
+			c.logf("dropping packet over rate limit")
+		}
+		return nil
+	}
 
 	var fwd PacketForwarder
 	s.mu.Lock()
@@ -583,6 +625,45 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	return c.sendPkt(dst, p)
 }
 
+// allowPacket reports whether c's rate limits allow it to send a
+// packet of n bytes now. A packet either limit rejects uses up
+// neither.
+func (c *sclient) allowPacket(n int) bool {
+	now := time.Now()
+	pkt := reserveNow(c.pktLimit, now, 1)
+	bytes := reserveNow(c.byteLimit, now, n)
+	if pkt == nil || bytes == nil {
+		cancelAt(pkt, now)
+		cancelAt(bytes, now)
+		return false
+	}
+	return true
+}
+
+// reserveNow reserves n tokens from l if they're available at now. It
+// returns nil if they aren't, and an unused reservation if l is nil.
+func reserveNow(l *rate.Limiter, now time.Time, n int) *rate.Reservation {
+	if l == nil {
+		return new(rate.Reservation)
+	}
+	r := l.ReserveN(now, n)
+	if !r.OK() {
+		return nil
+	}
+	if r.DelayFrom(now) > 0 {
+		r.CancelAt(now)
+		return nil
+	}
+	return r
+}
+
+// cancelAt returns r's tokens, if any, to its limiter.
+func cancelAt(r *rate.Reservation, now time.Time) {
+	if r != nil {
+		r.CancelAt(now)
+	}
+}
+
 func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 	s := c.s
 	dstKey := dst.key
@@ -595,6 +676,7 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 		case <-dst.done:
 			s.packetsDropped.Add(1)
 			s.packetsDroppedGone.Add(1)
+			dst.packetsDropped.Add(1)
 			if debug {
 				c.logf("dropping packet for shutdown client %x", dstKey)
 			}
@@ -611,6 +693,7 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 		case <-dst.sendQueue:
 			s.packetsDropped.Add(1)
 			s.packetsDroppedQueueHead.Add(1)
+			dst.packetsDropped.Add(1)
 			if debug {
 				c.logf("dropping packet from client %x queue head", dstKey)
 			}
@@ -622,6 +705,7 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 	// this case to keep reader unblocked.
 	s.packetsDropped.Add(1)
 	s.packetsDroppedQueueTail.Add(1)
+	dst.packetsDropped.Add(1)
 	if debug {
 		c.logf("dropping packet from client %x queue tail", dstKey)
 	}
@@ -651,7 +735,14 @@ func (c *sclient) requestMeshUpdate() {
 
 func (s *Server) verifyClient(clientKey key.Public, info *clientInfo) error {
 	// TODO(crawshaw): implement policy constraints on who can use the DERP server
-	// TODO(bradfitz): ... and at what rate.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until, ok := s.banned[clientKey]; ok {
+		if time.Now().Before(until) {
+			return fmt.Errorf("banned until %v", until.Format(time.RFC3339))
+		}
+		delete(s.banned, clientKey)
+	}
 	return nil
 }
 
@@ -779,6 +870,13 @@ func (s *Server) recvForwardPacket(br *bufio.Reader, frameLen uint32) (srcKey, d
 //
 // (The "s" prefix is to more explicitly distinguish it from Client in derp_client.go)
 type sclient struct {
+	// Counters, first in the struct so they're 64-bit aligned on
+	// 32-bit platforms.
+	packetsRecv, bytesRecv expvar.Int // received from the client
+	packetsSent, bytesSent expvar.Int // sent to the client
+	packetsDropped         expvar.Int // destined to the client, but dropped
+	packetsRateLimited     expvar.Int // received from the client, but over its rate limit
+
 	// Static after construction.
 	connNum    int64 // process-wide unique counter, incremented each Accept
 	s          *Server
@@ -792,6 +890,8 @@ type sclient struct {
 	peerGone   chan key.Public // write request that a previous sender has disconnected (not used by mesh peers)
 	meshUpdate chan struct{}   // write request to write peerStateChange
 	canMesh    bool            // clientInfo had correct mesh token for inter-region routing
+	pktLimit   *rate.Limiter   // packets the client may send; nil if unlimited
+	byteLimit  *rate.Limiter   // bytes the client may send; nil if unlimited
 
 	// Owned by run, not thread-safe.
 	br          *bufio.Reader
@@ -866,6 +966,7 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			case <-c.sendQueue:
 				c.s.packetsDropped.Add(1)
 				c.s.packetsDroppedGone.Add(1)
+				c.packetsDropped.Add(1)
 				if debug {
 					c.logf("dropping packet for shutdown %x", c.key)
 				}
@@ -1015,12 +1116,15 @@ func (c *sclient) sendPacket(srcKey key.Public, contents []byte) (err error) {
 		if err != nil {
 			c.s.packetsDropped.Add(1)
 			c.s.packetsDroppedWrite.Add(1)
+			c.packetsDropped.Add(1)
 			if debug {
 				c.logf("dropping packet to %x: %v", c.key, err)
 			}
 		} else {
 			c.s.packetsSent.Add(1)
 			c.s.bytesSent.Add(int64(len(contents)))
+			c.packetsSent.Add(1)
+			c.bytesSent.Add(int64(len(contents)))
 		}
 	}()
 
@@ -1190,6 +1294,92 @@ func (s *Server) ExpVar() expvar.Var {
 	return m
 }
 
+// ClientStats is a snapshot of the traffic of a connected client.
+type ClientStats struct {
+	// Key identifies the client by the short form of its public
+	// key, enough to tell clients apart but not to reveal them.
+	Key         string
+	ConnectedAt time.Time
+	Mesh        bool // whether the client is a mesh peer
+
+	PacketsRecv, BytesRecv int64 // received from the client
+	PacketsSent, BytesSent int64 // sent to the client
+	PacketsDropped         int64 // destined to the client, but dropped
+	PacketsRateLimited     int64 // received from the client, but over its rate limit
+}
+
+// ClientStats returns the traffic stats of the currently connected
+// clients, the ones relaying the most bytes first.
+func (s *Server) ClientStats() []ClientStats {
+	s.mu.Lock()
+	ret := make([]ClientStats, 0, len(s.clients))
+	for k, c := range s.clients {
+		ret = append(ret, ClientStats{
+			Key:                k.ShortString(),
+			ConnectedAt:        c.connectedAt,
+			Mesh:               c.canMesh,
+			PacketsRecv:        c.packetsRecv.Value(),
+			BytesRecv:          c.bytesRecv.Value(),
+			PacketsSent:        c.packetsSent.Value(),
+			BytesSent:          c.bytesSent.Value(),
+			PacketsDropped:     c.packetsDropped.Value(),
+			PacketsRateLimited: c.packetsRateLimited.Value(),
+		})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		bi := ret[i].BytesRecv + ret[i].BytesSent
+		bj := ret[j].BytesRecv + ret[j].BytesSent
+		if bi != bj {
+			return bi > bj
+		}
+		return ret[i].Key < ret[j].Key
+	})
+	return ret
+}
+
+// DisconnectClient closes the connection of the connected client
+// identified by id, which is either its public key in hex or its
+// short form, as in ClientStats.Key. If ban is positive, the client
+// can't reconnect for that long.
+func (s *Server) DisconnectClient(id string, ban time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var match []*sclient
+	for k, c := range s.clients {
+		if id == k.ShortString() || id == fmt.Sprintf("%x", k[:]) {
+			match = append(match, c)
+		}
+	}
+	switch len(match) {
+	case 0:
+		return fmt.Errorf("no connected client %q", id)
+	case 1:
+	default:
+		return fmt.Errorf("%q matches %d clients; use the full key", id, len(match))
+	}
+	c := match[0]
+	if ban > 0 {
+		s.banned[c.key] = time.Now().Add(ban)
+		c.logf("disconnected by admin, banned for %v", ban)
+	} else {
+		c.logf("disconnected by admin")
+	}
+	go c.nc.Close()
+	return nil
+}
+
+// PacketsDroppedByReason returns the number of packets dropped so
+// far, keyed by the reason they were dropped.
+func (s *Server) PacketsDroppedByReason() map[string]int64 {
+	ret := map[string]int64{}
+	s.packetsDroppedReason.Do(func(kv expvar.KeyValue) {
+		ret[kv.Key] = kv.Value.(*expvar.Int).Value()
+	})
+	return ret
+}
+
 func (s *Server) ConsistencyCheck() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -18,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"golang.org/x/time/rate"
 	"tailscale.com/net/nettest"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
@@ -173,6 +174,27 @@ func TestSendRecv(t *testing.T) {
 	recvNothing(0)
 	recvNothing(1)
 
+	wantStats := func(i int, bytesRecv, bytesSent int64) {
+		t.Helper()
+		dl := time.Now().Add(5 * time.Second)
+		var got ClientStats
+		for time.Now().Before(dl) {
+			for _, cs := range s.ClientStats() {
+				if cs.Key == clientKeys[i].ShortString() {
+					got = cs
+				}
+			}
+			if got.BytesRecv == bytesRecv && got.BytesSent == bytesSent {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("client %d: bytes recv/sent=%v/%v; want %v/%v", i, got.BytesRecv, got.BytesSent, bytesRecv, bytesSent)
+	}
+	wantStats(0, int64(len(msg1)), 0)
+	wantStats(1, int64(len(msg2)), int64(len(msg1)))
+	wantStats(2, 0, int64(len(msg2)))
+
 	wantActive(3, 0)
 	clients[0].NotePreferred(true)
 	wantActive(3, 1)
@@ -742,3 +764,67 @@ func TestForwarderRegistration(t *testing.T) {
 		u1: testFwd(3),
 	})
 }
+
+func TestAllowPacket(t *testing.T) {
+	c := &sclient{pktLimit: rate.NewLimiter(1, 2)}
+	for i, want := range []bool{true, true, false} {
+		if got := c.allowPacket(100); got != want {
+			t.Errorf("packet %d: allowed=%v; want %v", i, got, want)
+		}
+	}
+
+	c = &sclient{byteLimit: rate.NewLimiter(100, 1000)}
+	if !c.allowPacket(600) {
+		t.Error("first packet not allowed")
+	}
+	if c.allowPacket(600) {
+		t.Error("second packet allowed over byte limit")
+	}
+
+	// A packet over the byte limit doesn't use up the packet limit.
+	c = &sclient{
+		pktLimit:  rate.NewLimiter(1, 1),
+		byteLimit: rate.NewLimiter(100, 1000),
+	}
+	if c.allowPacket(2000) {
+		t.Error("packet over the byte burst allowed")
+	}
+	if !c.allowPacket(100) {
+		t.Error("packet not allowed after a rejected one")
+	}
+
+	c = &sclient{}
+	if !c.allowPacket(MaxPacketSize) {
+		t.Error("packet not allowed without limits")
+	}
+}
+
+func TestDisconnectClient(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+
+	c1 := newRegularClient(t, ts, "c1")
+	dl := time.Now().Add(5 * time.Second)
+	for len(ts.s.ClientStats()) == 0 {
+		if time.Now().After(dl) {
+			t.Fatal("client never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := ts.s.DisconnectClient("[nope]", 0); err == nil {
+		t.Error("disconnected unknown client")
+	}
+	if err := ts.s.DisconnectClient(fmt.Sprintf("%x", c1.pub[:]), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for len(ts.s.ClientStats()) != 0 {
+		if time.Now().After(dl) {
+			t.Fatal("client never disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := ts.s.verifyClient(c1.pub, nil); err == nil {
+		t.Error("banned client can reconnect")
+	}
+}
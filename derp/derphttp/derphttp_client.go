@@ -206,6 +206,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 
 	defer func() {
 		if err != nil {
+			err = tlsdial.DescribeError(err)
 			if ctx.Err() != nil {
 				err = fmt.Errorf("%v: %v", ctx.Err(), err)
 			}
@@ -356,6 +357,7 @@ func (c *Client) tlsClient(nc net.Conn, node *tailcfg.DERPNode) *tls.Conn {
 	if node != nil {
 		if node.DERPTestPort != 0 {
 			tlsConf.InsecureSkipVerify = true
+			tlsConf.VerifyPeerCertificate = nil
 		}
 		if node.CertName != "" {
 			tlsdial.SetConfigExpectedCert(tlsConf, node.CertName)
@@ -382,7 +384,7 @@ func (c *Client) DialRegionTLS(ctx context.Context, reg *tailcfg.DERPRegion) (tl
 	}()
 	err = tlsConn.Handshake()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, tlsdial.DescribeError(err)
 	}
 	select {
 	case done <- true:
@@ -86,10 +86,16 @@ func appendMsgHeader(b []byte, t MessageType, ver uint8, dataLen int) (all, data
 
 type Ping struct {
 	TxID [12]byte
+
+	// Padding is the number of zero bytes added to the end of the
+	// message, to probe whether the path carries packets that
+	// large. Recipients that predate it ignore it, as they do all
+	// trailing bytes.
+	Padding int
 }
 
 func (m *Ping) AppendMarshal(b []byte) []byte {
-	ret, d := appendMsgHeader(b, TypePing, v0, 12)
+	ret, d := appendMsgHeader(b, TypePing, v0, 12+m.Padding)
 	copy(d, m.TxID[:])
 	return ret
 }
@@ -100,6 +106,7 @@ func parsePing(ver uint8, p []byte) (m *Ping, err error) {
 	}
 	m = new(Ping)
 	copy(m.TxID[:], p)
+	m.Padding = len(p) - 12
 	return m, nil
 }
 
@@ -125,12 +132,17 @@ func (CallMeMaybe) AppendMarshal(b []byte) []byte {
 type Pong struct {
 	TxID [12]byte
 	Src  netaddr.IPPort // 18 bytes (16+2) on the wire; v4-mapped ipv6 for IPv4
+
+	// Padding is the number of zero bytes added to the end of the
+	// message. A reply to a padded Ping is padded to the same size,
+	// to probe the return path too.
+	Padding int
 }
 
 const pongLen = 12 + 16 + 2
 
 func (m *Pong) AppendMarshal(b []byte) []byte {
-	ret, d := appendMsgHeader(b, TypePong, v0, pongLen)
+	ret, d := appendMsgHeader(b, TypePong, v0, pongLen+m.Padding)
 	d = d[copy(d, m.TxID[:]):]
 	ip16 := m.Src.IP.As16()
 	d = d[copy(d, ip16[:]):]
@@ -150,6 +162,7 @@ func parsePong(ver uint8, p []byte) (m *Pong, err error) {
 	p = p[16:]
 
 	m.Src.Port = binary.BigEndian.Uint16(p)
+	m.Padding = len(p) - 2
 	return m, nil
 }
 
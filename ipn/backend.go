@@ -16,15 +16,17 @@ import (
 	"tailscale.com/wgengine"
 )
 
+// State is the state of the backend's state machine. See nextStateFor
+// for the transitions between states.
 type State int
 
 const (
-	NoState = State(iota)
-	NeedsLogin
-	NeedsMachineAuth
-	Stopped
-	Starting
-	Running
+	NoState          = State(iota) // starting up; no netmap yet
+	NeedsLogin                     // the user must log in
+	NeedsMachineAuth               // an administrator must authorize the machine
+	Stopped                        // logged in, but WantRunning is off
+	Starting                       // configuring the engine; no peers reachable yet
+	Running                        // connected
 )
 
 func (s State) String() string {
@@ -52,11 +54,18 @@ type Notify struct {
 	LoginFinished *empty.Message            // event: non-nil when login process succeeded
 	State         *State                    // current IPN state has changed
 	Prefs         *Prefs                    // preferences were changed
+	PrefSources   map[string]PrefSource     // where each of Prefs' values came from; only set in reply to RequestPrefs
 	NetMap        *controlclient.NetworkMap // new netmap received
+	NetInfo       *tailcfg.NetInfo          // this node's network conditions, such as DERP latencies; only set in reply to RequestNetMap
 	Engine        *EngineStatus             // wireguard engine stats
 	Status        *ipnstate.Status          // full status
 	BrowseToURL   *string                   // UI should open a browser right now
 	BackendLogID  *string                   // public logtail id used by backend
+	Goroutines    *string                   // all of the backend's goroutine stacks; only set in reply to RequestGoroutines
+
+	// KeyExpiryWarning is the node key's expiry time, sent when
+	// it's getting close (see LocalBackend.SetKeyExpiryWarnings).
+	KeyExpiryWarning *time.Time
 
 	// type is mirrored in xcode/Shared/IPN.swift
 }
@@ -130,6 +139,10 @@ type Backend interface {
 	// WantRunning. This may cause the wireguard engine to
 	// reconfigure or stop.
 	SetPrefs(*Prefs)
+	// EditPrefs changes only the prefs named in the edit, leaving
+	// the rest as they are. Edits are applied one at a time, so
+	// concurrent edits of different prefs don't undo each other.
+	EditPrefs(*MaskedPrefs)
 	// RequestEngineStatus polls for an update from the wireguard
 	// engine. Only needed if you want to display byte
 	// counts. Connection events are emitted automatically without
@@ -138,6 +151,13 @@ type Backend interface {
 	// RequestStatus requests that a full Status update
 	// notification is sent.
 	RequestStatus()
+	// RequestPrefs requests that a Prefs notification is sent,
+	// along with the source of each pref's value.
+	RequestPrefs()
+	// RequestNetMap requests that a NetMap notification is sent,
+	// without the node's private key, along with NetInfo. NetMap
+	// is nil if there's no network map yet.
+	RequestNetMap()
 	// FakeExpireAfter pretends that the current key is going to
 	// expire after duration x. This is useful for testing GUIs to
 	// make sure they react properly with keys that are going to
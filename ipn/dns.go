@@ -0,0 +1,252 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/tsdns"
+)
+
+// magicDNSIP is the address on which wgengine's DNS resolver listens.
+var magicDNSIP = netaddr.IPv4(100, 100, 100, 100)
+
+// magicDNSDomain is the domain under which the resolver answers for
+// peers' names.
+const magicDNSDomain = "tailscale.us"
+
+// magicDNSZones returns the domains that wgengine's resolver answers
+// for, or forwards to the resolvers control configured for them,
+// given dc: its own domain, the search domains, the split DNS routes
+// and the names of extra records. They're sorted and without
+// duplicates.
+func magicDNSZones(dc tailcfg.DNSConfig) []string {
+	seen := map[string]bool{}
+	var zones []string
+	add := func(z string) {
+		z = strings.TrimSuffix(strings.ToLower(z), ".")
+		if z != "" && !seen[z] {
+			seen[z] = true
+			zones = append(zones, z)
+		}
+	}
+	add(magicDNSDomain)
+	for _, d := range dc.Domains {
+		add(d)
+	}
+	for d := range dc.Routes {
+		add(d)
+	}
+	for _, rec := range dc.ExtraRecords {
+		add(rec.Name)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// dnsConfigs compiles the DNS configuration from control into the
+// nameservers the OS should be configured with and the upstreams of
+// wgengine's DNS resolver.
+//
+// If dc.Proxied is unset, all resolvers are plain port 53 servers and
+// there are neither split nor fallback resolvers nor extra records,
+// the OS uses the resolvers directly. Otherwise, the OS is pointed at wgengine's
+// resolver, which answers for peers and routes other queries
+// according to dc.
+//
+// Resolvers with malformed addresses are logged and skipped.
+func dnsConfigs(logf logger.Logf, dc tailcfg.DNSConfig) (osNameservers []netaddr.IP, upstreams tsdns.Upstreams) {
+	direct := !dc.Proxied && len(dc.Routes) == 0 && len(dc.FallbackResolvers) == 0 && len(dc.ExtraRecords) == 0
+
+	addrs := func(resolvers []tailcfg.DNSResolver) (ret []string) {
+		for _, r := range resolvers {
+			ip, port, err := parseDNSResolver(r)
+			if err != nil {
+				logf("dns: skipping resolver: %v", err)
+				continue
+			}
+			if port != 53 || r.TLSServerName != "" {
+				direct = false
+			}
+			if direct {
+				osNameservers = append(osNameservers, ip)
+			}
+			addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+			if r.TLSServerName != "" {
+				addr = tsdns.DoTAddr(addr, r.TLSServerName)
+			}
+			ret = append(ret, addr)
+		}
+		return ret
+	}
+
+	upstreams.Nameservers = addrs(dc.Resolvers)
+	upstreams.Fallback = addrs(dc.FallbackResolvers)
+	if len(dc.Routes) > 0 {
+		upstreams.Routes = make(map[string][]string, len(dc.Routes))
+		for domain, resolvers := range dc.Routes {
+			upstreams.Routes[domain] = addrs(resolvers)
+		}
+	}
+
+	if dc.Proxied || len(dc.ExtraRecords) > 0 || !direct && (len(upstreams.Nameservers) > 0 || len(upstreams.Routes) > 0 || len(upstreams.Fallback) > 0) {
+		osNameservers = []netaddr.IP{magicDNSIP}
+	}
+	return osNameservers, upstreams
+}
+
+// exitNodeResolvers are where wgengine's resolver forwards queries
+// while traffic goes via an exit node, if control configured no
+// resolvers. Like all other traffic, the queries go through the exit
+// node.
+var exitNodeResolvers = []string{"1.1.1.1:53", "8.8.8.8:53"}
+
+// exitNodeDNS returns the DNS configuration to use instead of that
+// from dnsConfigs while traffic goes via an exit node: the OS sends
+// all queries to wgengine's resolver, which forwards those it doesn't
+// answer to upstreams, or exitNodeResolvers if there are none, so
+// that no queries go to the local network's resolvers.
+func exitNodeDNS(upstreams tsdns.Upstreams) (osNameservers []netaddr.IP, _ tsdns.Upstreams) {
+	if len(upstreams.Nameservers) == 0 && len(upstreams.Fallback) == 0 {
+		upstreams.Fallback = exitNodeResolvers
+	}
+	return []netaddr.IP{magicDNSIP}, upstreams
+}
+
+// dnsRecords compiles extra records from control, or the local
+// override file, for wgengine's resolver. Malformed records are
+// logged and skipped.
+func dnsRecords(logf logger.Logf, recs []tailcfg.DNSRecord) []tsdns.Record {
+	var ret []tsdns.Record
+	for _, rec := range recs {
+		name := strings.TrimSuffix(rec.Name, ".")
+		if name == "" {
+			logf("dns: skipping extra record without a name: %+v", rec)
+			continue
+		}
+		switch typ := strings.ToUpper(rec.Type); typ {
+		case "", "A", "AAAA":
+			ip, err := netaddr.ParseIP(rec.Value)
+			if err != nil || typ == "A" && !ip.Is4() || typ == "AAAA" && ip.Is4() {
+				logf("dns: skipping extra record for %q: bad %s value %q", rec.Name, typ, rec.Value)
+				continue
+			}
+			ret = append(ret, tsdns.Record{Name: name, IP: ip})
+		case "CNAME":
+			target := strings.TrimSuffix(rec.Value, ".")
+			if target == "" {
+				logf("dns: skipping extra record for %q: empty CNAME", rec.Name)
+				continue
+			}
+			ret = append(ret, tsdns.Record{Name: name, Target: target})
+		default:
+			logf("dns: skipping extra record for %q: unsupported type %q", rec.Name, rec.Type)
+		}
+	}
+	return ret
+}
+
+// readDNSRecords reads extra records, as a JSON array of
+// tailcfg.DNSRecord, from the file at path.
+func readDNSRecords(path string) ([]tailcfg.DNSRecord, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var recs []tailcfg.DNSRecord
+	if err := json.Unmarshal(b, &recs); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return recs, nil
+}
+
+// dnsRouting returns which queries the OS should send to
+// osNameservers, as returned by dnsConfigs: besides those under the
+// search domains, those under routes, and if defaultRoute, all those
+// no other network's DNS configuration claims. That's everything when
+// control set global resolvers or traffic goes via an exit node, and
+// otherwise just the zones wgengine's resolver serves.
+func dnsRouting(dc tailcfg.DNSConfig, osNameservers []netaddr.IP, exitNode bool) (routes []string, defaultRoute bool) {
+	if len(osNameservers) == 0 {
+		return nil, false
+	}
+	if len(osNameservers) == 1 && osNameservers[0] == magicDNSIP {
+		search := map[string]bool{}
+		for _, d := range dc.Domains {
+			search[strings.TrimSuffix(strings.ToLower(d), ".")] = true
+		}
+		for _, z := range magicDNSZones(dc) {
+			if !search[z] {
+				routes = append(routes, z)
+			}
+		}
+	}
+	return routes, len(dc.Resolvers) > 0 || exitNode
+}
+
+// resolvConfPath is where systemNameservers reads the system's
+// nameservers from.
+var resolvConfPath = "/etc/resolv.conf"
+
+// systemNameservers returns the nameservers in r, in resolv.conf(5)
+// format, as ip:port strings for wgengine's resolver.
+//
+// They're where the resolver forwards names control has no resolver
+// for, when control configures split DNS alone and the OS can't send
+// only the split domains to it, so all queries come to it. The
+// resolver's own address, which is in resolv.conf when Tailscale
+// manages it, and loopback stub resolvers, which may forward back to
+// it, are skipped.
+func systemNameservers(r io.Reader) []string {
+	var ret []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 2 || f[0] != "nameserver" {
+			continue
+		}
+		ip := net.ParseIP(f[1])
+		if ip == nil || ip.IsLoopback() || ip.String() == magicDNSIP.String() {
+			continue
+		}
+		ret = append(ret, net.JoinHostPort(ip.String(), "53"))
+	}
+	return ret
+}
+
+// parseDNSResolver parses the address of r, which is of the form
+// "ip" or "ip:port". Without a port, it's 53, or 853 for DNS-over-TLS.
+func parseDNSResolver(r tailcfg.DNSResolver) (netaddr.IP, uint16, error) {
+	if ip, err := netaddr.ParseIP(r.Addr); err == nil {
+		if r.TLSServerName != "" {
+			return ip, 853, nil
+		}
+		return ip, 53, nil
+	}
+	host, portStr, err := net.SplitHostPort(r.Addr)
+	if err != nil {
+		return netaddr.IP{}, 0, fmt.Errorf("invalid resolver address %q: %v", r.Addr, err)
+	}
+	ip, err := netaddr.ParseIP(host)
+	if err != nil {
+		return netaddr.IP{}, 0, fmt.Errorf("invalid resolver address %q: %v", r.Addr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return netaddr.IP{}, 0, fmt.Errorf("invalid resolver port in %q", r.Addr)
+	}
+	return ip, uint16(port), nil
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/tsdns"
+)
+
+func TestDNSConfigs(t *testing.T) {
+	resolvers := func(addrs ...string) (ret []tailcfg.DNSResolver) {
+		for _, a := range addrs {
+			ret = append(ret, tailcfg.DNSResolver{Addr: a})
+		}
+		return ret
+	}
+	ips := func(strs ...string) (ret []netaddr.IP) {
+		for _, s := range strs {
+			ip, err := netaddr.ParseIP(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, ip)
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name      string
+		in        tailcfg.DNSConfig
+		wantOS    []netaddr.IP
+		wantUpstr tsdns.Upstreams
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "direct",
+			in:     tailcfg.DNSConfig{Resolvers: resolvers("1.1.1.1", "2606:4700:4700::1111")},
+			wantOS: ips("1.1.1.1", "2606:4700:4700::1111"),
+			wantUpstr: tsdns.Upstreams{
+				Nameservers: []string{"1.1.1.1:53", "[2606:4700:4700::1111]:53"},
+			},
+		},
+		{
+			name:   "nonstandard_port",
+			in:     tailcfg.DNSConfig{Resolvers: resolvers("1.1.1.1", "10.0.0.1:5353")},
+			wantOS: ips("100.100.100.100"),
+			wantUpstr: tsdns.Upstreams{
+				Nameservers: []string{"1.1.1.1:53", "10.0.0.1:5353"},
+			},
+		},
+		{
+			name: "split",
+			in: tailcfg.DNSConfig{
+				Resolvers: resolvers("1.1.1.1"),
+				Routes: map[string][]tailcfg.DNSResolver{
+					"corp.example.com": resolvers("10.0.0.1", "[fd00::1]:53"),
+				},
+			},
+			wantOS: ips("100.100.100.100"),
+			wantUpstr: tsdns.Upstreams{
+				Nameservers: []string{"1.1.1.1:53"},
+				Routes: map[string][]string{
+					"corp.example.com": {"10.0.0.1:53", "[fd00::1]:53"},
+				},
+			},
+		},
+		{
+			name: "fallback_only",
+			in: tailcfg.DNSConfig{
+				FallbackResolvers: resolvers("8.8.8.8"),
+			},
+			wantOS: ips("100.100.100.100"),
+			wantUpstr: tsdns.Upstreams{
+				Fallback: []string{"8.8.8.8:53"},
+			},
+		},
+		{
+			name: "proxied",
+			in: tailcfg.DNSConfig{
+				Resolvers: resolvers("1.1.1.1"),
+				Proxied:   true,
+			},
+			wantOS: ips("100.100.100.100"),
+			wantUpstr: tsdns.Upstreams{
+				Nameservers: []string{"1.1.1.1:53"},
+			},
+		},
+		{
+			name:   "proxied_no_resolvers",
+			in:     tailcfg.DNSConfig{Proxied: true},
+			wantOS: ips("100.100.100.100"),
+		},
+		{
+			name: "dot",
+			in: tailcfg.DNSConfig{Resolvers: []tailcfg.DNSResolver{
+				{Addr: "10.0.0.1", TLSServerName: "dns.corp.example.com"},
+				{Addr: "10.0.0.2:8853", TLSServerName: "dns.corp.example.com"},
+			}},
+			wantOS: ips("100.100.100.100"),
+			wantUpstr: tsdns.Upstreams{
+				Nameservers: []string{
+					"tls://10.0.0.1:853#dns.corp.example.com",
+					"tls://10.0.0.2:8853#dns.corp.example.com",
+				},
+			},
+		},
+		{
+			name: "extra_records",
+			in: tailcfg.DNSConfig{
+				Resolvers:    resolvers("1.1.1.1"),
+				ExtraRecords: []tailcfg.DNSRecord{{Name: "git.internal", Value: "100.101.102.103"}},
+			},
+			wantOS: ips("100.100.100.100"),
+			wantUpstr: tsdns.Upstreams{
+				Nameservers: []string{"1.1.1.1:53"},
+			},
+		},
+		{
+			name:   "bad_addr",
+			in:     tailcfg.DNSConfig{Resolvers: resolvers("1.1.1.1", "not-an-ip", "1.2.3.4:0")},
+			wantOS: ips("1.1.1.1"),
+			wantUpstr: tsdns.Upstreams{
+				Nameservers: []string{"1.1.1.1:53"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotOS, gotUpstr := dnsConfigs(t.Logf, tt.in)
+			if !reflect.DeepEqual(gotOS, tt.wantOS) {
+				t.Errorf("OS nameservers = %v; want %v", gotOS, tt.wantOS)
+			}
+			if !reflect.DeepEqual(gotUpstr, tt.wantUpstr) {
+				t.Errorf("upstreams = %+v; want %+v", gotUpstr, tt.wantUpstr)
+			}
+		})
+	}
+}
+
+func TestMagicDNSZones(t *testing.T) {
+	got := magicDNSZones(tailcfg.DNSConfig{
+		Domains: []string{"Corp.Example.com.", "tailscale.us", ""},
+		Routes: map[string][]tailcfg.DNSResolver{
+			"ad.example.com":   {{Addr: "10.0.0.1"}},
+			"corp.example.com": {{Addr: "10.0.0.2"}},
+		},
+		ExtraRecords: []tailcfg.DNSRecord{{Name: "git.internal.", Value: "100.101.102.103"}},
+	})
+	want := []string{"ad.example.com", "corp.example.com", "git.internal", "tailscale.us"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestDNSRecords(t *testing.T) {
+	v6, err := netaddr.ParseIP("fd7a:115c:a1e0::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := dnsRecords(t.Logf, []tailcfg.DNSRecord{
+		{Name: "git.internal", Value: "100.101.102.103"},
+		{Name: "v6.internal.", Type: "aaaa", Value: "fd7a:115c:a1e0::1"},
+		{Name: "wiki.internal", Type: "CNAME", Value: "docs.example.com."},
+		{Name: "bad-a.internal", Type: "A", Value: "fd7a:115c:a1e0::1"},
+		{Name: "bad-ip.internal", Value: "not-an-ip"},
+		{Name: "mail.internal", Type: "MX", Value: "mx.example.com"},
+		{Name: "", Value: "100.101.102.103"},
+	})
+	want := []tsdns.Record{
+		{Name: "git.internal", IP: netaddr.IPv4(100, 101, 102, 103)},
+		{Name: "v6.internal", IP: v6},
+		{Name: "wiki.internal", Target: "docs.example.com"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestDNSRouting(t *testing.T) {
+	dc := tailcfg.DNSConfig{
+		Domains: []string{"corp.example.com"},
+		Routes: map[string][]tailcfg.DNSResolver{
+			"ad.example.com": {{Addr: "10.0.0.1"}},
+		},
+	}
+	tests := []struct {
+		name         string
+		dc           tailcfg.DNSConfig
+		nameservers  []netaddr.IP
+		exitNode     bool
+		wantRoutes   []string
+		wantDefRoute bool
+	}{
+		{
+			name: "no_nameservers",
+			dc:   dc,
+		},
+		{
+			name:        "split",
+			dc:          dc,
+			nameservers: []netaddr.IP{magicDNSIP},
+			wantRoutes:  []string{"ad.example.com", "tailscale.us"},
+		},
+		{
+			name:         "split_exit_node",
+			dc:           dc,
+			nameservers:  []netaddr.IP{magicDNSIP},
+			exitNode:     true,
+			wantRoutes:   []string{"ad.example.com", "tailscale.us"},
+			wantDefRoute: true,
+		},
+		{
+			name:         "global_direct",
+			dc:           tailcfg.DNSConfig{Resolvers: []tailcfg.DNSResolver{{Addr: "8.8.8.8"}}},
+			nameservers:  []netaddr.IP{netaddr.IPv4(8, 8, 8, 8)},
+			wantDefRoute: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, defRoute := dnsRouting(tt.dc, tt.nameservers, tt.exitNode)
+			if !reflect.DeepEqual(routes, tt.wantRoutes) || defRoute != tt.wantDefRoute {
+				t.Errorf("got %q, %v; want %q, %v", routes, defRoute, tt.wantRoutes, tt.wantDefRoute)
+			}
+		})
+	}
+}
+
+func TestExitNodeDNS(t *testing.T) {
+	tests := []struct {
+		name string
+		in   tsdns.Upstreams
+		want tsdns.Upstreams
+	}{
+		{
+			name: "none",
+			want: tsdns.Upstreams{Fallback: exitNodeResolvers},
+		},
+		{
+			name: "split",
+			in:   tsdns.Upstreams{Routes: map[string][]string{"corp.example.com": {"10.0.0.1:53"}}},
+			want: tsdns.Upstreams{
+				Routes:   map[string][]string{"corp.example.com": {"10.0.0.1:53"}},
+				Fallback: exitNodeResolvers,
+			},
+		},
+		{
+			name: "global",
+			in:   tsdns.Upstreams{Nameservers: []string{"9.9.9.9:53"}},
+			want: tsdns.Upstreams{Nameservers: []string{"9.9.9.9:53"}},
+		},
+		{
+			name: "fallback",
+			in:   tsdns.Upstreams{Fallback: []string{"9.9.9.9:53"}},
+			want: tsdns.Upstreams{Fallback: []string{"9.9.9.9:53"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			osNS, upstreams := exitNodeDNS(tt.in)
+			if len(osNS) != 1 || osNS[0] != magicDNSIP {
+				t.Errorf("OS nameservers = %v; want %v", osNS, magicDNSIP)
+			}
+			if !reflect.DeepEqual(upstreams, tt.want) {
+				t.Errorf("upstreams = %+v; want %+v", upstreams, tt.want)
+			}
+		})
+	}
+}
+
+func TestSystemNameservers(t *testing.T) {
+	const resolvConf = `# generated by resolvconf
+nameserver 100.100.100.100
+nameserver 192.168.1.1
+nameserver 127.0.0.53
+nameserver fd00::1
+search example.com
+nameserver
+`
+	got := systemNameservers(strings.NewReader(resolvConf))
+	want := []string{"192.168.1.1:53", "[fd00::1]:53"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
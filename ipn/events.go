@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+)
+
+// EventType is the kind of an Event.
+type EventType string
+
+const (
+	// EventStateChange is sent when the backend changes State.
+	EventStateChange = EventType("state-change")
+	// EventPeerAdded is sent when a node joins the network, or
+	// becomes visible to this one, after the first network map.
+	EventPeerAdded = EventType("peer-added")
+	// EventKeyExpiry is sent when the node key's expiry is close,
+	// at the times set by SetKeyExpiryWarnings.
+	EventKeyExpiry = EventType("key-expiry")
+)
+
+// Event is something significant happening to the backend, reported
+// to the hook set by LocalBackend.SetEventHook. Unlike Notify, it
+// doesn't depend on a frontend being connected, and it's meant to be
+// passed on as JSON to scripts and webhooks.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// State, PrevState and Reason are set for EventStateChange.
+	State     string      `json:",omitempty"`
+	PrevState string      `json:",omitempty"`
+	Reason    StateReason `json:",omitempty"`
+
+	// Peer is set for EventPeerAdded.
+	Peer *EventPeer `json:",omitempty"`
+
+	// KeyExpiry is set for EventKeyExpiry.
+	KeyExpiry *time.Time `json:",omitempty"`
+}
+
+// EventPeer identifies a peer in an Event.
+type EventPeer struct {
+	Name      string // MagicDNS name
+	Hostname  string
+	Addresses []string
+}
+
+func eventPeer(n *tailcfg.Node) *EventPeer {
+	p := &EventPeer{
+		Name:     n.Name,
+		Hostname: n.Hostinfo.Hostname,
+	}
+	for _, a := range n.Addresses {
+		p.Addresses = append(p.Addresses, a.IP.String())
+	}
+	return p
+}
+
+// addedPeers returns the peers in nm that aren't in old.
+func addedPeers(old, nm *controlclient.NetworkMap) []*tailcfg.Node {
+	had := make(map[tailcfg.NodeKey]bool, len(old.Peers))
+	for _, p := range old.Peers {
+		had[p.Key] = true
+	}
+	var ret []*tailcfg.Node
+	for _, p := range nm.Peers {
+		if !had[p.Key] {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
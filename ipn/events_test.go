@@ -0,0 +1,28 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"testing"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+)
+
+func TestAddedPeers(t *testing.T) {
+	a := &tailcfg.Node{Name: "a.example.", Key: tailcfg.NodeKey{1}}
+	b := &tailcfg.Node{Name: "b.example.", Key: tailcfg.NodeKey{2}}
+	c := &tailcfg.Node{Name: "c.example.", Key: tailcfg.NodeKey{3}}
+	old := &controlclient.NetworkMap{Peers: []*tailcfg.Node{a, b}}
+	nm := &controlclient.NetworkMap{Peers: []*tailcfg.Node{b, c}}
+
+	got := addedPeers(old, nm)
+	if len(got) != 1 || got[0] != c {
+		t.Errorf("addedPeers = %v; want [c]", got)
+	}
+	if got := addedPeers(nm, nm); len(got) != 0 {
+		t.Errorf("addedPeers of identical maps = %v; want none", got)
+	}
+}
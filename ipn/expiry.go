@@ -0,0 +1,161 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// DefaultKeyExpiryWarnings are how long before the node key expires
+// to warn about it, if not configured otherwise.
+var DefaultKeyExpiryWarnings = []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour}
+
+// ParseKeyExpiryWarnings parses a comma-separated list of durations,
+// like "7d,1d,1h", into a list for LocalBackend.SetKeyExpiryWarnings.
+// In addition to time.ParseDuration's units, it accepts whole days
+// ("7d"). An empty string means no warnings.
+func ParseKeyExpiryWarnings(s string) ([]time.Duration, error) {
+	var ret []time.Duration
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		var d time.Duration
+		if strings.HasSuffix(f, "d") {
+			n, err := strconv.Atoi(strings.TrimSuffix(f, "d"))
+			if err != nil {
+				return nil, fmt.Errorf("bad key expiry warning %q", f)
+			}
+			d = time.Duration(n) * 24 * time.Hour
+		} else {
+			var err error
+			if d, err = time.ParseDuration(f); err != nil {
+				return nil, fmt.Errorf("bad key expiry warning %q: %v", f, err)
+			}
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("bad key expiry warning %q: must be positive", f)
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+// expiryWarner warns as the node key's expiry approaches, once each
+// time less than one of its warning durations is left.
+type expiryWarner struct {
+	logf logger.Logf
+	warn func(expiry time.Time) // called without mu held
+
+	mu       sync.Mutex
+	warnings []time.Duration // longest first
+	expiry   time.Time       // zero if the key doesn't expire
+	warned   int             // number of warnings given for expiry
+	timer    *time.Timer     // fires at the next warning; nil if none
+}
+
+func newExpiryWarner(logf logger.Logf, warnings []time.Duration, warn func(expiry time.Time)) *expiryWarner {
+	w := &expiryWarner{
+		logf:     logf,
+		warn:     warn,
+		warnings: append([]time.Duration(nil), warnings...),
+	}
+	sort.Slice(w.warnings, func(i, j int) bool { return w.warnings[i] > w.warnings[j] })
+	return w
+}
+
+// warningsDue returns how many of warnings (longest first) are due
+// when left is the time until expiry.
+func warningsDue(warnings []time.Duration, left time.Duration) int {
+	n := 0
+	for n < len(warnings) && left <= warnings[n] {
+		n++
+	}
+	return n
+}
+
+// setExpiry updates the key expiry, from a new netmap.
+func (w *expiryWarner) setExpiry(expiry time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if expiry.Equal(w.expiry) {
+		return
+	}
+	w.expiry = expiry
+	w.warned = 0
+	w.checkLocked()
+}
+
+// stop cancels any pending warning.
+func (w *expiryWarner) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.expiry = time.Time{}
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+func (w *expiryWarner) check() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.checkLocked()
+}
+
+// checkLocked gives the warning due now, if any, and schedules the
+// next one. If several are due at once, as when starting up close to
+// expiry, only one warning is given.
+//
+// w.mu must be held.
+func (w *expiryWarner) checkLocked() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.expiry.IsZero() {
+		return
+	}
+	left := time.Until(w.expiry)
+	if left <= 0 {
+		// The state machine takes it from here (NeedsLogin).
+		return
+	}
+	if due := warningsDue(w.warnings, left); due > w.warned {
+		w.warned = due
+		w.logf("warning: node key expires in %v, at %v; log in again to renew it", left.Round(time.Minute), w.expiry.Format(time.RFC3339))
+		go w.warn(w.expiry)
+	}
+	if w.warned < len(w.warnings) {
+		w.timer = time.AfterFunc(left-w.warnings[w.warned], w.check)
+	}
+}
+
+// clockSkewWarnThreshold is how far the local clock can be from the
+// control server's before the status warns about it.
+const clockSkewWarnThreshold = 5 * time.Minute
+
+// clockSkewWarning returns a health warning about skew, how far the
+// local clock is ahead of the control server's, if it's large. Key
+// expiry is judged by the control server's clock, within limits (see
+// controlclient.NetworkMap.Expiry), but TLS certificate checks aren't.
+func clockSkewWarning(skew time.Duration) (string, bool) {
+	dir := "ahead of"
+	if skew < 0 {
+		skew, dir = -skew, "behind"
+	}
+	if skew < clockSkewWarnThreshold {
+		return "", false
+	}
+	return fmt.Sprintf("system clock is %v %s the control server's; TLS connections may fail until it's synced", skew, dir), true
+}
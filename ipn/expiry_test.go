@@ -0,0 +1,111 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeyExpiryWarnings(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []time.Duration
+		wantErr bool
+	}{
+		{in: ""},
+		{in: "7d,1d,1h", want: []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour}},
+		{in: " 30m , 2h", want: []time.Duration{30 * time.Minute, 2 * time.Hour}},
+		{in: "1w", wantErr: true},
+		{in: "xd", wantErr: true},
+		{in: "0s", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseKeyExpiryWarnings(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseKeyExpiryWarnings(%q) error = %v; want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseKeyExpiryWarnings(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWarningsDue(t *testing.T) {
+	warnings := DefaultKeyExpiryWarnings // 7d, 1d, 1h
+	tests := []struct {
+		left time.Duration
+		want int
+	}{
+		{30 * 24 * time.Hour, 0},
+		{7 * 24 * time.Hour, 1},
+		{3 * 24 * time.Hour, 1},
+		{2 * time.Hour, 2},
+		{time.Minute, 3},
+	}
+	for _, tt := range tests {
+		if got := warningsDue(warnings, tt.left); got != tt.want {
+			t.Errorf("warningsDue(%v) = %d; want %d", tt.left, got, tt.want)
+		}
+	}
+}
+
+func TestExpiryWarner(t *testing.T) {
+	got := make(chan time.Time, 10)
+	w := newExpiryWarner(t.Logf, []time.Duration{50 * time.Millisecond, time.Hour}, func(expiry time.Time) {
+		got <- expiry
+	})
+	defer w.stop()
+
+	// Already within the hour: one warning now, then one more
+	// 50ms before expiry.
+	expiry := time.Now().Add(200 * time.Millisecond)
+	w.setExpiry(expiry)
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-got:
+			if !e.Equal(expiry) {
+				t.Errorf("warning %d for %v; want %v", i, e, expiry)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for warning %d", i)
+		}
+	}
+	select {
+	case <-got:
+		t.Error("unexpected third warning")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// A renewed key resets the warnings.
+	w.setExpiry(time.Now().Add(24 * time.Hour))
+	select {
+	case <-got:
+		t.Error("unexpected warning after renewal")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClockSkewWarning(t *testing.T) {
+	tests := []struct {
+		skew time.Duration
+		want string
+	}{
+		{0, ""},
+		{time.Minute, ""},
+		{-4 * time.Minute, ""},
+		{2 * time.Hour, "system clock is 2h0m0s ahead of the control server's"},
+		{-10 * time.Minute, "system clock is 10m0s behind the control server's"},
+	}
+	for _, tt := range tests {
+		got, ok := clockSkewWarning(tt.skew)
+		if ok != (tt.want != "") || !strings.HasPrefix(got, tt.want) {
+			t.Errorf("clockSkewWarning(%v) = %q, %v; want prefix %q", tt.skew, got, ok, tt.want)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
 )
 
 type FakeBackend struct {
@@ -70,6 +71,14 @@ func (b *FakeBackend) SetPrefs(new *Prefs) {
 	}
 }
 
+func (b *FakeBackend) EditPrefs(mp *MaskedPrefs) {
+	p := NewPrefs()
+	if err := p.ApplyEdits(mp); err != nil {
+		panic("FakeBackend.EditPrefs: " + err.Error())
+	}
+	b.SetPrefs(p)
+}
+
 func (b *FakeBackend) RequestEngineStatus() {
 	b.notify(Notify{Engine: &EngineStatus{}})
 }
@@ -78,6 +87,14 @@ func (b *FakeBackend) RequestStatus() {
 	b.notify(Notify{Status: &ipnstate.Status{}})
 }
 
+func (b *FakeBackend) RequestPrefs() {
+	b.notify(Notify{Prefs: NewPrefs(), PrefSources: prefSources(nil, NewPrefs(), NewPrefs(), PrefFromDefault)})
+}
+
+func (b *FakeBackend) RequestNetMap() {
+	b.notify(Notify{NetMap: &controlclient.NetworkMap{}, NetInfo: &tailcfg.NetInfo{}})
+}
+
 func (b *FakeBackend) FakeExpireAfter(x time.Duration) {
 	b.notify(Notify{NetMap: &controlclient.NetworkMap{}})
 }
@@ -103,6 +103,13 @@ func (h *Handle) UpdatePrefs(updateFn func(p *Prefs)) {
 	h.b.SetPrefs(new)
 }
 
+// EditPrefs changes the prefs named in mp, without replacing the
+// others. The cached prefs are updated when the backend reports the
+// result.
+func (h *Handle) EditPrefs(mp *MaskedPrefs) {
+	h.b.EditPrefs(mp)
+}
+
 func (h *Handle) State() State {
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -166,6 +173,14 @@ func (h *Handle) RequestStatus() {
 	h.b.RequestStatus()
 }
 
+func (h *Handle) RequestPrefs() {
+	h.b.RequestPrefs()
+}
+
+func (h *Handle) RequestNetMap() {
+	h.b.RequestNetMap()
+}
+
 func (h *Handle) FakeExpireAfter(x time.Duration) {
 	h.b.FakeExpireAfter(x)
 }
@@ -0,0 +1,124 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// eventQueueSize is how many events can wait for delivery before
+	// new ones are dropped.
+	eventQueueSize = 32
+	// eventTimeout is how long delivering an event to the webhook or
+	// the command may take.
+	eventTimeout = 30 * time.Second
+)
+
+// eventSink delivers backend events, as JSON, to a webhook URL and a
+// command, one at a time and in order, without blocking the backend.
+type eventSink struct {
+	logf logger.Logf
+	url  string
+	args []string // command and its arguments
+	ch   chan ipn.Event
+}
+
+// newEventSink returns a sink for events to url and cmd, either of
+// which may be empty, or nil if both are.
+func newEventSink(logf logger.Logf, url, cmd string) *eventSink {
+	args := strings.Fields(cmd)
+	if url == "" && len(args) == 0 {
+		return nil
+	}
+	return &eventSink{
+		logf: logger.WithPrefix(logf, "events: "),
+		url:  url,
+		args: args,
+		ch:   make(chan ipn.Event, eventQueueSize),
+	}
+}
+
+// send queues e for delivery. It's the hook for
+// LocalBackend.SetEventHook.
+func (s *eventSink) send(e ipn.Event) {
+	select {
+	case s.ch <- e:
+	default:
+		s.logf("queue full; dropping %s event", e.Type)
+	}
+}
+
+// run delivers queued events until ctx is done.
+func (s *eventSink) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-s.ch:
+			j, err := json.Marshal(e)
+			if err != nil {
+				s.logf("%v", err)
+				continue
+			}
+			if s.url != "" {
+				if err := s.post(ctx, j); err != nil {
+					s.logf("webhook: %v", err)
+				}
+			}
+			if len(s.args) > 0 {
+				if err := s.exec(ctx, e.Type, j); err != nil {
+					s.logf("command: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (s *eventSink) post(ctx context.Context, j []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, eventTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", s.url, res.Status)
+	}
+	return nil
+}
+
+// exec runs the command with the event on its stdin and its type in
+// $TS_EVENT, so that simple scripts needn't parse JSON.
+func (s *eventSink) exec(ctx context.Context, typ ipn.EventType, j []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, eventTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.args[0], s.args[1:]...)
+	cmd.Env = append(os.Environ(), "TS_EVENT="+string(typ))
+	cmd.Stdin = bytes.NewReader(j)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%q: %v: %s", strings.Join(s.args, " "), err, out)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+func TestEventSinkWebhook(t *testing.T) {
+	got := make(chan ipn.Event, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e ipn.Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("decoding event: %v", err)
+		}
+		got <- e
+	}))
+	defer ts.Close()
+
+	if newEventSink(t.Logf, "", "") != nil {
+		t.Error("sink created with no URL or command")
+	}
+	s := newEventSink(t.Logf, ts.URL, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	s.send(ipn.Event{Type: ipn.EventStateChange, State: "Running", PrevState: "Starting"})
+	select {
+	case e := <-got:
+		if e.Type != ipn.EventStateChange || e.State != "Running" || e.PrevState != "Starting" {
+			t.Errorf("got event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// idleCheckInterval returns how often waitIdle should sample traffic
+// for an idle timeout of d.
+func idleCheckInterval(d time.Duration) time.Duration {
+	interval := d / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// peerTraffic returns a func that reports the total bytes sent to
+// and received from all of b's peers.
+func peerTraffic(b *ipn.LocalBackend) func() int64 {
+	return func() int64 {
+		var bytes int64
+		for _, ps := range b.Status().Peer {
+			bytes += ps.RxBytes + ps.TxBytes
+		}
+		return bytes
+	}
+}
+
+// waitIdle checks traffic every interval and waits until it hasn't
+// changed for d. It reports whether that happened before ctx was
+// done.
+func waitIdle(ctx context.Context, traffic func() int64, d, interval time.Duration) bool {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var lastBytes int64
+	lastActive := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case now := <-t.C:
+			if bytes := traffic(); bytes != lastBytes {
+				lastBytes = bytes
+				lastActive = now
+			} else if now.Sub(lastActive) >= d {
+				return true
+			}
+		}
+	}
+}
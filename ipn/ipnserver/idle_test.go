@@ -0,0 +1,64 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdleCheckInterval(t *testing.T) {
+	tests := []struct {
+		d, want time.Duration
+	}{
+		{time.Second, time.Second},
+		{20 * time.Second, 5 * time.Second},
+		{time.Hour, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := idleCheckInterval(tt.d); got != tt.want {
+			t.Errorf("idleCheckInterval(%v) = %v; want %v", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestWaitIdle(t *testing.T) {
+	const d = 50 * time.Millisecond
+	const interval = 5 * time.Millisecond
+
+	// No traffic at all: idle after d.
+	start := time.Now()
+	if !waitIdle(context.Background(), func() int64 { return 0 }, d, interval) {
+		t.Fatal("waitIdle without traffic = false; want true")
+	}
+	if elapsed := time.Since(start); elapsed < d {
+		t.Errorf("waitIdle returned after %v; want at least %v", elapsed, d)
+	}
+
+	// Steady traffic: never idle, returns false once ctx is done.
+	var bytes int64
+	busy := func() int64 { return atomic.AddInt64(&bytes, 100) }
+	ctx, cancel := context.WithTimeout(context.Background(), 4*d)
+	defer cancel()
+	if waitIdle(ctx, busy, d, interval) {
+		t.Fatal("waitIdle with ongoing traffic = true; want false")
+	}
+
+	// Traffic that stops: idle after it stops.
+	var calls int64
+	stops := func() int64 {
+		if n := atomic.AddInt64(&calls, 1); n < 5 {
+			return n * 100
+		}
+		return 500
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*d)
+	defer cancel()
+	if !waitIdle(ctx, stops, d, interval) {
+		t.Fatal("waitIdle after traffic stopped = false; want true")
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -21,6 +22,7 @@ import (
 	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn"
 	"tailscale.com/logtail/backoff"
+	"tailscale.com/net/dnsmasq"
 	"tailscale.com/safesocket"
 	"tailscale.com/smallzstd"
 	"tailscale.com/types/logger"
@@ -42,6 +44,9 @@ type Options struct {
 	// using the given StateKey. If empty, the agent stays idle and
 	// waits for a frontend to start it.
 	AutostartStateKey ipn.StateKey
+	// AutostartAuthKey, if non-empty, is a node auth key to log
+	// in with when autostarting without a node key.
+	AutostartAuthKey string
 	// LegacyConfigPath optionally specifies the old-style relaynode
 	// relay.conf location. If both LegacyConfigPath and
 	// AutostartStateKey are specified and the requested state doesn't
@@ -57,6 +62,60 @@ type Options struct {
 	// false, the server dumps its state and becomes idle.
 	SurviveDisconnects bool
 
+	// LogoutOnExit specifies whether to log out of the control
+	// server when Run returns, so that nodes that only live as long
+	// as the process (such as ephemeral CI machines) don't linger
+	// in the network.
+	LogoutOnExit bool
+	// IdleTimeout, if non-zero, is how long the node can go without
+	// sending or receiving any traffic to or from peers before Run
+	// stops and returns nil.
+	IdleTimeout time.Duration
+	// LockdownUnlockPath, if non-empty, is the path of a file whose
+	// existence allows frontends to turn off Prefs.Lockdown. Only
+	// administrators should be able to create it.
+	LockdownUnlockPath string
+	// DeclarativePrefs, if non-nil, are the node's prefs, from a
+	// config file, which frontends can't change; see
+	// LocalBackend.SetDeclarativePrefs.
+	DeclarativePrefs *ipn.Prefs
+
+	// NoLogs is whether log uploads are disabled
+	// (no-logs-no-support), shown in the status.
+	NoLogs bool
+	// Warnings are health warnings about the environment tailscaled
+	// runs in, shown in the status.
+	Warnings []string
+
+	// DHCPDNS, if non-nil, is told to advertise MagicDNS to the
+	// LAN's DHCP clients while it's available.
+	DHCPDNS *dnsmasq.Advertiser
+	// DNSRecordsPath, if non-empty, is the path of a file of extra
+	// DNS records for MagicDNS to serve; see
+	// LocalBackend.SetDNSRecordsPath.
+	DNSRecordsPath string
+
+	// KeyExpiryWarnings are how long before the node key expires
+	// to warn about it. If nil, ipn.DefaultKeyExpiryWarnings are
+	// used.
+	KeyExpiryWarnings []time.Duration
+	// KeyExpiryCommand, if non-empty, is a command run with a
+	// message as its last argument for each of those warnings,
+	// such as "notify-send Tailscale" for a desktop notification.
+	KeyExpiryCommand string
+
+	// EventURL, if non-empty, is a URL that each ipn.Event is POSTed
+	// to as JSON.
+	EventURL string
+	// EventCommand, if non-empty, is a command run for each
+	// ipn.Event, with the event as JSON on its stdin.
+	EventCommand string
+
+	// WatchdogRestart is whether to crash the process, for its
+	// service manager to restart it, when LocalBackend stops
+	// responding. Either way, all goroutines' stacks are logged.
+	WatchdogRestart bool
+
 	// DebugMux, if non-nil, specifies an HTTP ServeMux in which
 	// to register a debug handler.
 	DebugMux *http.ServeMux
@@ -83,6 +142,9 @@ func Run(rctx context.Context, logf logger.Logf, logid string, opts Options, e w
 	runDone := make(chan error, 1)
 	defer func() { runDone <- err }()
 
+	rctx, rcancel := context.WithCancel(rctx)
+	defer rcancel()
+
 	listen, _, err := safesocket.Listen(opts.SocketPath, uint16(opts.Port))
 	if err != nil {
 		return fmt.Errorf("safesocket.Listen: %v", err)
@@ -115,6 +177,29 @@ func Run(rctx context.Context, logf logger.Logf, logid string, opts Options, e w
 	b.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
+	b.SetLockdownUnlockPath(opts.LockdownUnlockPath)
+	if opts.DeclarativePrefs != nil {
+		b.SetDeclarativePrefs(opts.DeclarativePrefs)
+	}
+	if opts.NoLogs {
+		b.SetNoLogs()
+	}
+	b.SetWarnings(opts.Warnings)
+	if opts.DHCPDNS != nil {
+		b.SetDHCPDNS(opts.DHCPDNS)
+	}
+	b.SetDNSRecordsPath(opts.DNSRecordsPath)
+	if opts.KeyExpiryWarnings != nil || opts.KeyExpiryCommand != "" {
+		warnings := opts.KeyExpiryWarnings
+		if warnings == nil {
+			warnings = ipn.DefaultKeyExpiryWarnings
+		}
+		b.SetKeyExpiryWarnings(warnings, keyExpiryHook(logf, opts.KeyExpiryCommand))
+	}
+	if sink := newEventSink(logf, opts.EventURL, opts.EventCommand); sink != nil {
+		b.SetEventHook(sink.send)
+		go sink.run(rctx)
+	}
 
 	if opts.DebugMux != nil {
 		opts.DebugMux.HandleFunc("/debug/ipn", func(w http.ResponseWriter, r *http.Request) {
@@ -135,14 +220,21 @@ func Run(rctx context.Context, logf logger.Logf, logid string, opts Options, e w
 	bs := ipn.NewBackendServer(logf, b, serverToClient)
 
 	if opts.AutostartStateKey != "" {
+		startOpts := ipn.Options{
+			StateKey:         opts.AutostartStateKey,
+			AuthKey:          opts.AutostartAuthKey,
+			LegacyConfigPath: opts.LegacyConfigPath,
+		}
+		// The unattended config would be prefs from elsewhere.
+		if opts.DeclarativePrefs == nil {
+			if uc := firstStartConfig(logf, store, opts.AutostartStateKey); uc != nil {
+				startOpts.Prefs = uc.Prefs
+				startOpts.AuthKey = uc.AuthKey
+			}
+		}
 		bs.GotCommand(&ipn.Command{
 			Version: version.LONG,
-			Start: &ipn.StartArgs{
-				Opts: ipn.Options{
-					StateKey:         opts.AutostartStateKey,
-					LegacyConfigPath: opts.LegacyConfigPath,
-				},
-			},
+			Start:   &ipn.StartArgs{Opts: startOpts},
 		})
 	}
 
@@ -164,6 +256,40 @@ func Run(rctx context.Context, logf logger.Logf, logid string, opts Options, e w
 		}
 	}
 
+	defer func() {
+		if opts.LogoutOnExit {
+			ctx, cancel := context.WithTimeout(context.Background(), logoutOnExitTimeout)
+			if err := b.LogoutSync(ctx); err != nil {
+				logf("logout on exit: %v", err)
+			}
+			cancel()
+		}
+		b.Shutdown()
+	}()
+
+	wd := &backendWatchdog{
+		logf:     logf,
+		probe:    func() { b.State() },
+		interval: backendCheckInterval,
+		maxWait:  backendMaxWait,
+	}
+	if opts.WatchdogRestart {
+		wd.fatalf = log.Fatalf
+	}
+	go wd.run(rctx)
+
+	idle := make(chan struct{}) // closed when IdleTimeout stops Run
+	if opts.IdleTimeout > 0 {
+		go func() {
+			d := opts.IdleTimeout
+			if waitIdle(rctx, peerTraffic(b), d, idleCheckInterval(d)) {
+				logf("no traffic for %v; stopping", d)
+				close(idle)
+				rcancel()
+			}
+		}()
+	}
+
 	bo := backoff.NewBackoff("ipnserver", logf)
 
 	for i := 1; rctx.Err() == nil; i++ {
@@ -194,7 +320,33 @@ func Run(rctx context.Context, logf logger.Logf, logid string, opts Options, e w
 	}
 	stopAll()
 
-	return rctx.Err()
+	select {
+	case <-idle:
+		return nil
+	default:
+		return rctx.Err()
+	}
+}
+
+// logoutOnExitTimeout is how long Run waits for the control server to
+// acknowledge a logout when Options.LogoutOnExit is set.
+const logoutOnExitTimeout = 5 * time.Second
+
+// keyExpiryHook returns a hook for LocalBackend.SetKeyExpiryWarnings
+// that runs cmd, a space-separated command line, with a message as
+// an extra argument. It returns nil if cmd is empty.
+func keyExpiryHook(logf logger.Logf, cmd string) func(time.Time) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return nil
+	}
+	return func(expiry time.Time) {
+		msg := fmt.Sprintf("Tailscale key expires in %v; log in again to stay connected.", time.Until(expiry).Round(time.Minute))
+		out, err := exec.Command(args[0], append(args[1:], msg)...).CombinedOutput()
+		if err != nil {
+			logf("key expiry command %q: %v: %s", cmd, err, out)
+		}
+	}
 }
 
 func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
@@ -0,0 +1,112 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+// unattendedConfig is configuration left by an installer for the
+// first start of the service, so that it comes up without anyone
+// running "tailscale up", as in silent mass deployments.
+//
+// On Windows, it's the values under the registry key
+// HKLM\SOFTWARE\Tailscale IPN\Unattended, which an MSI writes from
+// its properties: AuthKey, and any Prefs field by name. Booleans are
+// REG_DWORDs, and lists, like AdvertiseTags and AdvertiseRoutes, are
+// REG_MULTI_SZs or comma-separated REG_SZs. Other platforms have no
+// unattended configuration.
+type unattendedConfig struct {
+	AuthKey string
+	Prefs   *ipn.Prefs // NewPrefs, with the configured prefs set
+}
+
+// parseUnattended parses the named values of an unattended
+// configuration, each given as a string.
+func parseUnattended(values map[string]string) (*unattendedConfig, error) {
+	uc := &unattendedConfig{Prefs: ipn.NewPrefs()}
+	pv := reflect.ValueOf(uc.Prefs).Elem()
+	for name, s := range values {
+		if name == "AuthKey" {
+			uc.AuthKey = s
+			continue
+		}
+		f := pv.FieldByName(name)
+		if !f.IsValid() || name == "Persist" {
+			return nil, fmt.Errorf("unknown setting %q", name)
+		}
+		switch f.Interface().(type) {
+		case bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			f.SetBool(b)
+		case string:
+			f.SetString(s)
+		case []string:
+			f.Set(reflect.ValueOf(splitList(s)))
+		case []wgcfg.CIDR:
+			var cidrs []wgcfg.CIDR
+			for _, c := range splitList(s) {
+				cidr, err := wgcfg.ParseCIDR(c)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", name, err)
+				}
+				cidrs = append(cidrs, cidr)
+			}
+			f.Set(reflect.ValueOf(cidrs))
+		default:
+			return nil, fmt.Errorf("setting %s isn't supported", name)
+		}
+	}
+	return uc, nil
+}
+
+// splitList splits a comma- or newline-separated list, as the values
+// of a REG_MULTI_SZ are joined.
+func splitList(s string) []string {
+	var ret []string
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if f = strings.TrimSpace(f); f != "" {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// firstStartConfig returns the unattended configuration to start
+// with, if there is one and store has no state for key yet. It's
+// removed once read, so that the auth key doesn't linger.
+func firstStartConfig(logf logger.Logf, store ipn.StateStore, key ipn.StateKey) *unattendedConfig {
+	if _, err := store.ReadState(key); err != ipn.ErrStateNotExist {
+		return nil
+	}
+	values, err := readUnattended()
+	if err != nil {
+		logf("reading unattended config: %v", err)
+		return nil
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	if err := clearUnattended(); err != nil {
+		logf("removing unattended config: %v", err)
+	}
+	uc, err := parseUnattended(values)
+	if err != nil {
+		logf("ignoring unattended config: %v", err)
+		return nil
+	}
+	logf("starting with unattended config: %v", uc.Prefs.Pretty())
+	return uc
+}
@@ -0,0 +1,11 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package ipnserver
+
+func readUnattended() (map[string]string, error) { return nil, nil }
+
+func clearUnattended() error { return nil }
@@ -0,0 +1,55 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUnattended(t *testing.T) {
+	uc, err := parseUnattended(map[string]string{
+		"AuthKey":         "tskey-123",
+		"RouteAll":        "0",
+		"ShieldsUp":       "1",
+		"Hostname":        "kiosk-17",
+		"AdvertiseTags":   "tag:kiosk, tag:lobby",
+		"AdvertiseRoutes": "10.0.0.0/8\n192.168.0.0/24",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uc.AuthKey != "tskey-123" {
+		t.Errorf("AuthKey = %q", uc.AuthKey)
+	}
+	p := uc.Prefs
+	if p.RouteAll || !p.ShieldsUp || p.Hostname != "kiosk-17" {
+		t.Errorf("prefs = %v; want no RouteAll, ShieldsUp, Hostname kiosk-17", p.Pretty())
+	}
+	if want := []string{"tag:kiosk", "tag:lobby"}; !reflect.DeepEqual(p.AdvertiseTags, want) {
+		t.Errorf("AdvertiseTags = %q; want %q", p.AdvertiseTags, want)
+	}
+	var routes []string
+	for _, r := range p.AdvertiseRoutes {
+		routes = append(routes, r.String())
+	}
+	if want := []string{"10.0.0.0/8", "192.168.0.0/24"}; !reflect.DeepEqual(routes, want) {
+		t.Errorf("AdvertiseRoutes = %q; want %q", routes, want)
+	}
+	if !p.WantRunning || !p.CorpDNS {
+		t.Errorf("unset prefs aren't NewPrefs' defaults: %v", p.Pretty())
+	}
+
+	for _, bad := range []map[string]string{
+		{"NoSuchSetting": "1"},
+		{"Persist": "{}"},
+		{"RouteAll": "maybe"},
+		{"AdvertiseRoutes": "10.0.0.0/8,lan"},
+	} {
+		if _, err := parseUnattended(bad); err == nil {
+			t.Errorf("parseUnattended(%v) succeeded; want error", bad)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// unattendedKey is the registry key, under HKEY_LOCAL_MACHINE, of
+// the unattended configuration.
+const unattendedKey = `SOFTWARE\Tailscale IPN\Unattended`
+
+// readUnattended returns the values of unattendedKey as strings, or
+// nil if it doesn't exist.
+func readUnattended() (map[string]string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, unattendedKey, registry.QUERY_VALUE)
+	if err == registry.ErrNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening HKLM\\%s: %v", unattendedKey, err)
+	}
+	defer k.Close()
+
+	names, err := k.ReadValueNames(0)
+	if err != nil {
+		return nil, fmt.Errorf("HKLM\\%s: %v", unattendedKey, err)
+	}
+	ret := make(map[string]string)
+	for _, name := range names {
+		_, typ, err := k.GetValue(name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("HKLM\\%s\\%s: %v", unattendedKey, name, err)
+		}
+		switch typ {
+		case registry.DWORD, registry.QWORD:
+			n, _, err := k.GetIntegerValue(name)
+			if err != nil {
+				return nil, fmt.Errorf("HKLM\\%s\\%s: %v", unattendedKey, name, err)
+			}
+			// Booleans are DWORDs; ParseBool takes 0 and 1.
+			ret[name] = strconv.FormatUint(n, 10)
+		case registry.MULTI_SZ:
+			ss, _, err := k.GetStringsValue(name)
+			if err != nil {
+				return nil, fmt.Errorf("HKLM\\%s\\%s: %v", unattendedKey, name, err)
+			}
+			ret[name] = strings.Join(ss, "\n")
+		default:
+			s, _, err := k.GetStringValue(name)
+			if err != nil {
+				return nil, fmt.Errorf("HKLM\\%s\\%s: %v", unattendedKey, name, err)
+			}
+			ret[name] = s
+		}
+	}
+	return ret, nil
+}
+
+// clearUnattended deletes unattendedKey.
+func clearUnattended() error {
+	err := registry.DeleteKey(registry.LOCAL_MACHINE, unattendedKey)
+	if err != nil && err != registry.ErrNotExist {
+		return err
+	}
+	return nil
+}
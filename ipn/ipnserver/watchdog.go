@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"time"
+
+	"tailscale.com/types/logger"
+	"tailscale.com/util/goroutines"
+)
+
+const (
+	// backendCheckInterval is how often the watchdog checks that
+	// LocalBackend still responds.
+	backendCheckInterval = 15 * time.Second
+	// backendMaxWait is how long LocalBackend can take to respond
+	// before the watchdog considers it wedged.
+	backendMaxWait = 45 * time.Second
+)
+
+// backendWatchdog checks that LocalBackend keeps making progress,
+// which, as everything it does happens under its lock, is the same as
+// its lock becoming free now and then.
+type backendWatchdog struct {
+	logf logger.Logf
+	// probe returns once the backend is responsive.
+	probe func()
+	// fatalf, if non-nil, is called when the backend wedges, after
+	// the stacks are logged. If nil, the watchdog waits for the
+	// backend to recover and logs when it does.
+	fatalf   func(format string, args ...interface{})
+	interval time.Duration
+	maxWait  time.Duration
+}
+
+// run checks on the backend every interval until ctx is done.
+func (w *backendWatchdog) run(ctx context.Context) {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			w.check(ctx)
+		}
+	}
+}
+
+func (w *backendWatchdog) check(ctx context.Context) {
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		w.probe()
+		close(done)
+	}()
+	timer := time.NewTimer(w.maxWait)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+	w.logf("ipnserver watchdog stacks:\n%s", goroutines.Stacks(false))
+	if w.fatalf != nil {
+		w.fatalf("ipnserver: watchdog: backend unresponsive for %v", w.maxWait)
+		return
+	}
+	w.logf("ipnserver: watchdog: backend unresponsive for %v; still waiting", w.maxWait)
+	select {
+	case <-done:
+		w.logf("ipnserver: watchdog: backend responsive again after %v", time.Since(start).Round(time.Second))
+	case <-ctx.Done():
+	}
+}
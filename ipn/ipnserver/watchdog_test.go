@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackendWatchdog(t *testing.T) {
+	var mu sync.Mutex // stands in for LocalBackend's lock
+	var logMu sync.Mutex
+	var logs []string
+	w := &backendWatchdog{
+		logf: func(format string, args ...interface{}) {
+			logMu.Lock()
+			defer logMu.Unlock()
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+		probe: func() {
+			mu.Lock()
+			mu.Unlock()
+		},
+		interval: 10 * time.Millisecond,
+		maxWait:  50 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A responsive backend logs nothing.
+	w.check(ctx)
+	if len(logs) != 0 {
+		t.Fatalf("logs for a responsive backend: %q", logs)
+	}
+
+	mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		w.check(ctx)
+		close(done)
+	}()
+	time.Sleep(150 * time.Millisecond)
+	mu.Unlock()
+	<-done
+
+	logMu.Lock()
+	got := strings.Join(logs, "\n")
+	logMu.Unlock()
+	for _, want := range []string{"goroutine profile: total ", "backend unresponsive", "responsive again after"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("logs missing %q; got:\n%s", want, got)
+		}
+	}
+
+	// With fatalf set, a wedge is fatal.
+	fatal := make(chan string, 1)
+	w.fatalf = func(format string, args ...interface{}) {
+		select {
+		case fatal <- fmt.Sprintf(format, args...):
+		default:
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	go w.run(ctx)
+	select {
+	case msg := <-fatal:
+		if !strings.Contains(msg, "unresponsive") {
+			t.Errorf("fatal = %q", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("watchdog didn't fire")
+	}
+}
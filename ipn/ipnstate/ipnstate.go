@@ -25,8 +25,170 @@ import (
 // Status represents the entire state of the IPN network.
 type Status struct {
 	BackendState string
+	Control      *ControlStatus // nil if there's no control client
+	ManagedPrefs []string       // names of prefs enforced by the administrator's policy
+	NoLogs       bool           // log uploads are disabled (no-logs-no-support)
+	Tags         []string       // ACL tags granted to this node
+	DeniedTags   []string       // requested tags the control server didn't grant
+	KeyExpiry    time.Time      // when this node's key expires; zero if it doesn't
 	Peer         map[key.Public]*PeerStatus
 	User         map[tailcfg.UserID]tailcfg.UserProfile
+
+	// BackendStateReason is why the backend entered BackendState,
+	// one of the ipn.StateReason values.
+	BackendStateReason string `json:",omitempty"`
+
+	// TUN is the name of the Tailscale network interface, such as
+	// tailscale0 or, on macOS, whichever utun was free.
+	TUN string `json:",omitempty"`
+
+	// Interfaces is the traffic on each network interface that
+	// has carried any, sorted by name.
+	Interfaces []InterfaceStats `json:",omitempty"`
+
+	// Metered is whether the current network is treated as metered,
+	// so background traffic is being kept down.
+	Metered bool `json:",omitempty"`
+
+	// OnBattery is whether the machine is running on battery, so
+	// background pings and probes are being kept down.
+	OnBattery bool `json:",omitempty"`
+
+	// PortMapping is the port mapping protocols the last network
+	// check found the LAN's gateway offering, as a comma-separated
+	// list of "UPnP", "NAT-PMP" and "PCP", or "none". It's "off" if
+	// probing for them is disabled, and empty until checked.
+	PortMapping string `json:",omitempty"`
+
+	// NoLANDiscovery is whether LAN addresses are kept from being
+	// used to find direct paths to peers on the same network.
+	NoLANDiscovery bool `json:",omitempty"`
+
+	// Warnings are problems with the node's health that need the
+	// user's attention, such as a security policy denying tailscaled
+	// something it needs.
+	Warnings []string `json:",omitempty"`
+
+	// Background is the background work done to keep paths to
+	// peers alive, so the cost of the timing in use can be seen.
+	Background BackgroundStats
+
+	// MagicDNS describes Tailscale's DNS resolver, or is nil if the
+	// node isn't using Tailscale's DNS settings.
+	MagicDNS *MagicDNSStatus `json:",omitempty"`
+
+	// DNS is the DNS configuration Tailscale last applied to the
+	// system resolver, or nil if it doesn't manage DNS here.
+	DNS *DNSStatus `json:",omitempty"`
+
+	// DNSPlan is the DNS configuration the current network map and
+	// prefs call for, which "tailscale up" would apply if it differs
+	// from DNS, or nil if there's no network map yet.
+	DNSPlan *DNSConfig `json:",omitempty"`
+
+	// DNSMetrics counts the queries Tailscale's DNS resolver has
+	// answered since tailscaled started.
+	DNSMetrics *DNSMetrics `json:",omitempty"`
+}
+
+// MagicDNSStatus describes Tailscale's DNS resolver, so that other DNS
+// servers on the machine can forward to it.
+type MagicDNSStatus struct {
+	Addr  string   // IP address the resolver listens on, port 53
+	Zones []string // domains to forward to it, without trailing dots
+}
+
+// DNSStatus describes how Tailscale configures the system resolver.
+type DNSStatus struct {
+	// Manager names the mechanism used, such as
+	// "systemd-resolved", "openresolv", "direct" or "NRPT".
+	Manager string
+	Applied DNSConfig
+}
+
+// DNSConfig is a DNS configuration for the system resolver.
+type DNSConfig struct {
+	Nameservers []string `json:",omitempty"`
+	Domains     []string `json:",omitempty"` // search domains
+	// Routes are domains resolved by Nameservers that aren't
+	// searched.
+	Routes []string `json:",omitempty"`
+	// DefaultRoute is whether Nameservers resolve all names not
+	// claimed by another interface's configuration, too.
+	DefaultRoute bool `json:",omitempty"`
+}
+
+// DNSMetrics counts the queries answered by Tailscale's DNS resolver.
+type DNSMetrics struct {
+	Queries          int64 // all queries
+	Local            int64 // answered from the network map
+	CacheHits        int64 // answered from cached upstream responses
+	Forwarded        int64 // answered by upstream nameservers
+	UpstreamFailures int64 // to be forwarded, but no upstream answered
+
+	// Upstreams are the counts for each upstream nameserver,
+	// sorted by address.
+	Upstreams []UpstreamDNSMetrics `json:",omitempty"`
+}
+
+// UpstreamDNSMetrics counts the queries forwarded to one upstream
+// nameserver.
+type UpstreamDNSMetrics struct {
+	Addr        string
+	Queries     int64
+	Failures    int64         // queries that failed or timed out
+	MeanLatency time.Duration // of the queries that succeeded
+	MaxLatency  time.Duration
+}
+
+// ControlStatus describes the node's connection to the control server.
+type ControlStatus struct {
+	// Connected is whether a network map poll is in progress and
+	// has received at least one network map.
+	Connected bool
+
+	// LastSync is when the most recent network map was received,
+	// or the zero time if none has been.
+	LastSync time.Time
+
+	// LastErr is the error from the most recent failed request
+	// to the control server, if there has been a failure since
+	// the last success.
+	LastErr string `json:",omitempty"`
+
+	// LastErrTime is when LastErr happened.
+	LastErrTime time.Time
+
+	// Failures is the number of consecutive failed requests
+	// to the control server, which drives the retry backoff.
+	Failures int
+}
+
+// InterfaceStats is how much traffic Tailscale's sockets sent and
+// received while a network interface had the default route. It lets
+// users on metered connections see how much data Tailscale used on
+// which network (cellular or Wi-Fi, say).
+type InterfaceStats struct {
+	Interface string // network interface name, or "unknown"
+	Expensive bool   // interface was last reported as metered (e.g. LTE)
+
+	// UDP bytes, including STUN and path discovery.
+	TxBytes int64
+	RxBytes int64
+
+	// DERP packet payload bytes, not counting TLS and DERP framing.
+	DERPTxBytes int64
+	DERPRxBytes int64
+}
+
+// BackgroundStats counts the periodic work tailscaled does while the
+// network is otherwise idle. Each unit is a wakeup, so they're a proxy
+// for tailscaled's battery cost.
+type BackgroundStats struct {
+	Heartbeats   int64 // keepalive rounds for active peers' paths
+	DiscoPings   int64 // path discovery pings sent
+	STUNRounds   int64 // rounds of STUN probes to find this node's endpoints
+	IdleSessions int64 // times a peer went idle and its heartbeats stopped
 }
 
 func (s *Status) Peers() []key.Public {
@@ -43,17 +205,27 @@ type PeerStatus struct {
 	HostName  string // HostInfo's Hostname (not a DNS name or necessarily unique)
 	OS        string // HostInfo.OS
 	UserID    tailcfg.UserID
+	Tags      []string `json:",omitempty"` // ACL tags granted to the peer
 
 	TailAddr string // Tailscale IP
 
+	// SSHHostKeys are the peer's SSH host keys, in authorized_keys
+	// format, as reported to the control server.
+	SSHHostKeys []string `json:",omitempty"`
+
 	// Endpoints:
 	Addrs   []string
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
+	// PathMTU is the largest tun MTU that CurAddr was probed to
+	// carry, or 0 if unknown. Larger packets are sent via Relay.
+	PathMTU int `json:",omitempty"`
+
 	RxBytes       int64
 	TxBytes       int64
 	Created       time.Time // time registered with tailcontrol
+	KeyExpiry     time.Time // when the peer's key expires; zero if it doesn't
 	LastWrite     time.Time // time last packet sent
 	LastSeen      time.Time // last seen to tailcontrol
 	LastHandshake time.Time // with local wireguard
@@ -93,6 +265,209 @@ func (sb *StatusBuilder) Status() *Status {
 	return &sb.st
 }
 
+// SetControlStatus sets the status of the control server connection.
+func (sb *StatusBuilder) SetControlStatus(cs ControlStatus) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetControlStatus after Locked")
+		return
+	}
+	sb.st.Control = &cs
+}
+
+// SetBackendState records the backend's state and why it entered it.
+func (sb *StatusBuilder) SetBackendState(state, reason string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetBackendState after Locked")
+		return
+	}
+	sb.st.BackendState = state
+	sb.st.BackendStateReason = reason
+}
+
+// SetManagedPrefs sets the names of the prefs that are enforced by
+// the administrator's policy.
+func (sb *StatusBuilder) SetManagedPrefs(names []string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetManagedPrefs after Locked")
+		return
+	}
+	sb.st.ManagedPrefs = names
+}
+
+// SetNoLogs records that log uploads are disabled.
+func (sb *StatusBuilder) SetNoLogs() {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetNoLogs after Locked")
+		return
+	}
+	sb.st.NoLogs = true
+}
+
+// SetTags records the ACL tags granted to this node, and those it
+// requested but wasn't granted.
+func (sb *StatusBuilder) SetTags(granted, denied []string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetTags after Locked")
+		return
+	}
+	sb.st.Tags = granted
+	sb.st.DeniedTags = denied
+}
+
+// AddWarning adds a health warning.
+func (sb *StatusBuilder) AddWarning(s string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: AddWarning after Locked")
+		return
+	}
+	sb.st.Warnings = append(sb.st.Warnings, s)
+}
+
+// SetKeyExpiry records when this node's key expires.
+func (sb *StatusBuilder) SetKeyExpiry(t time.Time) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetKeyExpiry after Locked")
+		return
+	}
+	sb.st.KeyExpiry = t
+}
+
+// SetMetered records whether the current network is treated as metered.
+func (sb *StatusBuilder) SetMetered(v bool) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetMetered after Locked")
+		return
+	}
+	sb.st.Metered = v
+}
+
+// SetOnBattery records whether the machine is running on battery.
+func (sb *StatusBuilder) SetOnBattery(v bool) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetOnBattery after Locked")
+		return
+	}
+	sb.st.OnBattery = v
+}
+
+// SetPortMapping records the port mapping protocols found on the LAN.
+func (sb *StatusBuilder) SetPortMapping(v string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetPortMapping after Locked")
+		return
+	}
+	sb.st.PortMapping = v
+}
+
+// SetNoLANDiscovery records whether LAN discovery is disabled.
+func (sb *StatusBuilder) SetNoLANDiscovery(v bool) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetNoLANDiscovery after Locked")
+		return
+	}
+	sb.st.NoLANDiscovery = v
+}
+
+// SetBackgroundStats sets the counts of background work.
+func (sb *StatusBuilder) SetBackgroundStats(bs BackgroundStats) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetBackgroundStats after Locked")
+		return
+	}
+	sb.st.Background = bs
+}
+
+// SetTUN records the name of the Tailscale network interface.
+func (sb *StatusBuilder) SetTUN(name string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetTUN after Locked")
+		return
+	}
+	sb.st.TUN = name
+}
+
+// SetMagicDNS records the address of Tailscale's DNS resolver and the
+// zones it serves.
+func (sb *StatusBuilder) SetMagicDNS(addr string, zones []string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetMagicDNS after Locked")
+		return
+	}
+	sb.st.MagicDNS = &MagicDNSStatus{Addr: addr, Zones: zones}
+}
+
+// SetDNS records the DNS configuration applied to the system.
+func (sb *StatusBuilder) SetDNS(ds DNSStatus) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetDNS after Locked")
+		return
+	}
+	sb.st.DNS = &ds
+}
+
+// SetDNSPlan records the DNS configuration the node should have.
+func (sb *StatusBuilder) SetDNSPlan(dc DNSConfig) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetDNSPlan after Locked")
+		return
+	}
+	sb.st.DNSPlan = &dc
+}
+
+// SetDNSMetrics records the counts of DNS queries answered.
+func (sb *StatusBuilder) SetDNSMetrics(m DNSMetrics) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetDNSMetrics after Locked")
+		return
+	}
+	sb.st.DNSMetrics = &m
+}
+
+// AddInterfaceStats adds the traffic counts for one network interface.
+func (sb *StatusBuilder) AddInterfaceStats(is InterfaceStats) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: AddInterfaceStats after Locked")
+		return
+	}
+	sb.st.Interfaces = append(sb.st.Interfaces, is)
+}
+
 // AddUser adds a user profile to the status.
 func (sb *StatusBuilder) AddUser(id tailcfg.UserID, up tailcfg.UserProfile) {
 	sb.mu.Lock()
@@ -149,12 +524,21 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	if v := st.OS; v != "" {
 		e.OS = st.OS
 	}
+	if v := st.SSHHostKeys; v != nil {
+		e.SSHHostKeys = v
+	}
+	if v := st.Tags; v != nil {
+		e.Tags = v
+	}
 	if v := st.Addrs; v != nil {
 		e.Addrs = v
 	}
 	if v := st.CurAddr; v != "" {
 		e.CurAddr = v
 	}
+	if v := st.PathMTU; v != 0 {
+		e.PathMTU = v
+	}
 	if v := st.RxBytes; v != 0 {
 		e.RxBytes = v
 	}
@@ -170,6 +554,9 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	if v := st.LastSeen; !v.IsZero() {
 		e.LastSeen = v
 	}
+	if v := st.KeyExpiry; !v.IsZero() {
+		e.KeyExpiry = v
+	}
 	if v := st.LastWrite; !v.IsZero() {
 		e.LastWrite = v
 	}
@@ -187,6 +574,25 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	}
 }
 
+// String returns a one-line human-readable summary of cs.
+func (cs *ControlStatus) String() string {
+	var b strings.Builder
+	if cs.Connected {
+		b.WriteString("connected")
+	} else {
+		b.WriteString("not connected")
+	}
+	if cs.LastSync.IsZero() {
+		b.WriteString(", never synced")
+	} else {
+		fmt.Fprintf(&b, ", last sync %v ago", time.Since(cs.LastSync).Round(time.Second))
+	}
+	if cs.LastErr != "" {
+		fmt.Fprintf(&b, ", %d failures, last %v ago: %s", cs.Failures, time.Since(cs.LastErrTime).Round(time.Second), cs.LastErr)
+	}
+	return b.String()
+}
+
 type StatusUpdater interface {
 	UpdateStatus(*StatusBuilder)
 }
@@ -215,6 +621,46 @@ table tbody tr:nth-child(even) td { background-color: #f5f5f5; }
 <h1>Tailscale State</h1>
 `)
 
+	if cs := st.Control; cs != nil {
+		f("<p><b>control:</b> %s</p>\n", html.EscapeString(cs.String()))
+	}
+	for _, w := range st.Warnings {
+		f("<p><b>warning:</b> %s</p>\n", html.EscapeString(w))
+	}
+	if len(st.ManagedPrefs) > 0 {
+		f("<p><b>managed by your organization:</b> %s</p>\n", html.EscapeString(strings.Join(st.ManagedPrefs, ", ")))
+	}
+	if st.NoLogs {
+		f("<p><b>no-logs-no-support:</b> log uploads are disabled; Tailscale support can't debug this node</p>\n")
+	}
+	if !st.KeyExpiry.IsZero() {
+		f("<p><b>key expires:</b> %s</p>\n", st.KeyExpiry.Format(time.RFC3339))
+	}
+	if len(st.Tags) > 0 {
+		f("<p><b>tags:</b> %s</p>\n", html.EscapeString(strings.Join(st.Tags, ", ")))
+	}
+	if len(st.DeniedTags) > 0 {
+		f("<p><b>tags not granted:</b> %s</p>\n", html.EscapeString(strings.Join(st.DeniedTags, ", ")))
+	}
+
+	if st.Metered {
+		f("<p><b>metered network:</b> background traffic reduced</p>\n")
+	}
+	if st.OnBattery {
+		f("<p><b>on battery:</b> background pings reduced</p>\n")
+	}
+	bg := st.Background
+	f("<p><b>background work:</b> %d heartbeats, %d disco pings, %d STUN rounds, %d idle sessions ended</p>\n",
+		bg.Heartbeats, bg.DiscoPings, bg.STUNRounds, bg.IdleSessions)
+	for _, is := range st.Interfaces {
+		var metered string
+		if is.Expensive {
+			metered = " (metered)"
+		}
+		f("<p><b>traffic via %s%s:</b> %d bytes sent, %d received; DERP %d sent, %d received</p>\n",
+			html.EscapeString(is.Interface), metered, is.TxBytes, is.RxBytes, is.DERPTxBytes, is.DERPRxBytes)
+	}
+
 	//f("<p><b>logid:</b> %s</p>\n", logid)
 	//f("<p><b>opts:</b> <code>%s</code></p>\n", html.EscapeString(fmt.Sprintf("%+v", opts)))
 
@@ -8,6 +8,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -17,11 +19,17 @@ import (
 	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/policy"
+	"tailscale.com/net/dnsmasq"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/portlist"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/empty"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/cloudinfo"
+	"tailscale.com/util/lsm"
+	"tailscale.com/util/syspolicy"
 	"tailscale.com/version"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
@@ -50,6 +58,16 @@ type LocalBackend struct {
 	backendLogID    string
 	portpoll        *portlist.Poller // may be nil
 	newDecompressor func() (controlclient.Decompressor, error)
+	unlockPath      string              // see SetLockdownUnlockPath
+	noLogs          bool                // see SetNoLogs
+	warnings        []string            // see SetWarnings
+	dhcpDNS         *dnsmasq.Advertiser // see SetDHCPDNS; may be nil
+	expiryWarner    *expiryWarner       // see SetKeyExpiryWarnings
+	scheduler       *scheduler          // applies Prefs.Schedule
+	editMu          sync.Mutex          // held by each writer of prefs from reading them to writing them
+	eventHook       func(Event)         // see SetEventHook; may be nil
+	dnsRecordsPath  string              // see SetDNSRecordsPath
+	declarative     *Prefs              // see SetDeclarativePrefs; nil unless in declarative mode
 
 	// TODO: these fields are accessed unsafely by concurrent
 	// goroutines. They need to be protected.
@@ -62,16 +80,31 @@ type LocalBackend struct {
 	c        *controlclient.Client
 	stateKey StateKey
 	prefs    *Prefs
-	state    State
+	// prefSources maps the names of prefs to where their
+	// values came from. It's replaced, never mutated.
+	prefSources map[string]PrefSource
+	state       State
+	// stateReason is why the backend entered state.
+	stateReason StateReason
 	// hostinfo is mutated in-place while mu is held.
 	hostinfo *tailcfg.Hostinfo
 	// netMap is not mutated in-place once set.
 	netMap       *controlclient.NetworkMap
 	engineStatus EngineStatus
+	sysPolicy    *syspolicy.Policy  // nil if the administrator set none
+	cloudInfo    *tailcfg.CloudInfo // nil until fetched, or if not in a cloud
+	fetchedCloud bool               // whether a cloud info fetch was started
+	deniedTags   []string           // requested tags control didn't grant, as last logged
+	lanSubnets   []netaddr.IPPrefix // local subnets, as last seen by setNetInfo
 	endpoints    []string
 	blocked      bool
 	authURL      string
 	interact     int
+	// serverKeyChange describes the last change of the control
+	// server's key from the pinned one, or is empty if there was
+	// none. It's kept across control clients, as each new one
+	// trusts the key the last one pinned.
+	serverKeyChange string
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -107,6 +140,8 @@ func NewLocalBackend(logf logger.Logf, logid string, store StateStore, e wgengin
 		portpoll:     portpoll,
 	}
 	b.statusChanged = sync.NewCond(&b.statusLock)
+	b.SetKeyExpiryWarnings(DefaultKeyExpiryWarnings, nil)
+	b.scheduler = newScheduler(b.logf, b.applySchedule)
 
 	return b, nil
 }
@@ -121,6 +156,9 @@ func (b *LocalBackend) Shutdown() {
 	if cli != nil {
 		cli.Shutdown()
 	}
+	b.setDHCPDNS(false)
+	b.expiryWarner.stop()
+	b.scheduler.stop()
 	b.ctxCancel()
 	b.e.Close()
 	b.e.Wait()
@@ -141,6 +179,40 @@ func (b *LocalBackend) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	if b.c != nil {
+		sb.SetControlStatus(b.c.ControlStatus())
+	}
+	sb.SetBackendState(b.state.String(), string(b.stateReason))
+	sb.SetManagedPrefs(b.sysPolicy.Managed())
+	if b.noLogs {
+		sb.SetNoLogs()
+	}
+	for _, w := range b.warnings {
+		sb.AddWarning(w)
+	}
+	if b.serverKeyChange != "" {
+		sb.AddWarning(b.serverKeyChange)
+	}
+	for _, d := range lsm.Denials() {
+		sb.AddWarning(d.String())
+	}
+	if b.netMap != nil {
+		sb.SetKeyExpiry(b.netMap.Expiry)
+		if w, ok := clockSkewWarning(b.netMap.ClockSkew); ok {
+			sb.AddWarning(w)
+		}
+	}
+	if b.netMap != nil && b.prefs != nil {
+		sb.SetTags(b.netMap.Tags, deniedTags(b.prefs.AdvertiseTags, b.netMap))
+		if b.prefs.CorpDNS {
+			sb.SetMagicDNS(magicDNSIP.String(), magicDNSZones(b.dnsConfig(b.netMap)))
+		}
+		_, rcfg, _, err := b.engineConfig(logger.Discard, b.netMap, b.prefs, engineFlags(b.prefs))
+		if err == nil {
+			sb.SetDNSPlan(dnsPlan(rcfg))
+		}
+	}
+
 	// TODO: hostinfo, and its networkinfo
 	// TODO: EngineStatus copy (and deprecate it?)
 	if b.netMap != nil {
@@ -162,6 +234,9 @@ func (b *LocalBackend) UpdateStatus(sb *ipnstate.StatusBuilder) {
 				TailAddr:     tailAddr,
 				HostName:     p.Hostinfo.Hostname,
 				OS:           p.Hostinfo.OS,
+				SSHHostKeys:  p.Hostinfo.SSHHostKeys,
+				Tags:         p.Tags,
+				KeyExpiry:    p.KeyExpiry,
 				KeepAlive:    p.KeepAlive,
 				Created:      p.Created,
 				LastSeen:     lastSeen,
@@ -181,9 +256,204 @@ func (b *LocalBackend) SetDecompressor(fn func() (controlclient.Decompressor, er
 	b.newDecompressor = fn
 }
 
+// SetLockdownUnlockPath sets the path of the file whose existence
+// allows frontends to turn off Prefs.Lockdown. The file is the
+// administrator's way of unlocking the node, so it must only be
+// writable by them. If path is empty, lockdown can't be turned off
+// once on.
+//
+// It must be called before Start.
+func (b *LocalBackend) SetLockdownUnlockPath(path string) {
+	b.unlockPath = path
+}
+
+// ErrManagedDeclaratively is the error frontends get for trying to
+// change the prefs of a backend in declarative mode.
+var ErrManagedDeclaratively = errors.New("prefs are managed declaratively, by tailscaled's --config file; change them there")
+
+// SetDeclarativePrefs puts the backend in declarative mode, for
+// systems like NixOS that configure everything from files. Its prefs
+// are then p, as from a config file, rather than those in its saved
+// state, and frontends can't change them. The state holds only the
+// node key (Prefs.Persist), so that's all the backend writes.
+//
+// It must be called before Start.
+func (b *LocalBackend) SetDeclarativePrefs(p *Prefs) {
+	b.declarative = p.Clone()
+	b.declarative.Persist = nil
+}
+
+// SetDNSRecordsPath sets the path of a file of extra DNS records
+// for MagicDNS to serve, as a JSON array of tailcfg.DNSRecord, in
+// addition to those from the control server. They take precedence
+// over control's records with the same names. The file is read each
+// time the DNS configuration is applied; it's fine for it not to
+// exist.
+//
+// It must be called before Start.
+func (b *LocalBackend) SetDNSRecordsPath(path string) {
+	b.dnsRecordsPath = path
+}
+
+// dnsConfig returns the DNS configuration of nm, with the extra
+// records from the file set by SetDNSRecordsPath added.
+func (b *LocalBackend) dnsConfig(nm *controlclient.NetworkMap) tailcfg.DNSConfig {
+	dc := nm.DNS
+	if b.dnsRecordsPath == "" {
+		return dc
+	}
+	recs, err := readDNSRecords(b.dnsRecordsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			b.logf("dns: %v", err)
+		}
+		return dc
+	}
+	dc.ExtraRecords = append(dc.ExtraRecords[:len(dc.ExtraRecords):len(dc.ExtraRecords)], recs...)
+	return dc
+}
+
+// SetNoLogs records that log uploads are disabled, so Status can
+// show it.
+//
+// It must be called before Start.
+func (b *LocalBackend) SetNoLogs() {
+	b.noLogs = true
+}
+
+// SetWarnings sets health warnings about the environment the backend
+// runs in, which Status shows along with its own.
+//
+// It must be called before Start.
+func (b *LocalBackend) SetWarnings(warnings []string) {
+	b.warnings = warnings
+}
+
+// SetKeyExpiryWarnings sets how long before the node key expires to
+// warn about it: each time less than one of warnings is left, the
+// backend logs it, sends frontends a Notify with KeyExpiryWarning
+// set, and calls hook (if non-nil) with the expiry time.
+// DefaultKeyExpiryWarnings are used until it's called.
+//
+// It must be called before Start.
+func (b *LocalBackend) SetKeyExpiryWarnings(warnings []time.Duration, hook func(expiry time.Time)) {
+	b.expiryWarner = newExpiryWarner(b.logf, warnings, func(expiry time.Time) {
+		b.send(Notify{KeyExpiryWarning: &expiry})
+		b.sendEvent(Event{Type: EventKeyExpiry, KeyExpiry: &expiry})
+		if hook != nil {
+			hook(expiry)
+		}
+	})
+}
+
+// SetEventHook sets a function called with each Event, such as to
+// run scripts or call webhooks. It's called synchronously and must
+// not block.
+//
+// It must be called before Start.
+func (b *LocalBackend) SetEventHook(hook func(Event)) {
+	b.eventHook = hook
+}
+
+// sendEvent passes e to the event hook, if any.
+func (b *LocalBackend) sendEvent(e Event) {
+	if b.eventHook == nil {
+		return
+	}
+	e.Time = time.Now()
+	b.eventHook(e)
+}
+
+// SetDHCPDNS sets the DHCP server configuration through which
+// MagicDNS is offered to LAN clients while it's on.
+//
+// It must be called before Start.
+func (b *LocalBackend) SetDHCPDNS(a *dnsmasq.Advertiser) {
+	b.dhcpDNS = a
+}
+
+// setDHCPDNS offers MagicDNS to LAN clients if on, or withdraws it.
+func (b *LocalBackend) setDHCPDNS(on bool) {
+	if b.dhcpDNS == nil {
+		return
+	}
+	var ip netaddr.IP
+	if on {
+		ip = magicDNSIP
+	}
+	if err := b.dhcpDNS.Set(ip); err != nil {
+		b.logf("dhcp dns: %v", err)
+	}
+}
+
+// readSysPolicyLocked rereads the administrator's policy, which
+// overrides prefs set by frontends.
+//
+// b.mu must be held.
+func (b *LocalBackend) readSysPolicyLocked() {
+	pol, err := syspolicy.Read()
+	if err != nil {
+		// Keep the previous policy. A broken policy store
+		// shouldn't hand control back to the user.
+		b.logf("syspolicy: %v", err)
+		return
+	}
+	if managed := pol.Managed(); len(managed) > 0 {
+		b.logf("syspolicy: prefs managed by the administrator: %v", managed)
+	}
+	b.sysPolicy = pol
+}
+
+// sysPolicySources returns sources updated for the prefs managed by
+// b.sysPolicy. Prefs that were managed by an earlier policy but no
+// longer are, and so kept their value, are attributed to src.
+//
+// b.mu must be held.
+func (b *LocalBackend) sysPolicySources(sources map[string]PrefSource, src PrefSource) map[string]PrefSource {
+	ret := make(map[string]PrefSource, len(sources))
+	for name, s := range sources {
+		if s == PrefFromPolicy {
+			s = src
+		}
+		ret[name] = s
+	}
+	for _, name := range b.sysPolicy.Managed() {
+		ret[name] = PrefFromPolicy
+	}
+	return ret
+}
+
+// lockdownUnlocked reports whether an administrator has allowed
+// lockdown to be turned off.
+func (b *LocalBackend) lockdownUnlocked() bool {
+	if b.unlockPath == "" {
+		return false
+	}
+	_, err := os.Stat(b.unlockPath)
+	return err == nil
+}
+
+// errLockdown is the error for trying to turn lockdown off before an
+// administrator has unlocked it.
+var errLockdown = errors.New("lockdown can only be turned off by an administrator")
+
+// keepLockdown turns lockdown back on in new, replacing old, unless an
+// administrator has unlocked it. who is logged with the reason.
+func (b *LocalBackend) keepLockdown(who string, old, new *Prefs) {
+	if old != nil && old.Lockdown && !new.Lockdown && !b.lockdownUnlocked() {
+		b.logf("%s: %v; keeping it on", who, errLockdown)
+		new.Lockdown = true
+	}
+}
+
 // setClientStatus is the callback invoked by the control client whenever it posts a new status.
 // Among other things, this is where we update the netmap, packet filters, DNS and DERP maps.
 func (b *LocalBackend) setClientStatus(st controlclient.Status) {
+	if st.ServerKeyChange != "" {
+		b.mu.Lock()
+		b.serverKeyChange = st.ServerKeyChange
+		b.mu.Unlock()
+	}
 	if st.LoginFinished != nil {
 		// Auth completed, unblock the engine
 		b.blockEngineUpdates(false)
@@ -193,6 +463,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	if st.Persist != nil {
 		persist := *st.Persist // copy
 
+		b.editMu.Lock()
 		b.mu.Lock()
 		b.prefs.Persist = &persist
 		prefs := b.prefs.Clone()
@@ -200,10 +471,11 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		b.mu.Unlock()
 
 		if stateKey != "" {
-			if err := b.store.WriteState(stateKey, prefs.ToBytes()); err != nil {
+			if err := b.store.WriteState(stateKey, b.stateBytes(prefs)); err != nil {
 				b.logf("Failed to save new controlclient state: %v", err)
 			}
 		}
+		b.editMu.Unlock()
 		b.send(Notify{Prefs: prefs})
 	}
 	if st.NetMap != nil {
@@ -220,9 +492,27 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 			}
 		}
 		disableDERP := b.prefs != nil && b.prefs.DisableDERP
+		var denied []string
+		if b.prefs != nil {
+			denied = deniedTags(b.prefs.AdvertiseTags, st.NetMap)
+		}
+		deniedChanged := !compareStrings(denied, b.deniedTags)
+		b.deniedTags = denied
+		oldNetMap := b.netMap
 		b.netMap = st.NetMap
 		b.mu.Unlock()
 
+		if oldNetMap != nil && changed {
+			for _, p := range addedPeers(oldNetMap, st.NetMap) {
+				b.sendEvent(Event{Type: EventPeerAdded, Peer: eventPeer(p)})
+			}
+		}
+
+		b.expiryWarner.setExpiry(st.NetMap.Expiry)
+		if deniedChanged && len(denied) > 0 {
+			b.logf("control didn't grant requested tags: %v", denied)
+		}
+
 		b.send(Notify{NetMap: st.NetMap})
 		// There is nothing to update if the map hasn't changed.
 		if changed {
@@ -254,14 +544,16 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		return
 	}
 	if st.NetMap != nil {
+		b.editMu.Lock()
 		b.mu.Lock()
+		prefs := b.prefs.Clone()
 		if b.state == NeedsLogin {
-			b.prefs.WantRunning = true
+			prefs.WantRunning = true
 		}
-		prefs := b.prefs
 		b.mu.Unlock()
 
-		b.SetPrefs(prefs)
+		b.setPrefs(prefs, PrefFromFrontend)
+		b.editMu.Unlock()
 	}
 	b.stateMachine()
 }
@@ -312,6 +604,17 @@ func (b *LocalBackend) Start(opts Options) error {
 	if opts.Prefs == nil && opts.StateKey == "" {
 		return errors.New("no state key or prefs provided")
 	}
+	if opts.Prefs != nil && b.declarative != nil {
+		// Reported as a message rather than an error, which would
+		// just get the frontend's connection closed. The frontend
+		// isn't b.notify yet, so tell it directly.
+		msg := fmt.Sprintf("Start: %v", ErrManagedDeclaratively)
+		b.logf("%s", msg)
+		if opts.Notify != nil {
+			opts.Notify(Notify{Version: version.LONG, ErrMessage: &msg})
+		}
+		return nil
+	}
 
 	if opts.Prefs != nil {
 		b.logf("Start: %v", opts.Prefs.Pretty())
@@ -323,6 +626,7 @@ func (b *LocalBackend) Start(opts Options) error {
 	hostinfo.BackendLogID = b.backendLogID
 	hostinfo.FrontendLogID = opts.FrontendLogID
 
+	b.editMu.Lock()
 	b.mu.Lock()
 
 	if b.c != nil {
@@ -342,21 +646,47 @@ func (b *LocalBackend) Start(opts Options) error {
 	}
 	b.hostinfo = hostinfo
 	b.state = NoState
+	b.stateReason = ReasonStart
 
 	if err := b.loadStateLocked(opts.StateKey, opts.Prefs, opts.LegacyConfigPath); err != nil {
 		b.mu.Unlock()
+		b.editMu.Unlock()
 		return fmt.Errorf("loading requested state: %v", err)
 	}
+	if b.declarative != nil {
+		prefs := b.declarative.Clone()
+		prefs.Persist = b.prefs.Persist
+		b.prefs = prefs
+		b.prefSources = prefSources(nil, NewPrefs(), prefs, PrefFromConfig)
+	}
+	b.readSysPolicyLocked()
+	b.prefs.applySysPolicy(b.sysPolicy)
+	b.prefSources = b.sysPolicySources(b.prefSources, PrefFromState)
 
 	b.serverURL = b.prefs.ControlURL
 	hostinfo.RoutableIPs = append(hostinfo.RoutableIPs, b.prefs.AdvertiseRoutes...)
 	hostinfo.RequestTags = append(hostinfo.RequestTags, b.prefs.AdvertiseTags...)
+	if b.prefs.CloudInfo {
+		hostinfo.Cloud = b.cloudInfo
+	}
+	fetchCloud := b.prefs.CloudInfo && !b.fetchedCloud
+	if fetchCloud {
+		b.fetchedCloud = true
+	}
 
 	b.notify = opts.Notify
 	b.netMap = nil
 	persist := b.prefs.Persist
+	metered := b.prefs.Metered
+	noPortMapping, noLANDiscovery := b.prefs.NoPortMapping, b.prefs.NoLANDiscovery
+	schedule := b.prefs.Schedule
+	strictControlKey := b.prefs.StrictControlKey
 	b.mu.Unlock()
+	b.editMu.Unlock()
 
+	b.e.SetMeteredOverride(metered)
+	b.e.SetLANPrivacy(noPortMapping, noLANDiscovery)
+	b.scheduler.set(schedule)
 	b.updateFilter(nil)
 
 	var discoPublic tailcfg.DiscoKey
@@ -379,6 +709,8 @@ func (b *LocalBackend) Start(opts Options) error {
 		NewDecompressor: b.newDecompressor,
 		HTTPTestClient:  opts.HTTPTestClient,
 		DiscoPublicKey:  discoPublic,
+		NoLogs:          b.noLogs,
+		StrictServerKey: strictControlKey,
 	})
 	if err != nil {
 		return err
@@ -390,6 +722,9 @@ func (b *LocalBackend) Start(opts Options) error {
 		go b.portpoll.Run(b.ctx)
 		go b.readPoller()
 	}
+	if fetchCloud {
+		go b.fetchCloudInfo()
+	}
 
 	b.mu.Lock()
 	b.c = cli
@@ -467,10 +802,10 @@ func (b *LocalBackend) updateDNSMap(netMap *controlclient.NetworkMap) {
 		// Like PeerStatus.SimpleHostName()
 		domain = strings.TrimSuffix(domain, ".local")
 		domain = strings.TrimSuffix(domain, ".localdomain")
-		domain = domain + ".tailscale.us"
+		domain = domain + "." + magicDNSDomain
 		domainToIP[domain] = netaddr.IPFrom16(peer.Addresses[0].IP.Addr)
 	}
-	b.e.SetDNSMap(tsdns.NewMap(domainToIP))
+	b.e.SetDNSMap(tsdns.NewMapWithRecords(domainToIP, dnsRecords(b.logf, b.dnsConfig(netMap).ExtraRecords)))
 }
 
 // readPoller is a goroutine that receives service lists from
@@ -505,6 +840,29 @@ func (b *LocalBackend) readPoller() {
 	}
 }
 
+// fetchCloudInfo looks up the identity of the cloud instance we run
+// on, and adds it to the Hostinfo sent to control if the prefs say
+// to.
+func (b *LocalBackend) fetchCloudInfo() {
+	ci := cloudinfo.Get(b.ctx)
+	if ci == nil {
+		return
+	}
+	b.logf("cloud instance: %s %s %s", ci.Provider, ci.Region, ci.InstanceType)
+
+	b.mu.Lock()
+	b.cloudInfo = ci
+	if b.prefs == nil || !b.prefs.CloudInfo || b.hostinfo == nil {
+		b.mu.Unlock()
+		return
+	}
+	b.hostinfo.Cloud = ci
+	hi := b.hostinfo
+	b.mu.Unlock()
+
+	b.doSetHostinfoFilterServices(hi)
+}
+
 // send delivers n to the connected frontend. If no frontend is
 // connected, the notification is dropped without being delivered.
 func (b *LocalBackend) send(n Notify) {
@@ -533,7 +891,7 @@ func (b *LocalBackend) popBrowserAuthNow() {
 	b.stopEngineAndWait()
 	b.send(Notify{BrowseToURL: &url})
 	if b.State() == Running {
-		b.enterState(Starting)
+		b.enterState(Starting, ReasonReauth)
 	}
 }
 
@@ -548,7 +906,10 @@ func (b *LocalBackend) loadStateLocked(key StateKey, prefs *Prefs, legacyPath st
 	if key == "" {
 		// Frontend fully owns the state, we just need to obey it.
 		b.logf("Using frontend prefs")
-		b.prefs = prefs.Clone()
+		prefs = prefs.Clone()
+		b.keepLockdown("Start", b.prefs, prefs)
+		b.prefs = prefs
+		b.prefSources = prefSources(nil, NewPrefs(), b.prefs, PrefFromFrontend)
 		b.stateKey = ""
 		return nil
 	}
@@ -557,15 +918,27 @@ func (b *LocalBackend) loadStateLocked(key StateKey, prefs *Prefs, legacyPath st
 		// Backend owns the state, but frontend is trying to migrate
 		// state into the backend.
 		b.logf("Importing frontend prefs into backend store")
+		prefs = prefs.Clone()
+		if bs, err := b.store.ReadState(key); err == nil {
+			if old, err := PrefsFromBytes(bs, false); err == nil {
+				b.keepLockdown("Start", old, prefs)
+			}
+		}
 		if err := b.store.WriteState(key, prefs.ToBytes()); err != nil {
 			return fmt.Errorf("store.WriteState: %v", err)
 		}
 	}
 
 	b.logf("Using backend prefs")
+	src := PrefFromState
+	if prefs != nil {
+		src = PrefFromFrontend
+	}
 	bs, err := b.store.ReadState(key)
 	if err != nil {
 		if errors.Is(err, ErrStateNotExist) {
+			// New state has only defaults, which prefSources
+			// attributes as such, unless relaynode's are imported.
 			if legacyPath != "" {
 				b.prefs, err = LoadPrefs(legacyPath, true)
 				if err != nil {
@@ -573,11 +946,13 @@ func (b *LocalBackend) loadStateLocked(key StateKey, prefs *Prefs, legacyPath st
 					b.prefs = NewPrefs()
 				} else {
 					b.logf("Imported state from relaynode for %q", key)
+					src = PrefFromLegacy
 				}
 			} else {
 				b.prefs = NewPrefs()
 				b.logf("Created empty state for %q", key)
 			}
+			b.prefSources = prefSources(nil, NewPrefs(), b.prefs, src)
 			b.stateKey = key
 			return nil
 		}
@@ -587,6 +962,7 @@ func (b *LocalBackend) loadStateLocked(key StateKey, prefs *Prefs, legacyPath st
 	if err != nil {
 		return fmt.Errorf("PrefsFromBytes: %v", err)
 	}
+	b.prefSources = prefSources(nil, NewPrefs(), b.prefs, src)
 	b.stateKey = key
 	return nil
 }
@@ -614,6 +990,10 @@ func (b *LocalBackend) getEngineStatus() EngineStatus {
 // in progress, in which case StartLoginInteractive attempts to pick
 // up the in-progress flow where it left off.
 func (b *LocalBackend) StartLoginInteractive() {
+	if b.declarative != nil {
+		b.rejectDeclarative("StartLoginInteractive")
+		return
+	}
 	b.mu.Lock()
 	b.assertClientLocked()
 	b.interact++
@@ -648,6 +1028,7 @@ func (b *LocalBackend) FakeExpireAfter(x time.Duration) {
 		mapCopy.Expiry = time.Now().Add(x)
 	}
 	b.netMap = &mapCopy
+	b.expiryWarner.setExpiry(mapCopy.Expiry)
 	b.send(Notify{NetMap: b.netMap})
 }
 
@@ -692,6 +1073,19 @@ func (b *LocalBackend) shieldsAreUp() bool {
 // SetPrefs saves new user preferences and propagates them throughout
 // the system. Implements Backend.
 func (b *LocalBackend) SetPrefs(new *Prefs) {
+	if b.declarative != nil {
+		b.rejectDeclarative("SetPrefs")
+		return
+	}
+	b.editMu.Lock()
+	defer b.editMu.Unlock()
+	b.setPrefs(new, PrefFromFrontend)
+}
+
+// setPrefs is SetPrefs, attributing changed prefs to src.
+//
+// b.editMu must be held.
+func (b *LocalBackend) setPrefs(new *Prefs, src PrefSource) {
 	if new == nil {
 		panic("SetPrefs got nil prefs")
 	}
@@ -699,27 +1093,59 @@ func (b *LocalBackend) SetPrefs(new *Prefs) {
 	b.mu.Lock()
 	old := b.prefs
 	new.Persist = old.Persist // caller isn't allowed to override this
+	b.keepLockdown("SetPrefs", old, new)
+	b.readSysPolicyLocked()
+	b.prefSources = b.sysPolicySources(prefSources(b.prefSources, old, new, src), src)
+	new.applySysPolicy(b.sysPolicy)
 	b.prefs = new
 	if b.stateKey != "" {
-		if err := b.store.WriteState(b.stateKey, b.prefs.ToBytes()); err != nil {
+		if err := b.store.WriteState(b.stateKey, b.stateBytes(b.prefs)); err != nil {
 			b.logf("Failed to save new controlclient state: %v", err)
 		}
 	}
 	oldHi := b.hostinfo
 	newHi := oldHi.Clone()
 	newHi.RoutableIPs = append([]wgcfg.CIDR(nil), b.prefs.AdvertiseRoutes...)
+	// Changing the requested tags doesn't need a new login; control
+	// grants or denies them when it gets the new Hostinfo.
+	newHi.RequestTags = append([]string(nil), b.prefs.AdvertiseTags...)
 	if h := new.Hostname; h != "" {
 		newHi.Hostname = h
 	}
+	if new.CloudInfo {
+		newHi.Cloud = b.cloudInfo
+	} else {
+		newHi.Cloud = nil
+	}
+	fetchCloud := new.CloudInfo && !b.fetchedCloud
+	if fetchCloud {
+		b.fetchedCloud = true
+	}
 	b.hostinfo = newHi
+	c := b.c
 	b.mu.Unlock()
 
+	if fetchCloud {
+		go b.fetchCloudInfo()
+	}
+	if c != nil && old.StrictControlKey != new.StrictControlKey {
+		c.SetStrictServerKey(new.StrictControlKey)
+	}
+	b.scheduler.set(new.Schedule)
+
 	b.logf("SetPrefs: %v", new.Pretty())
 
 	if old.ShieldsUp != new.ShieldsUp || !oldHi.Equal(newHi) {
 		b.doSetHostinfoFilterServices(newHi)
 	}
 
+	if old.Metered != new.Metered {
+		b.e.SetMeteredOverride(new.Metered)
+	}
+	if old.NoPortMapping != new.NoPortMapping || old.NoLANDiscovery != new.NoLANDiscovery {
+		b.e.SetLANPrivacy(new.NoPortMapping, new.NoLANDiscovery)
+	}
+
 	b.updateFilter(b.netMap)
 	// TODO(dmytro): when Prefs gain an EnableTailscaleDNS toggle, updateDNSMap here.
 
@@ -740,6 +1166,80 @@ func (b *LocalBackend) SetPrefs(new *Prefs) {
 	b.send(Notify{Prefs: new})
 }
 
+// EditPrefs implements Backend.
+func (b *LocalBackend) EditPrefs(mp *MaskedPrefs) {
+	if b.declarative != nil {
+		b.rejectDeclarative("EditPrefs")
+		return
+	}
+	b.editMu.Lock()
+	defer b.editMu.Unlock()
+
+	b.mu.Lock()
+	old := b.prefs
+	b.mu.Unlock()
+	if old == nil {
+		msg := "EditPrefs: no prefs to edit; the backend hasn't started"
+		b.logf("%s", msg)
+		b.send(Notify{ErrMessage: &msg})
+		return
+	}
+	new := old.Clone()
+	err := new.ApplyEdits(mp)
+	if err == nil && old.Lockdown && !new.Lockdown && !b.lockdownUnlocked() {
+		// Unlike "tailscale up", which resets every pref, this
+		// asked to turn lockdown off, so say it can't.
+		err = errLockdown
+	}
+	if err != nil {
+		msg := fmt.Sprintf("EditPrefs: %v", err)
+		b.logf("%s", msg)
+		b.send(Notify{ErrMessage: &msg})
+		return
+	}
+	b.setPrefs(new, PrefFromFrontend)
+}
+
+// rejectDeclarative tells the frontend that op, a change of prefs or
+// of the logged-in node, isn't allowed in declarative mode.
+func (b *LocalBackend) rejectDeclarative(op string) {
+	msg := fmt.Sprintf("%s: %v", op, ErrManagedDeclaratively)
+	b.logf("%s", msg)
+	b.send(Notify{ErrMessage: &msg})
+}
+
+// stateBytes returns the state to save for prefs: all of prefs,
+// except in declarative mode, where the prefs come from the config
+// and only the node key is saved.
+func (b *LocalBackend) stateBytes(prefs *Prefs) []byte {
+	if b.declarative != nil {
+		return (&Prefs{Persist: prefs.Persist}).ToBytes()
+	}
+	return prefs.ToBytes()
+}
+
+// applySchedule changes prefs as actions, the actions of the
+// Prefs.Schedule entries now due, say.
+func (b *LocalBackend) applySchedule(actions []string) {
+	b.editMu.Lock()
+	defer b.editMu.Unlock()
+
+	b.mu.Lock()
+	old := b.prefs
+	b.mu.Unlock()
+	if old == nil {
+		return
+	}
+	new := old.Clone()
+	for _, a := range actions {
+		scheduleActions[a](new)
+	}
+	if new.Equals(old) {
+		return
+	}
+	b.setPrefs(new, PrefFromSchedule)
+}
+
 // doSetHostinfoFilterServices calls SetHostinfo on the controlclient,
 // possibly after mangling the given hostinfo.
 //
@@ -802,9 +1302,30 @@ func (b *LocalBackend) authReconfig() {
 	}
 	if !uc.WantRunning {
 		b.logf("authReconfig: skipping because !WantRunning.")
+		b.setDHCPDNS(false)
+		return
+	}
+
+	uflags := engineFlags(uc)
+	cfg, rcfg, upstreams, err := b.engineConfig(b.logf, nm, uc, uflags)
+	if err != nil {
+		b.logf("wgcfg: %v", err)
+		return
+	}
+	b.e.SetDNSUpstreams(upstreams)
+	err = b.e.Reconfig(cfg, rcfg)
+	// LAN clients can only use MagicDNS if it has upstreams to
+	// forward their other queries to.
+	b.setDHCPDNS((err == nil || err == wgengine.ErrNoChanges) && uc.CorpDNS && len(upstreams.Nameservers) > 0)
+	if err == wgengine.ErrNoChanges {
 		return
 	}
+	b.logf("authReconfig: ra=%v dns=%v 0x%02x: %v", uc.RouteAll, uc.CorpDNS, uflags, err)
+}
 
+// engineFlags returns the flags for converting the network map to a
+// wgcfg.Config under prefs uc.
+func engineFlags(uc *Prefs) int {
 	uflags := controlclient.UDefault
 	if uc.RouteAll {
 		uflags |= controlclient.UAllowDefaultRoute
@@ -820,24 +1341,81 @@ func (b *LocalBackend) authReconfig() {
 	if uc.AllowSingleHosts {
 		uflags |= controlclient.UAllowSingleHosts
 	}
-
-	dns := nm.DNS
-	dom := nm.DNSDomains
-	if !uc.CorpDNS {
-		dns = []wgcfg.IP{}
-		dom = []string{}
+	if uc.SiteToSite {
+		uflags |= controlclient.UAllowSubnetRoutes
 	}
-	cfg, err := nm.WGCfg(b.logf, uflags, dns)
+	return uflags
+}
+
+// engineConfig returns the engine and router configuration, and the
+// DNS resolver's upstreams, that nm and prefs uc call for.
+func (b *LocalBackend) engineConfig(logf logger.Logf, nm *controlclient.NetworkMap, uc *Prefs, uflags int) (cfg *wgcfg.Config, rcfg *router.Config, upstreams tsdns.Upstreams, err error) {
+	cfg, err = nm.WGCfg(logf, uflags, nil)
 	if err != nil {
-		b.logf("wgcfg: %v", err)
-		return
+		return nil, nil, upstreams, err
+	}
+	exitNode := hasExitNode(cfg)
+
+	dom := []string{}
+	var osDNS []netaddr.IP
+	dc := b.dnsConfig(nm)
+	if uc.CorpDNS {
+		osDNS, upstreams = dnsConfigs(logf, dc)
+		if exitNode && !uc.NoExitNodeDNS {
+			osDNS, upstreams = exitNodeDNS(upstreams)
+		} else if len(upstreams.Nameservers) == 0 && (len(upstreams.Routes) > 0 || dc.Proxied || len(dc.ExtraRecords) > 0) {
+			if f, err := os.Open(resolvConfPath); err == nil {
+				upstreams.Nameservers = systemNameservers(f)
+				f.Close()
+			}
+		}
+		for _, ip := range osDNS {
+			cfg.DNS = append(cfg.DNS, wgcfg.IP{Addr: ip.As16()})
+		}
+		dom = dc.Domains
+		if dc.Proxied {
+			// Searching magicDNSDomain is what makes peers'
+			// short names resolve on most systems.
+			dom = append(dom[:len(dom):len(dom)], magicDNSDomain)
+		}
 	}
 
-	err = b.e.Reconfig(cfg, routerConfig(cfg, uc, dom))
-	if err == wgengine.ErrNoChanges {
-		return
+	rcfg = routerConfig(cfg, uc, dom)
+	rcfg.DNSRoutes, rcfg.DNSDefaultRoute = dnsRouting(dc, osDNS, exitNode)
+	if exitNode && uc.ExitNodeAllowLANAccess {
+		lan, err := interfaces.LocalSubnets()
+		if err != nil {
+			logf("exit node LAN access: %v", err)
+		}
+		rcfg.LocalRoutes = lan
 	}
-	b.logf("authReconfig: ra=%v dns=%v 0x%02x: %v", uc.RouteAll, uc.CorpDNS, uflags, err)
+	return cfg, rcfg, upstreams, nil
+}
+
+// deniedTags returns the tags in requested that control didn't grant
+// in nm. It returns nil if control hasn't yet seen the request, or
+// doesn't report the tags it grants.
+func deniedTags(requested []string, nm *controlclient.NetworkMap) []string {
+	if len(requested) == 0 || nm == nil || nm.Tags == nil {
+		return nil
+	}
+	// nm.Hostinfo is control's copy of ours. Until it has the
+	// current request, tags missing from nm.Tags may still be
+	// coming.
+	if !compareStrings(nm.Hostinfo.RequestTags, requested) {
+		return nil
+	}
+	granted := make(map[string]bool, len(nm.Tags))
+	for _, t := range nm.Tags {
+		granted[t] = true
+	}
+	var denied []string
+	for _, t := range requested {
+		if !granted[t] {
+			denied = append(denied, t)
+		}
+	}
+	return denied
 }
 
 // routerConfig produces a router.Config from a wireguard config,
@@ -845,11 +1423,15 @@ func (b *LocalBackend) authReconfig() {
 func routerConfig(cfg *wgcfg.Config, prefs *Prefs, dnsDomains []string) *router.Config {
 	var addrs []wgcfg.CIDR
 	for _, addr := range cfg.Addresses {
-		addrs = append(addrs, wgcfg.CIDR{
-			IP:   addr.IP,
-			Mask: 32,
-		})
+		cidr := wgcfg.CIDR{IP: addr.IP, Mask: 32}
+		if !addr.IP.Is4() {
+			cidr.Mask = 128
+		}
+		addrs = append(addrs, cidr)
 	}
+	// Without an exit node, blocking non-Tailscale traffic would
+	// only cut the node off from the internet.
+	exitNode := prefs.RouteAll && hasExitNode(cfg)
 
 	rs := &router.Config{
 		LocalAddrs:       wgCIDRToNetaddr(addrs),
@@ -857,23 +1439,104 @@ func routerConfig(cfg *wgcfg.Config, prefs *Prefs, dnsDomains []string) *router.
 		DNSDomains:       dnsDomains,
 		SubnetRoutes:     wgCIDRToNetaddr(prefs.AdvertiseRoutes),
 		SNATSubnetRoutes: !prefs.NoSNAT,
+		ProxyNeighbors:   wgCIDRToNetaddr(prefs.ProxyNeighbors),
 		NetfilterMode:    prefs.NetfilterMode,
+		KillSwitch:       prefs.Lockdown || ((prefs.KillSwitch || prefs.ExitNodeLockdown) && exitNode),
+		Lockdown:         prefs.Lockdown,
+		NoExclusiveDNS:   prefs.NoExclusiveDNS,
+		// Whatever the DNS settings, the control server's name
+		// has to keep resolving.
+		DNSProbeName: controlHostname(prefs.ControlURL),
 	}
 
 	for _, peer := range cfg.Peers {
 		rs.Routes = append(rs.Routes, wgCIDRToNetaddr(peer.AllowedIPs)...)
 	}
+	if prefs.SiteToSite {
+		rs.Routes, rs.NoSNATFrom = siteRoutes(rs.Routes, rs.SubnetRoutes)
+	}
 
 	// The Tailscale DNS IP.
 	// TODO(dmytro): make this configurable.
 	rs.Routes = append(rs.Routes, netaddr.IPPrefix{
-		IP:   netaddr.IPv4(100, 100, 100, 100),
+		IP:   magicDNSIP,
 		Bits: 32,
 	})
 
 	return rs
 }
 
+// controlHostname returns the host name in controlURL, or "" if it
+// doesn't parse.
+func controlHostname(controlURL string) string {
+	u, err := url.Parse(controlURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// siteRoutes returns routes without those overlapping local, this
+// site's subnets, which mustn't be routed away from the LAN, and the
+// other sites' subnets among them.
+func siteRoutes(routes, local []netaddr.IPPrefix) (kept, sites []netaddr.IPPrefix) {
+	for _, r := range routes {
+		if overlapsAny(r, local) {
+			continue
+		}
+		kept = append(kept, r)
+		if r.Bits == 0 || r.Bits == 32 && r.IP.Is4() || r.Bits == 128 || tsaddr.IsTailscaleIP(r.IP) {
+			continue // not a site: a single host, or an exit node
+		}
+		sites = append(sites, r)
+	}
+	return kept, sites
+}
+
+func overlapsAny(p netaddr.IPPrefix, ps []netaddr.IPPrefix) bool {
+	for _, q := range ps {
+		if p.Contains(q.IP) || q.Contains(p.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasExitNode reports whether cfg routes all traffic via a peer.
+func hasExitNode(cfg *wgcfg.Config) bool {
+	for _, p := range cfg.Peers {
+		for _, cidr := range p.AllowedIPs {
+			if cidr.Mask == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dnsPlan returns the system DNS configuration in rcfg, for status.
+func dnsPlan(rcfg *router.Config) ipnstate.DNSConfig {
+	dc := ipnstate.DNSConfig{
+		Domains:      rcfg.DNSDomains,
+		Routes:       rcfg.DNSRoutes,
+		DefaultRoute: rcfg.DNSDefaultRoute,
+	}
+	for _, ip := range rcfg.DNS {
+		dc.Nameservers = append(dc.Nameservers, ip.String())
+	}
+	return dc
+}
+
+// downRouterConfig returns the router.Config to use while the engine
+// is stopped. It's empty, except that in lockdown the kill switch
+// stays on so that stopping doesn't restore direct internet access.
+func downRouterConfig(prefs *Prefs) *router.Config {
+	return &router.Config{
+		KillSwitch: prefs.Lockdown,
+		Lockdown:   prefs.Lockdown,
+	}
+}
+
 // wgCIDRsToFilter converts lists of wgcfg.CIDR into a single list of
 // filter.Net.
 func wgCIDRsToFilter(cidrLists ...[]wgcfg.CIDR) (ret []filter.Net) {
@@ -921,10 +1584,11 @@ func wgCIDRToNetaddr(cidrs []wgcfg.CIDR) (ret []netaddr.IPPrefix) {
 // places twiddle IPN internal state without going through here, so
 // really this is more "one of several places in which random things
 // happen".
-func (b *LocalBackend) enterState(newState State) {
+func (b *LocalBackend) enterState(newState State, reason StateReason) {
 	b.mu.Lock()
 	state := b.state
 	b.state = newState
+	b.stateReason = reason
 	prefs := b.prefs
 	notify := b.notify
 	b.mu.Unlock()
@@ -932,18 +1596,24 @@ func (b *LocalBackend) enterState(newState State) {
 	if state == newState {
 		return
 	}
-	b.logf("Switching ipn state %v -> %v (WantRunning=%v)",
-		state, newState, prefs.WantRunning)
+	b.logf("Switching ipn state %v -> %v (WantRunning=%v, reason=%v)",
+		state, newState, prefs.WantRunning, reason)
 	if notify != nil {
 		b.send(Notify{State: &newState})
 	}
+	b.sendEvent(Event{
+		Type:      EventStateChange,
+		State:     newState.String(),
+		PrevState: state.String(),
+		Reason:    reason,
+	})
 
 	switch newState {
 	case NeedsLogin:
 		b.blockEngineUpdates(true)
 		fallthrough
 	case Stopped:
-		err := b.e.Reconfig(&wgcfg.Config{}, &router.Config{})
+		err := b.e.Reconfig(&wgcfg.Config{}, downRouterConfig(prefs))
 		if err != nil {
 			b.logf("Reconfig(down): %v", err)
 		}
@@ -960,49 +1630,31 @@ func (b *LocalBackend) enterState(newState State) {
 }
 
 // nextState returns the state the backend seems to be in, based on
-// its internal state.
-func (b *LocalBackend) nextState() State {
+// its internal state, and why.
+func (b *LocalBackend) nextState() (State, StateReason) {
 	b.mu.Lock()
 	b.assertClientLocked()
 	var (
-		c           = b.c
-		netMap      = b.netMap
-		state       = b.state
-		wantRunning = b.prefs.WantRunning
+		c      = b.c
+		netMap = b.netMap
+		in     = stateInputs{
+			state:       b.state,
+			reason:      b.stateReason,
+			haveNetMap:  netMap != nil,
+			wantRunning: b.prefs.WantRunning,
+		}
 	)
 	b.mu.Unlock()
 
-	switch {
-	case netMap == nil:
-		if c.AuthCantContinue() {
-			// Auth was interrupted or waiting for URL visit,
-			// so it won't proceed without human help.
-			return NeedsLogin
-		} else {
-			// Auth or map request needs to finish
-			return state
-		}
-	case !wantRunning:
-		return Stopped
-	case !netMap.Expiry.IsZero() && time.Until(netMap.Expiry) <= 0:
-		return NeedsLogin
-	case netMap.MachineStatus != tailcfg.MachineAuthorized:
-		// TODO(crawshaw): handle tailcfg.MachineInvalid
-		return NeedsMachineAuth
-	case state == NeedsMachineAuth:
-		// (if we get here, we know MachineAuthorized == true)
-		return Starting
-	case state == Starting:
-		if st := b.getEngineStatus(); st.NumLive > 0 || st.LiveDERPs > 0 {
-			return Running
-		} else {
-			return state
-		}
-	case state == Running:
-		return Running
-	default:
-		return Starting
+	if netMap == nil {
+		in.authCantContinue = c.AuthCantContinue()
+	} else {
+		in.keyExpired = !netMap.Expiry.IsZero() && time.Until(netMap.Expiry) <= 0
+		in.machineAuthorized = netMap.MachineStatus == tailcfg.MachineAuthorized
+		st := b.getEngineStatus()
+		in.engineLive = st.NumLive > 0 || st.LiveDERPs > 0
 	}
+	return nextStateFor(in)
 }
 
 // RequestEngineStatus implements Backend.
@@ -1016,6 +1668,34 @@ func (b *LocalBackend) RequestStatus() {
 	b.notify(Notify{Status: st})
 }
 
+// RequestPrefs implements Backend.
+func (b *LocalBackend) RequestPrefs() {
+	b.mu.Lock()
+	prefs := b.prefs.Clone()
+	sources := b.prefSources
+	b.mu.Unlock()
+	b.send(Notify{Prefs: prefs, PrefSources: sources})
+}
+
+// RequestNetMap implements Backend.
+func (b *LocalBackend) RequestNetMap() {
+	b.mu.Lock()
+	nm := b.netMap
+	ni := new(tailcfg.NetInfo)
+	if b.hostinfo != nil && b.hostinfo.NetInfo != nil {
+		ni = b.hostinfo.NetInfo.Clone()
+	}
+	b.mu.Unlock()
+	if nm != nil {
+		// The netmap is only sent on request for inspection,
+		// which doesn't need the private key.
+		nm2 := *nm
+		nm2.PrivateKey = wgcfg.PrivateKey{}
+		nm = &nm2
+	}
+	b.send(Notify{NetMap: nm, NetInfo: ni})
+}
+
 // stateMachine updates the state machine state based on other things
 // that have happened. It is invoked from the various callbacks that
 // feed events into LocalBackend.
@@ -1033,7 +1713,10 @@ func (b *LocalBackend) stateMachine() {
 // a status update that predates the "I've shut down" update.
 func (b *LocalBackend) stopEngineAndWait() {
 	b.logf("stopEngineAndWait...")
-	b.e.Reconfig(&wgcfg.Config{}, &router.Config{})
+	b.mu.Lock()
+	prefs := b.prefs
+	b.mu.Unlock()
+	b.e.Reconfig(&wgcfg.Config{}, downRouterConfig(prefs))
 	b.requestEngineStatusAndWait()
 	b.logf("stopEngineAndWait: done.")
 }
@@ -1061,6 +1744,10 @@ func (b *LocalBackend) requestEngineStatusAndWait() {
 //  Maybe that's for the better; if someone logs out accidentally,
 //  rebooting will fix it.
 func (b *LocalBackend) Logout() {
+	if b.declarative != nil {
+		b.rejectDeclarative("Logout")
+		return
+	}
 	b.mu.Lock()
 	b.assertClientLocked()
 	c := b.c
@@ -1072,10 +1759,26 @@ func (b *LocalBackend) Logout() {
 	b.mu.Lock()
 	b.netMap = nil
 	b.mu.Unlock()
+	b.expiryWarner.setExpiry(time.Time{})
 
 	b.stateMachine()
 }
 
+// LogoutSync logs out of the control server, waiting at most until
+// ctx is done for the server to acknowledge it. The backend's control
+// client is shut down, so LogoutSync is only suitable right before
+// calling Shutdown.
+func (b *LocalBackend) LogoutSync(ctx context.Context) error {
+	b.mu.Lock()
+	c := b.c
+	b.mu.Unlock()
+
+	if c == nil {
+		return nil
+	}
+	return c.LogoutSync(ctx)
+}
+
 // assertClientLocked crashes if there is no controlclient in this backend.
 func (b *LocalBackend) assertClientLocked() {
 	if b.c == nil {
@@ -1091,12 +1794,47 @@ func (b *LocalBackend) setNetInfo(ni *tailcfg.NetInfo) {
 	if b.hostinfo != nil {
 		b.hostinfo.NetInfo = ni.Clone()
 	}
+	lanAccess := b.prefs != nil && b.prefs.ExitNodeAllowLANAccess
 	b.mu.Unlock()
 
 	if c == nil {
 		return
 	}
 	c.SetNetInfo(ni)
+	if lanAccess && b.lanSubnetsChanged() {
+		// The network was just rechecked, likely after a link
+		// change, and the local networks are new too.
+		b.authReconfig()
+	}
+}
+
+// lanSubnetsChanged reports whether the machine's local subnets
+// changed since it was last called.
+func (b *LocalBackend) lanSubnetsChanged() bool {
+	lan, err := interfaces.LocalSubnets()
+	if err != nil {
+		// authReconfig would fail to get them too.
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	changed := !prefixesEqual(b.lanSubnets, lan)
+	b.lanSubnets = lan
+	return changed
+}
+
+// prefixesEqual reports whether a and b hold the same prefixes in the
+// same order.
+func prefixesEqual(a, b []netaddr.IPPrefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // TestOnlyPublicKeys returns the current machine and node public
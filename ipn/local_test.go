@@ -0,0 +1,272 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+)
+
+func TestDeniedTags(t *testing.T) {
+	nm := func(requested, granted []string) *controlclient.NetworkMap {
+		return &controlclient.NetworkMap{
+			Hostinfo: tailcfg.Hostinfo{RequestTags: requested},
+			Tags:     granted,
+		}
+	}
+	tests := []struct {
+		name      string
+		requested []string
+		nm        *controlclient.NetworkMap
+		want      []string
+	}{
+		{
+			name: "none_requested",
+			nm:   nm(nil, []string{}),
+		},
+		{
+			name:      "all_granted",
+			requested: []string{"tag:web", "tag:prod"},
+			nm:        nm([]string{"tag:web", "tag:prod"}, []string{"tag:prod", "tag:web"}),
+		},
+		{
+			name:      "some_denied",
+			requested: []string{"tag:web", "tag:prod"},
+			nm:        nm([]string{"tag:web", "tag:prod"}, []string{"tag:web"}),
+			want:      []string{"tag:prod"},
+		},
+		{
+			name:      "all_denied",
+			requested: []string{"tag:web"},
+			nm:        nm([]string{"tag:web"}, []string{}),
+			want:      []string{"tag:web"},
+		},
+		{
+			name:      "request_not_seen_yet",
+			requested: []string{"tag:web", "tag:prod"},
+			nm:        nm([]string{"tag:web"}, []string{"tag:web"}),
+		},
+		{
+			name:      "control_without_tags",
+			requested: []string{"tag:web"},
+			nm:        nm([]string{"tag:web"}, nil),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := deniedTags(tt.requested, tt.nm)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSiteRoutes(t *testing.T) {
+	pfxs := func(ss ...string) []netaddr.IPPrefix {
+		var ret []netaddr.IPPrefix
+		for _, s := range ss {
+			p, err := netaddr.ParseIPPrefix(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, p)
+		}
+		return ret
+	}
+	routes := pfxs(
+		"100.101.102.103/32", // a peer
+		"192.168.2.0/24",     // another site
+		"192.168.1.128/25",   // inside this site's LAN
+		"10.0.0.0/8",         // contains this site's LAN
+		"172.16.5.0/24",      // another site
+	)
+	local := pfxs("10.1.0.0/16", "192.168.1.0/24")
+
+	kept, sites := siteRoutes(routes, local)
+	if want := pfxs("100.101.102.103/32", "192.168.2.0/24", "172.16.5.0/24"); !reflect.DeepEqual(kept, want) {
+		t.Errorf("routes = %v; want %v", kept, want)
+	}
+	if want := pfxs("192.168.2.0/24", "172.16.5.0/24"); !reflect.DeepEqual(sites, want) {
+		t.Errorf("sites = %v; want %v", sites, want)
+	}
+}
+
+func TestRouterConfigKillSwitch(t *testing.T) {
+	peer := func(allowed string) wgcfg.Peer {
+		cidr, err := wgcfg.ParseCIDR(allowed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wgcfg.Peer{AllowedIPs: []wgcfg.CIDR{cidr}}
+	}
+	subnetRouter := &wgcfg.Config{Peers: []wgcfg.Peer{peer("192.168.1.0/24")}}
+	exitNode := &wgcfg.Config{Peers: []wgcfg.Peer{peer("0.0.0.0/0")}}
+
+	tests := []struct {
+		name  string
+		cfg   *wgcfg.Config
+		prefs *Prefs
+		want  bool
+	}{
+		{"kill switch, exit node", exitNode, &Prefs{RouteAll: true, KillSwitch: true}, true},
+		{"kill switch, no exit node", subnetRouter, &Prefs{RouteAll: true, KillSwitch: true}, false},
+		{"exit node lockdown, no exit node", subnetRouter, &Prefs{RouteAll: true, ExitNodeLockdown: true}, false},
+		{"lockdown, no exit node", subnetRouter, &Prefs{Lockdown: true}, true},
+		{"no kill switch, exit node", exitNode, &Prefs{RouteAll: true}, false},
+	}
+	for _, tt := range tests {
+		if got := routerConfig(tt.cfg, tt.prefs, nil).KillSwitch; got != tt.want {
+			t.Errorf("%s: KillSwitch = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeclarativePrefs(t *testing.T) {
+	var errs []string
+	b := &LocalBackend{
+		logf: t.Logf,
+		notify: func(n Notify) {
+			if n.ErrMessage != nil {
+				errs = append(errs, *n.ErrMessage)
+			}
+		},
+	}
+	cfg := NewPrefs()
+	cfg.ShieldsUp = true
+	b.SetDeclarativePrefs(cfg)
+
+	b.SetPrefs(NewPrefs())
+	b.EditPrefs(&MaskedPrefs{Set: []string{"ShieldsUp"}})
+	b.Logout()
+	b.StartLoginInteractive()
+	if len(errs) != 4 {
+		t.Fatalf("got errors %q; want one each for SetPrefs, EditPrefs, Logout and StartLoginInteractive", errs)
+	}
+
+	// Start with prefs, as "tailscale up" does, is reported to
+	// the frontend rather than failing its connection.
+	var startErrs []string
+	err := b.Start(Options{
+		StateKey: "k",
+		Prefs:    NewPrefs(),
+		Notify: func(n Notify) {
+			if n.ErrMessage != nil {
+				startErrs = append(startErrs, *n.ErrMessage)
+			}
+		},
+	})
+	if err != nil {
+		t.Errorf("Start with prefs: err = %v; want nil", err)
+	}
+	if len(startErrs) != 1 {
+		t.Fatalf("Start with prefs: got errors %q; want one", startErrs)
+	}
+	for _, e := range append(errs, startErrs...) {
+		if !strings.Contains(e, "managed declaratively") {
+			t.Errorf("error %q doesn't say the prefs are managed declaratively", e)
+		}
+	}
+
+	// Only the node key is saved.
+	prefs := cfg.Clone()
+	prefs.Persist = &controlclient.Persist{LoginName: "user@example.com"}
+	saved, err := PrefsFromBytes(b.stateBytes(prefs), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Persist == nil || saved.Persist.LoginName != "user@example.com" {
+		t.Errorf("saved Persist = %+v; want the node's", saved.Persist)
+	}
+	if saved.ShieldsUp {
+		t.Errorf("saved prefs include ShieldsUp from the config")
+	}
+}
+
+func TestStartKeepsLockdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	unlock := filepath.Join(dir, "unlock")
+
+	locked := NewPrefs()
+	locked.Lockdown = true
+	b := &LocalBackend{
+		logf:       t.Logf,
+		store:      &MemoryStore{},
+		unlockPath: unlock,
+	}
+	if err := b.store.WriteState("k", locked.ToBytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Importing prefs without lockdown, as "tailscale up" does,
+	// doesn't turn it off, neither in use nor in the store.
+	if err := b.loadStateLocked("k", NewPrefs(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !b.prefs.Lockdown {
+		t.Errorf("imported prefs turned lockdown off")
+	}
+	bs, err := b.store.ReadState("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := PrefsFromBytes(bs, false); err != nil || !saved.Lockdown {
+		t.Errorf("saved prefs turned lockdown off (err %v)", err)
+	}
+
+	// Frontend-owned prefs don't either.
+	if err := b.loadStateLocked("", NewPrefs(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !b.prefs.Lockdown {
+		t.Errorf("frontend prefs turned lockdown off")
+	}
+
+	// Once an administrator unlocks the node, they can.
+	if err := ioutil.WriteFile(unlock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.loadStateLocked("k", NewPrefs(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if b.prefs.Lockdown {
+		t.Errorf("lockdown kept on after unlocking")
+	}
+}
+
+func TestEditPrefsLockdown(t *testing.T) {
+	var errs []string
+	b := &LocalBackend{
+		logf: t.Logf,
+		notify: func(n Notify) {
+			if n.ErrMessage != nil {
+				errs = append(errs, *n.ErrMessage)
+			}
+		},
+	}
+	b.prefs = NewPrefs()
+	b.prefs.Lockdown = true
+
+	b.EditPrefs(&MaskedPrefs{Set: []string{"Lockdown"}})
+	if len(errs) != 1 || !strings.Contains(errs[0], errLockdown.Error()) {
+		t.Errorf("got errors %q; want one saying lockdown can't be turned off", errs)
+	}
+	if !b.prefs.Lockdown {
+		t.Errorf("EditPrefs turned lockdown off")
+	}
+}
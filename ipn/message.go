@@ -15,6 +15,7 @@ import (
 
 	"tailscale.com/types/logger"
 	"tailscale.com/types/structs"
+	"tailscale.com/util/goroutines"
 	"tailscale.com/version"
 )
 
@@ -51,8 +52,12 @@ type Command struct {
 	StartLoginInteractive *NoArgs
 	Logout                *NoArgs
 	SetPrefs              *SetPrefsArgs
+	EditPrefs             *MaskedPrefs
 	RequestEngineStatus   *NoArgs
 	RequestStatus         *NoArgs
+	RequestPrefs          *NoArgs
+	RequestNetMap         *NoArgs
+	RequestGoroutines     *NoArgs
 	FakeExpireAfter       *FakeExpireAfterArgs
 }
 
@@ -130,12 +135,30 @@ func (bs *BackendServer) GotCommand(cmd *Command) error {
 	} else if c := cmd.SetPrefs; c != nil {
 		bs.b.SetPrefs(c.New)
 		return nil
+	} else if c := cmd.EditPrefs; c != nil {
+		bs.b.EditPrefs(c)
+		return nil
 	} else if c := cmd.RequestEngineStatus; c != nil {
 		bs.b.RequestEngineStatus()
 		return nil
 	} else if c := cmd.RequestStatus; c != nil {
 		bs.b.RequestStatus()
 		return nil
+	} else if c := cmd.RequestPrefs; c != nil {
+		bs.b.RequestPrefs()
+		return nil
+	} else if c := cmd.RequestNetMap; c != nil {
+		bs.b.RequestNetMap()
+		return nil
+	} else if c := cmd.RequestGoroutines; c != nil {
+		// Answered here rather than by the Backend, as the
+		// Backend may well be what's wedged.
+		stacks := goroutines.Stacks(true)
+		if len(stacks) > maxGoroutinesSize {
+			stacks = stacks[:maxGoroutinesSize] + "\n[truncated]\n"
+		}
+		bs.send(Notify{Goroutines: &stacks})
+		return nil
 	} else if c := cmd.FakeExpireAfter; c != nil {
 		bs.b.FakeExpireAfter(c.Duration)
 		return nil
@@ -229,6 +252,10 @@ func (bc *BackendClient) SetPrefs(new *Prefs) {
 	bc.send(Command{SetPrefs: &SetPrefsArgs{New: new}})
 }
 
+func (bc *BackendClient) EditPrefs(mp *MaskedPrefs) {
+	bc.send(Command{EditPrefs: mp})
+}
+
 func (bc *BackendClient) RequestEngineStatus() {
 	bc.send(Command{RequestEngineStatus: &NoArgs{}})
 }
@@ -237,6 +264,18 @@ func (bc *BackendClient) RequestStatus() {
 	bc.send(Command{AllowVersionSkew: true, RequestStatus: &NoArgs{}})
 }
 
+func (bc *BackendClient) RequestPrefs() {
+	bc.send(Command{AllowVersionSkew: true, RequestPrefs: &NoArgs{}})
+}
+
+func (bc *BackendClient) RequestNetMap() {
+	bc.send(Command{AllowVersionSkew: true, RequestNetMap: &NoArgs{}})
+}
+
+func (bc *BackendClient) RequestGoroutines() {
+	bc.send(Command{AllowVersionSkew: true, RequestGoroutines: &NoArgs{}})
+}
+
 func (bc *BackendClient) FakeExpireAfter(x time.Duration) {
 	bc.send(Command{FakeExpireAfter: &FakeExpireAfterArgs{Duration: x}})
 }
@@ -244,6 +283,10 @@ func (bc *BackendClient) FakeExpireAfter(x time.Duration) {
 // MaxMessageSize is the maximum message size, in bytes.
 const MaxMessageSize = 1 << 20
 
+// maxGoroutinesSize is how much of the goroutine stacks are sent in
+// reply to RequestGoroutines, leaving room for escaping them as JSON.
+const maxGoroutinesSize = MaxMessageSize / 2
+
 // TODO(apenwarr): incremental json decode?
 //  That would let us avoid storing the whole byte array uselessly in RAM.
 func ReadMsg(r io.Reader) ([]byte, error) {
@@ -6,6 +6,8 @@ package ipn
 
 import (
 	"bytes"
+	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 
@@ -178,3 +180,26 @@ func TestClientServer(t *testing.T) {
 	h.Logout()
 	flushUntil(NeedsLogin)
 }
+
+func TestRequestGoroutines(t *testing.T) {
+	var got []byte
+	bs := NewBackendServer(t.Logf, &FakeBackend{}, func(b []byte) {
+		got = append([]byte{}, b...)
+	})
+	if err := bs.GotCommand(&Command{AllowVersionSkew: true, RequestGoroutines: &NoArgs{}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) > MaxMessageSize {
+		t.Errorf("notification is %d bytes; max %d", len(got), MaxMessageSize)
+	}
+	var n Notify
+	if err := json.Unmarshal(got, &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Goroutines == nil {
+		t.Fatalf("no goroutines in reply: %s", got)
+	}
+	if !strings.Contains(*n.Goroutines, "TestRequestGoroutines") {
+		t.Errorf("stacks missing this test:\n%s", *n.Goroutines)
+	}
+}
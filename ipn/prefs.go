@@ -11,10 +11,13 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"tailscale.com/atomicfile"
 	"tailscale.com/control/controlclient"
+	"tailscale.com/types/opt"
+	"tailscale.com/util/syspolicy"
 	"tailscale.com/wgengine/router"
 )
 
@@ -37,6 +40,20 @@ type Prefs struct {
 	// CorpDNS specifies whether to install the Tailscale network's
 	// DNS configuration, if it exists.
 	CorpDNS bool
+	// NoExitNodeDNS specifies whether to keep using the DNS
+	// configuration from control as is while traffic goes via an
+	// exit node. By default, all queries are then sent to
+	// Tailscale's resolver and forwarded through the exit node, so
+	// that none reach the local network's resolvers. It has no
+	// effect unless CorpDNS is set.
+	NoExitNodeDNS bool
+	// NoExclusiveDNS specifies whether, on systems using
+	// openresolv, Tailscale's nameservers are merged with other
+	// interfaces' even when they resolve all names. By default
+	// they're then registered as the only ones used, so queries
+	// can't bypass MagicDNS; with this set, only the search
+	// domains are added to what's there.
+	NoExclusiveDNS bool
 	// WantRunning indicates whether networking should be active on
 	// this node.
 	WantRunning bool
@@ -66,6 +83,43 @@ type Prefs struct {
 	// DisableDERP prevents DERP from being used.
 	DisableDERP bool
 
+	// CloudInfo specifies whether to look up the identity of the
+	// cloud instance the node runs on (provider, region, instance
+	// type and IDs) and send it to the control server as part of
+	// Hostinfo, so that nodes can be told apart by their cloud
+	// attributes. Off by default, the instance's metadata service
+	// isn't queried at all.
+	CloudInfo bool
+
+	// NoPortMapping specifies whether to keep from probing the
+	// LAN's gateway for UPnP, NAT-PMP and PCP port mapping services.
+	NoPortMapping bool
+
+	// NoLANDiscovery specifies whether to keep from using LAN
+	// addresses to find direct paths to peers: this node's LAN
+	// addresses aren't sent to the control server as endpoints, and
+	// peers' private addresses aren't probed. Peers on the same
+	// network are then reached through public addresses or DERP.
+	NoLANDiscovery bool
+
+	// Metered, if set, overrides whether the current network is
+	// treated as metered (charged by the byte, like cellular or a
+	// phone hotspot). On metered networks, background traffic such as
+	// STUN probes, keepalives and log uploads is reduced. If unset,
+	// it's detected from the OS.
+	Metered opt.Bool
+
+	// Schedule lists changes to make to these prefs at set times of
+	// the week, in local time, such as taking the node down during
+	// working hours. Each entry is "DAYS HH:MM ACTION": DAYS is a
+	// comma-separated list of days ("mon", "tue", ...) and ranges of
+	// days ("mon-fri"), or "*" for every day, and ACTION is one of
+	// "up" or "down", which set WantRunning, or "accept-routes" or
+	// "no-accept-routes", which set RouteAll (and so switch to or from
+	// an exit node). Changes made by hand stay until the next entry
+	// is due. See ParseSchedule.
+	Schedule []string
+
 	// The following block of options only have an effect on Linux.
 
 	// AdvertiseRoutes specifies CIDR prefixes to advertise into the
@@ -83,9 +137,69 @@ type Prefs struct {
 	//
 	// Linux-only.
 	NoSNAT bool
+	// ProxyNeighbors specifies CIDR prefixes, reached over Tailscale,
+	// for which to answer ARP and NDP requests on the LAN interface
+	// on the same subnet, so that hosts there treat them as on-link
+	// and need no route for them. Each prefix may have at most 256
+	// addresses.
+	//
+	// Linux-only.
+	ProxyNeighbors []wgcfg.CIDR
+	// SiteToSite specifies whether this subnet router links its
+	// AdvertiseRoutes with those of other subnet routers: it
+	// accepts their advertised subnets, except any overlapping its
+	// own, and doesn't source NAT traffic from them, so that hosts on
+	// each site see each other's real addresses. Traffic from
+	// Tailscale IPs is still source NATed if NoSNAT is unset.
+	//
+	// Each site's LAN must route the other sites' subnets to its
+	// subnet router.
+	//
+	// Linux-only.
+	SiteToSite bool
 	// NetfilterMode specifies how much to manage netfilter rules for
 	// Tailscale, if at all.
 	NetfilterMode router.NetfilterMode
+	// KillSwitch specifies whether to block all outgoing traffic
+	// that doesn't go over Tailscale while RouteAll is set and an
+	// exit node (a peer advertising a default route) is in use: if
+	// the exit node becomes unreachable, traffic is dropped rather
+	// than leaking out of the physical interface. It has no effect
+	// while there's no exit node in the network map.
+	//
+	// Linux-only.
+	KillSwitch bool
+	// Lockdown specifies whether the node must never have direct
+	// internet access: all traffic that doesn't go over Tailscale is
+	// blocked, as with KillSwitch, but also while the node is stopped
+	// and after tailscaled exits. Once on, frontends can only turn it
+	// off after an administrator unlocks the node (see
+	// LocalBackend.SetLockdownUnlockPath).
+	//
+	// Linux-only.
+	Lockdown bool
+	// ExitNodeLockdown specifies whether to block all traffic that
+	// doesn't go over Tailscale while an exit node is in use, other
+	// than tailscaled's own (to DERP and the control server), so that
+	// a dropped tunnel doesn't leak traffic to the local network.
+	// Unlike KillSwitch, it has no effect while traffic isn't routed
+	// through an exit node.
+	//
+	// Windows-only.
+	ExitNodeLockdown bool
+	// ExitNodeAllowLANAccess specifies whether, while traffic goes
+	// via an exit node, the networks this node is directly connected
+	// to are still reached directly rather than through the exit
+	// node, so that local printers, file shares and the like keep
+	// working. It also exempts them from KillSwitch and
+	// ExitNodeLockdown.
+	ExitNodeAllowLANAccess bool
+	// StrictControlKey specifies whether to refuse to connect to
+	// the control server if its key isn't the one first seen from
+	// it, as happens if the server is replaced by another. Either
+	// way, a changed key raises a health warning. To accept a new
+	// key, turn this off until the next login.
+	StrictControlKey bool
 
 	// The Persist field is named 'Config' in the file for backward
 	// compatibility with earlier versions.
@@ -105,9 +219,80 @@ func (p *Prefs) Pretty() string {
 	} else {
 		pp = "Persist=nil"
 	}
-	return fmt.Sprintf("Prefs{ra=%v mesh=%v dns=%v want=%v notepad=%v derp=%v shields=%v routes=%v snat=%v nf=%v %v}",
+	return fmt.Sprintf("Prefs{ra=%v mesh=%v dns=%v want=%v notepad=%v derp=%v shields=%v cloud=%v routes=%v snat=%v nf=%v killswitch=%v lockdown=%v %v}",
 		p.RouteAll, p.AllowSingleHosts, p.CorpDNS, p.WantRunning,
-		p.NotepadURLs, !p.DisableDERP, p.ShieldsUp, p.AdvertiseRoutes, !p.NoSNAT, p.NetfilterMode, pp)
+		p.NotepadURLs, !p.DisableDERP, p.ShieldsUp, p.CloudInfo, p.AdvertiseRoutes, !p.NoSNAT, p.NetfilterMode, p.KillSwitch, p.Lockdown, pp)
+}
+
+// PrefSource describes where the value of a pref came from.
+type PrefSource string
+
+const (
+	PrefFromDefault  PrefSource = "default"  // the default from NewPrefs
+	PrefFromState    PrefSource = "state"    // the backend's saved state
+	PrefFromLegacy   PrefSource = "legacy"   // the legacy relaynode config
+	PrefFromFrontend PrefSource = "frontend" // a frontend, such as the CLI or a GUI
+	PrefFromPolicy   PrefSource = "policy"   // the administrator's system policy
+	PrefFromSchedule PrefSource = "schedule" // an entry of Prefs.Schedule
+	PrefFromConfig   PrefSource = "config"   // tailscaled's declarative config file
+)
+
+// prefSources returns the sources of the values in p, a new version
+// of base: values that differ from base came from src, and the others
+// keep their source from baseSources. If baseSources is nil, base
+// must be NewPrefs and its values are attributed to PrefFromDefault.
+//
+// Persist isn't a pref, and has no source.
+func prefSources(baseSources map[string]PrefSource, base, p *Prefs, src PrefSource) map[string]PrefSource {
+	ret := make(map[string]PrefSource)
+	bv, pv := reflect.ValueOf(base).Elem(), reflect.ValueOf(p).Elem()
+	for i := 0; i < pv.NumField(); i++ {
+		name := pv.Type().Field(i).Name
+		if name == "Persist" {
+			continue
+		}
+		switch {
+		case !reflect.DeepEqual(bv.Field(i).Interface(), pv.Field(i).Interface()):
+			ret[name] = src
+		case baseSources == nil:
+			ret[name] = PrefFromDefault
+		default:
+			ret[name] = baseSources[name]
+		}
+	}
+	return ret
+}
+
+// applySysPolicy overrides the prefs that the administrator's policy
+// pol manages.
+func (p *Prefs) applySysPolicy(pol *syspolicy.Policy) {
+	if pol == nil {
+		return
+	}
+	if pol.ControlURL != nil {
+		p.ControlURL = *pol.ControlURL
+	}
+	if pol.RouteAll != nil {
+		p.RouteAll = *pol.RouteAll
+	}
+	if pol.CorpDNS != nil {
+		p.CorpDNS = *pol.CorpDNS
+	}
+	if pol.ShieldsUp != nil {
+		p.ShieldsUp = *pol.ShieldsUp
+	}
+	if pol.Hostname != nil {
+		p.Hostname = *pol.Hostname
+	}
+	if pol.CloudInfo != nil {
+		p.CloudInfo = *pol.CloudInfo
+	}
+	if pol.KillSwitch != nil {
+		p.KillSwitch = *pol.KillSwitch
+	}
+	if pol.Lockdown != nil {
+		p.Lockdown = *pol.Lockdown
+	}
 }
 
 func (p *Prefs) ToBytes() []byte {
@@ -131,15 +316,29 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.RouteAll == p2.RouteAll &&
 		p.AllowSingleHosts == p2.AllowSingleHosts &&
 		p.CorpDNS == p2.CorpDNS &&
+		p.NoExitNodeDNS == p2.NoExitNodeDNS &&
+		p.NoExclusiveDNS == p2.NoExclusiveDNS &&
 		p.WantRunning == p2.WantRunning &&
 		p.NotepadURLs == p2.NotepadURLs &&
 		p.DisableDERP == p2.DisableDERP &&
+		p.CloudInfo == p2.CloudInfo &&
+		p.NoPortMapping == p2.NoPortMapping &&
+		p.NoLANDiscovery == p2.NoLANDiscovery &&
+		p.Metered == p2.Metered &&
 		p.ShieldsUp == p2.ShieldsUp &&
 		p.NoSNAT == p2.NoSNAT &&
+		p.SiteToSite == p2.SiteToSite &&
 		p.NetfilterMode == p2.NetfilterMode &&
+		p.KillSwitch == p2.KillSwitch &&
+		p.Lockdown == p2.Lockdown &&
+		p.ExitNodeLockdown == p2.ExitNodeLockdown &&
+		p.ExitNodeAllowLANAccess == p2.ExitNodeAllowLANAccess &&
+		p.StrictControlKey == p2.StrictControlKey &&
 		p.Hostname == p2.Hostname &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
+		compareIPNets(p.ProxyNeighbors, p2.ProxyNeighbors) &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
+		compareStrings(p.Schedule, p2.Schedule) &&
 		p.Persist.Equals(p2.Persist)
 }
 
@@ -217,6 +416,32 @@ func (p *Prefs) Clone() *Prefs {
 	return p2
 }
 
+// MaskedPrefs is an edit of Prefs: the prefs it names in Set take
+// the values in Prefs, and the rest are left as they are. Unlike
+// replacing all the prefs, edits made at the same time by different
+// frontends don't undo each other.
+type MaskedPrefs struct {
+	Prefs
+	// Set are the names of the Prefs fields to change, such as
+	// "RouteAll". Persist isn't a pref, and can't be set.
+	Set []string
+}
+
+// ApplyEdits changes the prefs of p named in m.Set to their values in
+// m. If m names a field that isn't a pref, p is left unchanged.
+func (p *Prefs) ApplyEdits(m *MaskedPrefs) error {
+	pv, mv := reflect.ValueOf(p).Elem(), reflect.ValueOf(&m.Prefs).Elem()
+	for _, name := range m.Set {
+		if _, ok := pv.Type().FieldByName(name); !ok || name == "Persist" {
+			return fmt.Errorf("unknown pref %q", name)
+		}
+	}
+	for _, name := range m.Set {
+		pv.FieldByName(name).Set(mv.FieldByName(name))
+	}
+	return nil
+}
+
 // LoadLegacyPrefs loads a legacy relaynode config file into Prefs
 // with sensible migration defaults set. If enforceDefaults is true,
 // Prefs.RouteAll and Prefs.AllowSingleHosts are forced on.
@@ -11,6 +11,7 @@ import (
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/tstest"
+	"tailscale.com/util/syspolicy"
 	"tailscale.com/wgengine/router"
 )
 
@@ -24,7 +25,7 @@ func fieldsOf(t reflect.Type) (fields []string) {
 func TestPrefsEqual(t *testing.T) {
 	tstest.PanicOnLog()
 
-	prefsHandles := []string{"ControlURL", "RouteAll", "AllowSingleHosts", "CorpDNS", "WantRunning", "ShieldsUp", "AdvertiseTags", "Hostname", "NotepadURLs", "DisableDERP", "AdvertiseRoutes", "NoSNAT", "NetfilterMode", "Persist"}
+	prefsHandles := []string{"ControlURL", "RouteAll", "AllowSingleHosts", "CorpDNS", "NoExitNodeDNS", "NoExclusiveDNS", "WantRunning", "ShieldsUp", "AdvertiseTags", "Hostname", "NotepadURLs", "DisableDERP", "CloudInfo", "NoPortMapping", "NoLANDiscovery", "Metered", "Schedule", "AdvertiseRoutes", "NoSNAT", "ProxyNeighbors", "SiteToSite", "NetfilterMode", "KillSwitch", "Lockdown", "ExitNodeLockdown", "ExitNodeAllowLANAccess", "StrictControlKey", "Persist"}
 	if have := fieldsOf(reflect.TypeOf(Prefs{})); !reflect.DeepEqual(have, prefsHandles) {
 		t.Errorf("Prefs.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
 			have, prefsHandles)
@@ -103,6 +104,16 @@ func TestPrefsEqual(t *testing.T) {
 			&Prefs{CorpDNS: true},
 			true,
 		},
+		{
+			&Prefs{NoExitNodeDNS: true},
+			&Prefs{NoExitNodeDNS: false},
+			false,
+		},
+		{
+			&Prefs{NoExclusiveDNS: true},
+			&Prefs{NoExclusiveDNS: false},
+			false,
+		},
 
 		{
 			&Prefs{WantRunning: true},
@@ -115,6 +126,17 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{NoPortMapping: true},
+			&Prefs{NoPortMapping: false},
+			false,
+		},
+		{
+			&Prefs{NoLANDiscovery: true},
+			&Prefs{NoLANDiscovery: false},
+			false,
+		},
+
 		{
 			&Prefs{NoSNAT: true},
 			&Prefs{NoSNAT: false},
@@ -126,6 +148,39 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{ProxyNeighbors: nets("192.168.1.200/29")},
+			&Prefs{ProxyNeighbors: nets("192.168.1.200/29")},
+			true,
+		},
+		{
+			&Prefs{ProxyNeighbors: nets("192.168.1.200/29")},
+			&Prefs{ProxyNeighbors: nets("192.168.1.208/29")},
+			false,
+		},
+
+		{
+			&Prefs{Schedule: []string{"mon-fri 09:00 down"}},
+			&Prefs{Schedule: []string{"mon-fri 09:00 down"}},
+			true,
+		},
+		{
+			&Prefs{Schedule: []string{"mon-fri 09:00 down"}},
+			&Prefs{Schedule: []string{"mon-fri 09:00 down", "mon-fri 17:00 up"}},
+			false,
+		},
+
+		{
+			&Prefs{SiteToSite: true},
+			&Prefs{SiteToSite: false},
+			false,
+		},
+		{
+			&Prefs{SiteToSite: true},
+			&Prefs{SiteToSite: true},
+			true,
+		},
+
 		{
 			&Prefs{Hostname: "android-host01"},
 			&Prefs{Hostname: "android-host02"},
@@ -159,6 +214,28 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{CloudInfo: true},
+			&Prefs{CloudInfo: false},
+			false,
+		},
+		{
+			&Prefs{CloudInfo: true},
+			&Prefs{CloudInfo: true},
+			true,
+		},
+
+		{
+			&Prefs{Metered: "true"},
+			&Prefs{Metered: ""},
+			false,
+		},
+		{
+			&Prefs{Metered: "false"},
+			&Prefs{Metered: "false"},
+			true,
+		},
+
 		{
 			&Prefs{AdvertiseRoutes: nil},
 			&Prefs{AdvertiseRoutes: []wgcfg.CIDR{}},
@@ -196,6 +273,61 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{KillSwitch: true},
+			&Prefs{KillSwitch: false},
+			false,
+		},
+		{
+			&Prefs{KillSwitch: true},
+			&Prefs{KillSwitch: true},
+			true,
+		},
+
+		{
+			&Prefs{Lockdown: true},
+			&Prefs{Lockdown: false},
+			false,
+		},
+		{
+			&Prefs{Lockdown: true},
+			&Prefs{Lockdown: true},
+			true,
+		},
+
+		{
+			&Prefs{ExitNodeLockdown: true},
+			&Prefs{ExitNodeLockdown: false},
+			false,
+		},
+		{
+			&Prefs{ExitNodeLockdown: true},
+			&Prefs{ExitNodeLockdown: true},
+			true,
+		},
+
+		{
+			&Prefs{ExitNodeAllowLANAccess: true},
+			&Prefs{ExitNodeAllowLANAccess: false},
+			false,
+		},
+		{
+			&Prefs{ExitNodeAllowLANAccess: true},
+			&Prefs{ExitNodeAllowLANAccess: true},
+			true,
+		},
+
+		{
+			&Prefs{StrictControlKey: true},
+			&Prefs{StrictControlKey: false},
+			false,
+		},
+		{
+			&Prefs{StrictControlKey: true},
+			&Prefs{StrictControlKey: true},
+			true,
+		},
+
 		{
 			&Prefs{Persist: &controlclient.Persist{}},
 			&Prefs{Persist: &controlclient.Persist{LoginName: "dave"}},
@@ -278,3 +410,109 @@ func TestPrefsPersist(t *testing.T) {
 	}
 	checkPrefs(t, p)
 }
+
+func TestApplySysPolicy(t *testing.T) {
+	// Every policy setting must override the pref of the same name.
+	prefsType := reflect.TypeOf(Prefs{})
+	polType := reflect.TypeOf(syspolicy.Policy{})
+	for i := 0; i < polType.NumField(); i++ {
+		pf := polType.Field(i)
+		f, ok := prefsType.FieldByName(pf.Name)
+		if !ok {
+			t.Errorf("syspolicy.Policy.%s has no matching Prefs field", pf.Name)
+			continue
+		}
+		if f.Type != pf.Type.Elem() {
+			t.Errorf("syspolicy.Policy.%s is %v; Prefs.%s is %v", pf.Name, pf.Type, f.Name, f.Type)
+		}
+	}
+
+	url := "https://ctrl.example.com"
+	no, yes := false, true
+	p := Prefs{
+		ControlURL: "https://login.tailscale.com",
+		ShieldsUp:  true,
+		CorpDNS:    true,
+	}
+	p.applySysPolicy(&syspolicy.Policy{
+		ControlURL: &url,
+		ShieldsUp:  &no,
+		Lockdown:   &yes,
+	})
+	want := Prefs{
+		ControlURL: url,
+		CorpDNS:    true,
+		Lockdown:   true,
+	}
+	if !p.Equals(&want) {
+		t.Errorf("got %v; want %v", p.Pretty(), want.Pretty())
+	}
+
+	p.applySysPolicy(nil)
+	if !p.Equals(&want) {
+		t.Errorf("nil policy changed prefs to %v", p.Pretty())
+	}
+}
+
+func TestPrefSources(t *testing.T) {
+	def := NewPrefs()
+	loaded := NewPrefs()
+	loaded.ShieldsUp = true
+	sources := prefSources(nil, def, loaded, PrefFromState)
+	if got := sources["ShieldsUp"]; got != PrefFromState {
+		t.Errorf("ShieldsUp from %q; want %q", got, PrefFromState)
+	}
+	if got := sources["RouteAll"]; got != PrefFromDefault {
+		t.Errorf("RouteAll from %q; want %q", got, PrefFromDefault)
+	}
+	if _, ok := sources["Persist"]; ok {
+		t.Error("Persist has a source")
+	}
+	if len(sources) != reflect.TypeOf(Prefs{}).NumField()-1 {
+		t.Errorf("got %d sources; want one per pref", len(sources))
+	}
+
+	set := loaded.Clone()
+	set.RouteAll = false
+	sources = prefSources(sources, loaded, set, PrefFromFrontend)
+	want := map[string]PrefSource{
+		"ShieldsUp":  PrefFromState,
+		"RouteAll":   PrefFromFrontend,
+		"ControlURL": PrefFromDefault,
+	}
+	for name, src := range want {
+		if got := sources[name]; got != src {
+			t.Errorf("%s from %q; want %q", name, got, src)
+		}
+	}
+}
+
+func TestApplyEdits(t *testing.T) {
+	p := NewPrefs()
+	p.Hostname = "foo"
+	p.AdvertiseTags = []string{"tag:server"}
+
+	m := &MaskedPrefs{Set: []string{"RouteAll", "AdvertiseTags"}}
+	m.RouteAll = false
+	m.Hostname = "ignored"
+	if err := p.ApplyEdits(m); err != nil {
+		t.Fatal(err)
+	}
+	want := NewPrefs()
+	want.RouteAll = false
+	want.Hostname = "foo"
+	if !p.Equals(want) {
+		t.Errorf("after edit, prefs = %v; want %v", p.Pretty(), want.Pretty())
+	}
+
+	for _, name := range []string{"Persist", "NoSuchPref"} {
+		m := &MaskedPrefs{Set: []string{"ShieldsUp", name}}
+		m.ShieldsUp = true
+		if err := p.ApplyEdits(m); err == nil {
+			t.Errorf("editing %s succeeded; want error", name)
+		}
+		if p.ShieldsUp {
+			t.Errorf("failed edit of %s changed ShieldsUp", name)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// scheduleActions are the actions a schedule entry can take, and how
+// each changes prefs. Nodes using an exit node reach it through
+// accepted routes, so accept-routes and no-accept-routes switch to
+// and from it.
+var scheduleActions = map[string]func(*Prefs){
+	"up":               func(p *Prefs) { p.WantRunning = true },
+	"down":             func(p *Prefs) { p.WantRunning = false },
+	"accept-routes":    func(p *Prefs) { p.RouteAll = true },
+	"no-accept-routes": func(p *Prefs) { p.RouteAll = false },
+}
+
+// weekdays are the names of the days in schedule entries, indexed by
+// time.Weekday.
+var weekdays = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// scheduleCheckInterval is the longest the scheduler waits between
+// checks for entries that are due. Timers don't advance while the
+// machine is asleep, so waiting for the next entry in one go could
+// miss it by as long as the machine slept.
+const scheduleCheckInterval = time.Minute
+
+// A scheduleEntry is a parsed entry of Prefs.Schedule.
+type scheduleEntry struct {
+	days   [7]bool // indexed by time.Weekday
+	minute int     // minutes after midnight, local time
+	action string  // a key of scheduleActions
+}
+
+// ParseSchedule parses a semicolon-separated list of schedule entries,
+// like "mon-fri 09:00 down; mon-fri 17:30 up", into a list for
+// Prefs.Schedule. See Prefs.Schedule for the entries' format. An
+// empty string means no schedule.
+func ParseSchedule(s string) ([]string, error) {
+	var ret []string
+	for _, f := range strings.Split(s, ";") {
+		f = strings.Join(strings.Fields(strings.ToLower(f)), " ")
+		if f == "" {
+			continue
+		}
+		if _, err := parseScheduleEntry(f); err != nil {
+			return nil, err
+		}
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
+func parseScheduleEntry(s string) (scheduleEntry, error) {
+	var e scheduleEntry
+	f := strings.Fields(strings.ToLower(s))
+	if len(f) != 3 {
+		return e, fmt.Errorf("bad schedule entry %q: want \"DAYS HH:MM ACTION\"", s)
+	}
+	var err error
+	if e.days, err = parseWeekdays(f[0]); err != nil {
+		return e, fmt.Errorf("bad schedule entry %q: %v", s, err)
+	}
+	t, err := time.Parse("15:04", f[1])
+	if err != nil {
+		return e, fmt.Errorf("bad schedule entry %q: bad time %q", s, f[1])
+	}
+	e.minute = t.Hour()*60 + t.Minute()
+	if _, ok := scheduleActions[f[2]]; !ok {
+		return e, fmt.Errorf("bad schedule entry %q: unknown action %q", s, f[2])
+	}
+	e.action = f[2]
+	return e, nil
+}
+
+// parseWeekdays parses a comma-separated list of days and ranges of
+// days, like "mon-fri" or "sat,sun", or "*" for every day. Ranges
+// may wrap around the end of the week, as in "fri-mon".
+func parseWeekdays(s string) (days [7]bool, err error) {
+	if s == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+	for _, f := range strings.Split(s, ",") {
+		first, last := f, f
+		if i := strings.Index(f, "-"); i >= 0 {
+			first, last = f[:i], f[i+1:]
+		}
+		d, end := weekdayIndex(first), weekdayIndex(last)
+		if d < 0 || end < 0 {
+			return days, fmt.Errorf("bad days %q", s)
+		}
+		for {
+			days[d] = true
+			if d == end {
+				break
+			}
+			d = (d + 1) % 7
+		}
+	}
+	return days, nil
+}
+
+func weekdayIndex(name string) int {
+	for i, d := range weekdays {
+		if name == d {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextScheduled returns the first time after t at which any of
+// entries is due, in t's location, and the actions of the entries
+// due then, in order. It returns the zero time if entries is empty.
+func nextScheduled(entries []scheduleEntry, t time.Time) (next time.Time, actions []string) {
+	y, m, d := t.Date()
+	for i := 0; i <= 7; i++ {
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, t.Location())
+		for _, e := range entries {
+			if !e.days[day.Weekday()] {
+				continue
+			}
+			at := time.Date(y, m, d+i, e.minute/60, e.minute%60, 0, 0, t.Location())
+			switch {
+			case !at.After(t):
+			case next.IsZero() || at.Before(next):
+				next, actions = at, []string{e.action}
+			case at.Equal(next):
+				actions = append(actions, e.action)
+			}
+		}
+		if !next.IsZero() {
+			return next, actions
+		}
+	}
+	return next, nil
+}
+
+// scheduledBetween returns the actions of entries due after from and
+// no later than to, in the order they were due.
+func scheduledBetween(entries []scheduleEntry, from, to time.Time) []string {
+	var ret []string
+	for {
+		next, actions := nextScheduled(entries, from)
+		if next.IsZero() || next.After(to) {
+			return ret
+		}
+		ret = append(ret, actions...)
+		from = next
+	}
+}
+
+// scheduler changes prefs as Prefs.Schedule says.
+type scheduler struct {
+	logf  logger.Logf
+	apply func(actions []string) // called without mu held
+
+	mu      sync.Mutex
+	spec    []string        // Prefs.Schedule that entries came from
+	entries []scheduleEntry // nil if there's no schedule
+	checked time.Time       // when due entries were last applied
+	timer   *time.Timer     // fires at the next check; nil if none
+}
+
+func newScheduler(logf logger.Logf, apply func(actions []string)) *scheduler {
+	return &scheduler{
+		logf:  logf,
+		apply: apply,
+	}
+}
+
+// set replaces the schedule with spec, the value of Prefs.Schedule.
+// Only entries due after set is called are applied, so restarting
+// doesn't undo a change made since the last entry was due.
+func (s *scheduler) set(spec []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if compareStrings(spec, s.spec) && (len(spec) == 0 || s.timer != nil) {
+		return
+	}
+	s.spec = append([]string(nil), spec...)
+	s.entries = nil
+	for _, f := range spec {
+		e, err := parseScheduleEntry(f)
+		if err != nil {
+			s.logf("schedule: ignoring %v", err)
+			continue
+		}
+		s.entries = append(s.entries, e)
+	}
+	s.checked = time.Now()
+	s.resetLocked()
+}
+
+// stop cancels the schedule.
+func (s *scheduler) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spec, s.entries = nil, nil
+	s.resetLocked()
+}
+
+func (s *scheduler) check() {
+	s.mu.Lock()
+	if s.timer == nil {
+		// Stopped while the timer was firing.
+		s.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	actions := scheduledBetween(s.entries, s.checked, now)
+	s.checked = now
+	s.resetLocked()
+	s.mu.Unlock()
+
+	if len(actions) > 0 {
+		s.logf("schedule: %s", strings.Join(actions, ", "))
+		s.apply(actions)
+	}
+}
+
+// resetLocked schedules the next check, if there are entries.
+//
+// s.mu must be held.
+func (s *scheduler) resetLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.entries) == 0 {
+		return
+	}
+	next, _ := nextScheduled(s.entries, s.checked)
+	d := time.Until(next)
+	if d > scheduleCheckInterval {
+		d = scheduleCheckInterval
+	}
+	s.timer = time.AfterFunc(d, s.check)
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: ""},
+		{in: "Mon-Fri  09:00 down; mon-fri 17:30 up;", want: []string{"mon-fri 09:00 down", "mon-fri 17:30 up"}},
+		{in: "sat,sun 8:00 accept-routes", want: []string{"sat,sun 8:00 accept-routes"}},
+		{in: "* 23:00 no-accept-routes", want: []string{"* 23:00 no-accept-routes"}},
+		{in: "fri-mon 00:00 up", want: []string{"fri-mon 00:00 up"}},
+		{in: "mon-fri 09:00", wantErr: true},
+		{in: "weekdays 09:00 down", wantErr: true},
+		{in: "mon 25:00 down", wantErr: true},
+		{in: "mon 09:00 sleep", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSchedule(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSchedule(%q) error = %v; want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSchedule(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseWeekdays(t *testing.T) {
+	tests := []struct {
+		in   string
+		want [7]bool // sun first
+	}{
+		{"*", [7]bool{true, true, true, true, true, true, true}},
+		{"mon-fri", [7]bool{false, true, true, true, true, true, false}},
+		{"sat,sun", [7]bool{true, false, false, false, false, false, true}},
+		{"fri-mon", [7]bool{true, true, false, false, false, true, true}},
+		{"wed,mon-tue", [7]bool{false, true, true, true, false, false, false}},
+	}
+	for _, tt := range tests {
+		got, err := parseWeekdays(tt.in)
+		if err != nil {
+			t.Errorf("parseWeekdays(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseWeekdays(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestScheduled(t *testing.T) {
+	var entries []scheduleEntry
+	for _, s := range []string{"mon-fri 09:00 down", "mon-fri 17:30 up", "fri 17:30 no-accept-routes"} {
+		e, err := parseScheduleEntry(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2020, 8, day, hour, min, 0, 0, time.UTC)
+	}
+	// 2020-08-03 is a Monday.
+	tests := []struct {
+		now         time.Time
+		wantNext    time.Time
+		wantActions []string
+	}{
+		{at(3, 8, 0), at(3, 9, 0), []string{"down"}},
+		{at(3, 9, 0), at(3, 17, 30), []string{"up"}},
+		{at(7, 12, 0), at(7, 17, 30), []string{"up", "no-accept-routes"}},
+		{at(7, 18, 0), at(10, 9, 0), []string{"down"}},
+		{at(8, 10, 0), at(10, 9, 0), []string{"down"}},
+	}
+	for _, tt := range tests {
+		next, actions := nextScheduled(entries, tt.now)
+		if !next.Equal(tt.wantNext) || !reflect.DeepEqual(actions, tt.wantActions) {
+			t.Errorf("nextScheduled(%v) = %v, %q; want %v, %q", tt.now, next, actions, tt.wantNext, tt.wantActions)
+		}
+	}
+
+	if next, _ := nextScheduled(nil, at(3, 8, 0)); !next.IsZero() {
+		t.Errorf("nextScheduled with no entries = %v; want zero", next)
+	}
+
+	// Asleep from Friday lunchtime to Monday at 10.
+	got := scheduledBetween(entries, at(7, 12, 0), at(10, 10, 0))
+	want := []string{"up", "no-accept-routes", "down"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scheduledBetween = %q; want %q", got, want)
+	}
+	if got := scheduledBetween(entries, at(3, 9, 0), at(3, 17, 0)); len(got) != 0 {
+		t.Errorf("scheduledBetween with none due = %q; want none", got)
+	}
+}
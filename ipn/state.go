@@ -0,0 +1,105 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+// A StateReason is why the backend entered its current State. It's
+// reported in ipnstate.Status, so frontends and scripts can say why
+// Tailscale isn't running without guessing from other fields.
+type StateReason string
+
+const (
+	// ReasonStart is the reason for NoState after Start: the
+	// backend is (re)starting with new state or prefs.
+	ReasonStart StateReason = "start"
+	// ReasonAuthRequired is the reason for NeedsLogin when
+	// logging in can't continue without the user.
+	ReasonAuthRequired StateReason = "auth-required"
+	// ReasonKeyExpired is the reason for NeedsLogin when the
+	// node key has expired.
+	ReasonKeyExpired StateReason = "key-expired"
+	// ReasonWantRunningOff is the reason for Stopped: the prefs
+	// say not to run.
+	ReasonWantRunningOff StateReason = "want-running-off"
+	// ReasonMachineUnauthorized is the reason for
+	// NeedsMachineAuth: an administrator must authorize the machine.
+	ReasonMachineUnauthorized StateReason = "machine-unauthorized"
+	// ReasonMachineAuthorized is the reason for leaving
+	// NeedsMachineAuth for Starting.
+	ReasonMachineAuthorized StateReason = "machine-authorized"
+	// ReasonNetMap is the reason for Starting when a usable
+	// network map arrives.
+	ReasonNetMap StateReason = "netmap"
+	// ReasonReauth is the reason for going from Running back to
+	// Starting while an interactive login is in progress.
+	ReasonReauth StateReason = "reauth"
+	// ReasonConnected is the reason for Running: the engine has a
+	// live peer or DERP connection.
+	ReasonConnected StateReason = "connected"
+)
+
+// stateInputs are the parts of the backend's internal state that its
+// next State is derived from.
+type stateInputs struct {
+	state             State // current state
+	reason            StateReason
+	haveNetMap        bool
+	authCantContinue  bool // login is waiting on the user
+	wantRunning       bool
+	keyExpired        bool
+	machineAuthorized bool
+	engineLive        bool // the engine has live peers or DERP connections
+}
+
+// nextStateFor returns the State the backend moves to given in, and
+// why. If the state doesn't change, it returns the current reason.
+//
+// The transitions are:
+//
+//	any              -> NeedsLogin        login needs the user, or the key expired
+//	any              -> Stopped           WantRunning is off
+//	any              -> NeedsMachineAuth  the machine isn't authorized
+//	NeedsMachineAuth -> Starting          the machine was authorized
+//	NoState, Stopped,
+//	NeedsLogin       -> Starting          a usable netmap arrived
+//	Starting         -> Running           the engine connected
+func nextStateFor(in stateInputs) (State, StateReason) {
+	switch {
+	case !in.haveNetMap:
+		if in.authCantContinue {
+			// Auth was interrupted or waiting for URL visit,
+			// so it won't proceed without human help.
+			return transition(in, NeedsLogin, ReasonAuthRequired)
+		}
+		// Auth or map request needs to finish.
+		return in.state, in.reason
+	case !in.wantRunning:
+		return transition(in, Stopped, ReasonWantRunningOff)
+	case in.keyExpired:
+		return transition(in, NeedsLogin, ReasonKeyExpired)
+	case !in.machineAuthorized:
+		// TODO(crawshaw): handle tailcfg.MachineInvalid
+		return transition(in, NeedsMachineAuth, ReasonMachineUnauthorized)
+	case in.state == NeedsMachineAuth:
+		return Starting, ReasonMachineAuthorized
+	case in.state == Starting:
+		if in.engineLive {
+			return Running, ReasonConnected
+		}
+		return in.state, in.reason
+	case in.state == Running:
+		return Running, in.reason
+	default:
+		return Starting, ReasonNetMap
+	}
+}
+
+// transition returns to and reason, unless in is already in state to,
+// in which case its reason is kept.
+func transition(in stateInputs, to State, reason StateReason) (State, StateReason) {
+	if in.state == to {
+		return to, in.reason
+	}
+	return to, reason
+}
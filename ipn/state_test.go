@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import "testing"
+
+func TestNextStateFor(t *testing.T) {
+	// ready is a logged in, authorized node that wants to run.
+	ready := stateInputs{haveNetMap: true, wantRunning: true, machineAuthorized: true}
+	with := func(in stateInputs, f func(*stateInputs)) stateInputs {
+		f(&in)
+		return in
+	}
+
+	tests := []struct {
+		name       string
+		in         stateInputs
+		wantState  State
+		wantReason StateReason
+	}{
+		{
+			name:       "waiting_for_netmap",
+			in:         stateInputs{state: NoState, reason: ReasonStart},
+			wantState:  NoState,
+			wantReason: ReasonStart,
+		},
+		{
+			name:       "needs_login",
+			in:         stateInputs{state: NoState, authCantContinue: true},
+			wantState:  NeedsLogin,
+			wantReason: ReasonAuthRequired,
+		},
+		{
+			name:       "stopped",
+			in:         with(ready, func(in *stateInputs) { in.state = Running; in.wantRunning = false }),
+			wantState:  Stopped,
+			wantReason: ReasonWantRunningOff,
+		},
+		{
+			name:       "key_expired",
+			in:         with(ready, func(in *stateInputs) { in.state = Running; in.keyExpired = true }),
+			wantState:  NeedsLogin,
+			wantReason: ReasonKeyExpired,
+		},
+		{
+			name:       "key_expired_keeps_reason",
+			in:         with(ready, func(in *stateInputs) { in.state = NeedsLogin; in.reason = ReasonAuthRequired; in.keyExpired = true }),
+			wantState:  NeedsLogin,
+			wantReason: ReasonAuthRequired,
+		},
+		{
+			name:       "machine_unauthorized",
+			in:         with(ready, func(in *stateInputs) { in.machineAuthorized = false }),
+			wantState:  NeedsMachineAuth,
+			wantReason: ReasonMachineUnauthorized,
+		},
+		{
+			name:       "machine_authorized",
+			in:         with(ready, func(in *stateInputs) { in.state = NeedsMachineAuth }),
+			wantState:  Starting,
+			wantReason: ReasonMachineAuthorized,
+		},
+		{
+			name:       "netmap",
+			in:         with(ready, func(in *stateInputs) { in.state = Stopped }),
+			wantState:  Starting,
+			wantReason: ReasonNetMap,
+		},
+		{
+			name:       "starting",
+			in:         with(ready, func(in *stateInputs) { in.state = Starting; in.reason = ReasonNetMap }),
+			wantState:  Starting,
+			wantReason: ReasonNetMap,
+		},
+		{
+			name:       "connected",
+			in:         with(ready, func(in *stateInputs) { in.state = Starting; in.engineLive = true }),
+			wantState:  Running,
+			wantReason: ReasonConnected,
+		},
+		{
+			name:       "running",
+			in:         with(ready, func(in *stateInputs) { in.state = Running; in.reason = ReasonConnected }),
+			wantState:  Running,
+			wantReason: ReasonConnected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, reason := nextStateFor(tt.in)
+			if state != tt.wantState || reason != tt.wantReason {
+				t.Errorf("got %v (%v); want %v (%v)", state, reason, tt.wantState, tt.wantReason)
+			}
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"sync"
 
 	"tailscale.com/atomicfile"
+	"tailscale.com/util/lsm"
 )
 
 // ErrStateNotExist is returned by StateStore.ReadState when the
@@ -117,5 +118,7 @@ func (s *FileStore) WriteState(id StateKey, bs []byte) error {
 	if err != nil {
 		return err
 	}
-	return atomicfile.WriteFile(s.path, bs, 0600)
+	err = atomicfile.WriteFile(s.path, bs, 0600)
+	lsm.Check(lsm.OpStateDir, err)
+	return err
 }
@@ -0,0 +1,62 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalWriter sends each message to the systemd journal using its
+// native protocol, so that it gets proper fields rather than being
+// parsed from stderr.
+type journalWriter struct {
+	ident string
+	conn  *net.UnixConn
+}
+
+func newJournal(ident string) (*journalWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalWriter{ident: ident, conn: conn}, nil
+}
+
+// appendJournalField appends a field in the journal's native format.
+// Values with newlines use the length-prefixed binary form.
+func appendJournalField(b []byte, name, value string) []byte {
+	if !strings.Contains(value, "\n") {
+		b = append(b, name...)
+		b = append(b, '=')
+		b = append(b, value...)
+		return append(b, '\n')
+	}
+	b = append(b, name...)
+	b = append(b, '\n')
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(value)))
+	b = append(b, n[:]...)
+	b = append(b, value...)
+	return append(b, '\n')
+}
+
+func (j *journalWriter) Write(buf []byte) (int, error) {
+	msg := string(bytes.TrimSuffix(buf, []byte("\n")))
+	var b []byte
+	b = appendJournalField(b, "MESSAGE", msg)
+	b = appendJournalField(b, "PRIORITY", "6") // info
+	b = appendJournalField(b, "SYSLOG_IDENTIFIER", j.ident)
+	if _, err := j.conn.Write(b); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (j *journalWriter) Close() error { return j.conn.Close() }
@@ -0,0 +1,27 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logsink
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestAppendJournalField(t *testing.T) {
+	if got, want := string(appendJournalField(nil, "MESSAGE", "hi")), "MESSAGE=hi\n"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	got := appendJournalField(nil, "MESSAGE", "a\nb")
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], 3)
+	want := "MESSAGE\n" + string(n[:]) + "a\nb\n"
+	if string(got) != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if strings.Count(string(got), "=") != 0 {
+		t.Errorf("binary form has '=': %q", got)
+	}
+}
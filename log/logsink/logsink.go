@@ -0,0 +1,213 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logsink provides the destinations that Tailscale programs
+// can write their local log output to: stderr, the systemd journal,
+// syslog, rotating files, and JSON lines on any of those.
+//
+// Each Write to a Sink is one log message, as written by the standard
+// library's log.Logger.
+package logsink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink is a destination for log messages.
+type Sink struct {
+	io.Writer
+
+	// Timestamps is whether messages written to the sink should
+	// carry their own timestamp, because the sink doesn't add one.
+	Timestamps bool
+
+	closer io.Closer // or nil
+}
+
+// Close closes the sink's underlying file or connection, if any.
+func (s *Sink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// Specs describes the sink specs accepted by Open, for flag help.
+const Specs = "stderr, journald, syslog, file:<path> (rotated at 10MB), or json:<sink> for JSON lines (json alone is json:stderr)"
+
+// Open opens the sink described by spec, one of Specs. Messages sent
+// to the journal or syslog are tagged with ident.
+func Open(spec, ident string) (*Sink, error) {
+	switch {
+	case spec == "" || spec == "stderr":
+		return &Sink{Writer: stderrWriter{}, Timestamps: true}, nil
+	case spec == "journald":
+		w, err := newJournal(ident)
+		if err != nil {
+			return nil, fmt.Errorf("logsink: journald: %v", err)
+		}
+		return &Sink{Writer: w, closer: w}, nil
+	case spec == "syslog":
+		w, err := newSyslog(ident)
+		if err != nil {
+			return nil, fmt.Errorf("logsink: syslog: %v", err)
+		}
+		return &Sink{Writer: w, closer: w}, nil
+	case strings.HasPrefix(spec, "file:"):
+		path := strings.TrimPrefix(spec, "file:")
+		if path == "" {
+			return nil, errors.New("logsink: file: missing path")
+		}
+		f, err := NewRotatingFile(path, defaultMaxFileSize, defaultKeepFiles)
+		if err != nil {
+			return nil, fmt.Errorf("logsink: %v", err)
+		}
+		return &Sink{Writer: f, Timestamps: true, closer: f}, nil
+	case spec == "json" || strings.HasPrefix(spec, "json:"):
+		inner, err := Open(strings.TrimPrefix(strings.TrimPrefix(spec, "json"), ":"), ident)
+		if err != nil {
+			return nil, err
+		}
+		return &Sink{Writer: &jsonWriter{w: inner}, closer: inner}, nil
+	default:
+		return nil, fmt.Errorf("logsink: unknown sink %q; want %s", spec, Specs)
+	}
+}
+
+// stderrWriter is an io.Writer that always writes to the latest
+// os.Stderr, even if os.Stderr changes during the lifetime of the
+// stderrWriter value.
+type stderrWriter struct{}
+
+func (stderrWriter) Write(buf []byte) (int, error) {
+	return os.Stderr.Write(buf)
+}
+
+// jsonWriter writes each message to w as a line of JSON.
+type jsonWriter struct {
+	w       io.Writer
+	timeNow func() time.Time // or nil for time.Now
+}
+
+type jsonLine struct {
+	Time string `json:"time"`
+	Msg  string `json:"msg"`
+}
+
+func (j *jsonWriter) Write(buf []byte) (int, error) {
+	now := time.Now
+	if j.timeNow != nil {
+		now = j.timeNow
+	}
+	b, err := json.Marshal(jsonLine{
+		Time: now().UTC().Format(time.RFC3339Nano),
+		Msg:  strings.TrimSuffix(string(buf), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := j.w.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+const (
+	defaultMaxFileSize = 10 << 20
+	defaultKeepFiles   = 3
+)
+
+// RotatingFile is an io.Writer that appends to a file, and once the
+// file reaches a maximum size, renames it to <path>.1 (shifting older
+// ones to <path>.2 and so on) and starts a new one.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int // number of old files to keep
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFile opens path for appending, keeping it under maxSize
+// bytes and keeping keep older files.
+func NewRotatingFile(path string, maxSize int64, keep int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens r.path for appending.
+//
+// r.mu must be held, or r not yet shared.
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+// rotateLocked moves the current file aside and opens a new one.
+//
+// r.mu must be held.
+func (r *RotatingFile) rotateLocked() error {
+	r.f.Close()
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+	for i := r.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.keep > 0 {
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) Write(buf []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(buf)) > r.maxSize {
+		if err := r.rotateLocked(); err != nil {
+			r.f = nil
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(buf)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logsink
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpen(t *testing.T) {
+	for _, spec := range []string{"", "stderr", "json", "json:stderr"} {
+		s, err := Open(spec, "test")
+		if err != nil {
+			t.Errorf("Open(%q): %v", spec, err)
+			continue
+		}
+		s.Close()
+	}
+	for _, spec := range []string{"bogus", "file:", "json:bogus"} {
+		if _, err := Open(spec, "test"); err == nil {
+			t.Errorf("Open(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestJSONWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &jsonWriter{
+		w:       &buf,
+		timeNow: func() time.Time { return time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC) },
+	}
+	msg := "hello \"world\"\n"
+	n, err := w.Write([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(msg) {
+		t.Errorf("n = %d; want %d", n, len(msg))
+	}
+	want := `{"time":"2020-08-01T12:00:00Z","msg":"hello \"world\""}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logsink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log")
+
+	r, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, msg := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := r.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{
+		path:        "dddddd\n",
+		path + ".1": "cccccc\n",
+		path + ".2": "bbbbbb\n",
+	}
+	for p, w := range want {
+		got, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(got) != w {
+			t.Errorf("%s = %q; want %q", p, got, w)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists; want only 2 old files", path)
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build windows plan9
+
+package logsink
+
+import (
+	"errors"
+	"io"
+)
+
+func newSyslog(ident string) (io.WriteCloser, error) {
+	return nil, errors.New("not available on this platform")
+}
@@ -27,6 +27,7 @@ import (
 
 	"golang.org/x/crypto/ssh/terminal"
 	"tailscale.com/atomicfile"
+	"tailscale.com/log/logsink"
 	"tailscale.com/logtail"
 	"tailscale.com/logtail/filch"
 	"tailscale.com/net/netns"
@@ -48,6 +49,9 @@ type Policy struct {
 	Logtail logtail.Logger
 	// PublicID is the logger's instance identifier.
 	PublicID logtail.PublicID
+	// NoLogs is whether log uploads are disabled, in which case
+	// Logtail is nil. See NewNoLogs.
+	NoLogs bool
 }
 
 // ToBytes returns the JSON representation of c.
@@ -287,9 +291,84 @@ func tryFixLogStateLocation(dir, cmdname string) {
 	}
 }
 
-// New returns a new log policy (a logger and its instance ID) for a
-// given collection name.
-func New(collection string) *Policy {
+// NewNoLogs returns a log policy that never uploads logs, for
+// environments that forbid any telemetry. Logs only go to stderr, and
+// nothing is buffered on disk for later upload. Its PublicID is
+// random on every run, as the control server still wants one, and
+// identifies no logs.
+//
+// Without logs, Tailscale can't help debug problems with the node.
+func NewNoLogs() *Policy {
+	log.SetFlags(0) // console has its own flags
+	log.SetOutput(logWriter{newConsole()})
+	log.Printf("Program starting: v%v, Go %v: %#v\n",
+		version.LONG,
+		strings.TrimPrefix(runtime.Version(), "go"),
+		os.Args)
+	log.Printf("LogID: none (no-logs-no-support: log uploads are disabled)")
+	priv, err := logtail.NewPrivateID()
+	if err != nil {
+		log.Fatalf("logpolicy: NewPrivateID() should never fail")
+	}
+	return &Policy{
+		PublicID: priv.Public(),
+		NoLogs:   true,
+	}
+}
+
+// localSink is where logs are written locally, or nil for stderr.
+// See SetLocalSink.
+var localSink *logsink.Sink
+
+// instance is the name of this instance of the program, if it's not
+// the only one. See SetInstance.
+var instance string
+
+// SetInstance sets the name of this instance of the program, for
+// hosts running several, such as tailscaled for two tailnets. Each
+// instance keeps its own log ID and log buffer.
+//
+// It must be called before New.
+func SetInstance(name string) {
+	instance = name
+}
+
+// stateName returns the base name of the files in which this
+// instance keeps its log state.
+func stateName() string {
+	if instance != "" {
+		return version.CmdName() + "-" + instance
+	}
+	return version.CmdName()
+}
+
+// SetLocalSink sets where logs are written locally, in addition to
+// being uploaded, to spec, one of logsink.Specs. The default is
+// stderr.
+//
+// It must be called before New or NewNoLogs.
+func SetLocalSink(spec string) error {
+	if spec == "" || spec == "stderr" {
+		localSink = nil
+		return nil
+	}
+	s, err := logsink.Open(spec, version.CmdName())
+	if err != nil {
+		return err
+	}
+	localSink = s
+	return nil
+}
+
+// newConsole returns the logger for writing logs locally.
+func newConsole() *log.Logger {
+	if localSink != nil {
+		var lflags int
+		if localSink.Timestamps {
+			lflags = log.LstdFlags
+		}
+		return log.New(localSink, "", lflags)
+	}
 	var lflags int
 	if terminal.IsTerminal(2) || runtime.GOOS == "windows" {
 		lflags = 0
@@ -301,7 +380,13 @@ func New(collection string) *Policy {
 		// anyway, no need to add one.
 		lflags = 0
 	}
-	console := log.New(stderrWriter{}, "", lflags)
+	return log.New(stderrWriter{}, "", lflags)
+}
+
+// New returns a new log policy (a logger and its instance ID) for a
+// given collection name.
+func New(collection string) *Policy {
+	console := newConsole()
 
 	dir := logsDir()
 
@@ -309,7 +394,7 @@ func New(collection string) *Policy {
 		tryFixLogStateLocation(dir, version.CmdName())
 	}
 
-	cfgPath := filepath.Join(dir, fmt.Sprintf("%s.log.conf", version.CmdName()))
+	cfgPath := filepath.Join(dir, fmt.Sprintf("%s.log.conf", stateName()))
 	var oldc *Config
 	data, err := ioutil.ReadFile(cfgPath)
 	if err != nil {
@@ -359,7 +444,7 @@ func New(collection string) *Policy {
 		HTTPC: &http.Client{Transport: newLogtailTransport(logtail.DefaultHost)},
 	}
 
-	filchBuf, filchErr := filch.New(filepath.Join(dir, version.CmdName()), filch.Options{})
+	filchBuf, filchErr := filch.New(filepath.Join(dir, stateName()), filch.Options{})
 	if filchBuf != nil {
 		c.Buffer = filchBuf
 	}
@@ -26,6 +26,9 @@ type Backoff struct {
 	// LogLongerThan sets the minimum time of a single backoff interval
 	// before we mention it in the log.
 	LogLongerThan time.Duration
+	// OnDelay, if non-nil, is called with the length of each backoff
+	// interval as it starts, and with zero once backing off stops.
+	OnDelay func(d time.Duration)
 }
 
 func NewBackoff(name string, logf logger.Logf) Backoff {
@@ -52,6 +55,9 @@ func (b *Backoff) BackOff(ctx context.Context, err error) {
 		if dur >= b.LogLongerThan {
 			b.logf("%s: backoff: %d msec\n", b.name, msec)
 		}
+		if b.OnDelay != nil {
+			b.OnDelay(dur)
+		}
 		t := b.NewTimer(dur)
 		select {
 		case <-ctx.Done():
@@ -61,5 +67,8 @@ func (b *Backoff) BackOff(ctx context.Context, err error) {
 	} else {
 		// not a regular error
 		b.n = 0
+		if b.OnDelay != nil {
+			b.OnDelay(0)
+		}
 	}
 }
@@ -14,6 +14,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"tailscale.com/logtail/backoff"
@@ -24,6 +25,10 @@ import (
 // Config.BaseURL isn't provided.
 const DefaultHost = "log.tailscale.io"
 
+// meteredUploadDelay is how long uploads are held back, at most, while
+// the network is metered. Logs written meanwhile go out in one batch.
+const meteredUploadDelay = 10 * time.Minute
+
 type Logger interface {
 	// Write logs an encoded JSON blob.
 	//
@@ -50,6 +55,10 @@ type Logger interface {
 	//
 	// DEPRECATED: use Shutdown
 	Close()
+
+	// SetMetered sets whether the network is metered. While it is,
+	// logs are uploaded in larger, less frequent batches.
+	SetMetered(bool)
 }
 
 type Encoder interface {
@@ -139,6 +148,10 @@ type logger struct {
 
 	shutdownStart chan struct{} // closed when shutdown begins
 	shutdownDone  chan struct{} // closd when shutdown complete
+
+	meteredMu sync.Mutex
+	metered   bool
+	unmetered chan struct{} // closed when metered becomes false
 }
 
 func (l *logger) Shutdown(ctx context.Context) error {
@@ -167,6 +180,40 @@ func (l *logger) Close() {
 	l.Shutdown(context.Background())
 }
 
+func (l *logger) SetMetered(metered bool) {
+	l.meteredMu.Lock()
+	defer l.meteredMu.Unlock()
+	if metered == l.metered {
+		return
+	}
+	l.metered = metered
+	if metered {
+		l.unmetered = make(chan struct{})
+	} else {
+		close(l.unmetered)
+	}
+}
+
+// awaitUpload is called before draining each batch of logs. If the
+// network is metered, it waits until it no longer is, until
+// meteredUploadDelay passes, or until shutdown begins.
+func (l *logger) awaitUpload(ctx context.Context) {
+	l.meteredMu.Lock()
+	metered, unmetered := l.metered, l.unmetered
+	l.meteredMu.Unlock()
+	if !metered {
+		return
+	}
+	t := time.NewTimer(meteredUploadDelay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-unmetered:
+	case <-l.shutdownStart:
+	case <-ctx.Done():
+	}
+}
+
 // drainBlock is called by drainPending when there are no logs to drain.
 //
 // In typical operation, every call to the Write method unblocks and triggers
@@ -191,6 +238,9 @@ func (l *logger) drainBlock() (shuttingDown bool) {
 	return false
 }
 
+// maxBatchLen is the size after which drainPending ends a batch.
+const maxBatchLen = 256 << 10
+
 // drainPending drains and encodes a batch of logs from the buffer for upload.
 // If no logs are available, drainPending blocks until logs are available.
 func (l *logger) drainPending() (res []byte) {
@@ -198,8 +248,7 @@ func (l *logger) drainPending() (res []byte) {
 	entries := 0
 
 	var batchDone bool
-	const maxLen = 256 << 10
-	for buf.Len() < maxLen && !batchDone {
+	for buf.Len() < maxBatchLen && !batchDone {
 		b, err := l.buffer.TryReadLine()
 		if err == io.EOF {
 			break
@@ -257,8 +306,13 @@ func (l *logger) drainPending() (res []byte) {
 func (l *logger) uploading(ctx context.Context) {
 	defer close(l.shutdownDone)
 
+	full := false // whether the last batch was cut short by maxLen
 	for {
+		if !full {
+			l.awaitUpload(ctx)
+		}
 		body := l.drainPending()
+		full = len(body) >= maxBatchLen
 		if l.zstdEncoder != nil {
 			body = l.zstdEncoder.EncodeAll(body, nil)
 		}
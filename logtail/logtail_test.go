@@ -6,6 +6,10 @@ package logtail
 
 import (
 	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -32,3 +36,41 @@ func TestLoggerEncodeTextAllocs(t *testing.T) {
 		t.Logf("allocs = %d; want 1", int(n))
 	}
 }
+
+func TestMeteredDefersUpload(t *testing.T) {
+	uploads := make(chan string, 16)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		uploads <- string(b)
+	}))
+	defer ts.Close()
+
+	l := Log(Config{BaseURL: ts.URL}, t.Logf)
+	defer l.Shutdown(context.Background())
+	<-uploads // "logtail started"
+
+	l.SetMetered(true)
+	// The uploader may already be blocked waiting for logs, in which
+	// case the first write after going metered still goes out.
+	l.Write([]byte("one"))
+	select {
+	case <-uploads:
+	case <-time.After(200 * time.Millisecond):
+	}
+	l.Write([]byte("two"))
+	select {
+	case b := <-uploads:
+		t.Fatalf("uploaded %q while metered", b)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	l.SetMetered(false)
+	select {
+	case b := <-uploads:
+		if !strings.Contains(b, "two") {
+			t.Errorf("upload = %q; want it to contain %q", b, "two")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no upload after network became unmetered")
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnsfallback resolves host names when the system DNS is
+// broken, so that a node can always reach its control server.
+//
+// It matters most when the system's resolv.conf points at a resolver
+// only reachable over Tailscale (or one Tailscale itself configured
+// and is no longer running): without control, the node can't get the
+// network map it needs to bring that resolver back.
+package dnsfallback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"tailscale.com/derp/derpmap"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/tlsdial"
+)
+
+// fallbackDelay is how long the system resolver gets to answer on its
+// own before the fallbacks are tried too.
+const fallbackDelay = 2 * time.Second
+
+// publicResolvers are well-known public DNS servers, asked directly
+// over UDP.
+var publicResolvers = []string{
+	"8.8.8.8",
+	"1.1.1.1",
+	"9.9.9.9",
+}
+
+type lookupFunc func(ctx context.Context, host string) ([]net.IP, error)
+
+// resolver races the system resolver against the fallbacks.
+type resolver struct {
+	system    lookupFunc
+	fallbacks []lookupFunc
+	delay     time.Duration
+}
+
+var defaultResolver = &resolver{
+	system:    systemLookup,
+	fallbacks: defaultFallbacks(),
+	delay:     fallbackDelay,
+}
+
+// Lookup returns the IP addresses of host.
+//
+// It asks the system resolver first. If that fails, or hasn't
+// answered within a couple of seconds, host is also looked up via the
+// bootstrap DNS endpoints of Tailscale's DERP servers (over HTTPS, to
+// their hardcoded IPs) and via well-known public DNS servers, and the
+// first answer wins.
+func Lookup(ctx context.Context, host string) ([]net.IP, error) {
+	return defaultResolver.lookup(ctx, host)
+}
+
+func (r *resolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		ips    []net.IP
+		err    error
+		system bool
+	}
+	ch := make(chan result, 1+len(r.fallbacks)) // buffered so losers don't block
+	run := func(f lookupFunc, system bool) {
+		ips, err := f(ctx, host)
+		if err == nil && len(ips) == 0 {
+			err = fmt.Errorf("no IPs for %q found", host)
+		}
+		ch <- result{ips, err, system}
+	}
+	go run(r.system, true)
+	pending := 1
+
+	timer := time.NewTimer(r.delay)
+	defer timer.Stop()
+	startedFallbacks := false
+	startFallbacks := func() {
+		if startedFallbacks {
+			return
+		}
+		startedFallbacks = true
+		for _, f := range r.fallbacks {
+			go run(f, false)
+			pending++
+		}
+	}
+
+	var systemErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			startFallbacks()
+		case res := <-ch:
+			pending--
+			if res.err == nil {
+				return res.ips, nil
+			}
+			// Report the system resolver's error if everything
+			// fails; it's the one the user can do something about.
+			if res.system {
+				systemErr = res.err
+			}
+			startFallbacks()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, systemErr
+}
+
+func systemLookup(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+func defaultFallbacks() []lookupFunc {
+	var fs []lookupFunc
+	dm := derpmap.Prod()
+	for _, id := range dm.RegionIDs() {
+		for _, n := range dm.Regions[id].Nodes {
+			if ip := net.ParseIP(n.IPv4); ip != nil {
+				fs = append(fs, derpLookup(n.HostName, ip))
+			}
+		}
+	}
+	for _, ip := range publicResolvers {
+		fs = append(fs, publicLookup(ip))
+	}
+	return fs
+}
+
+// publicLookup returns a lookupFunc that asks the DNS server at ip.
+func publicLookup(ip string) lookupFunc {
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return netns.NewDialer().DialContext(ctx, network, net.JoinHostPort(ip, "53"))
+		},
+	}
+	return func(ctx context.Context, host string) ([]net.IP, error) {
+		addrs, err := r.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]net.IP, len(addrs))
+		for i, a := range addrs {
+			ips[i] = a.IP
+		}
+		return ips, nil
+	}
+}
+
+// derpLookup returns a lookupFunc that asks the bootstrap DNS endpoint
+// of the DERP server derpHost, dialing it at ip. The server's TLS
+// certificate is still verified against derpHost.
+func derpLookup(derpHost string, ip net.IP) lookupFunc {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = nil
+	tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return netns.NewDialer().DialContext(ctx, network, net.JoinHostPort(ip.String(), "443"))
+	}
+	tr.TLSClientConfig = tlsdial.Config(derpHost, nil)
+	c := &http.Client{Transport: tr}
+	return func(ctx context.Context, host string) ([]net.IP, error) {
+		u := "https://" + derpHost + "/bootstrap-dns?q=" + url.QueryEscape(host)
+		return bootstrapDNS(ctx, c, u, host)
+	}
+}
+
+// bootstrapDNS fetches u, a DERP server's /bootstrap-dns endpoint, and
+// returns the addresses it lists for host.
+func bootstrapDNS(ctx context.Context, c *http.Client, u, host string) ([]net.IP, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, errors.New(res.Status)
+	}
+	var m map[string][]net.IP
+	if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("bootstrap DNS: %v", err)
+	}
+	return m[host], nil
+}
+
+// DialContext returns a func, for use as an http.Transport's
+// DialContext, that dials using d and resolves host names with Lookup.
+// If d goes through a SOCKS proxy, it's returned unchanged, as the
+// proxy does the resolving.
+func DialContext(d netns.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if netns.IsSOCKSDialer(d) {
+		return d.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := Lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, ip := range ips {
+			c, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return c, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil, firstErr
+	}
+}
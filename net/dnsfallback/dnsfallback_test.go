@@ -0,0 +1,107 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsfallback
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func fixed(ip string, err error) lookupFunc {
+	return func(ctx context.Context, host string) ([]net.IP, error) {
+		if err != nil {
+			return nil, err
+		}
+		return []net.IP{net.ParseIP(ip)}, nil
+	}
+}
+
+func hang(ctx context.Context, host string) ([]net.IP, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestLookup(t *testing.T) {
+	errSystem := errors.New("system DNS broken")
+	errFallback := errors.New("fallback broken")
+	tests := []struct {
+		name      string
+		system    lookupFunc
+		fallbacks []lookupFunc
+		want      string
+		wantErr   error
+	}{
+		{
+			name:      "system_ok",
+			system:    fixed("1.2.3.4", nil),
+			fallbacks: []lookupFunc{fixed("5.6.7.8", nil)},
+			want:      "1.2.3.4",
+		},
+		{
+			name:      "system_fails",
+			system:    fixed("", errSystem),
+			fallbacks: []lookupFunc{fixed("", errFallback), fixed("5.6.7.8", nil)},
+			want:      "5.6.7.8",
+		},
+		{
+			name:      "system_hangs",
+			system:    hang,
+			fallbacks: []lookupFunc{fixed("5.6.7.8", nil)},
+			want:      "5.6.7.8",
+		},
+		{
+			name:      "all_fail",
+			system:    fixed("", errSystem),
+			fallbacks: []lookupFunc{fixed("", errFallback), fixed("", errFallback)},
+			wantErr:   errSystem,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &resolver{system: tt.system, fallbacks: tt.fallbacks, delay: 10 * time.Millisecond}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ips, err := r.lookup(ctx, "control.example.com")
+			if err != tt.wantErr {
+				t.Fatalf("err = %v; want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(ips) != 1 || ips[0].String() != tt.want {
+				t.Errorf("ips = %v; want %v", ips, tt.want)
+			}
+		})
+	}
+}
+
+func TestBootstrapDNS(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bootstrap-dns" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `{"control.example.com":["1.2.3.4","2001:db8::1"],"other.example.com":["5.6.7.8"]}`)
+	}))
+	defer ts.Close()
+
+	ips, err := bootstrapDNS(context.Background(), ts.Client(), ts.URL+"/bootstrap-dns?q=control.example.com", "control.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || ips[0].String() != "1.2.3.4" || ips[1].String() != "2001:db8::1" {
+		t.Errorf("ips = %v", ips)
+	}
+
+	if _, err := bootstrapDNS(context.Background(), ts.Client(), ts.URL+"/nope", "control.example.com"); err == nil {
+		t.Error("expected error for 404")
+	}
+}
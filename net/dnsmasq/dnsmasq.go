@@ -0,0 +1,130 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnsmasq configures a local dnsmasq DHCP server to hand out
+// Tailscale's DNS resolver to LAN clients.
+//
+// On a subnet router that's also the LAN's DHCP server (typical for
+// OpenWrt), this makes MagicDNS names resolve for the whole LAN, not
+// just the router.
+package dnsmasq
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"inet.af/netaddr"
+	"tailscale.com/atomicfile"
+	"tailscale.com/types/logger"
+)
+
+// DefaultConfPath returns the default location of the config file
+// Advertiser writes, in the directory dnsmasq reads extra config from.
+func DefaultConfPath() string {
+	if isOpenWrt() {
+		return "/tmp/dnsmasq.d/tailscale.conf"
+	}
+	return "/etc/dnsmasq.d/tailscale.conf"
+}
+
+// DefaultReloadCommand returns the default command to make dnsmasq
+// pick up config changes. dnsmasq only rereads its DHCP options on
+// restart, not on SIGHUP.
+func DefaultReloadCommand() string {
+	if isOpenWrt() {
+		return "/etc/init.d/dnsmasq restart"
+	}
+	return "systemctl restart dnsmasq"
+}
+
+func isOpenWrt() bool {
+	_, err := os.Stat("/etc/openwrt_release")
+	return err == nil
+}
+
+// Advertiser maintains a dnsmasq config file that sets the DNS server
+// option in DHCP replies.
+type Advertiser struct {
+	confPath string
+	reload   func() error
+	logf     logger.Logf
+
+	mu   sync.Mutex
+	cur  netaddr.IP // currently advertised; zero if none
+	init bool       // whether cur reflects the file
+}
+
+// New returns an Advertiser that writes confPath and runs reloadCmd,
+// a space-separated command line, after changing it.
+func New(logf logger.Logf, confPath, reloadCmd string) *Advertiser {
+	args := strings.Fields(reloadCmd)
+	return &Advertiser{
+		confPath: confPath,
+		logf:     logger.WithPrefix(logf, "dnsmasq: "),
+		reload: func() error {
+			if len(args) == 0 {
+				return nil
+			}
+			out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%s: %v: %s", reloadCmd, err, bytes.TrimSpace(out))
+			}
+			return nil
+		},
+	}
+}
+
+// Set makes dnsmasq advertise ip as the DNS server to DHCP clients,
+// or stop advertising one if ip is zero. dnsmasq is only reloaded if
+// that changes anything.
+//
+// Clients only pick up the change when they renew their lease.
+func (a *Advertiser) Set(ip netaddr.IP) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.init && ip == a.cur {
+		return nil
+	}
+
+	old, err := ioutil.ReadFile(a.confPath)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	switch {
+	case ip.IsZero() && !exists, !ip.IsZero() && exists && bytes.Equal(old, confContents(ip)):
+		// Already as wanted, maybe from before a restart.
+	case ip.IsZero():
+		if err := os.Remove(a.confPath); err != nil {
+			return err
+		}
+		a.logf("no longer advertising DNS to DHCP clients")
+		if err := a.reload(); err != nil {
+			return err
+		}
+	default:
+		if err := os.MkdirAll(filepath.Dir(a.confPath), 0755); err != nil {
+			return err
+		}
+		if err := atomicfile.WriteFile(a.confPath, confContents(ip), 0644); err != nil {
+			return err
+		}
+		a.logf("advertising %v as DNS to DHCP clients", ip)
+		if err := a.reload(); err != nil {
+			return err
+		}
+	}
+	a.cur, a.init = ip, true
+	return nil
+}
+
+func confContents(ip netaddr.IP) []byte {
+	return []byte(fmt.Sprintf("# Generated by tailscaled; removed when Tailscale DNS is off.\ndhcp-option=option:dns-server,%v\n", ip))
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsmasq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestAdvertiser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dnsmasq.d", "tailscale.conf")
+	a := New(t.Logf, path, "")
+	reloads := 0
+	a.reload = func() error {
+		reloads++
+		return nil
+	}
+
+	ip := netaddr.IPv4(100, 100, 100, 100)
+	steps := []struct {
+		ip          netaddr.IP
+		wantFile    bool
+		wantReloads int
+	}{
+		{netaddr.IP{}, false, 0}, // nothing to remove
+		{ip, true, 1},
+		{ip, true, 1}, // unchanged
+		{netaddr.IP{}, false, 2},
+		{netaddr.IP{}, false, 2},
+	}
+	for i, st := range steps {
+		if err := a.Set(st.ip); err != nil {
+			t.Fatalf("%d: Set(%v): %v", i, st.ip, err)
+		}
+		_, err := os.Stat(path)
+		if gotFile := err == nil; gotFile != st.wantFile {
+			t.Errorf("%d: file exists = %v; want %v", i, gotFile, st.wantFile)
+		}
+		if reloads != st.wantReloads {
+			t.Errorf("%d: reloads = %d; want %d", i, reloads, st.wantReloads)
+		}
+	}
+
+	// A file left over from a previous run that matches isn't
+	// rewritten, and dnsmasq isn't restarted for it.
+	if err := a.Set(ip); err != nil {
+		t.Fatal(err)
+	}
+	b := New(t.Logf, path, "")
+	b.reload = func() error {
+		t.Error("unexpected reload")
+		return nil
+	}
+	if err := b.Set(ip); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,6 +6,7 @@
 package interfaces
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"reflect"
@@ -145,6 +146,57 @@ func ForeachInterfaceAddress(fn func(Interface, netaddr.IP)) error {
 	return nil
 }
 
+// LocalSubnets returns the subnets of the addresses on the machine's
+// up interfaces, other than Tailscale's and loopback: the local
+// networks it's directly connected to. Link-local and single-address
+// subnets are left out.
+func LocalSubnets() ([]netaddr.IPPrefix, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ret []netaddr.IPPrefix
+	seen := map[netaddr.IPPrefix]bool{}
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if !isUp(iface) || isLoopback(iface) || maybeTailscaleInterfaceName(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if p, ok := localSubnet(ipnet); ok && !seen[p] {
+				seen[p] = true
+				ret = append(ret, p)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// localSubnet returns the subnet of the interface address ipnet, if
+// it's a local network's, as LocalSubnets defines it.
+func localSubnet(ipnet *net.IPNet) (netaddr.IPPrefix, bool) {
+	ones, bits := ipnet.Mask.Size()
+	if ones == bits || bits == 0 {
+		return netaddr.IPPrefix{}, false // a single address, or a non-canonical mask
+	}
+	if ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+		return netaddr.IPPrefix{}, false
+	}
+	ip, ok := netaddr.FromStdIP(ipnet.IP.Mask(ipnet.Mask))
+	if !ok || tsaddr.IsTailscaleIP(ip) || tsaddr.TailscaleULARange().Contains(ip) {
+		return netaddr.IPPrefix{}, false
+	}
+	return netaddr.IPPrefix{IP: ip, Bits: uint8(ones)}, true
+}
+
 // State is intended to store the state of the machine's network interfaces,
 // routing table, and other network configuration.
 // For now it's pretty basic.
@@ -231,6 +283,42 @@ func HTTPOfListener(ln net.Listener) string {
 
 }
 
+var defaultRouteInterface func() (string, error)
+
+// DefaultRouteInterface returns the name of the network interface
+// that has the default route, not counting Tailscale's own. On
+// platforms where the routing table isn't read, it returns the only
+// interface that's up and has a non-loopback address, if there's
+// exactly one.
+func DefaultRouteInterface() (string, error) {
+	if defaultRouteInterface != nil {
+		return defaultRouteInterface()
+	}
+	var name string
+	multiple := false
+	err := ForeachInterfaceAddress(func(i Interface, ip netaddr.IP) {
+		if !i.IsUp() || i.IsLoopback() || ip.IsLoopback() || maybeTailscaleInterfaceName(i.Name) {
+			return
+		}
+		if ip.IPAddr().IP.IsLinkLocalUnicast() {
+			return // every interface has one; doesn't mean it's in use
+		}
+		if name != "" && name != i.Name {
+			multiple = true
+		}
+		name = i.Name
+	})
+	switch {
+	case err != nil:
+		return "", err
+	case multiple:
+		return "", errors.New("multiple interfaces are up; can't tell which has the default route")
+	case name == "":
+		return "", errors.New("no interfaces are up")
+	}
+	return name, nil
+}
+
 var likelyHomeRouterIP func() (netaddr.IP, bool)
 
 // LikelyHomeRouterIP returns the likely IP of the residential router,
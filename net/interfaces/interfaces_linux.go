@@ -5,6 +5,10 @@
 package interfaces
 
 import (
+	"errors"
+	"strconv"
+	"strings"
+
 	"go4.org/mem"
 	"inet.af/netaddr"
 	"tailscale.com/util/lineread"
@@ -12,6 +16,7 @@ import (
 
 func init() {
 	likelyHomeRouterIP = likelyHomeRouterIPLinux
+	defaultRouteInterface = defaultRouteInterfaceLinux
 }
 
 /*
@@ -57,3 +62,52 @@ func likelyHomeRouterIPLinux() (ret netaddr.IP, ok bool) {
 	})
 	return ret, !ret.IsZero()
 }
+
+/*
+Parse ens18 out of:
+
+$ cat /proc/net/route
+Iface   Destination     Gateway         Flags   RefCnt  Use     Metric  Mask            MTU     Window  IRTT
+ens18   00000000        0100000A        0003    0       0       0       00000000        0       0       0
+ens18   0000000A        00000000        0001    0       0       0       0000FFFF        0       0       0
+*/
+func defaultRouteInterfaceLinux() (string, error) {
+	return defaultRouteInterfaceProcNet("/proc/net/route")
+}
+
+func defaultRouteInterfaceProcNet(file string) (string, error) {
+	lineNum := 0
+	var ret string
+	err := lineread.File(file, func(line []byte) error {
+		lineNum++
+		if lineNum == 1 || ret != "" {
+			// Skip header line, and everything after the answer.
+			return nil
+		}
+		f := strings.Fields(string(line))
+		if len(f) < 8 {
+			return nil
+		}
+		ifc, dst, flagsHex, mask := f[0], f[1], f[3], f[7]
+		if dst != "00000000" || mask != "00000000" {
+			return nil
+		}
+		flags, err := strconv.ParseUint(flagsHex, 16, 16)
+		if err != nil {
+			return nil // ignore error, skip line and keep going
+		}
+		const RTF_UP = 0x0001
+		if flags&RTF_UP == 0 || maybeTailscaleInterfaceName(ifc) {
+			return nil
+		}
+		ret = ifc
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if ret == "" {
+		return "", errors.New("no default route found")
+	}
+	return ret, nil
+}
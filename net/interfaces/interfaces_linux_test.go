@@ -0,0 +1,60 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interfaces
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultRouteInterfaceProcNet(t *testing.T) {
+	const header = "Iface\tDestination\tGateway\tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+	tests := []struct {
+		name    string
+		routes  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "simple",
+			routes: "ens18\t00000000\t0100000A\t0003\t0\t0\t0\t00000000\t0\t0\t0\n" +
+				"ens18\t0000000A\t00000000\t0001\t0\t0\t0\t0000FFFF\t0\t0\t0\n",
+			want: "ens18",
+		},
+		{
+			name: "skip_tailscale",
+			routes: "tailscale0\t00000000\t00000000\t0001\t0\t0\t0\t00000000\t0\t0\t0\n" +
+				"wlan0\t00000000\t0101A8C0\t0003\t0\t0\t600\t00000000\t0\t0\t0\n",
+			want: "wlan0",
+		},
+		{
+			name:    "no_default",
+			routes:  "ens18\t0000000A\t00000000\t0001\t0\t0\t0\t0000FFFF\t0\t0\t0\n",
+			wantErr: true,
+		},
+	}
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, tt.name)
+			if err := ioutil.WriteFile(file, []byte(header+tt.routes), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := defaultRouteInterfaceProcNet(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -56,3 +56,37 @@ func TestLikelyHomeRouterIP(t *testing.T) {
 	}
 	t.Logf("myIP = %v; gw = %v", my, gw)
 }
+
+func TestLocalSubnet(t *testing.T) {
+	tests := []struct {
+		addr string // interface address, as CIDR
+		want string // subnet, or empty if none
+	}{
+		{"192.168.1.23/24", "192.168.1.0/24"},
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{"2001:db8:1:2::17/64", "2001:db8:1:2::/64"},
+		{"192.168.1.23/32", ""},
+		{"127.0.0.1/8", ""},
+		{"169.254.10.1/16", ""},
+		{"fe80::1/64", ""},
+		{"100.101.102.103/10", ""},
+		{"fd7a:115c:a1e0:ab12::1/64", ""},
+	}
+	for _, tt := range tests {
+		ip, ipnet, err := net.ParseCIDR(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipnet.IP = ip // as an interface address has it
+		got, ok := localSubnet(ipnet)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("localSubnet(%s) = %v; want none", tt.addr, got)
+			}
+			continue
+		}
+		if !ok || got.String() != tt.want {
+			t.Errorf("localSubnet(%s) = %v, %v; want %s", tt.addr, got, ok, tt.want)
+		}
+	}
+}
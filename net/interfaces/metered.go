@@ -0,0 +1,50 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interfaces
+
+import (
+	"strings"
+)
+
+var isMetered func(ifName string) (bool, error)
+
+// IsMetered reports whether the OS considers the network reached via
+// the interface ifName to be metered: billed by usage, or otherwise
+// something to use sparingly, like a phone's hotspot.
+//
+// It's only known on Linux with NetworkManager and on Windows. On
+// Windows, ifName is ignored and the internet connection's cost is
+// used. Elsewhere, IsMetered always reports false.
+func IsMetered(ifName string) (bool, error) {
+	if isMetered == nil || ifName == "" {
+		return false, nil
+	}
+	return isMetered(ifName)
+}
+
+// parseNMCLIMetered parses the output of
+// "nmcli -t -f GENERAL.METERED device show <dev>", which is a line
+// like "GENERAL.METERED:yes (guessed)". NetworkManager guesses a
+// connection is metered when, for instance, it's to an Android
+// phone's hotspot; those guesses are trusted.
+func parseNMCLIMetered(out string) bool {
+	out = strings.TrimSpace(out)
+	out = strings.TrimPrefix(out, "GENERAL.METERED:")
+	return strings.HasPrefix(out, "yes")
+}
+
+// NLM_CONNECTION_COST flags, as returned by Windows'
+// INetworkCostManager.GetCost.
+const (
+	nlmCostUnrestricted = 0x1
+	nlmCostFixed        = 0x2 // a data cap
+	nlmCostVariable     = 0x4 // billed per byte
+)
+
+// windowsCostIsMetered reports whether the Windows connection cost
+// flags in cost describe a metered network.
+func windowsCostIsMetered(cost uint32) bool {
+	return cost&(nlmCostFixed|nlmCostVariable) != 0
+}
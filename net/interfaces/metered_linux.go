@@ -0,0 +1,26 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interfaces
+
+import (
+	"os/exec"
+)
+
+func init() {
+	isMetered = isMeteredLinux
+}
+
+// isMeteredLinux asks NetworkManager, if it's installed.
+func isMeteredLinux(ifName string) (bool, error) {
+	nmcli, err := exec.LookPath("nmcli")
+	if err != nil {
+		return false, nil // no NetworkManager; nobody to ask
+	}
+	out, err := exec.Command(nmcli, "-t", "-f", "GENERAL.METERED", "device", "show", ifName).Output()
+	if err != nil {
+		return false, err
+	}
+	return parseNMCLIMetered(string(out)), nil
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interfaces
+
+import "testing"
+
+func TestParseMetered(t *testing.T) {
+	nmcli := []struct {
+		in   string
+		want bool
+	}{
+		{"GENERAL.METERED:yes\n", true},
+		{"GENERAL.METERED:yes (guessed)\n", true},
+		{"GENERAL.METERED:no\n", false},
+		{"GENERAL.METERED:no (guessed)\n", false},
+		{"GENERAL.METERED:unknown\n", false},
+		{"", false},
+	}
+	for _, tt := range nmcli {
+		if got := parseNMCLIMetered(tt.in); got != tt.want {
+			t.Errorf("parseNMCLIMetered(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+
+	windows := []struct {
+		in   uint32
+		want bool
+	}{
+		{0, false},
+		{nlmCostUnrestricted, false},
+		{nlmCostFixed, true},
+		{nlmCostVariable, true},
+		{nlmCostFixed | 0x80000, true}, // approaching the data limit
+	}
+	for _, tt := range windows {
+		if got := windowsCostIsMetered(tt.in); got != tt.want {
+			t.Errorf("windowsCostIsMetered(%#x) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interfaces
+
+import (
+	"runtime"
+
+	"github.com/go-ole/go-ole"
+	"tailscale.com/wgengine/winnet"
+)
+
+func init() {
+	isMetered = isMeteredWindows
+}
+
+// isMeteredWindows asks the Network List Manager for the cost of the
+// machine's internet connectivity, which Windows' own metered
+// connection setting feeds.
+func isMeteredWindows(ifName string) (bool, error) {
+	// COM is initialized per thread.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	c := ole.Connection{}
+	if err := c.Initialize(); err != nil {
+		return false, err
+	}
+	defer c.Uninitialize()
+
+	m, err := winnet.NewNetworkListManager(&c)
+	if err != nil {
+		return false, err
+	}
+	defer m.Release()
+
+	cm, err := m.GetCostManager()
+	if err != nil {
+		return false, err
+	}
+	defer cm.Release()
+
+	cost, err := cm.GetCost()
+	if err != nil {
+		return false, err
+	}
+	return windowsCostIsMetered(cost), nil
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mcastrelay
+
+import "net"
+
+// listenBroadcast returns a socket receiving broadcasts to port.
+// Unlike elsewhere, the port isn't shared with other programs, since
+// SO_REUSEADDR on Windows lets sockets steal each other's traffic.
+func listenBroadcast(port uint16) (*net.UDPConn, error) {
+	return net.ListenUDP("udp4", &net.UDPAddr{Port: int(port)})
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mcastrelay relays LAN multicast and broadcast traffic
+// between Tailscale nodes.
+//
+// WireGuard links are point to point, so discovery protocols such as
+// mDNS, SSDP and games' LAN server browsers, which multicast or
+// broadcast on the local network, don't reach across them. A Relay on
+// each of a set of designated nodes listens for chosen groups on its
+// LAN, sends what it hears to the other relays over Tailscale, and
+// sends what they relay to it onto its own LAN.
+//
+// It's experimental, and IPv4-only.
+package mcastrelay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+// DefaultPort is the UDP port relays send each other packets on.
+const DefaultPort = 41642
+
+// magic starts the packets relays send each other.
+var magic = []byte("tsmr")
+
+// headerLen is the length of the header before a relayed packet's
+// payload: magic, then the group's IPv4 address and port.
+const headerLen = 4 + 4 + 2
+
+// echoTimeout is how long a packet sent onto the LAN is remembered,
+// so that hearing it back isn't mistaken for new traffic.
+const echoTimeout = 2 * time.Second
+
+// Config is the configuration of a Relay.
+type Config struct {
+	// Groups are the multicast groups, or broadcast addresses, and
+	// the ports to relay, such as 224.0.0.251:5353 for mDNS.
+	Groups []netaddr.IPPort
+	// Peers are the Tailscale addresses of the other relays.
+	// Traffic is only relayed to and accepted from them.
+	Peers []netaddr.IP
+	// Interface is the name of the LAN interface to relay traffic
+	// from and to.
+	Interface string
+	// Port is the UDP port relays send each other packets on.
+	// If zero, DefaultPort is used.
+	Port uint16
+}
+
+// Relay relays multicast and broadcast traffic between its LAN and
+// other relays.
+type Relay struct {
+	logf   logger.Logf
+	peers  map[netaddr.IP]*net.UDPAddr
+	tunnel *net.UDPConn
+	// lan are the sockets listening for each group, which are
+	// also used to send relayed packets onto the LAN.
+	lan map[netaddr.IPPort]*net.UDPConn
+
+	mu sync.Mutex
+	// sent are the hashes of the packets recently sent onto the
+	// LAN, and when.
+	sent map[uint64]time.Time
+}
+
+// New returns a Relay for cfg, listening on its sockets.
+// Run must be called to relay traffic.
+func New(logf logger.Logf, cfg Config) (*Relay, error) {
+	if len(cfg.Groups) == 0 || len(cfg.Peers) == 0 {
+		return nil, errors.New("no groups or peers to relay to")
+	}
+	ifi, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Port == 0 {
+		cfg.Port = DefaultPort
+	}
+	r := &Relay{
+		logf:  logger.WithPrefix(logf, "mcastrelay: "),
+		peers: make(map[netaddr.IP]*net.UDPAddr, len(cfg.Peers)),
+		lan:   make(map[netaddr.IPPort]*net.UDPConn, len(cfg.Groups)),
+		sent:  make(map[uint64]time.Time),
+	}
+	for _, ip := range cfg.Peers {
+		r.peers[ip] = netaddr.IPPort{IP: ip, Port: cfg.Port}.UDPAddr()
+	}
+	r.tunnel, err = net.ListenUDP("udp4", &net.UDPAddr{Port: int(cfg.Port)})
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range cfg.Groups {
+		var c *net.UDPConn
+		if isMulticast(g.IP) {
+			c, err = net.ListenMulticastUDP("udp4", ifi, g.UDPAddr())
+		} else {
+			c, err = listenBroadcast(g.Port)
+		}
+		if err != nil {
+			r.close()
+			return nil, fmt.Errorf("listening for %v: %w", g, err)
+		}
+		r.lan[g] = c
+	}
+	return r, nil
+}
+
+// Run relays traffic until ctx is done, then closes r's sockets.
+func (r *Relay) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for g, c := range r.lan {
+		wg.Add(1)
+		go func(g netaddr.IPPort, c *net.UDPConn) {
+			defer wg.Done()
+			r.readLAN(g, c)
+		}(g, c)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.readTunnel()
+	}()
+	<-ctx.Done()
+	r.close()
+	wg.Wait()
+}
+
+func (r *Relay) close() {
+	if r.tunnel != nil {
+		r.tunnel.Close()
+	}
+	for _, c := range r.lan {
+		c.Close()
+	}
+}
+
+// readLAN relays the packets heard on c, which listens for g, to
+// the other relays.
+func (r *Relay) readLAN(g netaddr.IPPort, c *net.UDPConn) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := c.ReadFromUDP(buf[headerLen:])
+		if err != nil {
+			return
+		}
+		msg, ok := r.fromLAN(g, buf[:headerLen+n])
+		if !ok {
+			continue
+		}
+		for _, addr := range r.peers {
+			if _, err := r.tunnel.WriteToUDP(msg, addr); err != nil {
+				r.logf("relaying %v to %v: %v", g, addr.IP, err)
+			}
+		}
+	}
+}
+
+// readTunnel sends the packets other relays send to r onto the LAN.
+func (r *Relay) readTunnel() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, src, err := r.tunnel.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		srcIP, ok := netaddr.FromStdIP(src.IP)
+		if !ok {
+			continue
+		}
+		g, payload, ok := r.fromTunnel(srcIP, buf[:n])
+		if !ok {
+			continue
+		}
+		if _, err := r.lan[g].WriteToUDP(payload, g.UDPAddr()); err != nil {
+			r.logf("sending %v from %v: %v", g, srcIP, err)
+		}
+	}
+}
+
+// fromLAN returns the packet to send the other relays for a packet
+// heard on the LAN for g, which is in buf after headerLen bytes of
+// space for the header. It reports false if the packet is one r sent
+// onto the LAN itself.
+func (r *Relay) fromLAN(g netaddr.IPPort, buf []byte) ([]byte, bool) {
+	if r.isEcho(g, buf[headerLen:]) {
+		return nil, false
+	}
+	copy(buf, magic)
+	ip := g.IP.As4()
+	copy(buf[4:8], ip[:])
+	binary.BigEndian.PutUint16(buf[8:10], g.Port)
+	return buf, true
+}
+
+// fromTunnel returns the group and payload of msg, a packet from
+// the relay at src, reporting false if it's not from a relay, is
+// malformed or is for a group r doesn't relay. The payload is
+// remembered as sent, so that r doesn't relay it back.
+func (r *Relay) fromTunnel(src netaddr.IP, msg []byte) (g netaddr.IPPort, payload []byte, ok bool) {
+	if _, ok := r.peers[src]; !ok {
+		return g, nil, false
+	}
+	if len(msg) < headerLen || !bytes.Equal(msg[:4], magic) {
+		return g, nil, false
+	}
+	g.IP = netaddr.IPv4(msg[4], msg[5], msg[6], msg[7])
+	g.Port = binary.BigEndian.Uint16(msg[8:10])
+	if _, ok := r.lan[g]; !ok {
+		return g, nil, false
+	}
+	payload = msg[headerLen:]
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.sent) > 64 {
+		for h, t := range r.sent {
+			if now.Sub(t) > echoTimeout {
+				delete(r.sent, h)
+			}
+		}
+	}
+	r.sent[packetHash(g, payload)] = now
+	return g, payload, true
+}
+
+// isEcho reports whether payload, heard on the LAN for g, is a
+// packet r recently sent there.
+func (r *Relay) isEcho(g netaddr.IPPort, payload []byte) bool {
+	h := packetHash(g, payload)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.sent[h]
+	if !ok {
+		return false
+	}
+	delete(r.sent, h)
+	return time.Since(t) <= echoTimeout
+}
+
+func packetHash(g netaddr.IPPort, payload []byte) uint64 {
+	h := fnv.New64a()
+	ip := g.IP.As4()
+	h.Write(ip[:])
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], g.Port)
+	h.Write(port[:])
+	h.Write(payload)
+	return h.Sum64()
+}
+
+func isMulticast(ip netaddr.IP) bool {
+	b := ip.As4()
+	return b[0] >= 224 && b[0] <= 239
+}
+
+// ParseGroups parses a comma-separated list of IPv4 multicast or
+// broadcast addresses with ports, such as
+// "224.0.0.251:5353,255.255.255.255:27015".
+func ParseGroups(s string) ([]netaddr.IPPort, error) {
+	var ret []netaddr.IPPort
+	for _, f := range strings.Split(s, ",") {
+		host, portStr, err := net.SplitHostPort(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		ip, err := netaddr.ParseIP(host)
+		if err != nil || !ip.Is4() {
+			return nil, fmt.Errorf("%q is not an IPv4 address", host)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port in %q", f)
+		}
+		ret = append(ret, netaddr.IPPort{IP: ip, Port: uint16(port)})
+	}
+	return ret, nil
+}
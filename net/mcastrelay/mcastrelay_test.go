@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mcastrelay
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestParseGroups(t *testing.T) {
+	got, err := ParseGroups("224.0.0.251:5353, 255.255.255.255:27015")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netaddr.IPPort{
+		{IP: netaddr.IPv4(224, 0, 0, 251), Port: 5353},
+		{IP: netaddr.IPv4(255, 255, 255, 255), Port: 27015},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	for _, bad := range []string{"", "224.0.0.251", "[ff02::fb]:5353", "224.0.0.251:0", "mdns:5353"} {
+		if _, err := ParseGroups(bad); err == nil {
+			t.Errorf("ParseGroups(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestRelayPackets(t *testing.T) {
+	mdns := netaddr.IPPort{IP: netaddr.IPv4(224, 0, 0, 251), Port: 5353}
+	peer := netaddr.IPv4(100, 101, 102, 103)
+	newRelay := func() *Relay {
+		return &Relay{
+			logf:  t.Logf,
+			peers: map[netaddr.IP]*net.UDPAddr{peer: netaddr.IPPort{IP: peer, Port: DefaultPort}.UDPAddr()},
+			lan:   map[netaddr.IPPort]*net.UDPConn{mdns: nil},
+			sent:  map[uint64]time.Time{},
+		}
+	}
+	a, b := newRelay(), newRelay()
+
+	// A hears a query on its LAN and relays it to B.
+	buf := append(make([]byte, headerLen), "query"...)
+	msg, ok := a.fromLAN(mdns, buf)
+	if !ok {
+		t.Fatal("LAN packet not relayed")
+	}
+	g, payload, ok := b.fromTunnel(peer, msg)
+	if !ok || g != mdns || string(payload) != "query" {
+		t.Fatalf("fromTunnel = %v, %q, %v; want %v, %q, true", g, payload, ok, mdns, "query")
+	}
+
+	// B hears its own copy on its LAN, and mustn't send it back.
+	if _, ok := b.fromLAN(mdns, append(make([]byte, headerLen), "query"...)); ok {
+		t.Error("echo of relayed packet relayed back")
+	}
+	// But the same packet from a LAN host later is new.
+	if _, ok := b.fromLAN(mdns, append(make([]byte, headerLen), "query"...)); !ok {
+		t.Error("repeated LAN packet not relayed")
+	}
+
+	if _, _, ok := b.fromTunnel(netaddr.IPv4(100, 64, 0, 1), msg); ok {
+		t.Error("packet from a node that isn't a relay accepted")
+	}
+	other := append([]byte(nil), msg...)
+	other[7] = 250 // 224.0.0.250, not relayed
+	if _, _, ok := b.fromTunnel(peer, other); ok {
+		t.Error("packet for an unrelayed group accepted")
+	}
+	if _, _, ok := b.fromTunnel(peer, []byte("tsmr")); ok {
+		t.Error("short packet accepted")
+	}
+}
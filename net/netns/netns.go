@@ -56,6 +56,22 @@ func IsSOCKSDialer(d Dialer) bool {
 	return !ok
 }
 
+// DefaultBypassMark is the default packet mark indicating, on Linux,
+// that packets originating from a socket should bypass
+// Tailscale-managed routes during routing table lookups.
+const DefaultBypassMark = 0x20000
+
+// bypassMark is the bypass mark in use; see SetBypassMark.
+var bypassMark uint32 = DefaultBypassMark
+
+// SetBypassMark sets the packet mark that keeps sockets' traffic off
+// Tailscale's routes on Linux, which must be the one the router's
+// policy routing rules look for. It must be called before any sockets
+// are created.
+func SetBypassMark(mark uint32) {
+	bypassMark = mark
+}
+
 // wrapDialer, if non-nil, specifies a function to wrap a dialer in a
 // SOCKS-using dialer. It's set conditionally by socks.go.
 var wrapDialer func(Dialer) Dialer
@@ -0,0 +1,229 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package socks5 is a SOCKS5 proxy server (RFC 1928), supporting only
+// the CONNECT command and no authentication.
+//
+// It lets programs that can't use the Tailscale interface directly,
+// such as Chrome OS's browser outside of the Crostini container
+// tailscaled runs in, reach the tailnet through tailscaled's machine.
+// It's meant to listen on localhost only: anything that can connect
+// to it can connect anywhere the machine can.
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// DefaultAddr is where tailscaled's SOCKS5 proxy listens by default,
+// where it runs one.
+const DefaultAddr = "localhost:1055"
+
+// handshakeTimeout bounds how long a client has to send its request,
+// and the proxy to connect to the destination.
+const handshakeTimeout = 30 * time.Second
+
+const (
+	version5 = 5
+
+	methodNone         = 0x00
+	methodNoAcceptable = 0xff
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	replySuccess             = 0x00
+	replyGeneralFailure      = 0x01
+	replyCommandNotSupported = 0x07
+	replyAddrNotSupported    = 0x08
+)
+
+// Server is a SOCKS5 proxy server.
+type Server struct {
+	// Logf logs the proxy's errors. If nil, log.Printf is used.
+	Logf logger.Logf
+	// Dial connects to the destinations of CONNECT requests, given
+	// as host:port, the host being a name or an IP address. If
+	// nil, a net.Dialer is used.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Serve accepts connections on ln and serves each in its own
+// goroutine, until accepting fails. It returns the error from
+// Accept.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	addr, err := s.handshake(c)
+	if err != nil {
+		s.logf("socks5: %v: %v", c.RemoteAddr(), err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	dial := s.Dial
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	out, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		s.logf("socks5: %v: connecting to %s: %v", c.RemoteAddr(), addr, err)
+		writeReply(c, replyGeneralFailure, nil)
+		return
+	}
+	defer out.Close()
+	if err := writeReply(c, replySuccess, out.LocalAddr()); err != nil {
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(out, c)
+		closeWrite(out)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(c, out)
+		closeWrite(c)
+	}()
+	wg.Wait()
+}
+
+// handshake negotiates the authentication method with the client and
+// reads its request, returning the host:port to connect to. For
+// requests it can't serve, it replies with the error itself.
+func (s *Server) handshake(c net.Conn) (addr string, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != version5 {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", err
+	}
+	method := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == methodNone {
+			method = methodNone
+		}
+	}
+	if _, err := c.Write([]byte{version5, method}); err != nil {
+		return "", err
+	}
+	if method == methodNoAcceptable {
+		return "", errors.New("client requires authentication")
+	}
+
+	var req [4]byte // VER CMD RSV ATYP
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != version5 {
+		return "", fmt.Errorf("unsupported SOCKS version %d in request", req[0])
+	}
+	var host string
+	switch req[3] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeReply(c, replyAddrNotSupported, nil)
+		return "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != cmdConnect {
+		writeReply(c, replyCommandNotSupported, nil)
+		return "", fmt.Errorf("unsupported command %d", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeReply writes a reply with the code rep and the bound address
+// bound, which may be nil.
+func writeReply(w io.Writer, rep byte, bound net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if ta, ok := bound.(*net.TCPAddr); ok {
+		ip, port = ta.IP, ta.Port
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+	}
+	atyp := byte(atypIPv4)
+	if len(ip) == net.IPv6len {
+		atyp = atypIPv6
+	}
+	b := append([]byte{version5, rep, 0, atyp}, ip...)
+	b = append(b, byte(port>>8), byte(port))
+	_, err := w.Write(b)
+	return err
+}
+
+// closeWrite shuts down the writing side of c, if it can, so the
+// other end sees EOF while the reading side still drains.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// startProxy starts a Server whose Dial maps the name
+// "peer.example:80" to target.
+func startProxy(t *testing.T, target string) string {
+	ln := listen(t)
+	s := &Server{
+		Logf: t.Logf,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == "peer.example:80" {
+				addr = target
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	go s.Serve(ln)
+	return ln.Addr().String()
+}
+
+func TestConnect(t *testing.T) {
+	echo := listen(t)
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	proxy := startProxy(t, echo.Addr().String())
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+
+	tests := []struct {
+		name string
+		dst  []byte // ATYP, address and port
+	}{
+		{"ipv4", []byte{atypIPv4, 127, 0, 0, 1, byte(echoPort >> 8), byte(echoPort)}},
+		{"domain", append(append([]byte{atypDomain, 12}, "peer.example"...), 0, 80)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.Dial("tcp", proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			req := append([]byte{version5, 1, methodNone, version5, cmdConnect, 0}, tt.dst...)
+			if _, err := c.Write(req); err != nil {
+				t.Fatal(err)
+			}
+			var resp [2 + 10]byte // method choice, IPv4 reply
+			if _, err := io.ReadFull(c, resp[:]); err != nil {
+				t.Fatal(err)
+			}
+			if resp[0] != version5 || resp[1] != methodNone || resp[3] != replySuccess {
+				t.Fatalf("response = %v; want success", resp)
+			}
+			if _, err := c.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			c.(*net.TCPConn).CloseWrite()
+			got, err := ioutil.ReadAll(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "hello" {
+				t.Errorf("echoed %q; want %q", got, "hello")
+			}
+		})
+	}
+}
+
+func TestRefused(t *testing.T) {
+	proxy := startProxy(t, "")
+
+	tests := []struct {
+		name string
+		req  []byte
+		want []byte
+	}{
+		{
+			name: "auth_required",
+			req:  []byte{version5, 1, 0x02}, // username/password only
+			want: []byte{version5, methodNoAcceptable},
+		},
+		{
+			name: "bind",
+			req:  []byte{version5, 1, methodNone, version5, 0x02, 0, atypIPv4, 127, 0, 0, 1, 0, 80},
+			want: []byte{version5, methodNone, version5, replyCommandNotSupported, 0, atypIPv4, 0, 0, 0, 0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.Dial("tcp", proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if _, err := c.Write(tt.req); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("response = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package stunserver implements a STUN server that answers the
+// binding requests Tailscale nodes send to discover their public
+// address. It's what derper runs, and is small enough to run on its
+// own as a STUN-only node in a custom DERP map.
+package stunserver
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/metrics"
+	"tailscale.com/net/stun"
+	"tailscale.com/types/logger"
+)
+
+// Server is a STUN server. It can serve any number of PacketConns,
+// for instance an IPv4 and an IPv6 one.
+type Server struct {
+	logf logger.Logf
+
+	stats        metrics.Set
+	disposition  metrics.LabelMap
+	addrFamily   metrics.LabelMap
+	readError    *expvar.Int
+	notSTUN      *expvar.Int
+	writeError   *expvar.Int
+	success      *expvar.Int
+	requestsIPv4 *expvar.Int
+	requestsIPv6 *expvar.Int
+
+	mu     sync.Mutex
+	closed bool
+	pcs    map[net.PacketConn]bool
+}
+
+// New returns a new STUN server that logs to logf.
+// It doesn't listen on its own; see Serve and ListenAndServe.
+func New(logf logger.Logf) *Server {
+	s := &Server{
+		logf:        logf,
+		disposition: metrics.LabelMap{Label: "disposition"},
+		addrFamily:  metrics.LabelMap{Label: "family"},
+		pcs:         map[net.PacketConn]bool{},
+	}
+	s.readError = s.disposition.Get("read_error")
+	s.notSTUN = s.disposition.Get("not_stun")
+	s.writeError = s.disposition.Get("write_error")
+	s.success = s.disposition.Get("success")
+	s.requestsIPv4 = s.addrFamily.Get("ipv4")
+	s.requestsIPv6 = s.addrFamily.Get("ipv6")
+	s.stats.Set("counter_requests", &s.disposition)
+	s.stats.Set("counter_addrfamily", &s.addrFamily)
+	return s
+}
+
+// ExpVar returns an expvar variable suitable for registering with
+// expvar.Publish.
+func (s *Server) ExpVar() expvar.Var { return &s.stats }
+
+// ListenAndServe listens on the UDP address addr and serves STUN
+// requests on it. An addr without a host, like ":3478", accepts both
+// IPv4 and IPv6 requests where the OS supports it.
+func (s *Server) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.logf("running STUN server on %v", pc.LocalAddr())
+	return s.Serve(pc)
+}
+
+// Serve serves STUN requests on pc until pc or the server is
+// closed, in which case it returns nil. Serve takes ownership of pc
+// and closes it along with the server.
+func (s *Server) Serve(pc net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		pc.Close()
+		return errors.New("stunserver: server closed")
+	}
+	s.pcs[pc] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pcs, pc)
+		s.mu.Unlock()
+	}()
+
+	var buf [64 << 10]byte
+	for {
+		n, addr, err := pc.ReadFrom(buf[:])
+		if err != nil {
+			if s.isClosed() || strings.Contains(err.Error(), "use of closed network connection") {
+				return nil
+			}
+			s.logf("STUN ReadFrom: %v", err)
+			time.Sleep(time.Second)
+			s.readError.Add(1)
+			continue
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok {
+			s.logf("STUN unexpected address %T %v", addr, addr)
+			s.readError.Add(1)
+			continue
+		}
+		s.handle(pc, ua, buf[:n])
+	}
+}
+
+// handle answers the packet pkt, received from ua on pc.
+func (s *Server) handle(pc net.PacketConn, ua *net.UDPAddr, pkt []byte) {
+	if !stun.Is(pkt) {
+		s.notSTUN.Add(1)
+		return
+	}
+	txid, err := stun.ParseBindingRequest(pkt)
+	if err != nil {
+		s.notSTUN.Add(1)
+		return
+	}
+	if ua.IP.To4() != nil {
+		s.requestsIPv4.Add(1)
+	} else {
+		s.requestsIPv6.Add(1)
+	}
+	res := stun.Response(txid, ua.IP, uint16(ua.Port))
+	if _, err := pc.WriteTo(res, ua); err != nil {
+		s.writeError.Add(1)
+	} else {
+		s.success.Add(1)
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Close closes all the PacketConns being served.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for pc := range s.pcs {
+		pc.Close()
+	}
+	return nil
+}
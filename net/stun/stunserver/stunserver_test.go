@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stunserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun"
+)
+
+func TestServe(t *testing.T) {
+	tests := []struct {
+		network, addr string
+		counter       func(*Server) int64
+	}{
+		{"udp4", "127.0.0.1:0", func(s *Server) int64 { return s.requestsIPv4.Value() }},
+		{"udp6", "[::1]:0", func(s *Server) int64 { return s.requestsIPv6.Value() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			pc, err := net.ListenPacket(tt.network, tt.addr)
+			if err != nil {
+				t.Skipf("no %s: %v", tt.network, err)
+			}
+			s := New(t.Logf)
+			done := make(chan error, 1)
+			go func() { done <- s.Serve(pc) }()
+			defer func() {
+				s.Close()
+				if err := <-done; err != nil {
+					t.Errorf("Serve: %v", err)
+				}
+			}()
+
+			c, err := net.ListenPacket(tt.network, tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			// Junk is counted but not answered.
+			if _, err := c.WriteTo([]byte("not stun"), pc.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			txID := stun.NewTxID()
+			if _, err := c.WriteTo(stun.Request(txID), pc.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			var buf [1500]byte
+			n, _, err := c.ReadFrom(buf[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotTx, ip, port, err := stun.ParseResponse(buf[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotTx != txID {
+				t.Errorf("txID = %x; want %x", gotTx, txID)
+			}
+			la := c.LocalAddr().(*net.UDPAddr)
+			if !net.IP(ip).Equal(la.IP) || int(port) != la.Port {
+				t.Errorf("got address %v:%d; want %v", net.IP(ip), port, la)
+			}
+
+			if got := tt.counter(s); got != 1 {
+				t.Errorf("requests = %d; want 1", got)
+			}
+			if got := s.notSTUN.Value(); got != 1 {
+				t.Errorf("not_stun = %d; want 1", got)
+			}
+		})
+	}
+}
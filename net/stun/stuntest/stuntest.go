@@ -9,27 +9,16 @@ import (
 	"fmt"
 	"net"
 	"strconv"
-	"strings"
-	"sync"
 	"testing"
 
 	"inet.af/netaddr"
-	"tailscale.com/net/stun"
+	"tailscale.com/net/stun/stunserver"
 	"tailscale.com/tailcfg"
 )
 
-type stunStats struct {
-	mu       sync.Mutex
-	readIPv4 int
-	readIPv6 int
-}
-
 func Serve(t *testing.T) (addr *net.UDPAddr, cleanupFn func()) {
 	t.Helper()
 
-	// TODO(crawshaw): use stats to test re-STUN logic
-	var stats stunStats
-
 	pc, err := net.ListenPacket("udp4", ":0")
 	if err != nil {
 		t.Fatalf("failed to open STUN listener: %v", err)
@@ -38,52 +27,21 @@ func Serve(t *testing.T) (addr *net.UDPAddr, cleanupFn func()) {
 		IP:   net.ParseIP("127.0.0.1"),
 		Port: pc.LocalAddr().(*net.UDPAddr).Port,
 	}
+	s := stunserver.New(t.Logf)
 	doneCh := make(chan struct{})
-	go runSTUN(t, pc, &stats, doneCh)
+	go func() {
+		defer close(doneCh)
+		if err := s.Serve(pc); err != nil {
+			t.Logf("STUN server: %v", err)
+		}
+		t.Logf("STUN server shutdown")
+	}()
 	return addr, func() {
-		pc.Close()
+		s.Close()
 		<-doneCh
 	}
 }
 
-func runSTUN(t *testing.T, pc net.PacketConn, stats *stunStats, done chan<- struct{}) {
-	defer close(done)
-
-	var buf [64 << 10]byte
-	for {
-		n, addr, err := pc.ReadFrom(buf[:])
-		if err != nil {
-			if strings.Contains(err.Error(), "closed network connection") {
-				t.Logf("STUN server shutdown")
-				return
-			}
-			continue
-		}
-		ua := addr.(*net.UDPAddr)
-		pkt := buf[:n]
-		if !stun.Is(pkt) {
-			continue
-		}
-		txid, err := stun.ParseBindingRequest(pkt)
-		if err != nil {
-			continue
-		}
-
-		stats.mu.Lock()
-		if ua.IP.To4() != nil {
-			stats.readIPv4++
-		} else {
-			stats.readIPv6++
-		}
-		stats.mu.Unlock()
-
-		res := stun.Response(txid, ua.IP, uint16(ua.Port))
-		if _, err := pc.WriteTo(res, addr); err != nil {
-			t.Logf("STUN server write failed: %v", err)
-		}
-	}
-}
-
 func DERPMapOf(stun ...string) *tailcfg.DERPMap {
 	m := &tailcfg.DERPMap{
 		Regions: map[int]*tailcfg.DERPRegion{},
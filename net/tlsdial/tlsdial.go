@@ -15,9 +15,53 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
 	"time"
 )
 
+var (
+	extraRootsMu sync.Mutex
+	extraRoots   *x509.CertPool // nil if none
+)
+
+// SetExtraRootCAs configures the PEM-encoded certificates in the
+// named files as additional roots trusted for outgoing connections,
+// alongside the system's roots. It's intended for self-hosted control
+// and DERP servers using a private CA, and must be called before any
+// TLS configs are made with Config. An empty files removes any
+// additional roots.
+//
+// Only files are supported, not references to a certificate store
+// such as a Windows store or macOS keychain. Roots in the system's
+// own store are trusted already.
+func SetExtraRootCAs(files []string) error {
+	var pool *x509.CertPool
+	for _, file := range files {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("reading CA certificates: %v", err)
+		}
+		if pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no PEM certificates found in %s", file)
+		}
+	}
+	extraRootsMu.Lock()
+	defer extraRootsMu.Unlock()
+	extraRoots = pool
+	return nil
+}
+
+func getExtraRoots() *x509.CertPool {
+	extraRootsMu.Lock()
+	defer extraRootsMu.Unlock()
+	return extraRoots
+}
+
 // Config returns a tls.Config for connecting to a server.
 // If base is non-nil, it's cloned as the base config before
 // being configured and returned.
@@ -30,6 +74,16 @@ func Config(host string, base *tls.Config) *tls.Config {
 	}
 	conf.ServerName = host
 
+	if getExtraRoots() != nil {
+		// Verify ourselves, so that we can consult both the
+		// system roots (which can't be loaded into a CertPool
+		// on all platforms) and the extra roots.
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, host)
+		}
+	}
+
 	return conf
 }
 
@@ -39,11 +93,13 @@ func SetConfigExpectedCert(c *tls.Config, certDNSName string) {
 	if c.ServerName == certDNSName {
 		return
 	}
-	if c.ServerName == "" {
+	if c.ServerName == "" && getExtraRoots() == nil {
 		c.ServerName = certDNSName
 		return
 	}
-	if c.VerifyPeerCertificate != nil {
+	// With extra roots, Config already installed its own
+	// VerifyPeerCertificate hook, which we replace.
+	if c.VerifyPeerCertificate != nil && getExtraRoots() == nil {
 		panic("refusing to override tls.Config.VerifyPeerCertificate")
 	}
 	// Set InsecureSkipVerify to prevent crypto/tls from doing its
@@ -51,26 +107,69 @@ func SetConfigExpectedCert(c *tls.Config, certDNSName string) {
 	// (but using certDNSName) in the VerifyPeerCertificate hook.
 	c.InsecureSkipVerify = true
 	c.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
-		if len(rawCerts) == 0 {
-			return errors.New("no certs presented")
-		}
-		certs := make([]*x509.Certificate, len(rawCerts))
-		for i, asn1Data := range rawCerts {
-			cert, err := x509.ParseCertificate(asn1Data)
-			if err != nil {
-				return err
-			}
-			certs[i] = cert
-		}
-		opts := x509.VerifyOptions{
-			CurrentTime:   time.Now(),
-			DNSName:       certDNSName,
-			Intermediates: x509.NewCertPool(),
+		return verifyChain(rawCerts, certDNSName)
+	}
+}
+
+// verifyChain verifies the certificate chain presented by a server
+// for dnsName against the system roots and then any extra roots.
+func verifyChain(rawCerts [][]byte, dnsName string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no certs presented")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, asn1Data := range rawCerts {
+		cert, err := x509.ParseCertificate(asn1Data)
+		if err != nil {
+			return err
 		}
-		for _, cert := range certs[1:] {
-			opts.Intermediates.AddCert(cert)
+		certs[i] = cert
+	}
+	opts := x509.VerifyOptions{
+		CurrentTime:   time.Now(),
+		DNSName:       dnsName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	if err == nil {
+		return nil
+	}
+	if roots := getExtraRoots(); roots != nil {
+		opts.Roots = roots
+		if _, err2 := certs[0].Verify(opts); err2 == nil {
+			return nil
 		}
-		_, err := certs[0].Verify(opts)
+	}
+	return err
+}
+
+// IsCertError reports whether err was caused by the server's
+// certificate failing verification, as opposed to a network problem.
+func IsCertError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+	)
+	return errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &invalid)
+}
+
+// DescribeError returns err annotated as a certificate problem if
+// IsCertError reports true for it, and err unchanged otherwise. A
+// certificate that's expired or not yet valid more likely means the
+// system clock is wrong, so that's what it suggests checking.
+func DescribeError(err error) error {
+	if !IsCertError(err) {
 		return err
 	}
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) && invalid.Reason == x509.Expired {
+		return fmt.Errorf("server certificate expired or not yet valid; check the system clock, which reads %v: %w", time.Now().UTC().Format(time.RFC3339), err)
+	}
+	return fmt.Errorf("server certificate not trusted (a private CA needs --extra-ca-certs): %w", err)
 }
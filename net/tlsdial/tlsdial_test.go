@@ -0,0 +1,84 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tlsdial
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsCertError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"network", errors.New("connection refused"), false},
+		{"unknown_authority", x509.UnknownAuthorityError{}, true},
+		{"hostname", x509.HostnameError{Host: "foo"}, true},
+		{"expired", x509.CertificateInvalidError{Reason: x509.Expired}, true},
+		{"wrapped", &url.Error{Op: "Get", URL: "https://x", Err: x509.UnknownAuthorityError{}}, true},
+		{"wrapped_network", &url.Error{Op: "Get", URL: "https://x", Err: errors.New("timeout")}, false},
+	}
+	for _, tt := range tests {
+		if got := IsCertError(tt.err); got != tt.want {
+			t.Errorf("%s: IsCertError = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	network := errors.New("connection refused")
+	if got := DescribeError(network); got != network {
+		t.Errorf("DescribeError changed non-cert error: %v", got)
+	}
+	described := DescribeError(fmt.Errorf("dial: %w", x509.UnknownAuthorityError{}))
+	if !IsCertError(described) {
+		t.Errorf("DescribeError result lost cert error: %v", described)
+	}
+	expired := DescribeError(fmt.Errorf("dial: %w", x509.CertificateInvalidError{Reason: x509.Expired}))
+	if !strings.Contains(expired.Error(), "check the system clock") {
+		t.Errorf("DescribeError of expired certificate doesn't mention the clock: %v", expired)
+	}
+}
+
+func TestSetExtraRootCAs(t *testing.T) {
+	defer SetExtraRootCAs(nil)
+
+	dir, err := ioutil.TempDir("", "tlsdial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := SetExtraRootCAs([]string{filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("missing file: got nil error")
+	}
+
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("not a certificate\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetExtraRootCAs([]string{empty}); err == nil {
+		t.Error("file without certificates: got nil error")
+	}
+	if getExtraRoots() != nil {
+		t.Error("extra roots set after failed SetExtraRootCAs")
+	}
+
+	if err := SetExtraRootCAs(nil); err != nil {
+		t.Fatal(err)
+	}
+	conf := Config("example.com", nil)
+	if conf.InsecureSkipVerify || conf.VerifyPeerCertificate != nil {
+		t.Error("Config without extra roots overrode default verification")
+	}
+}
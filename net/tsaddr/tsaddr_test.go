@@ -17,3 +17,9 @@ func TestCGNATRange(t *testing.T) {
 		t.Errorf("got %q; want %q", got, want)
 	}
 }
+
+func TestTailscaleULARange(t *testing.T) {
+	if got, want := TailscaleULARange().String(), "fd7a:115c:a1e0::/48"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
@@ -8,7 +8,9 @@ package paths
 
 import (
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 // LegacyConfigPath is the path used by the pre-tailscaled "relaynode"
@@ -27,6 +29,20 @@ func DefaultTailscaledSocket() string {
 	return "tailscaled.sock"
 }
 
+// InstancePath returns path, a default path of tailscaled's, for the
+// tailscaled instance named instance, by adding the name to the file
+// name before its extension: tailscaled.state becomes
+// tailscaled-NAME.state. It's used to keep the files of several
+// instances on one host apart.
+func InstancePath(path, instance string) string {
+	if path == "" || instance == "" {
+		return path
+	}
+	dir, file := filepath.Split(path)
+	ext := filepath.Ext(file)
+	return dir + strings.TrimSuffix(file, ext) + "-" + instance + ext
+}
+
 var stateFileFunc func() string
 
 // DefaultTailscaledStateFile returns the default path to the
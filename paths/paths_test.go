@@ -0,0 +1,24 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package paths
+
+import "testing"
+
+func TestInstancePath(t *testing.T) {
+	tests := []struct {
+		path, instance, want string
+	}{
+		{"/var/lib/tailscale/tailscaled.state", "tailscale1", "/var/lib/tailscale/tailscaled-tailscale1.state"},
+		{"/var/run/tailscale/tailscaled.sock", "staging", "/var/run/tailscale/tailscaled-staging.sock"},
+		{"tailscaled.sock", "staging", "tailscaled-staging.sock"},
+		{"/var/lib/tailscale/tailscaled.state", "", "/var/lib/tailscale/tailscaled.state"},
+		{"", "staging", ""},
+	}
+	for _, tt := range tests {
+		if got := InstancePath(tt.path, tt.instance); got != tt.want {
+			t.Errorf("InstancePath(%q, %q) = %q; want %q", tt.path, tt.instance, got, tt.want)
+		}
+	}
+}
@@ -146,6 +146,12 @@ type Node struct {
 
 	MachineAuthorized bool // TODO(crawshaw): replace with MachineStatus
 
+	// Tags are the ACL tags the control server granted this node,
+	// out of those in Hostinfo.RequestTags. Control servers that
+	// support tags always send it, empty if none were granted; nil
+	// means the server doesn't say.
+	Tags []string
+
 	// NOTE: any new fields containing pointers in this type
 	//       require changes to Node.Clone.
 }
@@ -159,6 +165,9 @@ func (n *Node) Clone() (res *Node) {
 	res.Addresses = append([]wgcfg.CIDR{}, res.Addresses...)
 	res.AllowedIPs = append([]wgcfg.CIDR{}, res.AllowedIPs...)
 	res.Endpoints = append([]string{}, res.Endpoints...)
+	if res.Tags != nil {
+		res.Tags = append([]string{}, res.Tags...)
+	}
 	if res.LastSeen != nil {
 		lastSeen := *res.LastSeen
 		res.LastSeen = &lastSeen
@@ -289,11 +298,23 @@ type Hostinfo struct {
 	RequestTags   []string     `json:",omitempty"` // set of ACL tags this node wants to claim
 	Services      []Service    `json:",omitempty"` // services advertised by this machine
 	NetInfo       *NetInfo     `json:",omitempty"`
+	Cloud         *CloudInfo   `json:",omitempty"` // cloud instance identity, if any
+	SSHHostKeys   []string     `json:",omitempty"` // public SSH host keys, in authorized_keys format
 
 	// NOTE: any new fields containing pointers in this type
 	//       require changes to Hostinfo.Clone and Hostinfo.Equal.
 }
 
+// CloudInfo identifies the cloud instance a node runs on.
+type CloudInfo struct {
+	Provider     string `json:",omitempty"` // "aws", "gcp" or "azure"
+	Region       string `json:",omitempty"` // e.g. "us-east-1"
+	Zone         string `json:",omitempty"` // availability zone, e.g. "us-east-1a"
+	InstanceType string `json:",omitempty"` // e.g. "t3.micro"
+	InstanceID   string `json:",omitempty"`
+	AccountID    string `json:",omitempty"` // AWS account, GCP project or Azure subscription
+}
+
 // NetInfo contains information about the host's network state.
 type NetInfo struct {
 	// MappingVariesByDestIP says whether the host's NAT mappings
@@ -421,7 +442,12 @@ func (h *Hostinfo) Clone() (res *Hostinfo) {
 
 	res.RoutableIPs = append([]wgcfg.CIDR{}, h.RoutableIPs...)
 	res.Services = append([]Service{}, h.Services...)
+	res.SSHHostKeys = append([]string(nil), h.SSHHostKeys...)
 	res.NetInfo = h.NetInfo.Clone()
+	if h.Cloud != nil {
+		ci := *h.Cloud
+		res.Cloud = &ci
+	}
 	return res
 }
 
@@ -539,11 +565,19 @@ type MapResponse struct {
 	KeepAlive bool // if set, all other fields are ignored
 
 	// Networking
-	Node        *Node
-	Peers       []*Node
+	Node    *Node
+	Peers   []*Node
+	DERPMap *DERPMap
+
+	// DNSConfig is the DNS configuration for the node.
+	// If nil, the client falls back to the older DNS and
+	// SearchPaths fields.
+	DNSConfig *DNSConfig `json:",omitempty"`
+
+	// DNS and SearchPaths are the flat DNS configuration sent by
+	// older control servers. They are ignored when DNSConfig is set.
 	DNS         []wgcfg.IP
 	SearchPaths []string
-	DERPMap     *DERPMap
 
 	// ACLs
 	Domain       string
@@ -558,6 +592,68 @@ type MapResponse struct {
 	Debug *Debug `json:",omitempty"`
 }
 
+// DNSConfig is the DNS configuration sent by the control server.
+type DNSConfig struct {
+	// Resolvers are the global DNS resolvers, used for names
+	// that don't match any entry in Routes.
+	Resolvers []DNSResolver `json:",omitempty"`
+
+	// Routes maps DNS name suffixes to the resolvers that are
+	// authoritative for names under them ("split DNS"). The
+	// keys are domains without a trailing period, such as
+	// "corp.example.com". A name is routed by its longest
+	// matching suffix.
+	Routes map[string][]DNSResolver `json:",omitempty"`
+
+	// FallbackResolvers are queried when there are no resolvers
+	// for a name or when all of them have failed.
+	FallbackResolvers []DNSResolver `json:",omitempty"`
+
+	// Domains are the search domains to use.
+	Domains []string `json:",omitempty"`
+
+	// Proxied is whether all of the node's DNS queries go to
+	// Tailscale's resolver at 100.100.100.100, which answers for
+	// peers' names from the netmap itself and forwards other names
+	// to Resolvers, or to Routes' resolvers for names under them.
+	// It also makes peers' short names, like "mynas", resolve.
+	Proxied bool `json:",omitempty"`
+
+	// ExtraRecords are DNS records, other than those for nodes'
+	// names, that Tailscale's resolver serves, such as to give
+	// services on the network names like "git.internal". Queries
+	// for their names are sent to the resolver.
+	ExtraRecords []DNSRecord `json:",omitempty"`
+}
+
+// DNSRecord is an extra DNS record served by Tailscale's resolver.
+type DNSRecord struct {
+	// Name is the domain name of the record, without a trailing
+	// period, such as "git.internal".
+	Name string
+
+	// Type is the record type: "A", "AAAA" or "CNAME". If empty,
+	// it's A or AAAA, according to Value.
+	Type string `json:",omitempty"`
+
+	// Value is the record's data: an IP address for A and AAAA
+	// records, or a domain name for CNAME records.
+	Value string
+}
+
+// DNSResolver is a DNS server address.
+type DNSResolver struct {
+	// Addr is the address of the resolver, of the form "ip"
+	// or "ip:port". If the port is omitted, 53 is assumed, or
+	// 853 for DNS-over-TLS.
+	Addr string
+
+	// TLSServerName, if set, makes the resolver a DNS-over-TLS
+	// (RFC 7858) server whose certificate must be valid for
+	// this name.
+	TLSServerName string `json:",omitempty"`
+}
+
 // Debug are instructions from the control server to the client
 // to adjust debug settings.
 type Debug struct {
@@ -642,5 +738,6 @@ func (n *Node) Equal(n2 *Node) bool {
 		reflect.DeepEqual(n.Hostinfo, n2.Hostinfo) &&
 		n.Created.Equal(n2.Created) &&
 		reflect.DeepEqual(n.LastSeen, n2.LastSeen) &&
-		n.MachineAuthorized == n2.MachineAuthorized
+		n.MachineAuthorized == n2.MachineAuthorized &&
+		reflect.DeepEqual(n.Tags, n2.Tags)
 }
@@ -24,7 +24,7 @@ func fieldsOf(t reflect.Type) (fields []string) {
 func TestHostinfoEqual(t *testing.T) {
 	hiHandles := []string{
 		"IPNVersion", "FrontendLogID", "BackendLogID", "OS", "Hostname", "RoutableIPs", "RequestTags", "Services",
-		"NetInfo",
+		"NetInfo", "Cloud", "SSHHostKeys",
 	}
 	if have := fieldsOf(reflect.TypeOf(Hostinfo{})); !reflect.DeepEqual(have, hiHandles) {
 		t.Errorf("Hostinfo.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
@@ -168,6 +168,22 @@ func TestHostinfoEqual(t *testing.T) {
 			&Hostinfo{Services: []Service{Service{Proto: TCP, Port: 1234, Description: "foo"}}},
 			true,
 		},
+
+		{
+			&Hostinfo{Cloud: &CloudInfo{Provider: "aws", Region: "us-east-1"}},
+			&Hostinfo{Cloud: &CloudInfo{Provider: "aws", Region: "us-east-1"}},
+			true,
+		},
+		{
+			&Hostinfo{Cloud: &CloudInfo{Provider: "aws", Region: "us-east-1"}},
+			&Hostinfo{Cloud: &CloudInfo{Provider: "aws", Region: "us-west-2"}},
+			false,
+		},
+		{
+			&Hostinfo{Cloud: &CloudInfo{Provider: "gcp"}},
+			&Hostinfo{},
+			false,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.a.Equal(tt.b)
@@ -178,7 +194,7 @@ func TestHostinfoEqual(t *testing.T) {
 }
 
 func TestNodeEqual(t *testing.T) {
-	nodeHandles := []string{"ID", "Name", "User", "Key", "KeyExpiry", "Machine", "DiscoKey", "Addresses", "AllowedIPs", "Endpoints", "DERP", "Hostinfo", "Created", "LastSeen", "KeepAlive", "MachineAuthorized"}
+	nodeHandles := []string{"ID", "Name", "User", "Key", "KeyExpiry", "Machine", "DiscoKey", "Addresses", "AllowedIPs", "Endpoints", "DERP", "Hostinfo", "Created", "LastSeen", "KeepAlive", "MachineAuthorized", "Tags"}
 	if have := fieldsOf(reflect.TypeOf(Node{})); !reflect.DeepEqual(have, nodeHandles) {
 		t.Errorf("Node.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
 			have, nodeHandles)
@@ -314,6 +330,16 @@ func TestNodeEqual(t *testing.T) {
 			&Node{LastSeen: &now},
 			true,
 		},
+		{
+			&Node{Tags: []string{"tag:server"}},
+			&Node{Tags: []string{"tag:server", "tag:prod"}},
+			false,
+		},
+		{
+			&Node{Tags: []string{"tag:server"}},
+			&Node{Tags: []string{"tag:server"}},
+			true,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.a.Equal(tt.b)
@@ -59,6 +59,7 @@ func Discard(string, ...interface{}) {}
 type limitData struct {
 	lim        *rate.Limiter // the token bucket associated with this string
 	msgBlocked bool          // whether a "duplicate error" message has already been logged
+	suppressed int           // messages dropped since msgBlocked was set
 	ele        *list.Element // list element used to access this string in the cache
 }
 
@@ -74,6 +75,8 @@ var rateFreePrefix = []string{
 // RateLimitedFn returns a rate-limiting Logf wrapping the given logf.
 // Messages are allowed through at a maximum of one message every f (where f is a time.Duration), in
 // bursts of up to burst messages at a time. Up to maxCache strings will be held at a time.
+// When a format string that was rate limited is allowed through again, the number of
+// messages that were dropped in between is logged first.
 func RateLimitedFn(logf Logf, f time.Duration, burst int, maxCache int) Logf {
 	if disableRateLimit {
 		return logf
@@ -92,10 +95,13 @@ func RateLimitedFn(logf Logf, f time.Duration, burst int, maxCache int) Logf {
 		block
 	)
 
-	judge := func(format string) verdict {
+	// judge decides what to do with a message using format. When the
+	// verdict is allow, suppressed is how many messages using format
+	// were dropped since the last one allowed.
+	judge := func(format string) (v verdict, suppressed int) {
 		for _, pfx := range rateFreePrefix {
 			if strings.HasPrefix(format, pfx) {
-				return allow
+				return allow, 0
 			}
 		}
 
@@ -116,19 +122,26 @@ func RateLimitedFn(logf Logf, f time.Duration, burst int, maxCache int) Logf {
 			}
 		}
 		if rl.lim.Allow() {
+			suppressed = rl.suppressed
 			rl.msgBlocked = false
-			return allow
+			rl.suppressed = 0
+			return allow, suppressed
 		}
+		rl.suppressed++
 		if !rl.msgBlocked {
 			rl.msgBlocked = true
-			return warn
+			return warn, 0
 		}
-		return block
+		return block, 0
 	}
 
 	return func(format string, args ...interface{}) {
-		switch judge(format) {
+		v, suppressed := judge(format)
+		switch v {
 		case allow:
+			if suppressed > 0 {
+				logf("[RATE LIMITED] %d messages suppressed: %s", suppressed, format)
+			}
 			logf(format, args...)
 		case warn:
 			// For the warning, log the specific format string
@@ -163,6 +176,78 @@ func LogOnChange(logf Logf, maxInterval time.Duration, timeNow func() time.Time)
 
 }
 
+// Deduplicated returns a Logf that collapses runs of identical lines
+// into the first one and a "[message repeated N times]" line, logged
+// when a different line comes along or, if the same line keeps
+// coming or stops, maxInterval after the first repeat. Unlike
+// LogOnChange, it says how much was dropped, so a tight failure loop
+// shows up as one line instead of filling the log.
+//
+// Lines are passed to logf with their original format and args, so
+// that a RateLimitedFn below it still limits each format separately.
+func Deduplicated(logf Logf, maxInterval time.Duration, timeNow func() time.Time) Logf {
+	var (
+		mu       sync.Mutex
+		last     string
+		repeats  int       // times last was seen since it, or its count, was logged
+		firstRep time.Time // when the first of those repeats was seen
+		flushGen int       // incremented whenever repeats is reset
+	)
+
+	// takeRepeatsLocked resets and returns the count of repeats.
+	takeRepeatsLocked := func() int {
+		n := repeats
+		repeats = 0
+		flushGen++
+		return n
+	}
+	logRepeats := func(n int) {
+		if n > 0 {
+			logf("[message repeated %d times]", n)
+		}
+	}
+
+	return func(format string, args ...interface{}) {
+		s := fmt.Sprintf(format, args...)
+		now := timeNow()
+
+		mu.Lock()
+		if s == last {
+			if repeats == 0 {
+				firstRep = now
+				// Log the count even if the line stops coming.
+				gen := flushGen
+				time.AfterFunc(maxInterval, func() {
+					mu.Lock()
+					n := 0
+					if gen == flushGen {
+						n = takeRepeatsLocked()
+					}
+					mu.Unlock()
+					logRepeats(n)
+				})
+			}
+			repeats++
+			if now.Sub(firstRep) < maxInterval {
+				mu.Unlock()
+				return
+			}
+			n := takeRepeatsLocked()
+			mu.Unlock()
+			logRepeats(n)
+			return
+		}
+		last = s
+		n := takeRepeatsLocked()
+		mu.Unlock()
+
+		// Lines can come out of order if two goroutines race here,
+		// as they can with the underlying logger anyway.
+		logRepeats(n)
+		logf(format, args...)
+	}
+}
+
 // ArgWriter is a fmt.Formatter that can be passed to any Logf func to
 // efficiently write to a %v argument without allocations.
 type ArgWriter func(*bufio.Writer)
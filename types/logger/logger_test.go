@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -70,6 +71,27 @@ func TestRateLimiter(t *testing.T) {
 
 }
 
+func TestRateLimiterSuppressedCount(t *testing.T) {
+	want := []string{
+		"retrying 0",
+		"[RATE LIMITED] retrying %d",
+		"[RATE LIMITED] 2 messages suppressed: retrying %d",
+		"retrying 3",
+	}
+
+	testsRun := 0
+	lgtest := logTester(want, t, &testsRun)
+	lg := RateLimitedFn(lgtest, 50*time.Millisecond, 1, 50)
+	for i := 0; i < 3; i++ {
+		lg("retrying %d", i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	lg("retrying %d", 3)
+	if testsRun < len(want) {
+		t.Fatalf("Tests after %s weren't logged.", want[testsRun])
+	}
+}
+
 func testTimer(d time.Duration) func() time.Time {
 	timeNow := time.Now()
 	return func() time.Time {
@@ -106,6 +128,67 @@ func TestLogOnChange(t *testing.T) {
 	}
 }
 
+func TestDeduplicated(t *testing.T) {
+	want := []string{
+		"derp: connect failed: 100%",
+		"[message repeated 6 times]",
+		"[message repeated 3 times]",
+		"other",
+		"derp: connect failed: 100%",
+		"[message repeated 1 times]",
+		"done",
+	}
+
+	timeNow := testTimer(1 * time.Second)
+
+	testsRun := 0
+	lgtest := logTester(want, t, &testsRun)
+	lg := Deduplicated(lgtest, 5*time.Second, timeNow)
+
+	for i := 0; i < 10; i++ {
+		lg("derp: connect failed: %d%%", 100)
+	}
+	lg("other")
+	lg("derp: connect failed: 100%%")
+	lg("derp: connect failed: 100%%")
+	lg("done")
+
+	if testsRun < len(want) {
+		t.Fatalf("'Wanted' lines including and after [%s] weren't logged.", want[testsRun])
+	}
+}
+
+func TestDeduplicatedFormat(t *testing.T) {
+	var mu sync.Mutex
+	var formats []string
+	lg := Deduplicated(func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		formats = append(formats, format)
+	}, 20*time.Millisecond, time.Now)
+
+	lg("connect failed: %v", "timeout")
+	lg("connect failed: %v", "timeout")
+
+	// The repeat is counted even though no other line comes along.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(formats)
+		mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"connect failed: %v", "[message repeated %d times]"}
+	if !reflect.DeepEqual(formats, want) {
+		t.Errorf("formats = %q; want %q", formats, want)
+	}
+}
+
 func TestArgWriter(t *testing.T) {
 	got := new(bytes.Buffer)
 	fmt.Fprintf(got, "Greeting: %v", ArgWriter(func(bw *bufio.Writer) {
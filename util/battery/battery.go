@@ -0,0 +1,36 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package battery reports whether the machine is running on battery
+// power.
+package battery
+
+import (
+	"strings"
+)
+
+var onBattery func() (bool, error)
+
+// Supported reports whether OnBattery can tell on this platform.
+func Supported() bool { return onBattery != nil }
+
+// OnBattery reports whether the machine is running on battery rather
+// than from a power outlet. Machines without a battery, and platforms
+// where it's not known (see Supported), report false.
+func OnBattery() (bool, error) {
+	if onBattery == nil {
+		return false, nil
+	}
+	return onBattery()
+}
+
+// parsePMSet parses the output of "pmset -g batt" on macOS, whose
+// first line is "Now drawing from 'Battery Power'" or "Now drawing
+// from 'AC Power'".
+func parsePMSet(out string) bool {
+	if i := strings.IndexByte(out, '\n'); i != -1 {
+		out = out[:i]
+	}
+	return strings.Contains(out, "'Battery Power'")
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !ios
+
+package battery
+
+import (
+	"os/exec"
+)
+
+func init() {
+	onBattery = onBatteryPMSet
+}
+
+func onBatteryPMSet() (bool, error) {
+	out, err := exec.Command("pmset", "-g", "batt").Output()
+	if err != nil {
+		return false, err
+	}
+	return parsePMSet(string(out)), nil
+}
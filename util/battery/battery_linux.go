@@ -0,0 +1,53 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package battery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	onBattery = func() (bool, error) { return onBatterySysfs("/sys/class/power_supply") }
+}
+
+// onBatterySysfs reports whether, according to the power supplies
+// the kernel lists in dir, no external power is connected and some
+// battery is discharging.
+func onBatterySysfs(dir string) (bool, error) {
+	ents, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	read := func(supply, attr string) string {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, supply, attr))
+		return strings.TrimSpace(string(b))
+	}
+	discharging := false
+	for _, ent := range ents {
+		name := ent.Name()
+		switch read(name, "type") {
+		case "Mains", "USB", "USB_C", "USB_PD":
+			if read(name, "online") == "1" {
+				return false, nil
+			}
+		case "Battery":
+			// Peripherals (mice, keyboards) list their batteries
+			// too; only the system's own battery powers the machine.
+			if read(name, "scope") == "Device" {
+				continue
+			}
+			if read(name, "status") == "Discharging" {
+				discharging = true
+			}
+		}
+	}
+	return discharging, nil
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package battery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOnBatterySysfs(t *testing.T) {
+	type supply map[string]string // attribute file => contents
+	tests := []struct {
+		name     string
+		supplies map[string]supply
+		want     bool
+	}{
+		{
+			name: "no_supplies",
+			want: false,
+		},
+		{
+			name: "discharging",
+			supplies: map[string]supply{
+				"AC":   {"type": "Mains", "online": "0"},
+				"BAT0": {"type": "Battery", "status": "Discharging"},
+			},
+			want: true,
+		},
+		{
+			name: "plugged_in",
+			supplies: map[string]supply{
+				"AC":   {"type": "Mains", "online": "1"},
+				"BAT0": {"type": "Battery", "status": "Full"},
+			},
+			want: false,
+		},
+		{
+			name: "usb_c_power_while_discharging",
+			supplies: map[string]supply{
+				"ucsi-source-psy-USBC000:001": {"type": "USB", "online": "1"},
+				"BAT0":                        {"type": "Battery", "status": "Discharging"},
+			},
+			want: false,
+		},
+		{
+			name: "desktop_with_wireless_mouse",
+			supplies: map[string]supply{
+				"hidpp_battery_0": {"type": "Battery", "scope": "Device", "status": "Discharging"},
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "battery")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for name, attrs := range tt.supplies {
+				if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				for attr, v := range attrs {
+					if err := ioutil.WriteFile(filepath.Join(dir, name, attr), []byte(v+"\n"), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			got, err := onBatterySysfs(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got, err := onBatterySysfs("/nonexistent/power_supply"); got || err != nil {
+		t.Errorf("missing dir: got %v, %v; want false, nil", got, err)
+	}
+}
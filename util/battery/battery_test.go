@@ -0,0 +1,24 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package battery
+
+import "testing"
+
+func TestParsePMSet(t *testing.T) {
+	tests := []struct {
+		out  string
+		want bool
+	}{
+		{"Now drawing from 'Battery Power'\n -InternalBattery-0 (id=4653155)\t87%; discharging; 5:12 remaining present: true\n", true},
+		{"Now drawing from 'AC Power'\n -InternalBattery-0 (id=4653155)\t100%; charged; 0:00 remaining present: true\n", false},
+		{"Now drawing from 'AC Power'\n", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := parsePMSet(tt.out); got != tt.want {
+			t.Errorf("parsePMSet(%q) = %v; want %v", tt.out, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package battery
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+func init() {
+	onBattery = onBatteryWindows
+}
+
+var procGetSystemPowerStatus = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetSystemPowerStatus")
+
+// systemPowerStatus is SYSTEM_POWER_STATUS.
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+const (
+	acLineOffline   = 0
+	batteryFlagNone = 128 // no system battery
+)
+
+func onBatteryWindows() (bool, error) {
+	var st systemPowerStatus
+	r, _, err := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&st)))
+	if r == 0 {
+		return false, err
+	}
+	return st.ACLineStatus == acLineOffline && st.BatteryFlag != batteryFlagNone, nil
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cloudinfo identifies the cloud instance the current machine
+// runs on, using the cloud provider's instance metadata service.
+package cloudinfo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"runtime"
+	"strconv"
+	"time"
+
+	"tailscale.com/net/netns"
+	"tailscale.com/tailcfg"
+)
+
+// metadataBase is the base URL of the metadata services of all the
+// supported clouds. It's a link-local address, so it never leaves
+// the machine's network segment.
+const metadataBase = "http://169.254.169.254"
+
+// timeout bounds how long Get waits for the metadata services. On
+// machines outside of a cloud, nothing answers and all requests
+// time out.
+const timeout = 2 * time.Second
+
+// Get returns the identity of the cloud instance the machine runs on,
+// or nil if it doesn't run in a supported cloud (AWS, GCP or Azure).
+func Get(ctx context.Context) *tailcfg.CloudInfo {
+	switch runtime.GOOS {
+	case "linux", "windows", "freebsd":
+	default:
+		// Not an OS offered by any of the supported clouds.
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = netns.NewDialer().DialContext
+	tr.Proxy = nil // metadata services must be reached directly
+	defer tr.CloseIdleConnections()
+	return get(ctx, &http.Client{Transport: tr}, metadataBase)
+}
+
+func get(ctx context.Context, c *http.Client, base string) *tailcfg.CloudInfo {
+	fetchers := []func(context.Context, *http.Client, string) (*tailcfg.CloudInfo, error){
+		fetchAWS,
+		fetchGCP,
+		fetchAzure,
+	}
+	results := make(chan *tailcfg.CloudInfo, len(fetchers))
+	for _, fetch := range fetchers {
+		go func(fetch func(context.Context, *http.Client, string) (*tailcfg.CloudInfo, error)) {
+			ci, err := fetch(ctx, c, base)
+			if err != nil {
+				ci = nil
+			}
+			results <- ci
+		}(fetch)
+	}
+	for range fetchers {
+		if ci := <-results; ci != nil {
+			return ci
+		}
+	}
+	return nil
+}
+
+// getMetadata does an HTTP request against a metadata service
+// and returns the response body.
+func getMetadata(ctx context.Context, c *http.Client, method, url string, header map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %v", method, url, res.Status)
+	}
+	return body, nil
+}
+
+func fetchAWS(ctx context.Context, c *http.Client, base string) (*tailcfg.CloudInfo, error) {
+	// IMDSv2: get a session token first, then use it for the
+	// actual request.
+	token, err := getMetadata(ctx, c, "PUT", base+"/latest/api/token", map[string]string{
+		"X-aws-ec2-metadata-token-ttl-seconds": "60",
+	})
+	if err != nil {
+		return nil, err
+	}
+	body, err := getMetadata(ctx, c, "GET", base+"/latest/dynamic/instance-identity/document", map[string]string{
+		"X-aws-ec2-metadata-token": string(token),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+		InstanceType     string `json:"instanceType"`
+		InstanceID       string `json:"instanceId"`
+		AccountID        string `json:"accountId"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	if doc.InstanceID == "" {
+		return nil, errors.New("aws: no instance ID")
+	}
+	return &tailcfg.CloudInfo{
+		Provider:     "aws",
+		Region:       doc.Region,
+		Zone:         doc.AvailabilityZone,
+		InstanceType: doc.InstanceType,
+		InstanceID:   doc.InstanceID,
+		AccountID:    doc.AccountID,
+	}, nil
+}
+
+func fetchGCP(ctx context.Context, c *http.Client, base string) (*tailcfg.CloudInfo, error) {
+	hdr := map[string]string{"Metadata-Flavor": "Google"}
+	body, err := getMetadata(ctx, c, "GET", base+"/computeMetadata/v1/instance/?recursive=true", hdr)
+	if err != nil {
+		return nil, err
+	}
+	var inst struct {
+		ID          json.Number `json:"id"`
+		Zone        string      `json:"zone"`        // "projects/123/zones/us-central1-a"
+		MachineType string      `json:"machineType"` // "projects/123/machineTypes/e2-small"
+	}
+	if err := json.Unmarshal(body, &inst); err != nil {
+		return nil, err
+	}
+	if inst.ID == "" {
+		return nil, errors.New("gcp: no instance ID")
+	}
+	project, err := getMetadata(ctx, c, "GET", base+"/computeMetadata/v1/project/project-id", hdr)
+	if err != nil {
+		return nil, err
+	}
+	zone := path.Base(inst.Zone)
+	return &tailcfg.CloudInfo{
+		Provider:     "gcp",
+		Region:       gcpRegion(zone),
+		Zone:         zone,
+		InstanceType: path.Base(inst.MachineType),
+		InstanceID:   inst.ID.String(),
+		AccountID:    string(project),
+	}, nil
+}
+
+// gcpRegion returns the region of a GCP zone, which is the zone
+// without its last dash-separated part ("us-central1-a" is in
+// "us-central1").
+func gcpRegion(zone string) string {
+	for i := len(zone) - 1; i >= 0; i-- {
+		if zone[i] == '-' {
+			return zone[:i]
+		}
+	}
+	return zone
+}
+
+func fetchAzure(ctx context.Context, c *http.Client, base string) (*tailcfg.CloudInfo, error) {
+	body, err := getMetadata(ctx, c, "GET", base+"/metadata/instance/compute?api-version=2020-06-01", map[string]string{
+		"Metadata": "true",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var compute struct {
+		Location       string `json:"location"`
+		Zone           string `json:"zone"`
+		VMSize         string `json:"vmSize"`
+		VMID           string `json:"vmId"`
+		SubscriptionID string `json:"subscriptionId"`
+	}
+	if err := json.Unmarshal(body, &compute); err != nil {
+		return nil, err
+	}
+	if compute.VMID == "" {
+		return nil, errors.New("azure: no VM ID")
+	}
+	ci := &tailcfg.CloudInfo{
+		Provider:     "azure",
+		Region:       compute.Location,
+		InstanceType: compute.VMSize,
+		InstanceID:   compute.VMID,
+		AccountID:    compute.SubscriptionID,
+	}
+	if compute.Zone != "" {
+		// Azure zones are just numbers within the region.
+		if _, err := strconv.Atoi(compute.Zone); err == nil {
+			ci.Zone = compute.Location + "-" + compute.Zone
+		} else {
+			ci.Zone = compute.Zone
+		}
+	}
+	return ci, nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloudinfo
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    *tailcfg.CloudInfo
+	}{
+		{
+			name: "aws",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == "PUT" && r.URL.Path == "/latest/api/token":
+					io.WriteString(w, "tok")
+				case r.URL.Path == "/latest/dynamic/instance-identity/document" && r.Header.Get("X-aws-ec2-metadata-token") == "tok":
+					io.WriteString(w, `{"accountId":"123456789012","availabilityZone":"us-east-1a","instanceId":"i-0abc","instanceType":"t3.micro","region":"us-east-1"}`)
+				default:
+					http.NotFound(w, r)
+				}
+			},
+			want: &tailcfg.CloudInfo{
+				Provider:     "aws",
+				Region:       "us-east-1",
+				Zone:         "us-east-1a",
+				InstanceType: "t3.micro",
+				InstanceID:   "i-0abc",
+				AccountID:    "123456789012",
+			},
+		},
+		{
+			name: "gcp",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Metadata-Flavor") != "Google" {
+					http.NotFound(w, r)
+					return
+				}
+				switch r.URL.Path {
+				case "/computeMetadata/v1/instance/":
+					io.WriteString(w, `{"id":4520031799277581759,"machineType":"projects/123/machineTypes/e2-small","zone":"projects/123/zones/us-central1-a"}`)
+				case "/computeMetadata/v1/project/project-id":
+					io.WriteString(w, "my-project")
+				default:
+					http.NotFound(w, r)
+				}
+			},
+			want: &tailcfg.CloudInfo{
+				Provider:     "gcp",
+				Region:       "us-central1",
+				Zone:         "us-central1-a",
+				InstanceType: "e2-small",
+				InstanceID:   "4520031799277581759",
+				AccountID:    "my-project",
+			},
+		},
+		{
+			name: "azure",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/metadata/instance/compute" || r.Header.Get("Metadata") != "true" {
+					http.NotFound(w, r)
+					return
+				}
+				io.WriteString(w, `{"location":"westeurope","subscriptionId":"sub-1","vmId":"vm-1","vmSize":"Standard_B1s","zone":"2"}`)
+			},
+			want: &tailcfg.CloudInfo{
+				Provider:     "azure",
+				Region:       "westeurope",
+				Zone:         "westeurope-2",
+				InstanceType: "Standard_B1s",
+				InstanceID:   "vm-1",
+				AccountID:    "sub-1",
+			},
+		},
+		{
+			name:    "none",
+			handler: http.NotFound,
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(tt.handler)
+			defer ts.Close()
+
+			got := get(context.Background(), ts.Client(), ts.URL)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
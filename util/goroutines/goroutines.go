@@ -0,0 +1,28 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package goroutines dumps the stacks of all of a process's goroutines,
+// for debugging wedges.
+package goroutines
+
+import (
+	"runtime/pprof"
+	"strings"
+)
+
+// Stacks returns the stacks of all goroutines.
+//
+// If full is false, goroutines with the same stack are listed once,
+// with their count, as in a goroutine profile. That's compact enough
+// to log. If full is true, each goroutine is listed as in a panic,
+// with its state and how long it's been blocked.
+func Stacks(full bool) string {
+	debug := 1
+	if full {
+		debug = 2
+	}
+	buf := new(strings.Builder)
+	pprof.Lookup("goroutine").WriteTo(buf, debug)
+	return buf.String()
+}
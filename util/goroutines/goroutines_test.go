@@ -0,0 +1,28 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package goroutines
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStacks(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	go func() { <-block }()
+
+	summary := Stacks(false)
+	if !strings.HasPrefix(summary, "goroutine profile: total ") {
+		t.Errorf("summary doesn't start with a profile header:\n%s", summary)
+	}
+	full := Stacks(true)
+	if !strings.Contains(full, "[chan receive") {
+		t.Errorf("full stacks missing the blocked goroutine's state:\n%s", full)
+	}
+	if !strings.Contains(full, "TestStacks") {
+		t.Errorf("full stacks missing this test:\n%s", full)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package lsm detects the Linux security modules, SELinux and
+// AppArmor, confining tailscaled, and keeps track of the operations
+// they deny it, so that a denial can be reported as such rather than
+// as a bare "permission denied".
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// An Op is an operation of tailscaled's that a security policy can
+// deny.
+type Op string
+
+const (
+	OpTUN        Op = "open /dev/net/tun"
+	OpResolvConf Op = "write /etc/resolv.conf"
+	OpStateDir   Op = "write its state file"
+)
+
+// Module is a security module enforcing a policy on this process.
+type Module struct {
+	Name string // "SELinux" or "AppArmor"
+	// Label is the process's SELinux context or AppArmor profile.
+	Label string
+}
+
+// active is the platform's implementation of Active.
+var active func() (Module, bool)
+
+var geteuid = os.Geteuid // for tests
+
+// Active returns the security module enforcing a policy on this
+// process, if any.
+func Active() (Module, bool) {
+	if active == nil {
+		return Module{}, false
+	}
+	return active()
+}
+
+// A Denial is an operation denied by a security module.
+type Denial struct {
+	Op     Op
+	Module Module
+	Err    string
+}
+
+func (d Denial) String() string {
+	return fmt.Sprintf("%s (%s) denied tailscaled permission to %s: %s; \"tailscale debug policy\" prints a policy that allows it",
+		d.Module.Name, d.Module.Label, d.Op, d.Err)
+}
+
+var (
+	mu      sync.Mutex
+	denials = map[Op]Denial{}
+)
+
+// Check records the outcome of op, which failed with err or, if err
+// is nil, succeeded. It reports whether err is a denial: a permission
+// error while running as root under a security module, which is more
+// likely the module's doing than the file's permissions. A later
+// success forgets the denial.
+func Check(op Op, err error) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if err == nil {
+		delete(denials, op)
+		return false
+	}
+	if !errors.Is(err, os.ErrPermission) || geteuid() != 0 {
+		return false
+	}
+	m, ok := Active()
+	if !ok {
+		return false
+	}
+	denials[op] = Denial{Op: op, Module: m, Err: err.Error()}
+	return true
+}
+
+// Denied returns the denial of op, if it's currently denied.
+func Denied(op Op) (Denial, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	d, ok := denials[op]
+	return d, ok
+}
+
+// Denials returns the operations currently denied, sorted by Op.
+func Denials() []Denial {
+	mu.Lock()
+	defer mu.Unlock()
+	ret := make([]Denial, 0, len(denials))
+	for _, d := range denials {
+		ret = append(ret, d)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Op < ret[j].Op })
+	return ret
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lsm
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+func init() {
+	active = activeLinux
+}
+
+func readAttr(path string) string {
+	b, _ := ioutil.ReadFile(path)
+	return strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+}
+
+func activeLinux() (Module, bool) {
+	if readAttr("/sys/fs/selinux/enforce") == "1" {
+		if ctx := readAttr("/proc/self/attr/current"); selinuxConfined(ctx) {
+			return Module{Name: "SELinux", Label: ctx}, true
+		}
+	}
+	if readAttr("/sys/module/apparmor/parameters/enabled") == "Y" {
+		label := readAttr("/proc/self/attr/apparmor/current")
+		if label == "" {
+			// Kernels before 5.1 have no per-module attributes.
+			label = readAttr("/proc/self/attr/current")
+		}
+		if profile, ok := appArmorEnforced(label); ok {
+			return Module{Name: "AppArmor", Label: profile}, true
+		}
+	}
+	return Module{}, false
+}
+
+// selinuxConfined reports whether the SELinux context ctx, like
+// "system_u:system_r:container_t:s0", is of a domain that the policy
+// confines.
+func selinuxConfined(ctx string) bool {
+	f := strings.Split(ctx, ":")
+	if len(f) < 3 {
+		return false
+	}
+	domain := f[2]
+	return !strings.HasPrefix(domain, "unconfined_") && domain != "spc_t"
+}
+
+// appArmorEnforced returns the profile of the AppArmor label, like
+// "/usr/sbin/tailscaled (enforce)", and whether it's enforced rather
+// than in complain mode or unconfined.
+func appArmorEnforced(label string) (profile string, ok bool) {
+	const suffix = " (enforce)"
+	if !strings.HasSuffix(label, suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(label, suffix), true
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lsm
+
+import "testing"
+
+func TestSELinuxConfined(t *testing.T) {
+	tests := []struct {
+		ctx  string
+		want bool
+	}{
+		{"system_u:system_r:container_t:s0:c1,c2", true},
+		{"system_u:system_r:tailscaled_t:s0", true},
+		{"system_u:system_r:unconfined_service_t:s0", false},
+		{"unconfined_u:unconfined_r:unconfined_t:s0-s0:c0.c1023", false},
+		{"system_u:system_r:spc_t:s0", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := selinuxConfined(tt.ctx); got != tt.want {
+			t.Errorf("selinuxConfined(%q) = %v; want %v", tt.ctx, got, tt.want)
+		}
+	}
+}
+
+func TestAppArmorEnforced(t *testing.T) {
+	tests := []struct {
+		label   string
+		profile string
+		ok      bool
+	}{
+		{"/usr/sbin/tailscaled (enforce)", "/usr/sbin/tailscaled", true},
+		{"snap.tailscale.tailscaled (enforce)", "snap.tailscale.tailscaled", true},
+		{"/usr/sbin/tailscaled (complain)", "", false},
+		{"unconfined", "", false},
+	}
+	for _, tt := range tests {
+		profile, ok := appArmorEnforced(tt.label)
+		if profile != tt.profile || ok != tt.ok {
+			t.Errorf("appArmorEnforced(%q) = %q, %v; want %q, %v", tt.label, profile, ok, tt.profile, tt.ok)
+		}
+	}
+}
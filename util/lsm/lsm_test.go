@@ -0,0 +1,58 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	oldActive, oldGeteuid := active, geteuid
+	defer func() {
+		active, geteuid = oldActive, oldGeteuid
+		denials = map[Op]Denial{}
+	}()
+	mod := Module{Name: "SELinux", Label: "system_u:system_r:container_t:s0"}
+	enforcing := true
+	active = func() (Module, bool) { return mod, enforcing }
+	euid := 0
+	geteuid = func() int { return euid }
+
+	denied := &os.PathError{Op: "open", Path: "/dev/net/tun", Err: os.ErrPermission}
+	if !Check(OpTUN, fmt.Errorf("CreateTUN: %w", denied)) {
+		t.Error("permission error as root under SELinux isn't a denial")
+	}
+	if Check(OpStateDir, errors.New("disk full")) {
+		t.Error("other error is a denial")
+	}
+	euid = 1000
+	if Check(OpResolvConf, denied) {
+		t.Error("permission error as non-root is a denial")
+	}
+	euid, enforcing = 0, false
+	if Check(OpResolvConf, denied) {
+		t.Error("permission error without a security module is a denial")
+	}
+
+	ds := Denials()
+	if len(ds) != 1 || ds[0].Op != OpTUN || ds[0].Module != mod {
+		t.Fatalf("Denials = %+v; want just %q", ds, OpTUN)
+	}
+	if d, ok := Denied(OpTUN); !ok || d != ds[0] {
+		t.Errorf("Denied(%q) = %+v, %v; want %+v", OpTUN, d, ok, ds[0])
+	}
+	if Check(OpTUN, nil) {
+		t.Error("success is a denial")
+	}
+	if ds := Denials(); len(ds) != 0 {
+		t.Errorf("Denials after success = %+v; want none", ds)
+	}
+	if _, ok := Denied(OpTUN); ok {
+		t.Errorf("Denied(%q) after success", OpTUN)
+	}
+}
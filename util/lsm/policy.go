@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lsm
+
+// SELinuxPolicy returns a reference SELinux policy module for
+// tailscaled installed in the standard paths, as the type
+// enforcement (tailscaled.te) and file contexts (tailscaled.fc) to
+// build it from with the distribution's policy development files.
+// It gives tailscaled a domain of its own with what it needs: the
+// TUN device, network administration, resolv.conf and its state,
+// cache and socket directories.
+func SELinuxPolicy() (te, fc string) {
+	return selinuxTE, selinuxFC
+}
+
+const selinuxTE = `# Reference SELinux policy for tailscaled, from "tailscale debug policy".
+# Build and load it with the policy development files:
+#   make -f /usr/share/selinux/devel/Makefile tailscaled.pp
+#   semodule -i tailscaled.pp
+#   restorecon -R /usr/sbin/tailscaled /var/lib/tailscale /var/cache/tailscale /run/tailscale
+policy_module(tailscaled, 1.0.0)
+
+type tailscaled_t;
+type tailscaled_exec_t;
+init_daemon_domain(tailscaled_t, tailscaled_exec_t)
+
+type tailscaled_var_lib_t;
+files_type(tailscaled_var_lib_t)
+type tailscaled_cache_t;
+files_type(tailscaled_cache_t)
+type tailscaled_var_run_t;
+files_pid_file(tailscaled_var_run_t)
+
+# State, cache and the CLI's socket.
+manage_dirs_pattern(tailscaled_t, tailscaled_var_lib_t, tailscaled_var_lib_t)
+manage_files_pattern(tailscaled_t, tailscaled_var_lib_t, tailscaled_var_lib_t)
+files_var_lib_filetrans(tailscaled_t, tailscaled_var_lib_t, dir)
+manage_dirs_pattern(tailscaled_t, tailscaled_cache_t, tailscaled_cache_t)
+manage_files_pattern(tailscaled_t, tailscaled_cache_t, tailscaled_cache_t)
+files_var_filetrans(tailscaled_t, tailscaled_cache_t, dir)
+manage_dirs_pattern(tailscaled_t, tailscaled_var_run_t, tailscaled_var_run_t)
+manage_sock_files_pattern(tailscaled_t, tailscaled_var_run_t, tailscaled_var_run_t)
+files_pid_filetrans(tailscaled_t, tailscaled_var_run_t, dir)
+
+# The TUN device, routes, rules and firewall.
+allow tailscaled_t self:capability { net_admin net_raw };
+allow tailscaled_t self:tun_socket create_socket_perms;
+allow tailscaled_t self:netlink_route_socket create_netlink_socket_perms;
+allow tailscaled_t self:udp_socket create_socket_perms;
+allow tailscaled_t self:tcp_socket create_stream_socket_perms;
+corenet_rw_tun_tap_dev(tailscaled_t)
+corenet_udp_bind_generic_node(tailscaled_t)
+corenet_udp_bind_all_unreserved_ports(tailscaled_t)
+corenet_tcp_connect_all_ports(tailscaled_t)
+corecmd_exec_bin(tailscaled_t)
+sysnet_domtrans_ifconfig(tailscaled_t)
+iptables_domtrans(tailscaled_t)
+kernel_read_network_state(tailscaled_t)
+dev_read_sysfs(tailscaled_t)
+
+# DNS: resolv.conf, and the resolvers it may hand configuration to.
+sysnet_manage_config(tailscaled_t)
+sysnet_etc_filetrans_config(tailscaled_t)
+sysnet_dns_name_resolve(tailscaled_t)
+optional_policy(` + "`" + `
+	dbus_system_bus_client(tailscaled_t)
+	systemd_dbus_chat_resolved(tailscaled_t)
+')
+`
+
+const selinuxFC = `/usr/sbin/tailscaled	--	gen_context(system_u:object_r:tailscaled_exec_t,s0)
+/var/lib/tailscale(/.*)?	gen_context(system_u:object_r:tailscaled_var_lib_t,s0)
+/var/cache/tailscale(/.*)?	gen_context(system_u:object_r:tailscaled_cache_t,s0)
+/run/tailscale(/.*)?	gen_context(system_u:object_r:tailscaled_var_run_t,s0)
+`
+
+// AppArmorProfile returns a reference AppArmor profile for tailscaled
+// installed in the standard paths, with the same access as
+// SELinuxPolicy's. The helpers tailscaled runs, like ip and
+// iptables, run under their own profiles, if any.
+func AppArmorProfile() string {
+	return appArmorProfile
+}
+
+const appArmorProfile = `# Reference AppArmor profile for tailscaled, from "tailscale debug policy".
+# Install it as /etc/apparmor.d/usr.sbin.tailscaled and load it with:
+#   apparmor_parser -r /etc/apparmor.d/usr.sbin.tailscaled
+#include <tunables/global>
+
+/usr/sbin/tailscaled {
+  #include <abstractions/base>
+  #include <abstractions/nameservice>
+
+  capability net_admin,
+  capability net_raw,
+  network,
+
+  /usr/sbin/tailscaled mr,
+  /dev/net/tun rw,
+  @{PROC}/** r,
+  @{sys}/** r,
+
+  # Routes, rules, firewall and DNS helpers.
+  /{,usr/}{,s}bin/* PUx,
+
+  # State, cache and the CLI's socket.
+  /var/lib/tailscale/ rw,
+  /var/lib/tailscale/** rwk,
+  /var/cache/tailscale/ rw,
+  /var/cache/tailscale/** rw,
+  /{,var/}run/tailscale/ rw,
+  /{,var/}run/tailscale/** rw,
+
+  # resolv.conf, its backup and Tailscale's own.
+  /etc/ r,
+  /etc/resolv.conf rw,
+  /etc/resolv.*.conf* rw,
+}
+`
@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package syspolicy reads settings enforced by the system
+// administrator, such as through MDM or group policy, from the
+// platform's policy store.
+//
+// The policy stores are:
+//
+//   - Windows: values under the HKLM\SOFTWARE\Policies\Tailscale
+//     registry key (REG_DWORD for booleans, REG_SZ for strings).
+//   - macOS: the io.tailscale.ipn.macos managed preferences, as
+//     installed by a configuration profile.
+//   - elsewhere: the JSON file /etc/tailscale/policy.json, which
+//     must be owned by root and not writable by anyone else.
+//
+// In all of them, settings are named after the fields of Policy.
+package syspolicy
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Policy is a set of settings enforced by the system administrator.
+// Each field overrides the ipn.Prefs field of the same name. Nil
+// fields aren't managed, and are left to the user.
+type Policy struct {
+	ControlURL *string `json:",omitempty"`
+	RouteAll   *bool   `json:",omitempty"`
+	CorpDNS    *bool   `json:",omitempty"`
+	ShieldsUp  *bool   `json:",omitempty"`
+	Hostname   *string `json:",omitempty"`
+	CloudInfo  *bool   `json:",omitempty"`
+	KillSwitch *bool   `json:",omitempty"`
+	Lockdown   *bool   `json:",omitempty"`
+}
+
+// Read returns the policy currently set by the system administrator.
+// It returns a nil Policy and no error if there is none.
+func Read() (*Policy, error) {
+	return read()
+}
+
+// Managed returns the names of the settings that p manages.
+func (p *Policy) Managed() []string {
+	if p == nil {
+		return nil
+	}
+	var ret []string
+	v := reflect.ValueOf(p).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Field(i).IsNil() {
+			ret = append(ret, v.Type().Field(i).Name)
+		}
+	}
+	return ret
+}
+
+// parseJSON parses a JSON policy document. Unknown settings are
+// ignored, so that policies can be shared with newer versions.
+func parseJSON(b []byte) (*Policy, error) {
+	p := new(Policy)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	if len(p.Managed()) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
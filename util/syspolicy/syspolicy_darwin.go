@@ -0,0 +1,31 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syspolicy
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// managedPrefs is where macOS installs the settings of the
+// io.tailscale.ipn.macos payload of configuration profiles. Only
+// root can write there.
+const managedPrefs = "/Library/Managed Preferences/io.tailscale.ipn.macos.plist"
+
+func read() (*Policy, error) {
+	if _, err := os.Stat(managedPrefs); os.IsNotExist(err) {
+		return nil, nil
+	}
+	out, err := exec.Command("plutil", "-convert", "json", "-o", "-", managedPrefs).Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", managedPrefs, err)
+	}
+	p, err := parseJSON(out)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", managedPrefs, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syspolicy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseJSON(t *testing.T) {
+	tests := []struct {
+		in          string
+		wantManaged []string
+		wantErr     bool
+	}{
+		{in: `{}`},
+		{in: `{"SomeFutureSetting": true}`},
+		{
+			in:          `{"ControlURL": "https://ctrl.example.com", "ShieldsUp": false, "Lockdown": true}`,
+			wantManaged: []string{"ControlURL", "ShieldsUp", "Lockdown"},
+		},
+		{in: `{"ShieldsUp": "yes"}`, wantErr: true},
+		{in: `not json`, wantErr: true},
+	}
+	for _, tt := range tests {
+		p, err := parseJSON([]byte(tt.in))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseJSON(%s): err = %v; want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got := p.Managed(); !reflect.DeepEqual(got, tt.wantManaged) {
+			t.Errorf("parseJSON(%s): managed = %q; want %q", tt.in, got, tt.wantManaged)
+		}
+	}
+
+	p, err := parseJSON([]byte(`{"ShieldsUp": false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ShieldsUp == nil || *p.ShieldsUp {
+		t.Errorf("ShieldsUp = %v; want explicit false", p.ShieldsUp)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows,!darwin
+
+package syspolicy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+const policyFile = "/etc/tailscale/policy.json"
+
+func read() (*Policy, error) {
+	return readFile(policyFile)
+}
+
+func readFile(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The policy overrides the user's own settings, so it must
+	// come from an administrator.
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Uid != 0 {
+		return nil, fmt.Errorf("%s is not owned by root", path)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return nil, fmt.Errorf("%s is writable by non-root users (mode %v)", path, fi.Mode().Perm())
+	}
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parseJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return p, nil
+}
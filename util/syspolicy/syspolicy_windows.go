@@ -0,0 +1,61 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syspolicy
+
+import (
+	"fmt"
+	"reflect"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// policyKey is the registry key, under HKEY_LOCAL_MACHINE, that
+// group policy writes Tailscale's settings to.
+const policyKey = `SOFTWARE\Policies\Tailscale`
+
+func read() (*Policy, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, policyKey, registry.QUERY_VALUE)
+	if err == registry.ErrNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening HKLM\\%s: %v", policyKey, err)
+	}
+	defer k.Close()
+
+	p := new(Policy)
+	v := reflect.ValueOf(p).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		f := v.Field(i)
+		switch f.Type().Elem().Kind() {
+		case reflect.Bool:
+			n, _, err := k.GetIntegerValue(name)
+			if err == registry.ErrNotExist {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("HKLM\\%s\\%s: %v", policyKey, name, err)
+			}
+			b := n != 0
+			f.Set(reflect.ValueOf(&b))
+		case reflect.String:
+			s, _, err := k.GetStringValue(name)
+			if err == registry.ErrNotExist {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("HKLM\\%s\\%s: %v", policyKey, name, err)
+			}
+			f.Set(reflect.ValueOf(&s))
+		default:
+			panic(fmt.Sprintf("syspolicy: unhandled type of Policy.%s", name))
+		}
+	}
+	if len(p.Managed()) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/types/key"
+	"tailscale.com/wgengine/router"
+)
+
+// maxDiffItems is how many added, removed or changed items of a list
+// a config diff names before summarizing the rest as a count.
+const maxDiffItems = 8
+
+// wgConfigDiff returns a one-line summary of what changed between
+// two WireGuard configs, for logging on each Reconfig in place of the
+// configs themselves. Its output is deterministic, so the same change
+// always logs the same way.
+func wgConfigDiff(prev, cfg *wgcfg.Config) string {
+	var parts []string
+	if prev.PrivateKey != cfg.PrivateKey {
+		parts = append(parts, "private key changed")
+	}
+	if prev.ListenPort != cfg.ListenPort {
+		parts = append(parts, fmt.Sprintf("listen port %d->%d", prev.ListenPort, cfg.ListenPort))
+	}
+	parts = appendListDiff(parts, "addrs", cidrStrings(prev.Addresses), cidrStrings(cfg.Addresses))
+
+	old := make(map[wgcfg.Key]*wgcfg.Peer, len(prev.Peers))
+	for i := range prev.Peers {
+		old[prev.Peers[i].PublicKey] = &prev.Peers[i]
+	}
+	var added, removed, changed []string
+	for i := range cfg.Peers {
+		p := &cfg.Peers[i]
+		op, ok := old[p.PublicKey]
+		delete(old, p.PublicKey)
+		switch {
+		case !ok:
+			added = append(added, key.Public(p.PublicKey).ShortString())
+		case !peersEqual(op, p):
+			changed = append(changed, key.Public(p.PublicKey).ShortString())
+		}
+	}
+	for k := range old {
+		removed = append(removed, key.Public(k).ShortString())
+	}
+	if len(added)+len(removed)+len(changed) > 0 {
+		sort.Strings(added)
+		sort.Strings(removed)
+		sort.Strings(changed)
+		parts = append(parts, fmt.Sprintf("peers +%d -%d ~%d%s", len(added), len(removed), len(changed), diffItems(added, removed, changed)))
+	}
+	return joinDiff(parts)
+}
+
+// routerConfigDiff is like wgConfigDiff, but for router configs.
+func routerConfigDiff(prev, cfg *router.Config) string {
+	var parts []string
+	parts = appendListDiff(parts, "addrs", prefixStrings(prev.LocalAddrs), prefixStrings(cfg.LocalAddrs))
+	parts = appendListDiff(parts, "routes", prefixStrings(prev.Routes), prefixStrings(cfg.Routes))
+	parts = appendListDiff(parts, "local routes", prefixStrings(prev.LocalRoutes), prefixStrings(cfg.LocalRoutes))
+	parts = appendListDiff(parts, "subnet routes", prefixStrings(prev.SubnetRoutes), prefixStrings(cfg.SubnetRoutes))
+	parts = appendListDiff(parts, "proxy neighbors", prefixStrings(prev.ProxyNeighbors), prefixStrings(cfg.ProxyNeighbors))
+	parts = appendListDiff(parts, "no snat from", prefixStrings(prev.NoSNATFrom), prefixStrings(cfg.NoSNATFrom))
+	// The order of nameservers and search domains matters, so
+	// they're logged whole.
+	if a, b := ipStrings(prev.DNS), ipStrings(cfg.DNS); a != b {
+		parts = append(parts, fmt.Sprintf("dns [%s]->[%s]", a, b))
+	}
+	if a, b := strings.Join(prev.DNSDomains, " "), strings.Join(cfg.DNSDomains, " "); a != b {
+		parts = append(parts, fmt.Sprintf("domains [%s]->[%s]", a, b))
+	}
+	parts = appendListDiff(parts, "dns routes", prev.DNSRoutes, cfg.DNSRoutes)
+	if prev.DNSDefaultRoute != cfg.DNSDefaultRoute {
+		parts = append(parts, fmt.Sprintf("dns default route %v->%v", prev.DNSDefaultRoute, cfg.DNSDefaultRoute))
+	}
+	if prev.DNSProbeName != cfg.DNSProbeName {
+		parts = append(parts, fmt.Sprintf("dns probe %q->%q", prev.DNSProbeName, cfg.DNSProbeName))
+	}
+	if prev.NoExclusiveDNS != cfg.NoExclusiveDNS {
+		parts = append(parts, fmt.Sprintf("dns exclusive %v->%v", !prev.NoExclusiveDNS, !cfg.NoExclusiveDNS))
+	}
+	if prev.SNATSubnetRoutes != cfg.SNATSubnetRoutes {
+		parts = append(parts, fmt.Sprintf("snat %v->%v", prev.SNATSubnetRoutes, cfg.SNATSubnetRoutes))
+	}
+	if prev.NetfilterMode != cfg.NetfilterMode {
+		parts = append(parts, fmt.Sprintf("netfilter %v->%v", prev.NetfilterMode, cfg.NetfilterMode))
+	}
+	if prev.KillSwitch != cfg.KillSwitch {
+		parts = append(parts, fmt.Sprintf("killswitch %v->%v", prev.KillSwitch, cfg.KillSwitch))
+	}
+	if prev.Lockdown != cfg.Lockdown {
+		parts = append(parts, fmt.Sprintf("lockdown %v->%v", prev.Lockdown, cfg.Lockdown))
+	}
+	return joinDiff(parts)
+}
+
+func joinDiff(parts []string) string {
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// appendListDiff appends to parts the items added to and removed
+// from the list name, if any.
+func appendListDiff(parts []string, name string, prev, cur []string) []string {
+	inPrev := make(map[string]bool, len(prev))
+	for _, s := range prev {
+		inPrev[s] = true
+	}
+	var added, removed []string
+	for _, s := range cur {
+		if !inPrev[s] {
+			added = append(added, s)
+		}
+		delete(inPrev, s)
+	}
+	for s := range inPrev {
+		removed = append(removed, s)
+	}
+	if len(added)+len(removed) == 0 {
+		return parts
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return append(parts, name+diffItems(added, removed, nil))
+}
+
+// diffItems formats added, removed and changed items as " +a -b ~c",
+// naming at most maxDiffItems of them.
+func diffItems(added, removed, changed []string) string {
+	var b strings.Builder
+	n := 0
+	for _, l := range []struct {
+		sign  string
+		items []string
+	}{{"+", added}, {"-", removed}, {"~", changed}} {
+		for _, s := range l.items {
+			if n == maxDiffItems {
+				fmt.Fprintf(&b, " (%d more)", len(added)+len(removed)+len(changed)-n)
+				return b.String()
+			}
+			b.WriteString(" " + l.sign + s)
+			n++
+		}
+	}
+	return b.String()
+}
+
+func cidrStrings(cidrs []wgcfg.CIDR) []string {
+	ret := make([]string, len(cidrs))
+	for i, c := range cidrs {
+		ret[i] = c.String()
+	}
+	return ret
+}
+
+func prefixStrings(pfxs []netaddr.IPPrefix) []string {
+	ret := make([]string, len(pfxs))
+	for i, p := range pfxs {
+		ret[i] = p.String()
+	}
+	return ret
+}
+
+func ipStrings(ips []netaddr.IP) string {
+	ss := make([]string, len(ips))
+	for i, ip := range ips {
+		ss[i] = ip.String()
+	}
+	return strings.Join(ss, " ")
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/types/key"
+	"tailscale.com/wgengine/router"
+)
+
+func TestWGConfigDiff(t *testing.T) {
+	k1, k2, k3 := wgcfg.Key{1}, wgcfg.Key{2}, wgcfg.Key{3}
+	short := func(k wgcfg.Key) string { return key.Public(k).ShortString() }
+	prev := &wgcfg.Config{
+		ListenPort: 41641,
+		Peers:      []wgcfg.Peer{{PublicKey: k1}, {PublicKey: k2}},
+	}
+	cfg := &wgcfg.Config{
+		ListenPort: 41641,
+		Peers:      []wgcfg.Peer{{PublicKey: k1, PersistentKeepalive: 25}, {PublicKey: k3}},
+	}
+
+	want := fmt.Sprintf("peers +1 -1 ~1 +%s -%s ~%s", short(k3), short(k2), short(k1))
+	if got := wgConfigDiff(prev, cfg); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got := wgConfigDiff(cfg, cfg); got != "no changes" {
+		t.Errorf("same config: got %q", got)
+	}
+
+	var many wgcfg.Config
+	for i := 0; i < maxDiffItems+3; i++ {
+		many.Peers = append(many.Peers, wgcfg.Peer{PublicKey: wgcfg.Key{byte(i)}})
+	}
+	want = "peers +11 -0 ~0"
+	for i := 0; i < maxDiffItems; i++ {
+		want += " +" + short(wgcfg.Key{byte(i)})
+	}
+	want += " (3 more)"
+	if got := wgConfigDiff(&wgcfg.Config{}, &many); got != want {
+		t.Errorf("many peers: got %q; want %q", got, want)
+	}
+}
+
+func TestRouterConfigDiff(t *testing.T) {
+	pfx := func(ss ...string) []netaddr.IPPrefix {
+		var ret []netaddr.IPPrefix
+		for _, s := range ss {
+			p, err := netaddr.ParseIPPrefix(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, p)
+		}
+		return ret
+	}
+	prev := &router.Config{
+		LocalAddrs: pfx("100.101.102.103/32"),
+		Routes:     pfx("100.64.0.0/10", "192.168.1.0/24"),
+	}
+	cfg := &router.Config{
+		LocalAddrs:       pfx("100.101.102.103/32"),
+		Routes:           pfx("100.64.0.0/10", "10.0.0.0/8", "10.1.0.0/16"),
+		DNS:              []netaddr.IP{netaddr.IPv4(100, 100, 100, 100)},
+		SNATSubnetRoutes: true,
+	}
+	want := "routes +10.0.0.0/8 +10.1.0.0/16 -192.168.1.0/24; dns []->[100.100.100.100]; snat false->true"
+	if got := routerConfigDiff(prev, cfg); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got := routerConfigDiff(cfg, cfg); got != "no changes" {
+		t.Errorf("same config: got %q", got)
+	}
+}
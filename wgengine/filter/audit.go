@@ -0,0 +1,126 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+	"tailscale.com/wgengine/packet"
+)
+
+// auditBucket limits the records logged with AuditDrops. It's more
+// generous than dropBucket, as audit mode is turned on deliberately,
+// to see why packets are dropped while rolling out ACL changes.
+var auditBucket = rate.NewLimiter(rate.Every(100*time.Millisecond), 50)
+
+// auditSuppressed is the number of audit records not logged, because
+// of auditBucket, since the last one that was. Accessed atomically.
+var auditSuppressed int64
+
+// maxAuditRules is the most rules named in one AuditRecord.
+const maxAuditRules = 5
+
+// AuditRecord is logged, as JSON following "filter: audit: ", for each
+// packet dropped while the AuditDrops flag is set.
+type AuditRecord struct {
+	Dir    string // "in" or "out"
+	Proto  string // "TCP", "UDP", "ICMP", ...
+	Src    string // ip:port
+	Dst    string // ip:port
+	Len    int    // of the packet, in bytes
+	Reason string // why the packet was dropped
+
+	// Detail and Rules attribute a "no rules matched" drop to the
+	// filter rules. Rules are the (at most maxAuditRules) rules that
+	// allow either the packet's source or its destination, but not
+	// both; Detail says which.
+	Detail string   `json:",omitempty"`
+	Rules  []string `json:",omitempty"`
+
+	// Suppressed is how many records weren't logged before this
+	// one, due to rate limiting.
+	Suppressed int64 `json:",omitempty"`
+}
+
+// auditDrop logs an AuditRecord for q, which was given verdict r for
+// reason why, if r is Drop and rf has AuditDrops set.
+func (f *Filter) auditDrop(rf RunFlags, dir string, q *packet.ParsedPacket, r Response, why string) {
+	if r != Drop || rf&AuditDrops == 0 {
+		return
+	}
+	if !auditBucket.Allow() {
+		atomic.AddInt64(&auditSuppressed, 1)
+		return
+	}
+	rec := f.auditRecord(dir, q, why)
+	rec.Suppressed = atomic.SwapInt64(&auditSuppressed, 0)
+	j, err := json.Marshal(rec)
+	if err != nil {
+		f.logf("filter: audit: %v", err)
+		return
+	}
+	f.logf("filter: audit: %s", j)
+}
+
+// auditRecord returns the AuditRecord for q, dropped for reason why.
+func (f *Filter) auditRecord(dir string, q *packet.ParsedPacket, why string) AuditRecord {
+	rec := AuditRecord{
+		Dir:    dir,
+		Proto:  q.IPProto.String(),
+		Src:    fmt.Sprintf("%v:%d", q.SrcIP, q.SrcPort),
+		Dst:    fmt.Sprintf("%v:%d", q.DstIP, q.DstPort),
+		Len:    len(q.Buffer()),
+		Reason: why,
+	}
+	if why != "no rules matched" {
+		return rec
+	}
+
+	// ICMP is allowed to any IP with an open port, so only
+	// look at ports for TCP and UDP, like runIn does.
+	checkPort := q.IPProto != packet.ICMP
+	var srcRules, dstRules []string
+	for _, m := range f.matches {
+		srcOK := ipInList(q.SrcIP, m.Srcs)
+		dstOK := false
+		for _, dst := range m.Dsts {
+			if !dst.Net.Includes(q.DstIP) {
+				continue
+			}
+			if checkPort && (q.DstPort < dst.Ports.First || q.DstPort > dst.Ports.Last) {
+				continue
+			}
+			dstOK = true
+			break
+		}
+		switch {
+		case srcOK && !dstOK:
+			srcRules = append(srcRules, m.String())
+		case dstOK && !srcOK:
+			dstRules = append(dstRules, m.String())
+		}
+	}
+	switch {
+	case len(srcRules) == 0 && len(dstRules) == 0:
+		rec.Detail = "no rule allows the source or the destination"
+	case len(dstRules) == 0:
+		rec.Detail = "rules allow the source only to other destinations"
+		rec.Rules = srcRules
+	case len(srcRules) == 0:
+		rec.Detail = "rules allow the destination only from other sources"
+		rec.Rules = dstRules
+	default:
+		rec.Detail = "no single rule allows both the source and the destination"
+		rec.Rules = append(srcRules, dstRules...)
+	}
+	if len(rec.Rules) > maxAuditRules {
+		rec.Rules = rec.Rules[:maxAuditRules]
+	}
+	return rec
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// FirewallRules returns host firewall rules equivalent to f's policy
+// for packets arriving on the network interface named iface, so a
+// host firewall can enforce the tailnet's ACLs too, in case of a bug
+// in this package.
+//
+// format is "nftables", for a table to load with "nft -f", or "pf",
+// for an anchor to load with "pfctl -a tailscale -f".
+//
+// The rules are a little stricter than f: pf keeps state for TCP
+// rather than accepting all non-SYN packets, and neither format
+// accepts ICMP errors unrelated to a known connection.
+func (f *Filter) FirewallRules(format, iface string) (string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Generated by tailscaled from the tailnet's packet filter; don't edit.\n")
+	switch format {
+	case "nftables":
+		f.writeNFTables(&buf, iface)
+	case "pf":
+		f.writePF(&buf, iface)
+	default:
+		return "", fmt.Errorf("unknown firewall rule format %q; want nftables or pf", format)
+	}
+	return buf.String(), nil
+}
+
+// cidr returns n in CIDR notation, or "" if it includes all IPs.
+func (n Net) cidr() string {
+	if n.Mask == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", n.IP, n.Bits())
+}
+
+// cidrs returns nets in CIDR notation. It returns nil if any of them
+// includes all IPs.
+func cidrs(nets []Net) []string {
+	var ret []string
+	for _, n := range nets {
+		s := n.cidr()
+		if s == "" {
+			return nil
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+func (f *Filter) writeNFTables(buf *bytes.Buffer, iface string) {
+	set := func(ss []string) string {
+		return "{ " + strings.Join(ss, ", ") + " }"
+	}
+
+	// Declaring the table first makes deleting it work even the
+	// first time, so that reloading the file replaces the rules
+	// rather than adding to them.
+	//
+	// It's an inet table, so that its hooks see IPv6 packets too,
+	// which are dropped, as in the pf rules: the filter only has
+	// IPv4 rules.
+	fmt.Fprintf(buf, "table inet tailscale_filter\n")
+	fmt.Fprintf(buf, "delete table inet tailscale_filter\n")
+	fmt.Fprintf(buf, "table inet tailscale_filter {\n")
+	fmt.Fprintf(buf, "\tchain ts_in {\n")
+	fmt.Fprintf(buf, "\t\tct state established,related accept\n")
+	fmt.Fprintf(buf, "\t\tmeta nfproto ipv6 drop\n")
+	if len(f.localNets) == 0 {
+		fmt.Fprintf(buf, "\t\tdrop\n")
+	} else {
+		if local := cidrs(f.localNets); local != nil {
+			fmt.Fprintf(buf, "\t\tip daddr != %s drop\n", set(local))
+		}
+		fmt.Fprintf(buf, "\t\ttcp flags & (syn|ack) != syn accept\n")
+	}
+	for _, m := range f.matches {
+		if len(m.Srcs) == 0 {
+			continue
+		}
+		var from string
+		if srcs := cidrs(m.Srcs); srcs != nil {
+			from = "ip saddr " + set(srcs) + " "
+		}
+		for _, dst := range m.Dsts {
+			to := from
+			if d := dst.Net.cidr(); d != "" {
+				to += "ip daddr " + d + " "
+			}
+			if dst.Ports == PortRangeAny {
+				fmt.Fprintf(buf, "\t\t%sip protocol { tcp, udp } accept\n", to)
+			} else {
+				fmt.Fprintf(buf, "\t\t%stcp dport %v accept\n", to, dst.Ports)
+				fmt.Fprintf(buf, "\t\t%sudp dport %v accept\n", to, dst.Ports)
+			}
+			fmt.Fprintf(buf, "\t\t%sip protocol icmp accept\n", to)
+		}
+	}
+	fmt.Fprintf(buf, "\t\tdrop\n")
+	fmt.Fprintf(buf, "\t}\n")
+	for _, hook := range []string{"input", "forward"} {
+		fmt.Fprintf(buf, "\tchain %s {\n", hook)
+		fmt.Fprintf(buf, "\t\ttype filter hook %s priority 0; policy accept;\n", hook)
+		fmt.Fprintf(buf, "\t\tiifname %q jump ts_in\n", iface)
+		fmt.Fprintf(buf, "\t}\n")
+	}
+	fmt.Fprintf(buf, "}\n")
+}
+
+func (f *Filter) writePF(buf *bytes.Buffer, iface string) {
+	list := func(ss []string) string {
+		if ss == nil {
+			return "any"
+		}
+		return "{ " + strings.Join(ss, ", ") + " }"
+	}
+
+	// pf wants tables defined before any rules.
+	local := cidrs(f.localNets)
+	if local != nil {
+		fmt.Fprintf(buf, "table <tailscale_local> const %s\n", list(local))
+	}
+	fmt.Fprintf(buf, "block drop in quick on %s inet6 all\n", iface)
+	if len(f.localNets) == 0 {
+		fmt.Fprintf(buf, "block drop in quick on %s all\n", iface)
+		return
+	}
+	if local != nil {
+		fmt.Fprintf(buf, "block drop in quick on %s inet from any to ! <tailscale_local>\n", iface)
+	}
+	for _, m := range f.matches {
+		if len(m.Srcs) == 0 {
+			continue
+		}
+		from := list(cidrs(m.Srcs))
+		for _, dst := range m.Dsts {
+			to := "any"
+			if d := dst.Net.cidr(); d != "" {
+				to = d
+			}
+			var ports string
+			switch {
+			case dst.Ports == PortRangeAny:
+			case dst.Ports.First == dst.Ports.Last:
+				ports = fmt.Sprintf(" port %d", dst.Ports.First)
+			default:
+				ports = fmt.Sprintf(" port %d:%d", dst.Ports.First, dst.Ports.Last)
+			}
+			fmt.Fprintf(buf, "pass in quick on %s inet proto { tcp, udp } from %s to %s%s keep state\n", iface, from, to, ports)
+			fmt.Fprintf(buf, "pass in quick on %s inet proto icmp from %s to %s keep state\n", iface, from, to)
+		}
+	}
+	fmt.Fprintf(buf, "block drop in quick on %s all\n", iface)
+}
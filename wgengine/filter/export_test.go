@@ -0,0 +1,54 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"tailscale.com/types/logger"
+)
+
+func TestFirewallRules(t *testing.T) {
+	f := New(Matches{
+		{Srcs: nets([]IP{0x64656667}), Dsts: ippr(0x64010101, 22, 22)},
+		{Srcs: []Net{NetAny}, Dsts: netpr(0x0a000000, 8, 80, 81)},
+	}, nets([]IP{0x64010101}), nil, logger.Discard)
+
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{"nftables", []string{
+			"table inet tailscale_filter {\n",
+			"\t\tmeta nfproto ipv6 drop\n",
+			"\t\tip daddr != { 100.1.1.1/32 } drop\n",
+			"\t\tip saddr { 100.101.102.103/32 } ip daddr 100.1.1.1/32 tcp dport 22 accept\n",
+			"\t\tip daddr 10.0.0.0/8 udp dport 80-81 accept\n",
+			"\t\tiifname \"tailscale0\" jump ts_in\n",
+		}},
+		{"pf", []string{
+			"table <tailscale_local> const { 100.1.1.1/32 }\n",
+			"pass in quick on tailscale0 inet proto { tcp, udp } from { 100.101.102.103/32 } to 100.1.1.1/32 port 22 keep state\n",
+			"pass in quick on tailscale0 inet proto { tcp, udp } from any to 10.0.0.0/8 port 80:81 keep state\n",
+			"block drop in quick on tailscale0 all\n",
+		}},
+	}
+	for _, tt := range tests {
+		got, err := f.FirewallRules(tt.format, "tailscale0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s rules missing %q; got:\n%s", tt.format, want, got)
+			}
+		}
+	}
+
+	if _, err := f.FirewallRules("iptables", "tailscale0"); err == nil {
+		t.Error("unknown format: got nil error")
+	}
+}
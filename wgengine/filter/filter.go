@@ -71,6 +71,9 @@ const (
 	LogAccepts
 	HexdumpDrops
 	HexdumpAccepts
+	// AuditDrops logs a structured record, attributed to the filter
+	// rules involved, for each dropped packet. See audit.go.
+	AuditDrops
 )
 
 type tuple struct {
@@ -157,26 +160,30 @@ func (f *Filter) logRateLimit(runflags RunFlags, q *packet.ParsedPacket, r Respo
 
 // RunIn determines whether this node is allowed to receive q from a Tailscale peer.
 func (f *Filter) RunIn(q *packet.ParsedPacket, rf RunFlags) Response {
-	r := f.pre(q, rf)
+	r, why := f.pre(q, rf)
 	if r == Accept || r == Drop {
 		// already logged
+		f.auditDrop(rf, "in", q, r, why)
 		return r
 	}
 
-	r, why := f.runIn(q)
+	r, why = f.runIn(q)
 	f.logRateLimit(rf, q, r, why)
+	f.auditDrop(rf, "in", q, r, why)
 	return r
 }
 
 // RunOut determines whether this node is allowed to send q to a Tailscale peer.
 func (f *Filter) RunOut(q *packet.ParsedPacket, rf RunFlags) Response {
-	r := f.pre(q, rf)
+	r, why := f.pre(q, rf)
 	if r == Drop || r == Accept {
 		// already logged
+		f.auditDrop(rf, "out", q, r, why)
 		return r
 	}
-	r, why := f.runOut(q)
+	r, why = f.runOut(q)
 	f.logRateLimit(rf, q, r, why)
+	f.auditDrop(rf, "out", q, r, why)
 	return r
 }
 
@@ -247,30 +254,30 @@ func (f *Filter) runOut(q *packet.ParsedPacket) (r Response, why string) {
 	return Accept, "ok out"
 }
 
-func (f *Filter) pre(q *packet.ParsedPacket, rf RunFlags) Response {
+func (f *Filter) pre(q *packet.ParsedPacket, rf RunFlags) (r Response, why string) {
 	if len(q.Buffer()) == 0 {
 		// wireguard keepalive packet, always permit.
-		return Accept
+		return Accept, "keepalive"
 	}
 	if len(q.Buffer()) < 20 {
 		f.logRateLimit(rf, q, Drop, "too short")
-		return Drop
+		return Drop, "too short"
 	}
 
 	switch q.IPProto {
 	case packet.Unknown:
 		// Unknown packets are dangerous; always drop them.
 		f.logRateLimit(rf, q, Drop, "unknown")
-		return Drop
+		return Drop, "unknown"
 	case packet.IPv6:
 		f.logRateLimit(rf, q, Drop, "ipv6")
-		return Drop
+		return Drop, "ipv6"
 	case packet.Fragment:
 		// Fragments after the first always need to be passed through.
 		// Very small fragments are considered Junk by ParsedPacket.
 		f.logRateLimit(rf, q, Accept, "fragment")
-		return Accept
+		return Accept, "fragment"
 	}
 
-	return noVerdict
+	return noVerdict, ""
 }
@@ -7,6 +7,8 @@ package filter
 import (
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 
 	"tailscale.com/types/logger"
@@ -219,13 +221,54 @@ func TestPreFilter(t *testing.T) {
 	for _, testPacket := range packets {
 		p := &ParsedPacket{}
 		p.Decode(testPacket.b)
-		got := f.pre(p, LogDrops|LogAccepts)
+		got, _ := f.pre(p, LogDrops|LogAccepts)
 		if got != testPacket.want {
 			t.Errorf("%q got=%v want=%v packet:\n%s", testPacket.desc, got, testPacket.want, packet.Hexdump(testPacket.b))
 		}
 	}
 }
 
+func TestAudit(t *testing.T) {
+	acl := newFilter(t.Logf)
+	tests := []struct {
+		p          ParsedPacket
+		why        string
+		wantDetail string
+		wantRules  int
+	}{
+		{parsed(UDP, 0x08010101, 0x01020304, 999, 23), "no rules matched", "rules allow the source only to other destinations", 4},
+		{parsed(UDP, 0x99010101, 0x01020304, 999, 22), "no rules matched", "no single rule allows both the source and the destination", 4},
+		{parsed(TCP, 0x08010101, 0x10203040, 0, 443), "destination not allowed", "", 0},
+	}
+	for i, tt := range tests {
+		rec := acl.auditRecord("in", &tt.p, tt.why)
+		if rec.Reason != tt.why || rec.Detail != tt.wantDetail || len(rec.Rules) != tt.wantRules {
+			t.Errorf("#%d: got %+v; want detail %q, %d rules", i, rec, tt.wantDetail, tt.wantRules)
+		}
+	}
+
+	var logged []string
+	logf := func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	acl = newFilter(logf)
+	var q ParsedPacket
+	q.Decode(rawpacket(UDP, 0x08010101, 0x01020304, 999, 23, 0))
+	if got := acl.RunIn(&q, AuditDrops); got != Drop {
+		t.Fatalf("RunIn = %v; want Drop", got)
+	}
+	if len(logged) != 1 || !strings.HasPrefix(logged[0], "filter: audit: ") {
+		t.Fatalf("logged %q; want one audit record", logged)
+	}
+	var rec AuditRecord
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(logged[0], "filter: audit: ")), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Dir != "in" || rec.Src != "8.1.1.1:999" || rec.Dst != "1.2.3.4:23" || rec.Reason != "no rules matched" {
+		t.Errorf("audit record = %+v", rec)
+	}
+}
+
 func parsed(proto packet.IPProto, src, dst packet.IP, sport, dport uint16) ParsedPacket {
 	return ParsedPacket{
 		IPProto:  proto,
@@ -0,0 +1,101 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package flowlog counts the packets and bytes of each network flow
+// through the Tailscale interface, for export to NetFlow-style
+// collectors.
+package flowlog
+
+import (
+	"sync"
+	"time"
+
+	"tailscale.com/wgengine/packet"
+)
+
+// maxFlows bounds how many flows a Tracker keeps between Flushes.
+// Packets of flows beyond it are not counted.
+const maxFlows = 10000
+
+// Tuple identifies a unidirectional flow.
+type Tuple struct {
+	Proto   packet.IPProto
+	Src     packet.IP
+	Dst     packet.IP
+	SrcPort uint16
+	DstPort uint16
+}
+
+// Flow is the traffic of one Tuple over a period of time.
+type Flow struct {
+	Tuple
+	Packets uint64
+	Bytes   uint64
+	Start   time.Time // first packet
+	End     time.Time // last packet
+}
+
+// Tracker counts traffic by flow. Its methods are safe for
+// concurrent use.
+type Tracker struct {
+	mu      sync.Mutex
+	flows   map[Tuple]*Flow
+	dropped uint64 // packets not counted since the last Flush, because of maxFlows
+	timeNow func() time.Time
+}
+
+// NewTracker returns a new, empty Tracker.
+func NewTracker() *Tracker {
+	return &Tracker{flows: map[Tuple]*Flow{}, timeNow: time.Now}
+}
+
+// Add counts the packet p. Packets that aren't IPv4 TCP, UDP or ICMP
+// are ignored.
+func (t *Tracker) Add(p *packet.ParsedPacket) {
+	switch p.IPProto {
+	case packet.TCP, packet.UDP, packet.ICMP:
+	default:
+		return
+	}
+	tu := Tuple{
+		Proto:   p.IPProto,
+		Src:     p.SrcIP,
+		Dst:     p.DstIP,
+		SrcPort: p.SrcPort,
+		DstPort: p.DstPort,
+	}
+	n := uint64(len(p.Trim()))
+	now := t.timeNow()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.flows[tu]
+	if !ok {
+		if len(t.flows) >= maxFlows {
+			t.dropped++
+			return
+		}
+		f = &Flow{Tuple: tu, Start: now}
+		t.flows[tu] = f
+	}
+	f.Packets++
+	f.Bytes += n
+	f.End = now
+}
+
+// Flush returns the flows counted since the previous Flush and starts
+// counting anew, along with the number of packets that went uncounted
+// because too many flows were active.
+func (t *Tracker) Flush() (flows []Flow, dropped uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	flows = make([]Flow, 0, len(t.flows))
+	for _, f := range t.flows {
+		flows = append(flows, *f)
+	}
+	dropped = t.dropped
+	t.flows = map[Tuple]*Flow{}
+	t.dropped = 0
+	return flows, dropped
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flowlog
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"tailscale.com/wgengine/packet"
+)
+
+func udp(src, dst string, sport, dport uint16, payload string) *packet.ParsedPacket {
+	b := packet.Generate(&packet.UDPHeader{
+		IPHeader: packet.IPHeader{
+			SrcIP: packet.NewIP(net.ParseIP(src)),
+			DstIP: packet.NewIP(net.ParseIP(dst)),
+		},
+		SrcPort: sport,
+		DstPort: dport,
+	}, []byte(payload))
+	q := new(packet.ParsedPacket)
+	q.Decode(b)
+	return q
+}
+
+func TestTracker(t *testing.T) {
+	tr := NewTracker()
+	now := time.Unix(1600000000, 0)
+	tr.timeNow = func() time.Time { return now }
+
+	tr.Add(udp("100.1.1.1", "100.2.2.2", 1000, 53, "abc"))
+	now = now.Add(time.Second)
+	tr.Add(udp("100.1.1.1", "100.2.2.2", 1000, 53, "abcdef"))
+	tr.Add(udp("100.2.2.2", "100.1.1.1", 53, 1000, "x"))
+
+	flows, dropped := tr.Flush()
+	if dropped != 0 {
+		t.Errorf("dropped = %d", dropped)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("got %d flows; want 2: %+v", len(flows), flows)
+	}
+	for _, f := range flows {
+		if f.DstPort != 53 {
+			continue
+		}
+		if f.Packets != 2 || f.Bytes != 28+3+28+6 {
+			t.Errorf("flow %+v: want 2 packets, 65 bytes", f)
+		}
+		if f.End.Sub(f.Start) != time.Second {
+			t.Errorf("flow %+v: want 1s long", f)
+		}
+	}
+	if flows, _ := tr.Flush(); len(flows) != 0 {
+		t.Errorf("second Flush returned %d flows; want 0", len(flows))
+	}
+}
+
+func TestIPFIXMessage(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var flows []Flow
+	for i := 0; i < 100; i++ {
+		flows = append(flows, Flow{
+			Tuple: Tuple{
+				Proto:   packet.TCP,
+				Src:     packet.NewIP(net.ParseIP("100.1.1.1")),
+				Dst:     packet.NewIP(net.ParseIP("100.2.2.2")),
+				SrcPort: uint16(40000 + i),
+				DstPort: 22,
+			},
+			Packets: 3,
+			Bytes:   180,
+			Start:   now.Add(-time.Minute),
+			End:     now,
+		})
+	}
+	e := &IPFIXExporter{domain: 7}
+
+	msg, n := e.appendMessage(nil, flows, now, true)
+	if n == 0 || n == len(flows) {
+		t.Fatalf("first message holds %d of %d flows; want some but not all", n, len(flows))
+	}
+	if len(msg) > ipfixMaxMessage {
+		t.Errorf("message is %d bytes; want at most %d", len(msg), ipfixMaxMessage)
+	}
+	if v := binary.BigEndian.Uint16(msg[0:]); v != ipfixVersion {
+		t.Errorf("version = %d", v)
+	}
+	if l := binary.BigEndian.Uint16(msg[2:]); int(l) != len(msg) {
+		t.Errorf("header length = %d; message is %d bytes", l, len(msg))
+	}
+	if seq := binary.BigEndian.Uint32(msg[8:]); seq != 0 {
+		t.Errorf("first sequence number = %d; want 0", seq)
+	}
+	if d := binary.BigEndian.Uint32(msg[12:]); d != 7 {
+		t.Errorf("domain = %d; want 7", d)
+	}
+
+	// Walk the sets: a template set, then a data set.
+	sets := msg[ipfixHeaderLen:]
+	tmplLen := binary.BigEndian.Uint16(sets[2:])
+	if id := binary.BigEndian.Uint16(sets[0:]); id != ipfixTemplateSet || int(tmplLen) != ipfixSetLen+4+4*len(ipfixFields) {
+		t.Fatalf("template set id=%d len=%d", id, tmplLen)
+	}
+	data := sets[tmplLen:]
+	if id := binary.BigEndian.Uint16(data[0:]); id != ipfixTemplateID {
+		t.Fatalf("data set id = %d; want %d", id, ipfixTemplateID)
+	}
+	if l := binary.BigEndian.Uint16(data[2:]); int(l) != ipfixSetLen+n*ipfixRecordLen || int(l) != len(data) {
+		t.Fatalf("data set length = %d; want %d", l, ipfixSetLen+n*ipfixRecordLen)
+	}
+	rec := data[ipfixSetLen:]
+	if got := net.IP(rec[0:4]).String(); got != "100.1.1.1" {
+		t.Errorf("source = %v", got)
+	}
+	if got := binary.BigEndian.Uint16(rec[8:]); got != 40000 {
+		t.Errorf("source port = %d", got)
+	}
+	if got := rec[12]; got != byte(packet.TCP) {
+		t.Errorf("protocol = %d", got)
+	}
+	if got := binary.BigEndian.Uint64(rec[13:]); got != 180 {
+		t.Errorf("octets = %d", got)
+	}
+	if got := binary.BigEndian.Uint64(rec[37:]); got != uint64(now.Unix()*1000) {
+		t.Errorf("end = %d", got)
+	}
+
+	// The next message continues the sequence, without a template.
+	msg2, n2 := e.appendMessage(nil, flows[n:], now, false)
+	if seq := binary.BigEndian.Uint32(msg2[8:]); seq != uint32(n) {
+		t.Errorf("second sequence number = %d; want %d", seq, n)
+	}
+	if id := binary.BigEndian.Uint16(msg2[ipfixHeaderLen:]); id != ipfixTemplateID {
+		t.Errorf("second message starts with set %d; want data", id)
+	}
+	if n2 <= n {
+		t.Errorf("message without template holds %d flows; want more than %d", n2, n)
+	}
+}
+
+func TestIPFIXExport(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	e, err := NewIPFIXExporter(pc.LocalAddr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	// With no flows, the first export still sends the template.
+	if err := e.Export(nil); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2000)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := binary.BigEndian.Uint16(buf[ipfixHeaderLen:]); n <= ipfixHeaderLen || id != ipfixTemplateSet {
+		t.Errorf("got %d-byte message, first set %d; want template", n, id)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flowlog
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// IPFIX (RFC 7011) constants.
+const (
+	ipfixVersion     = 10
+	ipfixTemplateSet = 2   // set ID of template sets
+	ipfixTemplateID  = 256 // our one template; IDs below 256 are reserved
+
+	ipfixHeaderLen = 16
+	ipfixSetLen    = 4
+)
+
+// ipfixFields are the information elements (IANA IPFIX registry ID and
+// length) of each record, in order.
+var ipfixFields = []struct{ id, len uint16 }{
+	{8, 4},   // sourceIPv4Address
+	{12, 4},  // destinationIPv4Address
+	{7, 2},   // sourceTransportPort
+	{11, 2},  // destinationTransportPort
+	{4, 1},   // protocolIdentifier
+	{1, 8},   // octetDeltaCount
+	{2, 8},   // packetDeltaCount
+	{152, 8}, // flowStartMilliseconds
+	{153, 8}, // flowEndMilliseconds
+}
+
+const ipfixRecordLen = 4 + 4 + 2 + 2 + 1 + 8 + 8 + 8 + 8
+
+// ipfixMaxMessage keeps each message in a single unfragmented UDP
+// packet on a typical 1500-byte MTU path.
+const ipfixMaxMessage = 1400
+
+// ipfixTemplateEvery is how often the template is resent. Over UDP,
+// collectors that start (or restart) after us learn it only this way.
+const ipfixTemplateEvery = 10 * time.Minute
+
+// IPFIXExporter sends flows to an IPFIX collector over UDP.
+// It's not safe for concurrent use.
+type IPFIXExporter struct {
+	conn         net.Conn
+	domain       uint32 // observation domain ID
+	seq          uint32 // data records sent so far, mod 2^32
+	lastTemplate time.Time
+	timeNow      func() time.Time
+}
+
+// NewIPFIXExporter returns an exporter that sends to the collector at
+// addr ("host:port"), identifying this node to it as observation
+// domain domain.
+func NewIPFIXExporter(addr string, domain uint32) (*IPFIXExporter, error) {
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &IPFIXExporter{conn: c, domain: domain, timeNow: time.Now}, nil
+}
+
+// Export sends flows to the collector, in as many messages as needed.
+func (e *IPFIXExporter) Export(flows []Flow) error {
+	now := e.timeNow()
+	withTemplate := now.Sub(e.lastTemplate) >= ipfixTemplateEvery
+	for len(flows) > 0 || withTemplate {
+		msg, n := e.appendMessage(nil, flows, now, withTemplate)
+		if _, err := e.conn.Write(msg); err != nil {
+			return err
+		}
+		if withTemplate {
+			e.lastTemplate = now
+			withTemplate = false
+		}
+		flows = flows[n:]
+	}
+	return nil
+}
+
+// Close closes the exporter's socket.
+func (e *IPFIXExporter) Close() error {
+	return e.conn.Close()
+}
+
+// appendMessage appends to b one IPFIX message with as many of flows
+// as fit, preceded by the template if withTemplate, and returns it
+// along with how many flows it holds.
+func (e *IPFIXExporter) appendMessage(b []byte, flows []Flow, now time.Time, withTemplate bool) ([]byte, int) {
+	start := len(b)
+	b = append(b, make([]byte, ipfixHeaderLen)...)
+	hdr := b[start:]
+	binary.BigEndian.PutUint16(hdr[0:], ipfixVersion)
+	binary.BigEndian.PutUint32(hdr[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(hdr[8:], e.seq)
+	binary.BigEndian.PutUint32(hdr[12:], e.domain)
+
+	if withTemplate {
+		set := len(b)
+		b = appendUint16(b, ipfixTemplateSet, 0)
+		b = appendUint16(b, ipfixTemplateID, uint16(len(ipfixFields)))
+		for _, f := range ipfixFields {
+			b = appendUint16(b, f.id, f.len)
+		}
+		binary.BigEndian.PutUint16(b[set+2:], uint16(len(b)-set))
+	}
+
+	n := 0
+	if len(flows) > 0 {
+		room := ipfixMaxMessage - (len(b) - start) - ipfixSetLen
+		if n = room / ipfixRecordLen; n > len(flows) {
+			n = len(flows)
+		}
+	}
+	if n > 0 {
+		set := len(b)
+		b = appendUint16(b, ipfixTemplateID, 0)
+		for _, f := range flows[:n] {
+			b = appendUint32(b, uint32(f.Src), uint32(f.Dst))
+			b = appendUint16(b, f.SrcPort, f.DstPort)
+			b = append(b, byte(f.Proto))
+			b = appendUint64(b, f.Bytes, f.Packets,
+				uint64(f.Start.UnixNano()/1e6), uint64(f.End.UnixNano()/1e6))
+		}
+		binary.BigEndian.PutUint16(b[set+2:], uint16(len(b)-set))
+		e.seq += uint32(n)
+	}
+
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b, n
+}
+
+func appendUint16(b []byte, vs ...uint16) []byte {
+	for _, v := range vs {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return b
+}
+
+func appendUint32(b []byte, vs ...uint32) []byte {
+	for _, v := range vs {
+		b = append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return b
+}
+
+func appendUint64(b []byte, vs ...uint64) []byte {
+	for _, v := range vs {
+		b = appendUint32(b, uint32(v>>32), uint32(v))
+	}
+	return b
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"sync/atomic"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// bgStats counts the background work a Conn does to find and keep
+// paths to peers. Each unit means waking up the CPU (and often the
+// radio), so it's what the metered and battery timings trade against
+// how quickly path changes are noticed.
+type bgStats struct {
+	// Accessed atomically.
+	heartbeats   int64
+	discoPings   int64
+	stunRounds   int64
+	idleSessions int64
+}
+
+func (s *bgStats) add(p *int64) {
+	if s != nil {
+		atomic.AddInt64(p, 1)
+	}
+}
+
+func (s *bgStats) get() ipnstate.BackgroundStats {
+	if s == nil {
+		return ipnstate.BackgroundStats{}
+	}
+	return ipnstate.BackgroundStats{
+		Heartbeats:   atomic.LoadInt64(&s.heartbeats),
+		DiscoPings:   atomic.LoadInt64(&s.discoPings),
+		STUNRounds:   atomic.LoadInt64(&s.stunRounds),
+		IdleSessions: atomic.LoadInt64(&s.idleSessions),
+	}
+}
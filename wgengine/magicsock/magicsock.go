@@ -65,6 +65,8 @@ type Conn struct {
 	sendLogLimit *rate.Limiter
 	netChecker   *netcheck.Client
 	idleFunc     func() time.Duration // nil means unknown
+	timing       Timing               // path discovery intervals, with defaults filled in
+	sockStats    sockStats            // bytes sent and received, by network interface
 
 	// bufferedIPv4From and bufferedIPv4Packet are owned by
 	// ReceiveIPv4, and used when both a DERP and IPv4 packet arrive
@@ -150,6 +152,25 @@ type Conn struct {
 	// necessarily have a netcheck.Report and don't want to skip
 	// logging.
 	noV4, noV6 syncs.AtomicBool
+
+	// metered is whether the current network is metered, in which
+	// case background traffic is cut down and timingMetered (that
+	// is, timing.metered()) is used instead of timing. See SetMetered.
+	metered       syncs.AtomicBool
+	timingMetered Timing
+
+	// onBattery is whether the machine is running on battery, in
+	// which case timingBattery is used. It takes precedence over
+	// metered. See SetOnBattery.
+	onBattery     syncs.AtomicBool
+	timingBattery Timing
+
+	// noPortMapping and noLANDiscovery are whether to keep from
+	// probing the LAN's gateway for port mapping services, and from
+	// using LAN addresses to find direct paths. See SetLANPrivacy.
+	noPortMapping, noLANDiscovery syncs.AtomicBool
+
+	bgStats *bgStats // counts of background work, for Status
 }
 
 // derpRoute is a route entry for a public key, saying that a certain
@@ -229,6 +250,11 @@ type Options struct {
 	// IdleFunc optionally provides a func to return how long
 	// it's been since a TUN packet was sent or received.
 	IdleFunc func() time.Duration
+
+	// Timing optionally overrides the path discovery intervals.
+	// If zero, they come from the TS_DISCO_TIMING environment
+	// variable (see ParseTiming), or else their defaults.
+	Timing Timing
 }
 
 func (o *Options) logf() logger.Logf {
@@ -250,6 +276,10 @@ func (o *Options) endpointsFunc() func([]string) {
 func newConn() *Conn {
 	c := &Conn{
 		sendLogLimit:    rate.NewLimiter(rate.Every(1*time.Minute), 1),
+		timing:          DefaultTiming(),
+		timingMetered:   DefaultTiming().metered(),
+		timingBattery:   DefaultTiming().battery(),
+		bgStats:         new(bgStats),
 		addrsByUDP:      make(map[netaddr.IPPort]*AddrSet),
 		addrsByKey:      make(map[key.Public]*AddrSet),
 		derpRecvCh:      make(chan derpReadResult),
@@ -276,14 +306,29 @@ func NewConn(opts Options) (*Conn, error) {
 	c.epFunc = opts.endpointsFunc()
 	c.idleFunc = opts.IdleFunc
 
+	timing := opts.Timing
+	if timing == (Timing{}) {
+		var err error
+		if timing, err = envTiming(); err != nil {
+			return nil, err
+		}
+	}
+	if err := timing.Check(); err != nil {
+		return nil, err
+	}
+	c.timing = timing.withDefaults()
+	c.timingMetered = c.timing.metered()
+	c.timingBattery = c.timing.battery()
+
 	if err := c.initialBind(); err != nil {
 		return nil, err
 	}
 
 	c.connCtx, c.connCtxCancel = context.WithCancel(context.Background())
 	c.netChecker = &netcheck.Client{
-		Logf:         logger.WithPrefix(c.logf, "netcheck: "),
-		GetSTUNConn4: func() netcheck.STUNConn { return c.pconn4 },
+		Logf:            logger.WithPrefix(c.logf, "netcheck: "),
+		GetSTUNConn4:    func() netcheck.STUNConn { return c.pconn4 },
+		SkipPortMapping: c.noPortMapping.Get,
 	}
 	if c.pconn6 != nil {
 		c.netChecker.GetSTUNConn6 = func() netcheck.STUNConn { return c.pconn6 }
@@ -335,6 +380,7 @@ func (c *Conn) updateEndpoints(why string) {
 
 	}()
 	c.logf("magicsock: starting endpoint update (%s)", why)
+	c.bgStats.add(&c.bgStats.stunRounds)
 
 	endpoints, reasons, err := c.determineEndpoints(c.connCtx)
 	if err != nil {
@@ -584,7 +630,7 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 	var eps []string                   // unique endpoints
 
 	addAddr := func(s, reason string) {
-		if debugOmitLocalAddresses && (reason == "localAddresses" || reason == "socket") {
+		if (debugOmitLocalAddresses || c.noLANDiscovery.Get()) && (reason == "localAddresses" || reason == "socket") {
 			return
 		}
 		if _, ok := already[s]; !ok {
@@ -639,6 +685,78 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 	return eps, already, nil
 }
 
+// SetLANPrivacy sets whether c keeps from probing the LAN's gateway
+// for UPnP, NAT-PMP and PCP (noPortMapping), and from using LAN
+// addresses to find direct paths to peers on the same network
+// (noLANDiscovery): it then leaves its own LAN addresses out of its
+// endpoints and doesn't ping peers' private addresses. Peers are still
+// reached through their public endpoints or DERP.
+func (c *Conn) SetLANPrivacy(noPortMapping, noLANDiscovery bool) {
+	if c.noPortMapping.Get() == noPortMapping && c.noLANDiscovery.Get() == noLANDiscovery {
+		return
+	}
+	c.noPortMapping.Set(noPortMapping)
+	c.noLANDiscovery.Set(noLANDiscovery)
+	c.logf("magicsock: port mapping probes: %v, LAN discovery: %v", !noPortMapping, !noLANDiscovery)
+
+	c.mu.Lock()
+	started := c.started && !c.closed
+	c.mu.Unlock()
+	if started {
+		c.ReSTUN("lan-privacy")
+	}
+}
+
+// portMappingLocked describes the port mapping protocols the last
+// netcheck found, for ipnstate.Status.PortMapping.
+//
+// c.mu must be held.
+func (c *Conn) portMappingLocked() string {
+	if c.noPortMapping.Get() {
+		return "off"
+	}
+	ni := c.netInfoLast
+	if ni == nil || ni.UPnP == "" && ni.PMP == "" && ni.PCP == "" {
+		return ""
+	}
+	var found []string
+	if ni.UPnP.EqualBool(true) {
+		found = append(found, "UPnP")
+	}
+	if ni.PMP.EqualBool(true) {
+		found = append(found, "NAT-PMP")
+	}
+	if ni.PCP.EqualBool(true) {
+		found = append(found, "PCP")
+	}
+	if len(found) == 0 {
+		return "none"
+	}
+	return strings.Join(found, ",")
+}
+
+// lanPrefixes are the private and link-local address ranges, which
+// peers only reach directly from the same network.
+var lanPrefixes = func() (ret []netaddr.IPPrefix) {
+	for _, s := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "fc00::/7", "fe80::/10"} {
+		p, err := netaddr.ParseIPPrefix(s)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, p)
+	}
+	return ret
+}()
+
+func isLANAddr(ip netaddr.IP) bool {
+	for _, p := range lanPrefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func stringsEqual(x, y []string) bool {
 	if len(x) != len(y) {
 		return false
@@ -1124,6 +1242,7 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 		}
 		switch m := msg.(type) {
 		case derp.ReceivedPacket:
+			c.sockStats.addDERP(false, len(m.Data))
 			pkt = m
 			res.n = len(m.Data)
 			res.src = m.Source
@@ -1174,6 +1293,8 @@ func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch <-chan
 			err := dc.Send(wr.pubKey, wr.b)
 			if err != nil {
 				c.logf("magicsock: derp.Send(%v): %v", wr.addr, err)
+			} else {
+				c.sockStats.addDERP(true, len(wr.b))
 			}
 		}
 	}
@@ -1531,8 +1652,9 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, de *discoEndpoint, src netaddr.I
 
 	pongDst := src
 	go de.sendDiscoMessage(pongDst, &disco.Pong{
-		TxID: dm.TxID,
-		Src:  src,
+		TxID:    dm.TxID,
+		Src:     src,
+		Padding: pongPadding(dm.Padding),
 	})
 }
 
@@ -1907,7 +2029,7 @@ func (c *Conn) shouldDoPeriodicReSTUN() bool {
 			c.logf("magicsock: periodicReSTUN: idle for %v", idleFor.Round(time.Second))
 		}
 		if idleFor > maxIdleBeforeSTUNShutdown() {
-			if debugReSTUNStopOnIdle || version.IsMobile() { // TODO: make this unconditional later
+			if debugReSTUNStopOnIdle || version.IsMobile() || c.onBattery.Get() { // TODO: make this unconditional later
 				return false
 			}
 		}
@@ -1919,7 +2041,12 @@ func (c *Conn) periodicReSTUN() {
 	prand := rand.New(rand.NewSource(time.Now().UnixNano()))
 	dur := func() time.Duration {
 		// Just under 30s, a common UDP NAT timeout (Linux at least)
-		return time.Duration(20+prand.Intn(7)) * time.Second
+		d := time.Duration(20+prand.Intn(7)) * time.Second
+		if c.metered.Get() || c.onBattery.Get() {
+			// Risk the NAT mapping timing out instead.
+			d *= meteredSlowdown
+		}
+		return d
 	}
 	timer := time.NewTimer(dur())
 	defer timer.Stop()
@@ -2015,7 +2142,7 @@ func (c *Conn) bind1(ruc **RebindingUDPConn, which string) error {
 		return fmt.Errorf("magicsock: bind: %s/%d: %v", which, c.pconnPort, err)
 	}
 	if *ruc == nil {
-		*ruc = new(RebindingUDPConn)
+		*ruc = &RebindingUDPConn{stats: &c.sockStats}
 	}
 	(*ruc).Reset(pc.(*net.UDPConn))
 	return nil
@@ -2471,6 +2598,8 @@ type RebindingUDPConn struct {
 	// This is used by ReceiveIPv6 and awaitUDP4 (called from ReceiveIPv4).
 	ippCache ippCache
 
+	stats *sockStats // if non-nil, counts bytes read and written
+
 	mu    sync.Mutex
 	pconn *net.UDPConn
 }
@@ -2493,6 +2622,7 @@ func (c *RebindingUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
 		c.mu.Unlock()
 
 		n, addr, err := pconn.ReadFrom(b)
+		c.stats.addUDP(false, n)
 		if err != nil {
 			c.mu.Lock()
 			pconn2 := c.pconn
@@ -2531,6 +2661,7 @@ func (c *RebindingUDPConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
 		c.mu.Unlock()
 
 		n, err := pconn.WriteToUDP(b, addr)
+		c.stats.addUDP(true, n)
 		if err != nil {
 			c.mu.Lock()
 			pconn2 := c.pconn
@@ -2551,6 +2682,7 @@ func (c *RebindingUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 		c.mu.Unlock()
 
 		n, err := pconn.WriteTo(b, addr)
+		c.stats.addUDP(true, n)
 		if err != nil {
 			c.mu.Lock()
 			pconn2 := c.pconn
@@ -2637,6 +2769,15 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 		sb.AddPeer(k, ps)
 	}
 
+	for _, is := range c.sockStats.stats() {
+		sb.AddInterfaceStats(is)
+	}
+	sb.SetMetered(c.metered.Get())
+	sb.SetOnBattery(c.onBattery.Get())
+	sb.SetPortMapping(c.portMappingLocked())
+	sb.SetNoLANDiscovery(c.noLANDiscovery.Get())
+	sb.SetBackgroundStats(c.bgStats.get())
+
 	c.foreachActiveDerpSortedLocked(func(node int, ad activeDerp) {
 		// TODO(bradfitz): add to ipnstate.StatusBuilder
 		//f("<li><b>derp-%v</b>: cr%v,wr%v</li>", node, simpleDur(now.Sub(ad.createTime)), simpleDur(now.Sub(*ad.lastWrite)))
@@ -2673,11 +2814,21 @@ type discoEndpoint struct {
 	bestAddr           netaddr.IPPort // best non-DERP path; zero if none
 	bestAddrLatency    time.Duration
 	bestAddrAt         time.Time // time best address re-confirmed
+	bestAddrSince      time.Time // time bestAddr last changed
 	trustBestAddrUntil time.Time // time when bestAddr expires
 	sentPing           map[stun.TxID]sentPing
 	endpointState      map[netaddr.IPPort]*endpointState
+
+	// Path MTU of the best UDP path; see mtu.go.
+	mtuAddr        netaddr.IPPort // the path mtu is for
+	mtu            int            // largest probed tun MTU mtuAddr carries; 0 if unknown
+	mtuProbeAddr   netaddr.IPPort // where the last probes were sent
+	mtuProbeAt     time.Time      // when the last probes were sent
+	mtuRoundBest   int            // largest MTU that got a pong since mtuProbeAt
+	mtuShortRounds int            // probe rounds in a row whose mtuRoundBest was below mtu
 }
 
+// Default path discovery intervals. See Timing.
 const (
 	// sessionActiveTimeout is how long since the last activity we
 	// try to keep an established discoEndpoint peering alive.
@@ -2708,8 +2859,26 @@ const (
 	// goodEnoughLatency is the latency at or under which we don't
 	// try to upgrade to a better path.
 	goodEnoughLatency = 5 * time.Millisecond
+
+	// multipathWindow is how long after switching to a new UDP
+	// path small packets are also sent over DERP, with
+	// TS_DEBUG_MULTIPATH set.
+	multipathWindow = 5 * time.Second
+
+	// multipathMaxSize is the largest packet that's duplicated
+	// over DERP during multipathWindow. It's enough for WireGuard
+	// handshakes, keepalives and interactive traffic, but not bulk
+	// transfers.
+	multipathMaxSize = 256
 )
 
+// debugMultipath controls an experiment (2020-08) where, right after
+// moving a peer to a new UDP path, small packets are sent over both
+// that path and DERP, so that a path that doesn't quite work yet
+// doesn't stall latency-sensitive traffic. The receiver's WireGuard
+// drops whichever copy arrives second as a replay.
+var debugMultipath, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_MULTIPATH"))
+
 // endpointState is some state and history for a specific endpoint of
 // a discoEndpoint. (The subject is the discoEndpoint.endpointState
 // map key)
@@ -2735,6 +2904,7 @@ type sentPing struct {
 	to    netaddr.IPPort
 	at    time.Time
 	timer *time.Timer // timeout timer
+	mtu   int         // if non-zero, the ping is a probe of this path MTU
 }
 
 // initFakeUDPAddr populates fakeWGAddr with a globally unique fake UDPAddr.
@@ -2801,7 +2971,7 @@ func (de *discoEndpoint) addrForSendLocked(now time.Time) (udpAddr, derpAddr net
 	return
 }
 
-// heartbeat is called every heartbeatInterval to keep the best UDP path alive,
+// heartbeat is called every Timing.Heartbeat to keep the best UDP path alive,
 // or kick off discovery of other paths.
 func (de *discoEndpoint) heartbeat() {
 	de.mu.Lock()
@@ -2814,24 +2984,29 @@ func (de *discoEndpoint) heartbeat() {
 		return
 	}
 
-	if time.Since(de.lastSend) > sessionActiveTimeout {
+	if time.Since(de.lastSend) > de.c.curTiming().SessionActive {
 		// Session's idle. Stop heartbeating.
+		de.c.bgStats.add(&de.c.bgStats.idleSessions)
 		de.c.logf("magicsock: disco: ending heartbeats for idle session to %v (%v)", de.publicKey.ShortString(), de.discoShort)
 		return
 	}
 
+	de.c.bgStats.add(&de.c.bgStats.heartbeats)
 	now := time.Now()
 	udpAddr, _ := de.addrForSendLocked(now)
 	if !udpAddr.IsZero() {
 		// We have a preferred path. Ping that every 2 seconds.
 		de.startPingLocked(udpAddr, now)
+		if de.wantMTUProbeLocked(now) {
+			de.startMTUProbesLocked(now)
+		}
 	}
 
 	if de.wantFullPingLocked(now) {
 		de.sendPingsLocked(now, true)
 	}
 
-	de.heartBeatTimer = time.AfterFunc(heartbeatInterval, de.heartbeat)
+	de.heartBeatTimer = time.AfterFunc(de.c.curTiming().Heartbeat, de.heartbeat)
 }
 
 // wantFullPingLocked reports whether we should ping to all our peers looking for
@@ -2848,7 +3023,7 @@ func (de *discoEndpoint) wantFullPingLocked(now time.Time) bool {
 	if de.bestAddrLatency <= goodEnoughLatency {
 		return false
 	}
-	if now.Sub(de.lastFullPing) >= upgradeInterval {
+	if now.Sub(de.lastFullPing) >= de.c.curTiming().Upgrade {
 		return true
 	}
 	return false
@@ -2857,15 +3032,33 @@ func (de *discoEndpoint) wantFullPingLocked(now time.Time) bool {
 func (de *discoEndpoint) noteActiveLocked() {
 	de.lastSend = time.Now()
 	if de.heartBeatTimer == nil {
-		de.heartBeatTimer = time.AfterFunc(heartbeatInterval, de.heartbeat)
+		de.heartBeatTimer = time.AfterFunc(de.c.curTiming().Heartbeat, de.heartbeat)
 	}
 }
 
+// wantMultipathLocked reports whether a packet of n bytes should also
+// be sent over DERP even though we trust de.bestAddr. See
+// debugMultipath.
+//
+// de.mu must be held.
+func (de *discoEndpoint) wantMultipathLocked(now time.Time, n int) bool {
+	return debugMultipath &&
+		n <= multipathMaxSize &&
+		!de.bestAddr.IsZero() &&
+		now.Sub(de.bestAddrSince) < multipathWindow
+}
+
 func (de *discoEndpoint) send(b []byte) error {
 	now := time.Now()
 
 	de.mu.Lock()
 	udpAddr, derpAddr := de.addrForSendLocked(now)
+	if derpAddr.IsZero() && de.wantMultipathLocked(now, len(b)) {
+		derpAddr = de.derpAddr
+	}
+	if de.tooBigForPathLocked(udpAddr, len(b)) && !de.derpAddr.IsZero() {
+		udpAddr, derpAddr = netaddr.IPPort{}, de.derpAddr
+	}
 	if udpAddr.IsZero() || now.After(de.trustBestAddrUntil) {
 		de.sendPingsLocked(now, true)
 	}
@@ -2905,12 +3098,12 @@ func (de *discoEndpoint) removeSentPingLocked(txid stun.TxID, sp sentPing) {
 	delete(de.sentPing, txid)
 }
 
-// sendDiscoPing sends a ping with the provided txid to ep.
+// sendDiscoPing sends a ping with the provided txid and padding to ep.
 //
 // The caller (startPingLocked) should've already been recorded the ping in
 // sentPing and set up the timer.
-func (de *discoEndpoint) sendDiscoPing(ep netaddr.IPPort, txid stun.TxID) {
-	sent, _ := de.sendDiscoMessage(ep, &disco.Ping{TxID: [12]byte(txid)})
+func (de *discoEndpoint) sendDiscoPing(ep netaddr.IPPort, txid stun.TxID, padding int) {
+	sent, _ := de.sendDiscoMessage(ep, &disco.Ping{TxID: [12]byte(txid), Padding: padding})
 	if !sent {
 		de.forgetPing(txid)
 	}
@@ -2925,17 +3118,18 @@ func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now time.Time) {
 		return
 	}
 	st.lastPing = now
+	de.c.bgStats.add(&de.c.bgStats.discoPings)
 
 	txid := stun.NewTxID()
 	de.sentPing[txid] = sentPing{
 		to: ep,
 		at: now,
-		timer: time.AfterFunc(pingTimeoutDuration, func() {
+		timer: time.AfterFunc(de.c.curTiming().PingTimeout, func() {
 			de.c.logf("magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], ep, de.publicKey.ShortString(), de.discoShort)
 			de.forgetPing(txid)
 		}),
 	}
-	go de.sendDiscoPing(ep, txid)
+	go de.sendDiscoPing(ep, txid, 0)
 }
 
 func (de *discoEndpoint) sendPingsLocked(now time.Time, sendCallMeMaybe bool) {
@@ -2943,7 +3137,10 @@ func (de *discoEndpoint) sendPingsLocked(now time.Time, sendCallMeMaybe bool) {
 	var sentAny bool
 	for ep, st := range de.endpointState {
 		ep := ep
-		if !st.lastPing.IsZero() && now.Sub(st.lastPing) < discoPingInterval {
+		if !st.lastPing.IsZero() && now.Sub(st.lastPing) < de.c.curTiming().DiscoPing {
+			continue
+		}
+		if de.c.noLANDiscovery.Get() && isLANAddr(ep.IP) {
 			continue
 		}
 
@@ -3048,6 +3245,13 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 	}
 	de.removeSentPingLocked(m.TxID, sp)
 
+	if sp.mtu != 0 {
+		// Padded pongs may be slower, so don't count
+		// their latency.
+		de.handleMTUProbePongLocked(sp)
+		return
+	}
+
 	st, ok := de.endpointState[sp.to]
 	if !ok {
 		// This is no longer an endpoint we care about.
@@ -3078,12 +3282,13 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 		if de.bestAddr != sp.to {
 			de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
 			de.bestAddr = sp.to
+			de.bestAddrSince = now
 		}
 	}
 	if de.bestAddr == sp.to {
 		de.bestAddrLatency = latency
 		de.bestAddrAt = now
-		de.trustBestAddrUntil = now.Add(trustUDPAddrDuration)
+		de.trustBestAddrUntil = now.Add(de.c.curTiming().TrustUDPAddr)
 	}
 }
 
@@ -3131,6 +3336,7 @@ func (de *discoEndpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	now := time.Now()
 	if udpAddr, derpAddr := de.addrForSendLocked(now); !udpAddr.IsZero() && derpAddr.IsZero() {
 		ps.CurAddr = udpAddr.String()
+		ps.PathMTU = de.pathMTULocked(udpAddr)
 	}
 }
 
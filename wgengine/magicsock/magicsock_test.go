@@ -899,3 +899,80 @@ func TestDiscoStringLogRace(t *testing.T) {
 	}()
 	wg.Wait()
 }
+
+func TestWantMultipath(t *testing.T) {
+	defer func(old bool) { debugMultipath = old }(debugMultipath)
+
+	now := time.Now()
+	udp := netaddr.IPPort{IP: netaddr.IPv4(1, 2, 3, 4), Port: 41641}
+	tests := []struct {
+		name    string
+		enabled bool
+		best    netaddr.IPPort
+		since   time.Duration // how long ago bestAddr changed
+		size    int
+		want    bool
+	}{
+		{"disabled", false, udp, time.Second, 100, false},
+		{"new_path", true, udp, time.Second, 100, true},
+		{"old_path", true, udp, multipathWindow, 100, false},
+		{"big_packet", true, udp, time.Second, multipathMaxSize + 1, false},
+		{"no_path", true, netaddr.IPPort{}, time.Second, 100, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			debugMultipath = tt.enabled
+			de := &discoEndpoint{
+				bestAddr:      tt.best,
+				bestAddrSince: now.Add(-tt.since),
+			}
+			if got := de.wantMultipathLocked(now, tt.size); got != tt.want {
+				t.Errorf("wantMultipathLocked = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLANPrivacy(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	if got := c.portMappingLocked(); got != "" {
+		t.Errorf("port mapping before any netcheck = %q; want empty", got)
+	}
+	c.netInfoLast = &tailcfg.NetInfo{UPnP: "true", PMP: "false", PCP: "true"}
+	if got, want := c.portMappingLocked(), "UPnP,PCP"; got != want {
+		t.Errorf("port mapping = %q; want %q", got, want)
+	}
+	c.netInfoLast = &tailcfg.NetInfo{UPnP: "false", PMP: "false", PCP: "false"}
+	if got, want := c.portMappingLocked(), "none"; got != want {
+		t.Errorf("port mapping = %q; want %q", got, want)
+	}
+	c.SetLANPrivacy(true, true)
+	if got, want := c.portMappingLocked(), "off"; got != want {
+		t.Errorf("port mapping with probes disabled = %q; want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.10", true},
+		{"10.1.2.3", true},
+		{"172.31.0.1", true},
+		{"169.254.1.1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"172.32.0.1", false},
+		{"1.2.3.4", false},
+		{"100.101.102.103", false},
+		{"2001:db8::1", false},
+	} {
+		ip, err := netaddr.ParseIP(tt.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isLANAddr(ip); got != tt.want {
+			t.Errorf("isLANAddr(%v) = %v; want %v", ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+	"inet.af/netaddr"
+	"tailscale.com/disco"
+	"tailscale.com/net/stun"
+)
+
+// Path MTU discovery.
+//
+// Some paths between peers (tunnels, PPPoE, IPv6 paths with the
+// minimum MTU) can't carry a full-size WireGuard packet, and drop
+// large packets, or their fragments, silently. To find these, every
+// so often a peer's best UDP address is sent one disco ping for each
+// of mtuProbeMTUs, padded to the size of a WireGuard packet carrying
+// a packet of that MTU. The largest one that gets a pong is the
+// path's MTU. It's raised as soon as a larger probe gets a pong,
+// but only lowered once a larger probe has failed mtuLowerRounds
+// rounds in a row, so that a lost probe doesn't send a peer's large
+// packets over DERP.
+//
+// The probes are sent without the DF bit, just like WireGuard
+// packets, so they're fragmented and dropped exactly when WireGuard
+// packets of their size would be.
+//
+// Packets too large for a peer's path MTU are sent over DERP instead,
+// which, being TCP, carries them intact.
+
+// mtuProbeMTUs are the tun MTUs probed, largest first. The largest
+// is the tun MTU the engine uses.
+var mtuProbeMTUs = []int{1280, 1200, 1100, 1000}
+
+const (
+	// mtuProbeInterval is how often the path MTU to a peer's best
+	// address is probed, once known to fit mtuProbeMTUs[0].
+	mtuProbeInterval = 10 * time.Minute
+
+	// mtuReprobeInterval is how often it's probed otherwise, so a
+	// lost probe doesn't pessimize a path for long.
+	mtuReprobeInterval = time.Minute
+
+	// mtuLowerRounds is how many probe rounds in a row must find
+	// a smaller path MTU before it's lowered.
+	mtuLowerRounds = 3
+
+	// wgDataOverhead is what WireGuard adds to each packet: a
+	// 16 byte header and a 16 byte authentication tag.
+	wgDataOverhead = 32
+)
+
+// discoPingOverhead is the size of an unpadded disco ping on the wire.
+var discoPingOverhead = len(disco.Magic) + 32 + disco.NonceLen + box.Overhead + len((&disco.Ping{}).AppendMarshal(nil))
+
+// pongPadding returns how much to pad the pong to a ping with the
+// given padding, so that the pong is the same size as the ping.
+func pongPadding(pingPadding int) int {
+	if pingPadding == 0 {
+		return 0
+	}
+	pad := pingPadding - (len((&disco.Pong{}).AppendMarshal(nil)) - len((&disco.Ping{}).AppendMarshal(nil)))
+	if pad < 0 {
+		return 0
+	}
+	return pad
+}
+
+// wantMTUProbeLocked reports whether it's time to probe the path MTU
+// of de.bestAddr.
+//
+// de.mu must be held.
+func (de *discoEndpoint) wantMTUProbeLocked(now time.Time) bool {
+	if de.bestAddr.IsZero() {
+		return false
+	}
+	if de.mtuProbeAddr != de.bestAddr {
+		return true
+	}
+	interval := mtuProbeInterval
+	if de.pathMTULocked(de.bestAddr) < mtuProbeMTUs[0] || de.mtuShortRounds > 0 {
+		interval = mtuReprobeInterval
+	}
+	return now.Sub(de.mtuProbeAt) >= interval
+}
+
+// startMTUProbesLocked sends de.bestAddr a padded ping for each of
+// mtuProbeMTUs.
+//
+// de.mu must be held.
+func (de *discoEndpoint) startMTUProbesLocked(now time.Time) {
+	de.endMTURoundLocked()
+	ep := de.bestAddr
+	de.mtuProbeAddr = ep
+	de.mtuProbeAt = now
+	for _, mtu := range mtuProbeMTUs {
+		txid := stun.NewTxID()
+		de.sentPing[txid] = sentPing{
+			to:  ep,
+			at:  now,
+			mtu: mtu,
+			timer: time.AfterFunc(de.c.curTiming().PingTimeout, func() {
+				de.forgetPing(txid)
+			}),
+		}
+		go de.sendDiscoPing(ep, txid, mtu+wgDataOverhead-discoPingOverhead)
+	}
+}
+
+// handleMTUProbePongLocked records that the path to sp.to carries
+// packets of sp.mtu, raising its path MTU if that's larger.
+//
+// de.mu must be held.
+func (de *discoEndpoint) handleMTUProbePongLocked(sp sentPing) {
+	if sp.to != de.bestAddr || sp.mtu <= de.mtuRoundBest {
+		return
+	}
+	de.mtuRoundBest = sp.mtu
+	if de.mtuAddr != sp.to {
+		de.mtuAddr = sp.to
+		de.mtu = 0
+		de.mtuShortRounds = 0
+	}
+	if sp.mtu <= de.mtu {
+		// Lowering it is up to endMTURoundLocked.
+		return
+	}
+	de.mtuShortRounds = 0
+	de.setPathMTULocked(sp.mtu)
+}
+
+// endMTURoundLocked finishes the last round of probes, lowering the
+// path MTU to the largest probe that got a pong if that's been smaller
+// for mtuLowerRounds rounds in a row. Rounds that got no pongs at all
+// say nothing about the MTU, so they don't count.
+//
+// de.mu must be held.
+func (de *discoEndpoint) endMTURoundLocked() {
+	best := de.mtuRoundBest
+	de.mtuRoundBest = 0
+	if best == 0 || de.mtuProbeAddr != de.mtuAddr {
+		return
+	}
+	if best >= de.mtu {
+		de.mtuShortRounds = 0
+		return
+	}
+	de.mtuShortRounds++
+	if de.mtuShortRounds < mtuLowerRounds {
+		return
+	}
+	de.mtuShortRounds = 0
+	de.setPathMTULocked(best)
+}
+
+// setPathMTULocked sets the path MTU to de.mtuAddr.
+//
+// de.mu must be held.
+func (de *discoEndpoint) setPathMTULocked(mtu int) {
+	de.mtu = mtu
+	if mtu < mtuProbeMTUs[0] {
+		de.c.logf("magicsock: disco: path MTU to %v (%v) via %v is %d; sending larger packets via DERP", de.publicKey.ShortString(), de.discoShort, de.mtuAddr, mtu)
+	}
+}
+
+// pathMTULocked returns the tun MTU known to fit the path to
+// udpAddr, or 0 if it's unknown.
+//
+// de.mu must be held.
+func (de *discoEndpoint) pathMTULocked(udpAddr netaddr.IPPort) int {
+	if udpAddr.IsZero() || udpAddr != de.mtuAddr {
+		return 0
+	}
+	return de.mtu
+}
+
+// tooBigForPathLocked reports whether the WireGuard packet of n bytes
+// would be dropped on the path to udpAddr.
+//
+// de.mu must be held.
+func (de *discoEndpoint) tooBigForPathLocked(udpAddr netaddr.IPPort, n int) bool {
+	mtu := de.pathMTULocked(udpAddr)
+	return mtu != 0 && n > mtu+wgDataOverhead
+}
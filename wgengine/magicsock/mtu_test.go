@@ -0,0 +1,109 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/disco"
+)
+
+func TestMTUProbeSizes(t *testing.T) {
+	// magic + sender key + nonce + box overhead + type, version, TxID
+	if want := 6 + 32 + 24 + 16 + 14; discoPingOverhead != want {
+		t.Errorf("discoPingOverhead = %d; want %d", discoPingOverhead, want)
+	}
+	for _, mtu := range mtuProbeMTUs {
+		padding := mtu + wgDataOverhead - discoPingOverhead
+		ping := (&disco.Ping{Padding: padding}).AppendMarshal(nil)
+		pong := (&disco.Pong{Padding: pongPadding(padding)}).AppendMarshal(nil)
+		if len(pong) != len(ping) {
+			t.Errorf("MTU %d: pong is %d bytes; ping is %d", mtu, len(pong), len(ping))
+		}
+	}
+}
+
+func TestPathMTU(t *testing.T) {
+	addr := netaddr.IPPort{IP: netaddr.IPv4(1, 2, 3, 4), Port: 41641}
+	other := netaddr.IPPort{IP: netaddr.IPv4(5, 6, 7, 8), Port: 41641}
+	de := &discoEndpoint{c: &Conn{logf: t.Logf}, bestAddr: addr}
+
+	now := time.Now()
+	if !de.wantMTUProbeLocked(now) {
+		t.Fatal("unprobed path: want probe")
+	}
+	de.mtuProbeAddr, de.mtuProbeAt = addr, now
+	if de.tooBigForPathLocked(addr, 2000) {
+		t.Error("unknown MTU: packet too big")
+	}
+
+	de.handleMTUProbePongLocked(sentPing{to: addr, mtu: 1100})
+	de.handleMTUProbePongLocked(sentPing{to: addr, mtu: 1000})
+	if got := de.pathMTULocked(addr); got != 1100 {
+		t.Errorf("path MTU = %d; want 1100", got)
+	}
+	if de.tooBigForPathLocked(addr, 1100+wgDataOverhead) {
+		t.Error("packet of path MTU is too big")
+	}
+	if !de.tooBigForPathLocked(addr, 1101+wgDataOverhead) {
+		t.Error("packet over path MTU isn't too big")
+	}
+	if de.tooBigForPathLocked(other, 2000) {
+		t.Error("path MTU applied to another address")
+	}
+
+	if de.wantMTUProbeLocked(now.Add(time.Second)) {
+		t.Error("want probe right after the last")
+	}
+	if !de.wantMTUProbeLocked(now.Add(mtuReprobeInterval)) {
+		t.Error("small path MTU: want probe after mtuReprobeInterval")
+	}
+	de.bestAddr = other
+	if !de.wantMTUProbeLocked(now) {
+		t.Error("new best address: want probe")
+	}
+}
+
+func TestPathMTULowering(t *testing.T) {
+	addr := netaddr.IPPort{IP: netaddr.IPv4(1, 2, 3, 4), Port: 41641}
+	de := &discoEndpoint{c: &Conn{logf: t.Logf}, bestAddr: addr, mtuProbeAddr: addr}
+
+	// round sends pongs for mtus, then ends the round.
+	round := func(mtus ...int) {
+		for _, mtu := range mtus {
+			de.handleMTUProbePongLocked(sentPing{to: addr, mtu: mtu})
+		}
+		de.endMTURoundLocked()
+	}
+	round(1000, 1280)
+	if got := de.pathMTULocked(addr); got != 1280 {
+		t.Fatalf("path MTU = %d; want 1280", got)
+	}
+	for i := 1; i < mtuLowerRounds; i++ {
+		round(1100)
+		if got := de.pathMTULocked(addr); got != 1280 {
+			t.Fatalf("after %d short rounds, path MTU = %d; want 1280", i, got)
+		}
+	}
+	round() // no pongs at all; doesn't count
+	round(1100)
+	if got := de.pathMTULocked(addr); got != 1100 {
+		t.Fatalf("after %d short rounds, path MTU = %d; want 1100", mtuLowerRounds, got)
+	}
+
+	round(1000)
+	round(1280) // a full-size pong resets the count and raises it at once
+	if got := de.pathMTULocked(addr); got != 1280 {
+		t.Fatalf("path MTU = %d; want 1280", got)
+	}
+	for i := 1; i < mtuLowerRounds; i++ {
+		round(1000)
+	}
+	if got := de.pathMTULocked(addr); got != 1280 {
+		t.Errorf("path MTU = %d; want 1280", got)
+	}
+}
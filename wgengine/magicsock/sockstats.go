@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// sockStats counts the bytes a Conn sends and receives, by the
+// network interface that had the default route at the time.
+//
+// The sockets are bound to the wildcard address, so the interface a
+// packet actually used isn't known. The default route's interface is
+// close enough for the question this answers: how much data went over
+// cellular, and how much over Wi-Fi.
+type sockStats struct {
+	cur atomic.Value // of *ifaceCounters; counters of the current interface
+
+	mu      sync.Mutex
+	byIface map[string]*ifaceCounters
+}
+
+type ifaceCounters struct {
+	// Accessed atomically.
+	txBytes, rxBytes         int64
+	derpTxBytes, derpRxBytes int64
+
+	expensive bool // guarded by sockStats.mu
+}
+
+// setInterface records that traffic from now on goes via the network
+// interface named name (or "unknown", if empty).
+func (s *sockStats) setInterface(name string, expensive bool) {
+	if name == "" {
+		name = "unknown"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byIface == nil {
+		s.byIface = map[string]*ifaceCounters{}
+	}
+	ic, ok := s.byIface[name]
+	if !ok {
+		ic = new(ifaceCounters)
+		s.byIface[name] = ic
+	}
+	ic.expensive = expensive
+	s.cur.Store(ic)
+}
+
+func (s *sockStats) counters() *ifaceCounters {
+	if ic, ok := s.cur.Load().(*ifaceCounters); ok {
+		return ic
+	}
+	s.setInterface("", false)
+	return s.cur.Load().(*ifaceCounters)
+}
+
+// addUDP counts n bytes sent (if tx) or received on a UDP socket.
+func (s *sockStats) addUDP(tx bool, n int) {
+	if s == nil || n <= 0 {
+		return
+	}
+	ic := s.counters()
+	if tx {
+		atomic.AddInt64(&ic.txBytes, int64(n))
+	} else {
+		atomic.AddInt64(&ic.rxBytes, int64(n))
+	}
+}
+
+// addDERP counts n bytes of packet payload sent (if tx) or received
+// over DERP.
+func (s *sockStats) addDERP(tx bool, n int) {
+	if s == nil || n <= 0 {
+		return
+	}
+	ic := s.counters()
+	if tx {
+		atomic.AddInt64(&ic.derpTxBytes, int64(n))
+	} else {
+		atomic.AddInt64(&ic.derpRxBytes, int64(n))
+	}
+}
+
+// stats returns the counts for each interface that carried any
+// traffic, sorted by interface name.
+func (s *sockStats) stats() []ipnstate.InterfaceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []ipnstate.InterfaceStats
+	for name, ic := range s.byIface {
+		is := ipnstate.InterfaceStats{
+			Interface:   name,
+			Expensive:   ic.expensive,
+			TxBytes:     atomic.LoadInt64(&ic.txBytes),
+			RxBytes:     atomic.LoadInt64(&ic.rxBytes),
+			DERPTxBytes: atomic.LoadInt64(&ic.derpTxBytes),
+			DERPRxBytes: atomic.LoadInt64(&ic.derpRxBytes),
+		}
+		if is.TxBytes+is.RxBytes+is.DERPTxBytes+is.DERPRxBytes == 0 {
+			continue
+		}
+		ret = append(ret, is)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Interface < ret[j].Interface })
+	return ret
+}
+
+// SetNetworkInterface tells c which network interface has the default
+// route now, and whether it's metered, for accounting traffic by
+// interface. See ipnstate.Status.Interfaces.
+func (c *Conn) SetNetworkInterface(name string, expensive bool) {
+	c.sockStats.setInterface(name, expensive)
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"reflect"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+func TestSockStats(t *testing.T) {
+	var s sockStats
+	s.addUDP(true, 100) // before any interface is known
+	s.setInterface("wlan0", false)
+	s.addUDP(true, 10)
+	s.addUDP(false, 20)
+	s.addDERP(true, 30)
+	s.setInterface("rmnet0", true)
+	s.addUDP(false, 5)
+	s.addDERP(false, 7)
+	s.setInterface("wlan0", false)
+	s.addUDP(true, 1)
+	s.setInterface("eth0", false) // no traffic; not reported
+
+	var nilStats *sockStats
+	nilStats.addUDP(true, 1) // must not crash
+
+	want := []ipnstate.InterfaceStats{
+		{Interface: "rmnet0", Expensive: true, RxBytes: 5, DERPRxBytes: 7},
+		{Interface: "unknown", TxBytes: 100},
+		{Interface: "wlan0", TxBytes: 11, RxBytes: 20, DERPTxBytes: 30},
+	}
+	if got := s.stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats =\n%+v\nwant\n%+v", got, want)
+	}
+}
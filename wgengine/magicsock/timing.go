@@ -0,0 +1,199 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Timing holds the intervals that peer path discovery runs on. A zero
+// field means to use its default; see DefaultTiming.
+//
+// The defaults suit almost everyone. Changing them is for constrained
+// environments (where fewer wakeups and pings matter more than
+// finding a better path quickly) and for tests.
+type Timing struct {
+	// Heartbeat is how often the best UDP path to an active peer
+	// is pinged to keep it alive.
+	Heartbeat time.Duration
+	// DiscoPing is the minimum time between pings to any one
+	// endpoint of a peer.
+	DiscoPing time.Duration
+	// PingTimeout is how long to wait for a pong before assuming
+	// it's never coming.
+	PingTimeout time.Duration
+	// TrustUDPAddr is how long a UDP path is used on its own,
+	// without also sending over DERP, after its last pong.
+	TrustUDPAddr time.Duration
+	// Upgrade is how often to look for a better path when the
+	// current UDP path works but isn't fast.
+	Upgrade time.Duration
+	// SessionActive is how long after the last packet sent to a
+	// peer its path is kept alive.
+	SessionActive time.Duration
+}
+
+// DefaultTiming returns the default path discovery intervals.
+func DefaultTiming() Timing {
+	return Timing{
+		Heartbeat:     heartbeatInterval,
+		DiscoPing:     discoPingInterval,
+		PingTimeout:   pingTimeoutDuration,
+		TrustUDPAddr:  trustUDPAddrDuration,
+		Upgrade:       upgradeInterval,
+		SessionActive: sessionActiveTimeout,
+	}
+}
+
+// withDefaults returns t with its zero fields set to their defaults.
+func (t Timing) withDefaults() Timing {
+	def := DefaultTiming()
+	for _, b := range timingBounds {
+		if v := b.field(&t); *v == 0 {
+			*v = *b.field(&def)
+		}
+	}
+	return t
+}
+
+// meteredSlowdown is how many times longer the intervals between
+// background pings and STUN probes are on metered networks.
+const meteredSlowdown = 3
+
+// metered returns t adjusted for a metered network: heartbeats and
+// path upgrades happen less often, at the cost of noticing path
+// changes later. TrustUDPAddr grows with Heartbeat so a working path
+// isn't abandoned for DERP between pings.
+func (t Timing) metered() Timing {
+	t.Heartbeat *= meteredSlowdown
+	t.TrustUDPAddr *= meteredSlowdown
+	t.Upgrade *= meteredSlowdown
+	return t
+}
+
+// batterySessionActive caps Timing.SessionActive while on battery.
+const batterySessionActive = 30 * time.Second
+
+// battery returns t adjusted for running on battery: the same as
+// metered, and additionally idle peers stop being heartbeated sooner,
+// at the cost of a slower first packet when they're used again.
+func (t Timing) battery() Timing {
+	t = t.metered()
+	if t.SessionActive > batterySessionActive {
+		t.SessionActive = batterySessionActive
+	}
+	return t
+}
+
+// curTiming returns the intervals to use on the current network and
+// power source.
+func (c *Conn) curTiming() *Timing {
+	if c.onBattery.Get() {
+		return &c.timingBattery
+	}
+	if c.metered.Get() {
+		return &c.timingMetered
+	}
+	return &c.timing
+}
+
+// SetMetered sets whether the current network is metered. While it
+// is, c sends fewer heartbeats, STUN probes and path discovery pings.
+func (c *Conn) SetMetered(metered bool) {
+	if c.metered.Get() == metered {
+		return
+	}
+	c.metered.Set(metered)
+	c.logf("magicsock: metered network: %v", metered)
+}
+
+// SetOnBattery sets whether the machine is running on battery. While
+// it is, c wakes up less often to ping peers and probe STUN servers,
+// and stops keeping idle peers' paths alive sooner.
+func (c *Conn) SetOnBattery(onBattery bool) {
+	if c.onBattery.Get() == onBattery {
+		return
+	}
+	c.onBattery.Set(onBattery)
+	c.logf("magicsock: on battery: %v", onBattery)
+}
+
+// timingBounds are the allowed ranges of each Timing field, keyed by
+// the names ParseTiming uses. Outside of them, discovery either
+// floods the network with pings or takes too long to notice that
+// paths changed.
+var timingBounds = []struct {
+	name     string
+	field    func(*Timing) *time.Duration
+	min, max time.Duration
+}{
+	{"heartbeat", func(t *Timing) *time.Duration { return &t.Heartbeat }, 250 * time.Millisecond, time.Minute},
+	{"disco-ping", func(t *Timing) *time.Duration { return &t.DiscoPing }, time.Second, time.Minute},
+	{"ping-timeout", func(t *Timing) *time.Duration { return &t.PingTimeout }, time.Second, time.Minute},
+	{"trust-udp", func(t *Timing) *time.Duration { return &t.TrustUDPAddr }, time.Second, time.Minute},
+	{"upgrade", func(t *Timing) *time.Duration { return &t.Upgrade }, 5 * time.Second, time.Hour},
+	{"session-active", func(t *Timing) *time.Duration { return &t.SessionActive }, 10 * time.Second, time.Hour},
+}
+
+// Check reports whether t, with defaults filled in, is within the
+// allowed bounds.
+func (t Timing) Check() error {
+	t = t.withDefaults()
+	for _, b := range timingBounds {
+		v := *b.field(&t)
+		if v < b.min || v > b.max {
+			return fmt.Errorf("disco timing %s=%v out of range [%v, %v]", b.name, v, b.min, b.max)
+		}
+	}
+	// A UDP path that's trusted for less than a heartbeat would
+	// fall back to DERP between every pair of pings.
+	if t.TrustUDPAddr < t.Heartbeat {
+		return fmt.Errorf("disco timing trust-udp=%v is shorter than heartbeat=%v", t.TrustUDPAddr, t.Heartbeat)
+	}
+	return nil
+}
+
+// ParseTiming parses a comma-separated list of name=duration pairs,
+// such as "heartbeat=5s,upgrade=5m", into a Timing. The names are
+// heartbeat, disco-ping, ping-timeout, trust-udp, upgrade and
+// session-active. Unlisted fields are left zero, meaning default.
+func ParseTiming(s string) (Timing, error) {
+	var t Timing
+	if strings.TrimSpace(s) == "" {
+		return t, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i == -1 {
+			return Timing{}, fmt.Errorf("disco timing %q: want name=duration", kv)
+		}
+		name, val := strings.TrimSpace(kv[:i]), strings.TrimSpace(kv[i+1:])
+		found := false
+		for _, b := range timingBounds {
+			if b.name != name {
+				continue
+			}
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return Timing{}, fmt.Errorf("disco timing %s: %v", name, err)
+			}
+			*b.field(&t) = d
+			found = true
+		}
+		if !found {
+			return Timing{}, fmt.Errorf("unknown disco timing %q", name)
+		}
+	}
+	return t, t.Check()
+}
+
+// envTiming returns the Timing from the TS_DISCO_TIMING environment
+// variable, in ParseTiming's format.
+func envTiming() (Timing, error) {
+	return ParseTiming(os.Getenv("TS_DISCO_TIMING"))
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTiming(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Timing
+		wantErr bool
+	}{
+		{in: "", want: Timing{}},
+		{in: "heartbeat=5s,upgrade=5m", want: Timing{Heartbeat: 5 * time.Second, Upgrade: 5 * time.Minute}},
+		{in: " ping-timeout = 2s ", want: Timing{PingTimeout: 2 * time.Second}},
+		{in: "heartbeat", wantErr: true},
+		{in: "bogus=1s", wantErr: true},
+		{in: "upgrade=soon", wantErr: true},
+		{in: "heartbeat=1ms", wantErr: true},              // too frequent
+		{in: "session-active=24h", wantErr: true},         // too long
+		{in: "heartbeat=10s,trust-udp=5s", wantErr: true}, // path expires between heartbeats
+	}
+	for _, tt := range tests {
+		got, err := ParseTiming(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTiming(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("ParseTiming(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTimingDefaults(t *testing.T) {
+	if err := DefaultTiming().Check(); err != nil {
+		t.Errorf("default timing fails its own check: %v", err)
+	}
+	got := Timing{Heartbeat: 3 * time.Second}.withDefaults()
+	want := DefaultTiming()
+	want.Heartbeat = 3 * time.Second
+	if got != want {
+		t.Errorf("withDefaults = %+v; want %+v", got, want)
+	}
+}
+
+func TestTimingMetered(t *testing.T) {
+	def := DefaultTiming()
+	m := def.metered()
+	if m.Heartbeat <= def.Heartbeat || m.Upgrade <= def.Upgrade {
+		t.Errorf("metered timing %+v isn't slower than default %+v", m, def)
+	}
+	if m.TrustUDPAddr < m.Heartbeat {
+		t.Errorf("metered trust-udp=%v is shorter than heartbeat=%v", m.TrustUDPAddr, m.Heartbeat)
+	}
+	if m.PingTimeout != def.PingTimeout || m.SessionActive != def.SessionActive {
+		t.Errorf("metered timing changed ping timeout or session length: %+v", m)
+	}
+
+	c := newConn()
+	c.logf = t.Logf
+	if got := c.curTiming(); *got != c.timing {
+		t.Errorf("unmetered curTiming = %+v; want %+v", *got, c.timing)
+	}
+	c.SetMetered(true)
+	if got := c.curTiming(); *got != c.timingMetered {
+		t.Errorf("metered curTiming = %+v; want %+v", *got, c.timingMetered)
+	}
+}
+
+func TestTimingBattery(t *testing.T) {
+	def := DefaultTiming()
+	b := def.battery()
+	if b.Heartbeat != def.metered().Heartbeat {
+		t.Errorf("battery heartbeat = %v; want metered heartbeat %v", b.Heartbeat, def.metered().Heartbeat)
+	}
+	if b.SessionActive >= def.SessionActive || b.SessionActive < b.Heartbeat {
+		t.Errorf("battery session-active = %v; want shorter than %v but at least heartbeat %v", b.SessionActive, def.SessionActive, b.Heartbeat)
+	}
+
+	c := newConn()
+	c.logf = t.Logf
+	c.SetMetered(true)
+	c.SetOnBattery(true)
+	if got := c.curTiming(); *got != c.timingBattery {
+		t.Errorf("battery curTiming = %+v; want %+v", *got, c.timingBattery)
+	}
+	c.SetOnBattery(false)
+	if got := c.curTiming(); *got != c.timingMetered {
+		t.Errorf("curTiming off battery = %+v; want metered %+v", *got, c.timingMetered)
+	}
+}
@@ -8,6 +8,7 @@
 package monitor
 
 import (
+	"runtime"
 	"sync"
 	"time"
 
@@ -79,6 +80,7 @@ func New(logf logger.Logf, callback ChangeFunc) (*Mon, error) {
 func (m *Mon) Start() {
 	m.onceStart.Do(func() {
 		if m.om == nil {
+			m.logf("no network change monitoring on %s", runtime.GOOS)
 			return
 		}
 		m.started = true
@@ -0,0 +1,22 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import "os"
+
+// InCrostini reports whether the process runs in Chrome OS's Linux
+// container (Crostini), inside its Termina VM. Chrome OS itself
+// doesn't route through the container's network interfaces, so
+// Tailscale there only carries the container's own traffic.
+func InCrostini() bool {
+	// Chrome OS bind-mounts its milestone into its containers, and
+	// installs its integration tools in them.
+	for _, path := range []string{"/dev/.cros_milestone", "/opt/google/cros-containers"} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
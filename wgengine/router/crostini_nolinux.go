@@ -0,0 +1,13 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package router
+
+// InCrostini reports whether the process runs in Chrome OS's Linux
+// container. That's Linux, so elsewhere it always reports false.
+func InCrostini() bool {
+	return false
+}
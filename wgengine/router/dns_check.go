@@ -0,0 +1,24 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+
+	"inet.af/netaddr"
+)
+
+// ErrDNSCheckSkipped is wrapped by the errors CheckDNS returns when
+// the system has no DNS backend it knows, or when checking it would
+// disturb the DNS configuration of a running tailscaled.
+var ErrDNSCheckSkipped = errors.New("DNS check skipped")
+
+// checkDNSServers and checkDNSDomains are the DNS configuration
+// CheckDNS applies. It's only in place for as long as the check
+// takes, and the search domain can't collide with a real one.
+var (
+	checkDNSServers = []netaddr.IP{netaddr.IPv4(100, 100, 100, 100)}
+	checkDNSDomains = []string{"selftest.tailscale.invalid"}
+)
@@ -0,0 +1,45 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"tailscale.com/types/logger"
+)
+
+// CheckDNS sets a test DNS configuration in SystemConfiguration, then
+// removes it again. It returns the backend's name.
+func CheckDNS(logf logger.Logf, tunname string) (backend string, err error) {
+	backend = "SystemConfiguration"
+	if scDNSKeyExists() {
+		return backend, fmt.Errorf("%w: %s is set by a running tailscaled", ErrDNSCheckSkipped, scDNSKey)
+	}
+	if err := setSCDNS(checkDNSServers, checkDNSDomains, nil, false); err != nil {
+		setSCDNS(nil, nil, nil, false)
+		return backend, fmt.Errorf("applying DNS config: %v", err)
+	}
+	if !scDNSKeyExists() {
+		return backend, fmt.Errorf("%s wasn't set", scDNSKey)
+	}
+	if err := setSCDNS(nil, nil, nil, false); err != nil {
+		return backend, fmt.Errorf("rolling back DNS config: %v", err)
+	}
+	if scDNSKeyExists() {
+		return backend, fmt.Errorf("%s is still set after rolling back", scDNSKey)
+	}
+	return backend, nil
+}
+
+// scDNSKeyExists reports whether tailscaled's DNS entry is in the
+// dynamic store.
+func scDNSKeyExists() bool {
+	cmd := exec.Command("scutil")
+	cmd.Stdin = strings.NewReader("show " + scDNSKey + "\nquit\n")
+	out, err := cmd.CombinedOutput()
+	return err == nil && !strings.Contains(string(out), "No such key")
+}
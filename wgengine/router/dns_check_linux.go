@@ -0,0 +1,36 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"tailscale.com/types/logger"
+)
+
+// CheckDNS applies a test DNS configuration to the interface tunname
+// with the system's DNS backend, then rolls it back and checks that
+// resolv.conf is as it was. It returns the backend's name.
+func CheckDNS(logf logger.Logf, tunname string) (backend string, err error) {
+	if link, _ := os.Readlink(resolvConf); link == tsConf {
+		return "direct", fmt.Errorf("%w: %s is managed by a running tailscaled", ErrDNSCheckSkipped, resolvConf)
+	}
+	before, _ := ioutil.ReadFile(resolvConf)
+	m, backend := newDNSManager(logf, tunname, osCommandRunner{})
+	if err := m.Up(dnsConfig{Nameservers: checkDNSServers, Domains: checkDNSDomains}); err != nil {
+		m.Down()
+		return backend, fmt.Errorf("applying DNS config: %v", err)
+	}
+	if err := m.Down(); err != nil {
+		return backend, fmt.Errorf("rolling back DNS config: %v", err)
+	}
+	if after, _ := ioutil.ReadFile(resolvConf); !bytes.Equal(before, after) {
+		return backend, fmt.Errorf("%s differs after rolling back", resolvConf)
+	}
+	return backend, nil
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!darwin,!windows
+
+package router
+
+import (
+	"fmt"
+	"runtime"
+
+	"tailscale.com/types/logger"
+)
+
+// CheckDNS reports that tailscaled doesn't change the system DNS
+// config on this platform.
+func CheckDNS(logf logger.Logf, tunname string) (backend string, err error) {
+	return "", fmt.Errorf("%w: tailscaled doesn't change the system DNS config on %s", ErrDNSCheckSkipped, runtime.GOOS)
+}
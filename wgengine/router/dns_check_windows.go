@@ -0,0 +1,45 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows/registry"
+	"tailscale.com/types/logger"
+)
+
+// CheckDNS installs a test NRPT rule, then removes it again. It
+// returns the backend's name.
+func CheckDNS(logf logger.Logf, tunname string) (backend string, err error) {
+	backend = "NRPT"
+	if nrptRuleExists() {
+		return backend, fmt.Errorf("%w: the NRPT rule is set by a running tailscaled", ErrDNSCheckSkipped)
+	}
+	if err := setNRPTRule(checkDNSDomains, checkDNSServers); err != nil {
+		delNRPTRule()
+		return backend, fmt.Errorf("applying DNS config: %v", err)
+	}
+	if !nrptRuleExists() {
+		return backend, fmt.Errorf("NRPT rule %s wasn't created", nrptRuleID)
+	}
+	if err := delNRPTRule(); err != nil {
+		return backend, fmt.Errorf("rolling back DNS config: %v", err)
+	}
+	if nrptRuleExists() {
+		return backend, fmt.Errorf("NRPT rule %s is still there after rolling back", nrptRuleID)
+	}
+	return backend, nil
+}
+
+// nrptRuleExists reports whether Tailscale's NRPT rule is installed.
+func nrptRuleExists() bool {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, nrptBase+nrptRuleID, registry.QUERY_VALUE)
+	if err != nil {
+		return false
+	}
+	key.Close()
+	return true
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+// scDNSKey is where tailscaled's DNS configuration goes in the
+// SystemConfiguration dynamic store. configd merges every
+// State:/Network/Service/*/DNS entry into the resolver configuration,
+// turning those with SupplementalMatchDomains into supplemental
+// resolvers for just those domains, as scutil --dns shows. The key is
+// fixed so that an entry left behind by a crashed tailscaled is
+// replaced or removed by the next one.
+const scDNSKey = "State:/Network/Service/com.tailscale.tailscaled/DNS"
+
+// setSCDNS configures servers as the resolvers for names under
+// search and routes, or for all names if defaultRoute, with search
+// as search domains. Other services' DNS settings, such as Wi-Fi's,
+// are left alone. With no servers, it removes the configuration.
+func setSCDNS(servers []netaddr.IP, search, routes []string, defaultRoute bool) error {
+	return runScutil(scutilDNSCommands(servers, search, routes, defaultRoute))
+}
+
+// scutilDNSCommands returns the scutil(8) commands that set, or with
+// no servers remove, tailscaled's DNS entry.
+func scutilDNSCommands(servers []netaddr.IP, search, routes []string, defaultRoute bool) string {
+	if len(servers) == 0 {
+		return "remove " + scDNSKey + "\n"
+	}
+	var b strings.Builder
+	b.WriteString("d.init\n")
+	b.WriteString("d.add ServerAddresses *")
+	for _, ip := range servers {
+		b.WriteString(" " + ip.String())
+	}
+	b.WriteString("\n")
+	search = scutilSafe(search)
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "d.add SearchDomains * %s\n", strings.Join(search, " "))
+	}
+	match := append(append([]string(nil), search...), scutilSafe(routes)...)
+	if defaultRoute {
+		// The empty domain matches all names.
+		match = append(match, `""`)
+	}
+	if len(match) > 0 {
+		fmt.Fprintf(&b, "d.add SupplementalMatchDomains * %s\n", strings.Join(match, " "))
+	}
+	fmt.Fprintf(&b, "set %s\n", scDNSKey)
+	return b.String()
+}
+
+// scutilSafe returns the domains that can be passed to scutil as
+// they are, dropping any that contain spaces or quotes.
+func scutilSafe(domains []string) []string {
+	var ret []string
+	for _, d := range domains {
+		d = strings.TrimSuffix(d, ".")
+		if d == "" || strings.ContainsAny(d, " \t\r\n\"'\\") {
+			continue
+		}
+		ret = append(ret, d)
+	}
+	return ret
+}
+
+func runScutil(cmds string) error {
+	cmd := exec.Command("scutil")
+	cmd.Stdin = strings.NewReader(cmds + "quit\n")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("scutil: %v\n%s", err, out)
+	}
+	// scutil reports failed commands but still exits 0.
+	if len(strings.TrimSpace(string(out))) > 0 {
+		return fmt.Errorf("scutil: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestScutilDNSCommands(t *testing.T) {
+	servers := []netaddr.IP{netaddr.IPv4(100, 100, 100, 100)}
+	tests := []struct {
+		name         string
+		servers      []netaddr.IP
+		search       []string
+		routes       []string
+		defaultRoute bool
+		want         string
+	}{
+		{
+			name: "remove",
+			want: "remove " + scDNSKey + "\n",
+		},
+		{
+			name:    "split",
+			servers: servers,
+			search:  []string{"tailscale.us.", "bad domain"},
+			routes:  []string{"corp.example.com"},
+			want: "d.init\n" +
+				"d.add ServerAddresses * 100.100.100.100\n" +
+				"d.add SearchDomains * tailscale.us\n" +
+				"d.add SupplementalMatchDomains * tailscale.us corp.example.com\n" +
+				"set " + scDNSKey + "\n",
+		},
+		{
+			name:         "default_route",
+			servers:      servers,
+			defaultRoute: true,
+			want: "d.init\n" +
+				"d.add ServerAddresses * 100.100.100.100\n" +
+				"d.add SupplementalMatchDomains * \"\"\n" +
+				"set " + scDNSKey + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scutilDNSCommands(tt.servers, tt.search, tt.routes, tt.defaultRoute)
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
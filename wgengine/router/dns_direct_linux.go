@@ -0,0 +1,313 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"tailscale.com/atomicfile"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/lsm"
+)
+
+const (
+	tsConf     = "/etc/resolv.tailscale.conf"
+	backupConf = "/etc/resolv.pre-tailscale-backup.conf"
+	resolvConf = "/etc/resolv.conf"
+)
+
+const (
+	// resolvConfSettle is how long the watcher waits after
+	// resolv.conf changes before checking it, so that a writer
+	// making several changes in a row is only answered once.
+	resolvConfSettle = 500 * time.Millisecond
+	// resolvConfPollInterval is how often resolv.conf is checked
+	// where inotify isn't available.
+	resolvConfPollInterval = 10 * time.Second
+)
+
+// directManager is a dnsManager that points resolv.conf at a file of
+// Tailscale's, backing up the original, for systems where nothing
+// else manages DNS. DHCP clients such as dhclient rewrite resolv.conf
+// as leases renew, so it watches for that and puts Tailscale's
+// configuration back, keeping the rewritten file as the one to
+// restore on Down.
+type directManager struct {
+	logf logger.Logf
+	// Paths of resolv.conf, Tailscale's file, and the backup;
+	// they're only changed in tests.
+	resolvConf, tsConf, backupConf string
+
+	// mu guards the fields below, and the files.
+	mu sync.Mutex
+	// want is the contents of tsConf, or nil while down.
+	want []byte
+	// stop is closed to stop the watcher, which closes done on
+	// exiting. They're nil if there's no watcher.
+	stop, done chan struct{}
+}
+
+func newDirectManager(logf logger.Logf) *directManager {
+	return &directManager{
+		logf:       logf,
+		resolvConf: resolvConf,
+		tsConf:     tsConf,
+		backupConf: backupConf,
+	}
+}
+
+// Up implements dnsManager.
+func (m *directManager) Up(cfg dnsConfig) error {
+	if len(cfg.Nameservers) == 0 {
+		return m.Down()
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# resolv.conf(5) file generated by tailscale\n")
+	fmt.Fprintf(buf, "#     DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN\n\n")
+	writeResolvConf(buf, cfg.Nameservers, cfg.Domains)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.want = buf.Bytes()
+	if m.stop == nil {
+		m.stop = make(chan struct{})
+		m.done = make(chan struct{})
+		go m.watch(m.stop, m.done)
+	}
+	err := m.replaceLocked()
+	lsm.Check(lsm.OpResolvConf, err)
+	return err
+}
+
+// Down implements dnsManager.
+func (m *directManager) Down() error {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop, m.done = nil, nil
+	m.want = nil
+	m.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.restoreLocked()
+}
+
+// replaceLocked writes m.want to tsConf and points resolv.conf at
+// it, backing up resolv.conf unless it already points there.
+func (m *directManager) replaceLocked() error {
+	f, err := ioutil.TempFile(filepath.Dir(m.tsConf), filepath.Base(m.tsConf)+".*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := atomicfile.WriteFile(f.Name(), m.want, 0644); err != nil {
+		return err
+	}
+	os.Chmod(f.Name(), 0644) // ioutil.TempFile creates the file with 0600
+	if err := os.Rename(f.Name(), m.tsConf); err != nil {
+		return err
+	}
+
+	if linkPath, err := os.Readlink(m.resolvConf); err != nil {
+		// Remove any old backup that may exist.
+		os.Remove(m.backupConf)
+
+		// Backup the existing resolv.conf file.
+		contents, err := ioutil.ReadFile(m.resolvConf)
+		if os.IsNotExist(err) {
+			// No existing resolv.conf file to backup.
+			// Nothing to do.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := atomicfile.WriteFile(m.backupConf, contents, 0644); err != nil {
+			return err
+		}
+	} else if linkPath != m.tsConf {
+		// Backup the existing symlink.
+		os.Remove(m.backupConf)
+		if err := os.Symlink(linkPath, m.backupConf); err != nil {
+			return err
+		}
+	} else {
+		// Nothing to do, resolvConf already points to tsConf.
+		return nil
+	}
+
+	os.Remove(m.resolvConf)
+	return os.Symlink(m.tsConf, m.resolvConf)
+}
+
+// restoreLocked puts back the resolv.conf backed up by replaceLocked,
+// if any.
+func (m *directManager) restoreLocked() error {
+	if _, err := os.Stat(m.backupConf); err != nil {
+		if os.IsNotExist(err) {
+			return nil // no backup resolv.conf to restore
+		}
+		return err
+	}
+	if ln, err := os.Readlink(m.resolvConf); err != nil {
+		return err
+	} else if ln != m.tsConf {
+		return fmt.Errorf("resolv.conf is not a symlink to %s", m.tsConf)
+	}
+	if err := os.Rename(m.backupConf, m.resolvConf); err != nil {
+		return err
+	}
+	os.Remove(m.tsConf) // best effort removal of tsConf file
+	return nil
+}
+
+// check puts Tailscale's configuration back if something else
+// replaced resolv.conf or Tailscale's file.
+func (m *directManager) check() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.want == nil {
+		return
+	}
+	link, _ := os.Readlink(m.resolvConf)
+	if link == m.tsConf {
+		if got, err := ioutil.ReadFile(m.tsConf); err == nil && bytes.Equal(got, m.want) {
+			return
+		}
+		m.logf("dns: %s was modified; rewriting it", m.tsConf)
+	} else {
+		contents, _ := ioutil.ReadFile(m.resolvConf)
+		m.logf("dns: %s was replaced by %s; restoring Tailscale's DNS configuration", m.resolvConf, resolvConfWriter(link, contents))
+	}
+	if err := m.replaceLocked(); err != nil {
+		m.logf("dns: restoring %s: %v", m.resolvConf, err)
+	}
+}
+
+// watch calls check when resolv.conf changes, until stop is closed.
+// It uses inotify if it can, and polls otherwise.
+func (m *directManager) watch(stop, done chan struct{}) {
+	defer close(done)
+
+	changed := make(chan struct{}, 1)
+	w, err := newResolvConfWatcher(m.resolvConf, changed)
+	if err != nil {
+		m.logf("dns: can't watch %s, polling instead: %v", m.resolvConf, err)
+	} else {
+		defer w.Close()
+	}
+	// Catch changes made before the watch started.
+	m.check()
+
+	poll := time.NewTicker(resolvConfPollInterval)
+	defer poll.Stop()
+	settle := time.NewTimer(0)
+	<-settle.C
+	defer settle.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-changed:
+			settle.Reset(resolvConfSettle)
+		case <-settle.C:
+			m.check()
+		case <-poll.C:
+			if w == nil {
+				m.check()
+			}
+		}
+	}
+}
+
+// newResolvConfWatcher returns an inotify file whose events for the
+// file at path, made in its directory since writers replace it rather
+// than edit it, are signalled on changed until it's closed.
+func newResolvConfWatcher(path string, changed chan<- struct{}) (*os.File, error) {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	const mask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// The fd is non-blocking, so reads go through the runtime's
+	// poller, and Close interrupts them.
+	f := os.NewFile(uintptr(fd), "inotify")
+	name := filepath.Base(path)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			if inotifyNames(buf[:n], name) {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return f, nil
+}
+
+// inotifyNames reports whether any of the inotify events in buf is
+// for name.
+func inotifyNames(buf []byte, name string) bool {
+	for len(buf) >= unix.SizeofInotifyEvent {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		nameLen := int(ev.Len)
+		if unix.SizeofInotifyEvent+nameLen > len(buf) {
+			break
+		}
+		evName := string(bytes.TrimRight(buf[unix.SizeofInotifyEvent:unix.SizeofInotifyEvent+nameLen], "\x00"))
+		if evName == name {
+			return true
+		}
+		buf = buf[unix.SizeofInotifyEvent+nameLen:]
+	}
+	return false
+}
+
+// resolvConfWriter guesses, for logging, what wrote a resolv.conf
+// that's a symlink to link (if non-empty) or has contents. Most
+// generators say who they are in a leading comment.
+func resolvConfWriter(link string, contents []byte) string {
+	if link != "" {
+		return "a symlink to " + link
+	}
+	s := bufio.NewScanner(bytes.NewReader(contents))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		if c := strings.TrimSpace(strings.TrimLeft(line, "#")); c != "" {
+			return fmt.Sprintf("a file saying %q", c)
+		}
+	}
+	return "a file without a comment (likely from a DHCP client)"
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestDirectManagerReasserts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolvconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newDirectManager(t.Logf)
+	m.resolvConf = filepath.Join(dir, "resolv.conf")
+	m.tsConf = filepath.Join(dir, "resolv.tailscale.conf")
+	m.backupConf = filepath.Join(dir, "resolv.pre-tailscale-backup.conf")
+
+	if err := ioutil.WriteFile(m.resolvConf, []byte("nameserver 192.168.1.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(dnsConfig{Nameservers: []netaddr.IP{netaddr.IPv4(100, 100, 100, 100)}}); err != nil {
+		t.Fatal(err)
+	}
+	usesTailscale := func() bool {
+		b, err := ioutil.ReadFile(m.resolvConf)
+		return err == nil && strings.Contains(string(b), "nameserver 100.100.100.100")
+	}
+	if !usesTailscale() {
+		t.Fatal("resolv.conf not replaced by Up")
+	}
+
+	// Overwrite it, as a DHCP client renewing its lease would.
+	if err := os.Remove(m.resolvConf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(m.resolvConf, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !usesTailscale() {
+		if time.Now().After(deadline) {
+			t.Fatal("overwritten resolv.conf not restored")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(m.resolvConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "nameserver 10.0.0.1\n"; string(got) != want {
+		t.Errorf("after Down, resolv.conf = %q; want the DHCP client's %q", got, want)
+	}
+}
+
+func TestResolvConfWriter(t *testing.T) {
+	tests := []struct {
+		link     string
+		contents string
+		want     string
+	}{
+		{"../run/systemd/resolve/stub-resolv.conf", "", "a symlink to ../run/systemd/resolve/stub-resolv.conf"},
+		{"", "# Generated by NetworkManager\nnameserver 10.0.0.1\n", `a file saying "Generated by NetworkManager"`},
+		{"", "\n#\n# Dynamic resolv.conf(5) file\nnameserver 10.0.0.1\n", `a file saying "Dynamic resolv.conf(5) file"`},
+		{"", "domain example.com\n# not a header\n", "a file without a comment (likely from a DHCP client)"},
+	}
+	for _, tt := range tests {
+		if got := resolvConfWriter(tt.link, []byte(tt.contents)); got != tt.want {
+			t.Errorf("resolvConfWriter(%q, %q) = %q; want %q", tt.link, tt.contents, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+// dnsConfig is the DNS configuration of the Tailscale interface.
+type dnsConfig struct {
+	Nameservers []netaddr.IP
+	Domains     []string // search domains
+	// Routes are domains resolved by Nameservers, but not searched.
+	// Backends that can't route queries by domain ignore them.
+	Routes []string
+	// DefaultRoute is whether Nameservers resolve names that aren't
+	// under Domains or Routes, too.
+	DefaultRoute bool
+	// Exclusive is whether Nameservers should be the only ones
+	// used, rather than merged with other interfaces'. Only
+	// openresolv supports it; other backends ignore it.
+	Exclusive bool
+	// ProbeName is a name that must keep resolving with this
+	// configuration applied, or "" if there's none to check. Only
+	// verifyingDNSManager uses it.
+	ProbeName string
+}
+
+// dnsManager configures the system resolver to use the Tailscale
+// interface's DNS configuration.
+type dnsManager interface {
+	// Up applies cfg, replacing any configuration applied earlier.
+	// Managers wrapped by newVerifyingDNSManager may instead keep
+	// the earlier configuration, if cfg breaks name resolution,
+	// and return an error.
+	Up(cfg dnsConfig) error
+	// Down reverts the system to its configuration from before the
+	// first Up.
+	Down() error
+}
+
+// newDNSManager returns the dnsManager for the DNS backend the
+// system uses, and the backend's name. If there's none it knows, it
+// manages resolv.conf itself.
+func newDNSManager(logf logger.Logf, tunname string, cmd commandRunner) (dnsManager, string) {
+	direct := newDirectManager(logf)
+	// Undo resolv.conf changes left by a tailscaled that didn't
+	// shut down cleanly, whichever manager is used now.
+	if err := direct.Down(); err != nil {
+		logf("dns: restoring resolv.conf: %v", err)
+	}
+	if nmIsRunning(cmd) {
+		logf("dns: using NetworkManager")
+		return newNMManager(logf, tunname, cmd), "NetworkManager"
+	}
+	if resolvedIsActive(cmd) {
+		logf("dns: using systemd-resolved")
+		return newResolvedManager(logf, tunname, cmd), "systemd-resolved"
+	}
+	if style := resolvconfStyle(cmd); style != "" {
+		logf("dns: using %s", style)
+		return newResolvconfManager(logf, tunname, style, cmd.runStdin), style
+	}
+	logf("dns: using /etc/resolv.conf directly")
+	return direct, "direct"
+}
+
+// writeResolvConf writes the resolv.conf(5) lines for servers and
+// domains to w.
+func writeResolvConf(w io.Writer, servers []netaddr.IP, domains []string) {
+	for _, ns := range servers {
+		fmt.Fprintf(w, "nameserver %s\n", ns)
+	}
+	if len(domains) > 0 {
+		fmt.Fprintf(w, "search %s\n", strings.Join(domains, " "))
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"tailscale.com/types/logger"
+)
+
+// nmDNSPriority is the DNS priority given to the Tailscale
+// interface when its nameservers are the default route.
+// NetworkManager uses only the nameservers of the interfaces with
+// the lowest priority, if it's negative, so Tailscale's nameservers
+// replace the others like they do when resolv.conf is written
+// directly.
+//
+// Otherwise the interface keeps the default priority, and its
+// routing-only domains ("~domain") let NetworkManager's DNS plugin,
+// dnsmasq or systemd-resolved, send just those domains to it.
+const nmDNSPriority = "-50"
+
+// nmManager is a dnsManager that configures DNS through
+// NetworkManager (org.freedesktop.NetworkManager), which owns
+// resolv.conf on most desktop distros and rewrites it when it
+// changes, undoing any edits we make to it directly.
+//
+// It talks to NetworkManager over D-Bus by way of nmcli, and only
+// reapplies the settings of the tun device's active connection,
+// which NetworkManager doesn't persist, so nothing is left behind if
+// tailscaled dies.
+type nmManager struct {
+	logf    logger.Logf
+	tunname string
+	cmd     commandRunner
+
+	up bool // whether Up has applied a configuration
+	// unmanage is whether the tun device was unmanaged by
+	// NetworkManager before Up, and should be unmanaged again by
+	// Down.
+	unmanage bool
+}
+
+func newNMManager(logf logger.Logf, tunname string, cmd commandRunner) *nmManager {
+	return &nmManager{
+		logf:    logf,
+		tunname: tunname,
+		cmd:     cmd,
+	}
+}
+
+// nmIsRunning reports whether NetworkManager is running.
+func nmIsRunning(cmd commandRunner) bool {
+	out, err := cmd.output("nmcli", "-t", "-f", "RUNNING", "general")
+	return err == nil && strings.TrimSpace(string(out)) == "running"
+}
+
+// Up implements dnsManager.
+func (m *nmManager) Up(cfg dnsConfig) error {
+	if len(cfg.Nameservers) == 0 {
+		return m.Down()
+	}
+	if !m.up {
+		// NetworkManager only applies DNS settings of devices
+		// it manages. Managing the tun device makes it assume
+		// its existing addresses and routes, which it leaves
+		// alone.
+		out, err := m.cmd.output("nmcli", "-g", "GENERAL.NM-MANAGED", "device", "show", m.tunname)
+		if err != nil {
+			return fmt.Errorf("getting NetworkManager state of %s: %w", m.tunname, err)
+		}
+		if strings.TrimSpace(string(out)) != "yes" {
+			if err := m.cmd.run("nmcli", "device", "set", m.tunname, "managed", "yes"); err != nil {
+				return fmt.Errorf("making NetworkManager manage %s: %w", m.tunname, err)
+			}
+			m.unmanage = true
+		}
+	}
+
+	var dns4, dns6 []string
+	for _, ip := range cfg.Nameservers {
+		if ip.Is4() {
+			dns4 = append(dns4, ip.String())
+		} else {
+			dns6 = append(dns6, ip.String())
+		}
+	}
+	domains := append([]string(nil), cfg.Domains...)
+	for _, d := range cfg.Routes {
+		domains = append(domains, "~"+d)
+	}
+	if err := m.modify(strings.Join(dns4, ","), strings.Join(dns6, ","), strings.Join(domains, ","), cfg.DefaultRoute); err != nil {
+		return err
+	}
+	m.up = true
+	return nil
+}
+
+// Down implements dnsManager.
+func (m *nmManager) Down() error {
+	if !m.up {
+		return nil
+	}
+	if err := m.modify("", "", "", false); err != nil {
+		return err
+	}
+	m.up = false
+	if m.unmanage {
+		if err := m.cmd.run("nmcli", "device", "set", m.tunname, "managed", "no"); err != nil {
+			return fmt.Errorf("unmanaging %s in NetworkManager: %w", m.tunname, err)
+		}
+		m.unmanage = false
+	}
+	return nil
+}
+
+// modify reapplies the tun device's connection with the given
+// comma-separated nameservers and search domains, which take over
+// the system's DNS if exclusive.
+func (m *nmManager) modify(dns4, dns6, domains string, exclusive bool) error {
+	priority, ignoreAuto := "0", "no"
+	if exclusive {
+		priority, ignoreAuto = nmDNSPriority, "yes"
+	}
+	err := m.cmd.run("nmcli", "device", "modify", m.tunname,
+		"ipv4.dns", dns4,
+		"ipv4.dns-search", domains,
+		"ipv4.dns-priority", priority,
+		"ipv4.ignore-auto-dns", ignoreAuto,
+		"ipv6.dns", dns6,
+		"ipv6.dns-priority", priority,
+		"ipv6.ignore-auto-dns", ignoreAuto,
+	)
+	if err != nil {
+		return fmt.Errorf("setting DNS of %s in NetworkManager: %w", m.tunname, err)
+	}
+	return nil
+}
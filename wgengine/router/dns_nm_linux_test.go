@@ -0,0 +1,86 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+// cmdRecorder is a commandRunner that records the commands it's
+// asked to run.
+type cmdRecorder struct {
+	managed string // output of GENERAL.NM-MANAGED
+	cmds    []string
+}
+
+func (r *cmdRecorder) run(args ...string) error {
+	_, err := r.output(args...)
+	return err
+}
+
+func (r *cmdRecorder) runStdin(stdin []byte, args ...string) error {
+	return r.run(args...)
+}
+
+func (r *cmdRecorder) output(args ...string) ([]byte, error) {
+	cmd := strings.Join(args, " ")
+	r.cmds = append(r.cmds, cmd)
+	if strings.Contains(cmd, "GENERAL.NM-MANAGED") {
+		return []byte(r.managed + "\n"), nil
+	}
+	return nil, nil
+}
+
+func TestNMManager(t *testing.T) {
+	rec := &cmdRecorder{managed: "no"}
+	m := newNMManager(t.Logf, "tailscale0", rec)
+
+	ip6, err := netaddr.ParseIP("fd7a:115c:a1e0::53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := dnsConfig{
+		Nameservers:  []netaddr.IP{netaddr.IPv4(100, 100, 100, 100), ip6},
+		Domains:      []string{"example.ts.net", "corp.example.com"},
+		DefaultRoute: true,
+	}
+	if err := m.Up(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(cfg); err != nil {
+		t.Fatal(err)
+	}
+	split := dnsConfig{
+		Nameservers: []netaddr.IP{netaddr.IPv4(100, 100, 100, 100)},
+		Domains:     []string{"example.ts.net"},
+		Routes:      []string{"corp.example.com"},
+	}
+	if err := m.Up(split); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+
+	set := "nmcli device modify tailscale0 ipv4.dns 100.100.100.100 ipv4.dns-search example.ts.net,corp.example.com ipv4.dns-priority -50 ipv4.ignore-auto-dns yes ipv6.dns fd7a:115c:a1e0::53 ipv6.dns-priority -50 ipv6.ignore-auto-dns yes"
+	want := []string{
+		"nmcli -g GENERAL.NM-MANAGED device show tailscale0",
+		"nmcli device set tailscale0 managed yes",
+		set,
+		set,
+		"nmcli device modify tailscale0 ipv4.dns 100.100.100.100 ipv4.dns-search example.ts.net,~corp.example.com ipv4.dns-priority 0 ipv4.ignore-auto-dns no ipv6.dns  ipv6.dns-priority 0 ipv6.ignore-auto-dns no",
+		"nmcli device modify tailscale0 ipv4.dns  ipv4.dns-search  ipv4.dns-priority 0 ipv4.ignore-auto-dns no ipv6.dns  ipv6.dns-priority 0 ipv6.ignore-auto-dns no",
+		"nmcli device set tailscale0 managed no",
+	}
+	if got := strings.Join(rec.cmds, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"inet.af/netaddr"
+)
+
+const (
+	// nrptBase is where the DNS client reads locally configured
+	// Name Resolution Policy Table rules from, one subkey per rule.
+	nrptBase = `SYSTEM\CurrentControlSet\Services\Dnscache\Parameters\DnsPolicyConfig\`
+	// nrptRuleID names Tailscale's rule. It's fixed, so that a rule
+	// left behind by a tailscaled that crashed is found and removed
+	// by the next one.
+	nrptRuleID = `{5abe529b-675b-4486-8459-25a634dacc23}`
+
+	nrptConfigOptionsGenericDNS = 0x8 // use GenericDNSServers
+	nrptVersion                 = 0x2
+)
+
+var procDnsFlushResolverCache = windows.NewLazySystemDLL("dnsapi.dll").NewProc("DnsFlushResolverCache")
+
+// setNRPTRule installs an NRPT rule that sends queries for names
+// under domains to servers, or removes the rule if there are no
+// domains or servers. Unlike the interface's DNS servers, which
+// Windows may use for any name, the rule only affects those domains,
+// so this is how split DNS is done.
+func setNRPTRule(domains []string, servers []netaddr.IP) error {
+	if len(domains) == 0 || len(servers) == 0 {
+		return delNRPTRule()
+	}
+	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, nrptBase+nrptRuleID, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+	if err := key.SetStringsValue("Name", nrptNames(domains)); err != nil {
+		return err
+	}
+	ss := make([]string, len(servers))
+	for i, ip := range servers {
+		ss[i] = ip.String()
+	}
+	if err := key.SetStringValue("GenericDNSServers", strings.Join(ss, "; ")); err != nil {
+		return err
+	}
+	if err := key.SetDWordValue("ConfigOptions", nrptConfigOptionsGenericDNS); err != nil {
+		return err
+	}
+	if err := key.SetDWordValue("Version", nrptVersion); err != nil {
+		return err
+	}
+	if err := key.SetStringValue("IPSECCARestriction", ""); err != nil {
+		return err
+	}
+	flushDNSCache()
+	return nil
+}
+
+// delNRPTRule removes Tailscale's NRPT rule, if there is one.
+func delNRPTRule() error {
+	err := registry.DeleteKey(registry.LOCAL_MACHINE, nrptBase+nrptRuleID)
+	if err == registry.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	flushDNSCache()
+	return nil
+}
+
+// nrptNames returns the NRPT namespaces matching names under
+// domains. A leading period makes a namespace a suffix match.
+func nrptNames(domains []string) []string {
+	ret := make([]string, 0, len(domains))
+	seen := map[string]bool{}
+	for _, d := range domains {
+		d = "." + strings.Trim(strings.ToLower(d), ".")
+		if d == "." || seen[d] {
+			continue
+		}
+		seen[d] = true
+		ret = append(ret, d)
+	}
+	return ret
+}
+
+// flushDNSCache makes the DNS client drop cached answers, which
+// may have come from servers an NRPT change no longer applies to.
+func flushDNSCache() {
+	procDnsFlushResolverCache.Call()
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNRPTNames(t *testing.T) {
+	got := nrptNames([]string{"corp.example.com", "Tailscale.US.", ".corp.example.com", "", "."})
+	want := []string{".corp.example.com", ".tailscale.us"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"tailscale.com/types/logger"
+)
+
+// resolvconfStyle returns which resolvconf(8) generates resolv.conf:
+// "openresolv", "resolvconf" for Debian's, or "" if neither does.
+//
+// systemd-resolved also ships a resolvconf command, which configures
+// resolved rather than resolv.conf, so the command existing isn't
+// enough.
+func resolvconfStyle(cmd commandRunner) string {
+	if _, err := exec.LookPath("resolvconf"); err != nil {
+		return ""
+	}
+	if out, err := cmd.output("resolvconf", "--version"); err == nil && bytes.HasPrefix(out, []byte("openresolv")) {
+		return "openresolv"
+	}
+	if fi, err := os.Stat("/etc/resolvconf/run"); err == nil && fi.IsDir() {
+		return "resolvconf"
+	}
+	return ""
+}
+
+// resolvconfManager is a dnsManager that registers Tailscale's
+// nameservers with resolvconf(8), as Debian's resolvconf and
+// openresolv both accept, so that they're merged into the
+// resolv.conf it generates rather than overwritten the next time it
+// regenerates it.
+//
+// openresolv can also mark an interface's nameservers as the only
+// ones to use, which Up does for configurations with Exclusive set.
+type resolvconfManager struct {
+	logf    logger.Logf
+	tunname string
+	// openresolv is whether resolvconf is openresolv, rather
+	// than Debian's, which has no exclusive mode.
+	openresolv bool
+	// run runs a command with the given standard input.
+	run func(stdin []byte, args ...string) error
+
+	up bool // whether Up has registered nameservers
+}
+
+func newResolvconfManager(logf logger.Logf, tunname, style string, run func(stdin []byte, args ...string) error) *resolvconfManager {
+	return &resolvconfManager{
+		logf:       logf,
+		tunname:    tunname,
+		openresolv: style == "openresolv",
+		run:        run,
+	}
+}
+
+// Up implements dnsManager.
+func (m *resolvconfManager) Up(cfg dnsConfig) error {
+	if len(cfg.Nameservers) == 0 {
+		return m.Down()
+	}
+	var buf bytes.Buffer
+	writeResolvConf(&buf, cfg.Nameservers, cfg.Domains)
+	args := []string{"resolvconf", "-a", m.tunname}
+	if cfg.Exclusive && m.openresolv {
+		// Re-adding the interface without -x makes it
+		// non-exclusive again.
+		args = []string{"resolvconf", "-x", "-a", m.tunname}
+	}
+	if err := m.run(buf.Bytes(), args...); err != nil {
+		return fmt.Errorf("registering nameservers with resolvconf: %w", err)
+	}
+	m.up = true
+	return nil
+}
+
+// Down implements dnsManager.
+func (m *resolvconfManager) Down() error {
+	if !m.up {
+		return nil
+	}
+	if err := m.run(nil, "resolvconf", "-d", m.tunname); err != nil {
+		return fmt.Errorf("deregistering nameservers with resolvconf: %w", err)
+	}
+	m.up = false
+	return nil
+}
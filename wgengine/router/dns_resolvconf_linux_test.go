@@ -0,0 +1,82 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestResolvconfManager(t *testing.T) {
+	var cmds []string
+	run := func(stdin []byte, args ...string) error {
+		cmds = append(cmds, strings.Join(args, " ")+"\n"+string(stdin))
+		return nil
+	}
+	m := newResolvconfManager(t.Logf, "tailscale0", "resolvconf", run)
+
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := dnsConfig{
+		Nameservers: []netaddr.IP{netaddr.IPv4(100, 100, 100, 100)},
+		Domains:     []string{"example.ts.net"},
+	}
+	if err := m.Up(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(dnsConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"resolvconf -a tailscale0\nnameserver 100.100.100.100\nsearch example.ts.net\n",
+		"resolvconf -d tailscale0\n",
+	}
+	if got := strings.Join(cmds, "---\n"); got != strings.Join(want, "---\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", got, strings.Join(want, "---\n"))
+	}
+}
+
+func TestResolvconfManagerExclusive(t *testing.T) {
+	var cmds []string
+	run := func(stdin []byte, args ...string) error {
+		cmds = append(cmds, strings.Join(args, " "))
+		return nil
+	}
+	cfg := dnsConfig{
+		Nameservers:  []netaddr.IP{netaddr.IPv4(100, 100, 100, 100)},
+		DefaultRoute: true,
+		Exclusive:    true,
+	}
+	additive := cfg
+	additive.Exclusive = false
+
+	m := newResolvconfManager(t.Logf, "tailscale0", "openresolv", run)
+	for _, c := range []dnsConfig{cfg, additive} {
+		if err := m.Up(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Debian's resolvconf has no -x.
+	m = newResolvconfManager(t.Logf, "tailscale0", "resolvconf", run)
+	if err := m.Up(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"resolvconf -x -a tailscale0",
+		"resolvconf -a tailscale0",
+		"resolvconf -a tailscale0",
+	}
+	if got := strings.Join(cmds, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"tailscale.com/types/logger"
+)
+
+// resolvedStubPaths are the files that resolv.conf links to when
+// systemd-resolved manages it.
+var resolvedStubPaths = map[string]bool{
+	"/run/systemd/resolve/stub-resolv.conf": true,
+	"/run/systemd/resolve/resolv.conf":      true,
+	"/lib/systemd/resolv.conf":              true,
+	"/usr/lib/systemd/resolv.conf":          true,
+}
+
+// resolvedIsActive reports whether systemd-resolved is running and
+// so is where DNS configuration goes.
+//
+// The primary check is whether resolved owns org.freedesktop.resolve1
+// on the system bus and its unit is active, which works however
+// resolv.conf is set up: as a symlink to resolved's stub file, a copy
+// of it, or a bind mount. Only if busctl isn't available does it fall
+// back to whether resolv.conf is a symlink to one of resolved's files.
+func resolvedIsActive(cmd commandRunner) bool {
+	if _, err := exec.LookPath("busctl"); err == nil {
+		if err := cmd.run("busctl", "--system", "status", "org.freedesktop.resolve1"); err != nil {
+			return false
+		}
+		return cmd.run("systemctl", "is-active", "--quiet", "systemd-resolved") == nil
+	}
+	target, err := os.Readlink(resolvConf)
+	if err != nil {
+		return false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(resolvConf), target)
+	}
+	return resolvedStubPaths[filepath.Clean(target)]
+}
+
+// resolvedManager is a dnsManager that sets the tun device's DNS
+// configuration in systemd-resolved (org.freedesktop.resolve1) with
+// resolvectl, which calls SetLinkDNS, SetLinkDomains,
+// SetLinkDefaultRoute and RevertLink over D-Bus. Per-link
+// configuration is dropped by resolved when the link goes away, so a
+// crashed tailscaled leaves nothing behind.
+//
+// resolved sends each query to the links with the longest matching
+// domain, search or routing-only ("~domain"), and only queries that
+// match no link's domains to the links that are default routes. So
+// the tun device is a default route only if cfg.DefaultRoute is set,
+// and then it's also given the "~." routing domain, which makes it
+// take precedence over other links' default routes.
+type resolvedManager struct {
+	logf    logger.Logf
+	tunname string
+	cmd     commandRunner
+
+	up bool // whether Up has applied a configuration
+}
+
+func newResolvedManager(logf logger.Logf, tunname string, cmd commandRunner) *resolvedManager {
+	return &resolvedManager{
+		logf:    logf,
+		tunname: tunname,
+		cmd:     cmd,
+	}
+}
+
+// Up implements dnsManager.
+func (m *resolvedManager) Up(cfg dnsConfig) error {
+	if len(cfg.Nameservers) == 0 {
+		return m.Down()
+	}
+	args := []string{"resolvectl", "dns", m.tunname}
+	for _, ip := range cfg.Nameservers {
+		args = append(args, ip.String())
+	}
+	if err := m.cmd.run(args...); err != nil {
+		return fmt.Errorf("setting nameservers of %s in systemd-resolved: %w", m.tunname, err)
+	}
+	args = append([]string{"resolvectl", "domain", m.tunname}, cfg.Domains...)
+	for _, d := range cfg.Routes {
+		args = append(args, "~"+d)
+	}
+	if cfg.DefaultRoute {
+		args = append(args, "~.")
+	}
+	if len(args) == 3 {
+		// With no domains, resolvectl prints them rather than
+		// clearing them.
+		args = append(args, "")
+	}
+	if err := m.cmd.run(args...); err != nil {
+		return fmt.Errorf("setting domains of %s in systemd-resolved: %w", m.tunname, err)
+	}
+	if err := m.cmd.run("resolvectl", "default-route", m.tunname, strconv.FormatBool(cfg.DefaultRoute)); err != nil {
+		return fmt.Errorf("setting default route of %s in systemd-resolved: %w", m.tunname, err)
+	}
+	m.up = true
+	return nil
+}
+
+// Down implements dnsManager.
+func (m *resolvedManager) Down() error {
+	if !m.up {
+		return nil
+	}
+	if err := m.cmd.run("resolvectl", "revert", m.tunname); err != nil {
+		return fmt.Errorf("reverting DNS of %s in systemd-resolved: %w", m.tunname, err)
+	}
+	m.up = false
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestResolvedManager(t *testing.T) {
+	rec := new(cmdRecorder)
+	m := newResolvedManager(t.Logf, "tailscale0", rec)
+
+	if err := m.Up(dnsConfig{
+		Nameservers:  []netaddr.IP{netaddr.IPv4(100, 100, 100, 100), netaddr.IPv4(8, 8, 8, 8)},
+		DefaultRoute: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(dnsConfig{
+		Nameservers: []netaddr.IP{netaddr.IPv4(100, 100, 100, 100)},
+		Domains:     []string{"example.ts.net", "corp.example.com"},
+		Routes:      []string{"tailscale.us"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"resolvectl dns tailscale0 100.100.100.100 8.8.8.8",
+		"resolvectl domain tailscale0 ~.",
+		"resolvectl default-route tailscale0 true",
+		"resolvectl dns tailscale0 100.100.100.100",
+		"resolvectl domain tailscale0 example.ts.net corp.example.com ~tailscale.us",
+		"resolvectl default-route tailscale0 false",
+		"resolvectl revert tailscale0",
+	}
+	if got := strings.Join(rec.cmds, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
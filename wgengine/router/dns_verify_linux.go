@@ -0,0 +1,183 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// dnsProbeTimeout is how long a probe keeps retrying the
+	// lookup. Some backends, like systemd-resolved, take a moment
+	// to start using a new configuration.
+	dnsProbeTimeout = 5 * time.Second
+	// dnsProbeRetry is how long a probe waits between lookups.
+	dnsProbeRetry = 500 * time.Millisecond
+)
+
+// verifyingDNSManager is a dnsManager that, after each Up, probes the
+// system resolver in the background, and if cfg.ProbeName stopped
+// resolving, rolls back to the configuration that was in place
+// before.
+type verifyingDNSManager struct {
+	logf  logger.Logf
+	inner dnsManager
+	// probe reports whether the system resolver resolves name.
+	probe func(name string) error
+	// onChange, if non-nil, is called with the configuration left
+	// applied, or the zero dnsConfig if none, when a background
+	// verification changes it.
+	onChange func(dnsConfig)
+
+	// verifying is incremented while a verification goroutine
+	// runs, so tests can wait for it.
+	verifying sync.WaitGroup
+
+	mu   sync.Mutex // guards the following, and calls to inner
+	gen  int        // incremented by each Up and Down
+	up   bool       // whether inner has a configuration applied
+	last dnsConfig  // the configuration inner has applied, if up
+}
+
+func newVerifyingDNSManager(logf logger.Logf, inner dnsManager, probe func(name string) error) *verifyingDNSManager {
+	return &verifyingDNSManager{
+		logf:  logf,
+		inner: inner,
+		probe: probe,
+	}
+}
+
+// Up implements dnsManager.
+//
+// It applies cfg and returns without waiting for the probe, which
+// can take seconds. If the system then can't resolve cfg.ProbeName,
+// but can with the previous configuration, the previous one is
+// restored. If it can't with either, the network is assumed to be
+// down, and cfg is kept.
+func (m *verifyingDNSManager) Up(cfg dnsConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.inner.Up(cfg); err != nil {
+		return err
+	}
+	prev, prevUp := m.last, m.up
+	m.last, m.up = cfg, true
+	if prevUp && reflect.DeepEqual(cfg, prev) {
+		return nil
+	}
+	m.gen++
+	m.verifying.Add(1)
+	go m.verify(m.gen, cfg, prev, prevUp)
+	return nil
+}
+
+// verify probes the system resolver after Up applied cfg, replacing
+// prev, and rolls back if need be. It gives up as soon as a later Up
+// or Down supersedes gen.
+func (m *verifyingDNSManager) verify(gen int, cfg, prev dnsConfig, prevUp bool) {
+	defer m.verifying.Done()
+	probeErr := m.probe(cfg.ProbeName)
+	if probeErr == nil {
+		return
+	}
+
+	m.mu.Lock()
+	if m.gen != gen {
+		m.mu.Unlock()
+		return
+	}
+	m.logf("dns: %v with new configuration; rolling back", probeErr)
+	err := m.restoreLocked(prev, prevUp)
+	m.changedLocked()
+	m.mu.Unlock()
+	if err != nil {
+		m.logf("dns: rolling back after %v: %v", probeErr, err)
+		return
+	}
+
+	if err := m.probe(cfg.ProbeName); err == nil {
+		m.logf("dns: new configuration rolled back: %v", probeErr)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.gen != gen {
+		return
+	}
+	m.logf("dns: %v with previous configuration too; keeping new configuration", probeErr)
+	if err := m.inner.Up(cfg); err != nil {
+		m.logf("dns: reapplying new configuration: %v", err)
+		return
+	}
+	m.last, m.up = cfg, true
+	m.changedLocked()
+}
+
+// changedLocked calls m.onChange, if set, with the configuration
+// inner has applied.
+//
+// m.mu must be held.
+func (m *verifyingDNSManager) changedLocked() {
+	if m.onChange != nil {
+		m.onChange(m.last)
+	}
+}
+
+// restoreLocked returns inner to prev if up, or to the system's own
+// configuration if not.
+//
+// m.mu must be held.
+func (m *verifyingDNSManager) restoreLocked(prev dnsConfig, up bool) error {
+	if !up {
+		m.last, m.up = dnsConfig{}, false
+		return m.inner.Down()
+	}
+	if err := m.inner.Up(prev); err != nil {
+		return err
+	}
+	m.last, m.up = prev, true
+	return nil
+}
+
+// Down implements dnsManager.
+func (m *verifyingDNSManager) Down() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gen++
+	m.last, m.up = dnsConfig{}, false
+	return m.inner.Down()
+}
+
+// probeDNS looks up name through the C library, as most programs on
+// the system would, until it resolves or dnsProbeTimeout passes. If
+// there's no name to look up, or getent(1) isn't installed, it can't
+// tell, and reports success.
+func probeDNS(name string) error {
+	if _, err := netaddr.ParseIP(name); name == "" || err == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsProbeTimeout)
+	defer cancel()
+	for {
+		err := exec.CommandContext(ctx, "getent", "hosts", name).Run()
+		if err == nil || errors.Is(err, exec.ErrNotFound) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("can't resolve %s", name)
+		case <-time.After(dnsProbeRetry):
+		}
+	}
+}
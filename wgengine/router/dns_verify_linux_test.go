@@ -0,0 +1,138 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+// fakeDNSManager is a dnsManager recording the configuration it has
+// applied, and every call.
+type fakeDNSManager struct {
+	applied *dnsConfig // nil if down
+	calls   []string
+}
+
+func (m *fakeDNSManager) Up(cfg dnsConfig) error {
+	m.applied = &cfg
+	m.calls = append(m.calls, "up "+nameservers(cfg))
+	return nil
+}
+
+func (m *fakeDNSManager) Down() error {
+	m.applied = nil
+	m.calls = append(m.calls, "down")
+	return nil
+}
+
+func nameservers(cfg dnsConfig) string {
+	s := ""
+	for _, ns := range cfg.Nameservers {
+		s += ns.String()
+	}
+	return s
+}
+
+func TestVerifyingDNSManager(t *testing.T) {
+	good := dnsConfig{Nameservers: []netaddr.IP{netaddr.IPv4(100, 100, 100, 100)}, ProbeName: "control.example.com"}
+	bad := dnsConfig{Nameservers: []netaddr.IP{netaddr.IPv4(100, 64, 0, 1)}, ProbeName: "control.example.com"}
+
+	inner := new(fakeDNSManager)
+	offline := false
+	var probed []string
+	probe := func(name string) error {
+		probed = append(probed, name)
+		if offline || (inner.applied != nil && nameservers(*inner.applied) == nameservers(bad)) {
+			return errors.New("can't resolve")
+		}
+		return nil
+	}
+	m := newVerifyingDNSManager(t.Logf, inner, probe)
+	var changed []string
+	m.onChange = func(cfg dnsConfig) { changed = append(changed, nameservers(cfg)) }
+	check := func(name string, err error, wantCalls ...string) {
+		t.Helper()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		m.verifying.Wait()
+		if !reflect.DeepEqual(inner.calls, wantCalls) {
+			t.Errorf("%s: calls = %q; want %q", name, inner.calls, wantCalls)
+		}
+		inner.calls = nil
+	}
+
+	check("bad first", m.Up(bad), "up 100.64.0.1", "down")
+	check("good", m.Up(good), "up 100.100.100.100")
+	check("good again", m.Up(good), "up 100.100.100.100")
+	check("bad", m.Up(bad), "up 100.64.0.1", "up 100.100.100.100")
+	if !reflect.DeepEqual(inner.applied, &good) {
+		t.Errorf("after rollback, applied %v; want %v", inner.applied, good)
+	}
+	if want := []string{"", "100.100.100.100"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("onChange got %q; want %q", changed, want)
+	}
+	for _, name := range probed {
+		if name != "control.example.com" {
+			t.Errorf("probed %q; want control.example.com", name)
+		}
+	}
+
+	offline = true
+	check("offline", m.Up(bad), "up 100.64.0.1", "up 100.100.100.100", "up 100.64.0.1")
+	if !reflect.DeepEqual(inner.applied, &bad) {
+		t.Errorf("while offline, applied %v; want %v", inner.applied, bad)
+	}
+
+	check("down", m.Down(), "down")
+}
+
+func TestVerifyingDNSManagerSuperseded(t *testing.T) {
+	good := dnsConfig{Nameservers: []netaddr.IP{netaddr.IPv4(100, 100, 100, 100)}}
+	bad := dnsConfig{Nameservers: []netaddr.IP{netaddr.IPv4(100, 64, 0, 1)}}
+
+	inner := new(fakeDNSManager)
+	release := make(chan bool)
+	probe := func(name string) error {
+		if <-release {
+			return nil
+		}
+		return errors.New("can't resolve")
+	}
+	m := newVerifyingDNSManager(t.Logf, inner, probe)
+
+	// A probe that fails after a newer Up mustn't roll that back.
+	if err := m.Up(bad); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	release <- false
+	m.verifying.Wait()
+	if inner.applied != nil {
+		t.Errorf("applied %v after Down; want nothing", inner.applied)
+	}
+	if err := m.Up(good); err != nil {
+		t.Fatal(err)
+	}
+	release <- true
+	m.verifying.Wait()
+	if want := []string{"up 100.64.0.1", "down", "up 100.100.100.100"}; !reflect.DeepEqual(inner.calls, want) {
+		t.Errorf("calls = %q; want %q", inner.calls, want)
+	}
+}
+
+func TestProbeDNSSkips(t *testing.T) {
+	for _, name := range []string{"", "100.64.0.1", "fd7a:115c:a1e0::1"} {
+		if err := probeDNS(name); err != nil {
+			t.Errorf("probeDNS(%q) = %v; want nil", name, err)
+		}
+	}
+}
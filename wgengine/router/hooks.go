@@ -0,0 +1,213 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/tun"
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+// DefaultHookTimeout is how long a hook command may run if
+// Hooks.Timeout is zero.
+const DefaultHookTimeout = 10 * time.Second
+
+// Hooks are commands run as the router's configuration changes, such
+// as to update firewall rules or dynamic DNS. Each is split into
+// fields, like a shell command without quoting, and run with the
+// change described in its environment:
+//
+//	TS_HOOK            up, down or routes
+//	TS_INTERFACE       the tun device's name
+//	TS_ADDRESSES       the interface's Tailscale addresses
+//	TS_ROUTES          all routes into the interface
+//	TS_ROUTES_ADDED    routes added by this change
+//	TS_ROUTES_REMOVED  routes removed by this change
+//	TS_EXIT_NODE       1 if a default route goes to an exit node, else 0
+//
+// Lists are separated by spaces.
+type Hooks struct {
+	// Up runs when the interface gets addresses, and so starts
+	// carrying traffic.
+	Up string
+	// Down runs when the interface loses its addresses, because
+	// the node stopped or logged out, and when the router closes.
+	Down string
+	// Routes runs when the routes into the interface change,
+	// including when an exit node is picked or dropped. When
+	// coming up, it runs after Up; when going down, before Down.
+	Routes string
+	// Timeout is how long each command may run before it's
+	// killed. If zero, DefaultHookTimeout is used.
+	Timeout time.Duration
+}
+
+// IsZero reports whether h has no commands.
+func (h Hooks) IsZero() bool {
+	return h.Up == "" && h.Down == "" && h.Routes == ""
+}
+
+// WithHooks returns a Backend creating the routers of b, with the
+// hook commands run as their configuration changes.
+func WithHooks(b Backend, hooks Hooks) Backend {
+	if hooks.IsZero() {
+		return b
+	}
+	return func(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error) {
+		r, err := b(logf, wgdev, tundev)
+		if err != nil {
+			return nil, err
+		}
+		tunname, err := tundev.Name()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return &hookRouter{
+			Router:  r,
+			logf:    logf,
+			tunname: tunname,
+			hooks:   hooks,
+		}, nil
+	}
+}
+
+// hookRouter runs Hooks around another Router.
+type hookRouter struct {
+	Router
+	logf    logger.Logf
+	tunname string
+	hooks   Hooks
+
+	// addrs and routes are from the last Config set successfully.
+	addrs  []netaddr.IPPrefix
+	routes []netaddr.IPPrefix
+}
+
+func (r *hookRouter) Set(cfg *Config) error {
+	if cfg == nil {
+		cfg = &shutdownConfig
+	}
+	if err := r.Router.Set(cfg); err != nil {
+		// Hooks run when a later Set succeeds.
+		return err
+	}
+	r.changed(cfg.LocalAddrs, cfg.Routes)
+	return nil
+}
+
+func (r *hookRouter) Close() error {
+	err := r.Router.Close()
+	r.changed(nil, nil)
+	return err
+}
+
+func (r *hookRouter) DNSStatus() (DNSStatus, bool) {
+	if ds, ok := r.Router.(DNSStatuser); ok {
+		return ds.DNSStatus()
+	}
+	return DNSStatus{}, false
+}
+
+func (r *hookRouter) HealthWarnings() []string {
+	if hw, ok := r.Router.(HealthWarner); ok {
+		return hw.HealthWarnings()
+	}
+	return nil
+}
+
+// changed runs the hooks for going from the last addresses and
+// routes to addrs and routes.
+func (r *hookRouter) changed(addrs, routes []netaddr.IPPrefix) {
+	wasUp, up := len(r.addrs) > 0, len(addrs) > 0
+	added, removed := diffPrefixes(r.routes, routes)
+	r.addrs = append([]netaddr.IPPrefix(nil), addrs...)
+	r.routes = append([]netaddr.IPPrefix(nil), routes...)
+
+	env := hookEnv(r.tunname, addrs, routes, added, removed)
+	if up && !wasUp {
+		r.run("up", r.hooks.Up, env)
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		r.run("routes", r.hooks.Routes, env)
+	}
+	if wasUp && !up {
+		r.run("down", r.hooks.Down, env)
+	}
+}
+
+func (r *hookRouter) run(name, command string, env []string) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return
+	}
+	timeout := r.hooks.Timeout
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), append(env, "TS_HOOK="+name)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		r.logf("router: %s hook %q: %v\n%s", name, command, err, out)
+	}
+}
+
+// hookEnv returns the environment variables describing a change,
+// other than TS_HOOK.
+func hookEnv(tunname string, addrs, routes, added, removed []netaddr.IPPrefix) []string {
+	exitNode := "0"
+	for _, r := range routes {
+		if r.Bits == 0 {
+			exitNode = "1"
+		}
+	}
+	return []string{
+		"TS_INTERFACE=" + tunname,
+		"TS_ADDRESSES=" + joinPrefixes(addrs),
+		"TS_ROUTES=" + joinPrefixes(routes),
+		"TS_ROUTES_ADDED=" + joinPrefixes(added),
+		"TS_ROUTES_REMOVED=" + joinPrefixes(removed),
+		"TS_EXIT_NODE=" + exitNode,
+	}
+}
+
+// diffPrefixes returns the prefixes in new but not old, and those in
+// old but not new, in the order given.
+func diffPrefixes(old, new []netaddr.IPPrefix) (added, removed []netaddr.IPPrefix) {
+	had := make(map[netaddr.IPPrefix]bool, len(old))
+	for _, p := range old {
+		had[p] = true
+	}
+	have := make(map[netaddr.IPPrefix]bool, len(new))
+	for _, p := range new {
+		have[p] = true
+		if !had[p] {
+			added = append(added, p)
+		}
+	}
+	for _, p := range old {
+		if !have[p] {
+			removed = append(removed, p)
+		}
+	}
+	return added, removed
+}
+
+func joinPrefixes(ps []netaddr.IPPrefix) string {
+	ss := make([]string, len(ps))
+	for i, p := range ps {
+		ss[i] = p.String()
+	}
+	return strings.Join(ss, " ")
+}
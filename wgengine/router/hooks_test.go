@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestHookRouter(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook script is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+	script := filepath.Join(dir, "hook.sh")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+echo "$TS_HOOK $TS_INTERFACE exit=$TS_EXIT_NODE +[$TS_ROUTES_ADDED] -[$TS_ROUTES_REMOVED]" >> `+log+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &hookRouter{
+		Router:  fakeRouter{logf: func(string, ...interface{}) {}},
+		logf:    t.Logf,
+		tunname: "tailscale0",
+		hooks:   Hooks{Up: script, Down: script, Routes: script},
+	}
+	parse := func(s string) netaddr.IPPrefix {
+		t.Helper()
+		p, err := netaddr.ParseIPPrefix(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	addr := parse("100.101.102.103/32")
+	subnet := parse("10.0.0.0/8")
+	exit := parse("0.0.0.0/0")
+
+	steps := []*Config{
+		{LocalAddrs: []netaddr.IPPrefix{addr}, Routes: []netaddr.IPPrefix{subnet}},
+		{LocalAddrs: []netaddr.IPPrefix{addr}, Routes: []netaddr.IPPrefix{subnet}}, // no change
+		{LocalAddrs: []netaddr.IPPrefix{addr}, Routes: []netaddr.IPPrefix{subnet, exit}},
+		nil,
+	}
+	for _, cfg := range steps {
+		if err := r.Set(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close() // already down; runs nothing
+
+	got, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"up tailscale0 exit=0 +[10.0.0.0/8] -[]",
+		"routes tailscale0 exit=0 +[10.0.0.0/8] -[]",
+		"routes tailscale0 exit=1 +[0.0.0.0/0] -[]",
+		"routes tailscale0 exit=0 +[] -[10.0.0.0/8 0.0.0.0/0]",
+		"down tailscale0 exit=0 +[] -[10.0.0.0/8 0.0.0.0/0]",
+	}, "\n") + "\n"
+	if string(got) != want {
+		t.Errorf("hooks ran:\n%s\nwant:\n%s", got, want)
+	}
+}
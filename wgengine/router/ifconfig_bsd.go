@@ -0,0 +1,152 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build freebsd openbsd
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/net/route"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+// ifReq is struct ifreq, with the union as raw bytes.
+type ifReq struct {
+	Name [unix.IFNAMSIZ]byte
+	Data [16]byte
+}
+
+func inet4Sockaddr(ip [4]byte) unix.RawSockaddrInet4 {
+	return unix.RawSockaddrInet4{
+		Len:    unix.SizeofSockaddrInet4,
+		Family: unix.AF_INET,
+		Addr:   ip,
+	}
+}
+
+// ioctl runs the interface ioctl req with arg on an AF_INET datagram
+// socket, as ifconfig(8) does.
+func ioctl(req uint, arg unsafe.Pointer) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setIfUp sets or clears the IFF_UP flag on the interface named
+// ifname.
+func setIfUp(ifname string, up bool) error {
+	var ifr ifReq
+	copy(ifr.Name[:], ifname)
+	if err := ioctl(unix.SIOCGIFFLAGS, unsafe.Pointer(&ifr)); err != nil {
+		return fmt.Errorf("getting %s flags: %v", ifname, err)
+	}
+	// ifr_flags is the low 16 bits of the flags, at the start of
+	// the union.
+	flags := (*uint16)(unsafe.Pointer(&ifr.Data[0]))
+	if up {
+		*flags |= unix.IFF_UP
+	} else {
+		*flags &^= unix.IFF_UP
+	}
+	if err := ioctl(unix.SIOCSIFFLAGS, unsafe.Pointer(&ifr)); err != nil {
+		return fmt.Errorf("setting %s flags: %v", ifname, err)
+	}
+	return nil
+}
+
+// setIfAddr adds the IPv4 address p to the point-to-point interface
+// named ifname, or removes it if add is false. The kernel adds a
+// host route to the address along with it.
+func setIfAddr(ifname string, p netaddr.IPPrefix, add bool) error {
+	if !p.IP.Is4() {
+		return fmt.Errorf("%v: only IPv4 addresses are supported", p)
+	}
+	var ifra ifAliasReq
+	copy(ifra.Name[:], ifname)
+	ifra.Addr = inet4Sockaddr(p.IP.As4())
+	if !add {
+		// SIOCDIFADDR takes a struct ifreq, which ifaliasreq
+		// starts like.
+		if err := ioctl(unix.SIOCDIFADDR, unsafe.Pointer(&ifra)); err != nil {
+			return fmt.Errorf("removing %v from %s: %v", p, ifname, err)
+		}
+		return nil
+	}
+	var mask [4]byte
+	copy(mask[:], p.IPNet().Mask)
+	ifra.DstAddr = ifra.Addr
+	ifra.Mask = inet4Sockaddr(mask)
+	if err := ioctl(siocAIFADDR, unsafe.Pointer(&ifra)); err != nil {
+		return fmt.Errorf("adding %v to %s: %v", p, ifname, err)
+	}
+	return nil
+}
+
+// routeMessage returns the route(4) message of type typ
+// (unix.RTM_ADD or unix.RTM_DELETE) for the route to p through the
+// interface with index ifindex.
+func routeMessage(typ, seq, ifindex int, p netaddr.IPPrefix) ([]byte, error) {
+	n := p.IPNet()
+	dst, mask := n.IP.Mask(n.Mask), n.Mask
+	m := &route.RouteMessage{
+		Version: unix.RTM_VERSION,
+		Type:    typ,
+		Flags:   unix.RTF_UP | unix.RTF_STATIC,
+		Seq:     seq,
+		Addrs:   make([]route.Addr, unix.RTAX_NETMASK+1),
+	}
+	m.Addrs[unix.RTAX_GATEWAY] = &route.LinkAddr{Index: ifindex}
+	if p.IP.Is4() {
+		a, m4 := &route.Inet4Addr{}, &route.Inet4Addr{}
+		copy(a.IP[:], dst.To4())
+		copy(m4.IP[:], mask)
+		m.Addrs[unix.RTAX_DST], m.Addrs[unix.RTAX_NETMASK] = a, m4
+	} else {
+		a, m6 := &route.Inet6Addr{}, &route.Inet6Addr{}
+		copy(a.IP[:], dst.To16())
+		copy(m6.IP[:], mask)
+		m.Addrs[unix.RTAX_DST], m.Addrs[unix.RTAX_NETMASK] = a, m6
+	}
+	if ones, bits := mask.Size(); ones == bits {
+		m.Flags |= unix.RTF_HOST
+		m.Addrs = m.Addrs[:unix.RTAX_NETMASK]
+	}
+	return m.Marshal()
+}
+
+// writeRoute sends the route(4) message of type typ for p through
+// the interface with index ifindex. Adding a route that exists, or
+// deleting one that doesn't, isn't an error.
+func writeRoute(typ, seq, ifindex int, p netaddr.IPPrefix) error {
+	b, err := routeMessage(typ, seq, ifindex, p)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("opening routing socket: %v", err)
+	}
+	defer unix.Close(fd)
+	_, err = unix.Write(fd, b)
+	switch {
+	case err == nil:
+		return nil
+	case typ == unix.RTM_ADD && errors.Is(err, unix.EEXIST),
+		typ == unix.RTM_DELETE && errors.Is(err, unix.ESRCH):
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,27 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build freebsd openbsd
+
+package router
+
+import (
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestIoctlSizes(t *testing.T) {
+	// An ioctl request encodes the size of its argument in bits
+	// 16-28, which the kernel copies in.
+	size := func(req uint) uintptr { return uintptr(req>>16) & 0x1fff }
+
+	if got, want := unsafe.Sizeof(ifAliasReq{}), size(siocAIFADDR); got != want {
+		t.Errorf("sizeof ifAliasReq = %d; SIOCAIFADDR wants %d", got, want)
+	}
+	if got, want := unsafe.Sizeof(ifReq{}), size(unix.SIOCSIFFLAGS); got != want {
+		t.Errorf("sizeof ifReq = %d; SIOCSIFFLAGS wants %d", got, want)
+	}
+}
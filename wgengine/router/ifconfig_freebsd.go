@@ -0,0 +1,21 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import "golang.org/x/sys/unix"
+
+// siocAIFADDR is FreeBSD's SIOCAIFADDR, _IOW('i', 43, struct
+// ifaliasreq). x/sys/unix has the FreeBSD 9 one, which takes the
+// struct without ifra_vhid.
+const siocAIFADDR = 0x8044692b
+
+// ifAliasReq is FreeBSD's struct ifaliasreq, for an IPv4 address.
+type ifAliasReq struct {
+	Name    [unix.IFNAMSIZ]byte
+	Addr    unix.RawSockaddrInet4
+	DstAddr unix.RawSockaddrInet4
+	Mask    unix.RawSockaddrInet4
+	VHID    int32
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import "golang.org/x/sys/unix"
+
+// siocAIFADDR is OpenBSD's SIOCAIFADDR, _IOW('i', 26, struct
+// ifaliasreq).
+const siocAIFADDR = unix.SIOCAIFADDR
+
+// ifAliasReq is OpenBSD's struct ifaliasreq, for an IPv4 address.
+type ifAliasReq struct {
+	Name    [unix.IFNAMSIZ]byte
+	Addr    unix.RawSockaddrInet4
+	DstAddr unix.RawSockaddrInet4
+	Mask    unix.RawSockaddrInet4
+}
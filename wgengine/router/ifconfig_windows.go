@@ -281,7 +281,7 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) error {
 
 	foundDefault4 := false
 	foundDefault6 := false
-	for _, route := range cfg.Routes {
+	for _, route := range withoutLocalRoutes(cfg.Routes, cfg.LocalRoutes) {
 		if (route.IP.Is4() && firstGateway4 == nil) || (route.IP.Is6() && firstGateway6 == nil) {
 			return errors.New("Due to a Windows limitation, one cannot have interface routes without an interface address")
 		}
@@ -358,15 +358,29 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) error {
 		errAcc = err
 	}
 
+	// Windows may send any query to any interface's DNS servers,
+	// so they only go on the interface if they're to resolve
+	// everything. Otherwise an NRPT rule sends just the names they
+	// serve to them.
 	var dnsIPs []net.IP
-	for _, ip := range cfg.DNS {
-		dnsIPs = append(dnsIPs, ip.IPAddr().IP)
+	var nrptDomains []string
+	if cfg.DNSDefaultRoute {
+		for _, ip := range cfg.DNS {
+			dnsIPs = append(dnsIPs, ip.IPAddr().IP)
+		}
+	} else {
+		nrptDomains = append(append(nrptDomains, cfg.DNSDomains...), cfg.DNSRoutes...)
 	}
 	err = iface.SetDNS(dnsIPs)
 	if err != nil && errAcc == nil {
 		log.Printf("setdns: %v\n", err)
 		errAcc = err
 	}
+	err = setNRPTRule(nrptDomains, cfg.DNS)
+	if err != nil && errAcc == nil {
+		log.Printf("setNRPTRule: %v\n", err)
+		errAcc = err
+	}
 
 	ipif, err := iface.GetIpInterface(winipcfg.AF_INET)
 	if err != nil {
@@ -0,0 +1,18 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import "golang.org/x/sys/unix"
+
+// JailStatus reports whether the process runs in a FreeBSD jail and,
+// if so, whether the jail has its own VNET network stack rather than
+// sharing the host's.
+func JailStatus() (jailed, vnet bool) {
+	if n, err := unix.SysctlUint32("security.jail.jailed"); err != nil || n == 0 {
+		return false, false
+	}
+	n, err := unix.SysctlUint32("security.jail.vnet")
+	return true, err == nil && n != 0
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !freebsd
+
+package router
+
+// JailStatus reports whether the process runs in a FreeBSD jail and,
+// if so, whether the jail has its own VNET network stack. Jails only
+// exist on FreeBSD, so elsewhere it always reports false.
+func JailStatus() (jailed, vnet bool) {
+	return false, false
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"net"
+
+	"inet.af/netaddr"
+)
+
+// maxProxyNeighbors is the most addresses a single prefix in
+// Config.ProxyNeighbors may have, since each needs its own entry.
+const maxProxyNeighbors = 256
+
+// setProxyNeighbors makes the kernel answer ARP and NDP requests for
+// the addresses in prefixes on the LAN interfaces they belong to, so
+// that LAN hosts treat addresses reached over Tailscale as on-link,
+// replacing the entries set for earlier prefixes.
+//
+// IPv4 proxy entries need IP forwarding on, which subnet routers
+// already have; IPv6 ones also need proxy_ndp, which is turned on for
+// the interfaces used.
+func (r *linuxRouter) setProxyNeighbors(prefixes []netaddr.IPPrefix) error {
+	want := map[netaddr.IP]string{}
+	if len(prefixes) > 0 && r.lanPrefixes != nil {
+		lan, err := r.lanPrefixes()
+		if err != nil {
+			return fmt.Errorf("finding LAN interfaces for proxy ARP/NDP: %w", err)
+		}
+		for _, p := range prefixes {
+			iface := lanInterfaceFor(lan, p)
+			if iface == "" {
+				r.logf("proxy ARP/NDP: no interface is on the same subnet as %v; skipping it", p)
+				continue
+			}
+			ips, err := prefixAddrs(p)
+			if err != nil {
+				r.logf("proxy ARP/NDP: %v; skipping it", err)
+				continue
+			}
+			for _, ip := range ips {
+				want[ip] = iface
+			}
+		}
+	}
+
+	var errq error
+	for ip, iface := range r.proxyNeighbors {
+		if want[ip] == iface {
+			continue
+		}
+		if err := r.cmd.run("ip", "neigh", "del", "proxy", ip.String(), "dev", iface); err != nil && errq == nil {
+			errq = err
+		}
+		delete(r.proxyNeighbors, ip)
+	}
+	for ip, iface := range want {
+		if r.proxyNeighbors[ip] == iface {
+			continue
+		}
+		if ip.Is6() && !r.proxyNDP[iface] {
+			if err := r.cmd.run("sysctl", "-q", "-w", "net.ipv6.conf."+iface+".proxy_ndp=1"); err != nil {
+				if errq == nil {
+					errq = err
+				}
+				continue
+			}
+			if r.proxyNDP == nil {
+				r.proxyNDP = map[string]bool{}
+			}
+			r.proxyNDP[iface] = true
+		}
+		if err := r.cmd.run("ip", "neigh", "add", "proxy", ip.String(), "dev", iface); err != nil {
+			if errq == nil {
+				errq = err
+			}
+			continue
+		}
+		if r.proxyNeighbors == nil {
+			r.proxyNeighbors = map[netaddr.IP]string{}
+		}
+		r.proxyNeighbors[ip] = iface
+	}
+	return errq
+}
+
+// lanInterfaceFor returns the interface in lan, a map of interface
+// names to their subnets, whose subnet contains p, or "" if none does.
+func lanInterfaceFor(lan map[string][]netaddr.IPPrefix, p netaddr.IPPrefix) string {
+	for iface, subnets := range lan {
+		for _, s := range subnets {
+			if s.Bits <= p.Bits && s.Contains(p.IP) {
+				return iface
+			}
+		}
+	}
+	return ""
+}
+
+// prefixAddrs returns the addresses in p, which must have at most
+// maxProxyNeighbors of them.
+func prefixAddrs(p netaddr.IPPrefix) ([]netaddr.IP, error) {
+	bits := 128
+	if p.IP.Is4() {
+		bits = 32
+	}
+	if bits-int(p.Bits) > 8 {
+		return nil, fmt.Errorf("%v has more than %d addresses", p, maxProxyNeighbors)
+	}
+	ipn := p.IPNet()
+	base := ipn.IP.Mask(ipn.Mask)
+	n := 1 << uint(bits-int(p.Bits))
+	ret := make([]netaddr.IP, 0, n)
+	for i := 0; i < n; i++ {
+		b := make(net.IP, len(base))
+		copy(b, base)
+		b[len(b)-1] += byte(i)
+		ip, ok := netaddr.FromStdIP(b)
+		if !ok {
+			return nil, fmt.Errorf("bad address %v", b)
+		}
+		ret = append(ret, ip)
+	}
+	return ret, nil
+}
+
+// lanPrefixes returns the subnets of the interfaces other than the
+// tun device, by interface name.
+func lanPrefixes(tunname string) (map[string][]netaddr.IPPrefix, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string][]netaddr.IPPrefix{}
+	for _, iface := range ifaces {
+		if iface.Name == tunname || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netaddr.FromStdIP(ipn.IP)
+			if !ok {
+				continue
+			}
+			ones, _ := ipn.Mask.Size()
+			ret[iface.Name] = append(ret[iface.Name], netaddr.IPPrefix{IP: ip, Bits: uint8(ones)})
+		}
+	}
+	return ret, nil
+}
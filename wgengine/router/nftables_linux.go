@@ -0,0 +1,307 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// nftTable is the nftables table nftablesRunner keeps all its chains
+// in, whichever iptables table they stand for.
+const nftTable = "tailscale"
+
+// nftBaseChains are the nftables base chains standing for the
+// iptables built-in chains the router hooks into, keyed by
+// "table/chain", with their hook specifications. They're named
+// "table-CHAIN", like "filter-INPUT".
+var nftBaseChains = map[string]string{
+	"filter/INPUT":    "type filter hook input priority 0 ;",
+	"filter/FORWARD":  "type filter hook forward priority 0 ;",
+	"filter/OUTPUT":   "type filter hook output priority 0 ;",
+	"nat/POSTROUTING": "type nat hook postrouting priority 100 ;",
+}
+
+// nftablesRunner is a netfilterRunner that manages nftables with
+// nft(8) rather than iptables. On systems where iptables is the
+// nf_tables compatibility layer, rules added through it clash with
+// those of firewalld and Docker, which manage nftables natively.
+//
+// It translates the iptables arguments the router uses, and no
+// others, into nftables rules in the table nftTable of its family.
+// Each rule's comment is its iptables arguments, which is how Exists
+// and Delete find it again.
+type nftablesRunner struct {
+	cmd    commandRunner
+	family string // "ip" or "ip6", like iptables and ip6tables
+}
+
+func newNFTablesRunner(cmd commandRunner, family string) *nftablesRunner {
+	return &nftablesRunner{cmd: cmd, family: family}
+}
+
+// nftablesPreferred reports whether the router should manage
+// nftables itself: when nft is installed, and iptables is either
+// missing or the nf_tables compatibility layer. The legacy iptables
+// keeps being used where it's in use, since the two don't mix.
+func nftablesPreferred(cmd commandRunner) bool {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return false
+	}
+	out, err := cmd.output("iptables", "--version")
+	if err != nil {
+		return true
+	}
+	return bytes.Contains(out, []byte("nf_tables"))
+}
+
+// nftChain returns the nftables chain standing for the iptables chain
+// in table, and whether it's a base chain.
+func nftChain(table, chain string) (name string, base bool) {
+	if _, ok := nftBaseChains[table+"/"+chain]; ok {
+		return table + "-" + chain, true
+	}
+	return chain, false
+}
+
+// nftExpr translates the iptables rule args into an nftables rule's
+// statements.
+func nftExpr(args []string) ([]string, error) {
+	var ret []string
+	bad := func() ([]string, error) {
+		return nil, fmt.Errorf("nftables: can't translate %q", strings.Join(args, " "))
+	}
+	for i := 0; i < len(args); i++ {
+		op := ""
+		if args[i] == "!" {
+			op = "!="
+			i++
+		}
+		if i+1 >= len(args) {
+			return bad()
+		}
+		opt, val := args[i], args[i+1]
+		i++
+		withOp := func(s ...string) []string {
+			if op == "" {
+				return s
+			}
+			return append(s[:len(s)-1:len(s)-1], op, s[len(s)-1])
+		}
+		switch opt {
+		case "-i":
+			ret = append(ret, withOp("iifname", strconv.Quote(val))...)
+		case "-o":
+			ret = append(ret, withOp("oifname", strconv.Quote(val))...)
+		case "-s":
+			ret = append(ret, withOp(nftAddrFamily(val), "saddr", val)...)
+		case "-d":
+			ret = append(ret, withOp(nftAddrFamily(val), "daddr", val)...)
+		case "-m":
+			if i+2 >= len(args) {
+				return bad()
+			}
+			switch {
+			case val == "mark" && args[i+1] == "--mark":
+				mark, mask := args[i+2], ""
+				if j := strings.Index(mark, "/"); j >= 0 {
+					mark, mask = mark[:j], mark[j+1:]
+				}
+				ret = append(ret, "meta", "mark")
+				if mask != "" {
+					ret = append(ret, "and", mask)
+				}
+				if op == "" {
+					op = "=="
+				}
+				ret = append(ret, op, mark)
+			case val == "comment" && args[i+1] == "--comment":
+				// Part of the rule's identity, in its
+				// nftables comment.
+			default:
+				return bad()
+			}
+			i += 2
+		case "-j":
+			if op != "" {
+				return bad()
+			}
+			switch val {
+			case "ACCEPT", "DROP", "RETURN":
+				ret = append(ret, strings.ToLower(val))
+			case "MASQUERADE":
+				ret = append(ret, "masquerade")
+			case "MARK":
+				if i+2 >= len(args) || args[i+1] != "--set-mark" {
+					return bad()
+				}
+				ret = append(ret, "meta", "mark", "set", args[i+2])
+				i += 2
+			default:
+				ret = append(ret, "jump", val)
+			}
+		default:
+			return bad()
+		}
+	}
+	return ret, nil
+}
+
+// nftAddrFamily returns the nftables protocol of the address or
+// prefix addr, for matching on it.
+func nftAddrFamily(addr string) string {
+	if strings.Contains(addr, ":") {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// nftComment returns the comment identifying the rule with args.
+func nftComment(args []string) []string {
+	return []string{"comment", strconv.Quote(strings.Join(args, " "))}
+}
+
+// ensureChain creates nftTable and, if chain is a base chain, the
+// base chain, if they don't exist yet.
+func (n *nftablesRunner) ensureChain(table, chain string) error {
+	if err := n.cmd.run("nft", "add", "table", n.family, nftTable); err != nil {
+		return err
+	}
+	name, base := nftChain(table, chain)
+	if !base {
+		return nil
+	}
+	spec := strings.Fields(nftBaseChains[table+"/"+chain])
+	return n.cmd.run(append([]string{"nft", "add", "chain", n.family, nftTable, name, "{"}, append(spec, "}")...)...)
+}
+
+// handles returns the handles of the rules in the chain, in order,
+// and their comments. The chain not existing is reported as error
+// code 1, as by nft.
+func (n *nftablesRunner) handles(table, chain string) (handles, comments []string, err error) {
+	name, _ := nftChain(table, chain)
+	out, err := n.cmd.output("nft", "-a", "list", "chain", n.family, nftTable, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		i := strings.LastIndex(line, "# handle ")
+		if i < 0 || strings.HasPrefix(line, "chain ") || strings.HasPrefix(line, "table ") {
+			continue
+		}
+		comment := ""
+		if j := strings.Index(line, `comment "`); j >= 0 && j < i {
+			rest := line[j+len(`comment "`):]
+			if k := strings.Index(rest, `"`); k >= 0 {
+				comment = rest[:k]
+			}
+		}
+		handles = append(handles, strings.TrimSpace(line[i+len("# handle "):]))
+		comments = append(comments, comment)
+	}
+	return handles, comments, nil
+}
+
+// find returns the handle of the rule with args in the chain, or ""
+// if there's none.
+func (n *nftablesRunner) find(table, chain string, args []string) (string, error) {
+	handles, comments, err := n.handles(table, chain)
+	if err != nil {
+		return "", err
+	}
+	want := strings.Join(args, " ")
+	for i, c := range comments {
+		if c == want {
+			return handles[i], nil
+		}
+	}
+	return "", nil
+}
+
+// Insert implements netfilterRunner.
+func (n *nftablesRunner) Insert(table, chain string, pos int, args ...string) error {
+	expr, err := nftExpr(args)
+	if err != nil {
+		return err
+	}
+	if err := n.ensureChain(table, chain); err != nil {
+		return err
+	}
+	name, _ := nftChain(table, chain)
+	if pos <= 1 {
+		return n.cmd.run(append(append([]string{"nft", "insert", "rule", n.family, nftTable, name}, expr...), nftComment(args)...)...)
+	}
+	handles, _, err := n.handles(table, chain)
+	if err != nil {
+		return err
+	}
+	if pos-1 > len(handles) {
+		return fmt.Errorf("nftables: no position %d in %s/%s", pos, table, chain)
+	}
+	return n.cmd.run(append(append([]string{"nft", "add", "rule", n.family, nftTable, name, "position", handles[pos-2]}, expr...), nftComment(args)...)...)
+}
+
+// Append implements netfilterRunner.
+func (n *nftablesRunner) Append(table, chain string, args ...string) error {
+	expr, err := nftExpr(args)
+	if err != nil {
+		return err
+	}
+	if err := n.ensureChain(table, chain); err != nil {
+		return err
+	}
+	name, _ := nftChain(table, chain)
+	return n.cmd.run(append(append([]string{"nft", "add", "rule", n.family, nftTable, name}, expr...), nftComment(args)...)...)
+}
+
+// Exists implements netfilterRunner.
+func (n *nftablesRunner) Exists(table, chain string, args ...string) (bool, error) {
+	h, err := n.find(table, chain, args)
+	if errCode(err) == 1 {
+		return false, nil
+	}
+	return h != "", err
+}
+
+// Delete implements netfilterRunner.
+func (n *nftablesRunner) Delete(table, chain string, args ...string) error {
+	h, err := n.find(table, chain, args)
+	if err != nil {
+		return err
+	}
+	if h == "" {
+		return fmt.Errorf("nftables: no rule %q in %s/%s", strings.Join(args, " "), table, chain)
+	}
+	name, _ := nftChain(table, chain)
+	return n.cmd.run("nft", "delete", "rule", n.family, nftTable, name, "handle", h)
+}
+
+// ClearChain implements netfilterRunner. Like iptables, it fails
+// with error code 1 if the chain doesn't exist.
+func (n *nftablesRunner) ClearChain(table, chain string) error {
+	name, _ := nftChain(table, chain)
+	return n.cmd.run("nft", "flush", "chain", n.family, nftTable, name)
+}
+
+// NewChain implements netfilterRunner.
+func (n *nftablesRunner) NewChain(table, chain string) error {
+	if err := n.ensureChain(table, chain); err != nil {
+		return err
+	}
+	name, _ := nftChain(table, chain)
+	return n.cmd.run("nft", "add", "chain", n.family, nftTable, name)
+}
+
+// DeleteChain implements netfilterRunner.
+func (n *nftablesRunner) DeleteChain(table, chain string) error {
+	name, _ := nftChain(table, chain)
+	return n.cmd.run("nft", "delete", "chain", n.family, nftTable, name)
+}
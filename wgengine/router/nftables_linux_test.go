@@ -0,0 +1,120 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNFTExpr(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"-j ts-input", "jump ts-input"},
+		{"-i lo -s 100.101.102.103/32 -j ACCEPT", `iifname "lo" ip saddr 100.101.102.103/32 accept`},
+		{"! -i tailscale0 -s 100.64.0.0/10 -j DROP", `iifname != "tailscale0" ip saddr 100.64.0.0/10 drop`},
+		{"! -i tailscale0 -s fd7a:115c:a1e0::/48 -j DROP", `iifname != "tailscale0" ip6 saddr fd7a:115c:a1e0::/48 drop`},
+		{"-i tailscale0 -j MARK --set-mark 0x10000", `iifname "tailscale0" meta mark set 0x10000`},
+		{"-m mark --mark 0x10000 -j MASQUERADE", "meta mark == 0x10000 masquerade"},
+		{"-m mark --mark 0x20000/0x20000 -j RETURN", "meta mark and 0x20000 == 0x20000 return"},
+		{"-m comment --comment tailscale -o eth0 -j MASQUERADE", `oifname "eth0" masquerade`},
+	}
+	for _, tt := range tests {
+		got, err := nftExpr(strings.Fields(tt.args))
+		if err != nil {
+			t.Errorf("nftExpr(%q): %v", tt.args, err)
+			continue
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("nftExpr(%q) = %q; want %q", tt.args, strings.Join(got, " "), tt.want)
+		}
+	}
+
+	for _, bad := range []string{"-p tcp -j ACCEPT", "-j", "! -j DROP", "-j MARK --or-mark 1"} {
+		if _, err := nftExpr(strings.Fields(bad)); err == nil {
+			t.Errorf("nftExpr(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+// nftRecorder is a commandRunner standing in for nft, with a fixed
+// ruleset for "nft -a list chain" to print.
+type nftRecorder struct {
+	list string // output of "nft -a list chain", or "" if the chain doesn't exist
+	cmds []string
+}
+
+func (r *nftRecorder) run(args ...string) error {
+	_, err := r.output(args...)
+	return err
+}
+
+func (r *nftRecorder) runStdin(stdin []byte, args ...string) error {
+	return r.run(args...)
+}
+
+func (r *nftRecorder) output(args ...string) ([]byte, error) {
+	cmd := strings.Join(args, " ")
+	r.cmds = append(r.cmds, cmd)
+	if strings.HasPrefix(cmd, "nft -a list chain") {
+		if r.list == "" {
+			return nil, errors.New("exitcode:1")
+		}
+		return []byte(r.list), nil
+	}
+	return nil, nil
+}
+
+const nftTestList = `table ip tailscale {
+	chain filter-OUTPUT { # handle 3
+		type filter hook output priority filter; policy accept;
+		oifname "lo" comment "-o lo -j ACCEPT" # handle 7
+		jump ts-output comment "-j ts-output" # handle 9
+	}
+}
+`
+
+func TestNFTablesRunner(t *testing.T) {
+	rec := &nftRecorder{list: nftTestList}
+	n := newNFTablesRunner(rec, "ip")
+
+	if ok, err := n.Exists("filter", "OUTPUT", "-j", "ts-output"); err != nil || !ok {
+		t.Errorf("Exists(-j ts-output) = %v, %v; want true", ok, err)
+	}
+	if ok, err := n.Exists("filter", "OUTPUT", "-j", "DROP"); err != nil || ok {
+		t.Errorf("Exists(-j DROP) = %v, %v; want false", ok, err)
+	}
+	rec.cmds = nil
+	if err := n.Delete("filter", "OUTPUT", "-j", "ts-output"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Insert("filter", "OUTPUT", 2, "-j", "DROP"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"nft -a list chain ip tailscale filter-OUTPUT",
+		"nft delete rule ip tailscale filter-OUTPUT handle 9",
+		"nft add table ip tailscale",
+		"nft add chain ip tailscale filter-OUTPUT { type filter hook output priority 0 ; }",
+		"nft -a list chain ip tailscale filter-OUTPUT",
+		`nft add rule ip tailscale filter-OUTPUT position 7 drop comment "-j DROP"`,
+	}
+	if !reflect.DeepEqual(rec.cmds, want) {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(rec.cmds, "\n"), strings.Join(want, "\n"))
+	}
+
+	rec = &nftRecorder{}
+	n = newNFTablesRunner(rec, "ip")
+	if ok, err := n.Exists("nat", "POSTROUTING", "-j", "ts-postrouting"); err != nil || ok {
+		t.Errorf("Exists in missing chain = %v, %v; want false, nil", ok, err)
+	}
+	if err := n.Delete("nat", "POSTROUTING", "-j", "ts-postrouting"); errCode(err) != 1 {
+		t.Errorf("Delete in missing chain = %v; want error code 1", err)
+	}
+}
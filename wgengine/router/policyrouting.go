@@ -0,0 +1,78 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+
+	"tailscale.com/net/netns"
+)
+
+// PolicyRouting is how the Linux router keeps tailscaled's own
+// traffic off Tailscale's routes, and lets forwarded traffic through:
+// the packet marks it uses, and the routing table it puts Tailscale's
+// routes in. The defaults can collide with other VPNs and
+// policy-routing setups, which is what makes them configurable.
+type PolicyRouting struct {
+	// BypassMark marks tailscaled's own packets, which are routed
+	// with the main table rather than Tailscale's.
+	BypassMark uint32
+	// SubnetRouteMark marks packets from the Tailscale interface
+	// to advertised subnets, which are allowed to be forwarded.
+	SubnetRouteMark uint32
+	// Table is the routing table holding Tailscale's routes. Busybox's
+	// ip only supports tables up to 255.
+	Table uint32
+}
+
+// DefaultPolicyRouting is the policy routing used unless
+// SetPolicyRouting says otherwise.
+//
+// Its marks are out of the way of the lower byte, which sysadmins
+// tend to use, and of the second, where Kubernetes has a few bits.
+// Most documentation on packet marks gives the impression that they
+// are 16 bits wide, so the upper two bytes are relatively unused in
+// the wild, and the marks start at the 17th bit.
+var DefaultPolicyRouting = PolicyRouting{
+	BypassMark:      netns.DefaultBypassMark,
+	SubnetRouteMark: 0x10000,
+	Table:           88,
+}
+
+// policyRouting is the policy routing in use.
+var policyRouting = DefaultPolicyRouting
+
+// SetPolicyRouting sets the packet marks and routing table the Linux
+// router uses, including the bypass mark of netns's sockets. It must
+// be called before the router is created, and before any sockets are.
+func SetPolicyRouting(pr PolicyRouting) error {
+	if pr.BypassMark == 0 || pr.SubnetRouteMark == 0 {
+		return errors.New("packet marks must be non-zero")
+	}
+	if pr.BypassMark == pr.SubnetRouteMark {
+		return fmt.Errorf("bypass and subnet route marks are both %#x", pr.BypassMark)
+	}
+	switch pr.Table {
+	case 0, 253, 254, 255:
+		return fmt.Errorf("routing table %d is reserved (unspec, default, main and local are 0 and 253-255)", pr.Table)
+	}
+	policyRouting = pr
+	netns.SetBypassMark(pr.BypassMark)
+	return nil
+}
+
+// allowISPCGNAT is whether the Linux router lets in traffic from the
+// CGNAT-range subnets of other interfaces; see SetAllowISPCGNAT.
+var allowISPCGNAT bool
+
+// SetAllowISPCGNAT sets whether the Linux router lets in traffic from
+// the subnets of other interfaces that are in Tailscale's CGNAT range,
+// as when an ISP does carrier-grade NAT, from those interfaces. By
+// default, only traffic over Tailscale may come from that range. It
+// must be called before the router is created.
+func SetAllowISPCGNAT(allow bool) {
+	allowISPCGNAT = allow
+}
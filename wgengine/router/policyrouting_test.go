@@ -0,0 +1,33 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import "testing"
+
+func TestSetPolicyRouting(t *testing.T) {
+	defer SetPolicyRouting(DefaultPolicyRouting)
+
+	tests := []struct {
+		pr PolicyRouting
+		ok bool
+	}{
+		{DefaultPolicyRouting, true},
+		{PolicyRouting{BypassMark: 0x400000, SubnetRouteMark: 0x800000, Table: 1000}, true},
+		{PolicyRouting{BypassMark: 0, SubnetRouteMark: 0x10000, Table: 88}, false},
+		{PolicyRouting{BypassMark: 0x20000, SubnetRouteMark: 0x20000, Table: 88}, false},
+		{PolicyRouting{BypassMark: 0x20000, SubnetRouteMark: 0x10000, Table: 254}, false},
+		{PolicyRouting{BypassMark: 0x20000, SubnetRouteMark: 0x10000, Table: 0}, false},
+	}
+	for _, tt := range tests {
+		err := SetPolicyRouting(tt.pr)
+		if (err == nil) != tt.ok {
+			t.Errorf("SetPolicyRouting(%+v) = %v; want ok=%v", tt.pr, err, tt.ok)
+			continue
+		}
+		if tt.ok && policyRouting != tt.pr {
+			t.Errorf("after SetPolicyRouting(%+v), policyRouting = %+v", tt.pr, policyRouting)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/tun"
+	"tailscale.com/types/logger"
+)
+
+// A Backend creates a Router for a tun device. New is the backend for
+// the current platform.
+type Backend func(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error)
+
+var (
+	backendsMu sync.Mutex
+	backends   = map[string]Backend{}
+)
+
+func init() {
+	Register("fake", NewFake)
+}
+
+// Register makes the router backend b available as name, for Lookup
+// (and tailscaled's --router flag) to find.
+//
+// It's meant to be called from the init function of a package
+// providing routes and DNS for a platform this package doesn't
+// support, or supports differently (a router OS with its own
+// configuration API, say). Such a package lives outside this one and
+// is linked into tailscaled with a blank import, typically in a file
+// with a build tag, so that no router_*.go file needs editing:
+//
+//	// +build vyos
+//
+//	package main
+//
+//	import _ "example.com/tailscale-vyos/router" // registers "vyos"
+//
+// Register panics if name is empty or already registered.
+func Register(name string, b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if name == "" {
+		panic("router: Register with empty name")
+	}
+	if _, dup := backends[name]; dup {
+		panic("router: Register called twice for " + name)
+	}
+	backends[name] = b
+}
+
+// Lookup returns the backend registered as name, or New if name is
+// empty.
+func Lookup(name string) (Backend, error) {
+	if name == "" {
+		return New, nil
+	}
+	backendsMu.Lock()
+	b, ok := backends[name]
+	backendsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown router backend %q; have: %s", name, strings.Join(Backends(), ", "))
+	}
+	return b, nil
+}
+
+// Backends returns the names of the registered backends, sorted.
+func Backends() []string {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
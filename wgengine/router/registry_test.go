@@ -0,0 +1,47 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	if _, err := Lookup(""); err != nil {
+		t.Errorf("Lookup(\"\"): %v", err)
+	}
+	if _, err := Lookup("fake"); err != nil {
+		t.Errorf("Lookup(fake): %v", err)
+	}
+	if _, err := Lookup("test-registry"); err == nil {
+		t.Error("Lookup of unregistered backend succeeded")
+	}
+
+	// Platforms may register backends of their own, like Linux's
+	// "iptables" and "nftables".
+	want := append(Backends(), "test-registry")
+	sort.Strings(want)
+	Register("test-registry", NewFake)
+	defer func() {
+		backendsMu.Lock()
+		delete(backends, "test-registry")
+		backendsMu.Unlock()
+	}()
+	if _, err := Lookup("test-registry"); err != nil {
+		t.Errorf("Lookup after Register: %v", err)
+	}
+	if got := Backends(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Backends = %q; want %q", got, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice didn't panic")
+		}
+	}()
+	Register("test-registry", NewFake)
+}
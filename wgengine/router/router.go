@@ -29,6 +29,33 @@ type Router interface {
 	Close() error
 }
 
+// DNSStatuser is implemented by Routers that configure the system
+// resolver.
+type DNSStatuser interface {
+	// DNSStatus returns the DNS configuration the router last
+	// applied, or false if it doesn't manage DNS on this system.
+	DNSStatus() (DNSStatus, bool)
+}
+
+// HealthWarner is implemented by Routers that find problems with the
+// system's configuration that need the user's attention.
+type HealthWarner interface {
+	// HealthWarnings describes the problems currently found.
+	HealthWarnings() []string
+}
+
+// DNSStatus is the DNS configuration a Router applied to the system.
+type DNSStatus struct {
+	// Manager names how the system resolver is configured, such
+	// as "systemd-resolved" or "NRPT".
+	Manager string
+
+	Nameservers  []netaddr.IP
+	Domains      []string // search domains
+	Routes       []string // domains resolved by Nameservers, not searched
+	DefaultRoute bool     // whether Nameservers resolve all other names
+}
+
 // New returns a new Router for the current platform, using the
 // provided tun device.
 func New(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error) {
@@ -65,12 +92,72 @@ type Config struct {
 	DNS        []netaddr.IP
 	DNSDomains []string
 	Routes     []netaddr.IPPrefix // routes to point into the Tailscale interface
+	// LocalRoutes are local networks to keep reaching directly,
+	// rather than over Tailscale, even when Routes include a
+	// default route (an exit node) or routes overlapping them.
+	LocalRoutes []netaddr.IPPrefix
+
+	// DNSRoutes are domains, other than DNSDomains, whose names
+	// are resolved by the DNS servers. Unlike DNSDomains, they
+	// aren't searched.
+	DNSRoutes []string
+	// DNSDefaultRoute is whether the DNS servers resolve all names
+	// that no other interface's DNS configuration claims, rather
+	// than just those under DNSDomains and DNSRoutes.
+	DNSDefaultRoute bool
+	// DNSProbeName is a name, such as the control server's, that
+	// must keep resolving with the DNS settings applied. On Linux,
+	// settings that break it are rolled back. It's ignored if
+	// empty or an IP address.
+	DNSProbeName string
 
 	// Linux-only things below, ignored on other platforms.
 
 	SubnetRoutes     []netaddr.IPPrefix // subnets being advertised to other Tailscale nodes
 	SNATSubnetRoutes bool               // SNAT traffic to local subnets
+	ProxyNeighbors   []netaddr.IPPrefix // LAN addresses to answer ARP/NDP for
+	NoSNATFrom       []netaddr.IPPrefix // sources whose traffic to local subnets isn't SNATed
 	NetfilterMode    NetfilterMode      // how much to manage netfilter rules
+	KillSwitch       bool               // block outgoing traffic not going over Tailscale; also on Windows
+	Lockdown         bool               // keep KillSwitch in place when shutting down
+	NoExclusiveDNS   bool               // never make the DNS servers the only ones used
+}
+
+// withoutLocalRoutes returns routes without those within local, so
+// that the OS's more specific routes to the local networks win over
+// any less specific ones into Tailscale, like a default route.
+func withoutLocalRoutes(routes, local []netaddr.IPPrefix) []netaddr.IPPrefix {
+	if len(local) == 0 {
+		return routes
+	}
+	var ret []netaddr.IPPrefix
+	for _, r := range routes {
+		within := false
+		for _, l := range local {
+			if l.Bits <= r.Bits && l.Contains(r.IP) {
+				within = true
+				break
+			}
+		}
+		if !within {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// prefixesEqual reports whether a and b hold the same prefixes in the
+// same order, treating nil and empty alike.
+func prefixesEqual(a, b []netaddr.IPPrefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // shutdownConfig is a routing configuration that removes all router
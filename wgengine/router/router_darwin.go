@@ -5,6 +5,9 @@
 package router
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
 	"tailscale.com/types/logger"
@@ -14,6 +17,10 @@ type darwinRouter struct {
 	logf    logger.Logf
 	tunname string
 	Router
+
+	mu sync.Mutex
+	// dns is the DNS configuration last set in SystemConfiguration.
+	dns DNSStatus
 }
 
 func newUserspaceRouter(logf logger.Logf, _ *device.Device, tundev tun.Device) (Router, error) {
@@ -27,6 +34,14 @@ func newUserspaceRouter(logf logger.Logf, _ *device.Device, tundev tun.Device) (
 		return nil, err
 	}
 
+	if SetRoutesFunc == nil {
+		// Remove DNS settings left by a tailscaled that didn't
+		// shut down cleanly.
+		if err := setSCDNS(nil, nil, nil, false); err != nil {
+			logf("router: removing stale DNS settings: %v", err)
+		}
+	}
+
 	return &darwinRouter{
 		logf:    logf,
 		tunname: tunname,
@@ -43,7 +58,37 @@ func (r *darwinRouter) Set(cfg *Config) error {
 		return SetRoutesFunc(cfg)
 	}
 
-	return r.Router.Set(cfg)
+	errq := r.Router.Set(cfg)
+	if err := setSCDNS(cfg.DNS, cfg.DNSDomains, cfg.DNSRoutes, cfg.DNSDefaultRoute); err != nil {
+		if errq == nil {
+			errq = fmt.Errorf("setting DNS: %v", err)
+		}
+	} else {
+		r.setDNS(DNSStatus{
+			Nameservers:  cfg.DNS,
+			Domains:      cfg.DNSDomains,
+			Routes:       cfg.DNSRoutes,
+			DefaultRoute: cfg.DNSDefaultRoute,
+		})
+	}
+	return errq
+}
+
+func (r *darwinRouter) setDNS(ds DNSStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dns = ds
+}
+
+func (r *darwinRouter) DNSStatus() (DNSStatus, bool) {
+	if SetRoutesFunc != nil {
+		return DNSStatus{}, false // DNS is configured externally
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ds := r.dns
+	ds.Manager = "SystemConfiguration"
+	return ds, true
 }
 
 func (r *darwinRouter) Up() error {
@@ -52,3 +97,14 @@ func (r *darwinRouter) Up() error {
 	}
 	return r.Router.Up()
 }
+
+func (r *darwinRouter) Close() error {
+	if SetRoutesFunc != nil {
+		return r.Router.Close()
+	}
+	if err := setSCDNS(nil, nil, nil, false); err != nil {
+		r.logf("router: removing DNS settings: %v", err)
+	}
+	r.setDNS(DNSStatus{})
+	return r.Router.Close()
+}
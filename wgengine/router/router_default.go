@@ -2,16 +2,21 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build !windows,!linux,!darwin,!openbsd,!freebsd
+// +build !windows,!linux,!darwin,!openbsd,!freebsd,!solaris
 
 package router
 
 import (
+	"runtime"
+
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
 	"tailscale.com/types/logger"
 )
 
-func newUserspaceRouter(logf logger.Logf, tunname string, dev *device.Device, tuntap tun.Device, netChanged func()) Router {
-	return NewFakeRouter(logf, tunname, dev, tuntap, netChanged)
+// newUserspaceRouter returns a router that does nothing. Platforms
+// without built-in support can register a real one; see Register.
+func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error) {
+	logf("router: not supported on %s; routes and DNS must be configured by hand", runtime.GOOS)
+	return NewFake(logf, wgdev, tundev)
 }
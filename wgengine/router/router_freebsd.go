@@ -5,8 +5,17 @@
 package router
 
 import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
 	"tailscale.com/types/logger"
 )
 
@@ -15,6 +24,197 @@ import (
 // Work is currently underway for an in-kernel FreeBSD implementation of wireguard
 // https://svnweb.freebsd.org/base?view=revision&revision=357986
 
+// freebsdRouter configures the tun device's addresses with ioctls,
+// its routes through the routing socket, and DNS with resolvconf(8),
+// rather than by running ifconfig and route.
+type freebsdRouter struct {
+	logf    logger.Logf
+	tunname string
+	ifindex int
+	local   map[netaddr.IPPrefix]bool
+	routes  map[netaddr.IPPrefix]bool
+	seq     int // of the last routing socket message
+
+	// hostNet is whether the network stack belongs to the host, as in
+	// a FreeBSD jail without VNET, which may not configure interfaces
+	// or routes. The host then has to set up the tun device's address
+	// and routes, and the router only manages DNS.
+	hostNet bool
+
+	mu sync.Mutex // guards dns, which DNSStatus reads concurrently
+	// dns is the DNS configuration registered with resolvconf, if
+	// it has Nameservers.
+	dns DNSStatus
+}
+
 func newUserspaceRouter(logf logger.Logf, _ *device.Device, tundev tun.Device) (Router, error) {
-	return newUserspaceBSDRouter(logf, nil, tundev)
+	tunname, err := tundev.Name()
+	if err != nil {
+		return nil, err
+	}
+	ifc, err := net.InterfaceByName(tunname)
+	if err != nil {
+		return nil, err
+	}
+	r := &freebsdRouter{
+		logf:    logf,
+		tunname: tunname,
+		ifindex: ifc.Index,
+	}
+	if jailed, vnet := JailStatus(); jailed && !vnet {
+		logf("router: in a jail without VNET, which can't configure the host's network stack; %s's address and routes must be set up on the host", tunname)
+		r.hostNet = true
+	}
+	return r, nil
+}
+
+func (r *freebsdRouter) Up() error {
+	if r.hostNet {
+		return nil
+	}
+	return setIfUp(r.tunname, true)
+}
+
+func (r *freebsdRouter) Set(cfg *Config) error {
+	if cfg == nil {
+		cfg = &shutdownConfig
+	}
+
+	var errq error
+	if !r.hostNet {
+		local := make(map[netaddr.IPPrefix]bool)
+		for _, addr := range cfg.LocalAddrs {
+			if !addr.IP.Is4() {
+				r.logf("router: not adding %v to %s; IPv6 addresses aren't supported yet", addr, r.tunname)
+				continue
+			}
+			local[addr] = true
+		}
+		for addr := range r.local {
+			if !local[addr] {
+				if err := setIfAddr(r.tunname, addr, false); err != nil {
+					r.logf("addr del failed: %v", err)
+					if errq == nil {
+						errq = err
+					}
+				}
+			}
+		}
+		for addr := range local {
+			if !r.local[addr] {
+				if err := setIfAddr(r.tunname, addr, true); err != nil {
+					r.logf("addr add failed: %v", err)
+					if errq == nil {
+						errq = err
+					}
+				}
+			}
+		}
+		r.local = local
+
+		routes := make(map[netaddr.IPPrefix]bool)
+		for _, route := range withoutLocalRoutes(cfg.Routes, cfg.LocalRoutes) {
+			routes[route] = true
+		}
+		for route := range r.routes {
+			if !routes[route] {
+				if err := r.writeRoute(unix.RTM_DELETE, route); err != nil {
+					r.logf("route del failed: %v: %v", route, err)
+					if errq == nil {
+						errq = err
+					}
+				}
+			}
+		}
+		for route := range routes {
+			if !r.routes[route] {
+				if err := r.writeRoute(unix.RTM_ADD, route); err != nil {
+					r.logf("route add failed: %v: %v", route, err)
+					if errq == nil {
+						errq = err
+					}
+				}
+			}
+		}
+		r.routes = routes
+	}
+
+	if err := r.replaceResolvConf(cfg.DNS, cfg.DNSDomains); err != nil {
+		errq = fmt.Errorf("replacing resolv.conf failed: %v", err)
+	}
+
+	return errq
+}
+
+func (r *freebsdRouter) writeRoute(typ int, p netaddr.IPPrefix) error {
+	r.seq++
+	return writeRoute(typ, r.seq, r.ifindex, p)
+}
+
+func (r *freebsdRouter) Close() error {
+	return r.restoreResolvConf()
+}
+
+func (r *freebsdRouter) DNSStatus() (DNSStatus, bool) {
+	if _, err := exec.LookPath("resolvconf"); err != nil {
+		return DNSStatus{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ds := r.dns
+	ds.Manager = "resolvconf"
+	return ds, true
+}
+
+func (r *freebsdRouter) setDNS(ds DNSStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dns = ds
+}
+
+// replaceResolvConf registers servers and domains with resolvconf(8),
+// which FreeBSD ships as openresolv in the base system. resolv.conf is
+// per jail, so this works the same inside one. Where there's no
+// resolvconf, DNS is left alone.
+func (r *freebsdRouter) replaceResolvConf(servers []netaddr.IP, domains []string) error {
+	if len(servers) == 0 {
+		return r.restoreResolvConf()
+	}
+	if _, err := exec.LookPath("resolvconf"); err != nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, ns := range servers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ns)
+	}
+	if len(domains) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(domains, " "))
+	}
+	cmd := exec.Command("resolvconf", "-a", r.tunname)
+	cmd.Stdin = &buf
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("resolvconf -a: %v\n%s", err, out)
+	}
+	r.setDNS(DNSStatus{
+		Nameservers:  servers,
+		Domains:      domains,
+		DefaultRoute: true,
+	})
+	return nil
+}
+
+// restoreResolvConf removes the nameservers registered by
+// replaceResolvConf, if any.
+func (r *freebsdRouter) restoreResolvConf() error {
+	r.mu.Lock()
+	up := len(r.dns.Nameservers) > 0
+	r.mu.Unlock()
+	if !up {
+		return nil
+	}
+	if out, err := exec.Command("resolvconf", "-d", r.tunname).CombinedOutput(); err != nil {
+		return fmt.Errorf("resolvconf -d: %v\n%s", err, out)
+	}
+	r.setDNS(DNSStatus{})
+	return nil
 }
@@ -5,51 +5,43 @@
 package router
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"os/exec"
-	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
 	"inet.af/netaddr"
-	"tailscale.com/atomicfile"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/types/logger"
 )
 
-// The following bits are added to packet marks for Tailscale use.
-//
-// We tried to pick bits sufficiently out of the way that it's
-// unlikely to collide with existing uses. We have 4 bytes of mark
-// bits to play with. We leave the lower byte alone on the assumption
-// that sysadmins would use those. Kubernetes uses a few bits in the
-// second byte, so we steer clear of that too.
-//
-// Empirically, most of the documentation on packet marks on the
-// internet gives the impression that the marks are 16 bits
-// wide. Based on this, we theorize that the upper two bytes are
-// relatively unused in the wild, and so we consume bits starting at
-// the 17th.
-//
-// The constants are in the iptables/iproute2 string format for
-// matching and setting the bits, so they can be directly embedded in
+// The packet marks and routing table of policyRouting, in the
+// iptables/iproute2 string format, so they can be directly embedded in
 // commands.
-const (
-	// Packet is from Tailscale and to a subnet route destination, so
-	// is allowed to be routed through this machine.
-	tailscaleSubnetRouteMark = "0x10000"
-	// Packet was originated by tailscaled itself, and must not be
-	// routed over the Tailscale network.
-	//
-	// Keep this in sync with tailscaleBypassMark in
-	// net/netns/netns_linux.go.
-	tailscaleBypassMark = "0x20000"
-)
+
+// tailscaleSubnetRouteMark marks packets that are from Tailscale and
+// to a subnet route destination, so are allowed to be routed through
+// this machine.
+func tailscaleSubnetRouteMark() string {
+	return fmt.Sprintf("%#x", policyRouting.SubnetRouteMark)
+}
+
+// tailscaleBypassMark marks packets originated by tailscaled itself,
+// which must not be routed over the Tailscale network.
+func tailscaleBypassMark() string {
+	return fmt.Sprintf("%#x", policyRouting.BypassMark)
+}
+
+// tailscaleRouteTable is the routing table of Tailscale's routes.
+func tailscaleRouteTable() string {
+	return strconv.FormatUint(uint64(policyRouting.Table), 10)
+}
 
 // netfilterRunner abstracts helpers to run netfilter commands. It
 // exists purely to swap out go-iptables for a fake implementation in
@@ -72,23 +64,133 @@ type linuxRouter struct {
 	routes           map[netaddr.IPPrefix]bool
 	snatSubnetRoutes bool
 	netfilterMode    NetfilterMode
+	killSwitch       bool
+	lockdown         bool
+	// killSwitchLAN are the local networks the kill switch lets
+	// traffic through to.
+	killSwitchLAN []netaddr.IPPrefix
+	// localRoutes are the local networks whose ip rules route them
+	// by the main table, ahead of Tailscale's.
+	localRoutes map[netaddr.IPPrefix]bool
+	// snatExempt are the sources whose traffic to local subnets
+	// ts-postrouting lets through without SNAT.
+	snatExempt map[netaddr.IPPrefix]bool
+	// cgnatExempt are the CGNAT-range subnets of other interfaces
+	// whose traffic ts-input currently lets in from them.
+	cgnatExempt map[cgnatSubnet]bool
+	// cgnatWarning describes the CGNAT-range subnets of other
+	// interfaces, and which of them are routed over Tailscale, as
+	// last logged.
+	cgnatWarning string
+	// proxyNeighbors are the addresses answered for by proxy ARP or
+	// NDP, and the interface each is answered on.
+	proxyNeighbors map[netaddr.IP]string
+	// proxyNDP are the interfaces proxy_ndp was turned on for.
+	proxyNDP map[string]bool
 
 	ipt4 netfilterRunner
-	cmd  commandRunner
+	// ipt6 manages IPv6 netfilter when v6Available.
+	ipt6 netfilterRunner
+	// v6Available is whether the kernel has IPv6, and so the router
+	// configures IPv6 addresses, routes, rules and netfilter. It's
+	// off in tests unless they set it, with ipt6.
+	v6Available bool
+	// v6NAT is whether IPv6 netfilter has a nat table, which
+	// ts-postrouting's masquerading of IPv6 subnet routes needs.
+	v6NAT bool
+	cmd   commandRunner
+	// lanPrefixes, if non-nil, returns the subnets of interfaces
+	// other than the tun device. It's nil in tests.
+	lanPrefixes func() (map[string][]netaddr.IPPrefix, error)
+	// dns configures the system resolver, or is nil if DNS isn't
+	// managed. It's nil in tests.
+	dns dnsManager
+	// dnsName names the kind of manager dns is.
+	dnsName string
+
+	dnsMu sync.Mutex // guards dnsApplied, which DNSStatus reads concurrently
+	// dnsApplied is the DNS configuration dns has applied.
+	dnsApplied dnsConfig
+
+	warnMu sync.Mutex // guards conflicts, which HealthWarnings reads concurrently
+	// conflicts describe the other ip rules and routes found using
+	// policyRouting's marks and table when the rules were added.
+	conflicts []string
 }
 
-func newUserspaceRouter(logf logger.Logf, _ *device.Device, tunDev tun.Device) (Router, error) {
-	tunname, err := tunDev.Name()
+func init() {
+	Register("iptables", newIPTablesRouter)
+	Register("nftables", newNFTablesRouter)
+}
+
+// newUserspaceRouter returns a router that manages netfilter with
+// nft(8) where nftablesPreferred says so, and with iptables
+// otherwise. The "iptables" and "nftables" backends pick one
+// explicitly.
+func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tunDev tun.Device) (Router, error) {
+	if nftablesPreferred(osCommandRunner{}) {
+		logf("router: managing netfilter with nftables")
+		return newNFTablesRouter(logf, wgdev, tunDev)
+	}
+	return newIPTablesRouter(logf, wgdev, tunDev)
+}
+
+func newIPTablesRouter(logf logger.Logf, _ *device.Device, tunDev tun.Device) (Router, error) {
+	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	if err != nil {
 		return nil, err
 	}
+	var ipt6 netfilterRunner
+	if ipv6Enabled() {
+		ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+		if err != nil {
+			logf("router: not configuring IPv6: %v", err)
+		} else {
+			ipt6 = ipt
+		}
+	}
+	return newOSRouter(logf, tunDev, ipt4, ipt6, ip6tablesNAT())
+}
 
-	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+func newNFTablesRouter(logf logger.Logf, _ *device.Device, tunDev tun.Device) (Router, error) {
+	var nft6 netfilterRunner
+	if ipv6Enabled() {
+		nft6 = newNFTablesRunner(osCommandRunner{}, "ip6")
+	}
+	return newOSRouter(logf, tunDev, newNFTablesRunner(osCommandRunner{}, "ip"), nft6, true)
+}
+
+// newOSRouter returns a router for tunDev that manages netfilter with
+// netfilter, IPv6 netfilter with netfilter6 if it's non-nil, and
+// everything else with the system's own commands. v6NAT is whether
+// netfilter6 has a nat table.
+func newOSRouter(logf logger.Logf, tunDev tun.Device, netfilter, netfilter6 netfilterRunner, v6NAT bool) (Router, error) {
+	tunname, err := tunDev.Name()
 	if err != nil {
 		return nil, err
 	}
 
-	return newUserspaceRouterAdvanced(logf, tunname, ipt4, osCommandRunner{})
+	r, err := newUserspaceRouterAdvanced(logf, tunname, netfilter, osCommandRunner{})
+	if err != nil {
+		return nil, err
+	}
+	if netfilter6 != nil {
+		r.(*linuxRouter).ipt6 = netfilter6
+		r.(*linuxRouter).v6Available = true
+		r.(*linuxRouter).v6NAT = v6NAT
+		if !v6NAT {
+			logf("router: no IPv6 nat table; IPv6 subnet routes won't be masqueraded")
+		}
+	}
+	r.(*linuxRouter).lanPrefixes = func() (map[string][]netaddr.IPPrefix, error) {
+		return lanPrefixes(tunname)
+	}
+	dns, dnsName := newDNSManager(logf, tunname, osCommandRunner{})
+	vdns := newVerifyingDNSManager(logf, dns, probeDNS)
+	vdns.onChange = r.(*linuxRouter).setDNSApplied
+	r.(*linuxRouter).dns = vdns
+	r.(*linuxRouter).dnsName = dnsName
+	return r, nil
 }
 
 func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, netfilter netfilterRunner, cmd commandRunner) (Router, error) {
@@ -105,6 +207,76 @@ func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, netfilter netf
 	}, nil
 }
 
+// ipv6Enabled reports whether the kernel has IPv6, and it isn't
+// disabled.
+func ipv6Enabled() bool {
+	b, err := ioutil.ReadFile("/proc/sys/net/ipv6/conf/all/disable_ipv6")
+	return err == nil && strings.TrimSpace(string(b)) == "0"
+}
+
+// ip6tablesNAT reports whether ip6tables has a nat table, which
+// needs Linux 3.7 or later. The table is listed once its module is
+// loaded, which modprobe does if it's not yet.
+func ip6tablesNAT() bool {
+	b, err := ioutil.ReadFile("/proc/net/ip6_tables_names")
+	if err == nil && strings.Contains(string(b), "nat\n") {
+		return true
+	}
+	return exec.Command("modprobe", "ip6table_nat").Run() == nil
+}
+
+// netfilterFor returns the netfilter runner managing table for ip's
+// address family, or nil if the router doesn't manage it.
+func (r *linuxRouter) netfilterFor(ip netaddr.IP, table string) netfilterRunner {
+	if ip.Is4() {
+		return r.ipt4
+	}
+	return r.netfilter6(table)
+}
+
+// netfilter6 returns the IPv6 netfilter runner managing table, or
+// nil if the router doesn't manage it.
+func (r *linuxRouter) netfilter6(table string) netfilterRunner {
+	if !r.v6Available || table == "nat" && !r.v6NAT {
+		return nil
+	}
+	return r.ipt6
+}
+
+// forEachNetfilter calls f with the netfilter runner of each address
+// family whose table the router manages, stopping at the first error.
+func (r *linuxRouter) forEachNetfilter(table string, f func(ipt netfilterRunner) error) error {
+	if err := f(r.ipt4); err != nil {
+		return err
+	}
+	if ipt := r.netfilter6(table); ipt != nil {
+		return f(ipt)
+	}
+	return nil
+}
+
+// ipCommands returns the ip(8) invocation for each address family
+// the router manages: plain "ip" for IPv4, its default, and "ip -6".
+func (r *linuxRouter) ipCommands() [][]string {
+	if r.v6Available {
+		return [][]string{{"ip"}, {"ip", "-6"}}
+	}
+	return [][]string{{"ip"}}
+}
+
+// ipCommandFor returns the ip(8) invocation for ip's address family.
+func (r *linuxRouter) ipCommandFor(ip netaddr.IP) []string {
+	if ip.Is4() {
+		return []string{"ip"}
+	}
+	return []string{"ip", "-6"}
+}
+
+// withArgs returns cmd followed by args, without modifying cmd.
+func withArgs(cmd []string, args ...string) []string {
+	return append(cmd[:len(cmd):len(cmd)], args...)
+}
+
 func (r *linuxRouter) Up() error {
 	if err := r.delLegacyNetfilter(); err != nil {
 		return err
@@ -115,6 +287,17 @@ func (r *linuxRouter) Up() error {
 	if err := r.setNetfilterMode(NetfilterOff); err != nil {
 		return err
 	}
+	// A kill switch left behind by an earlier tailscaled, either
+	// because it was in lockdown or because it didn't shut down
+	// cleanly, stays in place until we get a config that says
+	// otherwise.
+	args := []string{"-j", "ts-output"}
+	exists, err := r.ipt4.Exists("filter", "OUTPUT", args...)
+	if err != nil {
+		return fmt.Errorf("checking for %v in filter/OUTPUT: %w", args, err)
+	}
+	r.killSwitch = exists
+	r.lockdown = exists
 	if err := r.upInterface(); err != nil {
 		return err
 	}
@@ -123,6 +306,9 @@ func (r *linuxRouter) Up() error {
 }
 
 func (r *linuxRouter) down() error {
+	if err := r.setProxyNeighbors(nil); err != nil {
+		return err
+	}
 	if err := r.downInterface(); err != nil {
 		return err
 	}
@@ -132,17 +318,26 @@ func (r *linuxRouter) down() error {
 	if err := r.setNetfilterMode(NetfilterOff); err != nil {
 		return err
 	}
+	if !r.lockdown {
+		if err := r.delKillSwitch(); err != nil {
+			return err
+		}
+	}
 
 	r.addrs = nil
 	r.routes = nil
+	r.localRoutes = nil
 
 	return nil
 }
 
 func (r *linuxRouter) Close() error {
 	var ret error
-	if ret = r.restoreResolvConf(); ret != nil {
-		r.logf("failed to restore system resolv.conf: %v", ret)
+	if r.dns != nil {
+		if ret = r.dns.Down(); ret != nil {
+			r.logf("failed to restore system DNS: %v", ret)
+		}
+		r.setDNSApplied(dnsConfig{})
 	}
 	if err := r.down(); err != nil {
 		if ret == nil {
@@ -155,7 +350,8 @@ func (r *linuxRouter) Close() error {
 
 // Set implements the Router interface.
 func (r *linuxRouter) Set(cfg *Config) error {
-	if cfg == nil {
+	shutdown := cfg == nil
+	if shutdown {
 		cfg = &shutdownConfig
 	}
 
@@ -163,6 +359,10 @@ func (r *linuxRouter) Set(cfg *Config) error {
 		return err
 	}
 
+	if err := r.updateCGNATExemptions(cfg.Routes); err != nil {
+		return err
+	}
+
 	newAddrs, err := cidrDiff("addr", r.addrs, cfg.LocalAddrs, r.addAddress, r.delAddress, r.logf)
 	if err != nil {
 		return err
@@ -175,6 +375,16 @@ func (r *linuxRouter) Set(cfg *Config) error {
 	}
 	r.routes = newRoutes
 
+	newLocalRoutes, err := cidrDiff("local route", r.localRoutes, cfg.LocalRoutes, r.addLocalRouteRule, r.delLocalRouteRule, r.logf)
+	if err != nil {
+		return err
+	}
+	r.localRoutes = newLocalRoutes
+
+	if err := r.setProxyNeighbors(cfg.ProxyNeighbors); err != nil {
+		return err
+	}
+
 	switch {
 	case cfg.SNATSubnetRoutes == r.snatSubnetRoutes:
 		// state already correct, nothing to do.
@@ -188,16 +398,69 @@ func (r *linuxRouter) Set(cfg *Config) error {
 		}
 	}
 	r.snatSubnetRoutes = cfg.SNATSubnetRoutes
+	if err := r.setSNATExemptions(cfg.NoSNATFrom); err != nil {
+		return err
+	}
+
+	killSwitch := cfg.KillSwitch || cfg.Lockdown
+	if shutdown && r.lockdown {
+		// Shutting down doesn't lift a lockdown, only a config
+		// without it does.
+		killSwitch = true
+	} else {
+		r.lockdown = cfg.Lockdown
+	}
+	switch {
+	case killSwitch == r.killSwitch && (!killSwitch || prefixesEqual(cfg.LocalRoutes, r.killSwitchLAN)):
+		// state already correct, nothing to do.
+	case killSwitch:
+		if err := r.addKillSwitch(cfg.LocalRoutes); err != nil {
+			return err
+		}
+	default:
+		if err := r.delKillSwitch(); err != nil {
+			return err
+		}
+	}
 
-	// TODO: this:
-	if false {
-		if err := r.replaceResolvConf(cfg.DNS, cfg.DNSDomains); err != nil {
-			return fmt.Errorf("replacing resolv.conf failed: %w", err)
+	if r.dns != nil {
+		dcfg := dnsConfig{
+			Nameservers:  cfg.DNS,
+			Domains:      cfg.DNSDomains,
+			Routes:       cfg.DNSRoutes,
+			DefaultRoute: cfg.DNSDefaultRoute,
+			Exclusive:    cfg.DNSDefaultRoute && !cfg.NoExclusiveDNS,
+			ProbeName:    cfg.DNSProbeName,
 		}
+		if err := r.dns.Up(dcfg); err != nil {
+			return fmt.Errorf("setting DNS: %w", err)
+		}
+		r.setDNSApplied(dcfg)
 	}
 	return nil
 }
 
+func (r *linuxRouter) setDNSApplied(cfg dnsConfig) {
+	r.dnsMu.Lock()
+	defer r.dnsMu.Unlock()
+	r.dnsApplied = cfg
+}
+
+func (r *linuxRouter) DNSStatus() (DNSStatus, bool) {
+	if r.dns == nil {
+		return DNSStatus{}, false
+	}
+	r.dnsMu.Lock()
+	defer r.dnsMu.Unlock()
+	return DNSStatus{
+		Manager:      r.dnsName,
+		Nameservers:  r.dnsApplied.Nameservers,
+		Domains:      r.dnsApplied.Domains,
+		Routes:       r.dnsApplied.Routes,
+		DefaultRoute: r.dnsApplied.DefaultRoute,
+	}, true
+}
+
 // setNetfilterMode switches the router to the given netfilter
 // mode. Netfilter state is created or deleted appropriately to
 // reflect the new mode, and r.snatSubnetRoutes is updated to reflect
@@ -244,6 +507,7 @@ func (r *linuxRouter) setNetfilterMode(mode NetfilterMode) error {
 			}
 		}
 		r.snatSubnetRoutes = false
+		r.snatExempt = nil
 	case NetfilterNoDivert:
 		switch r.netfilterMode {
 		case NetfilterOff:
@@ -255,6 +519,7 @@ func (r *linuxRouter) setNetfilterMode(mode NetfilterMode) error {
 				return err
 			}
 			r.snatSubnetRoutes = false
+			r.snatExempt = nil
 		case NetfilterOn:
 			if err := r.delNetfilterHooks(); err != nil {
 				return err
@@ -283,6 +548,7 @@ func (r *linuxRouter) setNetfilterMode(mode NetfilterMode) error {
 				return err
 			}
 			r.snatSubnetRoutes = false
+			r.snatExempt = nil
 		case NetfilterNoDivert:
 			reprocess = true
 			if err := r.delNetfilterBase(); err != nil {
@@ -295,6 +561,7 @@ func (r *linuxRouter) setNetfilterMode(mode NetfilterMode) error {
 				return err
 			}
 			r.snatSubnetRoutes = false
+			r.snatExempt = nil
 		}
 	default:
 		panic("unhandled netfilter mode")
@@ -315,106 +582,130 @@ func (r *linuxRouter) setNetfilterMode(mode NetfilterMode) error {
 	return nil
 }
 
-const (
-	tsConf     = "/etc/resolv.tailscale.conf"
-	backupConf = "/etc/resolv.pre-tailscale-backup.conf"
-	resolvConf = "/etc/resolv.conf"
-)
+// cgnatSubnet is a subnet in the CGNAT range on an interface other
+// than Tailscale's.
+type cgnatSubnet struct {
+	iface  string
+	prefix netaddr.IPPrefix
+}
 
-func (r *linuxRouter) replaceResolvConf(servers []netaddr.IP, domains []string) error {
-	if len(servers) == 0 {
-		return r.restoreResolvConf()
+func (s cgnatSubnet) String() string { return fmt.Sprintf("%v on %s", s.prefix, s.iface) }
+
+// cgnatSubnets returns the subnets in lan, the subnets of each
+// interface by name, that are in the CGNAT range Tailscale assigns
+// addresses from, as when an ISP does carrier-grade NAT. Subnets
+// larger than that range are cut down to it.
+func cgnatSubnets(lan map[string][]netaddr.IPPrefix) []cgnatSubnet {
+	var ret []cgnatSubnet
+	for iface, prefixes := range lan {
+		for _, p := range prefixes {
+			if !tsaddr.IsTailscaleIP(p.IP) {
+				continue
+			}
+			if p.Bits < tsaddr.CGNATRange().Bits {
+				p = tsaddr.CGNATRange()
+			}
+			n := p.IPNet()
+			ip, _ := netaddr.FromStdIP(n.IP.Mask(n.Mask))
+			ret = append(ret, cgnatSubnet{iface, netaddr.IPPrefix{IP: ip, Bits: p.Bits}})
+		}
 	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].String() < ret[j].String() })
+	return ret
+}
 
-	// First write the tsConf file.
-	buf := new(bytes.Buffer)
-	fmt.Fprintf(buf, "# resolv.conf(5) file generated by tailscale\n")
-	fmt.Fprintf(buf, "#     DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN\n\n")
-	for _, ns := range servers {
-		fmt.Fprintf(buf, "nameserver %s\n", ns)
-	}
-	if len(domains) > 0 {
-		fmt.Fprintf(buf, "search "+strings.Join(domains, " ")+"\n")
+// updateCGNATExemptions finds the CGNAT-range subnets of interfaces
+// other than Tailscale's, as when an ISP does carrier-grade NAT, and
+// warns about them: ts-input drops traffic from that range that
+// doesn't come over Tailscale, so the ISP's hosts there (often its
+// DNS servers) are unreachable.
+//
+// With SetAllowISPCGNAT, it lets traffic from each such subnet in
+// from its own interface. That's opt-in, as hosts on that subnet can
+// then pose as Tailscale peers with addresses in it. Peers are still
+// reached over Tailscale, as their routes are more specific and in a
+// table consulted first.
+func (r *linuxRouter) updateCGNATExemptions(routes []netaddr.IPPrefix) error {
+	if r.lanPrefixes == nil || r.netfilterMode == NetfilterOff {
+		return nil
 	}
-	f, err := ioutil.TempFile(filepath.Dir(tsConf), filepath.Base(tsConf)+".*")
+	lan, err := r.lanPrefixes()
 	if err != nil {
-		return err
-	}
-	f.Close()
-	if err := atomicfile.WriteFile(f.Name(), buf.Bytes(), 0644); err != nil {
-		return err
-	}
-	os.Chmod(f.Name(), 0644) // ioutil.TempFile creates the file with 0600
-	if err := os.Rename(f.Name(), tsConf); err != nil {
-		return err
+		// Not fatal; keep the exemptions we have.
+		r.logf("checking for CGNAT addresses: %v", err)
+		return nil
 	}
+	subnets := cgnatSubnets(lan)
 
-	if linkPath, err := os.Readlink(resolvConf); err != nil {
-		// Remove any old backup that may exist.
-		os.Remove(backupConf)
-
-		// Backup the existing /etc/resolv.conf file.
-		contents, err := ioutil.ReadFile(resolvConf)
-		if os.IsNotExist(err) {
-			// No existing /etc/resolv.conf file to backup.
-			// Nothing to do.
-			return nil
-		} else if err != nil {
-			return err
+	want := map[cgnatSubnet]bool{}
+	if allowISPCGNAT {
+		for _, s := range subnets {
+			want[s] = true
 		}
-		if err := atomicfile.WriteFile(backupConf, contents, 0644); err != nil {
-			return err
+	}
+	cgnatRule := func(s cgnatSubnet) []string {
+		return []string{"-i", s.iface, "-s", s.prefix.String(), "-j", "RETURN"}
+	}
+	for s := range r.cgnatExempt {
+		if want[s] {
+			continue
 		}
-	} else if linkPath != tsConf {
-		// Backup the existing symlink.
-		os.Remove(backupConf)
-		if err := os.Symlink(linkPath, backupConf); err != nil {
-			return err
+		args := cgnatRule(s)
+		if err := r.ipt4.Delete("filter", "ts-input", args...); err != nil {
+			return fmt.Errorf("deleting %v in filter/ts-input: %w", args, err)
 		}
-	} else {
-		// Nothing to do, resolvConf already points to tsConf.
-		return nil
+		delete(r.cgnatExempt, s)
 	}
-
-	os.Remove(resolvConf)
-	if err := os.Symlink(tsConf, resolvConf); err != nil {
-		return nil
-	}
-
-	out, _ := exec.Command("service", "systemd-resolved", "restart").CombinedOutput()
-	if len(out) > 0 {
-		r.logf("service systemd-resolved restart: %s", out)
+	for _, s := range subnets {
+		if !want[s] || r.cgnatExempt[s] {
+			continue
+		}
+		// Insert before ts-input's rule dropping CGNAT traffic from
+		// anywhere but Tailscale.
+		args := cgnatRule(s)
+		if err := r.ipt4.Insert("filter", "ts-input", 1, args...); err != nil {
+			return fmt.Errorf("adding %v in filter/ts-input: %w", args, err)
+		}
+		if r.cgnatExempt == nil {
+			r.cgnatExempt = make(map[cgnatSubnet]bool)
+		}
+		r.cgnatExempt[s] = true
 	}
-	return nil
-}
 
-func (r *linuxRouter) restoreResolvConf() error {
-	if _, err := os.Stat(backupConf); err != nil {
-		if os.IsNotExist(err) {
-			return nil // no backup resolv.conf to restore
+	var found, conflicts []string
+	for _, s := range subnets {
+		found = append(found, s.String())
+		for _, rt := range routes {
+			if rt.Bits > 0 && (rt.Contains(s.prefix.IP) || s.prefix.Contains(rt.IP)) {
+				conflicts = append(conflicts, fmt.Sprintf("%v (route %v)", s, rt))
+			}
 		}
-		return err
 	}
-	if ln, err := os.Readlink(resolvConf); err != nil {
-		return err
-	} else if ln != tsConf {
-		return fmt.Errorf("resolv.conf is not a symlink to %s", tsConf)
+	warning := strings.Join(found, ", ")
+	if len(conflicts) > 0 {
+		warning += "; routed over Tailscale: " + strings.Join(conflicts, ", ")
 	}
-	if err := os.Rename(backupConf, resolvConf); err != nil {
-		return err
+	if warning == r.cgnatWarning {
+		return nil
 	}
-	os.Remove(tsConf) // best effort removal of tsConf file
-	out, _ := exec.Command("service", "systemd-resolved", "restart").CombinedOutput()
-	if len(out) > 0 {
-		r.logf("service systemd-resolved restart: %s", out)
+	r.cgnatWarning = warning
+	switch {
+	case len(found) == 0:
+	case allowISPCGNAT:
+		r.logf("warning: subnets in Tailscale's range %v, likely from an ISP's carrier-grade NAT, allowed in from their interfaces: %s", tsaddr.CGNATRange(), warning)
+	default:
+		r.logf("warning: subnets in Tailscale's range %v, likely from an ISP's carrier-grade NAT, are unreachable: %s; see tailscaled --allow-isp-cgnat", tsaddr.CGNATRange(), warning)
 	}
 	return nil
 }
 
 // addAddress adds an IP/mask to the tunnel interface. Fails if the
 // address is already assigned to the interface, or if the addition
-// fails.
+// fails. IPv6 addresses are skipped if IPv6 isn't available.
 func (r *linuxRouter) addAddress(addr netaddr.IPPrefix) error {
+	if !r.v6Available && addr.IP.Is6() {
+		return nil
+	}
 	if err := r.cmd.run("ip", "addr", "add", addr.String(), "dev", r.tunname); err != nil {
 		return fmt.Errorf("adding address %q to tunnel interface: %w", addr, err)
 	}
@@ -428,6 +719,9 @@ func (r *linuxRouter) addAddress(addr netaddr.IPPrefix) error {
 // the address is not assigned to the interface, or if the removal
 // fails.
 func (r *linuxRouter) delAddress(addr netaddr.IPPrefix) error {
+	if !r.v6Available && addr.IP.Is6() {
+		return nil
+	}
 	if err := r.delLoopbackRule(addr.IP); err != nil {
 		return err
 	}
@@ -440,10 +734,11 @@ func (r *linuxRouter) delAddress(addr netaddr.IPPrefix) error {
 // addLoopbackRule adds a firewall rule to permit loopback traffic to
 // a local Tailscale IP.
 func (r *linuxRouter) addLoopbackRule(addr netaddr.IP) error {
-	if r.netfilterMode == NetfilterOff {
+	ipt := r.netfilterFor(addr, "filter")
+	if r.netfilterMode == NetfilterOff || ipt == nil {
 		return nil
 	}
-	if err := r.ipt4.Insert("filter", "ts-input", 1, "-i", "lo", "-s", addr.String(), "-j", "ACCEPT"); err != nil {
+	if err := ipt.Insert("filter", "ts-input", 1, "-i", "lo", "-s", addr.String(), "-j", "ACCEPT"); err != nil {
 		return fmt.Errorf("adding loopback allow rule for %q: %w", addr, err)
 	}
 	return nil
@@ -452,10 +747,11 @@ func (r *linuxRouter) addLoopbackRule(addr netaddr.IP) error {
 // delLoopbackRule removes the firewall rule permitting loopback
 // traffic to a Tailscale IP.
 func (r *linuxRouter) delLoopbackRule(addr netaddr.IP) error {
-	if r.netfilterMode == NetfilterOff {
+	ipt := r.netfilterFor(addr, "filter")
+	if r.netfilterMode == NetfilterOff || ipt == nil {
 		return nil
 	}
-	if err := r.ipt4.Delete("filter", "ts-input", "-i", "lo", "-s", addr.String(), "-j", "ACCEPT"); err != nil {
+	if err := ipt.Delete("filter", "ts-input", "-i", "lo", "-s", addr.String(), "-j", "ACCEPT"); err != nil {
 		return fmt.Errorf("deleting loopback allow rule for %q: %w", addr, err)
 	}
 	return nil
@@ -463,15 +759,18 @@ func (r *linuxRouter) delLoopbackRule(addr netaddr.IP) error {
 
 // addRoute adds a route for cidr, pointing to the tunnel
 // interface. Fails if the route already exists, or if adding the
-// route fails.
+// route fails. IPv6 routes are skipped if IPv6 isn't available.
 func (r *linuxRouter) addRoute(cidr netaddr.IPPrefix) error {
+	if !r.v6Available && cidr.IP.Is6() {
+		return nil
+	}
 	args := []string{
 		"ip", "route", "add",
 		normalizeCIDR(cidr),
 		"dev", r.tunname,
 	}
 	if r.ipRuleAvailable {
-		args = append(args, "table", "88")
+		args = append(args, "table", tailscaleRouteTable())
 	}
 	return r.cmd.run(args...)
 }
@@ -480,17 +779,48 @@ func (r *linuxRouter) addRoute(cidr netaddr.IPPrefix) error {
 // interface. Fails if the route doesn't exist, or if removing the
 // route fails.
 func (r *linuxRouter) delRoute(cidr netaddr.IPPrefix) error {
+	if !r.v6Available && cidr.IP.Is6() {
+		return nil
+	}
 	args := []string{
 		"ip", "route", "del",
 		normalizeCIDR(cidr),
 		"dev", r.tunname,
 	}
 	if r.ipRuleAvailable {
-		args = append(args, "table", "88")
+		args = append(args, "table", tailscaleRouteTable())
 	}
 	return r.cmd.run(args...)
 }
 
+// addLocalRouteRule adds an ip rule that routes traffic to the local
+// network cidr by the main table, ahead of Tailscale's routes, so that
+// it stays reachable with an exit node or an overlapping subnet route.
+func (r *linuxRouter) addLocalRouteRule(cidr netaddr.IPPrefix) error {
+	if !r.ipRuleAvailable || !r.v6Available && cidr.IP.Is6() {
+		return nil
+	}
+	return r.cmd.run(withArgs(r.ipCommandFor(cidr.IP),
+		"rule", "add",
+		"pref", "8870",
+		"to", normalizeCIDR(cidr),
+		"table", "main",
+	)...)
+}
+
+// delLocalRouteRule removes the ip rule added by addLocalRouteRule.
+func (r *linuxRouter) delLocalRouteRule(cidr netaddr.IPPrefix) error {
+	if !r.ipRuleAvailable || !r.v6Available && cidr.IP.Is6() {
+		return nil
+	}
+	return r.cmd.run(withArgs(r.ipCommandFor(cidr.IP),
+		"rule", "del",
+		"pref", "8870",
+		"to", normalizeCIDR(cidr),
+		"table", "main",
+	)...)
+}
+
 // upInterface brings up the tunnel interface.
 func (r *linuxRouter) upInterface() error {
 	return r.cmd.run("ip", "link", "set", "dev", r.tunname, "up")
@@ -514,6 +844,7 @@ func (r *linuxRouter) addIPRules() error {
 	if err := r.delIPRules(); err != nil {
 		return err
 	}
+	r.checkPolicyRoutingConflicts()
 
 	rg := newRunGroup(nil, r.cmd)
 
@@ -529,51 +860,170 @@ func (r *linuxRouter) addIPRules() error {
 	// checking for the lack of a fwmark, only the presence. The technique
 	// below works even on very old kernels.
 
-	// Packets from us, tagged with our fwmark, first try the kernel's
-	// main routing table.
-	rg.Run(
-		"ip", "rule", "add",
-		"pref", "8810",
-		"fwmark", tailscaleBypassMark,
-		"table", "main",
-	)
-	// ...and then we try the 'default' table, for correctness,
-	// even though it's been empty on every Linux system I've ever seen.
-	rg.Run(
-		"ip", "rule", "add",
-		"pref", "8830",
-		"fwmark", tailscaleBypassMark,
-		"table", "default",
-	)
-	// If neither of those matched (no default route on this system?)
-	// then packets from us should be aborted rather than falling through
-	// to the tailscale routes, because that would create routing loops.
-	rg.Run(
-		"ip", "rule", "add",
-		"pref", "8850",
-		"fwmark", tailscaleBypassMark,
-		"type", "unreachable",
-	)
-	// If we get to this point, capture all packets and send them
-	// through to table 88, the set of tailscale routes.
-	// For apps other than us (ie. with no fwmark set), this is the
-	// first routing table, so it takes precedence over all the others,
-	// ie. VPN routes always beat non-VPN routes.
-	//
-	// NOTE(apenwarr): tables >255 are not supported in busybox.
-	// I really wanted to use table 8888 here for symmetry, but no luck
-	// with busybox alas.
-	rg.Run(
-		"ip", "rule", "add",
-		"pref", "8888",
-		"table", "88",
-	)
-	// If that didn't match, then non-fwmark packets fall through to the
-	// usual rules (pref 32766 and 32767, ie. main and default).
+	// The same rules route IPv6, with ip -6.
+	for _, ip := range r.ipCommands() {
+		// Packets from us, tagged with our fwmark, first try the kernel's
+		// main routing table.
+		rg.Run(withArgs(ip,
+			"rule", "add",
+			"pref", "8810",
+			"fwmark", tailscaleBypassMark(),
+			"table", "main",
+		)...)
+		// ...and then we try the 'default' table, for correctness,
+		// even though it's been empty on every Linux system I've ever seen.
+		rg.Run(withArgs(ip,
+			"rule", "add",
+			"pref", "8830",
+			"fwmark", tailscaleBypassMark(),
+			"table", "default",
+		)...)
+		// If neither of those matched (no default route on this system?)
+		// then packets from us should be aborted rather than falling through
+		// to the tailscale routes, because that would create routing loops.
+		rg.Run(withArgs(ip,
+			"rule", "add",
+			"pref", "8850",
+			"fwmark", tailscaleBypassMark(),
+			"type", "unreachable",
+		)...)
+		// Local networks the config asks to keep reaching directly
+		// get rules at pref 8870 (see addLocalRouteRule), which Set
+		// adds as the config changes.
+
+		// If we get to this point, capture all packets and send them
+		// through to table 88, the set of tailscale routes.
+		// For apps other than us (ie. with no fwmark set), this is the
+		// first routing table, so it takes precedence over all the others,
+		// ie. VPN routes always beat non-VPN routes.
+		//
+		// NOTE(apenwarr): tables >255 are not supported in busybox.
+		// I really wanted to use table 8888 here for symmetry, but no luck
+		// with busybox alas.
+		rg.Run(withArgs(ip,
+			"rule", "add",
+			"pref", "8888",
+			"table", tailscaleRouteTable(),
+		)...)
+		// If that didn't match, then non-fwmark packets fall through to the
+		// usual rules (pref 32766 and 32767, ie. main and default).
+	}
 
 	return rg.ErrAcc
 }
 
+// checkPolicyRoutingConflicts looks for ip rules, other than
+// Tailscale's, that use its packet marks or routing table, and for
+// routes other than Tailscale's in its table, as another VPN or
+// policy-routing setup might add. Rather than fight over them, it
+// reports them, so that the marks and table can be moved out of the
+// way (see SetPolicyRouting). It must run while Tailscale's rules
+// are deleted.
+func (r *linuxRouter) checkPolicyRoutingConflicts() {
+	var conflicts []string
+	for _, ip := range r.ipCommands() {
+		if out, err := r.cmd.output(withArgs(ip, "rule", "list")...); err != nil {
+			r.logf("router: listing ip rules: %v", err)
+		} else {
+			conflicts = append(conflicts, ipRuleConflicts(out, policyRouting)...)
+		}
+		// Fails if the table doesn't exist yet, which is no conflict.
+		if out, err := r.cmd.output(withArgs(ip, "route", "show", "table", tailscaleRouteTable())...); err == nil {
+			conflicts = append(conflicts, routeTableConflicts(out, r.tunname, policyRouting.Table)...)
+		}
+	}
+	for _, c := range conflicts {
+		r.logf("router: policy routing conflict: %s", c)
+	}
+	r.warnMu.Lock()
+	defer r.warnMu.Unlock()
+	r.conflicts = conflicts
+}
+
+// ipRuleConflicts returns descriptions of the rules in out, the
+// output of "ip rule list", that use pr's routing table or match
+// packets carrying one of its marks.
+func ipRuleConflicts(out []byte, pr PolicyRouting) []string {
+	var ret []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		f := strings.Fields(line)
+		for i := 0; i+1 < len(f); i++ {
+			switch f[i] {
+			case "lookup", "table":
+				if f[i+1] == strconv.FormatUint(uint64(pr.Table), 10) {
+					ret = append(ret, fmt.Sprintf("ip rule %q uses Tailscale's routing table %d", line, pr.Table))
+				}
+			case "fwmark":
+				val, mask, ok := parseFwmark(f[i+1])
+				if !ok {
+					continue
+				}
+				for _, m := range []struct {
+					name string
+					mark uint32
+				}{
+					{"bypass", pr.BypassMark},
+					{"subnet route", pr.SubnetRouteMark},
+				} {
+					if m.mark&mask == val {
+						ret = append(ret, fmt.Sprintf("ip rule %q matches Tailscale's %s mark %#x", line, m.name, m.mark))
+					}
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// parseFwmark parses an ip rule fwmark selector, like 0x20000 or
+// 0x20000/0xff0000.
+func parseFwmark(s string) (val, mask uint32, ok bool) {
+	mask = 0xffffffff
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		m, err := strconv.ParseUint(s[i+1:], 0, 32)
+		if err != nil {
+			return 0, 0, false
+		}
+		mask, s = uint32(m), s[:i]
+	}
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return uint32(v), mask, true
+}
+
+// routeTableConflicts returns descriptions of the routes in out, the
+// output of "ip route show table", that point elsewhere than tunname.
+func routeTableConflicts(out []byte, tunname string, table uint32) []string {
+	var ret []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		f := strings.Fields(line)
+		isTUN := false
+		for i := 0; i+1 < len(f); i++ {
+			if f[i] == "dev" && f[i+1] == tunname {
+				isTUN = true
+			}
+		}
+		if len(f) > 0 && !isTUN {
+			ret = append(ret, fmt.Sprintf("route %q is in Tailscale's routing table %d", line, table))
+		}
+	}
+	return ret
+}
+
+// HealthWarnings implements HealthWarner. It reports policy routing
+// conflicts.
+func (r *linuxRouter) HealthWarnings() []string {
+	r.warnMu.Lock()
+	defer r.warnMu.Unlock()
+	var ret []string
+	for _, c := range r.conflicts {
+		ret = append(ret, "policy routing conflict: "+c+"; move Tailscale's out of the way with tailscaled's --fwmark, --subnet-route-fwmark or --routing-table")
+	}
+	return ret
+}
+
 // delBypassrule removes the policy routing rules that avoid
 // tailscaled routing loops, if it exists.
 func (r *linuxRouter) delIPRules() error {
@@ -605,41 +1055,56 @@ func (r *linuxRouter) delIPRules() error {
 	)
 
 	// Delete new-style tailscale rules.
-	rg.Run(
-		"ip", "rule", "del",
-		"pref", "8810",
-		"table", "main",
-	)
-	rg.Run(
-		"ip", "rule", "del",
-		"pref", "8830",
-		"table", "default",
-	)
-	rg.Run(
-		"ip", "rule", "del",
-		"pref", "8850",
-		"type", "unreachable",
-	)
-	rg.Run(
-		"ip", "rule", "del",
-		"pref", "8888",
-		"table", "88",
-	)
+	for _, ip := range r.ipCommands() {
+		rg.Run(withArgs(ip,
+			"rule", "del",
+			"pref", "8810",
+			"table", "main",
+		)...)
+		rg.Run(withArgs(ip,
+			"rule", "del",
+			"pref", "8830",
+			"table", "default",
+		)...)
+		rg.Run(withArgs(ip,
+			"rule", "del",
+			"pref", "8850",
+			"type", "unreachable",
+		)...)
+		rg.Run(withArgs(ip,
+			"rule", "del",
+			"pref", "8888",
+			"table", tailscaleRouteTable(),
+		)...)
+	}
+	for cidr := range r.localRoutes {
+		if !r.v6Available && cidr.IP.Is6() {
+			continue
+		}
+		rg.Run(withArgs(r.ipCommandFor(cidr.IP),
+			"rule", "del",
+			"pref", "8870",
+			"to", normalizeCIDR(cidr),
+			"table", "main",
+		)...)
+	}
 	return rg.ErrAcc
 }
 
 // addNetfilterChains creates custom Tailscale chains in netfilter.
 func (r *linuxRouter) addNetfilterChains() error {
 	create := func(table, chain string) error {
-		err := r.ipt4.ClearChain(table, chain)
-		if errCode(err) == 1 {
-			// nonexistent chain. let's create it!
-			return r.ipt4.NewChain(table, chain)
-		}
-		if err != nil {
-			return fmt.Errorf("setting up %s/%s: %w", table, chain, err)
-		}
-		return nil
+		return r.forEachNetfilter(table, func(ipt netfilterRunner) error {
+			err := ipt.ClearChain(table, chain)
+			if errCode(err) == 1 {
+				// nonexistent chain. let's create it!
+				return ipt.NewChain(table, chain)
+			}
+			if err != nil {
+				return fmt.Errorf("setting up %s/%s: %w", table, chain, err)
+			}
+			return nil
+		})
 	}
 	if err := create("filter", "ts-input"); err != nil {
 		return err
@@ -666,8 +1131,22 @@ func (r *linuxRouter) addNetfilterBase() error {
 	if err := r.ipt4.Append("filter", "ts-input", args...); err != nil {
 		return fmt.Errorf("adding %v in filter/ts-input: %w", args, err)
 	}
-	args = []string{"!", "-i", r.tunname, "-s", tsaddr.CGNATRange().String(), "-j", "DROP"}
-	if err := r.ipt4.Append("filter", "ts-input", args...); err != nil {
+	if err := r.addNetfilterFamilyBase(r.ipt4, tsaddr.CGNATRange()); err != nil {
+		return err
+	}
+	// IPv6 gets the same rules, with Tailscale's ULA range for the
+	// CGNAT range, which nothing else uses.
+	if ipt := r.netfilter6("filter"); ipt != nil {
+		return r.addNetfilterFamilyBase(ipt, tsaddr.TailscaleULARange())
+	}
+	return nil
+}
+
+// addNetfilterFamilyBase adds the basic rules of one address family
+// to ipt, in which Tailscale's addresses are tsRange.
+func (r *linuxRouter) addNetfilterFamilyBase(ipt netfilterRunner, tsRange netaddr.IPPrefix) error {
+	args := []string{"!", "-i", r.tunname, "-s", tsRange.String(), "-j", "DROP"}
+	if err := ipt.Append("filter", "ts-input", args...); err != nil {
 		return fmt.Errorf("adding %v in filter/ts-input: %w", args, err)
 	}
 
@@ -682,20 +1161,20 @@ func (r *linuxRouter) addNetfilterBase() error {
 	// POSTROUTING. So instead, we match on the inbound interface in
 	// filter/FORWARD, and set a packet mark that nat/POSTROUTING can
 	// use to effectively run that same test again.
-	args = []string{"-i", r.tunname, "-j", "MARK", "--set-mark", tailscaleSubnetRouteMark}
-	if err := r.ipt4.Append("filter", "ts-forward", args...); err != nil {
+	args = []string{"-i", r.tunname, "-j", "MARK", "--set-mark", tailscaleSubnetRouteMark()}
+	if err := ipt.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in filter/ts-forward: %w", args, err)
 	}
-	args = []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark, "-j", "ACCEPT"}
-	if err := r.ipt4.Append("filter", "ts-forward", args...); err != nil {
+	args = []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark(), "-j", "ACCEPT"}
+	if err := ipt.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in filter/ts-forward: %w", args, err)
 	}
-	args = []string{"-o", r.tunname, "-s", tsaddr.CGNATRange().String(), "-j", "DROP"}
-	if err := r.ipt4.Append("filter", "ts-forward", args...); err != nil {
+	args = []string{"-o", r.tunname, "-s", tsRange.String(), "-j", "DROP"}
+	if err := ipt.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in filter/ts-forward: %w", args, err)
 	}
 	args = []string{"-o", r.tunname, "-j", "ACCEPT"}
-	if err := r.ipt4.Append("filter", "ts-forward", args...); err != nil {
+	if err := ipt.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in filter/ts-forward: %w", args, err)
 	}
 
@@ -705,20 +1184,22 @@ func (r *linuxRouter) addNetfilterBase() error {
 // delNetfilterChains removes the custom Tailscale chains from netfilter.
 func (r *linuxRouter) delNetfilterChains() error {
 	del := func(table, chain string) error {
-		if err := r.ipt4.ClearChain(table, chain); err != nil {
-			if errCode(err) == 1 {
-				// nonexistent chain. That's fine, since it's
-				// the desired state anyway.
-				return nil
+		return r.forEachNetfilter(table, func(ipt netfilterRunner) error {
+			if err := ipt.ClearChain(table, chain); err != nil {
+				if errCode(err) == 1 {
+					// nonexistent chain. That's fine, since it's
+					// the desired state anyway.
+					return nil
+				}
+				return fmt.Errorf("flushing %s/%s: %w", table, chain, err)
 			}
-			return fmt.Errorf("flushing %s/%s: %w", table, chain, err)
-		}
-		if err := r.ipt4.DeleteChain(table, chain); err != nil {
-			// this shouldn't fail, because if the chain didn't
-			// exist, we would have returned after ClearChain.
-			return fmt.Errorf("deleting %s/%s: %v", table, chain, err)
-		}
-		return nil
+			if err := ipt.DeleteChain(table, chain); err != nil {
+				// this shouldn't fail, because if the chain didn't
+				// exist, we would have returned after ClearChain.
+				return fmt.Errorf("deleting %s/%s: %v", table, chain, err)
+			}
+			return nil
+		})
 	}
 
 	if err := del("filter", "ts-input"); err != nil {
@@ -738,15 +1219,17 @@ func (r *linuxRouter) delNetfilterChains() error {
 // netfilter.
 func (r *linuxRouter) delNetfilterBase() error {
 	del := func(table, chain string) error {
-		if err := r.ipt4.ClearChain(table, chain); err != nil {
-			if errCode(err) == 1 {
-				// nonexistent chain. That's fine, since it's
-				// the desired state anyway.
-				return nil
+		return r.forEachNetfilter(table, func(ipt netfilterRunner) error {
+			if err := ipt.ClearChain(table, chain); err != nil {
+				if errCode(err) == 1 {
+					// nonexistent chain. That's fine, since it's
+					// the desired state anyway.
+					return nil
+				}
+				return fmt.Errorf("flushing %s/%s: %w", table, chain, err)
 			}
-			return fmt.Errorf("flushing %s/%s: %w", table, chain, err)
-		}
-		return nil
+			return nil
+		})
 	}
 
 	if err := del("filter", "ts-input"); err != nil {
@@ -758,6 +1241,7 @@ func (r *linuxRouter) delNetfilterBase() error {
 	if err := del("nat", "ts-postrouting"); err != nil {
 		return err
 	}
+	r.cgnatExempt = nil
 
 	return nil
 }
@@ -770,17 +1254,19 @@ func (r *linuxRouter) addNetfilterHooks() error {
 		tsChain := tsChain(chain)
 
 		args := []string{"-j", tsChain}
-		exists, err := r.ipt4.Exists(table, chain, args...)
-		if err != nil {
-			return fmt.Errorf("checking for %v in %s/%s: %w", args, table, chain, err)
-		}
-		if exists {
+		return r.forEachNetfilter(table, func(ipt netfilterRunner) error {
+			exists, err := ipt.Exists(table, chain, args...)
+			if err != nil {
+				return fmt.Errorf("checking for %v in %s/%s: %w", args, table, chain, err)
+			}
+			if exists {
+				return nil
+			}
+			if err := ipt.Insert(table, chain, 1, args...); err != nil {
+				return fmt.Errorf("adding %v in %s/%s: %w", args, table, chain, err)
+			}
 			return nil
-		}
-		if err := r.ipt4.Insert(table, chain, 1, args...); err != nil {
-			return fmt.Errorf("adding %v in %s/%s: %w", args, table, chain, err)
-		}
-		return nil
+		})
 	}
 
 	if err := divert("filter", "INPUT"); err != nil {
@@ -801,16 +1287,17 @@ func (r *linuxRouter) delNetfilterHooks() error {
 	del := func(table, chain string) error {
 		tsChain := tsChain(chain)
 		args := []string{"-j", tsChain}
-		if err := r.ipt4.Delete(table, chain, args...); err != nil {
-			// TODO(apenwarr): check for errCode(1) here.
-			// Unfortunately the error code from the iptables
-			// module resists unwrapping, unlike with other
-			// calls. So we have to assume if Delete fails,
-			// it's because there is no such rule.
-			r.logf("note: deleting %v in %s/%s: %w", args, table, chain, err)
+		return r.forEachNetfilter(table, func(ipt netfilterRunner) error {
+			if err := ipt.Delete(table, chain, args...); err != nil {
+				// TODO(apenwarr): check for errCode(1) here.
+				// Unfortunately the error code from the iptables
+				// module resists unwrapping, unlike with other
+				// calls. So we have to assume if Delete fails,
+				// it's because there is no such rule.
+				r.logf("note: deleting %v in %s/%s: %w", args, table, chain, err)
+			}
 			return nil
-		}
-		return nil
+		})
 	}
 
 	if err := del("filter", "INPUT"); err != nil {
@@ -832,11 +1319,13 @@ func (r *linuxRouter) addSNATRule() error {
 		return nil
 	}
 
-	args := []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark, "-j", "MASQUERADE"}
-	if err := r.ipt4.Append("nat", "ts-postrouting", args...); err != nil {
-		return fmt.Errorf("adding %v in nat/ts-postrouting: %w", args, err)
-	}
-	return nil
+	args := []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark(), "-j", "MASQUERADE"}
+	return r.forEachNetfilter("nat", func(ipt netfilterRunner) error {
+		if err := ipt.Append("nat", "ts-postrouting", args...); err != nil {
+			return fmt.Errorf("adding %v in nat/ts-postrouting: %w", args, err)
+		}
+		return nil
+	})
 }
 
 // delSNATRule removes the netfilter rule to SNAT traffic destined for
@@ -846,10 +1335,146 @@ func (r *linuxRouter) delSNATRule() error {
 		return nil
 	}
 
-	args := []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark, "-j", "MASQUERADE"}
-	if err := r.ipt4.Delete("nat", "ts-postrouting", args...); err != nil {
-		return fmt.Errorf("deleting %v in nat/ts-postrouting: %w", args, err)
+	args := []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark(), "-j", "MASQUERADE"}
+	return r.forEachNetfilter("nat", func(ipt netfilterRunner) error {
+		if err := ipt.Delete("nat", "ts-postrouting", args...); err != nil {
+			return fmt.Errorf("deleting %v in nat/ts-postrouting: %w", args, err)
+		}
+		return nil
+	})
+}
+
+// setSNATExemptions makes traffic from the prefixes in from, such as
+// the subnets of other sites, keep its source address on its way to
+// local subnets, replacing the exemptions set earlier. IPv6 prefixes
+// are skipped unless IPv6 is masqueraded in the first place.
+func (r *linuxRouter) setSNATExemptions(from []netaddr.IPPrefix) error {
+	if r.netfilterMode == NetfilterOff {
+		return nil
+	}
+	want := map[netaddr.IPPrefix]bool{}
+	for _, p := range from {
+		if r.netfilterFor(p.IP, "nat") != nil {
+			want[p] = true
+		}
+	}
+	for p := range r.snatExempt {
+		if want[p] {
+			continue
+		}
+		args := snatExemptArgs(p)
+		if err := r.netfilterFor(p.IP, "nat").Delete("nat", "ts-postrouting", args...); err != nil {
+			return fmt.Errorf("deleting %v in nat/ts-postrouting: %w", args, err)
+		}
+		delete(r.snatExempt, p)
+	}
+	for _, p := range from {
+		if !want[p] || r.snatExempt[p] {
+			continue
+		}
+		// Inserted so as to come before the MASQUERADE rule.
+		args := snatExemptArgs(p)
+		if err := r.netfilterFor(p.IP, "nat").Insert("nat", "ts-postrouting", 1, args...); err != nil {
+			return fmt.Errorf("adding %v in nat/ts-postrouting: %w", args, err)
+		}
+		if r.snatExempt == nil {
+			r.snatExempt = map[netaddr.IPPrefix]bool{}
+		}
+		r.snatExempt[p] = true
+	}
+	return nil
+}
+
+func snatExemptArgs(p netaddr.IPPrefix) []string {
+	return []string{"-s", p.String(), "-m", "mark", "--mark", tailscaleSubnetRouteMark(), "-j", "RETURN"}
+}
+
+// addKillSwitch adds netfilter rules that drop all outgoing traffic
+// except traffic to the Tailscale interface, loopback traffic,
+// tailscaled's own traffic (which carries the bypass mark), and
+// traffic to the local networks lan, for both IPv4 and IPv6. If the
+// kill switch is already on, its rules are replaced.
+//
+// The kill switch uses its own chain and hook, and doesn't depend on
+// the netfilter mode: it's requested explicitly, and must stay in
+// effect regardless of how the rest of netfilter is managed.
+func (r *linuxRouter) addKillSwitch(lan []netaddr.IPPrefix) error {
+	const chain = "ts-output"
+	err := r.forEachNetfilter("filter", func(ipt netfilterRunner) error {
+		err := ipt.ClearChain("filter", chain)
+		if errCode(err) == 1 {
+			err = ipt.NewChain("filter", chain)
+		}
+		if err != nil {
+			return fmt.Errorf("setting up filter/%s: %w", chain, err)
+		}
+		rules := [][]string{
+			{"-o", "lo", "-j", "RETURN"},
+			{"-o", r.tunname, "-j", "RETURN"},
+			{"-m", "mark", "--mark", tailscaleBypassMark(), "-j", "RETURN"},
+		}
+		for _, p := range lan {
+			if r.netfilterFor(p.IP, "filter") == ipt {
+				rules = append(rules, []string{"-d", normalizeCIDR(p), "-j", "RETURN"})
+			}
+		}
+		rules = append(rules, []string{"-j", "DROP"})
+		for _, args := range rules {
+			if err := ipt.Append("filter", chain, args...); err != nil {
+				return fmt.Errorf("adding %v in filter/%s: %w", args, chain, err)
+			}
+		}
+
+		args := []string{"-j", chain}
+		exists, err := ipt.Exists("filter", "OUTPUT", args...)
+		if err != nil {
+			return fmt.Errorf("checking for %v in filter/OUTPUT: %w", args, err)
+		}
+		if !exists {
+			if err := ipt.Insert("filter", "OUTPUT", 1, args...); err != nil {
+				return fmt.Errorf("adding %v in filter/OUTPUT: %w", args, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.killSwitch = true
+	r.killSwitchLAN = lan
+	return nil
+}
+
+// delKillSwitch removes the netfilter rules added by addKillSwitch,
+// if they exist.
+func (r *linuxRouter) delKillSwitch() error {
+	const chain = "ts-output"
+	err := r.forEachNetfilter("filter", func(ipt netfilterRunner) error {
+		args := []string{"-j", chain}
+		exists, err := ipt.Exists("filter", "OUTPUT", args...)
+		if err != nil {
+			return fmt.Errorf("checking for %v in filter/OUTPUT: %w", args, err)
+		}
+		if exists {
+			if err := ipt.Delete("filter", "OUTPUT", args...); err != nil {
+				return fmt.Errorf("deleting %v in filter/OUTPUT: %w", args, err)
+			}
+		}
+		if err := ipt.ClearChain("filter", chain); err != nil {
+			if errCode(err) != 1 {
+				return fmt.Errorf("flushing filter/%s: %w", chain, err)
+			}
+			// nonexistent chain, nothing more to do.
+		} else if err := ipt.DeleteChain("filter", chain); err != nil {
+			return fmt.Errorf("deleting filter/%s: %v", chain, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	r.killSwitch = false
+	r.killSwitchLAN = nil
 	return nil
 }
 
@@ -115,6 +115,35 @@ filter/ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
 filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
 nat/POSTROUTING -j ts-postrouting
 nat/ts-postrouting -m mark --mark 0x10000 -j MASQUERADE
+`,
+		},
+		{
+			name: "site to site",
+			in: &Config{
+				LocalAddrs:       mustCIDRs("100.101.102.104/10"),
+				Routes:           mustCIDRs("100.100.100.100/32", "10.0.0.0/8"),
+				SubnetRoutes:     mustCIDRs("200.0.0.0/8"),
+				SNATSubnetRoutes: true,
+				NoSNATFrom:       mustCIDRs("10.0.0.0/8", "fd00::/64"),
+				NetfilterMode:    NetfilterOn,
+			},
+			want: `
+up
+ip addr add 100.101.102.104/10 dev tailscale0
+ip route add 10.0.0.0/8 dev tailscale0 table 88
+ip route add 100.100.100.100/32 dev tailscale0 table 88` + basic +
+				`filter/FORWARD -j ts-forward
+filter/INPUT -j ts-input
+filter/ts-forward -i tailscale0 -j MARK --set-mark 0x10000
+filter/ts-forward -m mark --mark 0x10000 -j ACCEPT
+filter/ts-forward -o tailscale0 -s 100.64.0.0/10 -j DROP
+filter/ts-forward -o tailscale0 -j ACCEPT
+filter/ts-input -i lo -s 100.101.102.104 -j ACCEPT
+filter/ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
+filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
+nat/POSTROUTING -j ts-postrouting
+nat/ts-postrouting -s 10.0.0.0/8 -m mark --mark 0x10000 -j RETURN
+nat/ts-postrouting -m mark --mark 0x10000 -j MASQUERADE
 `,
 		},
 		{
@@ -236,6 +265,57 @@ filter/ts-input -i lo -s 100.101.102.104 -j ACCEPT
 filter/ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
 filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
 nat/POSTROUTING -j ts-postrouting
+`,
+		},
+
+		{
+			name: "addr and routes with kill switch",
+			in: &Config{
+				LocalAddrs:    mustCIDRs("100.101.102.104/10"),
+				Routes:        mustCIDRs("100.100.100.100/32", "0.0.0.0/0"),
+				NetfilterMode: NetfilterOff,
+				KillSwitch:    true,
+			},
+			want: `
+up
+ip addr add 100.101.102.104/10 dev tailscale0
+ip route add 0.0.0.0/0 dev tailscale0 table 88
+ip route add 100.100.100.100/32 dev tailscale0 table 88` + basic +
+				`filter/OUTPUT -j ts-output
+filter/ts-output -o lo -j RETURN
+filter/ts-output -o tailscale0 -j RETURN
+filter/ts-output -m mark --mark 0x20000 -j RETURN
+filter/ts-output -j DROP
+`,
+		},
+		{
+			name: "addr and routes with netfilter and kill switch",
+			in: &Config{
+				LocalAddrs:    mustCIDRs("100.101.102.104/10"),
+				Routes:        mustCIDRs("100.100.100.100/32", "0.0.0.0/0"),
+				NetfilterMode: NetfilterOn,
+				KillSwitch:    true,
+			},
+			want: `
+up
+ip addr add 100.101.102.104/10 dev tailscale0
+ip route add 0.0.0.0/0 dev tailscale0 table 88
+ip route add 100.100.100.100/32 dev tailscale0 table 88` + basic +
+				`filter/FORWARD -j ts-forward
+filter/INPUT -j ts-input
+filter/OUTPUT -j ts-output
+filter/ts-forward -i tailscale0 -j MARK --set-mark 0x10000
+filter/ts-forward -m mark --mark 0x10000 -j ACCEPT
+filter/ts-forward -o tailscale0 -s 100.64.0.0/10 -j DROP
+filter/ts-forward -o tailscale0 -j ACCEPT
+filter/ts-input -i lo -s 100.101.102.104 -j ACCEPT
+filter/ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
+filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
+filter/ts-output -o lo -j RETURN
+filter/ts-output -o tailscale0 -j RETURN
+filter/ts-output -m mark --mark 0x20000 -j RETURN
+filter/ts-output -j DROP
+nat/POSTROUTING -j ts-postrouting
 `,
 		},
 	}
@@ -275,6 +355,474 @@ nat/POSTROUTING -j ts-postrouting
 	}
 }
 
+func TestRouterLockdown(t *testing.T) {
+	const killSwitch = `filter/OUTPUT -j ts-output
+filter/ts-output -o lo -j RETURN
+filter/ts-output -o tailscale0 -j RETURN
+filter/ts-output -m mark --mark 0x20000 -j RETURN
+filter/ts-output -j DROP`
+
+	fake := NewFakeOS(t)
+	newRouter := func() *linuxRouter {
+		t.Helper()
+		r, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", fake, fake)
+		if err != nil {
+			t.Fatalf("failed to create router: %v", err)
+		}
+		if err := r.Up(); err != nil {
+			t.Fatalf("failed to up router: %v", err)
+		}
+		return r.(*linuxRouter)
+	}
+	check := func(want string) {
+		t.Helper()
+		if got := fake.String(); !strings.HasSuffix(got, want) {
+			t.Fatalf("unexpected OS state:\n%s\n\nwant suffix:\n%s", got, want)
+		}
+	}
+
+	r := newRouter()
+	if err := r.Set(&Config{KillSwitch: true, Lockdown: true}); err != nil {
+		t.Fatal(err)
+	}
+	check(killSwitch)
+
+	// Neither shutting down nor a restart lifts the lockdown.
+	if err := r.Set(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.down(); err != nil {
+		t.Fatal(err)
+	}
+	check("down\n" + killSwitch)
+	r = newRouter()
+	if err := r.Set(nil); err != nil {
+		t.Fatal(err)
+	}
+	check(killSwitch)
+
+	// A config without lockdown does.
+	if err := r.Set(&Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.String(); strings.Contains(got, "ts-output") {
+		t.Fatalf("kill switch still in place after lockdown was lifted:\n%s", got)
+	}
+}
+
+func TestRouterLocalRoutes(t *testing.T) {
+	fake, fake6 := NewFakeOS(t), NewFakeOS(t)
+	ri, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", fake, fake)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	r := ri.(*linuxRouter)
+	if !r.ipRuleAvailable {
+		t.Skip("ip rule not available")
+	}
+	r.ipt6 = fake6
+	r.v6Available = true
+	if err := r.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	check := func(fake *fakeOS, want, notWant []string) {
+		t.Helper()
+		got := fake.String()
+		for _, w := range want {
+			if !strings.Contains(got, w) {
+				t.Errorf("OS state lacks %q:\n%s", w, got)
+			}
+		}
+		for _, w := range notWant {
+			if strings.Contains(got, w) {
+				t.Errorf("OS state has %q:\n%s", w, got)
+			}
+		}
+	}
+	set := func(local ...string) {
+		t.Helper()
+		if err := r.Set(&Config{
+			LocalAddrs:  mustCIDRs("100.101.102.104/10", "fd7a:115c:a1e0::1/128"),
+			Routes:      mustCIDRs("0.0.0.0/0", "::/0"),
+			LocalRoutes: mustCIDRs(local...),
+			KillSwitch:  true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set("192.168.1.0/24", "fd00:1::/64")
+	check(fake, []string{
+		"ip rule add pref 8870 to 192.168.1.0/24 table main",
+		"ip -6 rule add pref 8870 to fd00:1::/64 table main",
+		"filter/ts-output -d 192.168.1.0/24 -j RETURN\nfilter/ts-output -j DROP",
+	}, []string{"-d fd00:1::/64"})
+	check(fake6, []string{"filter/ts-output -d fd00:1::/64 -j RETURN\nfilter/ts-output -j DROP"}, []string{"-d 192.168.1.0/24"})
+
+	// A new LAN replaces the old one's rules.
+	set("10.1.0.0/16")
+	check(fake, []string{
+		"ip rule add pref 8870 to 10.1.0.0/16 table main",
+		"filter/ts-output -d 10.1.0.0/16 -j RETURN",
+	}, []string{"192.168.1.0/24", "fd00:1::/64"})
+	check(fake6, nil, []string{"-d "})
+
+	if err := r.Set(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.String(); got != "down" {
+		t.Errorf("after Close, got:\n%s", got)
+	}
+}
+
+func TestRouterPolicyRouting(t *testing.T) {
+	defer func(pr PolicyRouting) { policyRouting = pr }(policyRouting)
+	policyRouting = PolicyRouting{BypassMark: 0x400000, SubnetRouteMark: 0x800000, Table: 100}
+
+	fake := NewFakeOS(t)
+	// Another VPN's rule and route, in the way of Tailscale's.
+	fake.rules = []string{"pref 100 fwmark 0x400000/0xff0000 table 200"}
+	fake.routes = []string{"10.0.0.0/8 dev wg0 table 100"}
+	r, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", fake, fake)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	if !r.(*linuxRouter).ipRuleAvailable {
+		t.Skip("ip rule not available")
+	}
+	if err := r.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	if err := r.Set(&Config{
+		LocalAddrs:    mustCIDRs("100.101.102.104/10"),
+		Routes:        mustCIDRs("100.100.100.100/32"),
+		SubnetRoutes:  mustCIDRs("10.0.0.0/16"),
+		NetfilterMode: NetfilterOn,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got := fake.String()
+	for _, want := range []string{
+		"ip route add 100.100.100.100/32 dev tailscale0 table 100",
+		"ip rule add pref 8810 fwmark 0x400000 table main",
+		"ip rule add pref 8888 table 100",
+		"filter/ts-forward -i tailscale0 -j MARK --set-mark 0x800000",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("OS state lacks %q:\n%s", want, got)
+		}
+	}
+
+	warnings := r.(HealthWarner).HealthWarnings()
+	if len(warnings) != 2 {
+		t.Fatalf("HealthWarnings = %q; want the conflicting rule and route", warnings)
+	}
+	for i, want := range []string{"fwmark 0x400000/0xff0000", "10.0.0.0/8 dev wg0"} {
+		if !strings.Contains(warnings[i], want) {
+			t.Errorf("HealthWarnings[%d] = %q; want it to mention %q", i, warnings[i], want)
+		}
+	}
+}
+
+func TestRouterIPv6(t *testing.T) {
+	fake, fake6 := NewFakeOS(t), NewFakeOS(t)
+	ri, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", fake, fake)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	r := ri.(*linuxRouter)
+	if !r.ipRuleAvailable {
+		t.Skip("ip rule not available")
+	}
+	r.ipt6 = fake6
+	r.v6Available = true
+	r.v6NAT = true
+	if err := r.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	if err := r.Set(&Config{
+		LocalAddrs:       mustCIDRs("100.101.102.104/10", "fd7a:115c:a1e0::1/128"),
+		Routes:           mustCIDRs("100.100.100.100/32", "fd7a:115c:a1e0::/48", "2001:db8::/64"),
+		SubnetRoutes:     mustCIDRs("2001:db8:1::/64"),
+		SNATSubnetRoutes: true,
+		NoSNATFrom:       mustCIDRs("10.0.0.0/8", "fd00::/64"),
+		NetfilterMode:    NetfilterOn,
+		KillSwitch:       true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+up
+ip addr add 100.101.102.104/10 dev tailscale0
+ip addr add fd7a:115c:a1e0::1/128 dev tailscale0
+ip route add 100.100.100.100/32 dev tailscale0 table 88
+ip route add 2001:db8::/64 dev tailscale0 table 88
+ip route add fd7a:115c:a1e0::/48 dev tailscale0 table 88
+ip rule add pref 8810 fwmark 0x20000 table main
+ip rule add pref 8830 fwmark 0x20000 table default
+ip rule add pref 8850 fwmark 0x20000 type unreachable
+ip rule add pref 8888 table 88
+ip -6 rule add pref 8810 fwmark 0x20000 table main
+ip -6 rule add pref 8830 fwmark 0x20000 table default
+ip -6 rule add pref 8850 fwmark 0x20000 type unreachable
+ip -6 rule add pref 8888 table 88
+filter/FORWARD -j ts-forward
+filter/INPUT -j ts-input
+filter/OUTPUT -j ts-output
+filter/ts-forward -i tailscale0 -j MARK --set-mark 0x10000
+filter/ts-forward -m mark --mark 0x10000 -j ACCEPT
+filter/ts-forward -o tailscale0 -s 100.64.0.0/10 -j DROP
+filter/ts-forward -o tailscale0 -j ACCEPT
+filter/ts-input -i lo -s 100.101.102.104 -j ACCEPT
+filter/ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
+filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
+filter/ts-output -o lo -j RETURN
+filter/ts-output -o tailscale0 -j RETURN
+filter/ts-output -m mark --mark 0x20000 -j RETURN
+filter/ts-output -j DROP
+nat/POSTROUTING -j ts-postrouting
+nat/ts-postrouting -s 10.0.0.0/8 -m mark --mark 0x10000 -j RETURN
+nat/ts-postrouting -m mark --mark 0x10000 -j MASQUERADE
+`
+	want6 := `
+down
+filter/FORWARD -j ts-forward
+filter/INPUT -j ts-input
+filter/OUTPUT -j ts-output
+filter/ts-forward -i tailscale0 -j MARK --set-mark 0x10000
+filter/ts-forward -m mark --mark 0x10000 -j ACCEPT
+filter/ts-forward -o tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
+filter/ts-forward -o tailscale0 -j ACCEPT
+filter/ts-input -i lo -s fd7a:115c:a1e0::1 -j ACCEPT
+filter/ts-input ! -i tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
+filter/ts-output -o lo -j RETURN
+filter/ts-output -o tailscale0 -j RETURN
+filter/ts-output -m mark --mark 0x20000 -j RETURN
+filter/ts-output -j DROP
+nat/POSTROUTING -j ts-postrouting
+nat/ts-postrouting -s fd00::/64 -m mark --mark 0x10000 -j RETURN
+nat/ts-postrouting -m mark --mark 0x10000 -j MASQUERADE
+`
+	if got := fake.String(); got != strings.TrimSpace(want) {
+		t.Errorf("got:\n%s\nwant:\n%s", got, strings.TrimSpace(want))
+	}
+	// fake6 only sees IPv6 netfilter; ip commands all go to fake.
+	if got := fake6.String(); got != strings.TrimSpace(want6) {
+		t.Errorf("IPv6 netfilter got:\n%s\nwant:\n%s", got, strings.TrimSpace(want6))
+	}
+
+	// Shutting down cleans up both families.
+	if err := r.Set(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.String(); got != "down" {
+		t.Errorf("after Close, got:\n%s", got)
+	}
+	if got := fake6.String(); got != "down" {
+		t.Errorf("after Close, IPv6 netfilter got:\n%s", got)
+	}
+
+	// Without an IPv6 nat table, only IPv4 is masqueraded.
+	r.v6NAT = false
+	if err := r.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	if err := r.Set(&Config{
+		LocalAddrs:       mustCIDRs("100.101.102.104/10", "fd7a:115c:a1e0::1/128"),
+		SNATSubnetRoutes: true,
+		NoSNATFrom:       mustCIDRs("fd00::/64"),
+		NetfilterMode:    NetfilterOn,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake6.String(); strings.Contains(got, "nat/") {
+		t.Errorf("IPv6 nat rules without a nat table:\n%s", got)
+	}
+	if got := fake.String(); !strings.Contains(got, "nat/ts-postrouting -m mark --mark 0x10000 -j MASQUERADE") {
+		t.Errorf("IPv4 isn't masqueraded:\n%s", got)
+	}
+}
+
+func TestIPRuleConflicts(t *testing.T) {
+	const rules = `0:	from all lookup local
+8810:	from all fwmark 0x20000 lookup main
+8888:	from all lookup 88
+9000:	from all fwmark 0x10000/0x10000 lookup 51820
+9100:	from all fwmark 0xca6c lookup 51820
+32766:	from all lookup main`
+	got := ipRuleConflicts([]byte(rules), DefaultPolicyRouting)
+	want := []string{
+		`ip rule "8810:\tfrom all fwmark 0x20000 lookup main" matches Tailscale's bypass mark 0x20000`,
+		`ip rule "8888:\tfrom all lookup 88" uses Tailscale's routing table 88`,
+		`ip rule "9000:\tfrom all fwmark 0x10000/0x10000 lookup 51820" matches Tailscale's subnet route mark 0x10000`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ipRuleConflicts:\ngot:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCGNATSubnets(t *testing.T) {
+	got := cgnatSubnets(map[string][]netaddr.IPPrefix{
+		"eth0":  mustCIDRs("192.168.1.10/24"),
+		"wwan0": mustCIDRs("100.80.1.2/16", "fd00::2/64"),
+		"ppp0":  mustCIDRs("100.100.100.100/32"),
+		"tun9":  mustCIDRs("100.70.0.1/8"),
+	})
+	var strs []string
+	for _, s := range got {
+		strs = append(strs, s.String())
+	}
+	want := "100.100.100.100/32 on ppp0, 100.64.0.0/10 on tun9, 100.80.0.0/16 on wwan0"
+	if g := strings.Join(strs, ", "); g != want {
+		t.Errorf("cgnatSubnets = %s; want %s", g, want)
+	}
+}
+
+func TestRouterCGNATExemption(t *testing.T) {
+	fake := NewFakeOS(t)
+	ri, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", fake, fake)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	r := ri.(*linuxRouter)
+	if err := r.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	var lan map[string][]netaddr.IPPrefix
+	r.lanPrefixes = func() (map[string][]netaddr.IPPrefix, error) { return lan, nil }
+	defer SetAllowISPCGNAT(false)
+
+	const exempt = "filter/ts-input -i wwan0 -s 100.80.0.0/16 -j RETURN"
+	const drop = "filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP"
+	checkExempt := func() {
+		t.Helper()
+		got := fake.String()
+		i, j := strings.Index(got, exempt), strings.Index(got, drop)
+		if i == -1 || j == -1 || i > j || strings.Count(got, exempt) != 1 {
+			t.Fatalf("want exemption once, before the DROP rule; got:\n%s", got)
+		}
+	}
+	checkNoExempt := func(why string) {
+		t.Helper()
+		if got := fake.String(); strings.Contains(got, "wwan0") {
+			t.Fatalf("exemption %s:\n%s", why, got)
+		}
+	}
+	cfg := &Config{
+		LocalAddrs:    mustCIDRs("100.101.102.104/10"),
+		NetfilterMode: NetfilterOn,
+	}
+	set := func() {
+		t.Helper()
+		if err := r.Set(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set()
+	checkNoExempt("without CGNAT addresses")
+
+	// Only a warning, unless allowed.
+	lan = map[string][]netaddr.IPPrefix{"wwan0": mustCIDRs("100.80.1.2/16")}
+	set()
+	checkNoExempt("without SetAllowISPCGNAT")
+
+	SetAllowISPCGNAT(true)
+	set()
+	set() // not added twice
+	checkExempt()
+
+	// It goes away with the rest of the rules, and comes back when
+	// they're rebuilt.
+	cfg.NetfilterMode = NetfilterOff
+	set()
+	checkNoExempt("left behind with netfilter off")
+	cfg.NetfilterMode = NetfilterOn
+	set()
+	checkExempt()
+
+	lan = nil
+	set()
+	checkNoExempt("not removed")
+}
+
+func TestRouterProxyNeighbors(t *testing.T) {
+	fake := NewFakeOS(t)
+	ri, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", fake, fake)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	r := ri.(*linuxRouter)
+	if err := r.Up(); err != nil {
+		t.Fatalf("failed to up router: %v", err)
+	}
+	r.lanPrefixes = func() (map[string][]netaddr.IPPrefix, error) {
+		return map[string][]netaddr.IPPrefix{
+			"eth0": mustCIDRs("192.168.1.10/24", "fd00:1::10/64"),
+		}, nil
+	}
+
+	neighs := func() string {
+		var ret []string
+		for _, line := range strings.Split(fake.String(), "\n") {
+			if strings.HasPrefix(line, "ip neigh") || strings.HasPrefix(line, "sysctl") {
+				ret = append(ret, line)
+			}
+		}
+		return strings.Join(ret, "\n")
+	}
+	steps := []struct {
+		name  string
+		proxy []netaddr.IPPrefix
+		want  string
+	}{
+		{
+			name: "add",
+			// Prefixes off the LAN's subnets, or too big, are skipped.
+			proxy: mustCIDRs("192.168.1.252/30", "fd00:1::20/127", "10.9.0.0/30", "fd00:1::/112"),
+			want: `
+ip neigh add proxy 192.168.1.252 dev eth0
+ip neigh add proxy 192.168.1.253 dev eth0
+ip neigh add proxy 192.168.1.254 dev eth0
+ip neigh add proxy 192.168.1.255 dev eth0
+ip neigh add proxy fd00:1::20 dev eth0
+ip neigh add proxy fd00:1::21 dev eth0
+sysctl net.ipv6.conf.eth0.proxy_ndp=1
+`,
+		},
+		{
+			name:  "shrink",
+			proxy: mustCIDRs("192.168.1.254/31"),
+			want: `
+ip neigh add proxy 192.168.1.254 dev eth0
+ip neigh add proxy 192.168.1.255 dev eth0
+sysctl net.ipv6.conf.eth0.proxy_ndp=1
+`,
+		},
+		{
+			name: "none",
+			want: `
+sysctl net.ipv6.conf.eth0.proxy_ndp=1
+`,
+		},
+	}
+	for _, st := range steps {
+		if err := r.Set(&Config{ProxyNeighbors: st.proxy}); err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+		if got, want := neighs(), strings.TrimSpace(st.want); got != want {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", st.name, got, want)
+		}
+	}
+}
+
 // fakeOS implements netfilterRunner and commandRunner, but captures
 // changes without touching the OS.
 type fakeOS struct {
@@ -283,6 +831,9 @@ type fakeOS struct {
 	ips       []string
 	routes    []string
 	rules     []string
+	rules6    []string // added with ip -6
+	neighs    []string
+	sysctls   []string
 	netfilter map[string][]string
 }
 
@@ -322,6 +873,18 @@ func (o *fakeOS) String() string {
 		fmt.Fprintf(&b, "ip rule add %s\n", rule)
 	}
 
+	for _, rule := range o.rules6 {
+		fmt.Fprintf(&b, "ip -6 rule add %s\n", rule)
+	}
+
+	for _, neigh := range o.neighs {
+		fmt.Fprintf(&b, "ip neigh add %s\n", neigh)
+	}
+
+	for _, sysctl := range o.sysctls {
+		fmt.Fprintf(&b, "sysctl %s\n", sysctl)
+	}
+
 	var chains []string
 	for chain := range o.netfilter {
 		chains = append(chains, chain)
@@ -442,9 +1005,17 @@ func (o *fakeOS) run(args ...string) error {
 		o.t.Errorf("unexpected invocation %q", strings.Join(args, " "))
 		return errors.New("unrecognized invocation")
 	}
+	if args[0] == "sysctl" && len(args) == 4 && args[1] == "-q" && args[2] == "-w" {
+		o.sysctls = append(o.sysctls, args[3])
+		return nil
+	}
 	if args[0] != "ip" {
 		return unexpected()
 	}
+	v6 := len(args) > 1 && args[1] == "-6"
+	if v6 {
+		args = append([]string{"ip"}, args[2:]...)
+	}
 
 	rest := strings.Join(args[3:], " ")
 
@@ -467,6 +1038,11 @@ func (o *fakeOS) run(args ...string) error {
 		l = &o.routes
 	case "rule":
 		l = &o.rules
+		if v6 {
+			l = &o.rules6
+		}
+	case "neigh":
+		l = &o.neighs
 	default:
 		return unexpected()
 	}
@@ -484,7 +1060,7 @@ func (o *fakeOS) run(args ...string) error {
 	case "del":
 		found := false
 		for i, el := range *l {
-			if el == rest {
+			if el == rest || args[1] == "rule" && ruleMatches(el, rest) {
 				found = true
 				*l = append((*l)[:i], (*l)[i+1:]...)
 				break
@@ -512,19 +1088,56 @@ func (o *fakeOS) run(args ...string) error {
 	return nil
 }
 
+// ruleMatches reports whether the ip rule rule has all the selectors
+// in sel, as "ip rule del" matches rules.
+func ruleMatches(rule, sel string) bool {
+	have := map[string]string{}
+	f := strings.Fields(rule)
+	for i := 0; i+1 < len(f); i += 2 {
+		have[f[i]] = f[i+1]
+	}
+	f = strings.Fields(sel)
+	for i := 0; i+1 < len(f); i += 2 {
+		if have[f[i]] != f[i+1] {
+			return false
+		}
+	}
+	return true
+}
+
+func (o *fakeOS) runStdin(stdin []byte, args ...string) error {
+	return o.run(args...)
+}
+
 func (o *fakeOS) output(args ...string) ([]byte, error) {
-	want := "ip rule list priority 10000"
 	got := strings.Join(args, " ")
-	if got != want {
-		o.t.Errorf("unexpected command that wants output: %v", got)
-		return nil, errExec
+	v6 := strings.HasPrefix(got, "ip -6 ")
+	got = strings.Replace(got, "ip -6 ", "ip ", 1)
+	rules := o.rules
+	if v6 {
+		rules = o.rules6
 	}
-
 	var ret []string
-	for _, rule := range o.rules {
-		if strings.Contains(rule, "10000") {
-			ret = append(ret, rule)
+	switch {
+	case got == "ip rule list":
+		// Rules are stored as added, like "pref 8888 table 88",
+		// and listed like "8888:	from all lookup 88".
+		for _, rule := range rules {
+			f := strings.Fields(rule)
+			line := f[1] + ":\tfrom all " + strings.Join(f[2:], " ")
+			ret = append(ret, strings.Replace(line, " table ", " lookup ", 1))
+		}
+	case strings.HasPrefix(got, "ip route show table "):
+		suffix := " table " + strings.TrimPrefix(got, "ip route show table ")
+		for _, route := range o.routes {
+			// Routes of both families are stored together.
+			if strings.HasSuffix(route, suffix) && strings.Contains(strings.Fields(route)[0], ":") == v6 {
+				ret = append(ret, strings.TrimSuffix(route, suffix))
+			}
 		}
+	default:
+		o.t.Errorf("unexpected command that wants output: %v", got)
+		return nil, errExec
 	}
 	return []byte(strings.Join(ret, "\n")), nil
 }
@@ -5,20 +5,15 @@
 package router
 
 import (
-	"bytes"
-	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"os"
+	"net"
 	"os/exec"
-	"path/filepath"
-	"strings"
+	"sync"
 
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
+	"golang.org/x/sys/unix"
 	"inet.af/netaddr"
-	"tailscale.com/atomicfile"
 	"tailscale.com/types/logger"
 )
 
@@ -26,11 +21,22 @@ import (
 // There is an experimental kernel version in the works for OpenBSD:
 // https://git.zx2c4.com/wireguard-openbsd.
 
+// openbsdRouter configures the tun device's addresses with ioctls and
+// its routes through the routing socket, like freebsdRouter. DNS
+// goes to resolvd(8) where it runs, as on OpenBSD 6.9 and later, and
+// into resolv.conf otherwise.
 type openbsdRouter struct {
 	logf    logger.Logf
 	tunname string
-	local   netaddr.IPPrefix
-	routes  map[netaddr.IPPrefix]struct{}
+	ifindex int
+	local   map[netaddr.IPPrefix]bool
+	routes  map[netaddr.IPPrefix]bool
+	seq     int // of the last routing socket message
+
+	mu sync.Mutex // guards dns, which DNSStatus reads concurrently
+	// dns is the DNS configuration last applied, if it has
+	// Nameservers, with Manager set to how.
+	dns DNSStatus
 }
 
 func newUserspaceRouter(logf logger.Logf, _ *device.Device, tundev tun.Device) (Router, error) {
@@ -38,26 +44,19 @@ func newUserspaceRouter(logf logger.Logf, _ *device.Device, tundev tun.Device) (
 	if err != nil {
 		return nil, err
 	}
+	ifc, err := net.InterfaceByName(tunname)
+	if err != nil {
+		return nil, err
+	}
 	return &openbsdRouter{
 		logf:    logf,
 		tunname: tunname,
+		ifindex: ifc.Index,
 	}, nil
 }
 
-func cmd(args ...string) *exec.Cmd {
-	if len(args) == 0 {
-		log.Fatalf("exec.Cmd(%#v) invalid; need argv[0]\n", args)
-	}
-	return exec.Command(args[0], args[1:]...)
-}
-
 func (r *openbsdRouter) Up() error {
-	ifup := []string{"ifconfig", r.tunname, "up"}
-	if out, err := cmd(ifup...).CombinedOutput(); err != nil {
-		r.logf("running ifconfig failed: %v\n%s", err, out)
-		return err
-	}
-	return nil
+	return setIfUp(r.tunname, true)
 }
 
 func (r *openbsdRouter) Set(cfg *Config) error {
@@ -65,99 +64,68 @@ func (r *openbsdRouter) Set(cfg *Config) error {
 		cfg = &shutdownConfig
 	}
 
-	// TODO: support configuring multiple local addrs on interface.
-	if len(cfg.LocalAddrs) != 1 {
-		return errors.New("freebsd doesn't support setting multiple local addrs yet")
-	}
-	localAddr := cfg.LocalAddrs[0]
-
 	var errq error
 
-	if localAddr != r.local {
-		if r.local != (netaddr.IPPrefix{}) {
-			addrdel := []string{"ifconfig", r.tunname,
-				"inet", r.local.String(), "-alias"}
-			out, err := cmd(addrdel...).CombinedOutput()
-			if err != nil {
-				r.logf("addr del failed: %v: %v\n%s", addrdel, err, out)
+	local := make(map[netaddr.IPPrefix]bool)
+	for _, addr := range cfg.LocalAddrs {
+		if !addr.IP.Is4() {
+			r.logf("router: not adding %v to %s; IPv6 addresses aren't supported yet", addr, r.tunname)
+			continue
+		}
+		local[addr] = true
+	}
+	for addr := range r.local {
+		if !local[addr] {
+			if err := setIfAddr(r.tunname, addr, false); err != nil {
+				r.logf("addr del failed: %v", err)
 				if errq == nil {
 					errq = err
 				}
 			}
-
-			routedel := []string{"route", "-q", "-n",
-				"del", "-inet", r.local.String(),
-				"-iface", r.local.IP.String()}
-			if out, err := cmd(routedel...).CombinedOutput(); err != nil {
-				r.logf("route del failed: %v: %v\n%s", routedel, err, out)
+		}
+	}
+	for addr := range local {
+		if !r.local[addr] {
+			if err := setIfAddr(r.tunname, addr, true); err != nil {
+				r.logf("addr add failed: %v", err)
 				if errq == nil {
 					errq = err
 				}
 			}
 		}
-
-		addradd := []string{"ifconfig", r.tunname,
-			"inet", localAddr.String(), "alias"}
-		out, err := cmd(addradd...).CombinedOutput()
-		if err != nil {
-			r.logf("addr add failed: %v: %v\n%s", addradd, err, out)
-			if errq == nil {
-				errq = err
-			}
-		}
-
-		routeadd := []string{"route", "-q", "-n",
-			"add", "-inet", localAddr.String(),
-			"-iface", localAddr.IP.String()}
-		if out, err := cmd(routeadd...).CombinedOutput(); err != nil {
-			r.logf("route add failed: %v: %v\n%s", routeadd, err, out)
-			if errq == nil {
-				errq = err
-			}
-		}
 	}
+	r.local = local
 
-	newRoutes := make(map[netaddr.IPPrefix]struct{})
-	for _, route := range cfg.Routes {
-		newRoutes[route] = struct{}{}
+	// As the tun device is point-to-point, its addresses need routes
+	// of their own, like the ones it routes to.
+	routes := make(map[netaddr.IPPrefix]bool)
+	for addr := range local {
+		routes[addr] = true
+	}
+	for _, route := range withoutLocalRoutes(cfg.Routes, cfg.LocalRoutes) {
+		routes[route] = true
 	}
 	for route := range r.routes {
-		if _, keep := newRoutes[route]; !keep {
-			net := route.IPNet()
-			nip := net.IP.Mask(net.Mask)
-			nstr := fmt.Sprintf("%v/%d", nip, route.Bits)
-			routedel := []string{"route", "-q", "-n",
-				"del", "-inet", nstr,
-				"-iface", localAddr.IP.String()}
-			out, err := cmd(routedel...).CombinedOutput()
-			if err != nil {
-				r.logf("route del failed: %v: %v\n%s", routedel, err, out)
+		if !routes[route] {
+			if err := r.writeRoute(unix.RTM_DELETE, route); err != nil {
+				r.logf("route del failed: %v: %v", route, err)
 				if errq == nil {
 					errq = err
 				}
 			}
 		}
 	}
-	for route := range newRoutes {
-		if _, exists := r.routes[route]; !exists {
-			net := route.IPNet()
-			nip := net.IP.Mask(net.Mask)
-			nstr := fmt.Sprintf("%v/%d", nip, route.Bits)
-			routeadd := []string{"route", "-q", "-n",
-				"add", "-inet", nstr,
-				"-iface", localAddr.IP.String()}
-			out, err := cmd(routeadd...).CombinedOutput()
-			if err != nil {
-				r.logf("addr add failed: %v: %v\n%s", routeadd, err, out)
+	for route := range routes {
+		if !r.routes[route] {
+			if err := r.writeRoute(unix.RTM_ADD, route); err != nil {
+				r.logf("route add failed: %v: %v", route, err)
 				if errq == nil {
 					errq = err
 				}
 			}
 		}
 	}
-
-	r.local = localAddr
-	r.routes = newRoutes
+	r.routes = routes
 
 	if err := r.replaceResolvConf(cfg.DNS, cfg.DNSDomains); err != nil {
 		errq = fmt.Errorf("replacing resolv.conf failed: %v", err)
@@ -166,10 +134,14 @@ func (r *openbsdRouter) Set(cfg *Config) error {
 	return errq
 }
 
+func (r *openbsdRouter) writeRoute(typ int, p netaddr.IPPrefix) error {
+	r.seq++
+	return writeRoute(typ, r.seq, r.ifindex, p)
+}
+
 func (r *openbsdRouter) Close() error {
-	out, err := cmd("ifconfig", r.tunname, "down").CombinedOutput()
-	if err != nil {
-		r.logf("running ifconfig failed: %v\n%s", err, out)
+	if err := setIfUp(r.tunname, false); err != nil {
+		r.logf("%v", err)
 	}
 
 	if err := r.restoreResolvConf(); err != nil {
@@ -179,92 +151,85 @@ func (r *openbsdRouter) Close() error {
 	return nil
 }
 
-const (
-	tsConf     = "/etc/resolv.tailscale.conf"
-	backupConf = "/etc/resolv.pre-tailscale-backup.conf"
-	resolvConf = "/etc/resolv.conf"
-)
+func (r *openbsdRouter) DNSStatus() (DNSStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ds := r.dns
+	if ds.Manager == "" {
+		ds.Manager = "resolv.conf"
+		if resolvdRunning() {
+			ds.Manager = "resolvd"
+		}
+	}
+	return ds, true
+}
+
+func (r *openbsdRouter) setDNS(ds DNSStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dns = ds
+}
 
+// resolvdRunning reports whether resolvd(8) is running, in which case
+// it owns resolv.conf, and nameservers are proposed to it instead.
+func resolvdRunning() bool {
+	return exec.Command("pgrep", "-x", "resolvd").Run() == nil
+}
+
+// replaceResolvConf proposes servers to resolvd with "route
+// nameserver", or, without resolvd, points resolv.conf at a file
+// listing servers and domains. resolvd has no search domains, so
+// domains only apply to the latter.
 func (r *openbsdRouter) replaceResolvConf(servers []netaddr.IP, domains []string) error {
 	if len(servers) == 0 {
 		return r.restoreResolvConf()
 	}
-
-	// Write the tsConf file.
-	buf := new(bytes.Buffer)
-	fmt.Fprintf(buf, "# resolv.conf(5) file generated by tailscale\n")
-	fmt.Fprintf(buf, "# DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN\n\n")
-	for _, ns := range servers {
-		fmt.Fprintf(buf, "nameserver %s\n", ns)
-	}
-	if len(domains) > 0 {
-		fmt.Fprintf(buf, "search "+strings.Join(domains, " ")+"\n")
-	}
-	tf, err := ioutil.TempFile(filepath.Dir(tsConf), filepath.Base(tsConf)+".*")
-	if err != nil {
-		return err
+	ds := DNSStatus{
+		Nameservers:  servers,
+		DefaultRoute: true,
 	}
-	tempName := tf.Name()
-	tf.Close()
-
-	if err := atomicfile.WriteFile(tempName, buf.Bytes(), 0644); err != nil {
-		return err
-	}
-	if err := os.Rename(tempName, tsConf); err != nil {
-		return err
-	}
-
-	if linkPath, err := os.Readlink(resolvConf); err != nil {
-		// Remove any old backup that may exist.
-		os.Remove(backupConf)
-
-		// Backup the existing /etc/resolv.conf file.
-		contents, err := ioutil.ReadFile(resolvConf)
-		if os.IsNotExist(err) {
-			// No existing /etc/resolv.conf file to backup.
-			// Nothing to do.
-			return nil
-		} else if err != nil {
-			return err
+	if resolvdRunning() {
+		args := []string{"nameserver", r.tunname}
+		for _, ns := range servers {
+			args = append(args, ns.String())
 		}
-		if err := atomicfile.WriteFile(backupConf, contents, 0644); err != nil {
-			return err
+		if out, err := exec.Command("route", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("route nameserver: %v\n%s", err, out)
 		}
-	} else if linkPath != tsConf {
-		// Backup the existing symlink.
-		os.Remove(backupConf)
-		if err := os.Symlink(linkPath, backupConf); err != nil {
-			return err
+		if len(domains) > 0 {
+			r.logf("router: resolvd has no search domains; not adding %v", domains)
 		}
+		ds.Manager = "resolvd"
 	} else {
-		// Nothing to do, resolvConf already points to tsConf.
-		return nil
-	}
-
-	os.Remove(resolvConf)
-	if err := os.Symlink(tsConf, resolvConf); err != nil {
-		return nil
+		if err := replaceResolvConfFile(servers, domains); err != nil {
+			return err
+		}
+		ds.Manager = "resolv.conf"
+		ds.Domains = domains
 	}
-
+	r.setDNS(ds)
 	return nil
 }
 
+// restoreResolvConf withdraws the nameservers applied by
+// replaceResolvConf, if any.
 func (r *openbsdRouter) restoreResolvConf() error {
-	if _, err := os.Stat(backupConf); err != nil {
-		if os.IsNotExist(err) {
-			return nil // No backup resolv.conf to restore.
+	r.mu.Lock()
+	manager := r.dns.Manager
+	r.mu.Unlock()
+	switch manager {
+	case "resolvd":
+		// A proposal without nameservers withdraws the last one.
+		if out, err := exec.Command("route", "nameserver", r.tunname).CombinedOutput(); err != nil {
+			return fmt.Errorf("route nameserver: %v\n%s", err, out)
+		}
+	default:
+		// Also cleans up after a tailscaled that didn't shut
+		// down cleanly.
+		if err := restoreResolvConfFile(); err != nil {
+			return err
 		}
-		return err
-	}
-	if ln, err := os.Readlink(resolvConf); err != nil {
-		return err
-	} else if ln != tsConf {
-		return fmt.Errorf("resolv.conf is not a symlink to %s", tsConf)
-	}
-	if err := os.Rename(backupConf, resolvConf); err != nil {
-		return err
 	}
-	os.Remove(tsConf) // Best effort removal.
-
+	r.setDNS(DNSStatus{})
 	return nil
 }
@@ -0,0 +1,157 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/tun"
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+// solarisRouter configures the tun device on illumos and Solaris
+// with ifconfig(1M) and route(1M). The tun device is point-to-point,
+// so routes point at its own address with -interface.
+type solarisRouter struct {
+	logf    logger.Logf
+	tunname string
+	local   netaddr.IPPrefix
+	routes  map[netaddr.IPPrefix]struct{}
+}
+
+func newUserspaceRouter(logf logger.Logf, _ *device.Device, tundev tun.Device) (Router, error) {
+	tunname, err := tundev.Name()
+	if err != nil {
+		return nil, err
+	}
+	if !nsswitchUsesDNS("/etc/nsswitch.conf") {
+		logf("router: /etc/nsswitch.conf doesn't list dns for hosts; Tailscale's DNS settings won't be used")
+	}
+	return &solarisRouter{
+		logf:    logf,
+		tunname: tunname,
+	}, nil
+}
+
+func (r *solarisRouter) run(args ...string) error {
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		r.logf("%s failed: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return err
+}
+
+func (r *solarisRouter) Up() error {
+	return r.run("ifconfig", r.tunname, "up")
+}
+
+func (r *solarisRouter) Set(cfg *Config) error {
+	if cfg == nil {
+		cfg = &shutdownConfig
+	}
+	if len(cfg.LocalAddrs) == 0 {
+		return nil
+	}
+	// TODO: support configuring multiple local addrs on interface.
+	if len(cfg.LocalAddrs) != 1 {
+		return errors.New("illumos doesn't support setting multiple local addrs yet")
+	}
+	localAddr := cfg.LocalAddrs[0]
+
+	var errq error
+	setErr := func(err error) {
+		if err != nil && errq == nil {
+			errq = err
+		}
+	}
+
+	// Routes point at the local address, so they go when it changes.
+	if localAddr != r.local {
+		for route := range r.routes {
+			setErr(r.run(routeArgs("delete", route, r.local.IP)...))
+		}
+		r.routes = nil
+		setErr(r.run("ifconfig", r.tunname,
+			localAddr.IP.String(), localAddr.IP.String(),
+			"netmask", "255.255.255.255", "up"))
+	}
+
+	newRoutes := make(map[netaddr.IPPrefix]struct{})
+	for _, route := range withoutLocalRoutes(cfg.Routes, cfg.LocalRoutes) {
+		// IPv6 routes are skipped: the tun device only has
+		// an IPv4 address for them to point at.
+		if route.IP.Is4() {
+			newRoutes[route] = struct{}{}
+		}
+	}
+	for route := range r.routes {
+		if _, keep := newRoutes[route]; !keep {
+			setErr(r.run(routeArgs("delete", route, localAddr.IP)...))
+		}
+	}
+	for route := range newRoutes {
+		if _, exists := r.routes[route]; !exists {
+			setErr(r.run(routeArgs("add", route, localAddr.IP)...))
+		}
+	}
+
+	r.local = localAddr
+	r.routes = newRoutes
+
+	if err := replaceResolvConfFile(cfg.DNS, cfg.DNSDomains); err != nil {
+		errq = fmt.Errorf("replacing resolv.conf failed: %v", err)
+	}
+	return errq
+}
+
+func (r *solarisRouter) Close() error {
+	r.run("ifconfig", r.tunname, "down")
+	if err := restoreResolvConfFile(); err != nil {
+		r.logf("failed to restore system resolv.conf: %v", err)
+	}
+	return nil
+}
+
+// routeArgs returns the route(1M) command that adds or deletes route
+// via the tun device whose address is local.
+func routeArgs(op string, route netaddr.IPPrefix, local netaddr.IP) []string {
+	net := route.IPNet()
+	nip := net.IP.Mask(net.Mask)
+	return []string{"route", "-n", op, "-net",
+		fmt.Sprintf("%v/%d", nip, route.Bits), local.String(), "-interface"}
+}
+
+// nsswitchUsesDNS reports whether the hosts line of the nsswitch.conf
+// at path lists dns. Without it, which is the default on some
+// illumos distributions, resolv.conf is never consulted. It reports
+// true if the file can't be read, so as not to warn needlessly.
+func nsswitchUsesDNS(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || fields[0] != "hosts:" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			if f == "dns" {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
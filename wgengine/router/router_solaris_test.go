@@ -0,0 +1,61 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestRouteArgs(t *testing.T) {
+	route, err := netaddr.ParseIPPrefix("100.64.1.7/10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := netaddr.ParseIP("100.101.102.103")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := routeArgs("add", route, local)
+	want := []string{"route", "-n", "add", "-net", "100.64.0.0/10", "100.101.102.103", "-interface"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestNsswitchUsesDNS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsswitch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		conf string
+		want bool
+	}{
+		{"dns", "passwd: files\nhosts: files dns\n", true},
+		{"files_only", "# hosts: files dns\nhosts:\tfiles\n", false},
+		{"no_hosts_line", "passwd: files\n", true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := ioutil.WriteFile(path, []byte(tt.conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := nsswitchUsesDNS(path); got != tt.want {
+			t.Errorf("%s: got %v; want %v", tt.name, got, tt.want)
+		}
+	}
+	if !nsswitchUsesDNS(filepath.Join(dir, "missing")) {
+		t.Errorf("missing file: got false; want true")
+	}
+}
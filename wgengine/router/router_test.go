@@ -0,0 +1,62 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestWithoutLocalRoutes(t *testing.T) {
+	pfxs := func(ss ...string) []netaddr.IPPrefix {
+		var ret []netaddr.IPPrefix
+		for _, s := range ss {
+			p, err := netaddr.ParseIPPrefix(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, p)
+		}
+		return ret
+	}
+	tests := []struct {
+		name          string
+		routes, local []netaddr.IPPrefix
+		want          []netaddr.IPPrefix
+	}{
+		{
+			name:   "no local routes",
+			routes: pfxs("0.0.0.0/0", "192.168.1.0/24"),
+			want:   pfxs("0.0.0.0/0", "192.168.1.0/24"),
+		},
+		{
+			name:   "drops routes within the LAN",
+			routes: pfxs("0.0.0.0/0", "::/0", "192.168.1.0/24", "192.168.1.7/32", "10.0.0.0/8"),
+			local:  pfxs("192.168.1.0/24", "fd00:1::/64"),
+			want:   pfxs("0.0.0.0/0", "::/0", "10.0.0.0/8"),
+		},
+		{
+			name:   "keeps routes wider than the LAN",
+			routes: pfxs("192.168.0.0/16"),
+			local:  pfxs("192.168.1.0/24"),
+			want:   pfxs("192.168.0.0/16"),
+		},
+		{
+			name:   "everything local",
+			routes: pfxs("192.168.1.0/24"),
+			local:  pfxs("192.168.1.0/24"),
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withoutLocalRoutes(tt.routes, tt.local)
+			if !prefixesEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
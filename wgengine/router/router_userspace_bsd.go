@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build darwin freebsd
+// +build darwin
 
 package router
 
@@ -61,7 +61,7 @@ func (r *userspaceBSDRouter) Set(cfg *Config) error {
 	}
 	// TODO: support configuring multiple local addrs on interface.
 	if len(cfg.LocalAddrs) != 1 {
-		return errors.New("freebsd doesn't support setting multiple local addrs yet")
+		return errors.New("darwin doesn't support setting multiple local addrs yet")
 	}
 	localAddr := cfg.LocalAddrs[0]
 
@@ -95,7 +95,7 @@ func (r *userspaceBSDRouter) Set(cfg *Config) error {
 	}
 
 	newRoutes := make(map[netaddr.IPPrefix]struct{})
-	for _, route := range cfg.Routes {
+	for _, route := range withoutLocalRoutes(cfg.Routes, cfg.LocalRoutes) {
 		newRoutes[route] = struct{}{}
 	}
 	// Delete any pre-existing routes.
@@ -139,18 +139,9 @@ func (r *userspaceBSDRouter) Set(cfg *Config) error {
 	r.local = localAddr
 	r.routes = newRoutes
 
-	if err := r.replaceResolvConf(cfg.DNS, cfg.DNSDomains); err != nil {
-		errq = fmt.Errorf("replacing resolv.conf failed: %v", err)
-	}
-
 	return errq
 }
 
 func (r *userspaceBSDRouter) Close() error {
 	return nil
 }
-
-// TODO(mbaillie): these are no-ops for now. They could re-use the Linux funcs
-// (sans systemd parts), but I note Linux DNS is disabled(?) so leaving for now.
-func (r *userspaceBSDRouter) replaceResolvConf(_ []netaddr.IP, _ []string) error { return nil }
-func (r *userspaceBSDRouter) restoreResolvConf() error                           { return nil }
@@ -5,11 +5,14 @@
 package router
 
 import (
+	"fmt"
 	"log"
+	"sync"
 
 	winipcfg "github.com/tailscale/winipcfg-go"
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
+	"inet.af/netaddr"
 	"tailscale.com/types/logger"
 )
 
@@ -19,6 +22,14 @@ type winRouter struct {
 	nativeTun           *tun.NativeTun
 	wgdev               *device.Device
 	routeChangeCallback *winipcfg.RouteChangeCallback
+	// killSwitch holds the kill switch's filters while it's on.
+	killSwitch *wfpKillSwitch
+	// killSwitchLAN are the local networks killSwitch permits.
+	killSwitchLAN []netaddr.IPPrefix
+
+	mu sync.Mutex
+	// dns is the DNS configuration last set on the interface.
+	dns DNSStatus
 }
 
 func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error) {
@@ -26,6 +37,11 @@ func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Devic
 	if err != nil {
 		return nil, err
 	}
+	// Remove the NRPT rule of a tailscaled that didn't shut down
+	// cleanly, which would send its domains nowhere.
+	if err := delNRPTRule(); err != nil {
+		logf("removing stale NRPT rule: %v", err)
+	}
 	return &winRouter{
 		logf:      logf,
 		wgdev:     wgdev,
@@ -55,12 +71,90 @@ func (r *winRouter) Set(cfg *Config) error {
 		r.logf("ConfigureInterface: %v\n", err)
 		return err
 	}
+	if err := r.setKillSwitch(cfg.KillSwitch, cfg.LocalRoutes); err != nil {
+		r.logf("kill switch: %v", err)
+		return err
+	}
+	r.setDNS(DNSStatus{
+		Nameservers:  cfg.DNS,
+		Domains:      cfg.DNSDomains,
+		Routes:       cfg.DNSRoutes,
+		DefaultRoute: cfg.DNSDefaultRoute,
+	})
+	return nil
+}
+
+// setKillSwitch turns the kill switch on or off. While it's on, WFP
+// filters block all traffic that doesn't go over Tailscale, other
+// than tailscaled's own and that to and from the local networks lan.
+func (r *winRouter) setKillSwitch(on bool, lan []netaddr.IPPrefix) error {
+	if on && r.killSwitch != nil && !prefixesEqual(lan, r.killSwitchLAN) {
+		// The filters can't be edited in place; replace them.
+		if err := r.setKillSwitch(false, nil); err != nil {
+			return err
+		}
+	}
+	switch {
+	case on == (r.killSwitch != nil):
+		return nil
+	case on:
+		guid := r.nativeTun.GUID()
+		luid, err := winipcfg.InterfaceGuidToLuid(&guid)
+		if err != nil {
+			return fmt.Errorf("finding %s's LUID: %w", r.tunname, err)
+		}
+		ks, err := newWFPKillSwitch(r.tunname, luid, lan)
+		if err != nil {
+			return err
+		}
+		r.killSwitch = ks
+		r.killSwitchLAN = lan
+		if len(lan) > 0 {
+			r.logf("kill switch on: blocking traffic outside of %s, except to %v", r.tunname, lan)
+		} else {
+			r.logf("kill switch on: blocking traffic outside of %s", r.tunname)
+		}
+	default:
+		if err := r.killSwitch.Close(); err != nil {
+			return err
+		}
+		r.killSwitch = nil
+		r.killSwitchLAN = nil
+		r.logf("kill switch off")
+	}
 	return nil
 }
 
+func (r *winRouter) setDNS(ds DNSStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dns = ds
+}
+
+func (r *winRouter) DNSStatus() (DNSStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ds := r.dns
+	// configureInterface only gives the interface nameservers when
+	// they resolve everything; otherwise an NRPT rule scopes them to
+	// their domains.
+	ds.Manager = "interface"
+	if !ds.DefaultRoute {
+		ds.Manager = "NRPT"
+	}
+	return ds, true
+}
+
 func (r *winRouter) Close() error {
 	if r.routeChangeCallback != nil {
 		r.routeChangeCallback.Unregister()
 	}
+	if err := r.setKillSwitch(false, nil); err != nil {
+		r.logf("removing kill switch: %v", err)
+	}
+	if err := delNRPTRule(); err != nil {
+		r.logf("removing NRPT rule: %v", err)
+	}
+	r.setDNS(DNSStatus{})
 	return nil
 }
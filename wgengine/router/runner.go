@@ -7,6 +7,7 @@
 package router
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os/exec"
@@ -20,6 +21,9 @@ import (
 type commandRunner interface {
 	run(...string) error
 	output(...string) ([]byte, error)
+	// runStdin is like run, but with stdin as the command's
+	// standard input.
+	runStdin(stdin []byte, args ...string) error
 }
 
 type osCommandRunner struct{}
@@ -60,6 +64,22 @@ func (o osCommandRunner) output(args ...string) ([]byte, error) {
 	return out, nil
 }
 
+// runStdin runs the command args with stdin as its standard input.
+func (o osCommandRunner) runStdin(stdin []byte, args ...string) error {
+	if len(args) == 0 {
+		return errors.New("cmd: no argv[0]")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("running %q failed: %w\n%s", strings.Join(args, " "), err, out)
+	}
+
+	return nil
+}
+
 type runGroup struct {
 	OkCode []int         // error codes that are acceptable, other than 0, if any
 	Runner commandRunner // the runner that actually runs our commands
@@ -0,0 +1,367 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"inet.af/netaddr"
+)
+
+// The Windows Filtering Platform's management API, from fwpuclnt.dll.
+// The types mirror those in fwptypes.h and fwpmtypes.h.
+var (
+	modfwpuclnt                   = windows.NewLazySystemDLL("fwpuclnt.dll")
+	procFwpmEngineOpen0           = modfwpuclnt.NewProc("FwpmEngineOpen0")
+	procFwpmEngineClose0          = modfwpuclnt.NewProc("FwpmEngineClose0")
+	procFwpmTransactionBegin0     = modfwpuclnt.NewProc("FwpmTransactionBegin0")
+	procFwpmTransactionCommit0    = modfwpuclnt.NewProc("FwpmTransactionCommit0")
+	procFwpmTransactionAbort0     = modfwpuclnt.NewProc("FwpmTransactionAbort0")
+	procFwpmSubLayerAdd0          = modfwpuclnt.NewProc("FwpmSubLayerAdd0")
+	procFwpmFilterAdd0            = modfwpuclnt.NewProc("FwpmFilterAdd0")
+	procFwpmGetAppIdFromFileName0 = modfwpuclnt.NewProc("FwpmGetAppIdFromFileName0")
+	procFwpmFreeMemory0           = modfwpuclnt.NewProc("FwpmFreeMemory0")
+)
+
+const (
+	rpcCAuthnWinNT = 10 // RPC_C_AUTHN_WINNT
+
+	fwpmSessionFlagDynamic = 0x1 // FWPM_SESSION_FLAG_DYNAMIC
+
+	fwpmFilterFlagClearActionRight = 0x8 // FWPM_FILTER_FLAG_CLEAR_ACTION_RIGHT
+
+	fwpActionBlock  = 0x1001 // FWP_ACTION_BLOCK
+	fwpActionPermit = 0x1002 // FWP_ACTION_PERMIT
+
+	// FWP_DATA_TYPE values.
+	fwpUint8        = 1
+	fwpUint16       = 2
+	fwpUint32       = 3
+	fwpUint64       = 4
+	fwpByteBlobType = 12
+	fwpV4AddrMask   = 0x100
+	fwpV6AddrMask   = 0x101
+
+	// FWP_MATCH_TYPE values.
+	fwpMatchEqual       = 0
+	fwpMatchFlagsAllSet = 6
+
+	fwpConditionFlagIsLoopback = 0x1 // FWP_CONDITION_FLAG_IS_LOOPBACK
+
+	ipProtoUDP = 17
+)
+
+var (
+	fwpmLayerALEAuthConnectV4    = windows.GUID{Data1: 0xc38d57d1, Data2: 0x05a7, Data3: 0x4c33, Data4: [8]byte{0x90, 0x4f, 0x7f, 0xbc, 0xee, 0xe6, 0x0e, 0x82}}
+	fwpmLayerALEAuthConnectV6    = windows.GUID{Data1: 0x4a72393b, Data2: 0x319f, Data3: 0x44bc, Data4: [8]byte{0x84, 0xc3, 0xba, 0x54, 0xdc, 0xb3, 0xb6, 0xb4}}
+	fwpmLayerALEAuthRecvAcceptV4 = windows.GUID{Data1: 0xe1cd9fe7, Data2: 0xf4b5, Data3: 0x4273, Data4: [8]byte{0x96, 0xc0, 0x59, 0x2e, 0x48, 0x7b, 0x86, 0x50}}
+	fwpmLayerALEAuthRecvAcceptV6 = windows.GUID{Data1: 0xa3b42c97, Data2: 0x9f04, Data3: 0x4672, Data4: [8]byte{0xb8, 0x7e, 0xce, 0xe9, 0xc4, 0x83, 0x25, 0x7f}}
+
+	fwpmConditionALEAppID         = windows.GUID{Data1: 0xd78e1e87, Data2: 0x8644, Data3: 0x4ea5, Data4: [8]byte{0x94, 0x37, 0xd8, 0x09, 0xec, 0xef, 0xc9, 0x71}}
+	fwpmConditionIPRemoteAddress  = windows.GUID{Data1: 0xb235ae9a, Data2: 0x1d64, Data3: 0x49b8, Data4: [8]byte{0xa4, 0x4c, 0x5f, 0xf3, 0xd9, 0x09, 0x50, 0x45}}
+	fwpmConditionIPLocalInterface = windows.GUID{Data1: 0x4cd62a49, Data2: 0x59c3, Data3: 0x4969, Data4: [8]byte{0xb7, 0xf3, 0xbd, 0xa5, 0xd3, 0x28, 0x90, 0xa4}}
+	fwpmConditionFlags            = windows.GUID{Data1: 0x632ce23b, Data2: 0x5167, Data3: 0x435c, Data4: [8]byte{0x86, 0xd7, 0xe9, 0x03, 0x68, 0x4a, 0xa8, 0x0c}}
+	fwpmConditionIPProtocol       = windows.GUID{Data1: 0x3971ef2b, Data2: 0x623e, Data3: 0x4f9a, Data4: [8]byte{0x8c, 0xb1, 0x6e, 0x79, 0xb8, 0x06, 0xb9, 0xa7}}
+	fwpmConditionIPLocalPort      = windows.GUID{Data1: 0x0c1ba1af, Data2: 0x5765, Data3: 0x453f, Data4: [8]byte{0xaf, 0x22, 0xa8, 0xf7, 0x91, 0xac, 0x77, 0x5b}}
+	fwpmConditionIPRemotePort     = windows.GUID{Data1: 0xc35a604d, Data2: 0xd22b, Data3: 0x4e1a, Data4: [8]byte{0x91, 0xb4, 0x68, 0xf6, 0x74, 0xee, 0x67, 0x4b}}
+)
+
+// fwpmDisplayData0 is FWPM_DISPLAY_DATA0.
+type fwpmDisplayData0 struct {
+	name        *uint16
+	description *uint16
+}
+
+// fwpmSession0 is FWPM_SESSION0.
+type fwpmSession0 struct {
+	sessionKey           windows.GUID
+	displayData          fwpmDisplayData0
+	flags                uint32
+	txnWaitTimeoutInMSec uint32
+	processID            uint32
+	sid                  *windows.SID
+	username             *uint16
+	kernelMode           int32
+}
+
+// fwpByteBlob is FWP_BYTE_BLOB.
+type fwpByteBlob struct {
+	size uint32
+	data *uint8
+}
+
+// fwpV4AddrAndMask is FWP_V4_ADDR_AND_MASK, in host byte order.
+type fwpV4AddrAndMask struct {
+	addr uint32
+	mask uint32
+}
+
+// fwpV6AddrAndMask is FWP_V6_ADDR_AND_MASK.
+type fwpV6AddrAndMask struct {
+	addr         [16]byte
+	prefixLength uint8
+}
+
+// fwpmSublayer0 is FWPM_SUBLAYER0.
+type fwpmSublayer0 struct {
+	subLayerKey  windows.GUID
+	displayData  fwpmDisplayData0
+	flags        uint32
+	providerKey  *windows.GUID
+	providerData fwpByteBlob
+	weight       uint16
+}
+
+// fwpValue0 is FWP_VALUE0, and FWP_CONDITION_VALUE0, which has the
+// same layout: a type and a pointer-sized union holding values of up
+// to 32 bits, or a pointer to larger ones.
+type fwpValue0 struct {
+	typ   uint32
+	value uintptr
+}
+
+// fwpmFilterCondition0 is FWPM_FILTER_CONDITION0.
+type fwpmFilterCondition0 struct {
+	fieldKey       windows.GUID
+	matchType      uint32
+	conditionValue fwpValue0
+}
+
+// fwpmAction0 is FWPM_ACTION0.
+type fwpmAction0 struct {
+	typ        uint32
+	filterType windows.GUID
+}
+
+// fwpmFilter0 is FWPM_FILTER0. The padding fields give the 8-byte
+// alignment of its union of a UINT64 and a GUID, and of filterId,
+// which Go's types don't on all architectures.
+type fwpmFilter0 struct {
+	filterKey           windows.GUID
+	displayData         fwpmDisplayData0
+	flags               uint32
+	providerKey         *windows.GUID
+	providerData        fwpByteBlob
+	layerKey            windows.GUID
+	subLayerKey         windows.GUID
+	weight              fwpValue0
+	numFilterConditions uint32
+	filterCondition     *fwpmFilterCondition0
+	action              fwpmAction0
+	_                   [4]byte
+	providerContextKey  windows.GUID
+	reserved            *windows.GUID
+	_                   [8 - unsafe.Sizeof(uintptr(0))]byte
+	filterID            uint64
+	effectiveWeight     fwpValue0
+}
+
+func fwpmCall(p *windows.LazyProc, args ...uintptr) error {
+	r, _, _ := p.Call(args...)
+	if r != 0 {
+		return fmt.Errorf("%s: %w", p.Name, windows.Errno(r))
+	}
+	return nil
+}
+
+// wfpKillSwitch is a Windows Filtering Platform session whose filters
+// block all traffic, in and out, other than on the Tailscale
+// interface and loopback, tailscaled's own (to peers' endpoints, DERP
+// and the control server), DHCP, so the machine keeps its address,
+// and any local networks it's told to allow. The session is dynamic: its filters disappear when it's
+// closed, or when tailscaled exits, however it exits.
+type wfpKillSwitch struct {
+	engine windows.Handle
+}
+
+// newWFPKillSwitch puts the filters in place for the Tailscale
+// interface tunname, whose LUID is luid, permitting traffic to and
+// from the local networks lan.
+func newWFPKillSwitch(tunname string, luid uint64, lan []netaddr.IPPrefix) (*wfpKillSwitch, error) {
+	name, err := windows.UTF16PtrFromString("Tailscale")
+	if err != nil {
+		return nil, err
+	}
+	session := fwpmSession0{
+		displayData: fwpmDisplayData0{name: name},
+		flags:       fwpmSessionFlagDynamic,
+	}
+	k := new(wfpKillSwitch)
+	if err := fwpmCall(procFwpmEngineOpen0, 0, rpcCAuthnWinNT, 0, uintptr(unsafe.Pointer(&session)), uintptr(unsafe.Pointer(&k.engine))); err != nil {
+		return nil, err
+	}
+	if err := k.addFilters(tunname, luid, lan); err != nil {
+		k.Close()
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *wfpKillSwitch) addFilters(tunname string, luid uint64, lan []netaddr.IPPrefix) (err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe16, err := windows.UTF16PtrFromString(exe)
+	if err != nil {
+		return err
+	}
+	var appID *fwpByteBlob
+	if err := fwpmCall(procFwpmGetAppIdFromFileName0, uintptr(unsafe.Pointer(exe16)), uintptr(unsafe.Pointer(&appID))); err != nil {
+		return err
+	}
+	defer procFwpmFreeMemory0.Call(uintptr(unsafe.Pointer(&appID)))
+
+	if err := fwpmCall(procFwpmTransactionBegin0, uintptr(k.engine), 0); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			procFwpmTransactionAbort0.Call(uintptr(k.engine))
+		}
+	}()
+
+	name, err := windows.UTF16PtrFromString("Tailscale exit node lockdown")
+	if err != nil {
+		return err
+	}
+	sublayer := fwpmSublayer0{
+		subLayerKey: wfpSublayerKey(tunname),
+		displayData: fwpmDisplayData0{name: name},
+		weight:      0xffff, // evaluated before other sublayers
+	}
+	if err := fwpmCall(procFwpmSubLayerAdd0, uintptr(k.engine), uintptr(unsafe.Pointer(&sublayer)), 0); err != nil {
+		return err
+	}
+
+	cond := func(field windows.GUID, match, typ uint32, value uintptr) fwpmFilterCondition0 {
+		return fwpmFilterCondition0{
+			fieldKey:       field,
+			matchType:      match,
+			conditionValue: fwpValue0{typ: typ, value: value},
+		}
+	}
+	dhcp := func(clientPort, serverPort uint16) []fwpmFilterCondition0 {
+		return []fwpmFilterCondition0{
+			cond(fwpmConditionIPProtocol, fwpMatchEqual, fwpUint8, ipProtoUDP),
+			cond(fwpmConditionIPLocalPort, fwpMatchEqual, fwpUint16, uintptr(clientPort)),
+			cond(fwpmConditionIPRemotePort, fwpMatchEqual, fwpUint16, uintptr(serverPort)),
+		}
+	}
+	type permit struct {
+		name  string
+		v4    bool // only on IPv4 layers
+		v6    bool // only on IPv6 layers
+		conds []fwpmFilterCondition0
+	}
+	permits := []permit{
+		{name: "Tailscale interface", conds: []fwpmFilterCondition0{
+			cond(fwpmConditionIPLocalInterface, fwpMatchEqual, fwpUint64, uintptr(unsafe.Pointer(&luid))),
+		}},
+		{name: "loopback", conds: []fwpmFilterCondition0{
+			cond(fwpmConditionFlags, fwpMatchFlagsAllSet, fwpUint32, fwpConditionFlagIsLoopback),
+		}},
+		{name: "tailscaled", conds: []fwpmFilterCondition0{
+			cond(fwpmConditionALEAppID, fwpMatchEqual, fwpByteBlobType, uintptr(unsafe.Pointer(appID))),
+		}},
+		{name: "DHCP", v4: true, conds: dhcp(68, 67)},
+		{name: "DHCPv6", v6: true, conds: dhcp(546, 547)},
+	}
+	// The conditions point at the addresses, which must outlive
+	// the transaction.
+	var lanAddrs []interface{}
+	for _, p := range lan {
+		if p.IP.Is4() {
+			a4 := p.IP.As4()
+			m := &fwpV4AddrAndMask{addr: binary.BigEndian.Uint32(a4[:]), mask: ^uint32(0) << (32 - p.Bits)}
+			lanAddrs = append(lanAddrs, m)
+			permits = append(permits, permit{name: "LAN " + p.String(), v4: true, conds: []fwpmFilterCondition0{
+				cond(fwpmConditionIPRemoteAddress, fwpMatchEqual, fwpV4AddrMask, uintptr(unsafe.Pointer(m))),
+			}})
+		} else {
+			m := &fwpV6AddrAndMask{addr: p.IP.As16(), prefixLength: p.Bits}
+			lanAddrs = append(lanAddrs, m)
+			permits = append(permits, permit{name: "LAN " + p.String(), v6: true, conds: []fwpmFilterCondition0{
+				cond(fwpmConditionIPRemoteAddress, fwpMatchEqual, fwpV6AddrMask, uintptr(unsafe.Pointer(m))),
+			}})
+		}
+	}
+	for _, layer := range []struct {
+		key windows.GUID
+		v6  bool
+	}{
+		{fwpmLayerALEAuthConnectV4, false},
+		{fwpmLayerALEAuthConnectV6, true},
+		{fwpmLayerALEAuthRecvAcceptV4, false},
+		{fwpmLayerALEAuthRecvAcceptV6, true},
+	} {
+		for _, p := range permits {
+			if (p.v4 && layer.v6) || (p.v6 && !layer.v6) {
+				continue
+			}
+			if err := k.addFilter("Permit "+p.name, sublayer.subLayerKey, layer.key, fwpActionPermit, 0, 12, p.conds); err != nil {
+				return err
+			}
+		}
+		if err := k.addFilter("Block everything else", sublayer.subLayerKey, layer.key, fwpActionBlock, fwpmFilterFlagClearActionRight, 0, nil); err != nil {
+			return err
+		}
+	}
+	runtime.KeepAlive(&luid)
+	runtime.KeepAlive(appID)
+	runtime.KeepAlive(lanAddrs)
+
+	return fwpmCall(procFwpmTransactionCommit0, uintptr(k.engine))
+}
+
+// addFilter adds a filter that applies action to the traffic in layer
+// matching all of conds, at a weight from 0 to 15.
+func (k *wfpKillSwitch) addFilter(name string, sublayer, layer windows.GUID, action, flags uint32, weight uint8, conds []fwpmFilterCondition0) error {
+	name16, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	f := fwpmFilter0{
+		displayData:         fwpmDisplayData0{name: name16},
+		flags:               flags,
+		layerKey:            layer,
+		subLayerKey:         sublayer,
+		weight:              fwpValue0{typ: fwpUint8, value: uintptr(weight)},
+		numFilterConditions: uint32(len(conds)),
+		action:              fwpmAction0{typ: action},
+	}
+	if len(conds) > 0 {
+		f.filterCondition = &conds[0]
+	}
+	var id uint64
+	return fwpmCall(procFwpmFilterAdd0, uintptr(k.engine), uintptr(unsafe.Pointer(&f)), 0, uintptr(unsafe.Pointer(&id)))
+}
+
+// Close removes the filters.
+func (k *wfpKillSwitch) Close() error {
+	return fwpmCall(procFwpmEngineClose0, uintptr(k.engine))
+}
+
+// wfpSublayerKey returns the stable GUID of the sublayer holding the
+// filters for the Tailscale interface tunname, a name-based (version
+// 5 style) UUID, so that several tailscaled instances get their own.
+func wfpSublayerKey(tunname string) windows.GUID {
+	h := sha256.Sum256([]byte("tailscale wfp sublayer " + tunname))
+	h[6] = h[6]&0x0f | 0x50 // version 5
+	h[8] = h[8]&0x3f | 0x80 // RFC 4122 variant
+	g := windows.GUID{
+		Data1: binary.BigEndian.Uint32(h[0:4]),
+		Data2: binary.BigEndian.Uint16(h[4:6]),
+		Data3: binary.BigEndian.Uint16(h[6:8]),
+	}
+	copy(g.Data4[:], h[8:16])
+	return g
+}
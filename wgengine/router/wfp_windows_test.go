@@ -0,0 +1,35 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// TestWFPSizes checks the WFP types against the sizes of their C
+// counterparts, which fwpuclnt.dll reads without checking.
+func TestWFPSizes(t *testing.T) {
+	ptr := unsafe.Sizeof(uintptr(0))
+	tests := []struct {
+		name      string
+		got, want uintptr
+	}{
+		{"FWPM_SESSION0", unsafe.Sizeof(fwpmSession0{}), map[uintptr]uintptr{4: 48, 8: 72}[ptr]},
+		{"FWPM_SUBLAYER0", unsafe.Sizeof(fwpmSublayer0{}), map[uintptr]uintptr{4: 44, 8: 72}[ptr]},
+		{"FWPM_FILTER_CONDITION0", unsafe.Sizeof(fwpmFilterCondition0{}), map[uintptr]uintptr{4: 28, 8: 40}[ptr]},
+		{"FWPM_FILTER0", unsafe.Sizeof(fwpmFilter0{}), map[uintptr]uintptr{4: 152, 8: 200}[ptr]},
+		{"FWP_V4_ADDR_AND_MASK", unsafe.Sizeof(fwpV4AddrAndMask{}), 8},
+		{"FWP_V6_ADDR_AND_MASK", unsafe.Sizeof(fwpV6AddrAndMask{}), 17},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("sizeof(%s) = %d; want %d", tt.name, tt.got, tt.want)
+		}
+	}
+	if got, want := unsafe.Offsetof(fwpmFilter0{}.filterID), map[uintptr]uintptr{4: 136, 8: 176}[ptr]; got != want {
+		t.Errorf("offsetof(FWPM_FILTER0, filterId) = %d; want %d", got, want)
+	}
+}
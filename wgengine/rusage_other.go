@@ -0,0 +1,12 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build plan9 js
+
+package wgengine
+
+func rusageMaxRSS() float64 {
+	// Neither Plan 9 nor js/wasm has Getrusage.
+	return 0
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/metrics"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/packet"
+	"tailscale.com/wgengine/tstun"
+)
+
+// SLAProbeConfig configures the engine's latency and loss probes,
+// which measure the tailnet's quality between designated nodes.
+// See Engine.SetSLAProbes.
+type SLAProbeConfig struct {
+	// Targets are the peers to probe: Tailscale IPs, or ACL tags
+	// ("tag:name") meaning every peer with that tag.
+	Targets []string
+
+	// IfTag, if non-empty, is an ACL tag this node must have to
+	// send probes. It lets the same config be deployed to every
+	// node, with only the tagged ones probing.
+	IfTag string
+
+	// Interval is how often each target is probed. If zero,
+	// DefaultSLAProbeInterval is used.
+	Interval time.Duration
+}
+
+// DefaultSLAProbeInterval is the default SLAProbeConfig.Interval.
+const DefaultSLAProbeInterval = time.Minute
+
+const (
+	slaProbeCount   = 5                      // ICMP echo requests per target per round
+	slaProbeSpacing = 200 * time.Millisecond // between a round's requests to a target
+	slaProbeTimeout = 2 * time.Second        // for replies, after the last request
+)
+
+// slaProbeMagic starts the payload of each probe, followed by a
+// 64-bit probe number.
+var slaProbeMagic = []byte("tailscale-sla-probe")
+
+// Probe results, by peer Tailscale IP, exported to Prometheus by
+// tsweb's /debug/varz handler.
+var (
+	slaProbesSent = &metrics.LabelMap{Label: "peer"}
+	slaProbesLost = &metrics.LabelMap{Label: "peer"}
+	slaProbeRTT   = &metrics.LabelMap{Label: "peer"} // mean of last round, in microseconds
+)
+
+func init() {
+	expvar.Publish("counter_sla_probes_sent", slaProbesSent)
+	expvar.Publish("counter_sla_probes_lost", slaProbesLost)
+	expvar.Publish("gauge_sla_probe_rtt_us", slaProbeRTT)
+}
+
+// slaProber matches probe replies to the probes of the current round.
+type slaProber struct {
+	mu     sync.Mutex
+	next   uint64               // number of the next probe
+	probes map[uint64]*slaProbe // of the current round; nil between rounds
+}
+
+type slaProbe struct {
+	dst     packet.IP
+	sent    time.Time
+	replied bool
+	rtt     time.Duration // if replied
+}
+
+// add records a probe to dst sent now and returns its number.
+func (p *slaProber) add(dst packet.IP) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := p.next
+	p.next++
+	if p.probes != nil {
+		p.probes[n] = &slaProbe{dst: dst, sent: time.Now()}
+	}
+	return n
+}
+
+// handleReply is an inbound pre-filter consuming the replies to
+// probes. Other packets pass through.
+func (p *slaProber) handleReply(q *packet.ParsedPacket, t *tstun.TUN) filter.Response {
+	if q.IPProto != packet.ICMP || !q.IsEchoResponse() {
+		return filter.Accept
+	}
+	payload := q.Payload()
+	if !bytes.HasPrefix(payload, slaProbeMagic) || len(payload) < len(slaProbeMagic)+8 {
+		return filter.Accept
+	}
+	n := binary.BigEndian.Uint64(payload[len(slaProbeMagic):])
+	p.mu.Lock()
+	if sp := p.probes[n]; sp != nil && !sp.replied && sp.dst == q.SrcIP {
+		sp.rtt = time.Since(sp.sent)
+		sp.replied = true
+	}
+	p.mu.Unlock()
+	return filter.Drop
+}
+
+func (e *userspaceEngine) SetSLAProbes(cfg SLAProbeConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.slaStop != nil {
+		close(e.slaStop)
+		e.slaStop = nil
+	}
+	if len(cfg.Targets) == 0 {
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultSLAProbeInterval
+	}
+	e.slaStop = make(chan struct{})
+	go e.runSLAProbes(cfg, e.slaStop)
+}
+
+// runSLAProbes runs a round of probes every cfg.Interval, until stop
+// is closed or the engine is.
+func (e *userspaceEngine) runSLAProbes(cfg SLAProbeConfig, stop chan struct{}) {
+	t := time.NewTicker(cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-e.waitCh:
+			return
+		case <-t.C:
+		}
+		nm, _ := e.netMap.Load().(*controlclient.NetworkMap)
+		if nm == nil {
+			continue
+		}
+		self, ok := firstIPv4(nm.Addresses)
+		if !ok {
+			continue
+		}
+		if cfg.IfTag != "" && !hasTag(nm.Tags, cfg.IfTag) {
+			continue
+		}
+		targets := slaProbeTargets(nm, cfg.Targets)
+		if len(targets) == 0 {
+			continue
+		}
+		e.slaProbeRound(self, targets, stop)
+	}
+}
+
+// slaProbeRound probes each of dsts slaProbeCount times and records
+// the results in the metrics.
+func (e *userspaceEngine) slaProbeRound(src packet.IP, dsts []packet.IP, stop chan struct{}) {
+	probes := map[uint64]*slaProbe{}
+	e.sla.mu.Lock()
+	e.sla.probes = probes
+	e.sla.mu.Unlock()
+	defer func() {
+		e.sla.mu.Lock()
+		e.sla.probes = nil
+		e.sla.mu.Unlock()
+	}()
+
+	header := packet.ICMPHeader{
+		IPHeader: packet.IPHeader{SrcIP: src},
+		Type:     packet.ICMPEchoRequest,
+		Code:     packet.ICMPNoCode,
+	}
+	payload := make([]byte, len(slaProbeMagic)+8)
+	copy(payload, slaProbeMagic)
+	for i := 0; i < slaProbeCount; i++ {
+		if i > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(slaProbeSpacing):
+			}
+		}
+		for _, dst := range dsts {
+			header.DstIP = dst
+			header.IPID++
+			binary.BigEndian.PutUint64(payload[len(slaProbeMagic):], e.sla.add(dst))
+			// InjectOutbound takes ownership of the packet, so
+			// generate a new one each time.
+			if err := e.tundev.InjectOutbound(packet.Generate(&header, payload)); err != nil {
+				return
+			}
+		}
+	}
+	select {
+	case <-stop:
+		return
+	case <-time.After(slaProbeTimeout):
+	}
+
+	e.sla.mu.Lock()
+	defer e.sla.mu.Unlock()
+	type result struct {
+		sent, lost int64
+		rttSum     time.Duration
+	}
+	results := map[packet.IP]*result{}
+	for _, sp := range probes {
+		r := results[sp.dst]
+		if r == nil {
+			r = new(result)
+			results[sp.dst] = r
+		}
+		r.sent++
+		if !sp.replied {
+			r.lost++
+		} else {
+			r.rttSum += sp.rtt
+		}
+	}
+	for dst, r := range results {
+		peer := dst.String()
+		slaProbesSent.Get(peer).Add(r.sent)
+		slaProbesLost.Get(peer).Add(r.lost)
+		if r.lost < r.sent {
+			mean := r.rttSum / time.Duration(r.sent-r.lost)
+			slaProbeRTT.Get(peer).Set(mean.Microseconds())
+		}
+		if r.lost > 0 {
+			e.logf("wgengine: SLA probes to %s: %d of %d lost", peer, r.lost, r.sent)
+		}
+	}
+}
+
+// slaProbeTargets returns the Tailscale IPs of the peers in nm that
+// match targets, as documented at SLAProbeConfig.Targets.
+func slaProbeTargets(nm *controlclient.NetworkMap, targets []string) []packet.IP {
+	var ret []packet.IP
+	for _, peer := range nm.Peers {
+		ip, ok := firstIPv4(peer.Addresses)
+		if !ok {
+			continue
+		}
+		for _, t := range targets {
+			if strings.HasPrefix(t, "tag:") && hasTag(peer.Tags, t) || t == ip.String() {
+				ret = append(ret, ip)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// firstIPv4 returns the first IPv4 address of addrs. Probes are
+// IPv4-only, like the rest of the packet package.
+func firstIPv4(addrs []wgcfg.CIDR) (ip packet.IP, ok bool) {
+	for _, addr := range addrs {
+		// TODO: ipv6
+		if addr.IP.Is4() {
+			return packet.NewIP(addr.IP.IP()), true
+		}
+	}
+	return 0, false
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
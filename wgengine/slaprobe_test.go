@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/packet"
+)
+
+func TestSLAProbeTargets(t *testing.T) {
+	nm := &controlclient.NetworkMap{
+		Peers: []*tailcfg.Node{
+			testNode(t, "100.1.1.1", "tag:dc"),
+			testNode(t, "100.2.2.2"),
+			testNode(t, "100.3.3.3", "tag:office", "tag:dc"),
+			testNode(t, "100.4.4.4", "tag:office"),
+			testNode(t, "fd7a:115c:a1e0::5,100.5.5.5", "tag:dc"),
+			testNode(t, "fd7a:115c:a1e0::6", "tag:dc"),
+		},
+	}
+	ip := func(s string) packet.IP { return packet.NewIP(net.ParseIP(s)) }
+
+	got := slaProbeTargets(nm, []string{"tag:dc", "100.2.2.2", "100.9.9.9"})
+	want := []packet.IP{ip("100.1.1.1"), ip("100.2.2.2"), ip("100.3.3.3"), ip("100.5.5.5")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("targets = %v; want %v", got, want)
+	}
+}
+
+func TestFirstIPv4(t *testing.T) {
+	tests := []struct {
+		addrs  string
+		want   string
+		wantOK bool
+	}{
+		{"100.1.1.1", "100.1.1.1", true},
+		{"fd7a:115c:a1e0::1,100.1.1.1", "100.1.1.1", true},
+		{"fd7a:115c:a1e0::1", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := firstIPv4(testNode(t, tt.addrs).Addresses)
+		if ok != tt.wantOK || ok && got.String() != tt.want {
+			t.Errorf("firstIPv4(%q) = %v, %v; want %v, %v", tt.addrs, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// testNode returns a node with the comma-separated addresses addrs,
+// each a single IP, and tags.
+func testNode(t *testing.T, addrs string, tags ...string) *tailcfg.Node {
+	t.Helper()
+	n := &tailcfg.Node{Tags: tags}
+	for _, a := range strings.Split(addrs, ",") {
+		if a == "" {
+			continue
+		}
+		bits := "/32"
+		if strings.Contains(a, ":") {
+			bits = "/128"
+		}
+		cidr, err := wgcfg.ParseCIDR(a + bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Addresses = append(n.Addresses, cidr)
+	}
+	return n
+}
+
+func TestSLAProbeReply(t *testing.T) {
+	var p slaProber
+	peer := packet.NewIP(net.ParseIP("100.1.1.1"))
+	self := packet.NewIP(net.ParseIP("100.5.5.5"))
+	p.probes = map[uint64]*slaProbe{}
+	n := p.add(peer)
+
+	reply := func(src packet.IP, payload []byte) *packet.ParsedPacket {
+		h := packet.ICMPHeader{
+			IPHeader: packet.IPHeader{SrcIP: src, DstIP: self},
+			Type:     packet.ICMPEchoReply,
+		}
+		q := new(packet.ParsedPacket)
+		q.Decode(packet.Generate(&h, payload))
+		return q
+	}
+	payload := make([]byte, len(slaProbeMagic)+8)
+	copy(payload, slaProbeMagic)
+	binary.BigEndian.PutUint64(payload[len(slaProbeMagic):], n)
+
+	if got := p.handleReply(reply(peer, []byte("not a probe")), nil); got != filter.Accept {
+		t.Errorf("other echo reply: got %v; want Accept", got)
+	}
+	if got := p.handleReply(reply(self, payload), nil); got != filter.Drop {
+		t.Errorf("probe reply from wrong peer: got %v; want Drop", got)
+	}
+	if p.probes[n].replied {
+		t.Errorf("probe reply from wrong peer was counted")
+	}
+	if got := p.handleReply(reply(peer, payload), nil); got != filter.Drop {
+		t.Errorf("probe reply: got %v; want Drop", got)
+	}
+	if !p.probes[n].replied {
+		t.Errorf("probe reply wasn't counted")
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"container/list"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// cacheMinTTL is the least time a response is cached for, even if
+	// its records have shorter TTLs, so that names with TTLs of zero
+	// or a few seconds don't cost a round trip to the upstream
+	// nameservers on every lookup.
+	cacheMinTTL = 5 * time.Second
+	// cacheMaxTTL is the most time a response is cached for, whatever
+	// the TTLs of its records.
+	cacheMaxTTL = time.Hour
+	// cacheMaxNegativeTTL is the most time a response saying a name or
+	// record doesn't exist is cached for. It's short, so that a newly
+	// created record is found soon.
+	cacheMaxNegativeTTL = 5 * time.Minute
+	// cacheMaxBytes is roughly how much memory cached responses may use.
+	// The least recently used ones are evicted to stay below it.
+	cacheMaxBytes = 1 << 20
+	// cacheEntryOverhead approximates the memory used by an entry
+	// beyond its response.
+	cacheEntryOverhead = 200
+)
+
+// disableCache turns off caching of upstream responses, for debugging.
+var disableCache, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_DNS_NO_CACHE"))
+
+type cacheKey struct {
+	name  string // lowercase, with a trailing period
+	typ   dns.Type
+	class dns.Class
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     dns.Message
+	size    int
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCache is an LRU cache of responses from upstream
+// nameservers. A nil *responseCache caches nothing.
+type responseCache struct {
+	now func() time.Time // time.Now, or a fake clock in tests
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element // values are *cacheEntry
+	lru     list.List                  // most recently used at the front
+	size    int                        // sum of the entries' sizes
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		now:     time.Now,
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+func keyFor(q dns.Question) cacheKey {
+	return cacheKey{
+		name:  strings.ToLower(q.Name.String()),
+		typ:   q.Type,
+		class: q.Class,
+	}
+}
+
+// get returns the cached response to the query with header h and
+// question q, with the TTLs of its records reduced by the time since
+// it was cached.
+func (c *responseCache) get(h dns.Header, q dns.Question) ([]byte, bool) {
+	if c == nil || h.OpCode != 0 {
+		return nil, false
+	}
+	key := keyFor(q)
+	now := c.now()
+
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.removeLocked(el)
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	msg := e.msg
+	stored := e.stored
+	c.mu.Unlock()
+
+	age := uint32(now.Sub(stored) / time.Second)
+	msg.Header.ID = h.ID
+	msg.Header.RecursionDesired = h.RecursionDesired
+	// Answer with the name as asked, which may differ in case.
+	msg.Questions = []dns.Question{q}
+	msg.Answers = aged(msg.Answers, age)
+	msg.Authorities = aged(msg.Authorities, age)
+	msg.Additionals = aged(msg.Additionals, age)
+	out, err := msg.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+// aged returns a copy of rrs with age subtracted from their TTLs.
+// The records' bodies are shared.
+func aged(rrs []dns.Resource, age uint32) []dns.Resource {
+	if len(rrs) == 0 {
+		return nil
+	}
+	ret := make([]dns.Resource, len(rrs))
+	for i, rr := range rrs {
+		if rr.Header.TTL > age {
+			rr.Header.TTL -= age
+		} else {
+			rr.Header.TTL = 0
+		}
+		ret[i] = rr
+	}
+	return ret
+}
+
+// put caches resp, the response to a query for q, if it can be.
+// Successful responses are cached for the lowest TTL of their answers,
+// and NXDOMAIN and empty responses for the time their SOA record
+// allows (RFC 2308), within the cache's limits. Other responses
+// aren't cached.
+func (c *responseCache) put(q dns.Question, resp []byte) {
+	if c == nil {
+		return
+	}
+	var msg dns.Message
+	if err := msg.Unpack(resp); err != nil {
+		return
+	}
+	if msg.Header.Truncated || len(msg.Questions) != 1 || keyFor(msg.Questions[0]) != keyFor(q) {
+		return
+	}
+	ttl, ok := cacheTTL(&msg)
+	if !ok {
+		return
+	}
+
+	// The OPT record is a property of the exchange, not of the
+	// answer, and doesn't belong in responses to other queries.
+	var additionals []dns.Resource
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type != dns.TypeOPT {
+			additionals = append(additionals, rr)
+		}
+	}
+	msg.Additionals = additionals
+
+	key := keyFor(q)
+	now := c.now()
+	e := &cacheEntry{
+		key:     key,
+		msg:     msg,
+		size:    len(resp) + len(key.name) + cacheEntryOverhead,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.removeLocked(el)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.size += e.size
+	for c.size > cacheMaxBytes {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// cacheTTL returns how long msg may be cached for, and whether it may
+// be cached at all.
+func cacheTTL(msg *dns.Message) (time.Duration, bool) {
+	switch {
+	case msg.Header.RCode == dns.RCodeSuccess && len(msg.Answers) > 0:
+		ttl := msg.Answers[0].Header.TTL
+		for _, rr := range msg.Answers[1:] {
+			if rr.Header.TTL < ttl {
+				ttl = rr.Header.TTL
+			}
+		}
+		return clampTTL(ttl, cacheMaxTTL), true
+	case msg.Header.RCode == dns.RCodeSuccess, msg.Header.RCode == dns.RCodeNameError:
+		for _, rr := range msg.Authorities {
+			soa, ok := rr.Body.(*dns.SOAResource)
+			if !ok {
+				continue
+			}
+			ttl := rr.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			return clampTTL(ttl, cacheMaxNegativeTTL), true
+		}
+		// Without an SOA record, a negative response mustn't be
+		// cached.
+		return 0, false
+	default:
+		return 0, false
+	}
+}
+
+func clampTTL(ttl uint32, max time.Duration) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if d < cacheMinTTL {
+		return cacheMinTTL
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+// flush removes all cached responses.
+func (c *responseCache) flush() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+	c.size = 0
+}
+
+func (c *responseCache) removeLocked(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+)
+
+// cacheResponse returns a response to a query for name with the given
+// rcode, holding an A record with aTTL if it's nonzero, and an SOA
+// record with soaTTL if that's nonzero.
+func cacheResponse(t *testing.T, name string, rcode dns.RCode, aTTL, soaTTL uint32) []byte {
+	t.Helper()
+	q := dns.Question{Name: dns.MustNewName(name), Type: dns.TypeA, Class: dns.ClassINET}
+	b := dns.NewBuilder(nil, dns.Header{ID: 1, Response: true, RCode: rcode})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	if aTTL != 0 {
+		h := dns.ResourceHeader{Name: q.Name, Type: dns.TypeA, Class: dns.ClassINET, TTL: aTTL}
+		b.AResource(h, dns.AResource{A: [4]byte{192, 0, 2, 1}})
+	}
+	b.StartAuthorities()
+	if soaTTL != 0 {
+		h := dns.ResourceHeader{Name: dns.MustNewName("example.com."), Type: dns.TypeSOA, Class: dns.ClassINET, TTL: soaTTL}
+		b.SOAResource(h, dns.SOAResource{
+			NS:     dns.MustNewName("ns.example.com."),
+			MBox:   dns.MustNewName("hostmaster.example.com."),
+			MinTTL: 60,
+		})
+	}
+	out, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func question(name string) dns.Question {
+	return dns.Question{Name: dns.MustNewName(name), Type: dns.TypeA, Class: dns.ClassINET}
+}
+
+func TestResponseCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newResponseCache()
+	c.now = func() time.Time { return now }
+
+	c.put(question("www.example.com."), cacheResponse(t, "www.example.com.", dns.RCodeSuccess, 30, 0))
+
+	now = now.Add(10 * time.Second)
+	out, ok := c.get(dns.Header{ID: 42, RecursionDesired: true}, question("WWW.Example.com."))
+	if !ok {
+		t.Fatal("response not cached")
+	}
+	var msg dns.Message
+	if err := msg.Unpack(out); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.ID != 42 || !msg.Header.RecursionDesired {
+		t.Errorf("header = %+v; want ID 42 and RecursionDesired", msg.Header)
+	}
+	if got := msg.Questions[0].Name.String(); got != "WWW.Example.com." {
+		t.Errorf("question name = %q; want the name as asked", got)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != 20 {
+		t.Errorf("answers = %+v; want one with TTL 20", msg.Answers)
+	}
+
+	now = now.Add(20 * time.Second)
+	if _, ok := c.get(dns.Header{}, question("www.example.com.")); ok {
+		t.Error("expired response returned")
+	}
+	if len(c.entries) != 0 || c.size != 0 {
+		t.Errorf("expired response not removed: %d entries, size %d", len(c.entries), c.size)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		rcode  dns.RCode
+		aTTL   uint32
+		soaTTL uint32
+		want   time.Duration
+		ok     bool
+	}{
+		{"answer", dns.RCodeSuccess, 300, 0, 300 * time.Second, true},
+		{"answer_short", dns.RCodeSuccess, 1, 0, cacheMinTTL, true},
+		{"answer_long", dns.RCodeSuccess, 86400, 0, cacheMaxTTL, true},
+		{"nxdomain", dns.RCodeNameError, 0, 3600, 60 * time.Second, true},
+		{"nxdomain_soa_ttl", dns.RCodeNameError, 0, 30, 30 * time.Second, true},
+		{"nodata", dns.RCodeSuccess, 0, 3600, 60 * time.Second, true},
+		{"nxdomain_no_soa", dns.RCodeNameError, 0, 0, 0, false},
+		{"servfail", dns.RCodeServerFailure, 0, 3600, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg dns.Message
+			if err := msg.Unpack(cacheResponse(t, "example.com.", tt.rcode, tt.aTTL, tt.soaTTL)); err != nil {
+				t.Fatal(err)
+			}
+			got, ok := cacheTTL(&msg)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("cacheTTL = %v, %v; want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	c := newResponseCache()
+	n := 0
+	for c.lru.Len() == n {
+		name := fmt.Sprintf("host%d.example.com.", n)
+		c.put(question(name), cacheResponse(t, name, dns.RCodeSuccess, 300, 0))
+		n++
+		if n > cacheMaxBytes {
+			t.Fatal("cache never evicted")
+		}
+	}
+	if c.size > cacheMaxBytes {
+		t.Errorf("size = %d; want at most %d", c.size, cacheMaxBytes)
+	}
+	if _, ok := c.get(dns.Header{}, question("host0.example.com.")); ok {
+		t.Error("least recently used response not evicted")
+	}
+	name := fmt.Sprintf("host%d.example.com.", n-1)
+	if _, ok := c.get(dns.Header{}, question(name)); !ok {
+		t.Error("newest response evicted")
+	}
+
+	c.flush()
+	if c.lru.Len() != 0 || c.size != 0 {
+		t.Errorf("flush left %d entries, size %d", c.lru.Len(), c.size)
+	}
+}
+
+func TestResponseCacheSkips(t *testing.T) {
+	c := newResponseCache()
+
+	truncated := cacheResponse(t, "example.com.", dns.RCodeSuccess, 300, 0)
+	truncated[2] |= 0x02 // TC bit
+	c.put(question("example.com."), truncated)
+	// A response for a different name than was asked.
+	c.put(question("example.net."), cacheResponse(t, "example.com.", dns.RCodeSuccess, 300, 0))
+	if c.lru.Len() != 0 {
+		t.Errorf("%d responses cached; want none", c.lru.Len())
+	}
+
+	var nilCache *responseCache
+	nilCache.put(question("example.com."), cacheResponse(t, "example.com.", dns.RCodeSuccess, 300, 0))
+	if _, ok := nilCache.get(dns.Header{}, question("example.com.")); ok {
+		t.Error("nil cache returned a response")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/tlsdial"
+)
+
+// dohTimeout is how long a query over DNS-over-HTTPS may take before
+// it's retried over plain DNS, leaving the rest of delegateTimeout for
+// that.
+const dohTimeout = 2 * time.Second
+
+// dohRetryInterval is how long a DoH endpoint that failed is skipped
+// for, so that every query doesn't wait on an unreachable endpoint.
+const dohRetryInterval = time.Minute
+
+var (
+	errDoHBackoff  = errors.New("DoH endpoint failed recently")
+	errDoHTooLarge = errors.New("DoH response too large")
+)
+
+// dohEndpoints maps the addresses of public resolvers to their
+// DNS-over-HTTPS (RFC 8484) endpoints. Queries forwarded to these
+// addresses on port 53 go over HTTPS instead.
+var dohEndpoints = map[netaddr.IP]string{}
+
+func init() {
+	for ep, ips := range map[string][]string{
+		"https://cloudflare-dns.com/dns-query": {"1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001"},
+		"https://dns.google/dns-query":         {"8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844"},
+		"https://dns.quad9.net/dns-query":      {"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"},
+		"https://dns.nextdns.io/":              {"45.90.28.0", "45.90.30.0"},
+	} {
+		for _, s := range ips {
+			ip, err := netaddr.ParseIP(s)
+			if err != nil {
+				panic(err)
+			}
+			dohEndpoints[ip] = ep
+		}
+	}
+}
+
+// dohEndpoint returns the DoH endpoint to use in place of server, a
+// nameserver address of the form ip:port, if there is one.
+func dohEndpoint(server string) (string, bool) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil || port != "53" {
+		return "", false
+	}
+	ip, err := netaddr.ParseIP(host)
+	if err != nil {
+		return "", false
+	}
+	ep, ok := dohEndpoints[ip]
+	return ep, ok
+}
+
+// dohClient holds the HTTP client for one DoH endpoint reached at one
+// address, and whether it's currently failing.
+type dohClient struct {
+	http *http.Client
+
+	mu        sync.Mutex
+	failUntil time.Time // skip the endpoint until then
+}
+
+// dohClientFor returns the client for querying endpoint at server.
+// Clients, and so their connections, are reused across queries.
+func (r *Resolver) dohClientFor(endpoint, server string) (*dohClient, error) {
+	r.dohMu.Lock()
+	defer r.dohMu.Unlock()
+	if c, ok := r.dohClients[server]; ok {
+		return c, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	ip, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = nil
+	// Dial the resolver's address rather than resolving the
+	// endpoint's name, which would need DNS to work already.
+	tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return r.dialer.DialContext(ctx, network, net.JoinHostPort(ip, "443"))
+	}
+	tr.ForceAttemptHTTP2 = true
+	tr.TLSClientConfig = tlsdial.Config(u.Hostname(), tr.TLSClientConfig)
+	if r.dohClients == nil {
+		r.dohClients = make(map[string]*dohClient)
+	}
+	c := &dohClient{http: &http.Client{Transport: tr}}
+	r.dohClients[server] = c
+	return c, nil
+}
+
+// queryDoH sends query to endpoint, the DoH endpoint of server.
+func (r *Resolver) queryDoH(ctx context.Context, endpoint, server string, query []byte) ([]byte, error) {
+	c, err := r.dohClientFor(endpoint, server)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	skip := time.Now().Before(c.failUntil)
+	c.mu.Unlock()
+	if skip {
+		return nil, errDoHBackoff
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dohTimeout)
+	defer cancel()
+	out, err := c.do(ctx, endpoint, query)
+	if err != nil && err != errDoHTooLarge && ctx.Err() != context.Canceled {
+		c.mu.Lock()
+		c.failUntil = time.Now().Add(dohRetryInterval)
+		c.mu.Unlock()
+	}
+	return out, err
+}
+
+func (c *dohClient) do(ctx context.Context, endpoint string, query []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", endpoint, res.Status)
+	}
+	// Responses go back over UDP, so larger ones are left to plain
+	// DNS, which truncates them and lets the client retry over TCP.
+	out, err := ioutil.ReadAll(io.LimitReader(res.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxResponseSize {
+		return nil, errDoHTooLarge
+	}
+	return out, nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDoHEndpoint(t *testing.T) {
+	tests := []struct {
+		server string
+		want   string
+	}{
+		{"1.1.1.1:53", "https://cloudflare-dns.com/dns-query"},
+		{"[2001:4860:4860::8888]:53", "https://dns.google/dns-query"},
+		{"9.9.9.9:53", "https://dns.quad9.net/dns-query"},
+		{"1.1.1.1:5353", ""},
+		{"10.0.0.1:53", ""},
+		{"bogus", ""},
+	}
+	for _, tt := range tests {
+		got, ok := dohEndpoint(tt.server)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("dohEndpoint(%q) = %q, %v; want %q", tt.server, got, ok, tt.want)
+		}
+	}
+}
+
+func TestDoHClient(t *testing.T) {
+	query := dnspacket("test1.ipn.dev.", dns.TypeA)
+	var resp []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/dns-message" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if !bytes.Equal(body, query) {
+			t.Errorf("body = %x; want %x", body, query)
+		}
+		w.Write(resp)
+	}))
+	defer srv.Close()
+	c := &dohClient{http: srv.Client()}
+
+	resp = validIPv4Response
+	out, err := c.do(context.Background(), srv.URL, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, validIPv4Response) {
+		t.Errorf("response = %x; want %x", out, validIPv4Response)
+	}
+
+	resp = make([]byte, maxResponseSize+1)
+	if _, err := c.do(context.Background(), srv.URL, query); err != errDoHTooLarge {
+		t.Errorf("large response: err = %v; want %v", err, errDoHTooLarge)
+	}
+}
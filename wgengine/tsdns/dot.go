@@ -0,0 +1,148 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"tailscale.com/net/tlsdial"
+)
+
+// dotPrefix starts the addresses of DNS-over-TLS nameservers in
+// Upstreams.
+const dotPrefix = "tls://"
+
+var errDoTTooLarge = errors.New("DoT response too large")
+
+// DoTAddr returns the Upstreams address of the DNS-over-TLS (RFC 7858)
+// nameserver at addr, of the form ip:port, whose certificate must be
+// valid for serverName.
+func DoTAddr(addr, serverName string) string {
+	return dotPrefix + addr + "#" + serverName
+}
+
+// parseDoTAddr returns the address and certificate name of server if
+// it's a DoTAddr.
+func parseDoTAddr(server string) (addr, serverName string, ok bool) {
+	if !strings.HasPrefix(server, dotPrefix) {
+		return "", "", false
+	}
+	s := server[len(dotPrefix):]
+	i := strings.LastIndexByte(s, '#')
+	if i < 0 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// queryDoT sends query to the DoT nameserver server, a DoTAddr. The
+// connection is kept for the next query to the same server, as RFC
+// 7858 recommends, so that most queries skip the TLS handshake.
+func (r *Resolver) queryDoT(ctx context.Context, server string, query []byte) ([]byte, error) {
+	addr, serverName, ok := parseDoTAddr(server)
+	if !ok {
+		return nil, fmt.Errorf("invalid DoT nameserver %q", server)
+	}
+
+	if conn := r.takeDoTConn(server); conn != nil {
+		out, err := dotExchange(ctx, conn, query)
+		if err == nil {
+			r.putDoTConn(server, conn)
+			return out, nil
+		}
+		conn.Close()
+		if ctx.Err() != nil || err == errDoTTooLarge {
+			return nil, err
+		}
+		// The server probably closed the idle connection;
+		// retry on a new one.
+	}
+
+	raw, err := r.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, tlsdial.Config(serverName, nil))
+	out, err := dotExchange(ctx, conn, query)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r.putDoTConn(server, conn)
+	return out, nil
+}
+
+// takeDoTConn removes and returns the idle connection to server, if
+// there is one.
+func (r *Resolver) takeDoTConn(server string) *tls.Conn {
+	r.dotMu.Lock()
+	defer r.dotMu.Unlock()
+	conn := r.dotConns[server]
+	delete(r.dotConns, server)
+	return conn
+}
+
+// putDoTConn keeps conn as the idle connection to server. If there
+// already is one, from a concurrent query, conn is closed instead.
+func (r *Resolver) putDoTConn(server string, conn *tls.Conn) {
+	r.dotMu.Lock()
+	defer r.dotMu.Unlock()
+	if _, ok := r.dotConns[server]; ok {
+		conn.Close()
+		return
+	}
+	if r.dotConns == nil {
+		r.dotConns = make(map[string]*tls.Conn)
+	}
+	r.dotConns[server] = conn
+}
+
+// dotExchange writes query to conn and reads the response, both
+// prefixed by their length as in DNS over TCP.
+func dotExchange(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	// Interrupt the exchange when the context is cancelled.
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > maxResponseSize {
+		// Responses go back over UDP, which they wouldn't fit.
+		return nil, errDoTTooLarge
+	}
+	out := make([]byte, n)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return out, nil
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseDoTAddr(t *testing.T) {
+	server := DoTAddr("[fd00::1]:853", "dns.example.com")
+	addr, name, ok := parseDoTAddr(server)
+	if !ok || addr != "[fd00::1]:853" || name != "dns.example.com" {
+		t.Errorf("parseDoTAddr(%q) = %q, %q, %v", server, addr, name, ok)
+	}
+	for _, s := range []string{"10.0.0.1:53", "tls://10.0.0.1:853"} {
+		if _, _, ok := parseDoTAddr(s); ok {
+			t.Errorf("parseDoTAddr(%q) ok; want not ok", s)
+		}
+	}
+}
+
+func TestDoTExchange(t *testing.T) {
+	query := []byte("query")
+	resp := []byte("response")
+
+	serve := func(conn net.Conn, resp []byte) {
+		defer conn.Close()
+		var hdr [2]byte
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			t.Error(err)
+			return
+		}
+		got := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.Equal(got, query) {
+			t.Errorf("server got %q; want %q", got, query)
+		}
+		binary.BigEndian.PutUint16(hdr[:], uint16(len(resp)))
+		conn.Write(append(hdr[:], resp...))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, s := net.Pipe()
+	go serve(s, resp)
+	out, err := dotExchange(ctx, c, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, resp) {
+		t.Errorf("got %q; want %q", out, resp)
+	}
+
+	c, s = net.Pipe()
+	go serve(s, make([]byte, maxResponseSize+1))
+	if _, err := dotExchange(ctx, c, query); err != errDoTTooLarge {
+		t.Errorf("large response: err = %v; want %v", err, errDoTTooLarge)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/logger"
+)
+
+// debugQueryLog, if set, is the path of a file to which the name,
+// type and outcome of each query is appended, for diagnosing
+// resolution failures. Query names aren't logged otherwise, so that
+// they don't leave the machine.
+var debugQueryLog = os.Getenv("TS_DEBUG_DNS_QUERY_LOG")
+
+// Metrics counts the queries a Resolver has answered.
+type Metrics struct {
+	Queries   int64 // all queries answered
+	Local     int64 // answered from the map, including errors
+	CacheHits int64 // answered from the cache of upstream responses
+	Forwarded int64 // answered by upstream nameservers
+	// UpstreamFailures counts queries that were to be forwarded,
+	// but that no upstream nameserver answered.
+	UpstreamFailures int64
+	// Upstreams are the counts for each upstream nameserver
+	// queried, by address.
+	Upstreams map[string]UpstreamMetrics
+}
+
+// UpstreamMetrics counts the queries sent to one upstream nameserver.
+type UpstreamMetrics struct {
+	Queries  int64
+	Failures int64 // queries that failed or timed out
+	// TotalLatency is how long the queries that succeeded took
+	// altogether, and MaxLatency how long the slowest took.
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+// The ways a query can be answered, for Metrics and the query log.
+const (
+	answeredLocal = iota
+	answeredCache
+	answeredUpstream
+	answeredFailure
+)
+
+var answeredNames = [...]string{
+	answeredLocal:    "local",
+	answeredCache:    "cache",
+	answeredUpstream: "upstream",
+	answeredFailure:  "upstream failure",
+}
+
+// Metrics returns the counts of the queries r has answered since it
+// was created.
+func (r *Resolver) Metrics() Metrics {
+	r.metricsMu.Lock()
+	defer r.metricsMu.Unlock()
+	m := r.metrics
+	m.Upstreams = make(map[string]UpstreamMetrics, len(r.metrics.Upstreams))
+	for s, um := range r.metrics.Upstreams {
+		m.Upstreams[s] = um
+	}
+	return m
+}
+
+// noteAnswer records that a query for q was answered as how, one of
+// the answered constants.
+func (r *Resolver) noteAnswer(q dns.Question, how int) {
+	r.metricsMu.Lock()
+	r.metrics.Queries++
+	switch how {
+	case answeredLocal:
+		r.metrics.Local++
+	case answeredCache:
+		r.metrics.CacheHits++
+	case answeredUpstream:
+		r.metrics.Forwarded++
+	case answeredFailure:
+		r.metrics.UpstreamFailures++
+	}
+	r.metricsMu.Unlock()
+
+	if r.queryLog != nil {
+		r.queryLog.Printf("%s %v: %s", q.Name.String(), q.Type, answeredNames[how])
+	}
+}
+
+// queryUpstream is queryServer, recording the outcome in r's
+// metrics. Queries cancelled because another nameserver answered
+// first aren't counted.
+func (r *Resolver) queryUpstream(ctx context.Context, server string, query []byte) ([]byte, error) {
+	start := time.Now()
+	out, err := r.queryServer(ctx, server, query)
+	latency := time.Since(start)
+	if err != nil && ctx.Err() == context.Canceled {
+		return out, err
+	}
+
+	r.metricsMu.Lock()
+	defer r.metricsMu.Unlock()
+	if r.metrics.Upstreams == nil {
+		r.metrics.Upstreams = make(map[string]UpstreamMetrics)
+	}
+	um := r.metrics.Upstreams[server]
+	um.Queries++
+	if err != nil {
+		um.Failures++
+	} else {
+		um.TotalLatency += latency
+		if latency > um.MaxLatency {
+			um.MaxLatency = latency
+		}
+	}
+	r.metrics.Upstreams[server] = um
+	return out, err
+}
+
+// openQueryLog returns the logger for debugQueryLog, or nil if it's
+// unset or can't be opened.
+func openQueryLog(logf logger.Logf) (*log.Logger, *os.File) {
+	if debugQueryLog == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(debugQueryLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logf("opening query log: %v", err)
+		return nil, nil
+	}
+	logf("logging queries to %s", debugQueryLog)
+	return log.New(f, "", log.LstdFlags|log.Lmicroseconds), f
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"net"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+)
+
+// testServer starts a nameserver that answers A queries with
+// 1.2.3.4 and others with no records, returning its address.
+func testServer(t *testing.T) string {
+	t.Helper()
+	return testServerRCode(t, dns.RCodeSuccess)
+}
+
+// testServerRCode starts a nameserver like testServer's, answering
+// with rcode. Unsuccessful answers have no records.
+func testServerRCode(t *testing.T, rcode dns.RCode) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxResponseSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dns.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			h.Response = true
+			h.RCode = rcode
+			b := dns.NewBuilder(nil, h)
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			if q.Type == dns.TypeA && rcode == dns.RCodeSuccess {
+				rh := dns.ResourceHeader{Name: q.Name, Type: dns.TypeA, Class: dns.ClassINET, TTL: 60}
+				b.AResource(rh, dns.AResource{A: [4]byte{1, 2, 3, 4}})
+			}
+			out, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(out, addr)
+		}
+	}()
+	t.Cleanup(func() { pc.Close() })
+	return pc.LocalAddr().String()
+}
+
+func TestMetrics(t *testing.T) {
+	upstream := testServer(t)
+	r := NewResolver(t.Logf, "ipn.dev")
+	r.SetMap(dnsMap)
+	r.SetUpstreams(Upstreams{
+		Nameservers: []string{upstream},
+		Routes:      map[string][]string{"broken.example": {}},
+	})
+	r.Start()
+	defer r.Close()
+
+	queries := []struct {
+		name string
+		tp   dns.Type
+	}{
+		{"test1.ipn.dev.", dns.TypeA},    // local
+		{"nxdomain.ipn.dev.", dns.TypeA}, // local
+		{"example.com.", dns.TypeA},      // upstream
+		{"example.com.", dns.TypeAAAA},   // upstream
+		{"example.com.", dns.TypeA},      // cache
+		{"a.broken.example.", dns.TypeA}, // failure: no nameservers
+	}
+	for _, q := range queries {
+		if _, err := syncRespond(r, dnspacket(q.name, q.tp)); err != nil {
+			t.Fatalf("%s %v: %v", q.name, q.tp, err)
+		}
+	}
+
+	m := r.Metrics()
+	if m.Queries != 6 || m.Local != 2 || m.CacheHits != 1 || m.Forwarded != 2 || m.UpstreamFailures != 1 {
+		t.Errorf("metrics = %+v; want 6 queries: 2 local, 1 cached, 2 forwarded, 1 failed", m)
+	}
+	um, ok := m.Upstreams[upstream]
+	if !ok || um.Queries != 2 || um.Failures != 0 || um.MaxLatency <= 0 || um.TotalLatency < um.MaxLatency {
+		t.Errorf("upstream metrics = %+v, %v; want 2 queries with latencies", um, ok)
+	}
+}
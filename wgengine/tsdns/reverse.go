@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+)
+
+const (
+	reverseSuffix4 = ".in-addr.arpa."
+	reverseSuffix6 = ".ip6.arpa."
+)
+
+// reverseNameIP returns the address named by a reverse lookup name,
+// in the wire format with a trailing period, such as
+// "4.3.2.1.in-addr.arpa." for 1.2.3.4. Names of networks rather than
+// single addresses, such as "2.1.in-addr.arpa.", aren't recognized.
+func reverseNameIP(name []byte) (netaddr.IP, bool) {
+	s := strings.ToLower(string(name))
+	switch {
+	case strings.HasSuffix(s, reverseSuffix4):
+		labels := strings.Split(strings.TrimSuffix(s, reverseSuffix4), ".")
+		if len(labels) != 4 {
+			return netaddr.IP{}, false
+		}
+		var b [4]byte
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return netaddr.IP{}, false
+			}
+			b[3-i] = byte(n)
+		}
+		return netaddr.IPv4(b[0], b[1], b[2], b[3]), true
+	case strings.HasSuffix(s, reverseSuffix6):
+		labels := strings.Split(strings.TrimSuffix(s, reverseSuffix6), ".")
+		if len(labels) != 32 {
+			return netaddr.IP{}, false
+		}
+		var b [16]byte
+		for i, label := range labels {
+			if len(label) != 1 {
+				return netaddr.IP{}, false
+			}
+			n, err := strconv.ParseUint(label, 16, 4)
+			if err != nil {
+				return netaddr.IP{}, false
+			}
+			// Nibbles are least significant first.
+			j := 31 - i
+			if j%2 == 0 {
+				n <<= 4
+			}
+			b[j/2] |= byte(n)
+		}
+		return netaddr.IPv6Raw(b), true
+	}
+	return netaddr.IP{}, false
+}
+
+// isTailnetIP reports whether ip is in one of the ranges Tailscale
+// assigns node addresses from, whose reverse lookups the Resolver
+// answers itself.
+func isTailnetIP(ip netaddr.IP) bool {
+	return tsaddr.IsTailscaleIP(ip) || tsaddr.TailscaleULARange().Contains(ip)
+}
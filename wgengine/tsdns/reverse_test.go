@@ -0,0 +1,111 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+)
+
+func TestReverseNameIP(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // or empty if not an address
+	}{
+		{"103.102.101.100.in-addr.arpa.", "100.101.102.103"},
+		{"103.102.101.100.IN-ADDR.ARPA.", "100.101.102.103"},
+		{"0.4.2.b.8.5.2.6.6.9.d.c.3.4.8.4.2.1.b.a.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", "fd7a:115c:a1e0:ab12:4843:cd96:6258:b240"},
+		{"102.101.100.in-addr.arpa.", ""},
+		{"256.102.101.100.in-addr.arpa.", ""},
+		{"0.4.2.b.ip6.arpa.", ""},
+		{"00.4.2.b.8.5.2.6.6.9.d.c.3.4.8.4.2.1.b.a.0.e.1.a.c.5.1.1.a.7.d.ip6.arpa.", ""},
+		{"example.com.", ""},
+	}
+	for _, tt := range tests {
+		ip, ok := reverseNameIP([]byte(tt.name))
+		if tt.want == "" {
+			if ok {
+				t.Errorf("reverseNameIP(%q) = %v; want none", tt.name, ip)
+			}
+			continue
+		}
+		if !ok || ip.String() != tt.want {
+			t.Errorf("reverseNameIP(%q) = %v, %v; want %v", tt.name, ip, ok, tt.want)
+		}
+	}
+}
+
+// extractptrcode returns the target of the PTR record in response,
+// if any, and its rcode.
+func extractptrcode(response []byte) (string, dns.RCode, error) {
+	var parser dns.Parser
+	h, err := parser.Start(response)
+	if err != nil {
+		return "", 0, err
+	}
+	if h.RCode != dns.RCodeSuccess {
+		return "", h.RCode, nil
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return "", 0, err
+	}
+	if _, err := parser.AnswerHeader(); err != nil {
+		return "", 0, err
+	}
+	res, err := parser.PTRResource()
+	if err != nil {
+		return "", 0, err
+	}
+	return res.PTR.String(), h.RCode, nil
+}
+
+func TestResolveReverse(t *testing.T) {
+	ip6, err := netaddr.ParseIP("fd7a:115c:a1e0:ab12:4843:cd96:6258:b240")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewResolver(t.Logf, "ipn.dev")
+	r.SetMap(NewMap(map[string]netaddr.IP{
+		"test1.ipn.dev": netaddr.IPv4(100, 101, 102, 103),
+		"alias.ipn.dev": netaddr.IPv4(100, 101, 102, 103),
+		"test2.ipn.dev": ip6,
+	}))
+	r.Start()
+	defer r.Close()
+
+	tests := []struct {
+		name  string
+		query string
+		ptr   string
+		code  dns.RCode
+	}{
+		{"ipv4", "103.102.101.100.in-addr.arpa.", "alias.ipn.dev.", dns.RCodeSuccess},
+		{"ipv6", "0.4.2.b.8.5.2.6.6.9.d.c.3.4.8.4.2.1.b.a.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", "test2.ipn.dev.", dns.RCodeSuccess},
+		{"unknown", "1.1.64.100.in-addr.arpa.", "", dns.RCodeNameError},
+		// Addresses outside Tailscale's ranges are delegated, and
+		// there are no nameservers to delegate to.
+		{"foreign", "1.1.168.192.in-addr.arpa.", "", dns.RCodeServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := syncRespond(r, dnspacket(tt.query, dns.TypePTR))
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+			ptr, code, err := extractptrcode(resp)
+			if err != nil {
+				t.Fatalf("extract: err = %v; want nil (in %x)", err, resp)
+			}
+			if code != tt.code {
+				t.Errorf("code = %v; want %v", code, tt.code)
+			}
+			if ptr != tt.ptr {
+				t.Errorf("ptr = %q; want %q", ptr, tt.ptr)
+			}
+		})
+	}
+}
@@ -9,7 +9,11 @@ package tsdns
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
+	"log"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -31,6 +35,10 @@ const queueSize = 8
 // for upstream nameservers to process a query.
 const delegateTimeout = 5 * time.Second
 
+// hedgeDelay is how long Resolver waits for an upstream nameserver
+// to answer before also querying the next one.
+const hedgeDelay = 200 * time.Millisecond
+
 // defaultTTL is the TTL of all responses from Resolver.
 const defaultTTL = 600 * time.Second
 
@@ -50,11 +58,82 @@ type Map struct {
 	// domainToIP is a mapping of Tailscale domains to their IP addresses.
 	// For example, monitoring.tailscale.us -> 100.64.0.1.
 	domainToIP map[string]netaddr.IP
+	// ipToDomain is the reverse of domainToIP, for PTR queries.
+	// Where several domains share an address, the first in
+	// lexicographic order is used. Extra records aren't included.
+	ipToDomain map[netaddr.IP]string
+	// aliases maps the names of CNAME records to their targets.
+	aliases map[string]string
 }
 
 // NewMap returns a new Map with domain to address mapping given by domainToIP.
 func NewMap(domainToIP map[string]netaddr.IP) *Map {
-	return &Map{domainToIP: domainToIP}
+	return NewMapWithRecords(domainToIP, nil)
+}
+
+// Record is an extra DNS record for a Map to serve.
+type Record struct {
+	// Name is the domain name of the record, without a trailing period.
+	Name string
+	// IP is the address of an A or AAAA record.
+	IP netaddr.IP
+	// Target, if non-empty, makes the record a CNAME record
+	// pointing at Target, which has no trailing period.
+	Target string
+}
+
+// NewMapWithRecords is like NewMap, but the Map also serves records.
+// Names of domainToIP take precedence over records with the same name,
+// and later records over earlier ones. A name has at most one address.
+func NewMapWithRecords(domainToIP map[string]netaddr.IP, records []Record) *Map {
+	m := &Map{
+		domainToIP: domainToIP,
+		ipToDomain: make(map[netaddr.IP]string, len(domainToIP)),
+	}
+	for domain, ip := range domainToIP {
+		if prev, ok := m.ipToDomain[ip]; !ok || domain < prev {
+			m.ipToDomain[ip] = domain
+		}
+	}
+	if len(records) == 0 {
+		return m
+	}
+
+	m.domainToIP = make(map[string]netaddr.IP, len(domainToIP)+len(records))
+	for domain, ip := range domainToIP {
+		m.domainToIP[domain] = ip
+	}
+	m.aliases = make(map[string]string)
+	for _, rec := range records {
+		name := strings.ToLower(strings.TrimSuffix(rec.Name, "."))
+		if _, ok := domainToIP[name]; ok || name == "" {
+			continue
+		}
+		if rec.Target != "" {
+			delete(m.domainToIP, name)
+			m.aliases[name] = strings.ToLower(strings.TrimSuffix(rec.Target, "."))
+		} else {
+			delete(m.aliases, name)
+			m.domainToIP[name] = rec.IP
+		}
+	}
+	return m
+}
+
+// Upstreams describes where a Resolver forwards queries for names
+// outside of the Tailscale network. Nameserver addresses are strings
+// of the form ip:port, as expected by Dial, or for DNS-over-TLS
+// nameservers, as returned by DoTAddr.
+type Upstreams struct {
+	// Nameservers are used for names that don't match any entry in Routes.
+	Nameservers []string
+	// Routes maps domain suffixes, without a trailing period,
+	// to the nameservers responsible for names under them.
+	// The longest matching suffix wins.
+	Routes map[string][]string
+	// Fallback nameservers are queried when no nameservers
+	// are configured for a name or all of them failed.
+	Fallback []string
 }
 
 // Packet represents a DNS payload together with the address of its origin.
@@ -69,6 +148,9 @@ type Packet struct {
 
 // Resolver is a DNS resolver for nodes on the Tailscale network,
 // associating them with domain names of the form <mynode>.<mydomain>.<root>.
+// Single-label names are resolved as <name>.<root>, if that exists.
+// Reverse lookups (PTR queries) of Tailscale addresses are answered
+// with the names of the nodes that have them.
 // If it is asked to resolve a domain that is not of that form,
 // it delegates to upstream nameservers if any are set.
 type Resolver struct {
@@ -94,14 +176,44 @@ type Resolver struct {
 	// dialer is the netns.Dialer used for delegation.
 	dialer netns.Dialer
 
+	// dohMu guards dohClients.
+	dohMu sync.Mutex
+	// dohClients are the DNS-over-HTTPS clients of upstream
+	// nameservers that have DoH endpoints, by nameserver address.
+	dohClients map[string]*dohClient
+
+	// dotMu guards dotConns.
+	dotMu sync.Mutex
+	// dotConns are the idle connections to DNS-over-TLS nameservers,
+	// by nameserver address.
+	dotConns map[string]*tls.Conn
+
+	// cache holds responses from upstream nameservers.
+	// It is nil if caching is disabled.
+	cache *responseCache
+
+	// queryLog, if non-nil, logs every query to queryLogFile.
+	queryLog     *log.Logger
+	queryLogFile *os.File
+
+	metricsMu sync.Mutex // guards metrics
+	metrics   Metrics
+
 	// mu guards the following fields from being updated while used.
 	mu sync.RWMutex
 	// dnsMap is the map most recently received from the control server.
 	dnsMap *Map
 	// nameservers is the list of nameserver addresses that should be used
-	// if the received query is not for a Tailscale node.
+	// if the received query is not for a Tailscale node
+	// and does not match any of routes.
 	// The addresses are strings of the form ip:port, as expected by Dial.
 	nameservers []string
+	// routes maps lowercase domain suffixes with a trailing period
+	// to the nameservers that should be used for names under them.
+	routes map[string][]string
+	// fallback is the list of nameservers used when the nameservers
+	// selected for a query are absent or have all failed.
+	fallback []string
 }
 
 // NewResolver constructs a resolver associated with the given root domain.
@@ -116,6 +228,10 @@ func NewResolver(logf logger.Logf, rootDomain string) *Resolver {
 		rootDomain: []byte(rootDomain + "."),
 		dialer:     netns.NewDialer(),
 	}
+	if !disableCache {
+		r.cache = newResponseCache()
+	}
+	r.queryLog, r.queryLogFile = openQueryLog(r.logf)
 
 	return r
 }
@@ -137,6 +253,23 @@ func (r *Resolver) Close() {
 	}
 	close(r.closed)
 	r.pollGroup.Wait()
+
+	r.dohMu.Lock()
+	for _, c := range r.dohClients {
+		c.http.CloseIdleConnections()
+	}
+	r.dohMu.Unlock()
+
+	r.dotMu.Lock()
+	for _, conn := range r.dotConns {
+		conn.Close()
+	}
+	r.dotConns = nil
+	r.dotMu.Unlock()
+
+	if r.queryLogFile != nil {
+		r.queryLogFile.Close()
+	}
 }
 
 // SetMap sets the resolver's DNS map, taking ownership of it.
@@ -146,14 +279,62 @@ func (r *Resolver) SetMap(m *Map) {
 	r.mu.Unlock()
 }
 
-// SetUpstreamNameservers sets the addresses of the resolver's
-// upstream nameservers, taking ownership of the argument.
+// SetNameservers sets the addresses of the resolver's
+// default upstream nameservers, taking ownership of the argument.
 // The addresses should be strings of the form ip:port,
 // matching what Dial("udp", addr) expects as addr.
 func (r *Resolver) SetNameservers(nameservers []string) {
 	r.mu.Lock()
 	r.nameservers = nameservers
 	r.mu.Unlock()
+	r.cache.flush()
+}
+
+// SetUpstreams replaces all of the resolver's upstream nameservers,
+// including per-domain routes and fallbacks, taking ownership of
+// the slices in u.
+func (r *Resolver) SetUpstreams(u Upstreams) {
+	routes := make(map[string][]string, len(u.Routes))
+	for domain, servers := range u.Routes {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if domain == "" {
+			continue
+		}
+		routes[domain+"."] = servers
+	}
+
+	r.mu.Lock()
+	r.nameservers = u.Nameservers
+	r.routes = routes
+	r.fallback = u.Fallback
+	r.mu.Unlock()
+	// Cached responses may be from nameservers no longer used.
+	r.cache.flush()
+}
+
+// upstreamsFor returns the nameservers that should handle a query
+// for name, given in the wire format with a trailing period,
+// and the fallback nameservers to use if those fail.
+func (r *Resolver) upstreamsFor(name string) (nameservers, fallback []string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.routes) > 0 {
+		name = strings.ToLower(name)
+		// Walk from the full name towards the root, so the
+		// first match is the longest matching suffix.
+		for suffix := name; suffix != ""; {
+			if servers, ok := r.routes[suffix]; ok {
+				return servers, r.fallback
+			}
+			i := strings.IndexByte(suffix, '.')
+			if i < 0 {
+				break
+			}
+			suffix = suffix[i+1:]
+		}
+	}
+	return r.nameservers, r.fallback
 }
 
 // EnqueueRequest places the given DNS request in the resolver's queue.
@@ -198,6 +379,58 @@ func (r *Resolver) Resolve(domain string) (netaddr.IP, dns.RCode, error) {
 	return addr, dns.RCodeSuccess, nil
 }
 
+// ResolveReverse maps a given IP address to the domain name of the
+// host that owns it, without a trailing period.
+func (r *Resolver) ResolveReverse(ip netaddr.IP) (string, dns.RCode, error) {
+	r.mu.RLock()
+	if r.dnsMap == nil {
+		r.mu.RUnlock()
+		return "", dns.RCodeServerFailure, errMapNotSet
+	}
+	domain, found := r.dnsMap.ipToDomain[ip]
+	r.mu.RUnlock()
+
+	if !found {
+		return "", dns.RCodeNameError, nil
+	}
+	return domain, dns.RCodeSuccess, nil
+}
+
+// resolveShort resolves name, in the wire format with a trailing
+// period, as a node's short name if it has a single label, such as
+// "mynas.". Resolvers that don't apply search domains to such names
+// send them as they are.
+func (r *Resolver) resolveShort(name []byte) (netaddr.IP, bool) {
+	if bytes.IndexByte(name, '.') != len(name)-1 {
+		return netaddr.IP{}, false
+	}
+	domain := string(name) + string(r.rootDomain[:len(r.rootDomain)-1])
+	ip, rcode, _ := r.Resolve(domain)
+	return ip, rcode == dns.RCodeSuccess
+}
+
+// resolveLocal answers resp's question about domain, which has no
+// trailing period, from the map, reporting whether the map has a
+// record for domain.
+func (r *Resolver) resolveLocal(domain string, resp *response) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.dnsMap == nil {
+		return false
+	}
+	if ip, ok := r.dnsMap.domainToIP[domain]; ok {
+		resp.IP = ip
+		return true
+	}
+	if target, ok := r.dnsMap.aliases[domain]; ok {
+		resp.Target = target
+		// Save the client a query if the target is in the map.
+		resp.IP = r.dnsMap.domainToIP[target]
+		return true
+	}
+	return false
+}
+
 func (r *Resolver) poll() {
 	defer r.pollGroup.Done()
 
@@ -233,7 +466,25 @@ func (r *Resolver) poll() {
 }
 
 // queryServer obtains a DNS response by querying the given server.
+// Queries to public resolvers with a known DNS-over-HTTPS endpoint go
+// over HTTPS, and over plain DNS only if that fails.
 func (r *Resolver) queryServer(ctx context.Context, server string, query []byte) ([]byte, error) {
+	if strings.HasPrefix(server, dotPrefix) {
+		return r.queryDoT(ctx, server, query)
+	}
+	if endpoint, ok := dohEndpoint(server); ok {
+		out, err := r.queryDoH(ctx, endpoint, server, query)
+		if err == nil {
+			return out, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != errDoHBackoff && err != errDoHTooLarge {
+			r.logf("querying %s over DoH: %v; using plain DNS", server, err)
+		}
+	}
+
 	conn, err := r.dialer.DialContext(ctx, "udp", server)
 	if err != nil {
 		return nil, err
@@ -260,13 +511,29 @@ func (r *Resolver) queryServer(ctx context.Context, server string, query []byte)
 	return out[:n], nil
 }
 
-// delegate forwards the query to all upstream nameservers and returns the first response.
-func (r *Resolver) delegate(query []byte) ([]byte, error) {
-	r.mu.RLock()
-	nameservers := r.nameservers
-	r.mu.RUnlock()
+// delegate forwards the query for name to the upstream nameservers
+// responsible for it and returns the first response.
+// If they all fail, the fallback nameservers are tried.
+func (r *Resolver) delegate(name string, query []byte) ([]byte, error) {
+	nameservers, fallback := r.upstreamsFor(name)
 
-	if len(r.nameservers) == 0 {
+	out, err := r.queryServers(nameservers, query)
+	if err != nil && len(fallback) > 0 {
+		if len(nameservers) > 0 {
+			r.logf("delegating: %v; trying fallback", err)
+		}
+		out, err = r.queryServers(fallback, query)
+	}
+	return out, err
+}
+
+// queryServers forwards the query to nameservers and returns the
+// first answer that isn't a server failure. Nameservers are queried
+// in order, each once the one before has failed or hedgeDelay has
+// passed without an answer, so that a slow or unreachable nameserver
+// delays answers only briefly.
+func (r *Resolver) queryServers(nameservers []string, query []byte) ([]byte, error) {
+	if len(nameservers) == 0 {
 		return nil, errAllFailed
 	}
 
@@ -275,43 +542,84 @@ func (r *Resolver) delegate(query []byte) ([]byte, error) {
 
 	// Common case, don't spawn goroutines.
 	if len(nameservers) == 1 {
-		return r.queryServer(ctx, nameservers[0], query)
+		return r.queryUpstream(ctx, nameservers[0], query)
 	}
 
-	datach := make(chan []byte)
-	for _, server := range nameservers {
-		go func(s string) {
-			resp, err := r.queryServer(ctx, s, query)
-			// Only print errors not due to cancelation after first response.
-			if err != nil && ctx.Err() != context.Canceled {
-				r.logf("querying %s: %v", s, err)
-			}
-
-			datach <- resp
-		}(server)
+	type result struct {
+		server string
+		resp   []byte
+		err    error
+	}
+	// Buffered so that queries still running when one answers
+	// don't block.
+	results := make(chan result, len(nameservers))
+	var hedge <-chan time.Time // fires when the next nameserver is due
+	next, pending := 0, 0
+	startNext := func() {
+		s := nameservers[next]
+		go func() {
+			resp, err := r.queryUpstream(ctx, s, query)
+			results <- result{s, resp, err}
+		}()
+		next++
+		pending++
+		hedge = nil
+		if next < len(nameservers) {
+			hedge = time.After(hedgeDelay)
+		}
 	}
 
-	var response []byte
-	for range nameservers {
-		cur := <-datach
-		if cur != nil && response == nil {
-			// Received first successful response
-			response = cur
-			cancel()
+	startNext()
+	var failure []byte // a server failure answer, if there's nothing better
+	for pending > 0 {
+		select {
+		case <-hedge:
+			startNext()
+		case res := <-results:
+			pending--
+			switch {
+			case res.err != nil:
+				r.logf("querying %s: %v", res.server, res.err)
+			case isServerFailure(res.resp):
+				if failure == nil {
+					failure = res.resp
+				}
+			default:
+				return res.resp, nil
+			}
+			if next < len(nameservers) {
+				startNext()
+			}
 		}
 	}
 
-	if response == nil {
-		return nil, errAllFailed
+	if failure != nil {
+		return failure, nil
 	}
-	return response, nil
+	return nil, errAllFailed
+}
+
+// isServerFailure reports whether resp is a SERVFAIL or REFUSED
+// answer, which another nameserver might answer better.
+func isServerFailure(resp []byte) bool {
+	var p dns.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return true
+	}
+	return h.RCode == dns.RCodeServerFailure || h.RCode == dns.RCodeRefused
 }
 
 type response struct {
 	Header   dns.Header
 	Question dns.Question
-	Name     string
-	IP       netaddr.IP
+	// Name is the answer to a PTR query, without a trailing period.
+	Name string
+	// Target is the target of a CNAME record answering the
+	// question, without a trailing period. IP, if set, is then the
+	// target's address.
+	Target string
+	IP     netaddr.IP
 }
 
 // parseQuery parses the query in given packet into a response struct.
@@ -368,6 +676,41 @@ func marshalAAAARecord(name dns.Name, ip netaddr.IP, builder *dns.Builder) error
 	return builder.AAAAResource(answerHeader, answer)
 }
 
+// marshalPTRRecord serializes a PTR record pointing at domain,
+// which has no trailing period, into an active builder.
+// The caller may continue using the builder following the call.
+func marshalPTRRecord(name dns.Name, domain string, builder *dns.Builder) error {
+	ptr, err := dns.NewName(domain + ".")
+	if err != nil {
+		return err
+	}
+	answerHeader := dns.ResourceHeader{
+		Name:  name,
+		Type:  dns.TypePTR,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	return builder.PTRResource(answerHeader, dns.PTRResource{PTR: ptr})
+}
+
+// marshalCNAMERecord serializes a CNAME record pointing at target,
+// which has no trailing period, into an active builder, returning
+// the target's name. The caller may continue using the builder
+// following the call.
+func marshalCNAMERecord(name dns.Name, target string, builder *dns.Builder) (dns.Name, error) {
+	cname, err := dns.NewName(target + ".")
+	if err != nil {
+		return dns.Name{}, err
+	}
+	answerHeader := dns.ResourceHeader{
+		Name:  name,
+		Type:  dns.TypeCNAME,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	return cname, builder.CNAMEResource(answerHeader, dns.CNAMEResource{CNAME: cname})
+}
+
 // marshalResponse serializes the DNS response into a new buffer.
 func marshalResponse(resp *response) ([]byte, error) {
 	resp.Header.Response = true
@@ -398,10 +741,28 @@ func marshalResponse(resp *response) ([]byte, error) {
 		return nil, err
 	}
 
-	if resp.IP.Is4() {
-		err = marshalARecord(resp.Question.Name, resp.IP, &builder)
-	} else {
-		err = marshalAAAARecord(resp.Question.Name, resp.IP, &builder)
+	name := resp.Question.Name
+	if resp.Target != "" {
+		name, err = marshalCNAMERecord(name, resp.Target, &builder)
+		if err != nil {
+			return nil, err
+		}
+		if resp.IP == (netaddr.IP{}) {
+			return builder.Finish()
+		}
+	}
+	if resp.Question.Type == dns.TypeCNAME {
+		// Names with addresses have no CNAME record.
+		return builder.Finish()
+	}
+
+	switch {
+	case resp.Question.Type == dns.TypePTR:
+		err = marshalPTRRecord(name, resp.Name, &builder)
+	case resp.IP.Is4():
+		err = marshalARecord(name, resp.IP, &builder)
+	default:
+		err = marshalAAAARecord(name, resp.IP, &builder)
 	}
 	if err != nil {
 		return nil, err
@@ -413,6 +774,8 @@ func marshalResponse(resp *response) ([]byte, error) {
 // respond returns a DNS response to query.
 func (r *Resolver) respond(query []byte) ([]byte, error) {
 	resp := new(response)
+	answered := answeredLocal
+	defer func() { r.noteAnswer(resp.Question, answered) }()
 
 	// ParseQuery is sufficiently fast to run on every DNS packet.
 	// This is considerably simpler than extracting the name by hand
@@ -428,23 +791,57 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 	// Delegate only when not a subdomain of rootDomain.
 	// We do this on bytes because Name.String() allocates.
 	rawName := resp.Question.Name.Data[:resp.Question.Name.Length]
+	if resp.Question.Type == dns.TypePTR {
+		// Reverse lookups of Tailscale addresses are answered
+		// from the map; others are delegated like any name.
+		if ip, ok := reverseNameIP(rawName); ok && isTailnetIP(ip) {
+			resp.Name, resp.Header.RCode, err = r.ResolveReverse(ip)
+			if err != nil {
+				r.logf("resolving reverse: %v", err)
+			}
+			return marshalResponse(resp)
+		}
+	}
 	if !bytes.HasSuffix(rawName, r.rootDomain) {
-		out, err := r.delegate(query)
+		switch resp.Question.Type {
+		case dns.TypeA, dns.TypeAAAA:
+			if ip, ok := r.resolveShort(rawName); ok {
+				resp.IP = ip
+				return marshalResponse(resp)
+			}
+			fallthrough
+		case dns.TypeCNAME:
+			// Extra records can have any name.
+			if r.resolveLocal(strings.ToLower(string(rawName[:len(rawName)-1])), resp) {
+				return marshalResponse(resp)
+			}
+		}
+		if out, ok := r.cache.get(resp.Header, resp.Question); ok {
+			answered = answeredCache
+			return out, nil
+		}
+		out, err := r.delegate(string(rawName), query)
 		if err != nil {
 			r.logf("delegating: %v", err)
+			answered = answeredFailure
 			resp.Header.RCode = dns.RCodeServerFailure
 			return marshalResponse(resp)
 		}
+		answered = answeredUpstream
+		r.cache.put(resp.Question, out)
 		return out, nil
 	}
 
 	switch resp.Question.Type {
-	case dns.TypeA, dns.TypeAAAA:
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME:
 		domain := resp.Question.Name.String()
 		// Strip off the trailing period.
 		// This is safe: Name is guaranteed to have a trailing period by construction.
 		domain = domain[:len(domain)-1]
 		resp.IP, resp.Header.RCode, err = r.Resolve(domain)
+		if resp.Header.RCode == dns.RCodeNameError && r.resolveLocal(domain, resp) {
+			resp.Header.RCode = dns.RCodeSuccess
+		}
 	default:
 		resp.Header.RCode = dns.RCodeNotImplemented
 		err = errNotImplemented
@@ -7,8 +7,11 @@ package tsdns
 import (
 	"bytes"
 	"errors"
+	"net"
+	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
@@ -170,6 +173,124 @@ func TestDelegate(t *testing.T) {
 	}
 }
 
+func TestQueryServers(t *testing.T) {
+	// silent never answers.
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	silent := pc.LocalAddr().String()
+	good := testServer(t)
+	servfail := testServerRCode(t, dns.RCodeServerFailure)
+	refused := testServerRCode(t, dns.RCodeRefused)
+
+	tests := []struct {
+		name        string
+		nameservers []string
+		code        dns.RCode
+	}{
+		{"silent first", []string{silent, good}, dns.RCodeSuccess},
+		{"servfail first", []string{servfail, good}, dns.RCodeSuccess},
+		{"refused first", []string{refused, silent, good}, dns.RCodeSuccess},
+		{"all fail", []string{servfail, refused}, dns.RCodeServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewResolver(t.Logf, "ipn.dev")
+			r.SetNameservers(tt.nameservers)
+			start := time.Now()
+			resp, err := r.queryServers(tt.nameservers, dnspacket("example.com.", dns.TypeA))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := time.Since(start); d >= delegateTimeout {
+				t.Errorf("took %v; want an answer before the timeout", d)
+			}
+			_, code, err := extractipcode(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.code {
+				t.Errorf("code = %v; want %v", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestResolveShort(t *testing.T) {
+	r := NewResolver(t.Logf, "ipn.dev")
+	r.SetMap(dnsMap)
+	r.Start()
+
+	tests := []struct {
+		name  string
+		query []byte
+		ip    netaddr.IP
+		code  dns.RCode
+	}{
+		{"ipv4", dnspacket("test1.", dns.TypeA), netaddr.IPv4(1, 2, 3, 4), dns.RCodeSuccess},
+		{"ipv6", dnspacket("test2.", dns.TypeAAAA), netaddr.IPv6Raw(test2bytes), dns.RCodeSuccess},
+		// Unknown short names are delegated, and there are no
+		// nameservers to delegate to.
+		{"unknown", dnspacket("test3.", dns.TypeA), netaddr.IP{}, dns.RCodeServerFailure},
+		{"not_short", dnspacket("test1.example.", dns.TypeA), netaddr.IP{}, dns.RCodeServerFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := syncRespond(r, tt.query)
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+			ip, code, err := extractipcode(resp)
+			if err != nil {
+				t.Fatalf("extract: err = %v; want nil (in %x)", err, resp)
+			}
+			if code != tt.code {
+				t.Errorf("code = %v; want %v", code, tt.code)
+			}
+			if ip != tt.ip {
+				t.Errorf("ip = %v; want %v", ip, tt.ip)
+			}
+		})
+	}
+}
+
+func TestUpstreamsFor(t *testing.T) {
+	r := NewResolver(t.Logf, "ipn.dev")
+	r.SetUpstreams(Upstreams{
+		Nameservers: []string{"1.1.1.1:53"},
+		Routes: map[string][]string{
+			"corp.example.com":     {"10.0.0.1:53"},
+			"dev.corp.example.com": {"10.0.0.2:53"},
+			"Other.Example.":       {"10.0.0.3:53"},
+		},
+		Fallback: []string{"8.8.8.8:53"},
+	})
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"google.com.", "1.1.1.1:53"},
+		{"corp.example.com.", "10.0.0.1:53"},
+		{"host.corp.example.com.", "10.0.0.1:53"},
+		{"host.dev.corp.example.com.", "10.0.0.2:53"},
+		{"HOST.OTHER.example.", "10.0.0.3:53"},
+		{"notcorp.example.com.", "1.1.1.1:53"},
+	}
+	for _, tt := range tests {
+		servers, fallback := r.upstreamsFor(tt.name)
+		if len(servers) != 1 || servers[0] != tt.want {
+			t.Errorf("upstreamsFor(%q) = %v; want [%s]", tt.name, servers, tt.want)
+		}
+		if len(fallback) != 1 || fallback[0] != "8.8.8.8:53" {
+			t.Errorf("upstreamsFor(%q) fallback = %v; want [8.8.8.8:53]", tt.name, fallback)
+		}
+	}
+}
+
 func TestConcurrentSetMap(t *testing.T) {
 	r := NewResolver(t.Logf, "ipn.dev")
 	r.Start()
@@ -322,3 +443,81 @@ func BenchmarkFull(b *testing.B) {
 		})
 	}
 }
+
+func TestExtraRecords(t *testing.T) {
+	r := NewResolver(t.Logf, "ipn.dev")
+	r.SetMap(NewMapWithRecords(dnsMap.domainToIP, []Record{
+		{Name: "git.internal", IP: netaddr.IPv4(100, 101, 102, 103)},
+		{Name: "Wiki.Internal.", Target: "test1.ipn.dev"},
+		{Name: "docs.ipn.dev", Target: "wiki.internal"},
+		{Name: "mirror.internal", Target: "example.com"},
+		{Name: "test1.ipn.dev", IP: netaddr.IPv4(5, 6, 7, 8)}, // a node's name
+	}))
+	r.Start()
+	defer r.Close()
+
+	type answer struct {
+		typ  dns.Type
+		data string
+	}
+	tests := []struct {
+		name  string
+		query []byte
+		code  dns.RCode
+		want  []answer
+	}{
+		{"a", dnspacket("git.internal.", dns.TypeA), dns.RCodeSuccess, []answer{{dns.TypeA, "100.101.102.103"}}},
+		{"cname_to_node", dnspacket("wiki.internal.", dns.TypeA), dns.RCodeSuccess, []answer{
+			{dns.TypeCNAME, "test1.ipn.dev."},
+			{dns.TypeA, "1.2.3.4"},
+		}},
+		{"cname_only", dnspacket("wiki.internal.", dns.TypeCNAME), dns.RCodeSuccess, []answer{{dns.TypeCNAME, "test1.ipn.dev."}}},
+		{"cname_in_root", dnspacket("docs.ipn.dev.", dns.TypeA), dns.RCodeSuccess, []answer{{dns.TypeCNAME, "wiki.internal."}}},
+		{"cname_outside", dnspacket("mirror.internal.", dns.TypeA), dns.RCodeSuccess, []answer{{dns.TypeCNAME, "example.com."}}},
+		{"node_wins", dnspacket("test1.ipn.dev.", dns.TypeA), dns.RCodeSuccess, []answer{{dns.TypeA, "1.2.3.4"}}},
+		{"no_cname", dnspacket("git.internal.", dns.TypeCNAME), dns.RCodeSuccess, nil},
+		{"nxdomain", dnspacket("test3.ipn.dev.", dns.TypeA), dns.RCodeNameError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := syncRespond(r, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var p dns.Parser
+			h, err := p.Start(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.RCode != tt.code {
+				t.Errorf("code = %v; want %v", h.RCode, tt.code)
+			}
+			if err := p.SkipAllQuestions(); err != nil {
+				t.Fatal(err)
+			}
+			var got []answer
+			for {
+				ah, err := p.AnswerHeader()
+				if err == dns.ErrSectionDone {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch ah.Type {
+				case dns.TypeA:
+					res, _ := p.AResource()
+					got = append(got, answer{ah.Type, netaddr.IPv4(res.A[0], res.A[1], res.A[2], res.A[3]).String()})
+				case dns.TypeCNAME:
+					res, _ := p.CNAMEResource()
+					got = append(got, answer{ah.Type, res.CNAME.String()})
+				default:
+					t.Fatalf("unexpected answer type %v", ah.Type)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("answers = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
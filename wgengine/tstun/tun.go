@@ -18,6 +18,7 @@ import (
 	"github.com/tailscale/wireguard-go/tun"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/flowlog"
 	"tailscale.com/wgengine/packet"
 )
 
@@ -91,6 +92,11 @@ type TUN struct {
 	filter atomic.Value // of *filter.Filter
 	// filterFlags control the verbosity of logging packet drops/accepts.
 	filterFlags filter.RunFlags
+	// filterAudit is 1 if filter.AuditDrops is added to filterFlags.
+	// Accessed atomically.
+	filterAudit int32
+	// flows, if set, counts the packets that pass the filters.
+	flows atomic.Value // of *flowlog.Tracker
 
 	// PreFilterIn is the inbound filter function that runs before the main filter
 	// and therefore sees the packets that may be later dropped by it.
@@ -225,7 +231,7 @@ func (t *TUN) filterOut(buf []byte) filter.Response {
 		return filter.Drop
 	}
 
-	if filt.RunOut(p, t.filterFlags) != filter.Accept {
+	if filt.RunOut(p, t.runFlags()) != filter.Accept {
 		return filter.Drop
 	}
 
@@ -235,6 +241,7 @@ func (t *TUN) filterOut(buf []byte) filter.Response {
 		}
 	}
 
+	t.countFlow(p)
 	return filter.Accept
 }
 
@@ -305,7 +312,7 @@ func (t *TUN) filterIn(buf []byte) filter.Response {
 		return filter.Drop
 	}
 
-	if filt.RunIn(p, t.filterFlags) != filter.Accept {
+	if filt.RunIn(p, t.runFlags()) != filter.Accept {
 		return filter.Drop
 	}
 
@@ -315,6 +322,7 @@ func (t *TUN) filterIn(buf []byte) filter.Response {
 		}
 	}
 
+	t.countFlow(p)
 	return filter.Accept
 }
 
@@ -339,6 +347,35 @@ func (t *TUN) SetFilter(filt *filter.Filter) {
 	t.filter.Store(filt)
 }
 
+// SetFilterAudit sets whether the filter logs an audit record for
+// each packet it drops. See filter.AuditDrops.
+func (t *TUN) SetFilterAudit(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&t.filterAudit, v)
+}
+
+func (t *TUN) runFlags() filter.RunFlags {
+	if atomic.LoadInt32(&t.filterAudit) != 0 {
+		return t.filterFlags | filter.AuditDrops
+	}
+	return t.filterFlags
+}
+
+// SetFlowTracker sets the tracker that counts the flows of packets
+// passing the filters, or stops counting them if ft is nil.
+func (t *TUN) SetFlowTracker(ft *flowlog.Tracker) {
+	t.flows.Store(ft)
+}
+
+func (t *TUN) countFlow(p *packet.ParsedPacket) {
+	if ft, _ := t.flows.Load().(*flowlog.Tracker); ft != nil {
+		ft.Add(p)
+	}
+}
+
 // InjectInboundDirect makes the TUN device behave as if a packet
 // with the given contents was received from the network.
 // It blocks and does not take ownership of the packet.
@@ -0,0 +1,45 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"tailscale.com/types/logger"
+)
+
+// createTUN creates the utun device named tunname.
+//
+// macOS tun devices are all named utunN, and other VPNs take them
+// too, so a particular one may be in use. If tunname is a numbered
+// utun that can't be created, the kernel is asked for the next free
+// one instead, which it does when given plain "utun". The device's
+// actual name is logged and reported in the engine status.
+func createTUN(logf logger.Logf, tunname string) (tun.Device, error) {
+	dev, err := tun.CreateTUN(tunname, minimalMTU)
+	if err != nil && isNumberedUtun(tunname) {
+		logf("%s is unavailable, probably in use by another VPN: %v; using the next free utun", tunname, err)
+		dev, err = tun.CreateTUN("utun", minimalMTU)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if name, err := dev.Name(); err == nil && name != tunname {
+		logf("using tun device %s for %s", name, tunname)
+	}
+	return dev, nil
+}
+
+// isNumberedUtun reports whether name is of the form utunN.
+func isNumberedUtun(name string) bool {
+	n := strings.TrimPrefix(name, "utun")
+	if n == name || n == "" {
+		return false
+	}
+	_, err := strconv.ParseUint(n, 10, 32)
+	return err == nil
+}
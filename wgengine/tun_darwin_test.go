@@ -0,0 +1,26 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import "testing"
+
+func TestIsNumberedUtun(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"utun", false},
+		{"utun0", true},
+		{"utun12", true},
+		{"utun-1", false},
+		{"utunx", false},
+		{"tailscale0", false},
+	}
+	for _, tt := range tests {
+		if got := isNumberedUtun(tt.name); got != tt.want {
+			t.Errorf("isNumberedUtun(%q) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
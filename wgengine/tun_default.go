@@ -0,0 +1,16 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux freebsd openbsd
+
+package wgengine
+
+import (
+	"github.com/tailscale/wireguard-go/tun"
+	"tailscale.com/types/logger"
+)
+
+func createTUN(logf logger.Logf, tunname string) (tun.Device, error) {
+	return tun.CreateTUN(tunname, minimalMTU)
+}
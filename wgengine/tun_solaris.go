@@ -0,0 +1,22 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"tailscale.com/types/logger"
+)
+
+// createTUN would create the tuntap device named tunname on illumos
+// and Solaris, but wireguard-go has no tun driver for them yet: it
+// needs the STREAMS ioctls (I_STR, I_PUSH, IF_UNITSEL) that our
+// version of x/sys/unix lacks. Until then, tailscaled runs there
+// without a tun device.
+func createTUN(logf logger.Logf, tunname string) (tun.Device, error) {
+	return nil, fmt.Errorf("%w on %s yet", ErrTUNUnsupported, runtime.GOOS)
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!freebsd,!openbsd,!darwin,!windows,!solaris
+
+package wgengine
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"tailscale.com/types/logger"
+)
+
+// createTUN fails on platforms wireguard-go has no tun driver for,
+// such as AIX, NetBSD and Plan 9.
+func createTUN(logf logger.Logf, tunname string) (tun.Device, error) {
+	return nil, fmt.Errorf("%w on %s", ErrTUNUnsupported, runtime.GOOS)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"github.com/tailscale/wireguard-go/tun/wintun"
+	"golang.org/x/sys/windows"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// tunCreateAttempts is how many times creating the wintun
+	// adapter is tried before giving up.
+	tunCreateAttempts = 5
+	// tunCreateMaxBackoff caps the wait between attempts.
+	tunCreateMaxBackoff = 10 * time.Second
+)
+
+// createTUN creates the wintun adapter named tunname.
+//
+// A tailscaled that crashed or was killed leaves its adapter behind,
+// and Windows then gives the next one a name like "Tailscale 2", or
+// fails to create it at all until the old one is removed by hand. So
+// adapters left over from earlier runs are deleted first, and
+// creation is retried, deleting them again, with backoff.
+//
+// The adapter is created with a GUID derived from its name, rather
+// than a random one, so Windows sees the same network each time and
+// keeps its firewall profile and rules.
+func createTUN(logf logger.Logf, tunname string) (tun.Device, error) {
+	guid := tunGUID(tunname)
+	backoff := time.Second
+	var err error
+	for attempt := 1; attempt <= tunCreateAttempts; attempt++ {
+		deleteOrphanedTUNs(logf, tunname)
+		var dev tun.Device
+		dev, err = tun.CreateTUNWithRequestedGUID(tunname, &guid, minimalMTU)
+		if err == nil {
+			return dev, nil
+		}
+		if attempt == tunCreateAttempts {
+			break
+		}
+		logf("wintun: creating adapter %q (attempt %d/%d): %v; retrying in %v", tunname, attempt, tunCreateAttempts, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > tunCreateMaxBackoff {
+			backoff = tunCreateMaxBackoff
+		}
+	}
+	return nil, fmt.Errorf("creating wintun adapter %q: %w", tunname, err)
+}
+
+// deleteOrphanedTUNs deletes the wintun adapters named tunname, or
+// named like Windows renames duplicates of it ("tunname 2").
+func deleteOrphanedTUNs(logf logger.Logf, tunname string) {
+	reboot, errs := tun.WintunPool.DeleteMatchingInterfaces(func(wt *wintun.Interface) bool {
+		name, err := wt.Name()
+		if err != nil {
+			return false
+		}
+		if name == tunname {
+			logf("wintun: deleting adapter %q left from an earlier run", name)
+			return true
+		}
+		if isDuplicateTUNName(name, tunname) {
+			logf("wintun: deleting duplicate adapter %q", name)
+			return true
+		}
+		return false
+	})
+	for _, err := range errs {
+		logf("wintun: deleting adapter: %v", err)
+	}
+	if reboot {
+		logf("wintun: deleting adapters requires a reboot to finish")
+	}
+}
+
+// isDuplicateTUNName reports whether name is what Windows names an
+// adapter when one named tunname already exists: tunname, a space and
+// a number.
+func isDuplicateTUNName(name, tunname string) bool {
+	suffix := strings.TrimPrefix(name, tunname+" ")
+	if suffix == name || suffix == "" {
+		return false
+	}
+	for _, r := range suffix {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// tunGUID returns the stable GUID of the adapter named tunname, a
+// name-based (version 5 style) UUID.
+func tunGUID(tunname string) windows.GUID {
+	h := sha256.Sum256([]byte("tailscale wintun adapter " + tunname))
+	h[6] = h[6]&0x0f | 0x50 // version 5
+	h[8] = h[8]&0x3f | 0x80 // RFC 4122 variant
+	g := windows.GUID{
+		Data1: binary.BigEndian.Uint32(h[0:4]),
+		Data2: binary.BigEndian.Uint16(h[4:6]),
+		Data3: binary.BigEndian.Uint16(h[6:8]),
+	}
+	copy(g.Data4[:], h[8:16])
+	return g
+}
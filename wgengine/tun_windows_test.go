@@ -0,0 +1,40 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import "testing"
+
+func TestTUNGUID(t *testing.T) {
+	g := tunGUID("Tailscale")
+	if g != tunGUID("Tailscale") {
+		t.Error("GUID isn't stable")
+	}
+	if g == tunGUID("Tailscale2") {
+		t.Error("different names have the same GUID")
+	}
+	if v := g.Data3 >> 12; v != 5 {
+		t.Errorf("GUID version = %d; want 5", v)
+	}
+}
+
+func TestIsDuplicateTUNName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Tailscale", false},
+		{"Tailscale 2", true},
+		{"Tailscale 12", true},
+		{"Tailscale ", false},
+		{"Tailscale VPN", false},
+		{"Tailscale2", false},
+		{"Other 2", false},
+	}
+	for _, tt := range tests {
+		if got := isDuplicateTUNName(tt.name, "Tailscale"); got != tt.want {
+			t.Errorf("isDuplicateTUNName(%q) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
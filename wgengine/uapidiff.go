@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/types/key"
+)
+
+// writePeerDiffUAPI writes to w the wireguard-go UAPI set operation
+// that takes a device configured with prev to cfg by adding, removing
+// and updating only the peers that differ. Unlike a full Reconfig,
+// which replaces all peers, it leaves other peers' sessions and
+// allowed IPs alone, so they don't drop packets while it's applied.
+//
+// It reports false, having written nothing, if prev and cfg differ
+// in more than their peers; the device must be fully reconfigured.
+func writePeerDiffUAPI(w io.Writer, prev, cfg *wgcfg.Config) bool {
+	if prev.PrivateKey != cfg.PrivateKey || prev.ListenPort != cfg.ListenPort {
+		return false
+	}
+	old := make(map[wgcfg.Key]*wgcfg.Peer, len(prev.Peers))
+	for i := range prev.Peers {
+		old[prev.Peers[i].PublicKey] = &prev.Peers[i]
+	}
+	for i := range cfg.Peers {
+		p := &cfg.Peers[i]
+		op, ok := old[p.PublicKey]
+		delete(old, p.PublicKey)
+		if ok && peersEqual(op, p) {
+			continue
+		}
+		fmt.Fprintf(w, "public_key=%s\n", key.Public(p.PublicKey).HexString())
+		if !ok || endpointsString(op.Endpoints) != endpointsString(p.Endpoints) {
+			fmt.Fprintf(w, "endpoint=%s\n", endpointsString(p.Endpoints))
+		}
+		if !ok || cidrsString(op.AllowedIPs) != cidrsString(p.AllowedIPs) {
+			fmt.Fprintf(w, "replace_allowed_ips=true\n")
+			for _, ip := range p.AllowedIPs {
+				fmt.Fprintf(w, "allowed_ip=%s\n", ip.String())
+			}
+		}
+		// Set the keepalive last, as setting it sends a packet
+		// if the peer is otherwise configured.
+		if !ok || op.PersistentKeepalive != p.PersistentKeepalive {
+			fmt.Fprintf(w, "persistent_keepalive_interval=%d\n", p.PersistentKeepalive)
+		}
+	}
+	for _, p := range old {
+		fmt.Fprintf(w, "public_key=%s\nremove=true\n", key.Public(p.PublicKey).HexString())
+	}
+	return true
+}
+
+func peersEqual(a, b *wgcfg.Peer) bool {
+	return a.PersistentKeepalive == b.PersistentKeepalive &&
+		endpointsString(a.Endpoints) == endpointsString(b.Endpoints) &&
+		cidrsString(a.AllowedIPs) == cidrsString(b.AllowedIPs)
+}
+
+// endpointsString returns eps in the form of the UAPI endpoint key,
+// which magicsock's CreateEndpoint parses.
+func endpointsString(eps []wgcfg.Endpoint) string {
+	ss := make([]string, len(eps))
+	for i, ep := range eps {
+		ss[i] = net.JoinHostPort(ep.Host, strconv.Itoa(int(ep.Port)))
+	}
+	return strings.Join(ss, ",")
+}
+
+func cidrsString(cidrs []wgcfg.CIDR) string {
+	ss := make([]string, len(cidrs))
+	for i, c := range cidrs {
+		ss[i] = c.String()
+	}
+	return strings.Join(ss, ",")
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/types/key"
+)
+
+func TestWritePeerDiffUAPI(t *testing.T) {
+	cidrs := func(ss ...string) []wgcfg.CIDR {
+		var ret []wgcfg.CIDR
+		for _, s := range ss {
+			c, err := wgcfg.ParseCIDR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, c)
+		}
+		return ret
+	}
+	k1, k2, k3 := wgcfg.Key{1}, wgcfg.Key{2}, wgcfg.Key{3}
+	peer := func(k wgcfg.Key, ip string) wgcfg.Peer {
+		return wgcfg.Peer{
+			PublicKey:  k,
+			AllowedIPs: cidrs(ip),
+			Endpoints:  []wgcfg.Endpoint{{Host: "1.2.3.4", Port: 41641}},
+		}
+	}
+	hex := func(k wgcfg.Key) string { return key.Public(k).HexString() }
+
+	prev := &wgcfg.Config{Peers: []wgcfg.Peer{peer(k1, "100.1.1.1/32"), peer(k2, "100.2.2.2/32")}}
+	cfg := &wgcfg.Config{Peers: []wgcfg.Peer{peer(k1, "100.1.1.1/32"), peer(k3, "100.3.3.3/32")}}
+	cfg.Peers[0].PersistentKeepalive = 25
+
+	var buf bytes.Buffer
+	if !writePeerDiffUAPI(&buf, prev, cfg) {
+		t.Fatal("peer-only change: got false")
+	}
+	want := strings.Join([]string{
+		"public_key=" + hex(k1),
+		"persistent_keepalive_interval=25",
+		"public_key=" + hex(k3),
+		"endpoint=1.2.3.4:41641",
+		"replace_allowed_ips=true",
+		"allowed_ip=100.3.3.3/32",
+		"persistent_keepalive_interval=0",
+		"public_key=" + hex(k2),
+		"remove=true",
+	}, "\n") + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.Reset()
+	if !writePeerDiffUAPI(&buf, cfg, cfg) || buf.Len() != 0 {
+		t.Errorf("no change: wrote %q", buf.String())
+	}
+
+	cfg.ListenPort = 1234
+	if writePeerDiffUAPI(&buf, prev, cfg) || buf.Len() != 0 {
+		t.Errorf("listen port change: wrote %q; want full reconfig", buf.String())
+	}
+}
@@ -11,11 +11,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -26,6 +28,7 @@ import (
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"go4.org/mem"
 	"inet.af/netaddr"
+	"tailscale.com/atomicfile"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/internal/deepprint"
 	"tailscale.com/ipn/ipnstate"
@@ -33,7 +36,11 @@ import (
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/opt"
+	"tailscale.com/util/battery"
+	"tailscale.com/util/lsm"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/flowlog"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/packet"
@@ -78,6 +85,9 @@ type userspaceEngine struct {
 	lastEngineSig string
 	lastRouterSig string
 	lastCfg       wgcfg.Config
+	// lastRouterCfg is the router config last applied, to log
+	// what each Reconfig changes.
+	lastRouterCfg router.Config
 
 	mu             sync.Mutex // guards following; see lock order comment below
 	closing        bool       // Close was called (even if we're still closing)
@@ -87,6 +97,28 @@ type userspaceEngine struct {
 	pingers        map[wgcfg.Key]*pinger
 	linkState      *interfaces.State
 
+	netIfaceGen     int      // incremented by each setNetworkInterface call
+	linkMetered     bool     // the OS or app says the current network is metered
+	meteredOverride opt.Bool // if set, overrides linkMetered
+	metered         bool     // last value given to magicsock and meteredCallback
+	meteredCallback func(metered bool)
+
+	flowStop chan struct{} // closed to stop the flow exporter, if running
+	slaStop  chan struct{} // closed to stop the SLA prober, if running
+
+	sla    slaProber
+	netMap atomic.Value // of *controlclient.NetworkMap; the latest from SetNetworkMap
+
+	// netIfaceMu serializes setNetworkInterface's background work.
+	netIfaceMu sync.Mutex
+
+	fwMu     sync.Mutex // guards the following and serializes writing fwExport.path
+	fwExport struct {
+		format, path, reload string
+	}
+	fwReloading   bool // reloadFirewall is running
+	fwReloadAgain bool // reloadFirewall should run the command once more
+
 	// Lock ordering: wgLock, then mu.
 }
 
@@ -110,6 +142,9 @@ type EngineConfig struct {
 	// directed to the designated Taislcale DNS address (see wgengine/tsdns)
 	// will be intercepted and resolved by a tsdns.Resolver.
 	UseTailscaleDNS bool
+	// DiscoTiming optionally overrides the intervals used to
+	// discover and keep alive paths to peers. See magicsock.Timing.
+	DiscoTiming magicsock.Timing
 }
 
 type Loggify struct {
@@ -136,16 +171,27 @@ func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error)
 // NewUserspaceEngine creates the named tun device and returns a
 // Tailscale Engine running on it.
 func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16) (Engine, error) {
+	return NewUserspaceEngineWithRouter(logf, tunname, listenPort, router.New)
+}
+
+// NewUserspaceEngineWithRouter is like NewUserspaceEngine, but uses
+// routerGen to configure the OS's routes and DNS instead of the
+// current platform's router. See router.Lookup.
+func NewUserspaceEngineWithRouter(logf logger.Logf, tunname string, listenPort uint16, routerGen RouterGen) (Engine, error) {
 	if tunname == "" {
 		return nil, fmt.Errorf("--tun name must not be blank")
 	}
 
 	logf("Starting userspace wireguard engine with tun device %q", tunname)
 
-	tun, err := tun.CreateTUN(tunname, minimalMTU)
+	tun, err := createTUN(logf, tunname)
 	if err != nil {
 		diagnoseTUNFailure(logf)
 		logf("CreateTUN: %v", err)
+		if lsm.Check(lsm.OpTUN, err) {
+			d, _ := lsm.Denied(lsm.OpTUN)
+			logf("%v", d)
+		}
 		return nil, err
 	}
 	logf("CreateTUN ok.")
@@ -153,7 +199,7 @@ func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16) (En
 	conf := EngineConfig{
 		Logf:       logf,
 		TUN:        tun,
-		RouterGen:  router.New,
+		RouterGen:  routerGen,
 		ListenPort: listenPort,
 		// TODO(dmytro): plumb this down.
 		UseTailscaleDNS: true,
@@ -192,6 +238,7 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 		e.tundev.PostFilterIn = echoRespondToAll
 	}
 	e.tundev.PreFilterOut = e.handleLocalPackets
+	e.tundev.PreFilterIn = e.sla.handleReply
 
 	mon, err := monitor.New(logf, func() { e.LinkChange(false) })
 	if err != nil {
@@ -212,12 +259,14 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 		Port:          conf.ListenPort,
 		EndpointsFunc: endpointsFn,
 		IdleFunc:      e.tundev.IdleDuration,
+		Timing:        conf.DiscoTiming,
 	}
 	e.magicConn, err = magicsock.NewConn(magicsockOpts)
 	if err != nil {
 		e.tundev.Close()
 		return nil, fmt.Errorf("wgengine: %v", err)
 	}
+	e.setNetworkInterface(false)
 
 	// flags==0 because logf is already nested in another logger.
 	// The outer one can display the preferred log prefixes, etc.
@@ -316,6 +365,7 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 
 	e.resolver.Start()
 	go e.pollResolver()
+	go e.pollBattery()
 
 	return e, nil
 }
@@ -415,6 +465,93 @@ func (e *userspaceEngine) pollResolver() {
 	}
 }
 
+// batteryPollInterval is how often the engine checks whether the
+// machine is running on battery.
+const batteryPollInterval = time.Minute
+
+// pollBattery tells magicsock whenever the machine switches between
+// battery and external power, until the engine is closed.
+func (e *userspaceEngine) pollBattery() {
+	if !battery.Supported() {
+		return
+	}
+	t := time.NewTicker(batteryPollInterval)
+	defer t.Stop()
+	loggedErr := false
+	for {
+		onBattery, err := battery.OnBattery()
+		if err != nil && !loggedErr {
+			e.logf("wgengine: checking for battery power: %v", err)
+			loggedErr = true
+		}
+		if err == nil {
+			e.magicConn.SetOnBattery(onBattery)
+		}
+		select {
+		case <-e.waitCh:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// flowExportInterval is how often flows are sent to the collector set
+// by SetFlowCollector.
+const flowExportInterval = time.Minute
+
+func (e *userspaceEngine) SetFlowCollector(addr string) error {
+	var exp *flowlog.IPFIXExporter
+	if addr != "" {
+		var err error
+		// Observation domain 0: collectors tell nodes apart by
+		// their source address.
+		if exp, err = flowlog.NewIPFIXExporter(addr, 0); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.flowStop != nil {
+		close(e.flowStop)
+		e.flowStop = nil
+	}
+	if exp == nil {
+		e.tundev.SetFlowTracker(nil)
+		return nil
+	}
+	ft := flowlog.NewTracker()
+	e.tundev.SetFlowTracker(ft)
+	e.flowStop = make(chan struct{})
+	go e.exportFlows(ft, exp, e.flowStop)
+	e.logf("wgengine: exporting flows to IPFIX collector %s", addr)
+	return nil
+}
+
+// exportFlows sends the flows ft counted to exp every
+// flowExportInterval, until stop is closed or the engine is.
+func (e *userspaceEngine) exportFlows(ft *flowlog.Tracker, exp *flowlog.IPFIXExporter, stop chan struct{}) {
+	defer exp.Close()
+	t := time.NewTicker(flowExportInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-e.waitCh:
+			return
+		case <-t.C:
+		}
+		flows, dropped := ft.Flush()
+		if dropped > 0 {
+			e.logf("wgengine: too many flows; %d packets not counted", dropped)
+		}
+		if err := exp.Export(flows); err != nil {
+			e.logf("wgengine: exporting flows: %v", err)
+		}
+	}
+}
+
 // pinger sends ping packets for a few seconds.
 //
 // These generated packets are used to ensure we trigger the spray logic in
@@ -570,10 +707,11 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 	if !engineChanged && !routerChanged {
 		return ErrNoChanges
 	}
+	prevCfg := e.lastCfg
 	e.lastCfg = cfg.Copy()
 
 	if engineChanged {
-		e.logf("wgengine: Reconfig: configuring userspace wireguard config")
+		e.logf("wgengine: Reconfig: wireguard: %s", wgConfigDiff(&prevCfg, cfg))
 		// Tell magicsock about the new (or initial) private key
 		// (which is needed by DERP) before wgdev gets it, as wgdev
 		// will start trying to handshake, which we want to be able to
@@ -582,7 +720,7 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 			e.logf("wgengine: Reconfig: SetPrivateKey: %v", err)
 		}
 
-		if err := e.wgdev.Reconfig(cfg); err != nil {
+		if err := e.reconfigDevice(&prevCfg, cfg); err != nil {
 			e.logf("wgdev.Reconfig: %v", err)
 			return err
 		}
@@ -591,7 +729,8 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 	}
 
 	if routerChanged {
-		e.logf("wgengine: Reconfig: configuring router")
+		e.logf("wgengine: Reconfig: router: %s", routerConfigDiff(&e.lastRouterCfg, routerCfg))
+		e.lastRouterCfg = *routerCfg
 		if err := e.router.Set(routerCfg); err != nil {
 			return err
 		}
@@ -601,18 +740,135 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 	return nil
 }
 
+// reconfigDevice changes wgdev's config from prev to cfg, touching
+// only the peers that changed, if possible.
+//
+// e.wgLock must be held.
+func (e *userspaceEngine) reconfigDevice(prev, cfg *wgcfg.Config) error {
+	var buf bytes.Buffer
+	if !writePeerDiffUAPI(&buf, prev, cfg) {
+		return e.wgdev.Reconfig(cfg)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	if err := e.wgdev.IpcSetOperation(bufio.NewReader(&buf)); err != nil {
+		// Start over from a known state.
+		e.logf("wgengine: incremental reconfig failed, doing full reconfig: %v", err)
+		return e.wgdev.Reconfig(cfg)
+	}
+	return nil
+}
+
 func (e *userspaceEngine) GetFilter() *filter.Filter {
 	return e.tundev.GetFilter()
 }
 
 func (e *userspaceEngine) SetFilter(filt *filter.Filter) {
 	e.tundev.SetFilter(filt)
+	e.exportFirewall(filt)
+}
+
+func (e *userspaceEngine) SetFilterAudit(on bool) {
+	e.tundev.SetFilterAudit(on)
+}
+
+func (e *userspaceEngine) SetFirewallExport(format, path, reload string) error {
+	if path != "" {
+		// Check format now, rather than on every filter change.
+		if _, err := filter.NewAllowNone(logger.Discard).FirewallRules(format, ""); err != nil {
+			return err
+		}
+	}
+	e.fwMu.Lock()
+	e.fwExport.format = format
+	e.fwExport.path = path
+	e.fwExport.reload = reload
+	e.fwMu.Unlock()
+
+	if filt := e.GetFilter(); filt != nil {
+		e.exportFirewall(filt)
+	}
+	return nil
+}
+
+// exportFirewall writes the host firewall rules equivalent to filt to
+// the file set by SetFirewallExport, if any, and runs the reload
+// command if they changed.
+func (e *userspaceEngine) exportFirewall(filt *filter.Filter) {
+	e.fwMu.Lock()
+	defer e.fwMu.Unlock()
+	fe := e.fwExport
+	if fe.path == "" || filt == nil {
+		return
+	}
+	iface, err := e.tundev.Name()
+	if err != nil {
+		e.logf("wgengine: firewall export: %v", err)
+		return
+	}
+	rules, err := filt.FirewallRules(fe.format, iface)
+	if err != nil {
+		e.logf("wgengine: firewall export: %v", err)
+		return
+	}
+	if old, err := ioutil.ReadFile(fe.path); err == nil && string(old) == rules {
+		return
+	}
+	if err := atomicfile.WriteFile(fe.path, []byte(rules), 0644); err != nil {
+		e.logf("wgengine: firewall export: %v", err)
+		return
+	}
+	if fe.reload == "" {
+		return
+	}
+	if e.fwReloading {
+		// The running reload may have read the file before
+		// this write; run the command once more after it.
+		e.fwReloadAgain = true
+		return
+	}
+	e.fwReloading = true
+	go e.reloadFirewall(fe.reload)
+}
+
+// fwReloadTimeout is how long the firewall export's reload command
+// may run before it's killed.
+const fwReloadTimeout = 30 * time.Second
+
+// reloadFirewall runs the firewall export's reload command, then runs
+// it again for as long as exportFirewall asked for that meanwhile.
+func (e *userspaceEngine) reloadFirewall(reload string) {
+	for {
+		args := strings.Fields(reload)
+		ctx, cancel := context.WithTimeout(context.Background(), fwReloadTimeout)
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		cancel()
+		if err != nil {
+			e.logf("wgengine: firewall export: %s: %v: %s", reload, err, bytes.TrimSpace(out))
+		}
+
+		e.fwMu.Lock()
+		reload = e.fwExport.reload
+		if !e.fwReloadAgain || reload == "" {
+			e.fwReloading = false
+			e.fwReloadAgain = false
+			e.fwMu.Unlock()
+			return
+		}
+		e.fwReloadAgain = false
+		e.fwMu.Unlock()
+	}
 }
 
 func (e *userspaceEngine) SetDNSMap(dm *tsdns.Map) {
 	e.resolver.SetMap(dm)
 }
 
+func (e *userspaceEngine) SetDNSUpstreams(u tsdns.Upstreams) {
+	e.resolver.SetUpstreams(u)
+}
+
 func (e *userspaceEngine) SetStatusCallback(cb StatusCallback) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -625,6 +881,16 @@ func (e *userspaceEngine) getStatusCallback() StatusCallback {
 	return e.statusCallback
 }
 
+// probeLocks takes and releases the engine's locks, in lock order.
+// It blocks while anything holds them, and otherwise costs next to
+// nothing, which is what the watchdog's heartbeat wants.
+func (e *userspaceEngine) probeLocks() {
+	e.wgLock.Lock()
+	e.mu.Lock()
+	e.mu.Unlock()
+	e.wgLock.Unlock()
+}
+
 // TODO: this function returns an error but it's always nil, and when
 // there's actually a problem it just calls log.Fatal. Why?
 func (e *userspaceEngine) getStatus() (*Status, error) {
@@ -838,6 +1104,7 @@ func (e *userspaceEngine) LinkChange(isExpensive bool) {
 	needRebind := e.setLinkState(cur)
 
 	e.logf("LinkChange(isExpensive=%v); needsRebind=%v", isExpensive, needRebind)
+	e.setNetworkInterface(isExpensive)
 
 	why := "link-change-minor"
 	if needRebind {
@@ -847,6 +1114,98 @@ func (e *userspaceEngine) LinkChange(isExpensive bool) {
 	e.magicConn.ReSTUN(why)
 }
 
+// setNetworkInterface tells magicsock which network interface has
+// the default route, so it can account traffic to it, and works out
+// whether that network is metered. The isExpensive hint from the
+// caller of LinkChange wins over the OS's opinion.
+//
+// Asking the OS can take a while (on Linux it runs nmcli), so it's
+// done in the background; if the link changes again meanwhile, only
+// the newest answer is applied.
+func (e *userspaceEngine) setNetworkInterface(isExpensive bool) {
+	e.mu.Lock()
+	e.netIfaceGen++
+	gen := e.netIfaceGen
+	e.mu.Unlock()
+
+	go func() {
+		e.netIfaceMu.Lock()
+		defer e.netIfaceMu.Unlock()
+		if e.netIfaceStale(gen) {
+			return
+		}
+		name, err := interfaces.DefaultRouteInterface()
+		if err != nil {
+			e.logf("wgengine: default route interface: %v", err)
+		}
+		if !isExpensive {
+			if isExpensive, err = interfaces.IsMetered(name); err != nil {
+				e.logf("wgengine: checking whether %s is metered: %v", name, err)
+			}
+		}
+		if e.netIfaceStale(gen) {
+			return
+		}
+		e.magicConn.SetNetworkInterface(name, isExpensive)
+
+		e.mu.Lock()
+		e.linkMetered = isExpensive
+		e.mu.Unlock()
+		e.updateMetered()
+	}()
+}
+
+// netIfaceStale reports whether a setNetworkInterface call newer
+// than gen has been made, or the engine is closing.
+func (e *userspaceEngine) netIfaceStale(gen int) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.closing || gen != e.netIfaceGen
+}
+
+func (e *userspaceEngine) SetMeteredOverride(v opt.Bool) {
+	e.mu.Lock()
+	e.meteredOverride = v
+	e.mu.Unlock()
+	e.updateMetered()
+}
+
+func (e *userspaceEngine) SetLANPrivacy(noPortMapping, noLANDiscovery bool) {
+	e.magicConn.SetLANPrivacy(noPortMapping, noLANDiscovery)
+}
+
+func (e *userspaceEngine) SetMeteredCallback(cb func(metered bool)) {
+	e.mu.Lock()
+	e.meteredCallback = cb
+	metered := e.metered
+	e.mu.Unlock()
+	if cb != nil {
+		cb(metered)
+	}
+}
+
+// updateMetered applies the current metered state, if it changed.
+func (e *userspaceEngine) updateMetered() {
+	e.mu.Lock()
+	metered := e.linkMetered
+	if v, ok := e.meteredOverride.Get(); ok {
+		metered = v
+	}
+	changed := metered != e.metered
+	e.metered = metered
+	cb := e.meteredCallback
+	e.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	e.logf("wgengine: metered network: %v", metered)
+	e.magicConn.SetMetered(metered)
+	if cb != nil {
+		cb(metered)
+	}
+}
+
 func getLinkState() (*interfaces.State, error) {
 	s, err := interfaces.GetState()
 	if s != nil {
@@ -864,6 +1223,7 @@ func (e *userspaceEngine) SetDERPMap(dm *tailcfg.DERPMap) {
 }
 
 func (e *userspaceEngine) SetNetworkMap(nm *controlclient.NetworkMap) {
+	e.netMap.Store(nm)
 	e.magicConn.SetNetworkMap(nm)
 }
 
@@ -877,6 +1237,28 @@ func (e *userspaceEngine) UpdateStatus(sb *ipnstate.StatusBuilder) {
 		e.logf("wgengine: getStatus: %v", err)
 		return
 	}
+	if name, err := e.tundev.Name(); err == nil {
+		sb.SetTUN(name)
+	}
+	if r, ok := e.router.(router.DNSStatuser); ok {
+		if ds, ok := r.DNSStatus(); ok {
+			applied := ipnstate.DNSConfig{
+				Domains:      ds.Domains,
+				Routes:       ds.Routes,
+				DefaultRoute: ds.DefaultRoute,
+			}
+			for _, ip := range ds.Nameservers {
+				applied.Nameservers = append(applied.Nameservers, ip.String())
+			}
+			sb.SetDNS(ipnstate.DNSStatus{Manager: ds.Manager, Applied: applied})
+		}
+	}
+	if r, ok := e.router.(router.HealthWarner); ok {
+		for _, w := range r.HealthWarnings() {
+			sb.AddWarning(w)
+		}
+	}
+	sb.SetDNSMetrics(dnsMetrics(e.resolver.Metrics()))
 	for _, ps := range st.Peers {
 		sb.AddPeer(key.Public(ps.NodeKey), &ipnstate.PeerStatus{
 			RxBytes:       int64(ps.RxBytes),
@@ -889,6 +1271,31 @@ func (e *userspaceEngine) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	e.magicConn.UpdateStatus(sb)
 }
 
+// dnsMetrics converts m for ipnstate.
+func dnsMetrics(m tsdns.Metrics) ipnstate.DNSMetrics {
+	ret := ipnstate.DNSMetrics{
+		Queries:          m.Queries,
+		Local:            m.Local,
+		CacheHits:        m.CacheHits,
+		Forwarded:        m.Forwarded,
+		UpstreamFailures: m.UpstreamFailures,
+	}
+	for addr, um := range m.Upstreams {
+		u := ipnstate.UpstreamDNSMetrics{
+			Addr:       addr,
+			Queries:    um.Queries,
+			Failures:   um.Failures,
+			MaxLatency: um.MaxLatency,
+		}
+		if n := um.Queries - um.Failures; n > 0 {
+			u.MeanLatency = um.TotalLatency / time.Duration(n)
+		}
+		ret.Upstreams = append(ret.Upstreams, u)
+	}
+	sort.Slice(ret.Upstreams, func(i, j int) bool { return ret.Upstreams[i].Addr < ret.Upstreams[j].Addr })
+	return ret
+}
+
 // diagnoseTUNFailure is called if tun.CreateTUN fails, to poke around
 // the system and log some diagnostic info that might help debug why
 // TUN failed. Because TUN's already failed and things the program's
@@ -897,11 +1304,28 @@ func diagnoseTUNFailure(logf logger.Logf) {
 	switch runtime.GOOS {
 	case "linux":
 		diagnoseLinuxTUNFailure(logf)
+	case "freebsd":
+		diagnoseFreeBSDTUNFailure(logf)
 	default:
 		logf("no TUN failure diagnostics for OS %q", runtime.GOOS)
 	}
 }
 
+func diagnoseFreeBSDTUNFailure(logf logger.Logf) {
+	if _, err := os.Stat("/dev/tun"); err != nil {
+		logf("/dev/tun: %v", err)
+	}
+	jailed, vnet := router.JailStatus()
+	switch {
+	case !jailed:
+		logf("not in a jail; is if_tun loaded? (kldload if_tun)")
+	case !vnet:
+		logf("in a jail without VNET, which can't create interfaces; give the jail vnet in jail.conf, or create the tun device on the host and expose it to the jail")
+	default:
+		logf("in a VNET jail, which only sees tun devices its devfs ruleset unhides; add \"add path 'tun*' unhide\" to the jail's ruleset in /etc/devfs.rules")
+	}
+}
+
 func diagnoseLinuxTUNFailure(logf logger.Logf) {
 	kernel, err := exec.Command("uname", "-r").Output()
 	kernel = bytes.TrimSpace(kernel)
@@ -6,29 +6,53 @@ package wgengine
 
 import (
 	"log"
-	"runtime/pprof"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
+	"tailscale.com/util/goroutines"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/tsdns"
 )
 
 // NewWatchdog wraps an Engine and makes sure that all methods complete
-// within a reasonable amount of time.
+// within a reasonable amount of time. It also checks the engine every
+// so often while nothing calls it, so that a wedged engine is noticed
+// even when idle.
 //
-// If they do not, the watchdog crashes the process.
+// If either takes too long, the watchdog logs all goroutines' stacks
+// and crashes the process, for its service manager to restart it.
 func NewWatchdog(e Engine) Engine {
+	we := newWatchdog(e, true)
+	go we.heartbeat(heartbeatInterval)
+	return we
+}
+
+// NewLoggingWatchdog is like NewWatchdog, but it only logs the stacks,
+// and logs again if the engine recovers, rather than crashing the
+// process.
+func NewLoggingWatchdog(e Engine) Engine {
+	we := newWatchdog(e, false)
+	go we.heartbeat(heartbeatInterval)
+	return we
+}
+
+// heartbeatInterval is how often the watchdog checks on an engine.
+const heartbeatInterval = 15 * time.Second
+
+func newWatchdog(e Engine, restart bool) *watchdogEngine {
 	return &watchdogEngine{
 		wrap:    e,
 		logf:    log.Printf,
 		fatalf:  log.Fatalf,
 		maxWait: 45 * time.Second,
+		restart: restart,
+		closed:  make(chan struct{}),
 	}
 }
 
@@ -37,10 +61,43 @@ type watchdogEngine struct {
 	logf    func(format string, args ...interface{})
 	fatalf  func(format string, args ...interface{})
 	maxWait time.Duration
+	restart bool // crash on a timeout, rather than waiting it out
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// lockProber is implemented by engines with a cheap way to check that
+// their locks aren't stuck.
+type lockProber interface {
+	probeLocks()
+}
+
+// heartbeat checks every interval that the engine's locks can still be
+// taken, until the engine is closed. They're what the engine's main
+// loops block on when it's wedged. Engines without a cheap probe
+// aren't checked, as doing real work every interval would keep an
+// idle device awake.
+func (e *watchdogEngine) heartbeat(interval time.Duration) {
+	p, ok := e.wrap.(lockProber)
+	if !ok {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-e.closed:
+			return
+		case <-t.C:
+			e.watchdog("heartbeat", p.probeLocks)
+		}
+	}
 }
 
 func (e *watchdogEngine) watchdogErr(name string, fn func() error) error {
-	errCh := make(chan error)
+	start := time.Now()
+	errCh := make(chan error, 1)
 	go func() {
 		errCh <- fn()
 	}()
@@ -50,11 +107,15 @@ func (e *watchdogEngine) watchdogErr(name string, fn func() error) error {
 		t.Stop()
 		return err
 	case <-t.C:
-		buf := new(strings.Builder)
-		pprof.Lookup("goroutine").WriteTo(buf, 1)
-		e.logf("wgengine watchdog stacks:\n%s", buf.String())
-		e.fatalf("wgengine: watchdog timeout on %s", name)
-		return nil
+		e.logf("wgengine watchdog stacks:\n%s", goroutines.Stacks(false))
+		if e.restart {
+			e.fatalf("wgengine: watchdog timeout on %s", name)
+			return nil
+		}
+		e.logf("wgengine: watchdog timeout on %s; still waiting", name)
+		err := <-errCh
+		e.logf("wgengine: watchdog: %s returned after %v", name, time.Since(start).Round(time.Second))
+		return err
 	}
 }
 
@@ -76,9 +137,21 @@ func (e *watchdogEngine) GetFilter() *filter.Filter {
 func (e *watchdogEngine) SetFilter(filt *filter.Filter) {
 	e.watchdog("SetFilter", func() { e.wrap.SetFilter(filt) })
 }
+func (e *watchdogEngine) SetFilterAudit(on bool) {
+	e.watchdog("SetFilterAudit", func() { e.wrap.SetFilterAudit(on) })
+}
+func (e *watchdogEngine) SetFirewallExport(format, path, reload string) error {
+	return e.watchdogErr("SetFirewallExport", func() error { return e.wrap.SetFirewallExport(format, path, reload) })
+}
+func (e *watchdogEngine) SetSLAProbes(cfg SLAProbeConfig) {
+	e.watchdog("SetSLAProbes", func() { e.wrap.SetSLAProbes(cfg) })
+}
 func (e *watchdogEngine) SetDNSMap(dm *tsdns.Map) {
 	e.watchdog("SetDNSMap", func() { e.wrap.SetDNSMap(dm) })
 }
+func (e *watchdogEngine) SetDNSUpstreams(u tsdns.Upstreams) {
+	e.watchdog("SetDNSUpstreams", func() { e.wrap.SetDNSUpstreams(u) })
+}
 func (e *watchdogEngine) SetStatusCallback(cb StatusCallback) {
 	e.watchdog("SetStatusCallback", func() { e.wrap.SetStatusCallback(cb) })
 }
@@ -94,6 +167,18 @@ func (e *watchdogEngine) RequestStatus() {
 func (e *watchdogEngine) LinkChange(isExpensive bool) {
 	e.watchdog("LinkChange", func() { e.wrap.LinkChange(isExpensive) })
 }
+func (e *watchdogEngine) SetMeteredOverride(v opt.Bool) {
+	e.watchdog("SetMeteredOverride", func() { e.wrap.SetMeteredOverride(v) })
+}
+func (e *watchdogEngine) SetLANPrivacy(noPortMapping, noLANDiscovery bool) {
+	e.watchdog("SetLANPrivacy", func() { e.wrap.SetLANPrivacy(noPortMapping, noLANDiscovery) })
+}
+func (e *watchdogEngine) SetMeteredCallback(cb func(metered bool)) {
+	e.watchdog("SetMeteredCallback", func() { e.wrap.SetMeteredCallback(cb) })
+}
+func (e *watchdogEngine) SetFlowCollector(addr string) error {
+	return e.watchdogErr("SetFlowCollector", func() error { return e.wrap.SetFlowCollector(addr) })
+}
 func (e *watchdogEngine) SetDERPMap(m *tailcfg.DERPMap) {
 	e.watchdog("SetDERPMap", func() { e.wrap.SetDERPMap(m) })
 }
@@ -105,6 +190,7 @@ func (e *watchdogEngine) DiscoPublicKey() (k tailcfg.DiscoKey) {
 	return k
 }
 func (e *watchdogEngine) Close() {
+	e.closeOnce.Do(func() { close(e.closed) })
 	e.watchdog("Close", e.wrap.Close)
 }
 func (e *watchdogEngine) Wait() {
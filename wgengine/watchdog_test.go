@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"fmt"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -72,4 +73,81 @@ func TestWatchdog(t *testing.T) {
 		wdEngine.fatalf = t.Fatalf
 		wdEngine.Close()
 	})
+
+	t.Run("heartbeat fires on idle blocked engine", func(t *testing.T) {
+		t.Parallel()
+		e, err := NewFakeUserspaceEngine(t.Logf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		usEngine := e.(*userspaceEngine)
+		wdEngine := newWatchdog(e, true)
+		wdEngine.maxWait = 100 * time.Millisecond
+		wdEngine.logf = t.Logf
+		fatalCalled := make(chan string, 1)
+		wdEngine.fatalf = func(format string, args ...interface{}) {
+			select {
+			case fatalCalled <- fmt.Sprintf(format, args...):
+			default:
+			}
+		}
+
+		usEngine.wgLock.Lock() // blocks probeLocks, with no callers
+		go wdEngine.heartbeat(10 * time.Millisecond)
+
+		select {
+		case msg := <-fatalCalled:
+			if !strings.Contains(msg, "heartbeat") {
+				t.Errorf("fatal = %q; want heartbeat timeout", msg)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("heartbeat failed to fire")
+		}
+
+		usEngine.wgLock.Unlock()
+		wdEngine.Close()
+	})
+
+	t.Run("logging watchdog waits out a stall", func(t *testing.T) {
+		t.Parallel()
+		e, err := NewFakeUserspaceEngine(t.Logf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		usEngine := e.(*userspaceEngine)
+		wdEngine := newWatchdog(e, false)
+		wdEngine.maxWait = 100 * time.Millisecond
+		wdEngine.fatalf = t.Fatalf
+		var logMu sync.Mutex
+		logBuf := new(bytes.Buffer)
+		wdEngine.logf = func(format string, args ...interface{}) {
+			logMu.Lock()
+			defer logMu.Unlock()
+			fmt.Fprintf(logBuf, format+"\n", args...)
+		}
+
+		usEngine.wgLock.Lock()
+		done := make(chan struct{})
+		go func() {
+			wdEngine.RequestStatus()
+			close(done)
+		}()
+		time.Sleep(300 * time.Millisecond)
+		usEngine.wgLock.Unlock()
+
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("RequestStatus didn't return after the stall")
+		}
+		logMu.Lock()
+		got := logBuf.String()
+		logMu.Unlock()
+		for _, want := range []string{"goroutine profile: total ", "timeout on RequestStatus; still waiting", "RequestStatus returned after"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("log missing %q; got:\n%s", want, got)
+			}
+		}
+		wdEngine.Close()
+	})
 }
@@ -12,6 +12,7 @@ import (
 	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/tsdns"
@@ -50,6 +51,10 @@ type NetInfoCallback func(*tailcfg.NetInfo)
 // ErrNoChanges is returned by Engine.Reconfig if no changes were made.
 var ErrNoChanges = errors.New("no changes made to Engine config")
 
+// ErrTUNUnsupported is wrapped by the error NewUserspaceEngine returns
+// on platforms where tailscaled can't create tun devices.
+var ErrTUNUnsupported = errors.New("tun devices are not supported")
+
 // Engine is the Tailscale WireGuard engine interface.
 type Engine interface {
 	// Reconfig reconfigures WireGuard and makes sure it's running.
@@ -67,9 +72,29 @@ type Engine interface {
 	// SetFilter updates the packet filter.
 	SetFilter(*filter.Filter)
 
+	// SetFilterAudit sets whether each packet the filter drops is
+	// logged, rate-limited, with the filter rules that explain why.
+	SetFilterAudit(bool)
+
+	// SetFirewallExport arranges for host firewall rules equivalent
+	// to the packet filter, in the given format ("nftables" or "pf"),
+	// to be written to the file path each time the filter changes,
+	// after which the command line reload (if non-empty) is run.
+	// An empty path stops the export.
+	SetFirewallExport(format, path, reload string) error
+
+	// SetSLAProbes starts (or, given no targets, stops) periodic
+	// probes of the latency and loss to other nodes, which are
+	// exported as metrics.
+	SetSLAProbes(SLAProbeConfig)
+
 	// SetDNSMap updates the DNS map.
 	SetDNSMap(*tsdns.Map)
 
+	// SetDNSUpstreams updates the nameservers that the DNS
+	// resolver forwards non-Tailscale queries to.
+	SetDNSUpstreams(tsdns.Upstreams)
+
 	// SetStatusCallback sets the function to call when the
 	// WireGuard status changes.
 	SetStatusCallback(StatusCallback)
@@ -100,6 +125,28 @@ type Engine interface {
 	// action on.
 	LinkChange(isExpensive bool)
 
+	// SetMeteredOverride forces the network to be treated as
+	// metered (or not), regardless of what LinkChange's
+	// isExpensive and the OS say. An unset value removes the
+	// override. While the network is metered, the engine sends
+	// less background traffic.
+	SetMeteredOverride(opt.Bool)
+
+	// SetLANPrivacy sets whether to keep from probing the LAN's
+	// gateway for port mapping services, and from using LAN
+	// addresses to find direct paths to peers on the same network.
+	SetLANPrivacy(noPortMapping, noLANDiscovery bool)
+
+	// SetMeteredCallback sets the function to call when the
+	// network becomes metered or stops being metered. It's also
+	// called right away with the current state.
+	SetMeteredCallback(func(metered bool))
+
+	// SetFlowCollector starts exporting the flows of traffic through
+	// the Tailscale interface, as IPFIX over UDP, to the collector
+	// at addr ("host:port"). An empty addr stops exporting.
+	SetFlowCollector(addr string) error
+
 	// SetDERPMap controls which (if any) DERP servers are used.
 	// If nil, DERP is disabled. It starts disabled until a DERP map
 	// is configured.
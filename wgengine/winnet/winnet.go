@@ -15,6 +15,7 @@ const CLSID_NetworkListManager = "{DCB00C01-570F-4A9B-8D69-199FDBA5723B}"
 
 var IID_INetwork = ole.NewGUID("{8A40A45D-055C-4B62-ABD7-6D613E2CEAEC}")
 var IID_INetworkConnection = ole.NewGUID("{DCB00005-570F-4A9B-8D69-199FDBA5723B}")
+var IID_INetworkCostManager = ole.NewGUID("{DCB00008-570F-4A9B-8D69-199FDBA5723B}")
 
 type NetworkListManager struct {
 	d *ole.Dispatch
@@ -41,6 +42,17 @@ type INetwork struct {
 	ole.IDispatch
 }
 
+type INetworkCostManager struct {
+	ole.IUnknown
+}
+
+type INetworkCostManagerVtbl struct {
+	ole.IUnknownVtbl
+	GetCost                 uintptr
+	GetDataPlanStatus       uintptr
+	SetDestinationAddresses uintptr
+}
+
 func NewNetworkListManager(c *ole.Connection) (*NetworkListManager, error) {
 	err := c.Create(CLSID_NetworkListManager)
 	if err != nil {
@@ -81,6 +93,14 @@ func asIID(u ole.UnknownLike, iid *ole.GUID) (*ole.IDispatch, error) {
 	return d, nil
 }
 
+func (m *NetworkListManager) GetCostManager() (*INetworkCostManager, error) {
+	cm, err := m.d.Object.QueryInterface(IID_INetworkCostManager)
+	if err != nil {
+		return nil, err
+	}
+	return (*INetworkCostManager)(unsafe.Pointer(cm)), nil
+}
+
 func (m *NetworkListManager) GetNetworkConnections() (ConnectionList, error) {
 	ncraw, err := m.d.Call("GetNetworkConnections")
 	if err != nil {
@@ -151,3 +171,7 @@ func (v *INetworkConnection) GetNetwork() (*INetwork, error) {
 	}
 	return (*INetwork)(unsafe.Pointer(n)), nil
 }
+
+func (v *INetworkCostManager) VTable() *INetworkCostManagerVtbl {
+	return (*INetworkCostManagerVtbl)(unsafe.Pointer(v.RawVTable))
+}
@@ -24,3 +24,19 @@ func (v *INetworkConnection) GetAdapterId() (string, error) {
 	}
 	return buf.String(), nil
 }
+
+// GetCost returns the machine's connection cost, a combination of
+// NLM_CONNECTION_COST flags.
+func (v *INetworkCostManager) GetCost() (uint32, error) {
+	var cost uint32
+	hr, _, _ := syscall.Syscall(
+		v.VTable().GetCost,
+		3,
+		uintptr(unsafe.Pointer(v)),
+		uintptr(unsafe.Pointer(&cost)),
+		0)
+	if hr != 0 {
+		return 0, fmt.Errorf("GetCost failed: %08x", hr)
+	}
+	return cost, nil
+}